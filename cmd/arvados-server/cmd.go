@@ -30,6 +30,7 @@ var (
 		"config-check":       config.CheckCommand,
 		"config-defaults":    config.DumpDefaultsCommand,
 		"config-dump":        config.DumpCommand,
+		"config-migrate":     config.MigrateCommand,
 		"controller":         controller.Command,
 		"crunch-run":         crunchrun.Command,
 		"dispatch-cloud":     dispatchcloud.Command,
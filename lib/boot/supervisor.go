@@ -61,6 +61,8 @@ type Supervisor struct {
 	wwwtempdir string
 	configfile string
 	environ    []string // for child processes
+
+	testLoginPassword string // generated by autofillConfig, if any
 }
 
 func (super *Supervisor) Cluster() *arvados.Cluster { return super.cluster }
@@ -203,6 +205,10 @@ func (super *Supervisor) run(cfg *arvados.Config) error {
 	super.logger = ctxlog.New(super.Stderr, super.cluster.SystemLogs.Format, loglevel).WithFields(logrus.Fields{
 		"PID": os.Getpid(),
 	})
+	if super.testLoginPassword != "" {
+		super.logger.WithField("username", "admin").Info("no login provider configured, enabling test login (password is logged at debug level)")
+		super.logger.WithField("username", "admin").WithField("password", super.testLoginPassword).Debug("generated test login password")
+	}
 
 	if super.SourceVersion == "" && super.ClusterType == "production" {
 		// don't need SourceVersion
@@ -617,6 +623,19 @@ func (super *Supervisor) RunProgram(ctx context.Context, dir string, opts runOpt
 	return nil
 }
 
+// loginConfigured returns true if any login provider is enabled in
+// the cluster config.
+func loginConfigured(cluster *arvados.Cluster) bool {
+	login := cluster.Login
+	return login.Google.Enable ||
+		login.OpenIDConnect.Enable ||
+		login.SSO.Enable ||
+		login.PAM.Enable ||
+		login.LDAP.Enable ||
+		login.Test.Enable ||
+		login.LoginCluster != ""
+}
+
 func (super *Supervisor) autofillConfig(cfg *arvados.Config) error {
 	cluster, err := cfg.GetCluster("")
 	if err != nil {
@@ -704,6 +723,17 @@ func (super *Supervisor) autofillConfig(cfg *arvados.Config) error {
 			}
 			cluster.Containers.DispatchPrivateKey = string(buf)
 		}
+		if super.ClusterType == "development" && !loginConfigured(cluster) {
+			// Use the built-in test login provider, so
+			// login flows work without an external
+			// identity provider.
+			password := randomHexString(16)
+			cluster.Login.Test.Enable = true
+			cluster.Login.Test.Users = map[string]arvados.TestUser{
+				"admin": {Email: "admin@example.com", Password: password},
+			}
+			super.testLoginPassword = password
+		}
 		cluster.TLS.Insecure = true
 	}
 	if super.ClusterType == "test" {
@@ -6,11 +6,15 @@ package config
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
@@ -199,3 +203,189 @@ func (defaultsCommand) RunCommand(prog string, args []string, stdin io.Reader, s
 	}
 	return 0
 }
+
+var MigrateCommand migrateCommand
+
+type migrateCommand struct{}
+
+// RunCommand loads the cluster config file along with all legacy
+// per-service config files found on this host, writes the resulting
+// consolidated cluster config to stdout, and writes a report of the
+// legacy files and resulting config changes to stderr.
+func (migrateCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+
+	loader := &Loader{
+		Stdin:  stdin,
+		Logger: ctxlog.New(stderr, "text", "info"),
+	}
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	loader.SetupFlags(flags)
+	clusterID := flags.String("cluster-id", "", "Cluster `ID` to use if the cluster configuration file does not exist yet")
+
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if len(flags.Args()) != 0 || loader.SkipLegacy {
+		flags.Usage()
+		return 2
+	}
+
+	if loader.Path != "-" {
+		if _, err = os.Stat(loader.Path); os.IsNotExist(err) && *clusterID != "" {
+			fmt.Fprintf(stderr, "cluster config file %s does not exist, starting with empty config for cluster %s\n", loader.Path, *clusterID)
+			loader.configdata = []byte("Clusters:\n  " + *clusterID + ": {}\n")
+		} else if err != nil {
+			return 1
+		}
+	}
+
+	found := 0
+	for _, legacy := range []struct {
+		component string
+		path      *string
+	}{
+		{"keepstore", &loader.KeepstorePath},
+		{"keepproxy", &loader.KeepproxyPath},
+		{"keep-web", &loader.KeepWebPath},
+		{"arv-git-httpd", &loader.GitHttpdPath},
+		{"keep-balance", &loader.KeepBalancePath},
+		{"arvados-ws", &loader.WebsocketPath},
+		{"crunch-dispatch-slurm", &loader.CrunchDispatchSlurmPath},
+	} {
+		if *legacy.path == "" {
+			continue
+		} else if _, err := os.Stat(*legacy.path); os.IsNotExist(err) {
+			fmt.Fprintf(stderr, "legacy %s config file %s: not found\n", legacy.component, *legacy.path)
+			// Skip it, so the loader doesn't report an
+			// error for a missing non-default path.
+			*legacy.path = ""
+		} else {
+			fmt.Fprintf(stderr, "legacy %s config file %s: found\n", legacy.component, *legacy.path)
+			found++
+		}
+	}
+	if found == 0 {
+		fmt.Fprintln(stderr, "no legacy config files found, nothing to migrate")
+	}
+
+	// Load the config once without the legacy files, and once
+	// with, so we can report the changes that result from
+	// migrating them. Warnings from the first load would just be
+	// repeated by the second, so we discard them.
+	logger := loader.Logger
+	loader.Logger = ctxlog.New(ioutil.Discard, "text", "info")
+	loader.SkipLegacy = true
+	before, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+	loader.Logger = logger
+	loader.SkipLegacy = false
+	after, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+
+	changes, err := configChanges(before, after)
+	if err != nil {
+		return 1
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(stderr, "no changes")
+	} else {
+		fmt.Fprintf(stderr, "%d changes:\n", len(changes))
+		for _, change := range changes {
+			fmt.Fprintf(stderr, "  %s\n", change)
+		}
+	}
+
+	out, err := yaml.Marshal(after)
+	if err != nil {
+		return 1
+	}
+	_, err = stdout.Write(out)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// configChanges returns a sorted list of human-readable descriptions
+// of the differences between two configs, like
+// "Clusters.zzzzz.Collections.DefaultReplication: 2 => 3".
+func configChanges(before, after *arvados.Config) ([]string, error) {
+	flat := func(cfg *arvados.Config) (map[string]string, error) {
+		buf, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]interface{}
+		err = json.Unmarshal(buf, &m)
+		if err != nil {
+			return nil, err
+		}
+		ret := map[string]string{}
+		flattenConfig(ret, "", m)
+		return ret, nil
+	}
+	old, err := flat(before)
+	if err != nil {
+		return nil, err
+	}
+	new, err := flat(after)
+	if err != nil {
+		return nil, err
+	}
+	// hasChildren returns true if m has an entry for a key
+	// inside k. This lets us avoid reporting an empty map (like
+	// InternalURLs: {}) as removed when an entry is added to it.
+	hasChildren := func(m map[string]string, k string) bool {
+		for mk := range m {
+			if strings.HasPrefix(mk, k+".") {
+				return true
+			}
+		}
+		return false
+	}
+	var changes []string
+	for k, v := range new {
+		if ov, ok := old[k]; !ok {
+			if !hasChildren(old, k) {
+				changes = append(changes, fmt.Sprintf("%s: added %s", k, v))
+			}
+		} else if ov != v {
+			changes = append(changes, fmt.Sprintf("%s: %s => %s", k, ov, v))
+		}
+	}
+	for k, v := range old {
+		if _, ok := new[k]; !ok && !hasChildren(new, k) {
+			changes = append(changes, fmt.Sprintf("%s: removed %s", k, v))
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+func flattenConfig(dst map[string]string, prefix string, v interface{}) {
+	if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+		for k, v := range m {
+			flattenConfig(dst, prefix+k+".", v)
+		}
+		return
+	}
+	buf, _ := json.Marshal(v)
+	dst[strings.TrimSuffix(prefix, ".")] = string(buf)
+}
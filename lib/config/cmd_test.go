@@ -20,6 +20,7 @@ var (
 	// Commands must satisfy cmd.Handler interface
 	_ cmd.Handler = dumpCommand{}
 	_ cmd.Handler = checkCommand{}
+	_ cmd.Handler = migrateCommand{}
 )
 
 type CommandSuite struct{}
@@ -110,6 +111,77 @@ Clusters:
 	c.Check(stderr.String(), check.Matches, `(?ms).*you should remove the legacy keepstore config file.*\n`)
 }
 
+func (s *CommandSuite) TestMigrate(c *check.C) {
+	tmpdir := c.MkDir()
+	err := ioutil.WriteFile(tmpdir+"/keepproxy.yml", []byte("Listen: :12345\nDefaultReplicas: 3\n"), 0644)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/git-httpd.yml", []byte("Listen: :9001\nGitCommand: /usr/local/bin/git\n"), 0644)
+	c.Assert(err, check.IsNil)
+
+	var stdout, stderr bytes.Buffer
+	in := `
+Clusters:
+ z1234:
+  SystemLogs:
+    LogLevel: info
+`
+	code := MigrateCommand.RunCommand("arvados config-migrate", []string{
+		"-config", "-",
+		"-legacy-keepproxy-config", tmpdir + "/keepproxy.yml",
+		"-legacy-git-httpd-config", tmpdir + "/git-httpd.yml",
+		"-legacy-keepstore-config", tmpdir + "/keepstore.yml",
+		"-legacy-keepweb-config", tmpdir + "/keep-web.yml",
+		"-legacy-keepbalance-config", tmpdir + "/keep-balance.yml",
+		"-legacy-ws-config", tmpdir + "/ws.yml",
+		"-legacy-crunch-dispatch-slurm-config", tmpdir + "/crunch-dispatch-slurm.yml",
+	}, bytes.NewBufferString(in), &stdout, &stderr)
+	c.Check(code, check.Equals, 0)
+	c.Log(stderr.String())
+	c.Check(stderr.String(), check.Matches, `(?ms).*legacy keepproxy config file .*/keepproxy.yml: found\n.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*legacy arv-git-httpd config file .*/git-httpd.yml: found\n.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*legacy keepstore config file .*/keepstore.yml: not found\n.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*\n  Clusters.z1234.Collections.DefaultReplication: 2 => 3\n.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*\n4 changes:\n.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*\n  Clusters.z1234.Git.GitCommand: "/usr/bin/git" => "/usr/local/bin/git"\n.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*\n  Clusters.z1234.Services.Keepproxy.InternalURLs.//:12345/: added {}\n.*`)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\n +DefaultReplication: 3\n.*`)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\n +GitCommand: /usr/local/bin/git\n.*`)
+
+	// Cluster config file does not exist yet
+	stdout.Reset()
+	stderr.Reset()
+	code = MigrateCommand.RunCommand("arvados config-migrate", []string{
+		"-config", tmpdir + "/config.yml",
+		"-cluster-id", "z2345",
+		"-legacy-keepproxy-config", tmpdir + "/keepproxy.yml",
+		"-legacy-git-httpd-config", "",
+		"-legacy-keepstore-config", "",
+		"-legacy-keepweb-config", "",
+		"-legacy-keepbalance-config", "",
+		"-legacy-ws-config", "",
+		"-legacy-crunch-dispatch-slurm-config", "",
+	}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr.String(), check.Matches, `(?ms).*does not exist, starting with empty config for cluster z2345\n.*`)
+	c.Check(stdout.String(), check.Matches, `(?ms).*\n  z2345:\n.*\n +DefaultReplication: 3\n.*`)
+
+	// No legacy config files
+	stdout.Reset()
+	stderr.Reset()
+	code = MigrateCommand.RunCommand("arvados config-migrate", []string{
+		"-config", "-",
+		"-legacy-keepproxy-config", tmpdir + "/nonexistent.yml",
+		"-legacy-git-httpd-config", "",
+		"-legacy-keepstore-config", "",
+		"-legacy-keepweb-config", "",
+		"-legacy-keepbalance-config", "",
+		"-legacy-ws-config", "",
+		"-legacy-crunch-dispatch-slurm-config", "",
+	}, bytes.NewBufferString(in), &stdout, &stderr)
+	c.Check(code, check.Equals, 0)
+	c.Check(stderr.String(), check.Matches, `(?ms).*no legacy config files found, nothing to migrate\n.*\nno changes\n`)
+}
+
 func (s *CommandSuite) TestCheck_UnknownKey(c *check.C) {
 	var stdout, stderr bytes.Buffer
 	in := `
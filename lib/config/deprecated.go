@@ -380,18 +380,18 @@ func (ldr *Loader) loadOldKeepproxyConfig(cfg *arvados.Config) error {
 	if oc.ManagementToken != nil {
 		cluster.ManagementToken = *oc.ManagementToken
 	}
+	if oc.DisableGet != nil {
+		cluster.Collections.KeepproxyPermission.Default.Download = !*oc.DisableGet
+	}
+	if oc.DisablePut != nil {
+		cluster.Collections.KeepproxyPermission.Default.Upload = !*oc.DisablePut
+	}
 
 	// The following legacy options are no longer supported. If they are set to
 	// true or PIDFile has a value, error out and notify the user
 	unsupportedEntry := func(cfgEntry string) error {
 		return fmt.Errorf("the keepproxy %s configuration option is no longer supported, please remove it from your configuration file", cfgEntry)
 	}
-	if oc.DisableGet != nil && *oc.DisableGet {
-		return unsupportedEntry("DisableGet")
-	}
-	if oc.DisablePut != nil && *oc.DisablePut {
-		return unsupportedEntry("DisablePut")
-	}
 	if oc.PIDFile != nil && *oc.PIDFile != "" {
 		return unsupportedEntry("PIDFile")
 	}
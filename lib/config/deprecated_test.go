@@ -208,13 +208,20 @@ func (s *LoadSuite) TestLegacyKeepproxyConfig(c *check.C) {
 	c.Check(err, check.IsNil)
 	c.Check(cluster.SystemLogs.LogLevel, check.Equals, "info")
 
+	c.Check(cluster.Collections.KeepproxyPermission.Default.Download, check.Equals, true)
+	c.Check(cluster.Collections.KeepproxyPermission.Default.Upload, check.Equals, true)
+
 	content = []byte(fmtKeepproxyConfig(`"DisableGet": true,`, true))
-	_, err = testLoadLegacyConfig(content, f, c)
-	c.Check(err, check.NotNil)
+	cluster, err = testLoadLegacyConfig(content, f, c)
+	c.Check(err, check.IsNil)
+	c.Check(cluster.Collections.KeepproxyPermission.Default.Download, check.Equals, false)
+	c.Check(cluster.Collections.KeepproxyPermission.Default.Upload, check.Equals, true)
 
 	content = []byte(fmtKeepproxyConfig(`"DisablePut": true,`, true))
-	_, err = testLoadLegacyConfig(content, f, c)
-	c.Check(err, check.NotNil)
+	cluster, err = testLoadLegacyConfig(content, f, c)
+	c.Check(err, check.IsNil)
+	c.Check(cluster.Collections.KeepproxyPermission.Default.Download, check.Equals, true)
+	c.Check(cluster.Collections.KeepproxyPermission.Default.Upload, check.Equals, false)
 
 	content = []byte(fmtKeepproxyConfig(`"PIDFile": "test",`, true))
 	_, err = testLoadLegacyConfig(content, f, c)
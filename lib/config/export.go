@@ -80,12 +80,18 @@ var whitelist = map[string]bool{
 	"AuditLogs.UnloggedAttributes":                        false,
 	"ClusterID":                                           true,
 	"Collections":                                         true,
+	"Collections.BalanceBlackouts":                        false,
+	"Collections.BalancePlacementPolicy":                  false,
 	"Collections.BalanceCollectionBatch":                  false,
 	"Collections.BalanceCollectionBuffers":                false,
+	"Collections.BalanceCommitRetries":                    false,
+	"Collections.BalanceHotData":                          false,
 	"Collections.BalancePeriod":                           false,
 	"Collections.BalanceTimeout":                          false,
+	"Collections.BalanceWindows":                          false,
 	"Collections.BlobDeleteConcurrency":                   false,
 	"Collections.BlobMissingReport":                       false,
+	"Collections.BlobRecoveryReport":                      false,
 	"Collections.BlobReplicateConcurrency":                false,
 	"Collections.BlobSigning":                             true,
 	"Collections.BlobSigningKey":                          false,
@@ -98,30 +104,52 @@ var whitelist = map[string]bool{
 	"Collections.DefaultReplication":                      true,
 	"Collections.DefaultTrashLifetime":                    true,
 	"Collections.ForwardSlashNameSubstitution":            true,
+	"Collections.KeepproxyAdminPassthrough":               false,
+	"Collections.KeepproxyAuditLog":                       false,
+	"Collections.KeepproxyClientCertificates":             false,
+	"Collections.KeepproxyLocalReplicas":                  false,
+	"Collections.KeepproxyLocalityAwareReads":             false,
+	"Collections.KeepproxyPermission":                     false,
+	"Collections.KeepproxyTrafficStats":                   false,
 	"Collections.ManagedProperties":                       true,
 	"Collections.ManagedProperties.*":                     true,
 	"Collections.ManagedProperties.*.*":                   true,
 	"Collections.PreserveVersionIfIdle":                   true,
+	"Collections.S3ChecksumMaxSize":                       false,
 	"Collections.S3FolderObjects":                         true,
+	"Collections.S3Region":                                false,
 	"Collections.TrashSweepInterval":                      false,
 	"Collections.TrustAllContent":                         false,
+	"Collections.WebDAVAccessRules":                       false,
 	"Collections.WebDAVCache":                             false,
+	"Collections.WebDAVCacheControl":                      false,
+	"Collections.WebDAVHedgeDelay":                        false,
+	"Collections.WebDAVLandingPage":                       false,
+	"Collections.WebDAVLocks":                             false,
+	"Collections.WebDAVTracing":                           false,
 	"Containers":                                          true,
 	"Containers.CloudVMs":                                 false,
 	"Containers.CrunchRunArgumentsList":                   false,
 	"Containers.CrunchRunCommand":                         false,
 	"Containers.DefaultKeepCacheRAM":                      true,
 	"Containers.DispatchPrivateKey":                       false,
+	"Containers.DockerAPIRetries":                         false,
+	"Containers.DockerAPIRetryBackoff":                    false,
 	"Containers.JobsAPI":                                  true,
 	"Containers.JobsAPI.Enable":                           true,
 	"Containers.JobsAPI.GitInternalDir":                   false,
+	"Containers.KeepMountEngine":                          false,
 	"Containers.Logging":                                  false,
 	"Containers.LogReuseDecisions":                        false,
 	"Containers.MaxComputeVMs":                            false,
 	"Containers.MaxDispatchAttempts":                      false,
+	"Containers.MaxOutputSize":                            false,
 	"Containers.MaxRetryAttempts":                         true,
 	"Containers.MinRetryPeriod":                           true,
+	"Containers.PostRunHook":                              false,
+	"Containers.PropagateEnvironment":                     false,
 	"Containers.ReserveExtraRAM":                          true,
+	"Containers.RuntimeEngine":                            false,
 	"Containers.ShellAccess":                              true,
 	"Containers.ShellAccess.Admin":                        true,
 	"Containers.ShellAccess.User":                         true,
@@ -135,6 +163,7 @@ var whitelist = map[string]bool{
 	"InstanceTypes":                                       true,
 	"InstanceTypes.*":                                     true,
 	"InstanceTypes.*.*":                                   true,
+	"InstanceTypes.*.*.*":                                 true,
 	"Login":                                               true,
 	"Login.Google":                                        true,
 	"Login.Google.AlternateEmailAddresses":                false,
@@ -165,11 +194,14 @@ var whitelist = map[string]bool{
 	"Login.OpenIDConnect.EmailVerifiedClaim":              false,
 	"Login.OpenIDConnect.Enable":                          true,
 	"Login.OpenIDConnect.Issuer":                          false,
+	"Login.OpenIDConnect.OpaqueAccessTokenProvider":       false,
+	"Login.OpenIDConnect.Providers":                       false,
 	"Login.OpenIDConnect.UsernameClaim":                   false,
 	"Login.PAM":                                           true,
 	"Login.PAM.DefaultEmailDomain":                        false,
 	"Login.PAM.Enable":                                    true,
 	"Login.PAM.Service":                                   false,
+	"Login.RememberMeTokenLifetime":                       true,
 	"Login.RemoteTokenRefresh":                            true,
 	"Login.SSO":                                           true,
 	"Login.SSO.Enable":                                    true,
@@ -179,6 +211,7 @@ var whitelist = map[string]bool{
 	"Login.Test.Enable":                                   true,
 	"Login.Test.Users":                                    false,
 	"Login.TokenLifetime":                                 false,
+	"Login.TokenScopes":                                   false,
 	"Login.TrustedClients":                                false,
 	"Mail":                                                true,
 	"Mail.EmailFrom":                                      false,
@@ -40,8 +40,43 @@ Clusters:
             # the old URL (with trailing slash omitted) to preserve
             # rendezvous ordering.
             Rendezvous: ""
+
+            # Zone is an optional label for the datacenter or site
+            # where this service instance runs. Currently it is
+            # only used by keepproxy (see
+            # Collections.KeepproxyLocalReplicas and
+            # Collections.KeepproxyLocalityAwareReads) and
+            # keep-balance (see Collections.BalancePlacementPolicy).
+            Zone: ""
+
+            # Rack is an optional label for the rack (or other
+            # location within the Zone) where this service instance
+            # runs. Currently it is only used for reading from
+            # nearby keepstore servers first (see
+            # Collections.KeepproxyLocalityAwareReads).
+            #
+            # The Zone and Rack of each Keepstore entry are also
+            # reported to clients in the "properties" of the
+            # corresponding keep_services record, so Go SDK clients
+            # can use them too (see KeepClient.ClientLocality).
+            Rack: ""
+
+            # TLS certificate and key files ("file:///...") to use
+            # for this https URL instead of the ones in the TLS
+            # section, and the minimum TLS version to accept ("1.2"
+            # or "1.3", default "1.2"). Currently these are only
+            # used by keepproxy, e.g., to serve a different
+            # certificate on each of several network interfaces.
+            TLSCertificate: ""
+            TLSKey: ""
+            TLSMinVersion: ""
           SAMPLE:
             Rendezvous: ""
+            Zone: ""
+            Rack: ""
+            TLSCertificate: ""
+            TLSKey: ""
+            TLSMinVersion: ""
         ExternalURL: "-"
 
       RailsAPI:
@@ -65,6 +100,9 @@ Clusters:
       DispatchCloud:
         InternalURLs: {}
         ExternalURL: "-"
+      DispatchSLURM:
+        InternalURLs: {}
+        ExternalURL: "-"
       SSO:
         InternalURLs: {}
         ExternalURL: ""
@@ -434,6 +472,16 @@ Clusters:
       # Updated automically during each successful run.
       BlobMissingReport: ""
 
+      # When running keep-balance, this is the destination filename for
+      # a report of suggested recovery actions for lost blocks: copying
+      # collections from remote clusters that have them (see
+      # RemoteClusters), and untrashing blocks that may still be in
+      # the trash on a keepstore server (if BlobTrashLifetime is
+      # non-zero). The report is a shell script that can be reviewed
+      # and then run by an administrator. Updated atomically during
+      # each successful run.
+      BlobRecoveryReport: ""
+
       # keep-balance operates periodically, i.e.: do a
       # scan/balance operation, sleep, repeat.
       #
@@ -466,6 +514,231 @@ Clusters:
       # long-running balancing operation.
       BalanceTimeout: 6h
 
+      # Number of times keep-balance retries sending a pull or trash
+      # list to a keepstore server after an error, waiting 1s, 2s,
+      # 4s, ... between attempts. Lists are sent to all servers
+      # concurrently, so a slow or unreachable server doesn't delay
+      # the others. If a server's pull list can't be sent, its trash
+      # list is not sent either, but the other servers are not
+      # affected.
+      BalanceCommitRetries: 3
+
+      # If non-empty, keep-balance only starts a scan/balance
+      # operation during one of these time windows. Outside the
+      # windows, it sleeps until the next window opens. Each entry
+      # is a day specification followed by a time range (UTC), e.g.:
+      #
+      #   BalanceWindows:
+      #     - "Mon-Fri 22:00-06:00"
+      #     - "Sat,Sun *"
+      #
+      # The day specification is "*", a day name, a range of day
+      # names, or a comma-separated list of these. The time range
+      # is "*" (all day) or "HH:MM-HH:MM". A range that ends
+      # before it starts continues past midnight into the next day.
+      #
+      # This does not affect the -once flag, or runs started by
+      # SIGUSR1.
+      BalanceWindows: []
+
+      # Time windows during which keep-balance never starts a
+      # scan/balance operation, even if they overlap with
+      # BalanceWindows. Same syntax as BalanceWindows.
+      BalanceBlackouts: []
+
+      # How keep-balance decides which keepstore servers should
+      # store each block's replicas:
+      #
+      # "rendezvous" (default): use rendezvous order, which is also
+      # the order in which clients look for blocks.
+      #
+      # "zone-spread": spread each block's replicas across zones
+      # (see the Zone field of Services.Keepstore.InternalURLs
+      # entries) before placing more than one replica in the same
+      # zone. Within a zone, servers are used in rendezvous order.
+      # This protects against losing a whole rack or site, at the
+      # cost of clients sometimes having to probe more servers to
+      # find a block.
+      #
+      # Changing this setting causes keep-balance to move many
+      # replicas.
+      BalancePlacementPolicy: rendezvous
+
+      # "Hot" data that keep-balance should keep more accessible
+      # than other data, e.g., the inputs of frequently run
+      # workflows. Blocks of hot data are stored with extra
+      # replicas and/or in additional storage classes, and pull
+      # requests for them are sent to keepstore servers ahead of
+      # other pull requests.
+      BalanceHotData:
+        # Each entry is one of:
+        #
+        # - a collection portable data hash or UUID
+        #
+        # - a project UUID: all collections in the project and its
+        #   subprojects
+        #
+        # - a container request UUID: the collections and container
+        #   image mounted by the container request, and by the
+        #   container requests it submits (e.g., the steps of a
+        #   workflow)
+        #
+        # Entries are resolved at the start of each keep-balance
+        # run. Entries that refer to objects that no longer exist
+        # are logged and skipped. Any other error (e.g., the API
+        # server is unavailable) aborts the run, rather than
+        # trashing the extra replicas of the affected collections.
+        Sources: []
+
+        # Number of replicas to store in addition to the
+        # collection's own replication_desired. If StorageClasses
+        # is not empty, this many replicas (at least one) are stored
+        # in each of those classes, and the collection's own storage
+        # classes keep their usual replication.
+        ExtraReplication: 1
+
+        # Additional storage classes (e.g., ones configured on
+        # faster volumes) that should hold replicas of hot data.
+        StorageClasses: []
+
+      # Restrict which clients can read (Download) and write (Upload)
+      # data through keepproxy. This makes it possible to run, for
+      # example, a write-only ingestion proxy or a read-only
+      # distribution proxy. Keepstore and other services are not
+      # affected.
+      KeepproxyPermission:
+        # Permissions for clients that don't match any entry in
+        # ByUUID.
+        Default:
+          Download: true
+          Upload: true
+
+        # Permissions for specific clients, keyed by the UUID of
+        # an API token, a user, or a group. An entry for the
+        # client's token takes precedence over an entry for its
+        # user, which takes precedence over group entries. If the
+        # user can read more than one listed group, an operation
+        # is allowed if any of those groups allows it.
+        #
+        # Example:
+        #   ByUUID:
+        #     zzzzz-j7d0g-ingestiongroup:
+        #       Download: false
+        #       Upload: true
+        ByUUID:
+          SAMPLE:
+            Download: true
+            Upload: true
+
+      # Require clients to present a TLS client certificate signed
+      # by one of the given certificate authorities (mutual TLS)
+      # when reading or writing data through keepproxy. This is in
+      # addition to the usual API token and KeepproxyPermission
+      # checks: an operation is allowed only if the token and the
+      # certificate both allow it. Keepproxy must terminate TLS
+      # itself, i.e., clients must connect to an https URL in
+      # Services.Keepproxy.InternalURLs rather than a proxy
+      # server. Health check and management endpoints do not
+      # require a client certificate.
+      KeepproxyClientCertificates:
+        # Path to a PEM file with the CA certificates that sign
+        # acceptable client certificates. If empty, client
+        # certificates are not required.
+        CACertificates: ""
+
+        # Permissions for clients whose certificate subject doesn't
+        # match any entry in BySubject.
+        Default:
+          Download: true
+          Upload: true
+
+        # Permissions for specific client certificates, keyed by
+        # either the full subject distinguished name (e.g.,
+        # "CN=ingest01,O=Example Org") or the subject common name
+        # (e.g., "ingest01"). A full subject entry takes precedence
+        # over a common name entry.
+        BySubject:
+          SAMPLE:
+            Download: true
+            Upload: true
+
+      # Record each block read (GET/HEAD) or written (PUT/POST)
+      # through keepproxy, with the UUID of the client's token, the
+      # block locator (without permission signature), the number of
+      # bytes transferred, and the result. Records are written to the
+      # keepproxy service's own log in any case; these settings add
+      # structured audit records, e.g., for monitoring data egress at
+      # the cluster boundary.
+      KeepproxyAuditLog:
+        # Append audit records to this file, one JSON object per
+        # line. If empty, don't write an audit log file.
+        File: ""
+
+        # Also add an entry with event_type "keepproxy_access" to
+        # the API server's logs table for each record. This adds an
+        # API request for each block, so it is not recommended for
+        # busy proxies. If the API server falls behind, entries are
+        # dropped (and the number dropped is logged) rather than
+        # delaying data transfers; the File log is always complete.
+        APILogs: false
+
+      # When keepproxy writes a block, write up to this many
+      # replicas to keepstore servers in the same zone as the
+      # keepproxy server, before (if needed) using servers in other
+      # zones. The remaining replicas are placed in rendezvous order
+      # as usual. This reduces write latency in clusters that span
+      # multiple sites, but data is not spread as evenly across
+      # keepstore servers, and keep-balance will move replicas that
+      # are not in their optimal positions.
+      #
+      # Zones are configured with the Zone field of the keepproxy
+      # and keepstore InternalURLs entries. 0 means ignore zones.
+      KeepproxyLocalReplicas: 0
+
+      # When keepproxy reads a block, try keepstore servers in the
+      # same rack as the keepproxy server first, then servers in
+      # the same zone, then servers in other zones, instead of
+      # strictly following rendezvous order. Within each group,
+      # servers are tried in rendezvous order. This improves read
+      # throughput in clusters that span multiple sites, if most
+      # blocks have a replica in each zone (see
+      # BalancePlacementPolicy), at the cost of extra requests for
+      # blocks that don't.
+      #
+      # Zones and racks are configured with the Zone and Rack
+      # fields of the keepproxy and keepstore InternalURLs entries.
+      KeepproxyLocalityAwareReads: false
+
+      # Allow admin users to trash and untrash blocks through
+      # keepproxy, by sending "DELETE /{hash}" and "PUT
+      # /untrash/{hash}" requests, which keepproxy passes through to
+      # all keepstore servers. This lets operators on external
+      # networks perform recovery operations without direct access
+      # to keepstore servers. Requests are rejected unless the
+      # client's token belongs to an admin user. Trashing also
+      # requires Collections.BlobTrash to be enabled on the keepstore
+      # servers.
+      KeepproxyAdminPassthrough: false
+
+      # Keep a histogram of the sizes of blocks read and written
+      # through keepproxy, and the number of bytes transferred by
+      # each client token and IP address, over a rolling window, to
+      # help with capacity planning and abuse detection. The report
+      # is available at "/_traffic" on the keepproxy server, using
+      # ManagementToken.
+      KeepproxyTrafficStats:
+        # Length of the rolling window. 0 disables traffic stats.
+        # Windows shorter than 1m are rounded up to 1m.
+        Window: 1h
+
+        # Number of clients (tokens and addresses) to include in
+        # the report, in order of bytes transferred.
+        TopTalkers: 10
+
+        # If non-zero, also write a summary of the report to the
+        # keepproxy log at this interval.
+        LogInterval: 0s
+
       # Default lifetime for ephemeral collections: 2 weeks. This must not
       # be less than BlobSigningTTL.
       DefaultTrashLifetime: 336h
@@ -508,6 +781,21 @@ Clusters:
       # Include "folder objects" in S3 ListObjects responses.
       S3FolderObjects: true
 
+      # Region name reported to S3 clients in GetBucketLocation
+      # responses and x-amz-bucket-region headers. Some S3 client
+      # libraries (e.g., boto3) check that this matches the region
+      # they use to sign requests. If empty, the cluster ID is used.
+      S3Region: ""
+
+      # Maximum size of a file for which keep-web computes the
+      # checksums requested by S3 clients with the
+      # "x-amz-checksum-mode: ENABLED" header (SHA-256 and CRC32).
+      # Computing a checksum means reading the entire file before
+      # responding, so this should not be too large. Checksums are
+      # cached, so they only need to be computed once for each
+      # version of a file. 0 means never compute checksums.
+      S3ChecksumMaxSize: 1GiB
+
       # Managed collection properties. At creation time, if the client didn't
       # provide the listed keys, they will be automatically populated following
       # one of the following behaviors:
@@ -535,6 +823,22 @@ Clusters:
       # The default setting (false) is appropriate for a multi-user site.
       TrustAllContent: false
 
+      # If non-zero, when keep-web requests a block from a keepstore
+      # server and doesn't get a response within this time, it also
+      # requests the block from the next keepstore server that has
+      # it, and uses whichever response arrives first. This reduces
+      # worst-case latency for interactive reads, at the cost of
+      # extra keepstore load. Example: 500ms
+      WebDAVHedgeDelay: 0s
+
+      # Serve a landing page at the root of the download/attachment
+      # host (Services.WebDAVDownload.ExternalURL), listing the
+      # requesting user's favorite and most recently modified
+      # collections, with links to browse them. If false, the root
+      # is served as a plain listing of the "by_id" and "users"
+      # directories.
+      WebDAVLandingPage: false
+
       # Cache parameters for WebDAV content serving:
       WebDAVCache:
         # Time to cache manifests, permission checks, and sessions.
@@ -561,6 +865,121 @@ Clusters:
         # Persistent sessions.
         MaxSessions: 100
 
+      # Cache-Control headers sent with files served by keep-web.
+      WebDAVCacheControl:
+        # Maximum time browsers and proxies may cache files from
+        # collections that are addressed by portable data hash (or
+        # pinned to a specific collection version). This content
+        # never changes, so responses are also marked "immutable".
+        # Zero means such files are cached like files addressed by
+        # UUID.
+        ImmutableMaxAge: 8760h
+
+        # Maximum time browsers and proxies may cache files from
+        # collections that are addressed by UUID, without
+        # checking whether the collection has changed. Zero means
+        # clients may cache the files, but must revalidate them
+        # (using the ETag) every time they are used.
+        MutableMaxAge: 0s
+
+      # WebDAV class 2 locking (LOCK and UNLOCK requests). Some
+      # clients, notably office applications like Microsoft Word and
+      # LibreOffice, need working locks in order to edit files in
+      # place.
+      #
+      # Locks are held in memory by each keep-web process. If you
+      # run more than one keep-web server behind a load balancer,
+      # locks will only be effective if all requests for a given
+      # collection are routed to the same keep-web process.
+      WebDAVLocks:
+        # Hostnames (as they appear in request URLs) for which
+        # keep-web enforces WebDAV locks. A "*" prefix matches any
+        # hostname with the given suffix, and "*" alone matches all
+        # hostnames. Examples:
+        #
+        # Hosts:
+        #   "*.collections.example.com": {}
+        #   "download.example.com": {}
+        #
+        # On other hostnames, LOCK requests succeed, but do not
+        # prevent other clients from modifying the locked files.
+        Hosts: {}
+
+        # Maximum lock timeout. If a client requests a longer (or
+        # infinite) lock timeout, this timeout is used instead. The
+        # client must refresh the lock before it expires.
+        MaxTimeout: 1h
+
+      # Access rules for keep-web requests, selected by hostname and
+      # URL path prefix (as they appear in request URLs, before
+      # keep-web interprets them). Requests that don't match any
+      # rule are handled as usual. If more than one rule matches,
+      # the one with the longest PathPrefix applies, preferring rules
+      # that list specific Hosts. Example:
+      #
+      # WebDAVAccessRules:
+      #   public:
+      #     Hosts:
+      #       "*.collections.example.com": {}
+      #     PathPrefix: "/public/"
+      #     AllowAnonymous: true
+      #   upload:
+      #     Hosts:
+      #       "*.collections.example.com": {}
+      #     PathPrefix: "/upload/"
+      #     AllowWrite: true
+      #   default:
+      #     Hosts:
+      #       "*.collections.example.com": {}
+      #     PathPrefix: "/"
+      #
+      # With these rules, anonymous clients can read from /public/,
+      # clients with a suitable token can write to /upload/, and
+      # everything else on *.collections.example.com is read-only
+      # and requires a token.
+      #
+      # Rules are applied in addition to the usual Arvados
+      # permission checks; they can only restrict access.
+      WebDAVAccessRules:
+        SAMPLE:
+          # Hostnames this rule applies to. A "*" prefix matches any
+          # hostname with the given suffix. If empty, the rule applies
+          # to all hostnames.
+          Hosts: {}
+
+          # URL path prefix this rule applies to, e.g., "/public/".
+          # The request path is cleaned (so "/public/../private"
+          # is treated as "/private") and the prefix only matches
+          # whole path segments: "/public" matches "/public" and
+          # "/public/foo" but not "/publicity".
+          PathPrefix: "/"
+
+          # Use the anonymous token (Users.AnonymousUserToken) if
+          # the client does not provide a token that can read the
+          # requested collection. If false, clients must provide a
+          # token.
+          AllowAnonymous: false
+
+          # Allow requests that modify data (PUT, DELETE, MKCOL,
+          # MOVE, COPY, etc.). For MOVE and COPY, the rule for the
+          # destination path must also allow writes.
+          AllowWrite: false
+
+      # Request tracing for keep-web. When enabled, keep-web sends
+      # OpenTelemetry spans covering token lookup, collection
+      # fetch, Keep block reads, and response streaming to an OTLP
+      # collector, using the OTLP/HTTP JSON encoding.
+      WebDAVTracing:
+        # URL of the collector's OTLP/HTTP traces endpoint, e.g.,
+        # "http://localhost:4318/v1/traces". If empty, tracing is
+        # disabled.
+        Endpoint: ""
+
+        # Fraction of requests to trace (between 0 and 1). Requests
+        # that arrive with a W3C "traceparent" header are traced
+        # according to the sampling flag in that header instead.
+        SampleRate: 1.0
+
     Login:
       # One of the following mechanisms (SSO, Google, PAM, LDAP, or
       # LoginCluster) should be enabled; see
@@ -642,6 +1061,45 @@ Clusters:
         AuthenticationRequestParameters:
           SAMPLE: ""
 
+        # Additional OpenID Connect providers, keyed by an ID of your
+        # choosing (e.g., "institution"). Each entry accepts the same
+        # settings as above, plus a DisplayName to show users. In
+        # these entries, an empty EmailClaim means "email", but an
+        # empty EmailVerifiedClaim means email addresses are accepted
+        # without checking a "verified" claim.
+        #
+        # If more than one provider is configured -- counting
+        # Login.Google, the provider configured above (if Issuer is
+        # not empty), and the providers listed here -- users are
+        # shown a page where they can choose a provider when logging
+        # in. Clients can skip this step by passing the provider ID or
+        # issuer URL in the "provider" parameter of the login request.
+        #
+        # Providers listed here are used if Login.Google.Enable or
+        # Login.OpenIDConnect.Enable is true.
+        Providers:
+          SAMPLE:
+            DisplayName: ""
+            Issuer: ""
+            ClientID: ""
+            ClientSecret: ""
+            EmailClaim: "email"
+            EmailVerifiedClaim: "email_verified"
+            UsernameClaim: ""
+            AuthenticationRequestParameters:
+              SAMPLE: ""
+
+        # When more than one provider is configured, an OAuth2 access
+        # token presented as an Arvados token is only checked by the
+        # provider that issued it, so it isn't disclosed to the
+        # others. If the token is a JWT, the issuer is taken from its
+        # "iss" claim. Other (opaque) tokens, like the ones Google
+        # issues, don't say where they came from, so they are only
+        # accepted if this is set to the ID of the provider that
+        # should check them: "google", "openidconnect" (the provider
+        # configured with Issuer above), or a key in Providers.
+        OpaqueAccessTokenProvider: ""
+
       PAM:
         # (Experimental) Use PAM to authenticate users.
         Enable: false
@@ -760,8 +1218,24 @@ Clusters:
 
       # How long a client token created from a login flow will be valid without
       # asking the user to re-login. Example values: 60m, 8h.
-      # Default value zero means tokens don't have expiration.
-      TokenLifetime: 0s
+      # Zero means tokens don't have expiration.
+      TokenLifetime: 12h
+
+      # How long a client token created from a login flow will be
+      # valid if the user asks to be remembered ("remember me") when
+      # logging in. Example values: 168h, 720h.
+      # Default value zero disables the "remember me" option. It is
+      # also disabled if TokenLifetime is zero, or if
+      # RememberMeTokenLifetime is not longer than TokenLifetime.
+      RememberMeTokenLifetime: 0s
+
+      # Scopes assigned to client tokens created from a login flow,
+      # e.g., ["GET /arvados/v1/users/current", "GET /arvados/v1/collections"].
+      # See the api_client_authorizations API documentation for the
+      # scope syntax.
+      # Default value (empty list) means tokens are not restricted,
+      # i.e., ["all"].
+      TokenScopes: []
 
       # When the token is returned to a client, the token itself may
       # be restricted from manipulating other tokens based on whether
@@ -792,6 +1266,51 @@ Clusters:
       # {git_repositories_dir}/arvados/.git
       Repositories: /var/lib/arvados/git/repositories
 
+      # Lifetime of the git credentials issued by the git-httpd
+      # credential endpoint (/_credential). Each credential is a
+      # scoped API token that can only be used to access a single
+      # repository, so a git credential helper can avoid exposing a
+      # full API token to git (or to a CI job running git).
+      #
+      # Set to 0 to disable the credential endpoint.
+      CredentialLifetime: 1h
+
+      # Allow clients to read (clone/fetch) repositories without
+      # credentials, using Users.AnonymousUserToken. Only
+      # repositories that are readable by the anonymous user --
+      # i.e., shared with the anonymous group -- can be read this
+      # way. Requests for other repositories, and pushes, still get
+      # a 401 response asking for credentials. Has no effect if
+      # Users.AnonymousUserToken is empty.
+      AnonymousRead: false
+
+      # Cross-origin (CORS) policy for browser-based git clients,
+      # such as code-server and the JupyterLab git extension.
+      CORS:
+        # Web origins allowed to make cross-origin requests to the
+        # git smart HTTP endpoints, e.g.,
+        # "https://ide.example.com". The key "*" matches any
+        # origin that is not listed separately.
+        #
+        # If this is empty, any origin can read and push, but
+        # browsers won't send cookies or cached HTTP credentials
+        # (clients can still send an Authorization header
+        # explicitly, e.g., basic auth with an Arvados token as
+        # the password).
+        Origins:
+          SAMPLE:
+            # Allow requests made with credentials (i.e., the
+            # browser's cached HTTP authentication or cookies).
+            # Not allowed with "*".
+            AllowCredentials: false
+
+            # Allow pushes (git-receive-pack) from this origin.
+            AllowWrite: false
+
+        # How long browsers can cache the result of a CORS
+        # preflight request.
+        MaxAge: 24h
+
     TLS:
       Certificate: ""
       Key: ""
@@ -864,6 +1383,76 @@ Clusters:
       # Example: ["--cgroup-parent-subsystem=memory"]
       CrunchRunArgumentsList: []
 
+      # Program to run on the compute node after each container
+      # finishes and its final state has been recorded, e.g., to
+      # clean up the node or write billing records. The
+      # CRUNCH_CONTAINER_UUID, CRUNCH_CONTAINER_STATE, and
+      # CRUNCH_CONTAINER_EXIT_CODE environment variables are set. Its
+      # output is saved in the container's crunch-run log.
+      #
+      # Example: "/usr/local/bin/arvados-post-run"
+      PostRunHook: ""
+
+      # Environment variables to copy from crunch-run's environment
+      # on the compute node into each container, e.g., proxy
+      # settings or site-specific SLURM variables. A name ending in
+      # "*" matches all variables with that prefix. Variables set
+      # in the container request's "environment" take precedence.
+      # ARVADOS_* variables are never copied (crunch-run sets the
+      # ones containers need).
+      #
+      # Example: ["HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "SLURM_JOB_*"]
+      PropagateEnvironment: []
+
+      # Maximum total size of the files a container can save in its
+      # output directory. If the output is larger than this,
+      # crunch-run stops before uploading any of it, and the
+      # container fails with runtime_status error "Output too
+      # large". Container requests can set a lower limit with the
+      # "max_output_size" scheduling parameter. Files in collections
+      # mounted in (or linked from) the output directory are not
+      # counted, because they are already stored in Keep. Files
+      # written to the output directory are counted even if
+      # crunch-run's -output-arv-mount option is used. 0 means no
+      # limit.
+      #
+      # Example: 1T
+      MaxOutputSize: 0
+
+      # Number of times crunch-run retries a Docker API call (e.g.,
+      # creating or starting the container) that fails with a
+      # transient error, such as a dropped connection or a Docker
+      # daemon restart. Errors reported by Docker itself, such as a
+      # nonexistent command, are not retried. Set to 0 to disable
+      # retries.
+      DockerAPIRetries: 3
+
+      # Time to wait before the first retry of a Docker API
+      # call. This doubles after each attempt.
+      DockerAPIRetryBackoff: 2s
+
+      # Container runtime used by crunch-run: "docker", or "podman"
+      # for hosts where the Docker daemon is not allowed. With
+      # podman, crunch-run talks to the Docker-compatible API
+      # served by "podman system service" on the compute node, at
+      # $XDG_RUNTIME_DIR/podman/podman.sock if crunch-run runs as
+      # an unprivileged user (rootless podman), or
+      # /run/podman/podman.sock if it runs as root. To use a
+      # different socket, add "-podman-socket=/path/to/socket" to
+      # CrunchRunArgumentsList.
+      RuntimeEngine: docker
+
+      # Program used by crunch-run to provide collection mounts:
+      # "arv-mount", or "experimental-go" to use the read-only FUSE
+      # driver built on the Go SDK collection filesystem
+      # ("arvados-client mount"), which starts faster and does not
+      # need Python on the compute nodes. The Go driver is only
+      # used for containers that have no writable collection
+      # mounts; crunch-run falls back to arv-mount for the others.
+      # The Go driver is experimental and should not be used in
+      # production.
+      KeepMountEngine: arv-mount
+
       # Extra RAM to reserve on the node, in addition to
       # the amount specified in the container's RuntimeConstraints
       ReserveExtraRAM: 256MiB
@@ -913,6 +1502,42 @@ Clusters:
         # period.
         LogUpdateSize: 32MiB
 
+        # Send container stdout and stderr to these external log
+        # collectors as well as saving them in Keep. Lines are
+        # forwarded in near real time. If a collector is slow or
+        # unreachable, lines are dropped rather than delaying the
+        # logs in Keep. Supported URL forms:
+        #
+        # syslog://host:port         syslog over UDP
+        # syslog+tcp://host:port     syslog over TCP
+        # fluentd://host:port/tag    fluentd in_http input
+        # fluentd+https://host:port/tag
+        #
+        # Example: ["syslog+tcp://logs.example.com:514"]
+        ForwardURLs: []
+
+        # Fraction of stdout/stderr lines to send to ForwardURLs,
+        # e.g., 0.1 to send every 10th line. Must be greater than 0
+        # and at most 1.
+        ForwardSampleRate: 1
+
+        # Stream container stdout, stderr, and crunch-run log lines
+        # to the websocket server (Services.Websocket) as they are
+        # written, so clients can tail running containers without
+        # waiting for log entries to be saved in the logs table. Only
+        # clients that subscribe with "live_logs":true receive these
+        # events.
+        LiveLogs: false
+
+        # Maximum number of live log lines per second the websocket
+        # server accepts from each container (see LiveLogs). Each
+        # container can send up to one second's worth of lines at
+        # once. Lines over the limit are dropped from the live
+        # stream, but are still saved in the logs table and in Keep
+        # as usual. The limit applies to each arvados-ws process
+        # separately. 0 means no limit.
+        LiveLogsMaxLinesPerSecond: 100
+
       ShellAccess:
         # An admin user can use "arvados-client shell" to start an
         # interactive shell (with any user ID) in any running
@@ -938,6 +1563,92 @@ Clusters:
         SbatchArgumentsList: []
         SbatchEnvironmentVariables:
           SAMPLE: ""
+
+        # Licenses that containers can request using the "licenses"
+        # scheduling parameter, e.g., {"licenses": {"matlab": 2}}.
+        # Each requested license is passed to sbatch as
+        # --licenses=SLURMName:count. SLURMName is the license name
+        # in slurm.conf; if empty, the key is used.
+        #
+        # Containers that request a license not listed here are
+        # cancelled.
+        Licenses:
+          SAMPLE:
+            SLURMName: ""
+
+        # Burst buffers that containers can request using the
+        # "burst_buffers" scheduling parameter, e.g.,
+        # {"burst_buffers": {"scratch": 107374182400}} (size in
+        # bytes). Specification is passed to sbatch as --bb=..., with
+        # "${size}" replaced by the requested size in MiB followed by
+        # "M". Example:
+        #
+        # BurstBuffers:
+        #   scratch:
+        #     Specification: "capacity=${size}"
+        #
+        # Containers that request a burst buffer not listed here are
+        # cancelled.
+        BurstBuffers:
+          SAMPLE:
+            Specification: ""
+
+        # If sbatch fails, the dispatcher keeps the container locked
+        # and tries again after SbatchRetryInitialDelay, doubling the
+        # delay after each failure up to SbatchRetryMaxDelay.
+        SbatchRetryInitialDelay: 10s
+        SbatchRetryMaxDelay: 10m
+
+        # After this many consecutive sbatch failures, the dispatcher
+        # gives up and unlocks the container, which counts as a failed
+        # dispatch attempt (see MaxDispatchAttempts). If the container
+        # has already been locked MaxDispatchAttempts times, it is
+        # cancelled instead, and its runtime_status explains why. Zero
+        # means retry indefinitely (not recommended).
+        SbatchMaxAttempts: 10
+
+        # If not empty, a JSON message is POSTed to this URL when the
+        # dispatcher gives up on submitting a container because of
+        # repeated sbatch failures, e.g., to alert an operator. The
+        # "action" is "unlocked" or "cancelled". Example:
+        #
+        # {"cluster_id": "zzzzz", "container_uuid": "zzzzz-dz642-...",
+        #  "attempts": 10, "error": "...", "action": "unlocked"}
+        SbatchFailureWebhookURL: ""
+
+        # If not empty, crunch-dispatch-slurm saves the state of the
+        # slurm jobs it is tracking (desired priorities, and which
+        # jobs have hit the slurm nice limit) in this file, and
+        # reloads it at startup. This avoids unnecessary scontrol
+        # commands while a restarted dispatcher catches up. The
+        # directory must exist and be writable by the dispatcher.
+        # Example: /var/lib/arvados/crunch-dispatch-slurm/state.json
+        StateFile: ""
+
+        # crunch-run cgroup settings for containers that run in each
+        # SLURM partition, for sites where partitions use different
+        # SLURM cgroup plugin setups. ParentSubsystem is passed to
+        # crunch-run as -cgroup-parent-subsystem (e.g., "cpuset" if
+        # the SLURM task/cgroup plugin constrains cores, so the
+        # container gets the cpuset SLURM allocated to the job), and
+        # Root as -cgroup-root (e.g., "/sys/fs/cgroup"). Empty values
+        # are not passed. Example:
+        #
+        # PartitionCgroups:
+        #   gpu:
+        #     ParentSubsystem: cpuset
+        #     Root: /sys/fs/cgroup
+        #
+        # The batch script selects the settings for the partition the
+        # job is actually running in ($SLURM_JOB_PARTITION).
+        # Containers that run in a partition not listed here get the
+        # crunch-run defaults (or whatever is given in
+        # CrunchRunArgumentsList).
+        PartitionCgroups:
+          SAMPLE:
+            ParentSubsystem: ""
+            Root: ""
+
         Managed:
           # Path to dns server configuration directory
           # (e.g. /etc/unbound.d/conf.d). If false, do not write any config
@@ -1172,6 +1883,17 @@ Clusters:
         AddedScratch: 0
         Price: 0.1
         Preemptible: false
+        # NVIDIA GPUs available on this instance type, if any:
+        # the number of devices, the CUDA driver version installed
+        # on the node (e.g., "11.0"), and the devices' compute
+        # capability (e.g., "7.5"). Containers that request GPUs
+        # (see the "cuda" runtime constraint) only run on instance
+        # types with enough devices and at least the requested
+        # versions.
+        CUDA:
+          DeviceCount: 0
+          DriverVersion: ""
+          HardwareCapability: ""
 
     Volumes:
       SAMPLE:
@@ -12,8 +12,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -288,6 +290,11 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 			checkKeyConflict(fmt.Sprintf("Clusters.%s.PostgreSQL.Connection", id), cc.PostgreSQL.Connection),
 			ldr.checkEmptyKeepstores(cc),
 			ldr.checkUnlistedKeepstores(cc),
+			checkTestLoginUsers(fmt.Sprintf("Clusters.%s.Login.Test.Users", id), cc),
+			ldr.checkServiceURLs(fmt.Sprintf("Clusters.%s.Services", id), cc),
+			ldr.checkBlobSigning(fmt.Sprintf("Clusters.%s", id), cc),
+			checkLogForwarding(fmt.Sprintf("Clusters.%s.Containers.Logging", id), cc),
+			ldr.checkGitCORS(fmt.Sprintf("Clusters.%s.Git.CORS", id), cc),
 		} {
 			if err != nil {
 				return nil, err
@@ -322,6 +329,176 @@ func (ldr *Loader) checkToken(label, token string) error {
 	return nil
 }
 
+// checkTestLoginUsers rejects test login users with an empty
+// password, which would let anyone log in as that user.
+func checkTestLoginUsers(label string, cluster arvados.Cluster) error {
+	if !cluster.Login.Test.Enable {
+		return nil
+	}
+	for username, user := range cluster.Login.Test.Users {
+		if user.Password == "" {
+			return fmt.Errorf("%s.%s: password must not be empty", label, username)
+		}
+	}
+	return nil
+}
+
+// checkServiceURLs rejects service URLs that have no host (like
+// "keep.example.com" or "localhost:9000"), and InternalURLs that use
+// the same host and port as another service's InternalURLs. It warns
+// about ExternalURLs with no scheme, which clients can't use.
+func (ldr *Loader) checkServiceURLs(label string, cluster arvados.Cluster) error {
+	svcs := cluster.Services
+	type internalURL struct {
+		label string
+		url   arvados.URL
+	}
+	seen := map[string]internalURL{}
+	for _, svc := range []struct {
+		name string
+		svc  arvados.Service
+	}{
+		{"Composer", svcs.Composer},
+		{"Controller", svcs.Controller},
+		{"DispatchCloud", svcs.DispatchCloud},
+		{"DispatchSLURM", svcs.DispatchSLURM},
+		{"GitHTTP", svcs.GitHTTP},
+		{"GitSSH", svcs.GitSSH},
+		{"Health", svcs.Health},
+		{"Keepbalance", svcs.Keepbalance},
+		{"Keepproxy", svcs.Keepproxy},
+		{"Keepstore", svcs.Keepstore},
+		{"RailsAPI", svcs.RailsAPI},
+		{"SSO", svcs.SSO},
+		{"WebDAV", svcs.WebDAV},
+		{"WebDAVDownload", svcs.WebDAVDownload},
+		{"WebShell", svcs.WebShell},
+		{"Websocket", svcs.Websocket},
+		{"Workbench1", svcs.Workbench1},
+		{"Workbench2", svcs.Workbench2},
+	} {
+		svclabel := label + "." + svc.name
+		if err := checkURL(svclabel+".ExternalURL", svc.svc.ExternalURL, "https"); err != nil {
+			return err
+		} else if u := svc.svc.ExternalURL; u.Host != "" && u.Scheme == "" {
+			ldr.Logger.Warnf("%s.ExternalURL: %q has no scheme (did you mean \"https:%s\"?)", svclabel, u.String(), u.String())
+		}
+		// Sort InternalURLs so errors are reported
+		// consistently.
+		var urls []arvados.URL
+		for u := range svc.svc.InternalURLs {
+			urls = append(urls, u)
+		}
+		sort.Slice(urls, func(i, j int) bool { return urls[i].String() < urls[j].String() })
+		for _, u := range urls {
+			if err := checkURL(svclabel+".InternalURLs", u, "http"); err != nil {
+				return err
+			}
+			hp := strings.ToLower(urlHostPort(u))
+			if strings.HasSuffix(hp, ":0") {
+				// Port will be chosen at runtime
+				// (e.g., by arvados-server boot).
+				continue
+			}
+			if prev, ok := seen[hp]; ok {
+				if prev.label == svclabel {
+					return fmt.Errorf("%s: %q and %q use the same host and port", svclabel+".InternalURLs", prev.url.String(), u.String())
+				}
+				if prev.label == label+".WebDAV" && svclabel == label+".WebDAVDownload" {
+					// Both are served by keep-web.
+					continue
+				}
+				return fmt.Errorf("%s: %q uses the same host and port as %s %q (each service needs its own port)", svclabel+".InternalURLs", u.String(), prev.label+".InternalURLs", prev.url.String())
+			}
+			seen[hp] = internalURL{label: svclabel, url: u}
+		}
+	}
+	return nil
+}
+
+// checkURL returns an error if u is not empty (or "-") and has no
+// host, like "keep.example.com" or "localhost:9000", suggesting a fix
+// that uses defaultScheme.
+func checkURL(label string, u arvados.URL, defaultScheme string) error {
+	str := u.String()
+	if str == "" || str == "-" || (u.Host != "" && u.Opaque == "") {
+		return nil
+	}
+	if u.Opaque != "" {
+		// "localhost:9000" parses as scheme "localhost",
+		// opaque "9000".
+		str = u.Scheme + ":" + u.Opaque
+	}
+	return fmt.Errorf("%s: %q is not a URL with a scheme and host (did you mean \"%s://%s\"?)", label, u.String(), defaultScheme, strings.TrimPrefix(str, "//"))
+}
+
+// urlHostPort returns u's host and port, using the default port for
+// u's scheme if u has no explicit port.
+func urlHostPort(u arvados.URL) string {
+	if (*url.URL)(&u).Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		return u.Host + ":443"
+	case "ssh":
+		return u.Host + ":22"
+	default:
+		return u.Host + ":80"
+	}
+}
+
+// checkBlobSigning checks for Collections.BlobSigning settings that
+// would prevent keepstore (and therefore keep-web, keepproxy, and
+// all other clients) from issuing or verifying signed locators.
+func (ldr *Loader) checkBlobSigning(label string, cluster arvados.Cluster) error {
+	coll := cluster.Collections
+	if !coll.BlobSigning {
+		return nil
+	}
+	if coll.BlobSigningKey == "" && len(cluster.Services.Keepstore.InternalURLs) > 0 {
+		ldr.Logger.Warnf("%s.Collections.BlobSigningKey: must be set when Collections.BlobSigning is true, otherwise keepstore cannot verify signed locators and Keep reads and writes (including keep-web and S3 uploads) will fail", label)
+	}
+	if coll.BlobSigningTTL <= 0 {
+		return fmt.Errorf("%s.Collections.BlobSigningTTL: must be greater than zero when Collections.BlobSigning is true (signatures would expire immediately)", label)
+	}
+	return nil
+}
+
+func checkLogForwarding(label string, cluster arvados.Cluster) error {
+	logging := cluster.Containers.Logging
+	if len(logging.ForwardURLs) == 0 {
+		return nil
+	}
+	if logging.ForwardSampleRate <= 0 || logging.ForwardSampleRate > 1 {
+		return fmt.Errorf("%s.ForwardSampleRate: must be greater than 0 and at most 1", label)
+	}
+	for _, u := range logging.ForwardURLs {
+		if pu, err := url.Parse(u); err != nil || pu.Host == "" {
+			return fmt.Errorf("%s.ForwardURLs: %q is not a URL with a scheme and host (e.g., \"syslog://logs.example.com:514\")", label, u)
+		}
+	}
+	return nil
+}
+
+func (ldr *Loader) checkGitCORS(label string, cluster arvados.Cluster) error {
+	for origin, policy := range cluster.Git.CORS.Origins {
+		if origin == "SAMPLE" {
+			continue
+		}
+		if origin == "*" {
+			if policy.AllowCredentials {
+				return fmt.Errorf("%s.Origins: AllowCredentials cannot be used with \"*\"", label)
+			}
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			ldr.Logger.Warnf("%s.Origins: %q is not \"*\" or an origin like \"https://ide.example.com\", so it will never match a request", label, origin)
+		}
+	}
+	return nil
+}
+
 func checkKeyConflict(label string, m map[string]string) error {
 	saw := map[string]bool{}
 	for k := range m {
@@ -330,6 +330,168 @@ Clusters:
 	c.Check(err, check.ErrorMatches, `Clusters.zzzzz.PostgreSQL.Connection: multiple entries for "(dbname|host)".*`)
 }
 
+func (s *LoadSuite) TestTestLoginEmptyPassword(c *check.C) {
+	_, err := testLoader(c, `
+Clusters:
+ zzzzz:
+  Login:
+   Test:
+    Enable: true
+    Users:
+     alice:
+      Email: alice@example.com
+      Password: ""
+`, nil).Load()
+	c.Check(err, check.ErrorMatches, `Clusters.zzzzz.Login.Test.Users.alice: password must not be empty`)
+
+	// Disabled test login users are not checked.
+	_, err = testLoader(c, `
+Clusters:
+ zzzzz:
+  Login:
+   Test:
+    Enable: false
+    Users:
+     alice:
+      Email: alice@example.com
+`, nil).Load()
+	c.Check(err, check.IsNil)
+}
+
+func (s *LoadSuite) TestServiceURLs(c *check.C) {
+	for _, trial := range []struct {
+		services string
+		err      string
+	}{
+		{`{Controller: {ExternalURL: "zzzzz.example.com"}}`,
+			`Clusters.zzzzz.Services.Controller.ExternalURL: "zzzzz.example.com" is not a URL with a scheme and host \(did you mean "https://zzzzz.example.com"\?\)`},
+		{`{Keepstore: {InternalURLs: {"localhost:25107": {}}}}`,
+			`Clusters.zzzzz.Services.Keepstore.InternalURLs: "localhost:25107" is not a URL with a scheme and host \(did you mean "http://localhost:25107"\?\)`},
+		{`{Keepproxy: {InternalURLs: {"http://localhost:25107": {}}}, Keepstore: {InternalURLs: {"http://localhost:25107/": {}}}}`,
+			`Clusters.zzzzz.Services.Keepstore.InternalURLs: "http://localhost:25107/" uses the same host and port as Clusters.zzzzz.Services.Keepproxy.InternalURLs "http://localhost:25107/".*`},
+		{`{Controller: {InternalURLs: {"http://localhost": {}}}, RailsAPI: {InternalURLs: {"http://localhost:80": {}}}}`,
+			`Clusters.zzzzz.Services.RailsAPI.InternalURLs: "http://localhost:80/" uses the same host and port as Clusters.zzzzz.Services.Controller.InternalURLs "http://localhost/".*`},
+		{`{Keepstore: {InternalURLs: {"http://keep0:25107": {}, "https://keep0:25107": {}}}}`,
+			`Clusters.zzzzz.Services.Keepstore.InternalURLs: "http://keep0:25107/" and "https://keep0:25107/" use the same host and port`},
+		// keep-web serves both WebDAV and WebDAVDownload
+		{`{WebDAV: {InternalURLs: {"http://localhost:9002": {}}}, WebDAVDownload: {InternalURLs: {"http://localhost:9002": {}}}}`, ``},
+		// ports chosen at runtime
+		{`{Controller: {InternalURLs: {"http://localhost:0": {}}}, RailsAPI: {InternalURLs: {"http://localhost:0": {}}}}`, ``},
+		{`{Controller: {ExternalURL: "-"}, Keepbalance: {InternalURLs: {"//:9005": {}}}}`, ``},
+	} {
+		c.Logf("trial: %s", trial.services)
+		_, err := testLoader(c, "Clusters: {zzzzz: {Services: "+trial.services+"}}", nil).Load()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+
+	var logbuf bytes.Buffer
+	_, err := testLoader(c, `Clusters: {zzzzz: {Services: {WebDAVDownload: {ExternalURL: "//download.zzzzz.example.com"}}}}`, &logbuf).Load()
+	c.Check(err, check.IsNil)
+	c.Check(logbuf.String(), check.Matches, `(?ms).*Clusters.zzzzz.Services.WebDAVDownload.ExternalURL: \\"//download.zzzzz.example.com/\\" has no scheme.*`)
+}
+
+func (s *LoadSuite) TestBlobSigningChecks(c *check.C) {
+	_, err := testLoader(c, `
+Clusters:
+ zzzzz:
+  Collections:
+   BlobSigningTTL: 0s
+`, nil).Load()
+	c.Check(err, check.ErrorMatches, `Clusters.zzzzz.Collections.BlobSigningTTL: must be greater than zero when Collections.BlobSigning is true.*`)
+
+	var logbuf bytes.Buffer
+	_, err = testLoader(c, `
+Clusters:
+ zzzzz:
+  Services:
+   Keepstore:
+    InternalURLs:
+     "http://keep0.zzzzz.example:25107": {}
+`, &logbuf).Load()
+	c.Check(err, check.IsNil)
+	c.Check(logbuf.String(), check.Matches, `(?ms).*Clusters.zzzzz.Collections.BlobSigningKey: must be set when Collections.BlobSigning is true.*`)
+
+	logbuf.Reset()
+	_, err = testLoader(c, `
+Clusters:
+ zzzzz:
+  Collections:
+   BlobSigning: false
+   BlobSigningTTL: 0s
+  Services:
+   Keepstore:
+    InternalURLs:
+     "http://keep0.zzzzz.example:25107": {}
+`, &logbuf).Load()
+	c.Check(err, check.IsNil)
+	c.Check(logbuf.String(), check.Not(check.Matches), `(?ms).*BlobSigningKey: must be set.*`)
+}
+
+func (s *LoadSuite) TestLogForwardingChecks(c *check.C) {
+	for _, trial := range []struct {
+		urls string
+		rate string
+		err  string
+	}{
+		{`[]`, `0`, ``},
+		{`["syslog+tcp://logs.zzzzz.example:514"]`, `0.5`, ``},
+		{`["syslog+tcp://logs.zzzzz.example:514"]`, `0`, `Clusters.zzzzz.Containers.Logging.ForwardSampleRate: must be greater than 0 and at most 1`},
+		{`["syslog+tcp://logs.zzzzz.example:514"]`, `2`, `Clusters.zzzzz.Containers.Logging.ForwardSampleRate: .*`},
+		{`["logs.zzzzz.example:514"]`, `1`, `Clusters.zzzzz.Containers.Logging.ForwardURLs: "logs.zzzzz.example:514" is not a URL .*`},
+	} {
+		_, err := testLoader(c, `
+Clusters:
+ zzzzz:
+  Containers:
+   Logging:
+    ForwardURLs: `+trial.urls+`
+    ForwardSampleRate: `+trial.rate+`
+`, nil).Load()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+}
+
+func (s *LoadSuite) TestGitCORSChecks(c *check.C) {
+	for _, trial := range []struct {
+		origins string
+		err     string
+		warn    string
+	}{
+		{`{}`, ``, ``},
+		{`{"*": {AllowWrite: true}, "https://ide.zzzzz.example": {AllowCredentials: true}}`, ``, ``},
+		{`{"*": {AllowCredentials: true}}`, `Clusters.zzzzz.Git.CORS.Origins: AllowCredentials cannot be used with "\*"`, ``},
+		{`{"ide.zzzzz.example": {}}`, ``, `Clusters.zzzzz.Git.CORS.Origins: \\"ide.zzzzz.example\\" is not .*`},
+		{`{"https://ide.zzzzz.example/lab": {}}`, ``, `Clusters.zzzzz.Git.CORS.Origins: \\"https://ide.zzzzz.example/lab\\" is not .*`},
+	} {
+		var logbuf bytes.Buffer
+		_, err := testLoader(c, `
+Clusters:
+ zzzzz:
+  Git:
+   CORS:
+    Origins: `+trial.origins+`
+`, &logbuf).Load()
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+		if trial.warn == "" {
+			c.Check(logbuf.String(), check.Not(check.Matches), `(?ms).*Git\.CORS.*`)
+		} else {
+			c.Check(logbuf.String(), check.Matches, `(?ms).*`+trial.warn+`\n.*`)
+		}
+	}
+}
+
 func (s *LoadSuite) TestBadClusterIDs(c *check.C) {
 	for _, data := range []string{`
 Clusters:
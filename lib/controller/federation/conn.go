@@ -207,6 +207,9 @@ func (conn *Conn) Login(ctx context.Context, options arvados.LoginOptions) (arva
 		if options.Remote != "" {
 			params.Set("remote", options.Remote)
 		}
+		if options.RememberMe {
+			params.Set("remember_me", "true")
+		}
 		target.RawQuery = params.Encode()
 		return arvados.LoginResponse{
 			RedirectLocation: target.String(),
@@ -340,6 +343,10 @@ func (conn *Conn) ContainerSSH(ctx context.Context, options arvados.ContainerSSH
 	return conn.chooseBackend(options.UUID).ContainerSSH(ctx, options)
 }
 
+func (conn *Conn) ContainerSnapshotOutput(ctx context.Context, options arvados.GetOptions) (arvados.Collection, error) {
+	return conn.chooseBackend(options.UUID).ContainerSnapshotOutput(ctx, options)
+}
+
 func (conn *Conn) ContainerRequestList(ctx context.Context, options arvados.ListOptions) (arvados.ContainerRequestList, error) {
 	return conn.generated_ContainerRequestList(ctx, options)
 }
@@ -625,6 +632,18 @@ func (conn *Conn) APIClientAuthorizationCurrent(ctx context.Context, options arv
 	return conn.chooseBackend(options.UUID).APIClientAuthorizationCurrent(ctx, options)
 }
 
+func (conn *Conn) S3AccessKeyCreate(ctx context.Context, options arvados.CreateOptions) (arvados.S3AccessKey, error) {
+	return conn.local.S3AccessKeyCreate(ctx, options)
+}
+
+func (conn *Conn) S3AccessKeyList(ctx context.Context, options arvados.ListOptions) (arvados.S3AccessKeyList, error) {
+	return conn.local.S3AccessKeyList(ctx, options)
+}
+
+func (conn *Conn) S3AccessKeyDelete(ctx context.Context, options arvados.DeleteOptions) (arvados.S3AccessKey, error) {
+	return conn.chooseBackend(options.UUID).S3AccessKeyDelete(ctx, options)
+}
+
 type backend interface {
 	arvados.API
 	BaseURL() url.URL
@@ -95,6 +95,8 @@ func (h *Handler) setup() {
 	rtr := router.New(federation.New(h.Cluster), api.ComposeWrappers(ctrlctx.WrapCallsInTransactions(h.db), oidcAuthorizer.WrapCalls))
 	mux.Handle("/arvados/v1/config", rtr)
 	mux.Handle("/"+arvados.EndpointUserAuthenticate.Path, rtr)
+	mux.Handle("/arvados/v1/s3_access_keys", rtr)
+	mux.Handle("/arvados/v1/s3_access_keys/", rtr)
 
 	if !h.Cluster.ForceLegacyAPI14 {
 		mux.Handle("/arvados/v1/collections", rtr)
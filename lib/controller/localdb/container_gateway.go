@@ -6,13 +6,18 @@ package localdb
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -44,79 +49,17 @@ func (conn *Conn) ContainerSSH(ctx context.Context, opts arvados.ContainerSSHOpt
 			err = httpserver.ErrorWithStatus(errors.New("shell access is disabled in config"), http.StatusServiceUnavailable)
 			return
 		}
-		var crs arvados.ContainerRequestList
-		crs, err = conn.railsProxy.ContainerRequestList(ctxRoot, arvados.ListOptions{Limit: -1, Filters: []arvados.Filter{{"container_uuid", "=", opts.UUID}}})
+		err = conn.checkContainerRequestsOwner(ctxRoot, user, opts.UUID)
 		if err != nil {
 			return
 		}
-		for _, cr := range crs.Items {
-			if cr.ModifiedByUserUUID != user.UUID {
-				err = httpserver.ErrorWithStatus(errors.New("permission denied: container is associated with requests submitted by other users"), http.StatusForbidden)
-				return
-			}
-		}
-		if crs.ItemsAvailable != len(crs.Items) {
-			err = httpserver.ErrorWithStatus(errors.New("incomplete response while checking permission"), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	switch ctr.State {
-	case arvados.ContainerStateQueued, arvados.ContainerStateLocked:
-		err = httpserver.ErrorWithStatus(fmt.Errorf("container is not running yet (state is %q)", ctr.State), http.StatusServiceUnavailable)
-		return
-	case arvados.ContainerStateRunning:
-		if ctr.GatewayAddress == "" {
-			err = httpserver.ErrorWithStatus(errors.New("container is running but gateway is not available -- installation problem or feature not supported"), http.StatusServiceUnavailable)
-			return
-		}
-	default:
-		err = httpserver.ErrorWithStatus(fmt.Errorf("container has ended (state is %q)", ctr.State), http.StatusGone)
-		return
 	}
-	// crunch-run uses a self-signed / unverifiable TLS
-	// certificate, so we use the following scheme to ensure we're
-	// not talking to a MITM.
-	//
-	// 1. Compute ctrKey = HMAC-SHA256(sysRootToken,ctrUUID) --
-	// this will be the same ctrKey that a-d-c supplied to
-	// crunch-run in the GatewayAuthSecret env var.
-	//
-	// 2. Compute requestAuth = HMAC-SHA256(ctrKey,serverCert) and
-	// send it to crunch-run as the X-Arvados-Authorization
-	// header, proving that we know ctrKey. (Note a MITM cannot
-	// replay the proof to a real crunch-run server, because the
-	// real crunch-run server would have a different cert.)
-	//
-	// 3. Compute respondAuth = HMAC-SHA256(ctrKey,requestAuth)
-	// and ensure the server returns it in the
-	// X-Arvados-Authorization-Response header, proving that the
-	// server knows ctrKey.
-	var requestAuth, respondAuth string
-	netconn, err := tls.Dial("tcp", ctr.GatewayAddress, &tls.Config{
-		InsecureSkipVerify: true,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			if len(rawCerts) == 0 {
-				return errors.New("no certificate received, cannot compute authorization header")
-			}
-			h := hmac.New(sha256.New, []byte(conn.cluster.SystemRootToken))
-			fmt.Fprint(h, opts.UUID)
-			authKey := fmt.Sprintf("%x", h.Sum(nil))
-			h = hmac.New(sha256.New, []byte(authKey))
-			h.Write(rawCerts[0])
-			requestAuth = fmt.Sprintf("%x", h.Sum(nil))
-			h.Reset()
-			h.Write([]byte(requestAuth))
-			respondAuth = fmt.Sprintf("%x", h.Sum(nil))
-			return nil
-		},
-	})
+	err = checkGatewayAvailable(ctr)
 	if err != nil {
-		err = httpserver.ErrorWithStatus(err, http.StatusBadGateway)
 		return
 	}
-	if respondAuth == "" {
-		err = httpserver.ErrorWithStatus(errors.New("BUG: no respondAuth"), http.StatusInternalServerError)
+	netconn, requestAuth, respondAuth, err := conn.dialContainerGateway(ctr)
+	if err != nil {
 		return
 	}
 	bufr := bufio.NewReader(netconn)
@@ -172,3 +115,168 @@ func (conn *Conn) ContainerSSH(ctx context.Context, opts arvados.ContainerSSHOpt
 	sshconn.Logger = ctxlog.FromContext(ctx)
 	return
 }
+
+// ContainerSnapshotOutput asks the crunch-run process for the
+// specified container to save a snapshot of the container's output
+// directory, and returns the snapshot collection.
+//
+// The caller must be an admin, or the user who submitted the
+// container's requests.
+func (conn *Conn) ContainerSnapshotOutput(ctx context.Context, opts arvados.GetOptions) (coll arvados.Collection, err error) {
+	user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return
+	}
+	ctr, err := conn.railsProxy.ContainerGet(ctx, arvados.GetOptions{UUID: opts.UUID})
+	if err != nil {
+		return
+	}
+	if !user.IsAdmin {
+		ctxRoot := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{conn.cluster.SystemRootToken}})
+		err = conn.checkContainerRequestsOwner(ctxRoot, user, opts.UUID)
+		if err != nil {
+			return
+		}
+	}
+	err = checkGatewayAvailable(ctr)
+	if err != nil {
+		return
+	}
+	netconn, requestAuth, respondAuth, err := conn.dialContainerGateway(ctr)
+	if err != nil {
+		return
+	}
+	defer netconn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblock the request if ctx is cancelled.
+		select {
+		case <-ctx.Done():
+			netconn.Close()
+		case <-done:
+		}
+	}()
+
+	req, err := http.NewRequest("POST", "http://"+ctr.GatewayAddress+"/snapshot", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Arvados-Target-Uuid", opts.UUID)
+	req.Header.Set("X-Arvados-Authorization", requestAuth)
+	err = req.Write(netconn)
+	if err != nil {
+		err = httpserver.ErrorWithStatus(fmt.Errorf("error sending request to gateway: %w", err), http.StatusBadGateway)
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(netconn), req)
+	if err != nil {
+		err = httpserver.ErrorWithStatus(fmt.Errorf("error reading http response from gateway: %w", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Arvados-Authorization-Response") != respondAuth {
+		err = httpserver.ErrorWithStatus(errors.New("bad X-Arvados-Authorization-Response header"), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1000))
+		err = httpserver.ErrorWithStatus(fmt.Errorf("gateway error: %s: %s", resp.Status, bytes.TrimSpace(body)), http.StatusBadGateway)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&coll)
+	if err != nil {
+		err = httpserver.ErrorWithStatus(fmt.Errorf("error decoding gateway response: %w", err), http.StatusBadGateway)
+	}
+	return
+}
+
+// checkContainerRequestsOwner returns an error unless all of the
+// container requests associated with the given container were
+// submitted by user. ctx must have a token that can read all
+// container requests.
+func (conn *Conn) checkContainerRequestsOwner(ctx context.Context, user arvados.User, uuid string) error {
+	crs, err := conn.railsProxy.ContainerRequestList(ctx, arvados.ListOptions{Limit: -1, Filters: []arvados.Filter{{Attr: "container_uuid", Operator: "=", Operand: uuid}}})
+	if err != nil {
+		return err
+	}
+	for _, cr := range crs.Items {
+		if cr.ModifiedByUserUUID != user.UUID {
+			return httpserver.ErrorWithStatus(errors.New("permission denied: container is associated with requests submitted by other users"), http.StatusForbidden)
+		}
+	}
+	if crs.ItemsAvailable != len(crs.Items) {
+		return httpserver.ErrorWithStatus(errors.New("incomplete response while checking permission"), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// checkGatewayAvailable returns an error unless ctr is running and
+// has a gateway address.
+func checkGatewayAvailable(ctr arvados.Container) error {
+	switch ctr.State {
+	case arvados.ContainerStateQueued, arvados.ContainerStateLocked:
+		return httpserver.ErrorWithStatus(fmt.Errorf("container is not running yet (state is %q)", ctr.State), http.StatusServiceUnavailable)
+	case arvados.ContainerStateRunning:
+		if ctr.GatewayAddress == "" {
+			return httpserver.ErrorWithStatus(errors.New("container is running but gateway is not available -- installation problem or feature not supported"), http.StatusServiceUnavailable)
+		}
+		return nil
+	default:
+		return httpserver.ErrorWithStatus(fmt.Errorf("container has ended (state is %q)", ctr.State), http.StatusGone)
+	}
+}
+
+// dialContainerGateway opens a TLS connection to the gateway server
+// in the crunch-run process for ctr. It returns the
+// X-Arvados-Authorization header value to send with requests, and the
+// X-Arvados-Authorization-Response header value to expect in
+// responses.
+func (conn *Conn) dialContainerGateway(ctr arvados.Container) (netconn net.Conn, requestAuth, respondAuth string, err error) {
+	// crunch-run uses a self-signed / unverifiable TLS
+	// certificate, so we use the following scheme to ensure we're
+	// not talking to a MITM.
+	//
+	// 1. Compute ctrKey = HMAC-SHA256(sysRootToken,ctrUUID) --
+	// this will be the same ctrKey that a-d-c supplied to
+	// crunch-run in the GatewayAuthSecret env var.
+	//
+	// 2. Compute requestAuth = HMAC-SHA256(ctrKey,serverCert) and
+	// send it to crunch-run as the X-Arvados-Authorization
+	// header, proving that we know ctrKey. (Note a MITM cannot
+	// replay the proof to a real crunch-run server, because the
+	// real crunch-run server would have a different cert.)
+	//
+	// 3. Compute respondAuth = HMAC-SHA256(ctrKey,requestAuth)
+	// and ensure the server returns it in the
+	// X-Arvados-Authorization-Response header, proving that the
+	// server knows ctrKey.
+	netconn, err = tls.Dial("tcp", ctr.GatewayAddress, &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate received, cannot compute authorization header")
+			}
+			h := hmac.New(sha256.New, []byte(conn.cluster.SystemRootToken))
+			fmt.Fprint(h, ctr.UUID)
+			authKey := fmt.Sprintf("%x", h.Sum(nil))
+			h = hmac.New(sha256.New, []byte(authKey))
+			h.Write(rawCerts[0])
+			requestAuth = fmt.Sprintf("%x", h.Sum(nil))
+			h.Reset()
+			h.Write([]byte(requestAuth))
+			respondAuth = fmt.Sprintf("%x", h.Sum(nil))
+			return nil
+		},
+	})
+	if err != nil {
+		err = httpserver.ErrorWithStatus(err, http.StatusBadGateway)
+		return
+	}
+	if respondAuth == "" {
+		netconn.Close()
+		err = httpserver.ErrorWithStatus(errors.New("BUG: no respondAuth"), http.StatusInternalServerError)
+		return
+	}
+	return
+}
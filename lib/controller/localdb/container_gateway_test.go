@@ -8,6 +8,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -170,3 +171,25 @@ func (s *ContainerGatewaySuite) TestConnectFail(c *check.C) {
 	_, err = s.localdb.ContainerSSH(ctx, arvados.ContainerSSHOptions{UUID: s.ctrUUID})
 	c.Check(err, check.ErrorMatches, `.* 404 .*`)
 }
+
+func (s *ContainerGatewaySuite) TestSnapshotOutput(c *check.C) {
+	defer func() { s.gw.SnapshotOutput = nil }()
+	s.gw.SnapshotOutput = func() (arvados.Collection, error) {
+		return arvados.Collection{UUID: arvadostest.FooCollection, PortableDataHash: arvadostest.FooCollectionPDH}, nil
+	}
+	coll, err := s.localdb.ContainerSnapshotOutput(s.ctx, arvados.GetOptions{UUID: s.ctrUUID})
+	c.Check(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, arvadostest.FooCollection)
+	c.Check(coll.PortableDataHash, check.Equals, arvadostest.FooCollectionPDH)
+
+	s.gw.SnapshotOutput = func() (arvados.Collection, error) {
+		return arvados.Collection{}, errors.New("output directory is not available")
+	}
+	_, err = s.localdb.ContainerSnapshotOutput(s.ctx, arvados.GetOptions{UUID: s.ctrUUID})
+	c.Check(err, check.ErrorMatches, `gateway error: 503 Service Unavailable: output directory is not available`)
+
+	c.Log("trying with anonymous token")
+	ctx := auth.NewContext(context.Background(), &auth.Credentials{Tokens: []string{arvadostest.AnonymousToken}})
+	_, err = s.localdb.ContainerSnapshotOutput(ctx, arvados.GetOptions{UUID: s.ctrUUID})
+	c.Check(err, check.ErrorMatches, `.* 404 .*`)
+}
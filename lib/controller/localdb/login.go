@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/lib/ctrlctx"
@@ -36,34 +37,12 @@ func chooseLoginController(cluster *arvados.Cluster, parent *Conn) loginControll
 	wantTest := cluster.Login.Test.Enable
 	wantLoginCluster := cluster.Login.LoginCluster != "" && cluster.Login.LoginCluster != cluster.ClusterID
 	switch {
-	case 1 != countTrue(wantGoogle, wantOpenIDConnect, wantSSO, wantPAM, wantLDAP, wantTest, wantLoginCluster):
+	case 1 != countTrue(wantGoogle || wantOpenIDConnect, wantSSO, wantPAM, wantLDAP, wantTest, wantLoginCluster):
 		return errorLoginController{
-			error: errors.New("configuration problem: exactly one of Login.Google, Login.OpenIDConnect, Login.SSO, Login.PAM, Login.LDAP, Login.Test, or Login.LoginCluster must be set"),
-		}
-	case wantGoogle:
-		return &oidcLoginController{
-			Cluster:            cluster,
-			Parent:             parent,
-			Issuer:             "https://accounts.google.com",
-			ClientID:           cluster.Login.Google.ClientID,
-			ClientSecret:       cluster.Login.Google.ClientSecret,
-			AuthParams:         cluster.Login.Google.AuthenticationRequestParameters,
-			UseGooglePeopleAPI: cluster.Login.Google.AlternateEmailAddresses,
-			EmailClaim:         "email",
-			EmailVerifiedClaim: "email_verified",
-		}
-	case wantOpenIDConnect:
-		return &oidcLoginController{
-			Cluster:            cluster,
-			Parent:             parent,
-			Issuer:             cluster.Login.OpenIDConnect.Issuer,
-			ClientID:           cluster.Login.OpenIDConnect.ClientID,
-			ClientSecret:       cluster.Login.OpenIDConnect.ClientSecret,
-			AuthParams:         cluster.Login.OpenIDConnect.AuthenticationRequestParameters,
-			EmailClaim:         cluster.Login.OpenIDConnect.EmailClaim,
-			EmailVerifiedClaim: cluster.Login.OpenIDConnect.EmailVerifiedClaim,
-			UsernameClaim:      cluster.Login.OpenIDConnect.UsernameClaim,
+			error: errors.New("configuration problem: exactly one of Login.Google and/or Login.OpenIDConnect, Login.SSO, Login.PAM, Login.LDAP, Login.Test, or Login.LoginCluster must be set"),
 		}
+	case wantGoogle || wantOpenIDConnect:
+		return chooseOIDCLoginController(cluster, parent)
 	case wantSSO:
 		return &ssoLoginController{Parent: parent}
 	case wantPAM:
@@ -189,3 +168,82 @@ func (conn *Conn) CreateAPIClientAuthorization(ctx context.Context, rootToken st
 	}
 	return
 }
+
+// createLoginToken creates a token for a user who has just logged in
+// with a username and password, and applies the cluster's login
+// token policy to it.
+func createLoginToken(ctx context.Context, cluster *arvados.Cluster, parent *Conn, authinfo rpc.UserSessionAuthInfo, rememberMe bool) (arvados.APIClientAuthorization, error) {
+	aca, err := parent.CreateAPIClientAuthorization(ctx, cluster.SystemRootToken, authinfo)
+	if err != nil {
+		return aca, err
+	}
+	err = applyLoginTokenPolicy(ctx, cluster, &aca, rememberMe)
+	return aca, err
+}
+
+// loginTokenPolicyApplies returns true if a token issued at login
+// time needs a different expiry time or scopes than the ones
+// RailsAPI gives it.
+func loginTokenPolicyApplies(cluster *arvados.Cluster, rememberMe bool) bool {
+	return len(cluster.Login.TokenScopes) > 0 || (rememberMe && rememberMeEnabled(cluster))
+}
+
+// rememberMeEnabled returns true if users can ask for a longer-lived
+// token when logging in.
+func rememberMeEnabled(cluster *arvados.Cluster) bool {
+	return cluster.Login.TokenLifetime > 0 && cluster.Login.RememberMeTokenLifetime > cluster.Login.TokenLifetime
+}
+
+// loginTokenPolicy returns the expiry time (zero if the token should
+// not expire) and scopes for a token issued at login time.
+func loginTokenPolicy(cluster *arvados.Cluster, rememberMe bool, now time.Time) (time.Time, []string) {
+	ttl := cluster.Login.TokenLifetime
+	if rememberMe && rememberMeEnabled(cluster) {
+		ttl = cluster.Login.RememberMeTokenLifetime
+	}
+	var exp time.Time
+	if ttl > 0 {
+		exp = now.Add(ttl.Duration())
+	}
+	scopes := cluster.Login.TokenScopes
+	if len(scopes) == 0 {
+		scopes = []string{"all"}
+	}
+	return exp, scopes
+}
+
+// applyLoginTokenPolicy updates the expiry time and scopes of a token
+// that was just issued at login time (by RailsAPI, which doesn't know
+// about remember-me or scope restrictions) according to the
+// Login.TokenLifetime, Login.RememberMeTokenLifetime, and
+// Login.TokenScopes configs.
+func applyLoginTokenPolicy(ctx context.Context, cluster *arvados.Cluster, aca *arvados.APIClientAuthorization, rememberMe bool) error {
+	if !loginTokenPolicyApplies(cluster, rememberMe) {
+		// RailsAPI has already applied Login.TokenLifetime.
+		return nil
+	}
+	tx, err := ctrlctx.CurrentTx(ctx)
+	if err != nil {
+		return err
+	}
+	exp, scopes := loginTokenPolicy(cluster, rememberMe, time.Now().UTC())
+	var expiresAt interface{}
+	if !exp.IsZero() {
+		expiresAt = exp
+	}
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update api_client_authorizations set expires_at=$1, scopes=$2 where uuid=$3`, expiresAt, string(scopesJSON), aca.UUID)
+	if err != nil {
+		return fmt.Errorf("error applying login token policy: %w", err)
+	}
+	if exp.IsZero() {
+		aca.ExpiresAt = ""
+	} else {
+		aca.ExpiresAt = exp.Format(time.RFC3339Nano)
+	}
+	aca.Scopes = scopes
+	return nil
+}
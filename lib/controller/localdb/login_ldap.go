@@ -143,10 +143,10 @@ func (ctrl *ldapLoginController) UserAuthenticate(ctx context.Context, opts arva
 		return arvados.APIClientAuthorization{}, errors.New("authentication succeeded but ldap returned no email address")
 	}
 
-	return ctrl.Parent.CreateAPIClientAuthorization(ctx, ctrl.Cluster.SystemRootToken, rpc.UserSessionAuthInfo{
+	return createLoginToken(ctx, ctrl.Cluster, ctrl.Parent, rpc.UserSessionAuthInfo{
 		Email:     email,
 		FirstName: attrs["givenname"],
 		LastName:  attrs["sn"],
 		Username:  attrs[strings.ToLower(conf.UsernameAttribute)],
-	})
+	}, opts.RememberMe)
 }
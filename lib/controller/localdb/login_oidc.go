@@ -11,6 +11,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -56,6 +57,13 @@ type oidcLoginController struct {
 	UsernameClaim      string            // If non-empty, use as preferred username
 	AuthParams         map[string]string // Additional parameters to pass with authentication request
 
+	// If this is one of several providers offered by a
+	// multiOIDCLoginController, ProviderID identifies it in
+	// login requests and OAuth2 state, and DisplayName is shown on
+	// the provider selection page.
+	ProviderID  string
+	DisplayName string
+
 	// override Google People API base URL for testing purposes
 	// (normally empty, set by google pkg to
 	// https://people.googleapis.com/)
@@ -111,7 +119,7 @@ func (ctrl *oidcLoginController) Login(ctx context.Context, opts arvados.LoginOp
 		if opts.ReturnTo == "" {
 			return loginError(errors.New("missing return_to parameter"))
 		}
-		state := ctrl.newOAuth2State([]byte(ctrl.Cluster.SystemRootToken), opts.Remote, opts.ReturnTo)
+		state := ctrl.newOAuth2State([]byte(ctrl.Cluster.SystemRootToken), opts.Remote, opts.ReturnTo, opts.RememberMe)
 		var authparams []oauth2.AuthCodeOption
 		for k, v := range ctrl.AuthParams {
 			authparams = append(authparams, oauth2.SetAuthURLParam(k, v))
@@ -122,7 +130,7 @@ func (ctrl *oidcLoginController) Login(ctx context.Context, opts arvados.LoginOp
 	}
 	// Callback after OIDC sign-in.
 	state := ctrl.parseOAuth2State(opts.State)
-	if !state.verify([]byte(ctrl.Cluster.SystemRootToken)) {
+	if !state.verify([]byte(ctrl.Cluster.SystemRootToken)) || state.Provider != ctrl.ProviderID {
 		return loginError(errors.New("invalid OAuth2 state"))
 	}
 	oauth2Token, err := ctrl.oauth2conf.Exchange(ctx, opts.Code)
@@ -142,10 +150,29 @@ func (ctrl *oidcLoginController) Login(ctx context.Context, opts arvados.LoginOp
 		return loginError(err)
 	}
 	ctxRoot := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{ctrl.Cluster.SystemRootToken}})
-	return ctrl.Parent.UserSessionCreate(ctxRoot, rpc.UserSessionCreateOptions{
+	resp, err := ctrl.Parent.UserSessionCreate(ctxRoot, rpc.UserSessionCreateOptions{
 		ReturnTo: state.Remote + "," + state.ReturnTo,
 		AuthInfo: *authinfo,
 	})
+	if err != nil || !loginTokenPolicyApplies(ctrl.Cluster, state.RememberMe) {
+		return resp, err
+	}
+	// The redirect target has the new token (possibly salted for
+	// a remote cluster) in v2 format, which includes the UUID we
+	// need to apply the login token policy.
+	target, err := url.Parse(resp.RedirectLocation)
+	if err != nil {
+		return loginError(fmt.Errorf("error parsing login redirect: %s", err))
+	}
+	tokenparts := strings.Split(target.Query().Get("api_token"), "/")
+	if len(tokenparts) != 3 || tokenparts[0] != "v2" {
+		return loginError(errors.New("login redirect does not have a v2 token"))
+	}
+	err = applyLoginTokenPolicy(ctx, ctrl.Cluster, &arvados.APIClientAuthorization{UUID: tokenparts[1]}, state.RememberMe)
+	if err != nil {
+		return loginError(err)
+	}
+	return resp, nil
 }
 
 func (ctrl *oidcLoginController) UserAuthenticate(ctx context.Context, opts arvados.UserAuthenticateOptions) (arvados.APIClientAuthorization, error) {
@@ -264,11 +291,13 @@ func loginError(sendError error) (resp arvados.LoginResponse, err error) {
 	return
 }
 
-func (ctrl *oidcLoginController) newOAuth2State(key []byte, remote, returnTo string) oauth2State {
+func (ctrl *oidcLoginController) newOAuth2State(key []byte, remote, returnTo string, rememberMe bool) oauth2State {
 	s := oauth2State{
-		Time:     time.Now().Unix(),
-		Remote:   remote,
-		ReturnTo: returnTo,
+		Time:       time.Now().Unix(),
+		Remote:     remote,
+		ReturnTo:   returnTo,
+		Provider:   ctrl.ProviderID,
+		RememberMe: rememberMe,
 	}
 	s.HMAC = s.computeHMAC(key)
 	return s
@@ -279,6 +308,9 @@ type oauth2State struct {
 	Time     int64  // creation time (unix timestamp)
 	Remote   string // remote cluster if requesting a salted token, otherwise blank
 	ReturnTo string // redirect target
+	Provider string // provider ID if using multiple providers, otherwise blank
+
+	RememberMe bool // issue a token with Login.RememberMeTokenLifetime
 }
 
 func (ctrl *oidcLoginController) parseOAuth2State(encoded string) (s oauth2State) {
@@ -286,13 +318,19 @@ func (ctrl *oidcLoginController) parseOAuth2State(encoded string) (s oauth2State
 	// token will be rejected by verify().
 	decoded, _ := base64.RawURLEncoding.DecodeString(encoded)
 	f := strings.Split(string(decoded), "\n")
-	if len(f) != 4 {
+	if len(f) < 4 || len(f) > 6 {
 		return
 	}
 	fmt.Sscanf(f[0], "%x", &s.HMAC)
 	fmt.Sscanf(f[1], "%x", &s.Time)
 	fmt.Sscanf(f[2], "%s", &s.Remote)
 	fmt.Sscanf(f[3], "%s", &s.ReturnTo)
+	if len(f) >= 5 {
+		fmt.Sscanf(f[4], "%s", &s.Provider)
+	}
+	if len(f) == 6 {
+		s.RememberMe = f[5] == "1"
+	}
 	return
 }
 
@@ -307,6 +345,12 @@ func (s oauth2State) String() string {
 	var buf bytes.Buffer
 	enc := base64.NewEncoder(base64.RawURLEncoding, &buf)
 	fmt.Fprintf(enc, "%x\n%x\n%s\n%s", s.HMAC, s.Time, s.Remote, s.ReturnTo)
+	if s.Provider != "" || s.RememberMe {
+		fmt.Fprintf(enc, "\n%s", s.Provider)
+	}
+	if s.RememberMe {
+		fmt.Fprint(enc, "\n1")
+	}
 	enc.Close()
 	return buf.String()
 }
@@ -314,33 +358,46 @@ func (s oauth2State) String() string {
 func (s oauth2State) computeHMAC(key []byte) []byte {
 	mac := hmac.New(sha256.New, key)
 	fmt.Fprintf(mac, "%x %s %s", s.Time, s.Remote, s.ReturnTo)
+	if s.Provider != "" {
+		fmt.Fprintf(mac, " %s", s.Provider)
+	}
+	if s.RememberMe {
+		fmt.Fprint(mac, " remember_me")
+	}
 	return mac.Sum(nil)
 }
 
 func OIDCAccessTokenAuthorizer(cluster *arvados.Cluster, getdb func(context.Context) (*sqlx.DB, error)) *oidcTokenAuthorizer {
-	// We want ctrl to be nil if the chosen controller is not a
-	// *oidcLoginController, so we can ignore the 2nd return value
-	// of this type cast.
-	ctrl, _ := NewConn(cluster).loginController.(*oidcLoginController)
+	// We want ctrls to be empty if the chosen controller is not
+	// an OIDC controller.
+	var ctrls []*oidcLoginController
+	switch ctrl := NewConn(cluster).loginController.(type) {
+	case *oidcLoginController:
+		ctrls = []*oidcLoginController{ctrl}
+	case *multiOIDCLoginController:
+		ctrls = ctrl.Providers
+	}
 	cache, err := lru.New2Q(tokenCacheSize)
 	if err != nil {
 		panic(err)
 	}
 	return &oidcTokenAuthorizer{
-		ctrl:  ctrl,
-		getdb: getdb,
-		cache: cache,
+		cluster: cluster,
+		ctrls:   ctrls,
+		getdb:   getdb,
+		cache:   cache,
 	}
 }
 
 type oidcTokenAuthorizer struct {
-	ctrl  *oidcLoginController
-	getdb func(context.Context) (*sqlx.DB, error)
-	cache *lru.TwoQueueCache
+	cluster *arvados.Cluster
+	ctrls   []*oidcLoginController
+	getdb   func(context.Context) (*sqlx.DB, error)
+	cache   *lru.TwoQueueCache
 }
 
 func (ta *oidcTokenAuthorizer) Middleware(w http.ResponseWriter, r *http.Request, next http.Handler) {
-	if ta.ctrl == nil {
+	if len(ta.ctrls) == 0 {
 		// Not using a compatible (OIDC) login controller.
 	} else if authhdr := strings.Split(r.Header.Get("Authorization"), " "); len(authhdr) > 1 && (authhdr[0] == "OAuth2" || authhdr[0] == "Bearer") {
 		err := ta.registerToken(r.Context(), authhdr[1])
@@ -353,7 +410,7 @@ func (ta *oidcTokenAuthorizer) Middleware(w http.ResponseWriter, r *http.Request
 }
 
 func (ta *oidcTokenAuthorizer) WrapCalls(origFunc api.RoutableFunc) api.RoutableFunc {
-	if ta.ctrl == nil {
+	if len(ta.ctrls) == 0 {
 		// Not using a compatible (OIDC) login controller.
 		return origFunc
 	}
@@ -380,7 +437,7 @@ func (ta *oidcTokenAuthorizer) WrapCalls(origFunc api.RoutableFunc) api.Routable
 // if so, ensures that an api_client_authorizations row exists so that
 // RailsAPI will accept it as an Arvados token.
 func (ta *oidcTokenAuthorizer) registerToken(ctx context.Context, tok string) error {
-	if tok == ta.ctrl.Cluster.SystemRootToken || strings.HasPrefix(tok, "v2/") {
+	if tok == ta.cluster.SystemRootToken || strings.HasPrefix(tok, "v2/") {
 		return nil
 	}
 	if cached, hit := ta.cache.Get(tok); !hit {
@@ -422,7 +479,7 @@ func (ta *oidcTokenAuthorizer) registerToken(ctx context.Context, tok string) er
 	// We use hmac-sha256(accesstoken,systemroottoken) as the
 	// secret part of our own token, and avoid storing the auth
 	// provider's real secret in our database.
-	mac := hmac.New(sha256.New, []byte(ta.ctrl.Cluster.SystemRootToken))
+	mac := hmac.New(sha256.New, []byte(ta.cluster.SystemRootToken))
 	io.WriteString(mac, tok)
 	hmac := fmt.Sprintf("%x", mac.Sum(nil))
 
@@ -443,20 +500,18 @@ func (ta *oidcTokenAuthorizer) registerToken(ctx context.Context, tok string) er
 	// so, swap it out for an Arvados token (creating/updating an
 	// api_client_authorizations row if needed) which downstream
 	// server components will accept.
-	err = ta.ctrl.setup()
-	if err != nil {
-		return fmt.Errorf("error setting up OpenID Connect provider: %s", err)
-	}
 	oauth2Token := &oauth2.Token{
 		AccessToken: tok,
 	}
-	userinfo, err := ta.ctrl.provider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token))
+	ctrl, userinfo, err := ta.lookupUserInfo(ctx, oauth2Token)
 	if err != nil {
+		return err
+	} else if userinfo == nil {
 		ta.cache.Add(tok, time.Now().Add(tokenCacheNegativeTTL))
 		return nil
 	}
 	ctxlog.FromContext(ctx).WithField("userinfo", userinfo).Debug("(*oidcTokenAuthorizer)registerToken: got userinfo")
-	authinfo, err := ta.ctrl.getAuthInfo(ctx, oauth2Token, userinfo)
+	authinfo, err := ctrl.getAuthInfo(ctx, oauth2Token, userinfo)
 	if err != nil {
 		return err
 	}
@@ -474,7 +529,7 @@ func (ta *oidcTokenAuthorizer) registerToken(ctx context.Context, tok string) er
 		}
 		ctxlog.FromContext(ctx).WithField("HMAC", hmac).Debug("(*oidcTokenAuthorizer)registerToken: updated api_client_authorizations row")
 	} else {
-		aca, err = ta.ctrl.Parent.CreateAPIClientAuthorization(ctx, ta.ctrl.Cluster.SystemRootToken, *authinfo)
+		aca, err = ctrl.Parent.CreateAPIClientAuthorization(ctx, ta.cluster.SystemRootToken, *authinfo)
 		if err != nil {
 			return err
 		}
@@ -493,3 +548,75 @@ func (ta *oidcTokenAuthorizer) registerToken(ctx context.Context, tok string) er
 	ta.cache.Add(tok, aca)
 	return nil
 }
+
+// lookupUserInfo asks the OIDC provider that issued the given
+// access token (see tokenProvider) for the associated user info. The
+// token is never sent to any other provider. If no configured
+// provider could have issued the token, or the provider doesn't
+// accept it, it returns a nil userinfo and a nil error.
+func (ta *oidcTokenAuthorizer) lookupUserInfo(ctx context.Context, token *oauth2.Token) (*oidcLoginController, *oidc.UserInfo, error) {
+	ctrl := ta.tokenProvider(token.AccessToken)
+	if ctrl == nil {
+		return nil, nil, nil
+	}
+	err := ctrl.setup()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error setting up OpenID Connect provider: %s", err)
+	}
+	userinfo, err := ctrl.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, nil, nil
+	}
+	return ctrl, userinfo, nil
+}
+
+// tokenProvider returns the provider that should be asked about the
+// given access token, or nil if there isn't one.
+//
+// If only one provider is configured, that's the one. Otherwise, if
+// the token is a JWT, it's the provider whose issuer matches the
+// token's "iss" claim. An opaque token doesn't say where it came
+// from, so it can only be checked by the provider named in
+// Login.OpenIDConnect.OpaqueAccessTokenProvider, if any.
+func (ta *oidcTokenAuthorizer) tokenProvider(tok string) *oidcLoginController {
+	if len(ta.ctrls) == 1 {
+		return ta.ctrls[0]
+	}
+	if iss := tokenIssuer(tok); iss != "" {
+		for _, ctrl := range ta.ctrls {
+			if strings.TrimSuffix(ctrl.Issuer, "/") == strings.TrimSuffix(iss, "/") {
+				return ctrl
+			}
+		}
+		return nil
+	}
+	if id := ta.cluster.Login.OpenIDConnect.OpaqueAccessTokenProvider; id != "" {
+		for _, ctrl := range ta.ctrls {
+			if ctrl.ProviderID == id {
+				return ctrl
+			}
+		}
+	}
+	return nil
+}
+
+// tokenIssuer returns the "iss" claim of tok if it is a JWT,
+// otherwise "". The signature is not verified here: the issuer only
+// determines which provider is asked to verify the token.
+func tokenIssuer(tok string) string {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.Issuer
+}
@@ -0,0 +1,196 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// chooseOIDCLoginController returns an oidcLoginController if exactly
+// one OpenID Connect provider is configured, otherwise a
+// multiOIDCLoginController that lets the user choose one.
+func chooseOIDCLoginController(cluster *arvados.Cluster, parent *Conn) loginController {
+	var ctrls []*oidcLoginController
+	if cluster.Login.Google.Enable {
+		ctrls = append(ctrls, &oidcLoginController{
+			Cluster:            cluster,
+			Parent:             parent,
+			Issuer:             "https://accounts.google.com",
+			ClientID:           cluster.Login.Google.ClientID,
+			ClientSecret:       cluster.Login.Google.ClientSecret,
+			AuthParams:         cluster.Login.Google.AuthenticationRequestParameters,
+			UseGooglePeopleAPI: cluster.Login.Google.AlternateEmailAddresses,
+			EmailClaim:         "email",
+			EmailVerifiedClaim: "email_verified",
+			ProviderID:         "google",
+			DisplayName:        "Google",
+		})
+	}
+	oidcConfig := cluster.Login.OpenIDConnect
+	if oidcConfig.Enable && (oidcConfig.Issuer != "" || len(oidcConfig.Providers) == 0) {
+		ctrls = append(ctrls, &oidcLoginController{
+			Cluster:            cluster,
+			Parent:             parent,
+			Issuer:             oidcConfig.Issuer,
+			ClientID:           oidcConfig.ClientID,
+			ClientSecret:       oidcConfig.ClientSecret,
+			AuthParams:         oidcConfig.AuthenticationRequestParameters,
+			EmailClaim:         oidcConfig.EmailClaim,
+			EmailVerifiedClaim: oidcConfig.EmailVerifiedClaim,
+			UsernameClaim:      oidcConfig.UsernameClaim,
+			ProviderID:         "openidconnect",
+			DisplayName:        oidcConfig.Issuer,
+		})
+	}
+	var ids []string
+	for id := range oidcConfig.Providers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, ctrl := range ctrls {
+			if ctrl.ProviderID == id {
+				return errorLoginController{
+					error: fmt.Errorf("configuration problem: Login.OpenIDConnect.Providers entry %q conflicts with built-in provider ID", id),
+				}
+			}
+		}
+		p := oidcConfig.Providers[id]
+		if p.EmailClaim == "" {
+			p.EmailClaim = "email"
+		}
+		if p.DisplayName == "" {
+			p.DisplayName = id
+		}
+		ctrls = append(ctrls, &oidcLoginController{
+			Cluster:            cluster,
+			Parent:             parent,
+			Issuer:             p.Issuer,
+			ClientID:           p.ClientID,
+			ClientSecret:       p.ClientSecret,
+			AuthParams:         p.AuthenticationRequestParameters,
+			EmailClaim:         p.EmailClaim,
+			EmailVerifiedClaim: p.EmailVerifiedClaim,
+			UsernameClaim:      p.UsernameClaim,
+			ProviderID:         id,
+			DisplayName:        p.DisplayName,
+		})
+	}
+	switch len(ctrls) {
+	case 0:
+		return errorLoginController{
+			error: errors.New("configuration problem: no OpenID Connect providers are configured"),
+		}
+	case 1:
+		// A lone provider behaves exactly as it did before
+		// multiple providers were supported, including the
+		// OAuth2 state format.
+		ctrls[0].ProviderID = ""
+		return ctrls[0]
+	default:
+		return &multiOIDCLoginController{Cluster: cluster, Providers: ctrls}
+	}
+}
+
+// multiOIDCLoginController offers a choice of OpenID Connect
+// providers. Each login request is handed off to one of the
+// Providers, selected by the "provider" parameter (a provider ID or
+// issuer URL) or, in the callback from the provider, by the OAuth2
+// state.
+type multiOIDCLoginController struct {
+	Cluster   *arvados.Cluster
+	Providers []*oidcLoginController
+}
+
+func (ctrl *multiOIDCLoginController) Logout(ctx context.Context, opts arvados.LogoutOptions) (arvados.LogoutResponse, error) {
+	return noopLogout(ctrl.Cluster, opts)
+}
+
+func (ctrl *multiOIDCLoginController) Login(ctx context.Context, opts arvados.LoginOptions) (arvados.LoginResponse, error) {
+	if opts.State != "" {
+		// Callback after OIDC sign-in. The state was signed
+		// by the provider controller that issued it, which
+		// will verify it again.
+		state := ctrl.Providers[0].parseOAuth2State(opts.State)
+		p := ctrl.lookup(state.Provider)
+		if p == nil || state.Provider == "" {
+			return loginError(errors.New("invalid OAuth2 state"))
+		}
+		return p.Login(ctx, opts)
+	}
+	if opts.ReturnTo == "" {
+		return loginError(errors.New("missing return_to parameter"))
+	}
+	if opts.Provider == "" {
+		return ctrl.choosePage(opts)
+	}
+	p := ctrl.lookup(opts.Provider)
+	if p == nil {
+		return loginError(fmt.Errorf("unknown login provider %q", opts.Provider))
+	}
+	return p.Login(ctx, opts)
+}
+
+func (ctrl *multiOIDCLoginController) UserAuthenticate(ctx context.Context, opts arvados.UserAuthenticateOptions) (arvados.APIClientAuthorization, error) {
+	return ctrl.Providers[0].UserAuthenticate(ctx, opts)
+}
+
+// lookup returns the provider with the given ID or issuer URL, or nil
+// if there is none.
+func (ctrl *multiOIDCLoginController) lookup(idOrIssuer string) *oidcLoginController {
+	for _, p := range ctrl.Providers {
+		if p.ProviderID == idOrIssuer {
+			return p
+		}
+	}
+	for _, p := range ctrl.Providers {
+		if strings.TrimSuffix(p.Issuer, "/") == strings.TrimSuffix(idOrIssuer, "/") {
+			return p
+		}
+	}
+	return nil
+}
+
+var chooseProviderTemplate = template.Must(template.New("choose").Parse(`<h2>Log in</h2>
+<p>Choose a login provider:</p>
+<ul>
+{{range .}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+`))
+
+// choosePage returns a page with a link for each provider, each of
+// which repeats the login request with the "provider" parameter
+// added.
+func (ctrl *multiOIDCLoginController) choosePage(opts arvados.LoginOptions) (arvados.LoginResponse, error) {
+	loginURL, err := (*url.URL)(&ctrl.Cluster.Services.Controller.ExternalURL).Parse("/" + arvados.EndpointLogin.Path)
+	if err != nil {
+		return loginError(fmt.Errorf("error making login URL: %s", err))
+	}
+	type link struct {
+		Name string
+		URL  string
+	}
+	var links []link
+	for _, p := range ctrl.Providers {
+		q := url.Values{"return_to": {opts.ReturnTo}, "provider": {p.ProviderID}}
+		if opts.Remote != "" {
+			q.Set("remote", opts.Remote)
+		}
+		u := *loginURL
+		u.RawQuery = q.Encode()
+		links = append(links, link{Name: p.DisplayName, URL: u.String()})
+	}
+	var resp arvados.LoginResponse
+	err = chooseProviderTemplate.Execute(&resp.HTML, links)
+	return resp, err
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -115,6 +116,22 @@ func (s *OIDCLoginSuite) TestGoogleLogin_Start(c *check.C) {
 	}
 }
 
+func (s *OIDCLoginSuite) TestGoogleLogin_Start_RememberMe(c *check.C) {
+	resp, err := s.localdb.Login(context.Background(), arvados.LoginOptions{RememberMe: true, ReturnTo: "https://app.example.com/foo?bar"})
+	c.Check(err, check.IsNil)
+	target, err := url.Parse(resp.RedirectLocation)
+	c.Check(err, check.IsNil)
+	ctrl := s.localdb.loginController.(*oidcLoginController)
+	state := ctrl.parseOAuth2State(target.Query().Get("state"))
+	c.Check(state.verify([]byte(s.cluster.SystemRootToken)), check.Equals, true)
+	c.Check(state.RememberMe, check.Equals, true)
+	c.Check(state.ReturnTo, check.Equals, "https://app.example.com/foo?bar")
+
+	// The remember-me flag is covered by the HMAC.
+	state.RememberMe = false
+	c.Check(ctrl.parseOAuth2State(state.String()).verify([]byte(s.cluster.SystemRootToken)), check.Equals, false)
+}
+
 func (s *OIDCLoginSuite) TestGoogleLogin_InvalidCode(c *check.C) {
 	state := s.startLogin(c)
 	resp, err := s.localdb.Login(context.Background(), arvados.LoginOptions{
@@ -191,6 +208,115 @@ func (s *OIDCLoginSuite) TestConfig(c *check.C) {
 	}
 }
 
+func (s *OIDCLoginSuite) TestConfigMultipleProviders(c *check.C) {
+	s.cluster.Login.Google.Enable = true
+	s.cluster.Login.OpenIDConnect.Enable = true
+	s.cluster.Login.OpenIDConnect.Issuer = "https://accounts.example.com/"
+	s.cluster.Login.OpenIDConnect.Providers = map[string]arvados.OpenIDConnectProvider{
+		"zinst": {Issuer: "https://z.example.edu/", ClientID: "z-client-id"},
+		"ainst": {Issuer: "https://a.example.edu/", DisplayName: "A University", EmailVerifiedClaim: "verified"},
+	}
+	localdb := NewConn(s.cluster)
+	c.Assert(localdb.loginController, check.FitsTypeOf, (*multiOIDCLoginController)(nil))
+	ctrl := localdb.loginController.(*multiOIDCLoginController)
+	var ids, names []string
+	for _, p := range ctrl.Providers {
+		ids = append(ids, p.ProviderID)
+		names = append(names, p.DisplayName)
+	}
+	c.Check(ids, check.DeepEquals, []string{"google", "openidconnect", "ainst", "zinst"})
+	c.Check(names, check.DeepEquals, []string{"Google", "https://accounts.example.com/", "A University", "zinst"})
+	c.Check(ctrl.Providers[2].EmailClaim, check.Equals, "email")
+	c.Check(ctrl.Providers[2].EmailVerifiedClaim, check.Equals, "verified")
+	c.Check(ctrl.Providers[3].ClientID, check.Equals, "z-client-id")
+	c.Check(ctrl.lookup("https://z.example.edu"), check.Equals, ctrl.Providers[3])
+	c.Check(ctrl.lookup("bogus"), check.IsNil)
+
+	// A single provider listed in Providers is used directly.
+	s.cluster.Login.Google.Enable = false
+	s.cluster.Login.OpenIDConnect.Issuer = ""
+	delete(s.cluster.Login.OpenIDConnect.Providers, "zinst")
+	localdb = NewConn(s.cluster)
+	c.Assert(localdb.loginController, check.FitsTypeOf, (*oidcLoginController)(nil))
+	c.Check(localdb.loginController.(*oidcLoginController).Issuer, check.Equals, "https://a.example.edu/")
+	c.Check(localdb.loginController.(*oidcLoginController).ProviderID, check.Equals, "")
+
+	// Provider IDs must not collide with built-in providers.
+	s.cluster.Login.Google.Enable = true
+	s.cluster.Login.OpenIDConnect.Providers["google"] = arvados.OpenIDConnectProvider{Issuer: "https://accounts.google.com"}
+	localdb = NewConn(s.cluster)
+	_, err := localdb.Login(context.Background(), arvados.LoginOptions{ReturnTo: "https://app.example.com/foo"})
+	c.Check(err, check.ErrorMatches, `.*conflicts with built-in provider.*`)
+}
+
+func (s *OIDCLoginSuite) TestMultipleProvidersLogin(c *check.C) {
+	s.cluster.Login.Google.Enable = true
+	s.cluster.Login.OpenIDConnect.Enable = true
+	s.cluster.Login.OpenIDConnect.Providers = map[string]arvados.OpenIDConnectProvider{
+		"inst": {
+			DisplayName:        "Institution <IdP>",
+			Issuer:             s.fakeProvider.Issuer.URL,
+			ClientID:           "inst-client-id",
+			ClientSecret:       "inst-client-secret",
+			EmailClaim:         "email",
+			EmailVerifiedClaim: "email_verified",
+		},
+	}
+	s.fakeProvider.ValidClientID = "inst-client-id"
+	s.fakeProvider.ValidClientSecret = "inst-client-secret"
+	s.localdb = NewConn(s.cluster)
+	*s.localdb.railsProxy = *rpc.NewConn(s.cluster.ClusterID, s.railsSpy.URL, true, rpc.PassthroughTokenProvider)
+	ctrl, ok := s.localdb.loginController.(*multiOIDCLoginController)
+	c.Assert(ok, check.Equals, true)
+
+	// Without a provider parameter, offer a choice.
+	resp, err := s.localdb.Login(context.Background(), arvados.LoginOptions{Remote: "zzzzz", ReturnTo: "https://app.example.com/foo?bar"})
+	c.Check(err, check.IsNil)
+	c.Check(resp.RedirectLocation, check.Equals, "")
+	c.Check(resp.HTML.String(), check.Matches, `(?ms).*<a href="https://[^"]*/login\?provider=google&amp;remote=zzzzz&amp;return_to=https%3A%2F%2Fapp.example.com%2Ffoo%3Fbar">Google</a>.*`)
+	c.Check(resp.HTML.String(), check.Matches, `(?ms).*<a href="[^"]*provider=inst&amp;[^"]*">Institution &lt;IdP&gt;</a>.*`)
+
+	resp, err = s.localdb.Login(context.Background(), arvados.LoginOptions{Provider: "bogus", ReturnTo: "https://app.example.com/foo?bar"})
+	c.Check(err, check.IsNil)
+	c.Check(resp.HTML.String(), check.Matches, `(?ms).*unknown login provider.*`)
+
+	// Select a provider by ID or issuer URL.
+	for _, provider := range []string{"inst", s.fakeProvider.Issuer.URL + "/"} {
+		resp, err = s.localdb.Login(context.Background(), arvados.LoginOptions{Provider: provider, ReturnTo: "https://app.example.com/foo?bar"})
+		c.Check(err, check.IsNil)
+		target, err := url.Parse(resp.RedirectLocation)
+		c.Assert(err, check.IsNil)
+		c.Check(target.Query().Get("client_id"), check.Equals, "inst-client-id")
+		state := ctrl.Providers[0].parseOAuth2State(target.Query().Get("state"))
+		c.Check(state.verify([]byte(s.cluster.SystemRootToken)), check.Equals, true)
+		c.Check(state.Provider, check.Equals, "inst")
+		c.Check(state.ReturnTo, check.Equals, "https://app.example.com/foo?bar")
+	}
+
+	// A state issued for one provider is not accepted by another.
+	c.Assert(ctrl.Providers, check.HasLen, 2)
+	c.Check(ctrl.Providers[0].ProviderID, check.Equals, "google")
+	state := ctrl.Providers[0].newOAuth2State([]byte(s.cluster.SystemRootToken), "", "https://app.example.com/", false)
+	resp, err = ctrl.Providers[1].Login(context.Background(), arvados.LoginOptions{Code: s.fakeProvider.ValidCode, State: state.String()})
+	c.Check(err, check.IsNil)
+	c.Check(resp.HTML.String(), check.Matches, `(?ms).*invalid OAuth2 state.*`)
+
+	// The callback is handled by the provider that issued the
+	// state.
+	resp, err = s.localdb.Login(context.Background(), arvados.LoginOptions{Provider: "inst", ReturnTo: "https://app.example.com/foo?bar"})
+	c.Assert(err, check.IsNil)
+	target, err := url.Parse(resp.RedirectLocation)
+	c.Assert(err, check.IsNil)
+	resp, err = s.localdb.Login(context.Background(), arvados.LoginOptions{
+		Code:  s.fakeProvider.ValidCode,
+		State: target.Query().Get("state"),
+	})
+	c.Check(err, check.IsNil)
+	c.Check(resp.HTML.String(), check.Equals, "")
+	authinfo := getCallbackAuthInfo(c, s.railsSpy)
+	c.Check(authinfo.Email, check.Equals, "active-user@arvados.local")
+}
+
 func (s *OIDCLoginSuite) TestGoogleLogin_PeopleAPIError(c *check.C) {
 	s.setupPeopleAPIError(c)
 	state := s.startLogin(c)
@@ -258,6 +384,53 @@ func (s *OIDCLoginSuite) TestOIDCAuthorizer(c *check.C) {
 	})(ctx, nil)
 }
 
+func (s *OIDCLoginSuite) TestOIDCAuthorizerProviderSelection(c *check.C) {
+	s.cluster.Login.Google.Enable = true
+	s.cluster.Login.OpenIDConnect.Enable = true
+	s.cluster.Login.OpenIDConnect.Issuer = ""
+	s.cluster.Login.OpenIDConnect.Providers = map[string]arvados.OpenIDConnectProvider{
+		"inst": {Issuer: "https://inst.example.edu/"},
+	}
+	jwt := func(claims string) string {
+		enc := base64.RawURLEncoding.EncodeToString
+		return enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+	for _, trial := range []struct {
+		opaqueProvider string
+		token          string
+		expect         string
+	}{
+		{"", jwt(`{"iss":"https://inst.example.edu"}`), "inst"},
+		{"", jwt(`{"iss":"https://accounts.google.com"}`), "google"},
+		{"", jwt(`{"iss":"https://other.example"}`), ""},
+		{"google", jwt(`{"iss":"https://other.example"}`), ""},
+		{"", "ya29.opaque-token", ""},
+		{"google", "ya29.opaque-token", "google"},
+		{"inst", s.fakeProvider.ValidAccessToken(), "inst"},
+		{"bogus", "ya29.opaque-token", ""},
+	} {
+		c.Logf("trial: %+v", trial)
+		s.cluster.Login.OpenIDConnect.OpaqueAccessTokenProvider = trial.opaqueProvider
+		ta := OIDCAccessTokenAuthorizer(s.cluster, nil)
+		c.Assert(ta.ctrls, check.HasLen, 2)
+		ctrl := ta.tokenProvider(trial.token)
+		if trial.expect == "" {
+			c.Check(ctrl, check.IsNil)
+		} else if c.Check(ctrl, check.NotNil) {
+			c.Check(ctrl.ProviderID, check.Equals, trial.expect)
+		}
+	}
+
+	// With only one provider, every token is checked by that
+	// provider, as before multiple providers were supported.
+	s.cluster.Login.Google.Enable = false
+	s.cluster.Login.OpenIDConnect.OpaqueAccessTokenProvider = ""
+	ta := OIDCAccessTokenAuthorizer(s.cluster, nil)
+	c.Assert(ta.ctrls, check.HasLen, 1)
+	c.Check(ta.tokenProvider("ya29.opaque-token"), check.Equals, ta.ctrls[0])
+	c.Check(ta.tokenProvider(jwt(`{"iss":"https://other.example"}`)), check.Equals, ta.ctrls[0])
+}
+
 func (s *OIDCLoginSuite) TestGenericOIDCLogin(c *check.C) {
 	s.cluster.Login.Google.Enable = false
 	s.cluster.Login.OpenIDConnect.Enable = true
@@ -87,8 +87,8 @@ func (ctrl *pamLoginController) UserAuthenticate(ctx context.Context, opts arvad
 		"user":  user,
 		"email": email,
 	}).Debug("pam authentication succeeded")
-	return ctrl.Parent.CreateAPIClientAuthorization(ctx, ctrl.Cluster.SystemRootToken, rpc.UserSessionAuthInfo{
+	return createLoginToken(ctx, ctrl.Cluster, ctrl.Parent, rpc.UserSessionAuthInfo{
 		Username: user,
 		Email:    email,
-	})
+	}, opts.RememberMe)
 }
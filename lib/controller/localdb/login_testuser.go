@@ -31,7 +31,13 @@ func (ctrl *testLoginController) Login(ctx context.Context, opts arvados.LoginOp
 		return arvados.LoginResponse{}, err
 	}
 	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, opts)
+	err = tmpl.Execute(&buf, struct {
+		ReturnTo   string
+		RememberMe bool
+	}{
+		ReturnTo:   opts.ReturnTo,
+		RememberMe: rememberMeEnabled(ctrl.Cluster),
+	})
 	if err != nil {
 		return arvados.LoginResponse{}, err
 	}
@@ -45,10 +51,10 @@ func (ctrl *testLoginController) UserAuthenticate(ctx context.Context, opts arva
 				"username": username,
 				"email":    user.Email,
 			}).Debug("test authentication succeeded")
-			return ctrl.Parent.CreateAPIClientAuthorization(ctx, ctrl.Cluster.SystemRootToken, rpc.UserSessionAuthInfo{
+			return createLoginToken(ctx, ctrl.Cluster, ctrl.Parent, rpc.UserSessionAuthInfo{
 				Username: username,
 				Email:    user.Email,
-			})
+			}, opts.RememberMe)
 		}
 	}
 	return arvados.APIClientAuthorization{}, fmt.Errorf("authentication failed for user %q with password len=%d", opts.Username, len(opts.Password))
@@ -69,6 +75,7 @@ const loginform = `
 	  body: JSON.stringify({
 	    username: document.getElementById('username').value,
 	    password: document.getElementById('password').value,
+	    remember_me: !!(document.getElementById('remember_me') || {}).checked,
 	  }),
 	})
 	if (!resp.ok) {
@@ -92,6 +99,7 @@ const loginform = `
       <input id="return_to" type="hidden" name="return_to" value="{{.ReturnTo}}">
       username <input id="username" type="text" name="username" size=16>
       password <input id="password" type="password" name="password" size=16>
+      {{if .RememberMe}}<label><input id="remember_me" type="checkbox" name="remember_me"> remember me</label>{{end}}
       <input type="submit" value="Log in">
       <br>
       <p id="error"></p>
@@ -6,6 +6,7 @@ package localdb
 
 import (
 	"context"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/lib/controller/rpc"
@@ -93,6 +94,41 @@ func (s *TestUserSuite) TestLogin(c *check.C) {
 	}
 }
 
+func (s *TestUserSuite) TestLoginTokenPolicy(c *check.C) {
+	defer func(orig arvados.Cluster) { *s.cluster = orig }(*s.cluster)
+	s.cluster.Login.TokenLifetime = arvados.Duration(time.Hour)
+	s.cluster.Login.RememberMeTokenLifetime = arvados.Duration(720 * time.Hour)
+	s.cluster.Login.TokenScopes = []string{"GET /arvados/v1/users/current"}
+	for _, trial := range []struct {
+		rememberMe bool
+		lifetime   time.Duration
+	}{
+		{false, time.Hour},
+		{true, 720 * time.Hour},
+	} {
+		c.Logf("=== %#v", trial)
+		t0 := time.Now()
+		resp, err := s.ctrl.UserAuthenticate(s.ctx, arvados.UserAuthenticateOptions{
+			Username:   "valid",
+			Password:   "v@l1d",
+			RememberMe: trial.rememberMe,
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(resp.Scopes, check.DeepEquals, []string{"GET /arvados/v1/users/current"})
+		exp, err := time.Parse(time.RFC3339Nano, resp.ExpiresAt)
+		c.Assert(err, check.IsNil)
+		c.Check(exp.After(t0.Add(trial.lifetime-time.Minute)), check.Equals, true)
+		c.Check(exp.Before(time.Now().Add(trial.lifetime+time.Minute)), check.Equals, true)
+
+		tx, err := ctrlctx.CurrentTx(s.ctx)
+		c.Assert(err, check.IsNil)
+		var dbscopes string
+		err = tx.QueryRowContext(s.ctx, `select scopes from api_client_authorizations where uuid=$1`, resp.UUID).Scan(&dbscopes)
+		c.Check(err, check.IsNil)
+		c.Check(dbscopes, check.Equals, `["GET /arvados/v1/users/current"]`)
+	}
+}
+
 func (s *TestUserSuite) TestLoginForm(c *check.C) {
 	resp, err := s.ctrl.Login(s.ctx, arvados.LoginOptions{
 		ReturnTo: "https://localhost:12345/example",
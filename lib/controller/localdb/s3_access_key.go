@@ -0,0 +1,144 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+)
+
+// S3AccessKeyCreate issues a new S3 access key pair that can be used
+// with keep-web's S3 API in place of the caller's token.
+//
+// The key is stored as a link owned by the system user, so the
+// caller cannot modify it to point to a different token. The secret
+// key is derived from the access key ID and SystemRootToken (see
+// arvados.S3SecretAccessKey), and is only returned here.
+func (conn *Conn) S3AccessKeyCreate(ctx context.Context, opts arvados.CreateOptions) (arvados.S3AccessKey, error) {
+	if conn.cluster.SystemRootToken == "" {
+		return arvados.S3AccessKey{}, httpserver.ErrorWithStatus(errors.New("configuration error: empty SystemRootToken"), http.StatusInternalServerError)
+	}
+	user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+	aca, err := conn.railsProxy.APIClientAuthorizationCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+
+	props := map[string]interface{}{}
+	if v, ok := opts.Attrs["expires_at"]; ok && v != nil {
+		s, ok := v.(string)
+		if !ok {
+			return arvados.S3AccessKey{}, httpserver.ErrorWithStatus(fmt.Errorf("invalid expires_at %v: must be a timestamp", v), http.StatusBadRequest)
+		}
+		exp, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return arvados.S3AccessKey{}, httpserver.ErrorWithStatus(fmt.Errorf("invalid expires_at %q: %s", s, err), http.StatusBadRequest)
+		}
+		if !exp.After(time.Now()) {
+			return arvados.S3AccessKey{}, httpserver.ErrorWithStatus(fmt.Errorf("invalid expires_at %q: must be in the future", s), http.StatusBadRequest)
+		}
+		props["expires_at"] = exp.UTC().Format(time.RFC3339Nano)
+	}
+
+	id, err := newS3AccessKeyID()
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+	ctxRoot := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{conn.cluster.SystemRootToken}})
+	link, err := conn.railsProxy.LinkCreate(ctxRoot, arvados.CreateOptions{Attrs: map[string]interface{}{
+		"link_class": arvados.S3AccessKeyLinkClass,
+		"name":       id,
+		"tail_uuid":  user.UUID,
+		"head_uuid":  aca.UUID,
+		"properties": props,
+	}})
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+	key := arvados.S3AccessKeyFromLink(link)
+	key.SecretAccessKey = arvados.S3SecretAccessKey(conn.cluster.SystemRootToken, id)
+	return key, nil
+}
+
+// S3AccessKeyList returns the S3 access keys that have been issued
+// to the current user. Secret keys are not included.
+func (conn *Conn) S3AccessKeyList(ctx context.Context, opts arvados.ListOptions) (arvados.S3AccessKeyList, error) {
+	user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return arvados.S3AccessKeyList{}, err
+	}
+	ctxRoot := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{conn.cluster.SystemRootToken}})
+	links, err := conn.railsProxy.LinkList(ctxRoot, arvados.ListOptions{
+		Limit:  opts.Limit,
+		Offset: opts.Offset,
+		Order:  []string{"created_at desc"},
+		Filters: []arvados.Filter{
+			{Attr: "link_class", Operator: "=", Operand: arvados.S3AccessKeyLinkClass},
+			{Attr: "tail_uuid", Operator: "=", Operand: user.UUID},
+		},
+	})
+	if err != nil {
+		return arvados.S3AccessKeyList{}, err
+	}
+	resp := arvados.S3AccessKeyList{
+		Items:          []arvados.S3AccessKey{},
+		ItemsAvailable: links.ItemsAvailable,
+	}
+	for _, link := range links.Items {
+		resp.Items = append(resp.Items, arvados.S3AccessKeyFromLink(link))
+	}
+	return resp, nil
+}
+
+// S3AccessKeyDelete revokes an S3 access key. Users can revoke their
+// own keys; admins can revoke any key.
+func (conn *Conn) S3AccessKeyDelete(ctx context.Context, opts arvados.DeleteOptions) (arvados.S3AccessKey, error) {
+	user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+	ctxRoot := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{conn.cluster.SystemRootToken}})
+	links, err := conn.railsProxy.LinkList(ctxRoot, arvados.ListOptions{
+		Limit: 1,
+		Filters: []arvados.Filter{
+			{Attr: "uuid", Operator: "=", Operand: opts.UUID},
+			{Attr: "link_class", Operator: "=", Operand: arvados.S3AccessKeyLinkClass},
+		},
+	})
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+	if len(links.Items) == 0 || (links.Items[0].TailUUID != user.UUID && !user.IsAdmin) {
+		return arvados.S3AccessKey{}, httpserver.ErrorWithStatus(fmt.Errorf("S3 access key %q not found", opts.UUID), http.StatusNotFound)
+	}
+	link, err := conn.railsProxy.LinkDelete(ctxRoot, arvados.DeleteOptions{UUID: opts.UUID})
+	if err != nil {
+		return arvados.S3AccessKey{}, err
+	}
+	return arvados.S3AccessKeyFromLink(link), nil
+}
+
+// newS3AccessKeyID returns a new random access key ID, in the same
+// 20-character uppercase alphanumeric format as AWS access key IDs.
+func newS3AccessKeyID() (string, error) {
+	buf := make([]byte, 10)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return arvados.S3AccessKeyIDPrefix + base32.StdEncoding.EncodeToString(buf)[:15], nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&S3AccessKeySuite{})
+
+type S3AccessKeySuite struct {
+	cluster *arvados.Cluster
+	localdb *Conn
+}
+
+func (s *S3AccessKeySuite) TearDownSuite(c *check.C) {
+	// Undo any changes/additions to the database so they don't
+	// affect subsequent tests.
+	arvadostest.ResetEnv()
+	c.Check(arvados.NewClientFromEnv().RequestAndDecode(nil, "POST", "database/reset", nil, nil), check.IsNil)
+}
+
+func (s *S3AccessKeySuite) SetUpSuite(c *check.C) {
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, check.IsNil)
+	s.cluster, err = cfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+	s.localdb = NewConn(s.cluster)
+}
+
+func (s *S3AccessKeySuite) TestCreateListDelete(c *check.C) {
+	ctxActive := auth.NewContext(context.Background(), &auth.Credentials{Tokens: []string{arvadostest.ActiveTokenV2}})
+	ctxSpectator := auth.NewContext(context.Background(), &auth.Credentials{Tokens: []string{arvadostest.SpectatorToken}})
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	key, err := s.localdb.S3AccessKeyCreate(ctxActive, arvados.CreateOptions{Attrs: map[string]interface{}{
+		"expires_at": expires.Format(time.RFC3339),
+	}})
+	c.Assert(err, check.IsNil)
+	c.Check(arvados.IsS3AccessKeyID(key.AccessKeyID), check.Equals, true)
+	c.Check(key.SecretAccessKey, check.Equals, arvados.S3SecretAccessKey(s.cluster.SystemRootToken, key.AccessKeyID))
+	c.Check(key.TokenUUID, check.Equals, arvadostest.ActiveTokenUUID)
+	c.Check(key.UserUUID, check.Equals, arvadostest.ActiveUserUUID)
+	c.Assert(key.ExpiresAt, check.NotNil)
+	c.Check(key.ExpiresAt.Equal(expires), check.Equals, true)
+
+	// The link is owned by the system user, so the key owner
+	// can't modify it.
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = arvadostest.ActiveTokenV2
+	var link arvados.Link
+	err = client.RequestAndDecode(&link, "PATCH", "arvados/v1/links/"+key.UUID, nil, map[string]interface{}{
+		"link": map[string]interface{}{"head_uuid": arvadostest.AdminTokenUUID},
+	})
+	c.Check(err, check.NotNil)
+
+	_, err = s.localdb.S3AccessKeyCreate(ctxActive, arvados.CreateOptions{Attrs: map[string]interface{}{
+		"expires_at": time.Now().Add(-time.Hour).Format(time.RFC3339),
+	}})
+	c.Check(err, check.ErrorMatches, `.*must be in the future.*`)
+
+	list, err := s.localdb.S3AccessKeyList(ctxActive, arvados.ListOptions{Limit: -1})
+	c.Assert(err, check.IsNil)
+	c.Assert(list.Items, check.HasLen, 1)
+	c.Check(list.Items[0].AccessKeyID, check.Equals, key.AccessKeyID)
+	c.Check(list.Items[0].SecretAccessKey, check.Equals, "")
+
+	list, err = s.localdb.S3AccessKeyList(ctxSpectator, arvados.ListOptions{Limit: -1})
+	c.Assert(err, check.IsNil)
+	c.Check(list.Items, check.HasLen, 0)
+
+	_, err = s.localdb.S3AccessKeyDelete(ctxSpectator, arvados.DeleteOptions{UUID: key.UUID})
+	c.Check(err, check.ErrorMatches, `.*not found.*`)
+
+	deleted, err := s.localdb.S3AccessKeyDelete(ctxActive, arvados.DeleteOptions{UUID: key.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(deleted.AccessKeyID, check.Equals, key.AccessKeyID)
+
+	list, err = s.localdb.S3AccessKeyList(ctxActive, arvados.ListOptions{Limit: -1})
+	c.Assert(err, check.IsNil)
+	c.Check(list.Items, check.HasLen, 0)
+}
@@ -168,8 +168,10 @@ var boolParams = map[string]bool{
 	"include_trash":           true,
 	"include_old_versions":    true,
 	"redirect_to_new_user":    true,
+	"remember_me":             true,
 	"send_notification_email": true,
 	"bypass_federation":       true,
+	"merge_properties":        true,
 }
 
 func stringToBool(s string) bool {
@@ -305,6 +305,13 @@ func (conn *Conn) ContainerUnlock(ctx context.Context, options arvados.GetOption
 	return resp, err
 }
 
+func (conn *Conn) ContainerSnapshotOutput(ctx context.Context, options arvados.GetOptions) (arvados.Collection, error) {
+	ep := arvados.EndpointContainerSnapshotOutput
+	var resp arvados.Collection
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
 // ContainerSSH returns a connection to the out-of-band SSH server for
 // a running container. If the returned error is nil, the caller is
 // responsible for closing sshconn.Conn.
@@ -531,6 +538,52 @@ func (conn *Conn) APIClientAuthorizationCurrent(ctx context.Context, options arv
 	return resp, err
 }
 
+func (conn *Conn) S3AccessKeyCreate(ctx context.Context, options arvados.CreateOptions) (arvados.S3AccessKey, error) {
+	ep := arvados.EndpointS3AccessKeyCreate
+	var resp arvados.S3AccessKey
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
+func (conn *Conn) S3AccessKeyList(ctx context.Context, options arvados.ListOptions) (arvados.S3AccessKeyList, error) {
+	ep := arvados.EndpointS3AccessKeyList
+	var resp arvados.S3AccessKeyList
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
+func (conn *Conn) S3AccessKeyDelete(ctx context.Context, options arvados.DeleteOptions) (arvados.S3AccessKey, error) {
+	ep := arvados.EndpointS3AccessKeyDelete
+	var resp arvados.S3AccessKey
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
+// LinkCreate, LinkList, and LinkDelete are not part of the
+// arvados.API interface (link requests are proxied directly to
+// RailsAPI) but are used internally by controller.
+
+func (conn *Conn) LinkCreate(ctx context.Context, options arvados.CreateOptions) (arvados.Link, error) {
+	ep := arvados.EndpointLinkCreate
+	var resp arvados.Link
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
+func (conn *Conn) LinkList(ctx context.Context, options arvados.ListOptions) (arvados.LinkList, error) {
+	ep := arvados.EndpointLinkList
+	var resp arvados.LinkList
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
+func (conn *Conn) LinkDelete(ctx context.Context, options arvados.DeleteOptions) (arvados.Link, error) {
+	ep := arvados.EndpointLinkDelete
+	var resp arvados.Link
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
 type UserSessionAuthInfo struct {
 	UserUUID        string    `json:"user_uuid"`
 	Email           string    `json:"email"`
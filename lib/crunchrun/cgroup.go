@@ -12,22 +12,43 @@ import (
 
 // Return the current process's cgroup for the given subsystem.
 func findCgroup(subsystem string) string {
-	subsys := []byte(subsystem)
 	cgroups, err := ioutil.ReadFile("/proc/self/cgroup")
 	if err != nil {
 		log.Fatal(err)
 	}
+	cgroup, ok := parseCgroup(cgroups, subsystem)
+	if !ok {
+		log.Fatalf("subsystem %q not found in /proc/self/cgroup", subsystem)
+	}
+	return cgroup
+}
+
+// parseCgroup returns the cgroup for the given subsystem (controller)
+// listed in cgroups, which is the content of /proc/PID/cgroup.
+//
+// With cgroups v1, each line lists a hierarchy's controllers, like
+// "4:memory:/docker/abc". With cgroups v2, there is a single line
+// for the unified hierarchy, like "0::/system.slice/foo.service",
+// which is used for all subsystems. On "hybrid" systems with both
+// kinds of lines, the unified hierarchy is used only for subsystems
+// that are not in a v1 hierarchy.
+func parseCgroup(cgroups []byte, subsystem string) (string, bool) {
+	subsys := []byte(subsystem)
+	unified, haveUnified := "", false
 	for _, line := range bytes.Split(cgroups, []byte("\n")) {
-		toks := bytes.SplitN(line, []byte(":"), 4)
+		toks := bytes.SplitN(line, []byte(":"), 3)
 		if len(toks) < 3 {
 			continue
 		}
+		if len(toks[1]) == 0 && bytes.Equal(toks[0], []byte("0")) {
+			unified, haveUnified = string(toks[2]), true
+			continue
+		}
 		for _, s := range bytes.Split(toks[1], []byte(",")) {
 			if bytes.Compare(s, subsys) == 0 {
-				return string(toks[2])
+				return string(toks[2]), true
 			}
 		}
 	}
-	log.Fatalf("subsystem %q not found in /proc/self/cgroup", subsystem)
-	return ""
+	return unified, haveUnified
 }
@@ -19,3 +19,28 @@ func (s *CgroupSuite) TestFindCgroup(c *C) {
 		c.Logf("cgroup(%q) == %q", s, g)
 	}
 }
+
+func (s *CgroupSuite) TestParseCgroup(c *C) {
+	v1 := []byte("12:pids:/slurm/uid_0/job_1234\n4:cpu,cpuacct:/slurm/uid_0/job_1234/step_0\n1:name=systemd:/user.slice\n")
+	v2 := []byte("0::/system.slice/slurmstepd.scope/job_1234/step_0\n")
+	hybrid := []byte("4:memory:/docker/abc\n1:name=systemd:/\n0::/init.scope\n")
+	for _, trial := range []struct {
+		cgroups   []byte
+		subsystem string
+		cgroup    string
+		ok        bool
+	}{
+		{v1, "cpu", "/slurm/uid_0/job_1234/step_0", true},
+		{v1, "cpuacct", "/slurm/uid_0/job_1234/step_0", true},
+		{v1, "pids", "/slurm/uid_0/job_1234", true},
+		{v1, "memory", "", false},
+		{v2, "cpu", "/system.slice/slurmstepd.scope/job_1234/step_0", true},
+		{v2, "memory", "/system.slice/slurmstepd.scope/job_1234/step_0", true},
+		{hybrid, "memory", "/docker/abc", true},
+		{hybrid, "cpu", "/init.scope", true},
+	} {
+		cgroup, ok := parseCgroup(trial.cgroups, trial.subsystem)
+		c.Check(cgroup, Equals, trial.cgroup, Commentf("%q %s", trial.cgroups, trial.subsystem))
+		c.Check(ok, Equals, trial.ok)
+	}
+}
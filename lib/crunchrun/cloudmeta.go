@@ -0,0 +1,258 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// cloudInstanceInfo describes the cloud VM crunch-run is running on,
+// as reported by the cloud provider's instance metadata service.
+type cloudInstanceInfo struct {
+	Provider     string  `json:"provider"`
+	InstanceID   string  `json:"instance_id,omitempty"`
+	InstanceType string  `json:"instance_type,omitempty"`
+	Zone         string  `json:"zone,omitempty"`
+	Preemptible  bool    `json:"preemptible"`
+	Price        float64 `json:"price,omitempty"`
+}
+
+// Default metadata service URLs for each supported provider (see
+// -cloud-metadata).
+var cloudMetadataURLs = map[string]string{
+	"ec2":   "http://169.254.169.254",
+	"gce":   "http://metadata.google.internal",
+	"azure": "http://169.254.169.254",
+}
+
+// Time limit for each metadata service request. The service is
+// local, so it should respond quickly if it exists at all.
+const cloudMetadataTimeout = 5 * time.Second
+
+type cloudMetadataClient struct {
+	baseURL string
+	header  http.Header
+	client  *http.Client
+}
+
+func (mc *cloudMetadataClient) do(method, path string, hdr http.Header) (string, error) {
+	req, err := http.NewRequest(method, mc.baseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range mc.header {
+		req.Header[k] = v
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// getCloudInstanceInfo queries the given provider's instance
+// metadata service at baseURL ("" = the provider's default).
+//
+// If the dispatcher supplied an InstanceType config entry (see
+// LogNodeRecord), its price is included too, since metadata
+// services don't report prices.
+func getCloudInstanceInfo(provider, baseURL string) (*cloudInstanceInfo, error) {
+	if baseURL == "" {
+		baseURL = cloudMetadataURLs[provider]
+	}
+	mc := &cloudMetadataClient{
+		baseURL: baseURL,
+		header:  http.Header{},
+		client:  &http.Client{Timeout: cloudMetadataTimeout},
+	}
+	info := &cloudInstanceInfo{Provider: provider}
+	var err error
+	switch provider {
+	case "ec2":
+		err = mc.getEC2(info)
+	case "gce":
+		err = mc.getGCE(info)
+	case "azure":
+		err = mc.getAzure(info)
+	default:
+		err = fmt.Errorf("unsupported cloud metadata provider %q", provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if it := os.Getenv("InstanceType"); it != "" {
+		var itype arvados.InstanceType
+		if json.Unmarshal([]byte(it), &itype) == nil {
+			info.Price = itype.Price
+			info.Preemptible = info.Preemptible || itype.Preemptible
+		}
+	}
+	return info, nil
+}
+
+func (mc *cloudMetadataClient) getEC2(info *cloudInstanceInfo) error {
+	// Use an IMDSv2 session token if possible. If the PUT
+	// fails, the instance might only support IMDSv1, so carry on
+	// without one.
+	token, err := mc.do("PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"60"}})
+	if err == nil {
+		mc.header.Set("X-Aws-Ec2-Metadata-Token", token)
+	}
+	for _, f := range []struct {
+		path string
+		dst  *string
+	}{
+		{"instance-id", &info.InstanceID},
+		{"instance-type", &info.InstanceType},
+		{"placement/availability-zone", &info.Zone},
+	} {
+		*f.dst, err = mc.do("GET", "/latest/meta-data/"+f.path, nil)
+		if err != nil {
+			return err
+		}
+	}
+	// instance-life-cycle is "spot" or "on-demand". It's missing
+	// on some older instance types, which are never spot.
+	lifecycle, _ := mc.do("GET", "/latest/meta-data/instance-life-cycle", nil)
+	info.Preemptible = lifecycle == "spot"
+	return nil
+}
+
+func (mc *cloudMetadataClient) getGCE(info *cloudInstanceInfo) error {
+	mc.header.Set("Metadata-Flavor", "Google")
+	var preemptible string
+	for _, f := range []struct {
+		path string
+		dst  *string
+	}{
+		{"id", &info.InstanceID},
+		{"machine-type", &info.InstanceType},
+		{"zone", &info.Zone},
+		{"scheduling/preemptible", &preemptible},
+	} {
+		val, err := mc.do("GET", "/computeMetadata/v1/instance/"+f.path, nil)
+		if err != nil {
+			return err
+		}
+		// machine-type and zone are returned as
+		// "projects/{n}/machineTypes/{type}" and
+		// "projects/{n}/zones/{zone}".
+		*f.dst = path.Base(val)
+	}
+	info.Preemptible = preemptible == "TRUE"
+	return nil
+}
+
+func (mc *cloudMetadataClient) getAzure(info *cloudInstanceInfo) error {
+	mc.header.Set("Metadata", "true")
+	body, err := mc.do("GET", "/metadata/instance/compute?api-version=2021-02-01", nil)
+	if err != nil {
+		return err
+	}
+	var compute struct {
+		VMID     string `json:"vmId"`
+		VMSize   string `json:"vmSize"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		Priority string `json:"priority"`
+	}
+	err = json.Unmarshal([]byte(body), &compute)
+	if err != nil {
+		return fmt.Errorf("error decoding azure instance metadata: %s", err)
+	}
+	info.InstanceID = compute.VMID
+	info.InstanceType = compute.VMSize
+	info.Zone = compute.Location
+	if compute.Zone != "" {
+		info.Zone += "-" + compute.Zone
+	}
+	info.Preemptible = compute.Priority == "Spot" || compute.Priority == "Low"
+	return nil
+}
+
+// logCloudInstanceInfo writes the cloud instance metadata to w (the
+// node-info log) and saves it in the "cloud_instance" property of
+// the container's requests, for cost attribution. Errors are logged
+// but otherwise ignored: the container can run without this info.
+func (runner *ContainerRunner) logCloudInstanceInfo(w io.Writer) {
+	fmt.Fprintln(w, "Cloud Instance Metadata")
+	info, err := getCloudInstanceInfo(runner.cloudMetadataProvider, runner.cloudMetadataURL)
+	if err != nil {
+		fmt.Fprintf(w, "error getting %s instance metadata: %s\n\n", runner.cloudMetadataProvider, err)
+		return
+	}
+	fmt.Fprintf(w, "provider: %s\n", info.Provider)
+	fmt.Fprintf(w, "instance_id: %s\n", info.InstanceID)
+	fmt.Fprintf(w, "instance_type: %s\n", info.InstanceType)
+	fmt.Fprintf(w, "zone: %s\n", info.Zone)
+	fmt.Fprintf(w, "preemptible: %v\n", info.Preemptible)
+	if info.Price > 0 {
+		fmt.Fprintf(w, "price: %v\n", info.Price)
+	}
+	fmt.Fprintln(w, "")
+	runner.saveCloudInstanceInfo(info)
+}
+
+// saveCloudInstanceInfo adds the cloud instance info to the
+// properties of each request for the container. The API server
+// merges it into the existing properties, so concurrent changes to
+// other properties aren't lost.
+func (runner *ContainerRunner) saveCloudInstanceInfo(info *cloudInstanceInfo) {
+	var props map[string]interface{}
+	buf, _ := json.Marshal(info)
+	json.Unmarshal(buf, &props)
+
+	for offset := 0; ; {
+		var crs arvados.ContainerRequestList
+		err := runner.DispatcherArvClient.Call("GET", "container_requests", "", "", arvadosclient.Dict{
+			"filters": [][]interface{}{{"container_uuid", "=", runner.Container.UUID}},
+			"select":  []string{"uuid"},
+			"order":   "uuid",
+			"offset":  offset,
+			"limit":   1000,
+		}, &crs)
+		if err != nil {
+			runner.CrunchLog.Printf("error listing container requests to save cloud instance info: %s", err)
+			return
+		}
+		for _, cr := range crs.Items {
+			err = runner.DispatcherArvClient.Update("container_requests", cr.UUID, arvadosclient.Dict{
+				"merge_properties": true,
+				"container_request": arvadosclient.Dict{
+					"properties": map[string]interface{}{"cloud_instance": props},
+				},
+			}, nil)
+			if err != nil {
+				runner.CrunchLog.Printf("error saving cloud instance info in container request %s: %s", cr.UUID, err)
+			}
+		}
+		offset += len(crs.Items)
+		if len(crs.Items) == 0 || offset >= crs.ItemsAvailable {
+			break
+		}
+	}
+}
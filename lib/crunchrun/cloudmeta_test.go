@@ -0,0 +1,180 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CloudMetadataSuite{})
+
+type CloudMetadataSuite struct{}
+
+// stubMetadataServer responds to GET requests for the given paths,
+// if the request has the given header.
+func stubMetadataServer(c *C, hdr, hdrValue string, paths map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" && req.URL.Path == "/latest/api/token" {
+			w.Write([]byte("ec2token"))
+			return
+		}
+		if req.Header.Get(hdr) != hdrValue {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, ok := paths[req.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func (s *CloudMetadataSuite) TestEC2(c *C) {
+	srv := stubMetadataServer(c, "X-Aws-Ec2-Metadata-Token", "ec2token", map[string]string{
+		"/latest/meta-data/instance-id":                 "i-0123456789abcdef0",
+		"/latest/meta-data/instance-type":               "m5.large",
+		"/latest/meta-data/placement/availability-zone": "us-east-1a",
+		"/latest/meta-data/instance-life-cycle":         "spot",
+	})
+	defer srv.Close()
+	defer os.Unsetenv("InstanceType")
+	os.Setenv("InstanceType", `{"Name":"m5large","ProviderType":"m5.large","Price":0.096,"Preemptible":true}`)
+	info, err := getCloudInstanceInfo("ec2", srv.URL)
+	c.Assert(err, IsNil)
+	c.Check(*info, DeepEquals, cloudInstanceInfo{
+		Provider:     "ec2",
+		InstanceID:   "i-0123456789abcdef0",
+		InstanceType: "m5.large",
+		Zone:         "us-east-1a",
+		Preemptible:  true,
+		Price:        0.096,
+	})
+}
+
+func (s *CloudMetadataSuite) TestGCE(c *C) {
+	srv := stubMetadataServer(c, "Metadata-Flavor", "Google", map[string]string{
+		"/computeMetadata/v1/instance/id":                     "1234567890",
+		"/computeMetadata/v1/instance/machine-type":           "projects/123/machineTypes/n1-standard-4",
+		"/computeMetadata/v1/instance/zone":                   "projects/123/zones/us-central1-b",
+		"/computeMetadata/v1/instance/scheduling/preemptible": "FALSE",
+	})
+	defer srv.Close()
+	info, err := getCloudInstanceInfo("gce", srv.URL)
+	c.Assert(err, IsNil)
+	c.Check(*info, DeepEquals, cloudInstanceInfo{
+		Provider:     "gce",
+		InstanceID:   "1234567890",
+		InstanceType: "n1-standard-4",
+		Zone:         "us-central1-b",
+	})
+}
+
+func (s *CloudMetadataSuite) TestAzure(c *C) {
+	srv := stubMetadataServer(c, "Metadata", "true", map[string]string{
+		"/metadata/instance/compute?api-version=2021-02-01": `{"vmId":"02aab8a4-74ef-476e-8182-f6d2ba4166a6","vmSize":"Standard_D2s_v3","location":"eastus","zone":"2","priority":"Spot"}`,
+	})
+	defer srv.Close()
+	info, err := getCloudInstanceInfo("azure", srv.URL)
+	c.Assert(err, IsNil)
+	c.Check(*info, DeepEquals, cloudInstanceInfo{
+		Provider:     "azure",
+		InstanceID:   "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+		InstanceType: "Standard_D2s_v3",
+		Zone:         "eastus-2",
+		Preemptible:  true,
+	})
+}
+
+func (s *CloudMetadataSuite) TestErrors(c *C) {
+	srv := stubMetadataServer(c, "Metadata-Flavor", "Google", nil)
+	defer srv.Close()
+	_, err := getCloudInstanceInfo("gce", srv.URL)
+	c.Check(err, ErrorMatches, `GET /computeMetadata/v1/instance/id: 404 Not Found`)
+	_, err = getCloudInstanceInfo("ec2", srv.URL)
+	c.Check(err, ErrorMatches, `GET /latest/meta-data/instance-id: 403 Forbidden`)
+	_, err = getCloudInstanceInfo("openstack", srv.URL)
+	c.Check(err, ErrorMatches, `unsupported cloud metadata provider "openstack"`)
+}
+
+func (s *TestSuite) TestLogCloudInstanceInfo(c *C) {
+	srv := stubMetadataServer(c, "Metadata-Flavor", "Google", map[string]string{
+		"/computeMetadata/v1/instance/id":                     "1234567890",
+		"/computeMetadata/v1/instance/machine-type":           "projects/123/machineTypes/n1-standard-4",
+		"/computeMetadata/v1/instance/zone":                   "projects/123/zones/us-central1-b",
+		"/computeMetadata/v1/instance/scheduling/preemptible": "TRUE",
+	})
+	defer srv.Close()
+
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	api := &ArvTestClient{}
+	cr, err := NewContainerRunner(s.client, api, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.cloudMetadataProvider = "gce"
+	cr.cloudMetadataURL = srv.URL
+
+	var buf bytes.Buffer
+	cr.logCloudInstanceInfo(&buf)
+	c.Check(buf.String(), Equals, "Cloud Instance Metadata\nprovider: gce\ninstance_id: 1234567890\ninstance_type: n1-standard-4\nzone: us-central1-b\npreemptible: true\n\n")
+
+	c.Assert(api.Content, HasLen, 1)
+	c.Check(api.Content[0]["merge_properties"], Equals, true)
+	props := api.Content[0]["container_request"].(arvadosclient.Dict)["properties"].(map[string]interface{})
+	c.Check(props, DeepEquals, map[string]interface{}{
+		"cloud_instance": map[string]interface{}{
+			"provider":      "gce",
+			"instance_id":   "1234567890",
+			"instance_type": "n1-standard-4",
+			"zone":          "us-central1-b",
+			"preemptible":   true,
+		},
+	})
+}
+
+// pagingArvTestClient returns the container requests one page at a
+// time.
+type pagingArvTestClient struct {
+	ArvTestClient
+	requests []string
+	pageSize int
+}
+
+func (client *pagingArvTestClient) Call(method, resourceType, uuid, action string, parameters arvadosclient.Dict, output interface{}) error {
+	if method != "GET" || resourceType != "container_requests" {
+		return client.ArvTestClient.Call(method, resourceType, uuid, action, parameters, output)
+	}
+	crs := output.(*arvados.ContainerRequestList)
+	for i := parameters["offset"].(int); i < len(client.requests) && len(crs.Items) < client.pageSize; i++ {
+		crs.Items = append(crs.Items, arvados.ContainerRequest{UUID: client.requests[i]})
+	}
+	crs.ItemsAvailable = len(client.requests)
+	return nil
+}
+
+func (s *TestSuite) TestSaveCloudInstanceInfoPaging(c *C) {
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	api := &pagingArvTestClient{pageSize: 2}
+	for i := 0; i < 5; i++ {
+		api.requests = append(api.requests, fmt.Sprintf("zzzzz-xvhdp-%015d", i))
+	}
+	cr, err := NewContainerRunner(s.client, api, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.saveCloudInstanceInfo(&cloudInstanceInfo{Provider: "ec2", InstanceID: "i-123"})
+	c.Check(api.Content, HasLen, 5)
+	for _, p := range api.Content {
+		c.Check(p["merge_properties"], Equals, true)
+	}
+}
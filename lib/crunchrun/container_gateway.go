@@ -10,6 +10,7 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -20,6 +21,7 @@ import (
 	"syscall"
 
 	"git.arvados.org/arvados.git/lib/selfsigned"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
 	"github.com/creack/pty"
 	"github.com/google/shlex"
@@ -31,9 +33,13 @@ type Gateway struct {
 	ContainerUUID     string
 	Address           string // listen host:port; if port=0, Start() will change it to the selected port
 	AuthSecret        string
+	RuntimeEngine     string // command used for exec sessions: "docker" (default) or "podman"
 	Log               interface {
 		Printf(fmt string, args ...interface{})
 	}
+	// If not nil, SnapshotOutput is called to handle requests to
+	// save a snapshot of the container's output directory.
+	SnapshotOutput func() (arvados.Collection, error)
 
 	sshConfig   ssh.ServerConfig
 	requestAuth string
@@ -99,7 +105,7 @@ func (gw *Gateway) Start() error {
 
 	srv := &httpserver.Server{
 		Server: http.Server{
-			Handler: http.HandlerFunc(gw.handleSSH),
+			Handler: http.HandlerFunc(gw.handle),
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
 			},
@@ -124,6 +130,58 @@ func (gw *Gateway) Start() error {
 	return nil
 }
 
+func (gw *Gateway) handle(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/snapshot":
+		gw.handleSnapshot(w, req)
+	default:
+		gw.handleSSH(w, req)
+	}
+}
+
+// checkRequest checks the X-Arvados-Target-Uuid and
+// X-Arvados-Authorization headers (see handleSSH). If they are not
+// acceptable, it sends an error response and returns false.
+func (gw *Gateway) checkRequest(w http.ResponseWriter, req *http.Request) bool {
+	if want := req.Header.Get("X-Arvados-Target-Uuid"); want != gw.ContainerUUID {
+		http.Error(w, fmt.Sprintf("misdirected request: meant for %q but received by crunch-run %q", want, gw.ContainerUUID), http.StatusBadGateway)
+		return false
+	}
+	if req.Header.Get("X-Arvados-Authorization") != gw.requestAuth {
+		http.Error(w, "bad X-Arvados-Authorization header", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleSnapshot saves a snapshot of the container's output directory
+// and responds with the resulting collection record.
+//
+// Requests must have method POST, path "/snapshot", and the same
+// X-Arvados-Target-Uuid and X-Arvados-Authorization headers as
+// handleSSH.
+func (gw *Gateway) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !gw.checkRequest(w, req) {
+		return
+	}
+	w.Header().Set("X-Arvados-Authorization-Response", gw.respondAuth)
+	if gw.SnapshotOutput == nil {
+		http.Error(w, "output snapshots are not supported", http.StatusNotImplemented)
+		return
+	}
+	coll, err := gw.SnapshotOutput()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coll)
+}
+
 // handleSSH connects to an SSH server that allows the caller to run
 // interactive commands as root (or any other desired user) inside the
 // container. The tunnel itself can only be created by an
@@ -153,12 +211,7 @@ func (gw *Gateway) handleSSH(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "path not found", http.StatusNotFound)
 		return
 	}
-	if want := req.Header.Get("X-Arvados-Target-Uuid"); want != gw.ContainerUUID {
-		http.Error(w, fmt.Sprintf("misdirected request: meant for %q but received by crunch-run %q", want, gw.ContainerUUID), http.StatusBadGateway)
-		return
-	}
-	if req.Header.Get("X-Arvados-Authorization") != gw.requestAuth {
-		http.Error(w, "bad X-Arvados-Authorization header", http.StatusUnauthorized)
+	if !gw.checkRequest(w, req) {
 		return
 	}
 	detachKeys := req.Header.Get("X-Arvados-Detach-Keys")
@@ -232,7 +285,11 @@ func (gw *Gateway) handleSSH(w http.ResponseWriter, req *http.Request) {
 						execargs = []string{"/bin/bash", "-login"}
 					}
 					go func() {
-						cmd := exec.CommandContext(ctx, "docker", "exec", "-i", "--detach-keys="+detachKeys, "--user="+username)
+						engine := gw.RuntimeEngine
+						if engine == "" {
+							engine = "docker"
+						}
+						cmd := exec.CommandContext(ctx, engine, "exec", "-i", "--detach-keys="+detachKeys, "--user="+username)
 						cmd.Stdin = ch
 						cmd.Stdout = ch
 						cmd.Stderr = ch.Stderr()
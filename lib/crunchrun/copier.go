@@ -5,14 +5,19 @@
 package crunchrun
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
@@ -25,8 +30,24 @@ type printfer interface {
 
 var errTooManySymlinks = errors.New("too many symlinks, or symlink cycle")
 
+var errOutputTooLarge = errors.New("output is too large")
+
 const limitFollowSymlinks = 10
 
+// Output files smaller than this are always uploaded, even if an
+// identical file exists in an input collection: small files are
+// cheap to upload and get packed into shared blocks anyway.
+var dedupMinFileSize int64 = 1 << 20
+
+// Maximum number of input files of the same size to compare against
+// each output file.
+const dedupMaxCandidates = 4
+
+// Number of output blocks written to Keep concurrently if
+// uploadThreads is not set. This matches the number of background
+// writers used by the collection filesystem.
+const defaultUploadThreads = 4
+
 type filetodo struct {
 	src  string
 	dst  string
@@ -46,6 +67,24 @@ type filetodo struct {
 // Symlinks to other parts of the container's filesystem result in
 // errors.
 //
+// Regular files whose content is identical to a file in a read-only
+// collection mount are not uploaded again: the output manifest
+// references the existing data instead (see dedupFiles).
+//
+// Up to uploadThreads (default defaultUploadThreads) blocks are
+// written to Keep concurrently, and the next file is read while
+// earlier blocks (including the last block of the previous
+// directory) are being written. If uploadThreads is 1, each block is
+// written before reading more data.
+//
+// If maxOutputSize is greater than zero, the walk stops with an
+// errOutputTooLarge error, before anything is uploaded, as soon as
+// the total size of the regular files to copy exceeds maxOutputSize.
+// Data that is already stored in Keep (mounted collections) is not
+// counted, except for the writable collection mounted at ctrOutputDir
+// if countOutputCollection is true (see -output-arv-mount), because
+// its data was all written by the container.
+//
 // Use:
 //
 //	manifest, err := (&copier{...}).Copy()
@@ -59,21 +98,39 @@ type copier struct {
 	mounts        map[string]arvados.Mount
 	secretMounts  map[string]arvados.Mount
 	logger        printfer
+	uploadThreads int
+	maxOutputSize int64
+
+	countOutputCollection bool
 
-	dirs     []string
-	files    []filetodo
-	manifest string
+	dirs      []string
+	files     []filetodo
+	filesSize int64
+	manifest  string
 
 	manifestCache map[string]*manifest.Manifest
 }
 
 // Copy copies data as needed, and returns a new manifest.
+//
+// The manifest is normalized (streams and files are sorted by name),
+// and the results don't depend on the order files are found in, so
+// copying identical output directories always produces the same
+// portable data hash.
 func (cp *copier) Copy() (string, error) {
 	err := cp.walkMount("", cp.ctrOutputDir, limitFollowSymlinks, true)
 	if err != nil {
-		return "", fmt.Errorf("error scanning files to copy to output: %v", err)
+		return "", fmt.Errorf("error scanning files to copy to output: %w", err)
+	}
+	err = cp.dedupFiles()
+	if err != nil {
+		return "", fmt.Errorf("error checking output files for duplicate input data: %v", err)
 	}
-	fs, err := (&arvados.Collection{ManifestText: cp.manifest}).FileSystem(cp.client, cp.keepClient)
+	streams, err := cp.copyFiles()
+	if err != nil {
+		return "", err
+	}
+	fs, err := (&arvados.Collection{ManifestText: cp.manifest + streams}).FileSystem(cp.client, cp.keepClient)
 	if err != nil {
 		return "", fmt.Errorf("error creating Collection.FileSystem: %v", err)
 	}
@@ -83,49 +140,120 @@ func (cp *copier) Copy() (string, error) {
 			return "", fmt.Errorf("error making directory %q in output collection: %v", d, err)
 		}
 	}
-	var unflushed int64
-	var lastparentdir string
+	return fs.MarshalManifest(".")
+}
+
+// copyFiles uploads cp.files, and returns manifest text referencing
+// the uploaded data.
+//
+// Files in the same directory are written to the same stream, so
+// small files get packed into shared blocks. Files are written in
+// order of directory and then filename, regardless of the order they
+// were found in, so identical output directories always produce the
+// same blocks (and the same portable data hash).
+func (cp *copier) copyFiles() (string, error) {
+	sort.Slice(cp.files, func(i, j int) bool {
+		diri, dirj := path.Dir(cp.files[i].dst), path.Dir(cp.files[j].dst)
+		if diri != dirj {
+			return diri < dirj
+		}
+		return cp.files[i].dst < cp.files[j].dst
+	})
+	// writers limits the number of blocks being written, and
+	// finishing limits the number of streams being finished in
+	// the background (each of which may be holding a partial
+	// block in memory).
+	threads := cp.uploadThreads
+	if threads < 1 {
+		threads = defaultUploadThreads
+	}
+	var writers, finishing chan struct{}
+	if threads > 1 {
+		writers = make(chan struct{}, threads)
+		finishing = make(chan struct{}, threads)
+	}
+	// Each stream's text is filled in by finish, possibly in a
+	// background goroutine. The first error is kept in finishErr.
+	var texts []*string
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var finishErr error
+	finish := func(sw *keepclient.StreamWriter) {
+		text := new(string)
+		texts = append(texts, text)
+		fin := func() {
+			t, err := sw.Finish()
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil && finishErr == nil {
+				finishErr = fmt.Errorf("error writing output collection file data: %v", err)
+			}
+			*text = t
+		}
+		if writers == nil {
+			fin()
+			return
+		}
+		finishing <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-finishing }()
+			fin()
+		}()
+	}
+	var sw *keepclient.StreamWriter
 	for _, f := range cp.files {
-		// If a dir has just had its last file added, do a
-		// full Flush. Otherwise, do a partial Flush (write
-		// full-size blocks, but leave the last short block
-		// open so f's data can be packed with it).
-		dir, _ := filepath.Split(f.dst)
-		if dir != lastparentdir || unflushed > keepclient.BLOCKSIZE {
-			if err := fs.Flush("/"+lastparentdir, dir != lastparentdir); err != nil {
-				return "", fmt.Errorf("error flushing output collection file data: %v", err)
+		dir, name := path.Split(f.dst)
+		stream := "." + strings.TrimSuffix(dir, "/")
+		if sw == nil || sw.Name() != stream {
+			if sw != nil {
+				finish(sw)
+			}
+			mtx.Lock()
+			err := finishErr
+			mtx.Unlock()
+			if err != nil {
+				wg.Wait()
+				return "", err
 			}
-			unflushed = 0
+			sw = keepclient.NewStreamWriter(cp.keepClient, stream)
+			sw.Writers = writers
 		}
-		lastparentdir = dir
-
-		n, err := cp.copyFile(fs, f)
+		err := cp.copyFile(sw, name, f)
 		if err != nil {
+			if writers != nil {
+				// Wait for this stream's background
+				// writes, too.
+				sw.Finish()
+			}
+			wg.Wait()
 			return "", fmt.Errorf("error copying file %q into output collection: %v", f, err)
 		}
-		unflushed += n
 	}
-	return fs.MarshalManifest(".")
+	if sw != nil {
+		finish(sw)
+	}
+	wg.Wait()
+	if finishErr != nil {
+		return "", finishErr
+	}
+	var streams strings.Builder
+	for _, text := range texts {
+		streams.WriteString(*text)
+	}
+	return streams.String(), nil
 }
 
-func (cp *copier) copyFile(fs arvados.CollectionFileSystem, f filetodo) (int64, error) {
+func (cp *copier) copyFile(sw *keepclient.StreamWriter, name string, f filetodo) error {
 	cp.logger.Printf("copying %q (%d bytes)", f.dst, f.size)
-	dst, err := fs.OpenFile(f.dst, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return 0, err
-	}
 	src, err := os.Open(f.src)
 	if err != nil {
-		dst.Close()
-		return 0, err
+		return err
 	}
 	defer src.Close()
-	n, err := io.Copy(dst, src)
-	if err != nil {
-		dst.Close()
-		return n, err
-	}
-	return n, dst.Close()
+	_, err = sw.WriteFile(name, src, f.size)
+	return err
 }
 
 // Append to cp.manifest, cp.files, and cp.dirs so as to copy src (an
@@ -191,7 +319,14 @@ func (cp *copier) walkMount(dest, src string, maxSymlinks int, walkMountsBelow b
 			return err
 		}
 		mft := manifest.Manifest{Text: coll.ManifestText}
-		cp.manifest += mft.Extract(srcRelPath, dest).Text
+		txt := mft.Extract(srcRelPath, dest).Text
+		if cp.countOutputCollection && srcRoot == cp.ctrOutputDir {
+			cp.filesSize += manifestFilesSize(txt)
+			if cp.maxOutputSize > 0 && cp.filesSize > cp.maxOutputSize {
+				return fmt.Errorf("%w: files in output directory exceed maximum output size %d bytes (at %q)", errOutputTooLarge, cp.maxOutputSize, dest)
+			}
+		}
+		cp.manifest += txt
 	}
 	if walkMountsBelow {
 		return cp.walkMountsBelow(dest, src)
@@ -199,11 +334,37 @@ func (cp *copier) walkMount(dest, src string, maxSymlinks int, walkMountsBelow b
 	return nil
 }
 
+// manifestFilesSize returns the total size of the file segments in a
+// manifest.
+func manifestFilesSize(txt string) int64 {
+	var size int64
+	for _, line := range strings.Split(txt, "\n") {
+		for _, tok := range strings.Split(line, " ")[1:] {
+			parts := strings.SplitN(tok, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			if n, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+				size += n
+			}
+		}
+	}
+	return size
+}
+
 func (cp *copier) walkMountsBelow(dest, src string) error {
-	for mnt, mntinfo := range cp.mounts {
-		if !strings.HasPrefix(mnt, src+"/") {
-			continue
+	// Walk mounts in sorted order, so the resulting manifest
+	// (and the order of cp.files) doesn't depend on map
+	// iteration order.
+	var mnts []string
+	for mnt := range cp.mounts {
+		if strings.HasPrefix(mnt, src+"/") {
+			mnts = append(mnts, mnt)
 		}
+	}
+	sort.Strings(mnts)
+	for _, mnt := range mnts {
+		mntinfo := cp.mounts[mnt]
 		if cp.copyRegularFiles(mntinfo) {
 			// These got copied into the nearest parent
 			// mount as regular files during setup, so
@@ -329,6 +490,10 @@ func (cp *copier) walkHostFS(dest, src string, maxSymlinks int, includeMounts bo
 			dst:  dest,
 			size: fi.Size(),
 		})
+		cp.filesSize += fi.Size()
+		if cp.maxOutputSize > 0 && cp.filesSize > cp.maxOutputSize {
+			return fmt.Errorf("%w: files in output directory exceed maximum output size %d bytes (at %q)", errOutputTooLarge, cp.maxOutputSize, dest)
+		}
 		return nil
 	}
 
@@ -371,3 +536,205 @@ func (cp *copier) getManifest(pdh string) (*manifest.Manifest, error) {
 	}
 	return mft, nil
 }
+
+// dedupCandidate is a file in a read-only input collection.
+type dedupCandidate struct {
+	pdh  string
+	mft  *manifest.Manifest
+	path string // path within the collection, like "./dir/file.txt"
+}
+
+// dedupFiles removes entries from cp.files whose content is
+// identical to a file in a read-only collection mount, and appends
+// manifest text referencing the existing data to cp.manifest
+// instead.
+//
+// Candidates are found by file size. A candidate is accepted only
+// after verifying the entire local file against it: segments that
+// cover entire blocks are checked by comparing the MD5 hash of the
+// local data with the block locator, so they don't need to be read
+// from Keep; other segments are read from Keep and compared
+// byte-by-byte. A few sampled whole-block segments are checked first
+// so most mismatches are rejected cheaply.
+func (cp *copier) dedupFiles() error {
+	index, err := cp.dedupIndex()
+	if err != nil || len(index) == 0 {
+		return err
+	}
+	todo := cp.files[:0]
+	for _, f := range cp.files {
+		cands := index[f.size]
+		if f.size < dedupMinFileSize || len(cands) == 0 {
+			todo = append(todo, f)
+			continue
+		}
+		found := false
+		for _, cand := range cands {
+			same, err := cp.sameContent(f, cand)
+			if err != nil {
+				cp.logger.Printf("error comparing %q with %s %q, will upload: %s", f.dst, cand.pdh, cand.path, err)
+				break
+			}
+			if same {
+				cp.logger.Printf("reusing data from %s %q for %q (%d bytes)", cand.pdh, cand.path, f.dst, f.size)
+				cp.manifest += cand.mft.Extract(cand.path, f.dst).Text
+				found = true
+				break
+			}
+		}
+		if !found {
+			todo = append(todo, f)
+		}
+	}
+	cp.files = todo
+	return nil
+}
+
+// dedupIndex returns the files in read-only collection mounts,
+// grouped by size. Only files at least dedupMinFileSize bytes long
+// are included, and at most dedupMaxCandidates per size.
+func (cp *copier) dedupIndex() (map[int64][]dedupCandidate, error) {
+	var roots []string
+	for root, mnt := range cp.mounts {
+		if mnt.Kind == "collection" && !mnt.Writable && mnt.PortableDataHash != "" {
+			roots = append(roots, root)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	sort.Strings(roots)
+	wantSize := map[int64]bool{}
+	for _, f := range cp.files {
+		if f.size >= dedupMinFileSize {
+			wantSize[f.size] = true
+		}
+	}
+	if len(wantSize) == 0 {
+		return nil, nil
+	}
+	index := map[int64][]dedupCandidate{}
+	seen := map[string]bool{}
+	for _, root := range roots {
+		pdh := cp.mounts[root].PortableDataHash
+		if seen[pdh] {
+			continue
+		}
+		seen[pdh] = true
+		mft, err := cp.getManifest(pdh)
+		if err != nil {
+			return nil, err
+		}
+		sizes := map[string]int64{}
+		var paths []string
+		var streamErr error
+		for stream := range mft.StreamIter() {
+			if stream.Err != nil && streamErr == nil {
+				streamErr = stream.Err
+			}
+			for _, seg := range stream.FileStreamSegments {
+				path := stream.StreamName + "/" + seg.Name
+				if _, ok := sizes[path]; !ok {
+					paths = append(paths, path)
+				}
+				sizes[path] += int64(seg.SegLen)
+			}
+		}
+		if streamErr != nil {
+			return nil, fmt.Errorf("error parsing manifest for %s: %s", pdh, streamErr)
+		}
+		for _, path := range paths {
+			size := sizes[path]
+			if wantSize[size] && len(index[size]) < dedupMaxCandidates {
+				index[size] = append(index[size], dedupCandidate{pdh: pdh, mft: mft, path: path})
+			}
+		}
+	}
+	return index, nil
+}
+
+// sameContent returns true if the local file f has the same content
+// as cand.
+func (cp *copier) sameContent(f filetodo, cand dedupCandidate) (bool, error) {
+	type segment struct {
+		*manifest.FileSegment
+		pos       int64 // position of segment in file
+		wholeSize bool  // segment covers the entire block
+	}
+	var segs []segment
+	var size int64
+	for seg := range cand.mft.FileSegmentIterByName(cand.path) {
+		if seg.Len == 0 {
+			continue
+		}
+		blk, err := manifest.ParseBlockLocator(seg.Locator)
+		if err != nil {
+			return false, err
+		}
+		segs = append(segs, segment{
+			FileSegment: seg,
+			pos:         size,
+			wholeSize:   seg.Offset == 0 && seg.Len == blk.Size,
+		})
+		size += int64(seg.Len)
+	}
+	if size != f.size {
+		return false, nil
+	}
+
+	src, err := os.Open(f.src)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	check := func(seg segment) (bool, error) {
+		local := io.NewSectionReader(src, seg.pos, int64(seg.Len))
+		if seg.wholeSize {
+			h := md5.New()
+			if _, err := io.Copy(h, local); err != nil {
+				return false, err
+			}
+			return fmt.Sprintf("%x", h.Sum(nil)) == seg.Locator[:32], nil
+		}
+		localbuf := make([]byte, seg.Len)
+		if _, err := io.ReadFull(local, localbuf); err != nil {
+			return false, err
+		}
+		keepbuf := make([]byte, seg.Len)
+		n, err := cp.keepClient.ReadAt(seg.Locator, keepbuf, seg.Offset)
+		if err != nil && !(err == io.EOF && n == len(keepbuf)) {
+			return false, err
+		}
+		return bytes.Equal(localbuf, keepbuf[:n]), nil
+	}
+
+	// Check the first, middle, and last whole-block segments
+	// before anything else.
+	var whole []int
+	for i, seg := range segs {
+		if seg.wholeSize {
+			whole = append(whole, i)
+		}
+	}
+	checked := map[int]bool{}
+	if len(whole) > 0 {
+		for _, i := range []int{whole[0], whole[len(whole)/2], whole[len(whole)-1]} {
+			if checked[i] {
+				continue
+			}
+			checked[i] = true
+			if ok, err := check(segs[i]); !ok || err != nil {
+				return false, err
+			}
+		}
+	}
+	for i, seg := range segs {
+		if checked[i] {
+			continue
+		}
+		if ok, err := check(seg); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -5,13 +5,20 @@
 package crunchrun
 
 import (
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/manifest"
 	check "gopkg.in/check.v1"
 )
 
@@ -69,6 +76,22 @@ func (s *copierSuite) TestRegularFilesAndDirs(c *check.C) {
 	})
 }
 
+func (s *copierSuite) TestMaxOutputSize(c *check.C) {
+	s.writeFileInOutputDir(c, "foo", "foo")
+	s.writeFileInOutputDir(c, "bar", "barbar")
+
+	s.cp.maxOutputSize = 9
+	err := s.cp.walkMount("", s.cp.ctrOutputDir, 10, true)
+	c.Check(err, check.IsNil)
+	c.Check(s.cp.filesSize, check.Equals, int64(9))
+
+	s.cp.files, s.cp.filesSize = nil, 0
+	s.cp.maxOutputSize = 8
+	_, err = s.cp.Copy()
+	c.Check(errors.Is(err, errOutputTooLarge), check.Equals, true)
+	c.Check(err, check.ErrorMatches, `.*exceed maximum output size 8 bytes \(at "/foo"\)`)
+}
+
 func (s *copierSuite) TestSymlinkCycle(c *check.C) {
 	c.Assert(os.Mkdir(s.cp.hostOutputDir+"/dir1", 0755), check.IsNil)
 	c.Assert(os.Mkdir(s.cp.hostOutputDir+"/dir2", 0755), check.IsNil)
@@ -213,6 +236,174 @@ func (s *copierSuite) TestWritableMountBelow(c *check.C) {
 	})
 }
 
+// dedupKeepClient serves blocks from memory.
+type dedupKeepClient struct {
+	KeepTestClient
+	blocks map[string][]byte
+}
+
+func (kc *dedupKeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
+	blk, ok := kc.blocks[locator[:32]]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return copy(p, blk[off:]), nil
+}
+
+func (s *copierSuite) TestDedupFiles(c *check.C) {
+	defer func(orig int64) { dedupMinFileSize = orig }(dedupMinFileSize)
+	dedupMinFileSize = 4
+
+	blkA, blkB := []byte("0123456789"), []byte("abcdefXYZ")
+	locA, locB := fmt.Sprintf("%x+10", md5.Sum(blkA)), fmt.Sprintf("%x+9", md5.Sum(blkB))
+	kc := &dedupKeepClient{blocks: map[string][]byte{locA[:32]: blkA, locB[:32]: blkB}}
+	s.cp.keepClient = kc
+	s.cp.logger = ctxlog.TestLogger(c)
+	s.cp.mounts["/mnt"] = arvados.Mount{Kind: "collection", PortableDataHash: "fake-input-pdh"}
+	s.cp.manifestCache = map[string]*manifest.Manifest{
+		"fake-input-pdh": {Text: ". " + locA + " " + locB + " 0:16:input.txt 16:3:xyz.txt\n"},
+	}
+
+	s.writeFileInOutputDir(c, "same.txt", "0123456789abcdef")
+	s.writeFileInOutputDir(c, "diff-partial.txt", "0123456789abcdeg")
+	s.writeFileInOutputDir(c, "diff-whole.txt", "x123456789abcdef")
+	s.writeFileInOutputDir(c, "xyz.txt", "XYZ")
+
+	err := s.cp.walkMount("", s.cp.ctrOutputDir, 10, true)
+	c.Assert(err, check.IsNil)
+	err = s.cp.dedupFiles()
+	c.Assert(err, check.IsNil)
+	c.Check(s.cp.manifest, check.Equals, ". "+locA+" "+locB+" 0:16:same.txt\n")
+	var uploads []string
+	for _, f := range s.cp.files {
+		uploads = append(uploads, f.dst)
+	}
+	c.Check(uploads, check.DeepEquals, []string{"/diff-partial.txt", "/diff-whole.txt", "/xyz.txt"})
+}
+
+func (s *copierSuite) TestCopyFilesPacking(c *check.C) {
+	s.cp.keepClient = &KeepTestClient{}
+	s.cp.logger = ctxlog.TestLogger(c)
+	c.Assert(os.Mkdir(s.cp.hostOutputDir+"/dir1", 0755), check.IsNil)
+	s.writeFileInOutputDir(c, "dir1/a", "aaa")
+	s.writeFileInOutputDir(c, "b", "bbb")
+	s.writeFileInOutputDir(c, "dir1/c", "ccc")
+	s.cp.files = []filetodo{
+		{src: s.cp.hostOutputDir + "/dir1/a", dst: "/dir1/a", size: 3},
+		{src: s.cp.hostOutputDir + "/b", dst: "/b", size: 3},
+		{src: s.cp.hostOutputDir + "/dir1/c", dst: "/dir1/c", size: 3},
+		{src: os.DevNull, dst: "/dir1/dir2/.keep"},
+	}
+	streams, err := s.cp.copyFiles()
+	c.Assert(err, check.IsNil)
+	// Files in the same directory share a block, even if they
+	// weren't found consecutively.
+	c.Check(streams, check.Equals, fmt.Sprintf(". %x+3 0:3:b\n./dir1 %x+6 0:3:a 3:3:c\n./dir1/dir2 d41d8cd98f00b204e9800998ecf8427e+0 0:0:.keep\n", md5.Sum([]byte("bbb")), md5.Sum([]byte("aaaccc"))))
+}
+
+func (s *copierSuite) TestCopyFilesOrder(c *check.C) {
+	s.cp.keepClient = &KeepTestClient{}
+	s.cp.logger = ctxlog.TestLogger(c)
+	c.Assert(os.Mkdir(s.cp.hostOutputDir+"/dir1", 0755), check.IsNil)
+	var files []filetodo
+	for _, name := range []string{"dir1/b", "a", "dir1/a", "c"} {
+		s.writeFileInOutputDir(c, name, name)
+		files = append(files, filetodo{src: s.cp.hostOutputDir + "/" + name, dst: "/" + name, size: int64(len(name))})
+	}
+	var expect string
+	for i := 0; i < len(files); i++ {
+		// Try each rotation of the list.
+		s.cp.files = append(append([]filetodo(nil), files[i:]...), files[:i]...)
+		streams, err := s.cp.copyFiles()
+		c.Assert(err, check.IsNil)
+		if i == 0 {
+			expect = streams
+		}
+		c.Check(streams, check.Equals, expect)
+	}
+	c.Check(expect, check.Equals, fmt.Sprintf(". %x+2 0:1:a 1:1:c\n./dir1 %x+12 0:6:a 6:6:b\n", md5.Sum([]byte("ac")), md5.Sum([]byte("dir1/adir1/b"))))
+}
+
+// slowKeepClient is safe for concurrent use, and records the maximum
+// number of concurrent PutB calls.
+type slowKeepClient struct {
+	KeepTestClient
+	mtx     sync.Mutex
+	writing int
+	maxBusy int
+}
+
+func (kc *slowKeepClient) PutB(buf []byte) (string, int, error) {
+	kc.mtx.Lock()
+	kc.writing++
+	if kc.writing > kc.maxBusy {
+		kc.maxBusy = kc.writing
+	}
+	kc.mtx.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	kc.mtx.Lock()
+	kc.writing--
+	kc.mtx.Unlock()
+	return fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf)), 2, nil
+}
+
+func (s *copierSuite) TestCopyFilesConcurrent(c *check.C) {
+	s.cp.logger = ctxlog.TestLogger(c)
+	for i := 0; i < 8; i++ {
+		dir := fmt.Sprintf("dir%d", i)
+		c.Assert(os.Mkdir(s.cp.hostOutputDir+"/"+dir, 0755), check.IsNil)
+		for _, name := range []string{"a", "b"} {
+			s.writeFileInOutputDir(c, dir+"/"+name, dir+name)
+			s.cp.files = append(s.cp.files, filetodo{src: s.cp.hostOutputDir + "/" + dir + "/" + name, dst: "/" + dir + "/" + name, size: 5})
+		}
+	}
+	s.cp.keepClient = &KeepTestClient{}
+	s.cp.uploadThreads = 1
+	expect, err := s.cp.copyFiles()
+	c.Assert(err, check.IsNil)
+
+	// Each directory's block is written while the next
+	// directory is being read, and the resulting manifest is the
+	// same. If uploadThreads is not set, defaultUploadThreads
+	// blocks are written at a time.
+	for _, trial := range []struct {
+		threads int
+		maxBusy int
+	}{
+		{0, defaultUploadThreads},
+		{1, 1},
+		{3, 3},
+	} {
+		kc := &slowKeepClient{}
+		s.cp.keepClient = kc
+		s.cp.uploadThreads = trial.threads
+		streams, err := s.cp.copyFiles()
+		c.Assert(err, check.IsNil)
+		c.Check(streams, check.Equals, expect)
+		c.Check(kc.maxBusy, check.Equals, trial.maxBusy, check.Commentf("uploadThreads %d", trial.threads))
+	}
+}
+
+func (s *copierSuite) TestMountsBelowOrder(c *check.C) {
+	s.cp.manifestCache = map[string]*manifest.Manifest{}
+	for i := 0; i < 8; i++ {
+		pdh := fmt.Sprintf("fake-pdh-%d", i)
+		s.cp.mounts[fmt.Sprintf("/ctr/outdir/mnt%d", i)] = arvados.Mount{Kind: "collection", PortableDataHash: pdh}
+		s.cp.manifestCache[pdh] = &manifest.Manifest{Text: fmt.Sprintf(". %x+1 0:1:file%d\n", md5.Sum([]byte{byte(i)}), i)}
+	}
+	var expect string
+	for trial := 0; trial < 10; trial++ {
+		s.cp.manifest, s.cp.files, s.cp.dirs = "", nil, nil
+		err := s.cp.walkMount("", s.cp.ctrOutputDir, 10, true)
+		c.Assert(err, check.IsNil)
+		if trial == 0 {
+			expect = s.cp.manifest
+			c.Check(expect, check.Matches, `(?ms)\./mnt0 .*\./mnt1 .*\./mnt7 \S+ 0:1:file7\n`)
+		}
+		c.Check(s.cp.manifest, check.Equals, expect)
+	}
+}
+
 func (s *copierSuite) writeFileInOutputDir(c *check.C, path, data string) {
 	f, err := os.OpenFile(s.cp.hostOutputDir+"/"+path, os.O_CREATE|os.O_WRONLY, 0644)
 	c.Assert(err, check.IsNil)
@@ -21,7 +21,6 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/pprof"
-	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -38,7 +37,7 @@ import (
 	dockertypes "github.com/docker/docker/api/types"
 	dockercontainer "github.com/docker/docker/api/types/container"
 	dockernetwork "github.com/docker/docker/api/types/network"
-	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/strslice"
 )
 
 type command struct{}
@@ -95,7 +94,7 @@ type PsProcess interface {
 // ContainerRunner is the main stateful struct used for a single execution of a
 // container.
 type ContainerRunner struct {
-	Docker ThinDockerClient
+	executor containerExecutor
 
 	// Dispatcher client is initialized with the Dispatcher token.
 	// This is a privileged token used to manage container status
@@ -122,6 +121,7 @@ type ContainerRunner struct {
 	Container       arvados.Container
 	ContainerConfig dockercontainer.Config
 	HostConfig      dockercontainer.HostConfig
+	imageEntrypoint []string
 	token           string
 	ContainerID     string
 	ExitCode        *int
@@ -140,6 +140,7 @@ type ContainerRunner struct {
 	ArvMountPoint   string
 	HostOutputDir   string
 	Binds           []string
+	Tmpfs           map[string]string
 	Volumes         map[string]struct{}
 	OutputPDH       *string
 	SigChan         chan os.Signal
@@ -149,12 +150,40 @@ type ContainerRunner struct {
 	finalState      string
 	parentTemp      string
 
+	// Files for "secret" mounts are written in secretDir, a
+	// private directory in secretTmpfs, and their values are
+	// scrubbed from logs by scrubber.
+	secretTmpfs string
+	secretDir   string
+	scrubber    *secretScrubber
+
+	// Provide collection mounts with arv-mount ("" or
+	// "arv-mount") or "arvados-client mount" ("experimental-go")
+	// if possible (see -keep-mount-engine). SetupMounts sets
+	// goKeepMount if it uses the Go driver.
+	keepMountEngine string
+	goKeepMount     bool
+
 	statLogger       io.WriteCloser
 	statReporter     *crunchstat.Reporter
 	hoststatLogger   io.WriteCloser
 	hoststatReporter *crunchstat.Reporter
 	statInterval     time.Duration
 	cgroupRoot       string
+	// If non-zero, stdout and stderr logs are split into
+	// multiple files of at most this many bytes each.
+	logRotateSize int64
+	// Shell commands to run in the container image before
+	// starting the container; see CaptureEnvironment.
+	envCaptureCommands []string
+	// Program to run on the host after the container is
+	// finalized; see runPostRunHook.
+	postRunHook string
+
+	// updates sends container state updates to the API server.
+	updates *updateQueue
+	// Returns recent kernel log messages; see checkOOMKilled.
+	readKernelLog func() ([]byte, error)
 	// What we expect the container's cgroup parent to be.
 	expectCgroupParent string
 	// What we tell docker to use as the container's cgroup
@@ -176,10 +205,71 @@ type ContainerRunner struct {
 	enableNetwork string // one of "default" or "always"
 	networkMode   string // passed through to HostConfig.NetworkMode
 	arvMountLog   *ThrottledLogger
+	imageUsageDir string // where to record image usage for image GC ("" = don't record)
+
+	// Cloud provider whose instance metadata service should be
+	// queried for node-info ("" = don't), and the service's URL
+	// ("" = provider default); see logCloudInstanceInfo.
+	cloudMetadataProvider string
+	cloudMetadataURL      string
+
+	// Forward stdout and stderr to these external log collectors
+	// (see -log-forward), sampling this fraction of lines.
+	logForwarders        []*logForwarder
+	logForwardSampleRate float64
+	liveLogs             *liveLogStreamer
+
+	uploadCheckpointInterval time.Duration
+	uploadCheckpoint         *uploadCheckpoint
+
+	// Number of output blocks to write to Keep concurrently, unless
+	// the container's output_upload_threads runtime constraint
+	// overrides it (see -output-upload-threads).
+	outputUploadThreads int
+
+	// Maximum total size of files to copy from the output
+	// directory (0 = no limit). The container's max_output_size
+	// scheduling parameter can set a lower limit (see
+	// -max-output-size).
+	maxOutputSize int64
+
+	// If outputArvMount is true, a "tmp" output directory is
+	// replaced by a writable collection in arv-mount (see
+	// -output-arv-mount). SetupMounts sets outputInArvMount if
+	// it did so.
+	outputArvMount   bool
+	outputInArvMount bool
+
+	// Host environment variables to copy into the container (see
+	// -propagate-env and propagatedEnv).
+	propagateEnv []string
+
+	// Number of top processes by RSS and CPU to include in the
+	// hoststat log (see -hoststat-top-processes).
+	hoststatTopProcesses int
+
+	// If local is true, the container record was read from a file
+	// instead of the API server (see -local and runLocal), and
+	// the output directory is localOutputDir instead of a
+	// temporary directory that gets copied to Keep.
+	local          bool
+	localOutputDir string
+
+	// Number of times to retry Docker operations that fail with
+	// transient errors, and the initial wait between attempts
+	// (see retryDocker).
+	dockerRetries      int
+	dockerRetryBackoff time.Duration
 
 	containerWatchdogInterval time.Duration
 
 	gateway Gateway
+
+	snapshotMtx  sync.Mutex // held while saving output snapshot or final output
+	snapshotUUID string     // UUID of output snapshot collection, once created
+
+	// Progress reported on the status socket; see serveStatus.
+	status runtimeStatus
 }
 
 // setupSignals sets up signal handling to gracefully terminate the underlying
@@ -209,7 +299,7 @@ func (runner *ContainerRunner) stop(sig os.Signal) {
 	}
 	runner.cCancelled = true
 	runner.CrunchLog.Printf("removing container")
-	err := runner.Docker.ContainerRemove(context.TODO(), runner.ContainerID, dockertypes.ContainerRemoveOptions{Force: true})
+	err := runner.executor.Remove(context.TODO(), runner.ContainerID)
 	if err != nil {
 		runner.CrunchLog.Printf("error removing container: %s", err)
 	}
@@ -248,6 +338,46 @@ func (runner *ContainerRunner) runBrokenNodeHook() {
 	}
 }
 
+// postRunHookTimeout is the maximum time runPostRunHook waits for
+// the post-run hook to finish.
+var postRunHookTimeout = 5 * time.Minute
+
+// runPostRunHook runs the configured post-run hook program (if any)
+// after the container record has been finalized. The container UUID,
+// final state, and exit code (empty if the container did not exit
+// normally) are passed in the CRUNCH_CONTAINER_UUID,
+// CRUNCH_CONTAINER_STATE, and CRUNCH_CONTAINER_EXIT_CODE environment
+// variables.
+//
+// The hook's output is written to the crunch-run log. Errors are
+// logged but otherwise ignored: it is too late to affect the outcome
+// of the container.
+func (runner *ContainerRunner) runPostRunHook() {
+	if runner.postRunHook == "" {
+		return
+	}
+	exitCode := ""
+	if runner.ExitCode != nil {
+		exitCode = fmt.Sprintf("%d", *runner.ExitCode)
+	}
+	runner.CrunchLog.Printf("Running post-run hook %q", runner.postRunHook)
+	ctx, cancel := context.WithTimeout(context.Background(), postRunHookTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, runner.postRunHook)
+	c.Env = append(os.Environ(),
+		"CRUNCH_CONTAINER_UUID="+runner.Container.UUID,
+		"CRUNCH_CONTAINER_STATE="+runner.finalState,
+		"CRUNCH_CONTAINER_EXIT_CODE="+exitCode)
+	c.Stdout = runner.CrunchLog
+	c.Stderr = runner.CrunchLog
+	err := c.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		runner.CrunchLog.Printf("Post-run hook did not finish within %v", postRunHookTimeout)
+	} else if err != nil {
+		runner.CrunchLog.Printf("Error running post-run hook: %v", err)
+	}
+}
+
 func (runner *ContainerRunner) checkBrokenNode(goterr error) bool {
 	for _, d := range errorBlacklist {
 		if m, e := regexp.MatchString(d, goterr.Error()); m && e == nil {
@@ -283,40 +413,190 @@ func (runner *ContainerRunner) LoadImage() (err error) {
 
 	runner.CrunchLog.Printf("Using Docker image id '%s'", imageID)
 
-	_, _, err = runner.Docker.ImageInspectWithRaw(context.TODO(), imageID)
+	var inspect dockertypes.ImageInspect
+	err = runner.retryDocker("inspecting image", func(int) error {
+		var err error
+		inspect, err = runner.executor.ImageInspect(context.TODO(), imageID)
+		return err
+	})
 	if err != nil {
 		runner.CrunchLog.Print("Loading Docker image from keep")
 
-		var readCloser io.ReadCloser
-		readCloser, err = runner.ContainerKeepClient.ManifestFileReader(manifest, img)
-		if err != nil {
-			return fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
-		}
-
-		response, err := runner.Docker.ImageLoad(context.TODO(), readCloser, true)
+		// Each attempt needs a new reader, because a failed
+		// attempt might have consumed some of the image data.
+		var response string
+		err = runner.retryDocker("loading image", func(int) error {
+			readCloser, err := runner.ContainerKeepClient.ManifestFileReader(manifest, img)
+			if err != nil {
+				return fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
+			}
+			response, err = runner.executor.ImageLoad(context.TODO(), readCloser)
+			if err != nil {
+				return fmt.Errorf("While loading container image into Docker: %v", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("While loading container image into Docker: %v", err)
+			return err
 		}
+		runner.CrunchLog.Printf("Docker response: %s", response)
 
-		defer response.Body.Close()
-		rbody, err := ioutil.ReadAll(response.Body)
+		err = runner.retryDocker("inspecting loaded image", func(int) error {
+			var err error
+			inspect, err = runner.executor.ImageInspect(context.TODO(), imageID)
+			return err
+		})
 		if err != nil {
-			return fmt.Errorf("Reading response to image load: %v", err)
+			return fmt.Errorf("While inspecting loaded container image: %v", err)
 		}
-		runner.CrunchLog.Printf("Docker response: %s", rbody)
 	} else {
 		runner.CrunchLog.Print("Docker image is available")
 	}
 
+	err = runner.checkImagePlatform(inspect.Os, inspect.Architecture)
+	if err != nil {
+		return err
+	}
+
 	runner.ContainerConfig.Image = imageID
+	if err := recordImageUsage(runner.imageUsageDir, imageID); err != nil {
+		runner.CrunchLog.Printf("error recording image usage (image GC may remove this image prematurely): %s", err)
+	}
+	if inspect.Config != nil {
+		runner.imageEntrypoint = inspect.Config.Entrypoint
+	}
 
 	runner.ContainerKeepClient.ClearBlockCache()
 
 	return nil
 }
 
+// checkImagePlatform returns an error if the container image's OS
+// or architecture (as reported by docker, which might be empty for
+// old images) does not match the current node. In that case it also
+// records the problem in the container's runtime_status and the
+// node-info log, because the error docker would report when
+// starting the container (typically "exec format error") is
+// cryptic.
+func (runner *ContainerRunner) checkImagePlatform(imageOS, imageArch string) error {
+	if (imageOS == "" || imageOS == runtime.GOOS) && (imageArch == "" || imageArch == runtime.GOARCH) {
+		return nil
+	}
+	detail := fmt.Sprintf("container image platform %s/%s is not compatible with this node's platform %s/%s", imageOS, imageArch, runtime.GOOS, runtime.GOARCH)
+	runner.CrunchLog.Print(detail)
+
+	if w, err := runner.NewLogWriter("node-info"); err != nil {
+		runner.CrunchLog.Printf("error writing node-info log: %v", err)
+	} else {
+		fmt.Fprintf(w, "Image compatibility\n%s\n", detail)
+		w.Close()
+	}
+
+	runner.setRuntimeStatusError("Container image is not compatible with the node's OS/architecture", detail)
+	return errors.New(detail)
+}
+
+// setRuntimeStatusError records an error in the container's
+// runtime_status. Other keys, like the ones set by the dispatcher
+// (slurmJobID, warnings, etc.), are preserved.
+func (runner *ContainerRunner) setRuntimeStatusError(msg, detail string) {
+	if runner.local {
+		return
+	}
+	var current arvados.Container
+	err := runner.DispatcherArvClient.Get("containers", runner.Container.UUID, arvadosclient.Dict{
+		"select": []string{"uuid", "runtime_status"},
+	}, &current)
+	if err != nil {
+		runner.CrunchLog.Printf("error getting container runtime_status: %v", err)
+		current.RuntimeStatus = runner.Container.RuntimeStatus
+	}
+	rs := arvadosclient.Dict{}
+	for k, v := range current.RuntimeStatus {
+		rs[k] = v
+	}
+	rs["error"] = msg
+	rs["errorDetail"] = detail
+	err = runner.DispatcherArvClient.Update("containers", runner.Container.UUID, arvadosclient.Dict{
+		"container": arvadosclient.Dict{
+			"runtime_status": rs,
+		},
+	}, nil)
+	if err != nil {
+		runner.CrunchLog.Printf("error updating container runtime_status: %v", err)
+	}
+}
+
+// classifyExit logs an explanation of the container's exit code,
+// and records the reason in the container's runtime_status if the
+// container was killed by the kernel's out-of-memory killer or
+// terminated by a signal. Otherwise both are only visible as an exit
+// code above 128 (e.g., 137 for SIGKILL).
+func (runner *ContainerRunner) classifyExit(code int) {
+	if runner.IsCancelled() {
+		return
+	}
+	if detail := runner.checkOOMKilled(code); detail != "" {
+		runner.CrunchLog.Printf("Container was killed by the out-of-memory killer: %s", detail)
+		if ram := runner.Container.RuntimeConstraints.RAM; ram > 0 {
+			detail += fmt.Sprintf(" (runtime_constraints.ram was %d bytes)", ram)
+		}
+		runner.setRuntimeStatusError(arvados.RuntimeStatusErrorOutOfMemory, detail)
+	} else if code > 128 && code < 128+65 {
+		sig := syscall.Signal(code - 128)
+		detail := fmt.Sprintf("exit code %d: signal %d (%s)", code, sig, sig)
+		if sig == syscall.SIGKILL {
+			detail += "; no evidence of an out-of-memory kill was found, so it was probably sent by a process in the container or on the host"
+		}
+		runner.CrunchLog.Printf("Container was terminated by a signal: %s", detail)
+		runner.setRuntimeStatusError(arvados.RuntimeStatusErrorSignal, detail)
+	} else if code != 0 {
+		runner.CrunchLog.Printf("Container process exited with non-zero status %d", code)
+	}
+}
+
+// checkOOMKilled returns a description of the evidence that the
+// container was killed by the kernel's out-of-memory killer, or ""
+// if there is none.
+//
+// Docker's State.OOMKilled flag is checked first. It is not set in
+// all cases (e.g., when a process other than the container's init
+// process is killed, and init then exits with SIGKILL's status), so
+// if the exit code is 137 the kernel log is also searched for OOM
+// killer messages mentioning the container ID.
+func (runner *ContainerRunner) checkOOMKilled(code int) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ctr, err := runner.executor.Inspect(ctx, runner.ContainerID)
+	if err != nil {
+		runner.CrunchLog.Printf("error inspecting container after exit: %s", err)
+	} else if ctr.State != nil && ctr.State.OOMKilled {
+		return "docker reports the container was OOM-killed"
+	}
+	if code != 137 || runner.readKernelLog == nil || runner.ContainerID == "" {
+		return ""
+	}
+	klog, err := runner.readKernelLog()
+	if err != nil {
+		runner.CrunchLog.Printf("error reading kernel log: %s", err)
+		return ""
+	}
+	lines := strings.Split(string(klog), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if strings.Contains(line, runner.ContainerID) && strings.Contains(strings.ToLower(line), "oom") {
+			return "kernel log: " + line
+		}
+	}
+	return ""
+}
+
 func (runner *ContainerRunner) ArvMountCmd(arvMountCmd []string, token string) (c *exec.Cmd, err error) {
-	c = exec.Command("arv-mount", arvMountCmd...)
+	if runner.goKeepMount {
+		c = exec.Command("arvados-client", arvMountCmd...)
+	} else {
+		c = exec.Command("arv-mount", arvMountCmd...)
+	}
 
 	// Copy our environment, but override ARVADOS_API_TOKEN with
 	// the container auth token.
@@ -350,7 +630,13 @@ func (runner *ContainerRunner) ArvMountCmd(arvMountCmd []string, token string) (
 	go func() {
 		for keepStatting {
 			time.Sleep(100 * time.Millisecond)
-			_, err = os.Stat(fmt.Sprintf("%s/by_id/README", runner.ArvMountPoint))
+			if runner.goKeepMount {
+				// The Go driver doesn't have a
+				// README file to wait for.
+				err = checkMountPoint(runner.ArvMountPoint)
+			} else {
+				_, err = os.Stat(fmt.Sprintf("%s/by_id/README", runner.ArvMountPoint))
+			}
 			if err == nil {
 				keepStatting = false
 				statReadme <- true
@@ -418,140 +704,54 @@ func copyfile(src string, dst string) (err error) {
 	return nil
 }
 
+// SetupMounts creates the host directories, files, and arv-mount
+// process needed to provide the container's mounts, and sets
+// runner.Binds, runner.Tmpfs, and runner.HostOutputDir.
+//
+// The mounts are validated (see planMounts) before anything is
+// created.
 func (runner *ContainerRunner) SetupMounts() (err error) {
-	err = runner.SetupArvMountPoint("keep")
+	plan, err := runner.planMounts()
 	if err != nil {
-		return fmt.Errorf("While creating keep mount temp dir: %v", err)
-	}
-
-	token, err := runner.ContainerToken()
-	if err != nil {
-		return fmt.Errorf("could not get container token: %s", err)
+		return err
 	}
+	runner.outputInArvMount = plan.outputInArvMount
 
-	pdhOnly := true
-	tmpcount := 0
-	arvMountCmd := []string{
-		"--foreground",
-		"--allow-other",
-		"--read-write",
-		fmt.Sprintf("--crunchstat-interval=%v", runner.statInterval.Seconds())}
+	var token string
+	if !runner.local {
+		err = runner.SetupArvMountPoint("keep")
+		if err != nil {
+			return fmt.Errorf("While creating keep mount temp dir: %v", err)
+		}
 
-	if runner.Container.RuntimeConstraints.KeepCacheRAM > 0 {
-		arvMountCmd = append(arvMountCmd, "--file-cache", fmt.Sprintf("%d", runner.Container.RuntimeConstraints.KeepCacheRAM))
+		token, err = runner.ContainerToken()
+		if err != nil {
+			return fmt.Errorf("could not get container token: %s", err)
+		}
 	}
 
 	collectionPaths := []string{}
 	runner.Binds = nil
+	runner.Tmpfs = nil
 	runner.Volumes = make(map[string]struct{})
-	needCertMount := true
 	type copyFile struct {
 		src  string
 		bind string
 	}
 	var copyFiles []copyFile
 
-	var binds []string
-	for bind := range runner.Container.Mounts {
-		binds = append(binds, bind)
-	}
-	for bind := range runner.SecretMounts {
-		if _, ok := runner.Container.Mounts[bind]; ok {
-			return fmt.Errorf("secret mount %q conflicts with regular mount", bind)
-		}
-		if runner.SecretMounts[bind].Kind != "json" &&
-			runner.SecretMounts[bind].Kind != "text" {
-			return fmt.Errorf("secret mount %q type is %q but only 'json' and 'text' are permitted",
-				bind, runner.SecretMounts[bind].Kind)
-		}
-		binds = append(binds, bind)
-	}
-	sort.Strings(binds)
-
-	for _, bind := range binds {
-		mnt, ok := runner.Container.Mounts[bind]
-		if !ok {
-			mnt = runner.SecretMounts[bind]
-		}
-		if bind == "stdout" || bind == "stderr" {
-			// Is it a "file" mount kind?
-			if mnt.Kind != "file" {
-				return fmt.Errorf("unsupported mount kind '%s' for %s: only 'file' is supported", mnt.Kind, bind)
-			}
-
-			// Does path start with OutputPath?
-			prefix := runner.Container.OutputPath
-			if !strings.HasSuffix(prefix, "/") {
-				prefix += "/"
-			}
-			if !strings.HasPrefix(mnt.Path, prefix) {
-				return fmt.Errorf("%s path does not start with OutputPath: %s, %s", strings.Title(bind), mnt.Path, prefix)
-			}
-		}
-
-		if bind == "stdin" {
-			// Is it a "collection" mount kind?
-			if mnt.Kind != "collection" && mnt.Kind != "json" {
-				return fmt.Errorf("unsupported mount kind '%s' for stdin: only 'collection' and 'json' are supported", mnt.Kind)
-			}
-		}
-
-		if bind == "/etc/arvados/ca-certificates.crt" {
-			needCertMount = false
-		}
-
-		if strings.HasPrefix(bind, runner.Container.OutputPath+"/") && bind != runner.Container.OutputPath+"/" {
-			if mnt.Kind != "collection" && mnt.Kind != "text" && mnt.Kind != "json" {
-				return fmt.Errorf("only mount points of kind 'collection', 'text' or 'json' are supported underneath the output_path for %q, was %q", bind, mnt.Kind)
-			}
-		}
-
+	for _, pm := range plan.mounts {
+		bind, mnt := pm.bind, pm.mnt
 		switch {
 		case mnt.Kind == "collection" && bind != "stdin":
-			var src string
-			if mnt.UUID != "" && mnt.PortableDataHash != "" {
-				return fmt.Errorf("cannot specify both 'uuid' and 'portable_data_hash' for a collection mount")
-			}
-			if mnt.UUID != "" {
-				if mnt.Writable {
-					return fmt.Errorf("writing to existing collections currently not permitted")
-				}
-				pdhOnly = false
-				src = fmt.Sprintf("%s/by_id/%s", runner.ArvMountPoint, mnt.UUID)
-			} else if mnt.PortableDataHash != "" {
-				if mnt.Writable && !strings.HasPrefix(bind, runner.Container.OutputPath+"/") {
-					return fmt.Errorf("can never write to a collection specified by portable data hash")
-				}
-				idx := strings.Index(mnt.PortableDataHash, "/")
-				if idx > 0 {
-					mnt.Path = path.Clean(mnt.PortableDataHash[idx:])
-					mnt.PortableDataHash = mnt.PortableDataHash[0:idx]
-					runner.Container.Mounts[bind] = mnt
-				}
-				src = fmt.Sprintf("%s/by_id/%s", runner.ArvMountPoint, mnt.PortableDataHash)
-				if mnt.Path != "" && mnt.Path != "." {
-					if strings.HasPrefix(mnt.Path, "./") {
-						mnt.Path = mnt.Path[2:]
-					} else if strings.HasPrefix(mnt.Path, "/") {
-						mnt.Path = mnt.Path[1:]
-					}
-					src += "/" + mnt.Path
-				}
-			} else {
-				src = fmt.Sprintf("%s/tmp%d", runner.ArvMountPoint, tmpcount)
-				arvMountCmd = append(arvMountCmd, "--mount-tmp")
-				arvMountCmd = append(arvMountCmd, fmt.Sprintf("tmp%d", tmpcount))
-				tmpcount++
-			}
-			if mnt.Writable {
+			src := runner.ArvMountPoint + "/" + pm.keepPath
+			if pm.copyToOutput {
+				copyFiles = append(copyFiles, copyFile{src, runner.HostOutputDir + bind[len(runner.Container.OutputPath):]})
+			} else if mnt.Writable {
 				if bind == runner.Container.OutputPath {
 					runner.HostOutputDir = src
-					runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s", src, bind))
-				} else if strings.HasPrefix(bind, runner.Container.OutputPath+"/") {
-					copyFiles = append(copyFiles, copyFile{src, runner.HostOutputDir + bind[len(runner.Container.OutputPath):]})
-				} else {
-					runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s", src, bind))
 				}
+				runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s", src, bind))
 			} else {
 				runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", src, bind))
 			}
@@ -559,53 +759,72 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 
 		case mnt.Kind == "tmp":
 			var tmpdir string
-			tmpdir, err = runner.MkTempDir(runner.parentTemp, "tmp")
+			created := true
+			if runner.local && bind == runner.Container.OutputPath {
+				tmpdir = runner.localOutputDir
+				_, err = os.Stat(tmpdir)
+				if err == nil {
+					// The -local-output directory
+					// belongs to the user, so leave its
+					// permissions alone.
+					created = false
+				} else if os.IsNotExist(err) {
+					err = os.MkdirAll(tmpdir, 0777)
+				}
+			} else {
+				tmpdir, err = runner.MkTempDir(runner.parentTemp, "tmp")
+			}
 			if err != nil {
 				return fmt.Errorf("while creating mount temp dir: %v", err)
 			}
-			st, staterr := os.Stat(tmpdir)
-			if staterr != nil {
-				return fmt.Errorf("while Stat on temp dir: %v", staterr)
-			}
-			err = os.Chmod(tmpdir, st.Mode()|os.ModeSetgid|0777)
-			if staterr != nil {
-				return fmt.Errorf("while Chmod temp dir: %v", err)
+			if created {
+				st, staterr := os.Stat(tmpdir)
+				if staterr != nil {
+					return fmt.Errorf("while Stat on temp dir: %v", staterr)
+				}
+				err = os.Chmod(tmpdir, st.Mode()|os.ModeSetgid|0777)
+				if staterr != nil {
+					return fmt.Errorf("while Chmod temp dir: %v", err)
+				}
 			}
 			runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s", tmpdir, bind))
 			if bind == runner.Container.OutputPath {
 				runner.HostOutputDir = tmpdir
 			}
 
-		case mnt.Kind == "json" || mnt.Kind == "text":
-			var filedata []byte
-			if mnt.Kind == "json" {
-				filedata, err = json.Marshal(mnt.Content)
-				if err != nil {
-					return fmt.Errorf("encoding json data: %v", err)
-				}
-			} else {
-				text, ok := mnt.Content.(string)
-				if !ok {
-					return fmt.Errorf("content for mount %q must be a string", bind)
-				}
-				filedata = []byte(text)
+		case mnt.Kind == "tmpfs":
+			if runner.Tmpfs == nil {
+				runner.Tmpfs = map[string]string{}
 			}
+			runner.Tmpfs[bind] = pm.tmpfsOpts
 
+		case mnt.Kind == "json" || mnt.Kind == "text":
 			tmpdir, err := runner.MkTempDir(runner.parentTemp, mnt.Kind)
 			if err != nil {
 				return fmt.Errorf("creating temp dir: %v", err)
 			}
 			tmpfn := filepath.Join(tmpdir, "mountdata."+mnt.Kind)
-			err = ioutil.WriteFile(tmpfn, filedata, 0444)
+			err = ioutil.WriteFile(tmpfn, pm.data, 0444)
 			if err != nil {
 				return fmt.Errorf("writing temp file: %v", err)
 			}
-			if strings.HasPrefix(bind, runner.Container.OutputPath+"/") {
+			if pm.copyToOutput {
 				copyFiles = append(copyFiles, copyFile{tmpfn, runner.HostOutputDir + bind[len(runner.Container.OutputPath):]})
 			} else {
 				runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", tmpfn, bind))
 			}
 
+		case mnt.Kind == "secret":
+			// Unlike json and text mounts, secrets are
+			// bind-mounted even underneath the output
+			// path, so they are never copied to the
+			// output directory.
+			fn, err := runner.writeSecretFile(bind, mnt)
+			if err != nil {
+				return err
+			}
+			runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", fn, bind))
+
 		case mnt.Kind == "git_tree":
 			tmpdir, err := runner.MkTempDir(runner.parentTemp, "git_tree")
 			if err != nil {
@@ -619,11 +838,7 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 		}
 	}
 
-	if runner.HostOutputDir == "" {
-		return fmt.Errorf("output path does not correspond to a writable mount point")
-	}
-
-	if needCertMount && runner.Container.RuntimeConstraints.API {
+	if plan.needCertMount {
 		for _, certfile := range arvadosclient.CertFiles {
 			_, err := os.Stat(certfile)
 			if err == nil {
@@ -633,16 +848,21 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 		}
 	}
 
-	if pdhOnly {
-		arvMountCmd = append(arvMountCmd, "--mount-by-pdh", "by_id")
-	} else {
-		arvMountCmd = append(arvMountCmd, "--mount-by-id", "by_id")
+	arvMountCmd := append(plan.arvMountArgs, runner.ArvMountPoint)
+	if runner.keepMountEngine == "experimental-go" {
+		if plan.goMountArgs == nil {
+			runner.CrunchLog.Printf("Using arv-mount instead of experimental Go FUSE driver, which does not support writable collection mounts")
+		} else {
+			runner.goKeepMount = true
+			arvMountCmd = append(plan.goMountArgs, runner.ArvMountPoint, "-o", "allow_other")
+		}
 	}
-	arvMountCmd = append(arvMountCmd, runner.ArvMountPoint)
 
-	runner.ArvMount, err = runner.RunArvMount(arvMountCmd, token)
-	if err != nil {
-		return fmt.Errorf("while trying to start arv-mount: %v", err)
+	if !runner.local {
+		runner.ArvMount, err = runner.RunArvMount(arvMountCmd, token)
+		if err != nil {
+			return fmt.Errorf("while trying to start arv-mount: %v", err)
+		}
 	}
 
 	for _, p := range collectionPaths {
@@ -732,6 +952,8 @@ func (runner *ContainerRunner) ProcessDockerAttach(containerReader io.Reader) {
 		runner.CrunchLog.Printf("error closing stderr logs: %v", err)
 	}
 
+	runner.closeLogForwarders()
+
 	if runner.statReporter != nil {
 		runner.statReporter.Stop()
 		err = runner.statLogger.Close()
@@ -760,9 +982,10 @@ func (runner *ContainerRunner) startHoststat() error {
 	}
 	runner.hoststatLogger = NewThrottledLogger(w)
 	runner.hoststatReporter = &crunchstat.Reporter{
-		Logger:     log.New(runner.hoststatLogger, "", 0),
-		CgroupRoot: runner.cgroupRoot,
-		PollPeriod: runner.statInterval,
+		Logger:       log.New(runner.hoststatLogger, "", 0),
+		CgroupRoot:   runner.cgroupRoot,
+		PollPeriod:   runner.statInterval,
+		TopProcesses: runner.hoststatTopProcesses,
 	}
 	runner.hoststatReporter.Start()
 	return nil
@@ -776,12 +999,15 @@ func (runner *ContainerRunner) startCrunchstat() error {
 	runner.statLogger = NewThrottledLogger(w)
 	runner.statReporter = &crunchstat.Reporter{
 		CID:          runner.ContainerID,
-		Logger:       log.New(runner.statLogger, "", 0),
+		Logger:       log.New(io.MultiWriter(runner.statLogger, &runner.status), "", 0),
 		CgroupParent: runner.expectCgroupParent,
 		CgroupRoot:   runner.cgroupRoot,
 		PollPeriod:   runner.statInterval,
 		TempDir:      runner.parentTemp,
 	}
+	if runner.Container.RuntimeConstraints.CUDA.DeviceCount > 0 {
+		runner.statReporter.GPUs = cudaVisibleDevices(os.Getenv)
+	}
 	runner.statReporter.Start()
 	return nil
 }
@@ -839,6 +1065,10 @@ func (runner *ContainerRunner) LogHostInfo() (err error) {
 		fmt.Fprintln(w, "")
 	}
 
+	if runner.cloudMetadataProvider != "" {
+		runner.logCloudInstanceInfo(w)
+	}
+
 	err = w.Close()
 	if err != nil {
 		return fmt.Errorf("While closing node-info logs: %v", err)
@@ -976,8 +1206,12 @@ func (runner *ContainerRunner) AttachStreams() (err error) {
 	}
 
 	stdinUsed := stdinRdr != nil || len(stdinJSON) != 0
-	response, err := runner.Docker.ContainerAttach(context.TODO(), runner.ContainerID,
-		dockertypes.ContainerAttachOptions{Stream: true, Stdin: stdinUsed, Stdout: true, Stderr: true})
+	var response dockertypes.HijackedResponse
+	err = runner.retryDocker("attaching container streams", func(int) error {
+		var err error
+		response, err = runner.executor.Attach(context.TODO(), runner.ContainerID, stdinUsed)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("While attaching container stdout/stderr streams: %v", err)
 	}
@@ -993,7 +1227,10 @@ func (runner *ContainerRunner) AttachStreams() (err error) {
 	} else if w, err := runner.NewLogWriter("stdout"); err != nil {
 		return err
 	} else {
-		runner.Stdout = NewThrottledLogger(w)
+		tl := NewThrottledLogger(w)
+		tl.scrubber = runner.scrubber
+		tl.live = runner.liveLogs.lineFunc("stdout")
+		runner.Stdout = tl
 	}
 
 	if stderrMnt, ok := runner.Container.Mounts["stderr"]; ok {
@@ -1005,7 +1242,10 @@ func (runner *ContainerRunner) AttachStreams() (err error) {
 	} else if w, err := runner.NewLogWriter("stderr"); err != nil {
 		return err
 	} else {
-		runner.Stderr = NewThrottledLogger(w)
+		tl := NewThrottledLogger(w)
+		tl.scrubber = runner.scrubber
+		tl.live = runner.liveLogs.lineFunc("stderr")
+		runner.Stderr = tl
 	}
 
 	if stdinRdr != nil {
@@ -1064,13 +1304,44 @@ func (runner *ContainerRunner) CreateContainer() error {
 	runner.CrunchLog.Print("Creating Docker container")
 
 	runner.ContainerConfig.Cmd = runner.Container.Command
+	entrypoint := runner.imageEntrypoint
+	if ep := runner.Container.RuntimeConstraints.Entrypoint; ep != nil {
+		// Docker resets the image's entrypoint if we pass
+		// [""], but ignores an empty list.
+		runner.ContainerConfig.Entrypoint = strslice.StrSlice{*ep}
+		entrypoint = nil
+		if *ep != "" {
+			entrypoint = []string{*ep}
+		}
+	} else if len(entrypoint) > 0 {
+		runner.CrunchLog.Printf("Warning: container image has ENTRYPOINT %q, so the container command will be passed to it as arguments. Set runtime_constraints.entrypoint to \"\" to run the command without it.", entrypoint)
+	}
+	runner.CrunchLog.Printf("Resolved command line: %q", append(append([]string(nil), entrypoint...), runner.Container.Command...))
 	if runner.Container.Cwd != "." {
 		runner.ContainerConfig.WorkingDir = runner.Container.Cwd
 	}
 
+	if env := propagatedEnv(runner.propagateEnv, os.Environ(), runner.Container.Environment); len(env) > 0 {
+		var names []string
+		for _, kv := range env {
+			names = append(names, strings.SplitN(kv, "=", 2)[0])
+		}
+		runner.CrunchLog.Printf("Copying environment variables from the host: %s", strings.Join(names, " "))
+		runner.ContainerConfig.Env = append(runner.ContainerConfig.Env, env...)
+	}
 	for k, v := range runner.Container.Environment {
 		runner.ContainerConfig.Env = append(runner.ContainerConfig.Env, k+"="+v)
 	}
+	multiNode := runner.Container.SchedulingParameters.Nodes > 1
+	if multiNode {
+		hostname := os.Getenv("SLURMD_NODENAME")
+		if hostname == "" {
+			hostname, _ = os.Hostname()
+		}
+		runner.ContainerConfig.Env = append(runner.ContainerConfig.Env, multiNodeEnv(runner.Container.SchedulingParameters, os.Getenv, hostname)...)
+	}
+	cuda := runner.Container.RuntimeConstraints.CUDA
+	runner.ContainerConfig.Env = append(runner.ContainerConfig.Env, cudaEnv(cuda, os.Getenv)...)
 
 	runner.ContainerConfig.Volumes = runner.Volumes
 
@@ -1082,6 +1353,7 @@ func (runner *ContainerRunner) CreateContainer() error {
 	}
 	runner.HostConfig = dockercontainer.HostConfig{
 		Binds: runner.Binds,
+		Tmpfs: runner.Tmpfs,
 		LogConfig: dockercontainer.LogConfig{
 			Type: "none",
 		},
@@ -1093,6 +1365,10 @@ func (runner *ContainerRunner) CreateContainer() error {
 			KernelMemory: maxRAM, // kernel portion
 		},
 	}
+	if cuda.DeviceCount > 0 {
+		runner.CrunchLog.Printf("Requesting %d CUDA device(s)", cuda.DeviceCount)
+		runner.HostConfig.Runtime = cudaDockerRuntime
+	}
 
 	if runner.Container.RuntimeConstraints.API {
 		tok, err := runner.ContainerToken()
@@ -1106,7 +1382,9 @@ func (runner *ContainerRunner) CreateContainer() error {
 		)
 		runner.HostConfig.NetworkMode = dockercontainer.NetworkMode(runner.networkMode)
 	} else {
-		if runner.enableNetwork == "always" {
+		if runner.enableNetwork == "always" || multiNode {
+			// Multi-node containers need the network to
+			// reach their other nodes.
 			runner.HostConfig.NetworkMode = dockercontainer.NetworkMode(runner.networkMode)
 		} else {
 			runner.HostConfig.NetworkMode = dockercontainer.NetworkMode("none")
@@ -1120,12 +1398,25 @@ func (runner *ContainerRunner) CreateContainer() error {
 	runner.ContainerConfig.AttachStdout = true
 	runner.ContainerConfig.AttachStderr = true
 
-	createdBody, err := runner.Docker.ContainerCreate(context.TODO(), &runner.ContainerConfig, &runner.HostConfig, nil, runner.Container.UUID)
+	var containerID string
+	err := runner.retryDocker("creating container", func(attempt int) error {
+		var err error
+		containerID, err = runner.executor.Create(context.TODO(), runner.Container.UUID, &runner.ContainerConfig, &runner.HostConfig)
+		if err != nil && attempt > 0 && strings.Contains(err.Error(), "is already in use") {
+			// A previous attempt created the container,
+			// but we didn't get the response.
+			if ctr, err := runner.executor.Inspect(context.TODO(), runner.Container.UUID); err == nil && ctr.ContainerJSONBase != nil {
+				containerID = ctr.ID
+				return nil
+			}
+		}
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("While creating container: %v", err)
 	}
 
-	runner.ContainerID = createdBody.ID
+	runner.ContainerID = containerID
 
 	return runner.AttachStreams()
 }
@@ -1138,8 +1429,9 @@ func (runner *ContainerRunner) StartContainer() error {
 	if runner.cCancelled {
 		return ErrCancelled
 	}
-	err := runner.Docker.ContainerStart(context.TODO(), runner.ContainerID,
-		dockertypes.ContainerStartOptions{})
+	err := runner.retryDocker("starting container", func(int) error {
+		return runner.executor.Start(context.TODO(), runner.ContainerID)
+	})
 	if err != nil {
 		var advice string
 		if m, e := regexp.MatchString("(?ms).*(exec|System error).*(no such file or directory|file not found).*", err.Error()); m && e == nil {
@@ -1156,11 +1448,24 @@ func (runner *ContainerRunner) WaitFinish() error {
 	var runTimeExceeded <-chan time.Time
 	runner.CrunchLog.Print("Waiting for container to finish")
 
-	waitOk, waitErr := runner.Docker.ContainerWait(context.TODO(), runner.ContainerID, dockercontainer.WaitConditionNotRunning)
+	type waitResult struct {
+		code int
+		err  error
+	}
+	waited := make(chan waitResult, 1)
+	go func() {
+		code, err := runner.executor.Wait(context.TODO(), runner.ContainerID)
+		waited <- waitResult{code, err}
+	}()
 	arvMountExit := runner.ArvMountExit
 	if timeout := runner.Container.SchedulingParameters.MaxRunTime; timeout > 0 {
 		runTimeExceeded = time.After(time.Duration(timeout) * time.Second)
 	}
+	if interval := runner.Container.SchedulingParameters.OutputSnapshotInterval; interval > 0 {
+		stopSnapshots := make(chan struct{})
+		defer close(stopSnapshots)
+		go runner.snapshotOutputLoop(time.Duration(interval)*time.Second, stopSnapshots)
+	}
 
 	containerGone := make(chan struct{})
 	go func() {
@@ -1170,7 +1475,7 @@ func (runner *ContainerRunner) WaitFinish() error {
 		}
 		for range time.NewTicker(runner.containerWatchdogInterval).C {
 			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(runner.containerWatchdogInterval))
-			ctr, err := runner.Docker.ContainerInspect(ctx, runner.ContainerID)
+			ctr, err := runner.executor.Inspect(ctx, runner.ContainerID)
 			cancel()
 			runner.cStateLock.Lock()
 			done := runner.cRemoved || runner.ExitCode != nil
@@ -1190,18 +1495,21 @@ func (runner *ContainerRunner) WaitFinish() error {
 
 	for {
 		select {
-		case waitBody := <-waitOk:
-			runner.CrunchLog.Printf("Container exited with code: %v", waitBody.StatusCode)
-			code := int(waitBody.StatusCode)
+		case res := <-waited:
+			if res.err != nil {
+				return fmt.Errorf("container wait: %v", res.err)
+			}
+			runner.CrunchLog.Printf("Container exited with code: %v", res.code)
+			code := res.code
+			runner.cStateLock.Lock()
 			runner.ExitCode = &code
+			runner.cStateLock.Unlock()
 
 			// wait for stdout/stderr to complete
 			<-runner.loggingDone
+			runner.classifyExit(code)
 			return nil
 
-		case err := <-waitErr:
-			return fmt.Errorf("container wait: %v", err)
-
 		case <-arvMountExit:
 			runner.CrunchLog.Printf("arv-mount exited while container is still running.  Stopping container.")
 			runner.stop(nil)
@@ -1286,51 +1594,100 @@ func (runner *ContainerRunner) CaptureOutput() error {
 		}
 	}
 
+	// Wait for any output snapshot in progress to finish.
+	runner.snapshotMtx.Lock()
+	defer runner.snapshotMtx.Unlock()
+
+	txt, err := runner.copyOutput()
+	if errors.Is(err, errOutputTooLarge) {
+		runner.CrunchLog.Print(err)
+		runner.setRuntimeStatusError(arvados.RuntimeStatusErrorOutputTooLarge, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	var resp arvados.Collection
+	err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
+		"ensure_unique_name": true,
+		"collection": arvadosclient.Dict{
+			"is_trashed":    true,
+			"name":          "output for " + runner.Container.UUID,
+			"manifest_text": txt,
+		},
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("error creating output collection: %v", err)
+	}
+	runner.OutputPDH = &resp.PortableDataHash
+	return nil
+}
+
+// copyOutput copies the current contents of the container's output
+// directory to Keep, and returns the resulting manifest text.
+func (runner *ContainerRunner) copyOutput() (string, error) {
+	threads := runner.outputUploadThreads
+	if n := runner.Container.RuntimeConstraints.OutputUploadThreads; n > 0 {
+		threads = n
+	}
+	maxOutputSize := runner.maxOutputSize
+	if n := runner.Container.SchedulingParameters.MaxOutputSize; n > 0 && (maxOutputSize == 0 || n < maxOutputSize) {
+		maxOutputSize = n
+	}
+	mounts := runner.Container.Mounts
+	if runner.outputInArvMount {
+		// The "tmp" output mount was replaced by a writable
+		// collection in SetupMounts.
+		mounts = make(map[string]arvados.Mount, len(runner.Container.Mounts))
+		for bind, mnt := range runner.Container.Mounts {
+			mounts[bind] = mnt
+		}
+		mounts[runner.Container.OutputPath] = arvados.Mount{Kind: "collection", Writable: true}
+	}
+	keepClient := runner.outputKeepClient()
 	txt, err := (&copier{
 		client:        runner.containerClient,
 		arvClient:     runner.ContainerArvClient,
-		keepClient:    runner.ContainerKeepClient,
+		keepClient:    keepClient,
 		hostOutputDir: runner.HostOutputDir,
 		ctrOutputDir:  runner.Container.OutputPath,
 		binds:         runner.Binds,
-		mounts:        runner.Container.Mounts,
+		mounts:        mounts,
 		secretMounts:  runner.SecretMounts,
 		logger:        runner.CrunchLog,
+		uploadThreads: threads,
+		maxOutputSize: maxOutputSize,
+
+		countOutputCollection: runner.outputInArvMount,
 	}).Copy()
+	if ck, ok := keepClient.(*uploadCheckpoint); ok {
+		ck.report()
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
 	if n := len(regexp.MustCompile(` [0-9a-f]+\+\S*\+R`).FindAllStringIndex(txt, -1)); n > 0 {
 		runner.CrunchLog.Printf("Copying %d data blocks from remote input collections...", n)
 		fs, err := (&arvados.Collection{ManifestText: txt}).FileSystem(runner.containerClient, runner.ContainerKeepClient)
 		if err != nil {
-			return err
+			return "", err
 		}
 		txt, err = fs.MarshalManifest(".")
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
-	var resp arvados.Collection
-	err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
-		"ensure_unique_name": true,
-		"collection": arvadosclient.Dict{
-			"is_trashed":    true,
-			"name":          "output for " + runner.Container.UUID,
-			"manifest_text": txt,
-		},
-	}, &resp)
-	if err != nil {
-		return fmt.Errorf("error creating output collection: %v", err)
-	}
-	runner.OutputPDH = &resp.PortableDataHash
-	return nil
+	return txt, nil
 }
 
 func (runner *ContainerRunner) CleanupDirs() {
 	if runner.ArvMount != nil {
 		var delay int64 = 8
 		umount := exec.Command("arv-mount", fmt.Sprintf("--unmount-timeout=%d", delay), "--unmount", runner.ArvMountPoint)
+		if runner.goKeepMount {
+			// "arvados-client mount" exits when the
+			// filesystem is unmounted.
+			umount = exec.Command("fusermount", "-u", "-z", runner.ArvMountPoint)
+		}
 		umount.Stdout = runner.CrunchLog
 		umount.Stderr = runner.CrunchLog
 		runner.CrunchLog.Printf("Running %v", umount.Args)
@@ -1379,6 +1736,12 @@ func (runner *ContainerRunner) CleanupDirs() {
 	if rmerr := os.RemoveAll(runner.parentTemp); rmerr != nil {
 		runner.CrunchLog.Printf("While cleaning up temporary directory %s: %v", runner.parentTemp, rmerr)
 	}
+
+	if runner.secretDir != "" {
+		if rmerr := os.RemoveAll(runner.secretDir); rmerr != nil {
+			runner.CrunchLog.Printf("While cleaning up secret mount directory %s: %v", runner.secretDir, rmerr)
+		}
+	}
 }
 
 // CommitLogs posts the collection containing the final container logs.
@@ -1479,8 +1842,8 @@ func (runner *ContainerRunner) UpdateContainerRunning() error {
 	if runner.cCancelled {
 		return ErrCancelled
 	}
-	return runner.DispatcherArvClient.Update("containers", runner.Container.UUID,
-		arvadosclient.Dict{"container": arvadosclient.Dict{"state": "Running", "gateway_address": runner.gateway.Address}}, nil)
+	return runner.updates.Update(runner.Container.UUID,
+		arvadosclient.Dict{"state": "Running", "gateway_address": runner.gateway.Address})
 }
 
 // ContainerToken returns the api_token the container (and any
@@ -1489,6 +1852,9 @@ func (runner *ContainerRunner) ContainerToken() (string, error) {
 	if runner.token != "" {
 		return runner.token, nil
 	}
+	if runner.local {
+		return "", errors.New("no API token available in local mode (set ARVADOS_API_TOKEN)")
+	}
 
 	var auth arvados.APIClientAuthorization
 	err := runner.DispatcherArvClient.Call("GET", "containers", runner.Container.UUID, "auth", nil, &auth)
@@ -1515,7 +1881,7 @@ func (runner *ContainerRunner) UpdateContainerFinal() error {
 			update["output"] = *runner.OutputPDH
 		}
 	}
-	return runner.DispatcherArvClient.Update("containers", runner.Container.UUID, arvadosclient.Dict{"container": update}, nil)
+	return runner.updates.Update(runner.Container.UUID, update)
 }
 
 // IsCancelled returns the value of Cancelled, with goroutine safety.
@@ -1527,16 +1893,31 @@ func (runner *ContainerRunner) IsCancelled() bool {
 
 // NewArvLogWriter creates an ArvLogWriter
 func (runner *ContainerRunner) NewArvLogWriter(name string) (io.WriteCloser, error) {
-	writer, err := runner.LogCollection.OpenFile(name+".txt", os.O_CREATE|os.O_WRONLY, 0666)
+	var writer io.WriteCloser
+	var err error
+	if runner.logRotateSize > 0 && (name == "stdout" || name == "stderr") {
+		writer, err = newRotatingLogWriter(runner.LogCollection, name, runner.logRotateSize)
+	} else {
+		writer, err = runner.LogCollection.OpenFile(name+".txt", os.O_CREATE|os.O_WRONLY, 0666)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &ArvLogWriter{
+	arvlog := &ArvLogWriter{
 		ArvClient:     runner.DispatcherArvClient,
 		UUID:          runner.Container.UUID,
 		loggingStream: name,
 		writeCloser:   writer,
-	}, nil
+	}
+	if len(runner.logForwarders) > 0 && (name == "stdout" || name == "stderr") {
+		return &forwardingLogWriter{
+			WriteCloser: arvlog,
+			stream:      name,
+			forwarders:  runner.logForwarders,
+			sampleRate:  runner.logForwardSampleRate,
+		}, nil
+	}
+	return arvlog, nil
 }
 
 // Run the full container lifecycle.
@@ -1552,9 +1933,12 @@ func (runner *ContainerRunner) Run() (err error) {
 	}
 
 	runner.finalState = "Queued"
+	runner.status.setPhase("starting")
 
 	defer func() {
+		runner.status.setPhase("done")
 		runner.CleanupDirs()
+		runner.closeLiveLogs()
 
 		runner.CrunchLog.Printf("crunch-run finished")
 		runner.CrunchLog.Close()
@@ -1593,6 +1977,7 @@ func (runner *ContainerRunner) Run() (err error) {
 
 		if runner.finalState == "Queued" {
 			runner.UpdateContainerFinal()
+			runner.runPostRunHook()
 			return
 		}
 
@@ -1602,10 +1987,16 @@ func (runner *ContainerRunner) Run() (err error) {
 			// capture partial output and write logs
 		}
 
+		runner.status.setPhase("saving output")
 		checkErr("CaptureOutput", runner.CaptureOutput())
 		checkErr("stopHoststat", runner.stopHoststat())
+		runner.status.setPhase("saving logs")
 		checkErr("CommitLogs", runner.CommitLogs())
-		checkErr("UpdateContainerFinal", runner.UpdateContainerFinal())
+		runner.status.setPhase("finalizing")
+		finalErr := runner.UpdateContainerFinal()
+		checkErr("UpdateContainerFinal", finalErr)
+		runner.closeUploadCheckpoint(finalErr == nil && runner.finalState == "Complete")
+		runner.runPostRunHook()
 	}()
 
 	runner.setupSignals()
@@ -1615,6 +2006,7 @@ func (runner *ContainerRunner) Run() (err error) {
 	}
 
 	// check for and/or load image
+	runner.status.setPhase("loading image")
 	err = runner.LoadImage()
 	if err != nil {
 		if !runner.checkBrokenNode(err) {
@@ -1627,6 +2019,7 @@ func (runner *ContainerRunner) Run() (err error) {
 	}
 
 	// set up FUSE mount and binds
+	runner.status.setPhase("setting up mounts")
 	err = runner.SetupMounts()
 	if err != nil {
 		runner.finalState = "Cancelled"
@@ -1634,6 +2027,12 @@ func (runner *ContainerRunner) Run() (err error) {
 		return
 	}
 
+	runner.status.setPhase("creating container")
+	err = runner.CaptureEnvironment()
+	if err != nil {
+		return
+	}
+
 	err = runner.CreateContainer()
 	if err != nil {
 		return
@@ -1671,6 +2070,7 @@ func (runner *ContainerRunner) Run() (err error) {
 		runner.checkBrokenNode(err)
 		return
 	}
+	runner.status.setPhase("running")
 
 	err = runner.WaitFinish()
 	if err == nil && !runner.IsCancelled() {
@@ -1709,6 +2109,7 @@ func (runner *ContainerRunner) fetchContainerRecord() error {
 	if err != nil {
 		return fmt.Errorf("error creating container API client: %v", err)
 	}
+	runner.ContainerKeepClient = &statusKeepClient{IKeepClient: runner.ContainerKeepClient, status: &runner.status}
 
 	err = runner.ContainerArvClient.Call("GET", "containers", runner.Container.UUID, "secret_mounts", nil, &sm)
 	if err != nil {
@@ -1734,11 +2135,23 @@ func NewContainerRunner(dispatcherClient *arvados.Client,
 		dispatcherClient:     dispatcherClient,
 		DispatcherArvClient:  dispatcherArvClient,
 		DispatcherKeepClient: dispatcherKeepClient,
-		Docker:               docker,
+		executor:             newDockerExecutor(docker),
 	}
 	cr.NewLogWriter = cr.NewArvLogWriter
+	cr.updates = &updateQueue{
+		arv:        dispatcherArvClient,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		logf:       func(f string, args ...interface{}) { cr.CrunchLog.Printf(f, args...) },
+		onExpire:   cr.runBrokenNodeHook,
+	}
 	cr.RunArvMount = cr.ArvMountCmd
 	cr.MkTempDir = ioutil.TempDir
+	cr.secretTmpfs = "/dev/shm"
+	cr.scrubber = &secretScrubber{}
+	cr.readKernelLog = func() ([]byte, error) {
+		return exec.Command("dmesg").Output()
+	}
 	cr.MkArvClient = func(token string) (IArvadosClient, IKeepClient, *arvados.Client, error) {
 		cl, err := arvadosclient.MakeArvadosClient()
 		if err != nil {
@@ -1765,6 +2178,7 @@ func NewContainerRunner(dispatcherClient *arvados.Client,
 	}
 	cr.CrunchLog = NewThrottledLogger(w)
 	cr.CrunchLog.Immediate = log.New(os.Stderr, containerUUID+" ", 0)
+	cr.CrunchLog.scrubber = cr.scrubber
 
 	loadLogThrottleParams(dispatcherArvClient)
 	go cr.updateLogs()
@@ -1776,14 +2190,20 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
 	statInterval := flags.Duration("crunchstat-interval", 10*time.Second, "sampling period for periodic resource usage reporting")
 	cgroupRoot := flags.String("cgroup-root", "/sys/fs/cgroup", "path to sysfs cgroup tree")
+	logRotateSize := flags.Int64("log-rotate-size", 0, "split stdout/stderr logs into multiple files (stdout.0001.txt, ...) of at most this many bytes, and list them in stdout.index.txt (0 = no limit)")
+	var envCaptureCommands stringListFlag
+	flags.Var(&envCaptureCommands, "capture-environment", "shell `command` to run in the container image before starting the container (e.g., \"pip freeze\"); outputs are saved in the log collection as environment.json (may be given multiple times)")
 	cgroupParent := flags.String("cgroup-parent", "docker", "name of container's parent cgroup (ignored if -cgroup-parent-subsystem is used)")
 	cgroupParentSubsystem := flags.String("cgroup-parent-subsystem", "", "use current cgroup for given subsystem as parent cgroup for container")
 	caCertsPath := flags.String("ca-certs", "", "Path to TLS root certificates")
+	postRunHook := flags.String("post-run-hook", "", "`program` to run after the container is finalized, with CRUNCH_CONTAINER_UUID, CRUNCH_CONTAINER_STATE, and CRUNCH_CONTAINER_EXIT_CODE set in its environment")
 	detach := flags.Bool("detach", false, "Detach from parent process and run in the background")
 	stdinEnv := flags.Bool("stdin-env", false, "Load environment variables from JSON message on stdin")
 	sleep := flags.Duration("sleep", 0, "Delay before starting (testing use only)")
 	kill := flags.Int("kill", -1, "Send signal to an existing crunch-run process for given UUID")
 	list := flags.Bool("list", false, "List UUIDs of existing crunch-run processes")
+	status := flags.Bool("status", false, "Print live status of an existing crunch-run process for given UUID, as JSON")
+	statusDir := flags.String("status-dir", filepath.Join(lockdir, "crunch-run-status"), "serve live status (see -status) on a unix socket in `dir` (\"\" = don't serve)")
 	enableNetwork := flags.String("container-enable-networking", "default",
 		`Specify if networking should be enabled for container.  One of 'default', 'always':
     	default: only enable networking if container requests it.
@@ -1793,6 +2213,32 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		`Set networking mode for container.  Corresponds to Docker network mode (--net).
     	`)
 	memprofile := flags.String("memprofile", "", "write memory profile to `file` after running container")
+	updateQueueDir := flags.String("update-queue-dir", filepath.Join(lockdir, "crunch-run-updates"), "save outstanding container state updates in `dir` so they can be retried by a later crunch-run process if this one exits first (\"\" = don't save)")
+	updateMaxAge := flags.Duration("update-max-age", 10*time.Minute, "keep retrying a container state update for up to this long if the API server is unreachable, then run the broken node hook (0 = don't retry)")
+	imageGCRun := flags.Bool("image-gc", false, "Remove docker images that have not been used recently (see -image-gc-max-age and -image-gc-max-size), then exit")
+	imageGCMaxAge := flags.Duration("image-gc-max-age", 0, "after running the container, remove docker images that have not been used for this long (0 = no limit)")
+	imageGCMaxSize := flags.Int64("image-gc-max-size", 0, "after running the container, remove least recently used docker images until the total size of all images is at most this many bytes (0 = no limit)")
+	imageUsageDir := flags.String("image-usage-dir", filepath.Join(lockdir, "crunch-run-images"), "record when each docker image was last used in `dir`, for image GC")
+	hoststatTopProcesses := flags.Int("hoststat-top-processes", 0, "in each hoststat log interval, also report `N` processes on the host with the largest RSS, and N processes that used the most CPU time since the previous interval (0 = don't)")
+	var propagateEnv stringListFlag
+	flags.Var(&propagateEnv, "propagate-env", "copy environment variable `name` from crunch-run's environment into the container, unless the container's environment sets it; a name ending in \"*\" matches all variables with that prefix; ARVADOS_* variables are never copied (may be given multiple times)")
+	var logForwardURLs stringListFlag
+	flags.Var(&logForwardURLs, "log-forward", "also send container stdout and stderr to the log collector at `URL`: syslog://host:port (UDP), syslog+tcp://host:port, fluentd://host:port/tag (fluentd in_http input), or fluentd+https://host:port/tag (may be given multiple times)")
+	logForwardSampleRate := flags.Float64("log-forward-sample-rate", 1, "fraction of stdout/stderr lines to send to log collectors (see -log-forward), between 0 and 1")
+	dockerRetries := flags.Int("docker-api-retries", 0, "number of times to retry a Docker API call that fails with a transient error, such as a dropped connection or a daemon restart")
+	dockerRetryBackoff := flags.Duration("docker-api-retry-backoff", 2*time.Second, "time to wait before the first retry of a Docker API call (see -docker-api-retries); doubles after each attempt")
+	runtimeEngine := flags.String("runtime-engine", "docker", "container runtime: \"docker\" or \"podman\" (using the Docker-compatible API of \"podman system service\", which may be rootless)")
+	podmanSocket := flags.String("podman-socket", "", "path of the podman API socket (default $XDG_RUNTIME_DIR/podman/podman.sock, or /run/podman/podman.sock if running as root)")
+	uploadCheckpointInterval := flags.Duration("upload-checkpoint-interval", time.Minute, "while copying output to Keep, save the blocks written so far in a checkpoint collection at this `interval`, so a retry of the same container request can resume the upload (0 = don't save checkpoints)")
+	outputUploadThreads := flags.Int("output-upload-threads", defaultUploadThreads, "number of output blocks to write to Keep concurrently, unless overridden by the container's output_upload_threads runtime constraint (each uses up to 64 MiB of memory)")
+	maxOutputSize := flags.Int64("max-output-size", 0, "fail the container instead of saving its output if the files in its output directory total more than this many bytes, or the container's max_output_size scheduling parameter if that is lower (0 = no limit)")
+	outputArvMount := flags.Bool("output-arv-mount", false, "if the output directory is a \"tmp\" mount, use a writable collection in arv-mount instead of a local directory, so output data is written to Keep as the container writes it (the container can't create symlinks in its output directory)")
+	liveLogs := flags.Bool("live-logs", false, "stream stdout, stderr, and crunch-run log lines to the websocket server as they are written, in addition to the usual batched log entries")
+	secretTmpfs := flags.String("secret-tmpfs-dir", "/dev/shm", "write the content of \"secret\" mounts to files in `dir`, which must be on a tmpfs filesystem")
+	keepMountEngine := flags.String("keep-mount-engine", "arv-mount", "program that provides collection mounts: \"arv-mount\" or \"experimental-go\" (\"arvados-client mount\", read-only, used only if the container has no writable collection mounts)")
+	cloudMetadata := flags.String("cloud-metadata", "", "query the instance metadata service of cloud `provider` (ec2, gce, or azure) for the instance type, zone, and preemptible/spot status, and record them in node-info and the container requests' properties (\"\" = don't)")
+	local := flags.Bool("local", false, "read a container record (JSON) from stdin and run it without an API server or Keep: container_image is a local docker image, \"collection\" and \"git_tree\" mounts are not supported, output is written to the -local-output directory, and logs are written to stderr")
+	localOutput := flags.String("local-output", "", "in -local mode, write the container's output to `dir` instead of saving it in Keep")
 	flags.Duration("check-containerd", 0, "Ignored. Exists for compatibility with older versions.")
 
 	ignoreDetachFlag := false
@@ -1814,6 +2260,11 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		return 1
 	}
 
+	if *local && *stdinEnv {
+		log.Print("-local and -stdin-env cannot be used together")
+		return 1
+	}
+
 	if *stdinEnv && !ignoreDetachFlag {
 		// Load env vars on stdin if asked (but not in a
 		// detached child process, in which case stdin is
@@ -1834,12 +2285,85 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		return KillProcess(containerID, syscall.Signal(*kill), os.Stdout, os.Stderr)
 	case *list:
 		return ListProcesses(os.Stdout, os.Stderr)
+	case *status:
+		return PrintStatus(*statusDir, containerID, os.Stdout, os.Stderr)
+	case *imageGCRun:
+		docker, err := newEngineClient(*runtimeEngine, *podmanSocket)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		gc := &imageGC{
+			docker:   docker,
+			usageDir: *imageUsageDir,
+			maxAge:   *imageGCMaxAge,
+			maxSize:  *imageGCMaxSize,
+			logf:     log.Printf,
+		}
+		if err := gc.Run(context.Background()); err != nil {
+			log.Printf("image GC: %s", err)
+			return 1
+		}
+		return 0
+	case *local:
+		if *localOutput == "" {
+			log.Print("-local requires -local-output")
+			return 1
+		}
+		outputDir, err := filepath.Abs(*localOutput)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		engineClient, err := newEngineClient(*runtimeEngine, *podmanSocket)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		cr, err := newLocalRunner(os.Stdin, outputDir, engineClient, os.Stderr)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if *runtimeEngine == "podman" {
+			cr.executor = newPodmanExecutor(engineClient, os.Getuid() != 0)
+		}
+		cr.statInterval = *statInterval
+		cr.cgroupRoot = *cgroupRoot
+		cr.expectCgroupParent = *cgroupParent
+		cr.enableNetwork = *enableNetwork
+		cr.networkMode = *networkMode
+		cr.dockerRetries = *dockerRetries
+		cr.dockerRetryBackoff = *dockerRetryBackoff
+		cr.secretTmpfs = *secretTmpfs
+		cr.propagateEnv = propagateEnv
+		code, err := cr.runLocal()
+		if err != nil {
+			return 1
+		}
+		return code
 	}
 
 	if containerID == "" {
 		log.Printf("usage: %s [options] UUID", prog)
 		return 1
 	}
+	if _, ok := cloudMetadataURLs[*cloudMetadata]; *cloudMetadata != "" && !ok {
+		log.Printf("unsupported -cloud-metadata provider %q", *cloudMetadata)
+		return 1
+	}
+	if *runtimeEngine != "docker" && *runtimeEngine != "podman" {
+		log.Printf("unsupported -runtime-engine %q", *runtimeEngine)
+		return 1
+	}
+	if *keepMountEngine != "arv-mount" && *keepMountEngine != "experimental-go" {
+		log.Printf("unsupported -keep-mount-engine %q", *keepMountEngine)
+		return 1
+	}
+	if *logForwardSampleRate <= 0 || *logForwardSampleRate > 1 {
+		log.Printf("invalid -log-forward-sample-rate %v: must be greater than 0 and at most 1", *logForwardSampleRate)
+		return 1
+	}
 
 	log.Printf("crunch-run %s started", cmd.Version.String())
 	time.Sleep(*sleep)
@@ -1863,15 +2387,16 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: 2}
 	kc.Retries = 4
 
-	// API version 1.21 corresponds to Docker 1.9, which is currently the
-	// minimum version we want to support.
-	docker, dockererr := dockerclient.NewClient(dockerclient.DefaultDockerHost, "1.21", nil, nil)
+	engineClient, dockererr := newEngineClient(*runtimeEngine, *podmanSocket)
 
-	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, docker, containerID)
+	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, engineClient, containerID)
 	if err != nil {
 		log.Print(err)
 		return 1
 	}
+	if *runtimeEngine == "podman" {
+		cr.executor = newPodmanExecutor(engineClient, os.Getuid() != 0)
+	}
 	if dockererr != nil {
 		cr.CrunchLog.Printf("%s: %v", containerID, dockererr)
 		cr.checkBrokenNode(dockererr)
@@ -1884,7 +2409,9 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		AuthSecret:        os.Getenv("GatewayAuthSecret"),
 		ContainerUUID:     containerID,
 		DockerContainerID: &cr.ContainerID,
+		RuntimeEngine:     *runtimeEngine,
 		Log:               cr.CrunchLog,
+		SnapshotOutput:    cr.snapshotOutput,
 	}
 	os.Unsetenv("GatewayAuthSecret")
 	if cr.gateway.Address != "" {
@@ -1895,6 +2422,15 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		}
 	}
 
+	if *statusDir != "" {
+		stopStatus, err := cr.serveStatus(*statusDir)
+		if err != nil {
+			log.Printf("error starting status server: %s", err)
+		} else {
+			defer stopStatus()
+		}
+	}
+
 	parentTemp, tmperr := cr.MkTempDir("", "crunch-run."+containerID+".")
 	if tmperr != nil {
 		log.Printf("%s: %v", containerID, tmperr)
@@ -1904,17 +2440,53 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	cr.parentTemp = parentTemp
 	cr.statInterval = *statInterval
 	cr.cgroupRoot = *cgroupRoot
+	cr.logRotateSize = *logRotateSize
+	cr.envCaptureCommands = envCaptureCommands
+	cr.postRunHook = *postRunHook
+	cr.updates.dir = *updateQueueDir
+	cr.updates.maxAge = *updateMaxAge
 	cr.expectCgroupParent = *cgroupParent
 	cr.enableNetwork = *enableNetwork
 	cr.networkMode = *networkMode
+	cr.imageUsageDir = *imageUsageDir
+	cr.cloudMetadataProvider = *cloudMetadata
+	cr.logForwardSampleRate = *logForwardSampleRate
+	cr.dockerRetries = *dockerRetries
+	cr.dockerRetryBackoff = *dockerRetryBackoff
+	cr.secretTmpfs = *secretTmpfs
+	cr.keepMountEngine = *keepMountEngine
+	cr.uploadCheckpointInterval = *uploadCheckpointInterval
+	cr.outputUploadThreads = *outputUploadThreads
+	cr.maxOutputSize = *maxOutputSize
+	cr.outputArvMount = *outputArvMount
+	cr.propagateEnv = propagateEnv
+	cr.hoststatTopProcesses = *hoststatTopProcesses
+	cr.setupLogForwarders(logForwardURLs)
+	if *liveLogs {
+		cr.setupLiveLogs(api.ApiInsecure)
+	}
 	if *cgroupParentSubsystem != "" {
 		p := findCgroup(*cgroupParentSubsystem)
 		cr.setCgroupParent = p
 		cr.expectCgroupParent = p
 	}
 
+	cr.updates.Replay()
 	runerr := cr.Run()
 
+	if *imageGCMaxAge > 0 || *imageGCMaxSize > 0 {
+		gc := &imageGC{
+			docker:   engineClient,
+			usageDir: *imageUsageDir,
+			maxAge:   *imageGCMaxAge,
+			maxSize:  *imageGCMaxSize,
+			logf:     log.Printf,
+		}
+		if err := gc.Run(context.Background()); err != nil {
+			log.Printf("image GC: %s", err)
+		}
+	}
+
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
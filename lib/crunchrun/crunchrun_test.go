@@ -16,6 +16,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
 	"runtime/pprof"
 	"sort"
 	"strings"
@@ -70,6 +71,8 @@ type ArvTestClient struct {
 type KeepTestClient struct {
 	Called  bool
 	Content []byte
+
+	mtx sync.Mutex // PutB can be called concurrently (see copier)
 }
 
 var hwManifest = ". 82ab40c24fc8df01798e57ba66795bb1+841216+Aa124ac75e5168396c73c0a18eda641a4f41791c0@569fa8c3 0:841216:9c31ee32b3d15268a0754e8edc74d4f815ee014b693bc5109058e431dd5caea7.tar\n"
@@ -94,6 +97,10 @@ var fakeAuthToken = "a3ltuwzqcu2u4sc0q7yhpc2w7s00fdcqecg5d6e0u3pfohmbjt"
 
 type TestDockerClient struct {
 	imageLoaded string
+	imageOS     string
+	imageArch   string
+	imageEntry  []string
+	entrypoint  []string
 	logReader   io.ReadCloser
 	logWriter   io.WriteCloser
 	fn          func(t *TestDockerClient)
@@ -105,6 +112,7 @@ type TestDockerClient struct {
 	realTemp    string
 	calledWait  bool
 	ctrExited   bool
+	oomKilled   bool
 }
 
 func NewTestDockerClient() *TestDockerClient {
@@ -137,6 +145,7 @@ func (t *TestDockerClient) ContainerCreate(ctx context.Context, config *dockerco
 		t.cwd = config.WorkingDir
 	}
 	t.env = config.Env
+	t.entrypoint = config.Entrypoint
 	return dockercontainer.ContainerCreateCreatedBody{ID: "abcde"}, nil
 }
 
@@ -185,6 +194,7 @@ func (t *TestDockerClient) ContainerInspect(ctx context.Context, id string) (c d
 	} else {
 		c.State = &dockertypes.ContainerState{Status: "running", Pid: 1234, Running: true}
 	}
+	c.State.OOMKilled = t.oomKilled
 	return
 }
 
@@ -194,7 +204,7 @@ func (t *TestDockerClient) ImageInspectWithRaw(ctx context.Context, image string
 	}
 
 	if t.imageLoaded == image {
-		return dockertypes.ImageInspect{}, nil, nil
+		return dockertypes.ImageInspect{Os: t.imageOS, Architecture: t.imageArch, Config: &dockercontainer.Config{Entrypoint: t.imageEntry}}, nil, nil
 	}
 	return dockertypes.ImageInspect{}, nil, errors.New("")
 }
@@ -259,6 +269,8 @@ func (client *ArvTestClient) Call(method, resourceType, uuid, action string, par
 			return json.Unmarshal(client.secretMounts, output)
 		}
 		return json.Unmarshal([]byte(`{"secret_mounts":{}}`), output)
+	case method == "GET" && resourceType == "container_requests" && action == "":
+		return json.Unmarshal([]byte(`{"items":[{"uuid":"zzzzz-xvhdp-zzzzzzzzzzzzzzz","properties":{"foo":"bar"}}]}`), output)
 	default:
 		return fmt.Errorf("Not found")
 	}
@@ -376,6 +388,8 @@ func (client *KeepTestClient) LocalLocator(locator string) (string, error) {
 }
 
 func (client *KeepTestClient) PutB(buf []byte) (string, int, error) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
 	client.Content = buf
 	return fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf)), len(buf), nil
 }
@@ -447,10 +461,10 @@ func (s *TestSuite) TestLoadImage(c *C) {
 	cr.ContainerArvClient = &ArvTestClient{}
 	cr.ContainerKeepClient = kc
 
-	_, err = cr.Docker.ImageRemove(nil, hwImageID, dockertypes.ImageRemoveOptions{})
+	_, err = s.docker.ImageRemove(nil, hwImageID, dockertypes.ImageRemoveOptions{})
 	c.Check(err, IsNil)
 
-	_, _, err = cr.Docker.ImageInspectWithRaw(nil, hwImageID)
+	_, _, err = s.docker.ImageInspectWithRaw(nil, hwImageID)
 	c.Check(err, NotNil)
 
 	cr.Container.ContainerImage = hwPDH
@@ -463,13 +477,13 @@ func (s *TestSuite) TestLoadImage(c *C) {
 
 	c.Check(err, IsNil)
 	defer func() {
-		cr.Docker.ImageRemove(nil, hwImageID, dockertypes.ImageRemoveOptions{})
+		s.docker.ImageRemove(nil, hwImageID, dockertypes.ImageRemoveOptions{})
 	}()
 
 	c.Check(kc.Called, Equals, true)
 	c.Check(cr.ContainerConfig.Image, Equals, hwImageID)
 
-	_, _, err = cr.Docker.ImageInspectWithRaw(nil, hwImageID)
+	_, _, err = s.docker.ImageInspectWithRaw(nil, hwImageID)
 	c.Check(err, IsNil)
 
 	// (2) Test using image that's already loaded
@@ -483,6 +497,55 @@ func (s *TestSuite) TestLoadImage(c *C) {
 
 }
 
+func (s *TestSuite) TestLoadImageIncompatiblePlatform(c *C) {
+	api := &ArvTestClient{}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, api, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerArvClient = &ArvTestClient{}
+	cr.ContainerKeepClient = kc
+	cr.Container.ContainerImage = hwPDH
+	s.docker.imageLoaded = hwImageID
+
+	otherArch := "arm64"
+	if runtime.GOARCH == "arm64" {
+		otherArch = "amd64"
+	}
+	for _, trial := range []struct {
+		os, arch string
+		ok       bool
+	}{
+		{"", "", true},
+		{runtime.GOOS, runtime.GOARCH, true},
+		{"", runtime.GOARCH, true},
+		{runtime.GOOS, otherArch, false},
+		{"windows", runtime.GOARCH, false},
+	} {
+		c.Logf("%+v", trial)
+		s.docker.imageOS, s.docker.imageArch = trial.os, trial.arch
+		api.Content = nil
+		err = cr.LoadImage()
+		var updates []arvadosclient.Dict
+		for _, content := range api.Content {
+			if ctr, ok := content["container"].(arvadosclient.Dict); ok {
+				updates = append(updates, ctr)
+			}
+		}
+		if trial.ok {
+			c.Check(err, IsNil)
+			c.Check(updates, HasLen, 0)
+			continue
+		}
+		c.Check(err, ErrorMatches, `container image platform .* is not compatible with this node's platform .*`)
+		c.Assert(updates, HasLen, 1)
+		rs := updates[0]["runtime_status"].(arvadosclient.Dict)
+		c.Check(rs["error"], Matches, `.*not compatible.*`)
+		c.Check(rs["errorDetail"], Matches, `container image platform `+trial.os+`/`+trial.arch+` .*`)
+	}
+	c.Check(api.Logs["node-info"].String(), Matches, `(?ms).*Image compatibility\n.*not compatible.*`)
+}
+
 type ArvErrorTestClient struct{}
 
 func (ArvErrorTestClient) Create(resourceType string,
@@ -551,7 +614,7 @@ func (ErrorReader) Seek(int64, int) (int64, error) {
 	return 0, errors.New("ErrorReader")
 }
 
-func (KeepReadErrorTestClient) ManifestFileReader(m manifest.Manifest, filename string) (arvados.File, error) {
+func (*KeepReadErrorTestClient) ManifestFileReader(m manifest.Manifest, filename string) (arvados.File, error) {
 	return ErrorReader{}, nil
 }
 
@@ -614,6 +677,192 @@ func (s *TestSuite) TestLoadImageKeepReadError(c *C) {
 	c.Check(err, NotNil)
 }
 
+// envCaptureDockerClient emulates the short-lived containers started
+// by CaptureEnvironment: "pip freeze" succeeds, anything else fails
+// with "not found".
+type envCaptureDockerClient struct {
+	*TestDockerClient
+	created []*dockercontainer.Config
+	removed []string
+}
+
+func (t *envCaptureDockerClient) ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig, networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error) {
+	t.created = append(t.created, config)
+	return dockercontainer.ContainerCreateCreatedBody{ID: fmt.Sprintf("env%d", len(t.created)-1)}, nil
+}
+
+func (t *envCaptureDockerClient) ContainerAttach(ctx context.Context, container string, options dockertypes.ContainerAttachOptions) (dockertypes.HijackedResponse, error) {
+	var idx int
+	fmt.Sscanf(container, "env%d", &idx)
+	frame := func(stream byte, data string) []byte {
+		return append([]byte{stream, 0, 0, 0, 0, 0, 0, byte(len(data))}, data...)
+	}
+	var buf []byte
+	if t.created[idx].Cmd[2] == "pip freeze" {
+		buf = append(frame(1, "numpy==1.19.5\n"), frame(1, "six==1.15.0\n")...)
+	} else {
+		buf = frame(2, "/bin/sh: 1: "+t.created[idx].Cmd[2]+": not found\n")
+	}
+	conn, _ := net.Pipe()
+	return dockertypes.HijackedResponse{Conn: conn, Reader: bufio.NewReader(bytes.NewReader(buf))}, nil
+}
+
+func (t *envCaptureDockerClient) ContainerStart(ctx context.Context, container string, options dockertypes.ContainerStartOptions) error {
+	return nil
+}
+
+func (t *envCaptureDockerClient) ContainerWait(ctx context.Context, container string, condition dockercontainer.WaitCondition) (<-chan dockercontainer.ContainerWaitOKBody, <-chan error) {
+	var idx int
+	fmt.Sscanf(container, "env%d", &idx)
+	body := make(chan dockercontainer.ContainerWaitOKBody, 1)
+	if t.created[idx].Cmd[2] == "pip freeze" {
+		body <- dockercontainer.ContainerWaitOKBody{StatusCode: 0}
+	} else {
+		body <- dockercontainer.ContainerWaitOKBody{StatusCode: 127}
+	}
+	return body, make(chan error)
+}
+
+func (t *envCaptureDockerClient) ContainerRemove(ctx context.Context, container string, options dockertypes.ContainerRemoveOptions) error {
+	t.removed = append(t.removed, container)
+	return nil
+}
+
+func (s *TestSuite) TestCaptureEnvironment(c *C) {
+	docker := &envCaptureDockerClient{TestDockerClient: s.docker}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, kc, docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerConfig.Image = hwImageID
+	cr.Container.Environment = map[string]string{"FOO": "bar"}
+
+	// No commands configured: nothing to do
+	c.Check(cr.CaptureEnvironment(), IsNil)
+	c.Check(docker.created, HasLen, 0)
+	_, err = cr.LogCollection.Stat("environment.json")
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	cr.envCaptureCommands = []string{"pip freeze", "conda list"}
+	c.Check(cr.CaptureEnvironment(), IsNil)
+	c.Assert(docker.created, HasLen, 2)
+	c.Check(docker.created[0].Image, Equals, hwImageID)
+	c.Check([]string(docker.created[0].Cmd), DeepEquals, []string{"/bin/sh", "-c", "pip freeze"})
+	c.Check(docker.created[0].Env, DeepEquals, []string{"FOO=bar"})
+	c.Check(docker.removed, DeepEquals, []string{"env0", "env1"})
+
+	f, err := cr.LogCollection.Open("environment.json")
+	c.Assert(err, IsNil)
+	var results []envCaptureResult
+	err = json.NewDecoder(f).Decode(&results)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].Command, Equals, "pip freeze")
+	c.Check(*results[0].ExitCode, Equals, 0)
+	c.Check(results[0].Stdout, Equals, "numpy==1.19.5\nsix==1.15.0\n")
+	c.Check(results[0].Stderr, Equals, "")
+	c.Check(results[1].Command, Equals, "conda list")
+	c.Check(*results[1].ExitCode, Equals, 127)
+	c.Check(results[1].Stdout, Equals, "")
+	c.Check(results[1].Stderr, Equals, "/bin/sh: 1: conda list: not found\n")
+}
+
+func (s *TestSuite) TestPostRunHook(c *C) {
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+
+	tmpdir := c.MkDir()
+	hook := tmpdir + "/hook"
+	err = ioutil.WriteFile(hook, []byte(`#!/bin/sh
+echo "$CRUNCH_CONTAINER_UUID $CRUNCH_CONTAINER_STATE [$CRUNCH_CONTAINER_EXIT_CODE]" >>`+tmpdir+`/hook.out
+`), 0700)
+	c.Assert(err, IsNil)
+
+	// No hook configured: nothing to do
+	cr.runPostRunHook()
+	_, err = os.Stat(tmpdir + "/hook.out")
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	cr.postRunHook = hook
+	cr.finalState = "Cancelled"
+	cr.runPostRunHook()
+	exitCode := 3
+	cr.ExitCode = &exitCode
+	cr.finalState = "Complete"
+	cr.runPostRunHook()
+	buf, err := ioutil.ReadFile(tmpdir + "/hook.out")
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, "zzzzz-zzzzz-zzzzzzzzzzzzzzz Cancelled []\nzzzzz-zzzzz-zzzzzzzzzzzzzzz Complete [3]\n")
+}
+
+func (s *TestSuite) TestClassifyExitOOM(c *C) {
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	api := &ArvTestClient{}
+	cr, err := NewContainerRunner(s.client, api, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerID = "abcde"
+	cr.Container.RuntimeConstraints.RAM = 1000000
+	kernelLog := "[100.0] some other container abcdf: oom-kill\n"
+	cr.readKernelLog = func() ([]byte, error) { return []byte(kernelLog), nil }
+
+	// Exit code 137 alone is not evidence of an OOM kill.
+	cr.classifyExit(137)
+	c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorOutOfMemory), IsNil)
+	c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorSignal), NotNil)
+	c.Check(api.CalledWith("container.runtime_status.errorDetail", "exit code 137: signal 9 (killed); no evidence of an out-of-memory kill was found, so it was probably sent by a process in the container or on the host"), NotNil)
+
+	// Other signals.
+	api.Content = nil
+	cr.classifyExit(139)
+	c.Check(api.CalledWith("container.runtime_status.errorDetail", "exit code 139: signal 11 (segmentation fault)"), NotNil)
+
+	// A non-zero exit code is not recorded in runtime_status.
+	api.Content = nil
+	cr.classifyExit(1)
+	c.Check(api.Content, HasLen, 0)
+
+	// Docker's OOMKilled flag.
+	s.docker.oomKilled = true
+	cr.classifyExit(1)
+	c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorOutOfMemory), NotNil)
+	c.Check(api.CalledWith("container.runtime_status.errorDetail", "docker reports the container was OOM-killed (runtime_constraints.ram was 1000000 bytes)"), NotNil)
+
+	// Kernel log mentioning this container.
+	s.docker.oomKilled = false
+	api.Content = nil
+	kernelLog += "[200.0] oom-kill:constraint=CONSTRAINT_MEMCG,oom_memcg=/docker/abcde,task_memcg=/docker/abcde,task=python,pid=1234,uid=0\n"
+	cr.classifyExit(1)
+	c.Check(api.Content, HasLen, 0)
+	cr.classifyExit(137)
+	c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorOutOfMemory), NotNil)
+	c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorSignal), IsNil)
+}
+
+func (s *TestSuite) TestRuntimeStatusErrorPreservesOtherKeys(c *C) {
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	api := &ArvTestClient{}
+	cr, err := NewContainerRunner(s.client, api, kc, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	api.Container.RuntimeStatus = map[string]interface{}{
+		"slurmJobID":           "1234",
+		"warning":              "slow node",
+		"estimated_start_time": "2021-02-03T04:05:06Z",
+	}
+	cr.classifyExit(139)
+	c.Assert(api.Content, HasLen, 1)
+	c.Check(api.Content[0]["container"].(arvadosclient.Dict)["runtime_status"], DeepEquals, arvadosclient.Dict{
+		"slurmJobID":           "1234",
+		"warning":              "slow node",
+		"estimated_start_time": "2021-02-03T04:05:06Z",
+		"error":                arvados.RuntimeStatusErrorSignal,
+		"errorDetail":          "exit code 139: signal 11 (segmentation fault)",
+	})
+}
+
 type ClosableBuffer struct {
 	bytes.Buffer
 }
@@ -1088,6 +1337,43 @@ func (s *TestSuite) TestFullRunSetCwd(c *C) {
 	c.Check(strings.HasSuffix(api.Logs["stdout"].String(), "/bin\n"), Equals, true)
 }
 
+func (s *TestSuite) TestFullRunEntrypoint(c *C) {
+	for _, trial := range []struct {
+		imageEntry       []string
+		entrypoint       string
+		expectEntrypoint []string
+		expectLog        string
+	}{
+		{nil, `null`, nil, `Resolved command line: \["echo" "ok"\]`},
+		{[]string{"/entry.sh", "-x"}, `null`, nil, `Warning: container image has ENTRYPOINT \["/entry.sh" "-x"\].*\n.*Resolved command line: \["/entry.sh" "-x" "echo" "ok"\]`},
+		{[]string{"/entry.sh"}, `""`, []string{""}, `Resolved command line: \["echo" "ok"\]`},
+		{[]string{"/entry.sh"}, `"/bin/env"`, []string{"/bin/env"}, `Resolved command line: \["/bin/env" "echo" "ok"\]`},
+	} {
+		c.Logf("%+v", trial)
+		s.SetUpTest(c)
+		s.docker.imageEntry = trial.imageEntry
+		api, _, _ := s.fullRunHelper(c, `{
+    "command": ["echo", "ok"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {"entrypoint": `+trial.entrypoint+`},
+    "state": "Locked"
+}`, nil, 0, func(t *TestDockerClient) {
+			t.logWriter.Close()
+		})
+		c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+		c.Check([]string(s.docker.entrypoint), DeepEquals, trial.expectEntrypoint)
+		c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*`+trial.expectLog+`.*`)
+		if trial.entrypoint != `null` || trial.imageEntry == nil {
+			c.Check(api.Logs["crunch-run"].String(), Not(Matches), `(?ms).*Warning: container image has ENTRYPOINT.*`)
+		}
+	}
+}
+
 func (s *TestSuite) TestStopOnSignal(c *C) {
 	s.testStopContainer(c, func(cr *ContainerRunner) {
 		go func() {
@@ -1306,6 +1592,53 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 		cr.Container.RuntimeConstraints.API = false
 	}
 
+	{
+		i = 0
+		cr.ArvMountPoint = ""
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/tmp":     {Kind: "tmp"},
+			"/scratch": {Kind: "tmpfs", Capacity: 1 << 20, Mode: "1777"},
+			"/fast":    {Kind: "tmpfs", Capacity: 2 << 20},
+		}
+		cr.Container.OutputPath = "/tmp"
+		cr.Container.RuntimeConstraints.RAM = 4 << 20
+
+		err := cr.SetupMounts()
+		c.Check(err, IsNil)
+		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/tmp2:/tmp"})
+		c.Check(cr.Tmpfs, DeepEquals, map[string]string{
+			"/scratch": "size=1048576,mode=1777",
+			"/fast":    "size=2097152",
+		})
+		os.RemoveAll(cr.ArvMountPoint)
+		cr.CleanupDirs()
+		checkEmpty()
+
+		for _, trial := range []struct {
+			mnt    arvados.Mount
+			errMsg string
+		}{
+			{arvados.Mount{Kind: "tmpfs"}, `tmpfs mount "/scratch" must specify a positive capacity`},
+			{arvados.Mount{Kind: "tmpfs", Capacity: 1 << 20, Mode: "rwx"}, `tmpfs mount "/scratch" has invalid mode "rwx".*`},
+			{arvados.Mount{Kind: "tmpfs", Capacity: 1 << 20, Mode: "17777"}, `tmpfs mount "/scratch" has invalid mode "17777".*`},
+			{arvados.Mount{Kind: "tmpfs", Capacity: 8 << 20}, `total capacity of tmpfs mounts \(8388608 bytes\) exceeds the container's RAM constraint \(4194304 bytes\)`},
+		} {
+			i = 0
+			cr.ArvMountPoint = ""
+			cr.Container.Mounts = map[string]arvados.Mount{
+				"/tmp":     {Kind: "tmp"},
+				"/scratch": trial.mnt,
+			}
+			err := cr.SetupMounts()
+			c.Check(err, ErrorMatches, trial.errMsg)
+			os.RemoveAll(cr.ArvMountPoint)
+			cr.CleanupDirs()
+			checkEmpty()
+		}
+
+		cr.Container.RuntimeConstraints.RAM = 0
+	}
+
 	{
 		i = 0
 		cr.ArvMountPoint = ""
@@ -1327,6 +1660,37 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 		checkEmpty()
 	}
 
+	{
+		i = 0
+		cr.ArvMountPoint = ""
+		cr.outputArvMount = true
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/tmp":     {Kind: "tmp"},
+			"/scratch": {Kind: "tmp"},
+		}
+		cr.Container.OutputPath = "/tmp"
+
+		os.MkdirAll(realTemp+"/keep1/tmp0", os.ModePerm)
+
+		// With -output-arv-mount, a tmp output directory is a
+		// writable collection, and other tmp mounts are not
+		// affected.
+		err := cr.SetupMounts()
+		c.Check(err, IsNil)
+		c.Check(am.Cmd, DeepEquals, []string{"--foreground", "--allow-other",
+			"--read-write", "--crunchstat-interval=5",
+			"--mount-tmp", "tmp0", "--mount-by-pdh", "by_id", realTemp + "/keep1"})
+		sort.StringSlice(cr.Binds).Sort()
+		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/keep1/tmp0:/tmp", realTemp + "/tmp2:/scratch"})
+		c.Check(cr.HostOutputDir, Equals, realTemp+"/keep1/tmp0")
+		c.Check(cr.outputInArvMount, Equals, true)
+		c.Check(cr.Container.Mounts["/tmp"].Kind, Equals, "tmp")
+		os.RemoveAll(cr.ArvMountPoint)
+		cr.CleanupDirs()
+		checkEmpty()
+		cr.outputArvMount = false
+	}
+
 	{
 		i = 0
 		cr.ArvMountPoint = ""
@@ -1390,11 +1754,13 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 		cr.ArvMountPoint = ""
 		cr.Container.Mounts = map[string]arvados.Mount{
 			"/mnt/test.json": {Kind: "json", Content: test.in},
+			"/tmp":           {Kind: "tmp"},
 		}
+		cr.Container.OutputPath = "/tmp"
 		err := cr.SetupMounts()
 		c.Check(err, IsNil)
 		sort.StringSlice(cr.Binds).Sort()
-		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/json2/mountdata.json:/mnt/test.json:ro"})
+		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/json2/mountdata.json:/mnt/test.json:ro", realTemp + "/tmp3:/tmp"})
 		content, err := ioutil.ReadFile(realTemp + "/json2/mountdata.json")
 		c.Check(err, IsNil)
 		c.Check(content, DeepEquals, []byte(test.out))
@@ -1415,14 +1781,16 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 		cr.ArvMountPoint = ""
 		cr.Container.Mounts = map[string]arvados.Mount{
 			"/mnt/test.txt": {Kind: "text", Content: test.in},
+			"/tmp":          {Kind: "tmp"},
 		}
+		cr.Container.OutputPath = "/tmp"
 		err := cr.SetupMounts()
 		if test.out == "error" {
 			c.Check(err.Error(), Equals, "content for mount \"/mnt/test.txt\" must be a string")
 		} else {
 			c.Check(err, IsNil)
 			sort.StringSlice(cr.Binds).Sort()
-			c.Check(cr.Binds, DeepEquals, []string{realTemp + "/text2/mountdata.text:/mnt/test.txt:ro"})
+			c.Check(cr.Binds, DeepEquals, []string{realTemp + "/text2/mountdata.text:/mnt/test.txt:ro", realTemp + "/tmp3:/tmp"})
 			content, err := ioutil.ReadFile(realTemp + "/text2/mountdata.text")
 			c.Check(err, IsNil)
 			c.Check(content, DeepEquals, []byte(test.out))
@@ -1504,7 +1872,24 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 
 		err := cr.SetupMounts()
 		c.Check(err, NotNil)
-		c.Check(err, ErrorMatches, `only mount points of kind 'collection', 'text' or 'json' are supported underneath the output_path.*`)
+		c.Check(err, ErrorMatches, `only mount points of kind 'collection', 'text', 'json' or 'secret' are supported underneath the output_path.*`)
+		os.RemoveAll(cr.ArvMountPoint)
+		cr.CleanupDirs()
+		checkEmpty()
+	}
+
+	// Mount point of kind 'secret' is only allowed in secret_mounts
+	{
+		i = 0
+		cr.ArvMountPoint = ""
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/tmp":             {Kind: "tmp"},
+			"/tmp/secret.conf": {Kind: "secret", Content: "mypassword"},
+		}
+		cr.Container.OutputPath = "/tmp"
+
+		err := cr.SetupMounts()
+		c.Check(err, ErrorMatches, `mount "/tmp/secret.conf": kind 'secret' is only permitted in secret_mounts`)
 		os.RemoveAll(cr.ArvMountPoint)
 		cr.CleanupDirs()
 		checkEmpty()
@@ -1547,6 +1932,7 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 				Commit: "5ebfab0522851df01fec11ec55a6d0f4877b542e",
 				Path:   "/",
 			},
+			"/tmp": {Kind: "tmp", Writable: true},
 		}
 		cr.Container.OutputPath = "/tmp"
 
@@ -2198,6 +2584,56 @@ func (s *TestSuite) TestSecretTextMountPoint(c *C) {
 	c.Check(cr.ContainerArvClient.(*ArvTestClient).CalledWith("collection.manifest_text", ""), NotNil)
 }
 
+func (s *TestSuite) TestSecretMountPoint(c *C) {
+	helperRecord := `{
+		"command": ["true"],
+		"container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+		"cwd": "/bin",
+		"mounts": {
+                    "/tmp": {"kind": "tmp"}
+                },
+                "secret_mounts": {
+                    "/tmp/secret.conf": {"kind": "secret", "content": "mypassword"},
+                    "/etc/creds.json": {"kind": "secret", "content": {"token": "mytoken"}}
+                },
+		"output_path": "/tmp",
+		"priority": 1,
+		"runtime_constraints": {},
+		"state": "Locked"
+	}`
+
+	var secretFiles []string
+	api, cr, _ := s.fullRunHelper(c, helperRecord, nil, 0, func(t *TestDockerClient) {
+		for _, bind := range s.runner.Binds {
+			if strings.HasSuffix(bind, ":/tmp/secret.conf:ro") || strings.HasSuffix(bind, ":/etc/creds.json:ro") {
+				secretFiles = append(secretFiles, strings.Split(bind, ":")[0])
+			}
+		}
+		c.Assert(secretFiles, HasLen, 2)
+		sort.Strings(secretFiles)
+		for _, fn := range secretFiles {
+			c.Check(strings.HasPrefix(fn, "/dev/shm/crunch-run-secrets-"), Equals, true)
+		}
+		// Not copied into the output directory
+		_, err := os.Stat(t.realTemp + "/tmp2/secret.conf")
+		c.Check(os.IsNotExist(err), Equals, true)
+		t.logWriter.Write(dockerLog(1, "password is mypassword\n"))
+		t.logWriter.Write(dockerLog(2, "token is mytoken\n"))
+		t.logWriter.Close()
+	})
+
+	c.Check(api.CalledWith("container.exit_code", 0), NotNil)
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(cr.ContainerArvClient.(*ArvTestClient).CalledWith("collection.manifest_text", ""), NotNil)
+	c.Check(api.Logs["stdout"].String(), Matches, `.* password is \[secret\]\n`)
+	c.Check(api.Logs["stderr"].String(), Matches, `.* token is \[secret\]\n`)
+	// Files are removed when the container finishes.
+	for _, fn := range secretFiles {
+		_, err := os.Stat(fn)
+		c.Check(os.IsNotExist(err), Equals, true)
+	}
+}
+
 type FakeProcess struct {
 	cmdLine []string
 }
@@ -2205,3 +2641,147 @@ type FakeProcess struct {
 func (fp FakeProcess) CmdlineSlice() ([]string, error) {
 	return fp.cmdLine, nil
 }
+
+func (s *TestSuite) TestOutputSnapshot(c *C) {
+	var snapshots []arvados.Collection
+	api, cr, _ := s.fullRunHelper(c, `{
+    "command": ["true"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "state": "Locked"
+}`, nil, 0, func(t *TestDockerClient) {
+		for _, progress := range []string{"50%", "100%"} {
+			err := ioutil.WriteFile(s.runner.HostOutputDir+"/progress.txt", []byte(progress), 0644)
+			c.Check(err, IsNil)
+			coll, err := s.runner.snapshotOutput()
+			c.Check(err, IsNil)
+			snapshots = append(snapshots, coll)
+		}
+		t.logWriter.Close()
+	})
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+
+	// The second snapshot updates the collection created by the
+	// first.
+	c.Assert(snapshots, HasLen, 2)
+	c.Check(snapshots[0].UUID, Not(Equals), "")
+	c.Check(snapshots[1].UUID, Equals, snapshots[0].UUID)
+	client := cr.ContainerArvClient.(*ArvTestClient)
+	for _, mt := range []string{
+		". 2496af30b64c3a4ff21e8505ea439a73+3 0:3:progress.txt\n",
+		". 30bd7ce7de206924302499f197c7a966+4 0:4:progress.txt\n",
+	} {
+		call := client.CalledWith("collection.manifest_text", mt)
+		if c.Check(call, NotNil, Commentf("%s", mt)) {
+			attrs := call["collection"].(arvadosclient.Dict)
+			c.Check(attrs["name"], Equals, "output snapshot for "+cr.Container.UUID)
+			c.Check(attrs["preserve_version"], Equals, true)
+		}
+	}
+	c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*Saved output snapshot `+snapshots[0].UUID+`.*`)
+
+	// Snapshots are not possible after the container exits.
+	_, err := cr.snapshotOutput()
+	c.Check(err, ErrorMatches, `container is not running`)
+}
+
+func (s *TestSuite) TestMaxOutputSize(c *C) {
+	for _, trial := range []struct {
+		flag     int64
+		schedSP  string
+		tooLarge bool
+	}{
+		{0, `{}`, false},
+		{4, `{}`, false},
+		{3, `{}`, true},
+		{0, `{"max_output_size": 3}`, true},
+		{3, `{"max_output_size": 100}`, true},
+		{100, `{"max_output_size": 3}`, true},
+		{100, `{"max_output_size": 4}`, false},
+	} {
+		c.Logf("trial %+v", trial)
+		api, _, _ := s.fullRunHelper(c, `{
+    "command": ["true"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "scheduling_parameters": `+trial.schedSP+`,
+    "state": "Locked"
+}`, nil, 0, func(t *TestDockerClient) {
+			s.runner.maxOutputSize = trial.flag
+			err := ioutil.WriteFile(s.runner.HostOutputDir+"/foo", []byte("abcd"), 0644)
+			c.Check(err, IsNil)
+			t.logWriter.Close()
+		})
+		if trial.tooLarge {
+			c.Check(api.CalledWith("container.state", "Cancelled"), NotNil)
+			c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorOutputTooLarge), NotNil)
+			c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*output is too large: files in output directory exceed maximum output size 3 bytes.*`)
+		} else {
+			c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+			c.Check(api.CalledWith("container.runtime_status.error", arvados.RuntimeStatusErrorOutputTooLarge), IsNil)
+		}
+	}
+}
+
+func (s *TestSuite) TestCopyOutputFromArvMount(c *C) {
+	api := &ArvTestClient{}
+	cr, err := NewContainerRunner(s.client, api, &KeepTestClient{}, s.docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerArvClient = api
+	cr.ContainerKeepClient = &KeepTestClient{}
+	cr.Container.Mounts = map[string]arvados.Mount{"/tmp": {Kind: "tmp"}}
+	cr.Container.OutputPath = "/tmp"
+
+	// Simulate a writable collection in arv-mount that replaced
+	// the tmp output mount (-output-arv-mount). The files in the
+	// directory are not read.
+	cr.HostOutputDir = c.MkDir()
+	cr.Binds = []string{cr.HostOutputDir + ":/tmp"}
+	cr.outputInArvMount = true
+	c.Assert(ioutil.WriteFile(cr.HostOutputDir+"/.arvados#collection", []byte(`{"manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n"}`), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(cr.HostOutputDir+"/bar", []byte("baz"), 0644), IsNil)
+	txt, err := cr.copyOutput()
+	c.Check(err, IsNil)
+	c.Check(txt, Equals, ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n")
+	c.Check(cr.Container.Mounts["/tmp"].Kind, Equals, "tmp")
+
+	// The data in the collection was written by the container, so
+	// it counts toward the maximum output size.
+	cr.maxOutputSize = 3
+	_, err = cr.copyOutput()
+	c.Check(err, IsNil)
+	cr.maxOutputSize = 2
+	_, err = cr.copyOutput()
+	c.Check(errors.Is(err, errOutputTooLarge), Equals, true)
+	c.Check(err, ErrorMatches, `.*exceed maximum output size 2 bytes.*`)
+}
+
+func (s *TestSuite) TestOutputSnapshotInterval(c *C) {
+	api, _, _ := s.fullRunHelper(c, `{
+    "command": ["sleep", "2"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "scheduling_parameters": {"output_snapshot_interval": 1},
+    "state": "Locked"
+}`, nil, 0, func(t *TestDockerClient) {
+		time.Sleep(1500 * time.Millisecond)
+		t.logWriter.Close()
+	})
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*Saved output snapshot .*`)
+}
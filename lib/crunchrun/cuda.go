@@ -0,0 +1,50 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// cudaDockerRuntime is the Docker runtime that gives containers
+// access to NVIDIA GPUs (nvidia-container-runtime). The Docker API
+// version we use predates device requests ("docker run --gpus"), so
+// the devices are selected with the runtime's environment variables
+// instead (see cudaEnv).
+const cudaDockerRuntime = "nvidia"
+
+// cudaEnv returns the environment variables that tell the NVIDIA
+// container runtime which GPUs to expose in a container with the
+// given CUDA runtime constraints, and which driver version and
+// hardware capability to require.
+//
+// When running under SLURM with --gres=gpu:N, the devices allocated
+// to the job are listed in CUDA_VISIBLE_DEVICES. Otherwise (e.g., on
+// a cloud node chosen for the container), all devices are exposed.
+func cudaEnv(cuda arvados.CUDARuntimeConstraints, getenv func(string) string) []string {
+	if cuda.DeviceCount < 1 {
+		return nil
+	}
+	env := []string{
+		"NVIDIA_VISIBLE_DEVICES=" + cudaVisibleDevices(getenv),
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+	}
+	if cuda.DriverVersion != "" {
+		env = append(env, "NVIDIA_REQUIRE_CUDA=cuda>="+cuda.DriverVersion)
+	}
+	if cuda.HardwareCapability != "" {
+		env = append(env, "NVIDIA_REQUIRE_ARCH=arch>="+cuda.HardwareCapability)
+	}
+	return env
+}
+
+// cudaVisibleDevices returns the GPUs allocated to this process
+// ("all" if not running under SLURM with --gres=gpu:N).
+func cudaVisibleDevices(getenv func(string) string) string {
+	if devices := getenv("CUDA_VISIBLE_DEVICES"); devices != "" {
+		return devices
+	}
+	return "all"
+}
@@ -0,0 +1,62 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCUDAEnv(c *C) {
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	c.Check(cudaEnv(arvados.CUDARuntimeConstraints{}, getenv), IsNil)
+
+	cuda := arvados.CUDARuntimeConstraints{DeviceCount: 2}
+	c.Check(cudaEnv(cuda, getenv), DeepEquals, []string{
+		"NVIDIA_VISIBLE_DEVICES=all",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+	})
+
+	// Devices allocated by SLURM
+	env["CUDA_VISIBLE_DEVICES"] = "1,3"
+	cuda.DriverVersion = "11.0"
+	cuda.HardwareCapability = "7.5"
+	c.Check(cudaEnv(cuda, getenv), DeepEquals, []string{
+		"NVIDIA_VISIBLE_DEVICES=1,3",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+		"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+		"NVIDIA_REQUIRE_ARCH=arch>=7.5",
+	})
+}
+
+func (s *TestSuite) TestCreateContainerCUDA(c *C) {
+	rec := &hostConfigRecorder{TestDockerClient: s.docker}
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, &KeepTestClient{}, rec, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerArvClient = &ArvTestClient{}
+	cr.ContainerKeepClient = &KeepTestClient{}
+	var logs TestLogs
+	cr.NewLogWriter = logs.NewTestLoggingWriter
+	cr.Container.ContainerImage = hwPDH
+	cr.Container.Command = []string{"./hw"}
+	c.Assert(cr.LoadImage(), IsNil)
+
+	c.Assert(cr.CreateContainer(), IsNil)
+	c.Check(rec.hostConfig.Runtime, Equals, "")
+	for _, e := range s.docker.env {
+		c.Check(e, Not(Matches), `NVIDIA_.*`)
+	}
+
+	cr.Container.RuntimeConstraints.CUDA = arvados.CUDARuntimeConstraints{DeviceCount: 1, DriverVersion: "11.0"}
+	c.Assert(cr.CreateContainer(), IsNil)
+	c.Check(rec.hostConfig.Runtime, Equals, "nvidia")
+	c.Check(s.docker.env, DeepEquals, []string{
+		"NVIDIA_VISIBLE_DEVICES=all",
+		"NVIDIA_DRIVER_CAPABILITIES=compute,utility",
+		"NVIDIA_REQUIRE_CUDA=cuda>=11.0",
+	})
+}
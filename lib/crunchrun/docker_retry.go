@@ -0,0 +1,73 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	dockerclient "github.com/docker/docker/client"
+)
+
+// isTransientDockerError returns true if err indicates a problem
+// communicating with the Docker daemon (e.g., the daemon is
+// restarting, or the connection was dropped or timed out), as
+// opposed to an error reported by the daemon itself (e.g., the
+// container's command does not exist), which would just happen again
+// if the operation were retried.
+func isTransientDockerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if dockerclient.IsErrConnectionFailed(err) {
+		return true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "Error response from daemon: ") {
+		return false
+	}
+	for _, s := range []string{
+		"Cannot connect to the Docker daemon",
+		"connection reset by peer",
+		"broken pipe",
+		"i/o timeout",
+		"unexpected EOF",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return strings.HasSuffix(msg, ": EOF")
+}
+
+// retryDocker calls f, which performs an idempotent Docker operation,
+// and retries it if it fails with a transient error (see
+// isTransientDockerError), up to runner.dockerRetries times. The wait
+// before the first retry is runner.dockerRetryBackoff, and doubles
+// after each attempt.
+//
+// The attempt number (starting at 0) is passed to f, so it can
+// account for the possibility that a previous attempt succeeded even
+// though its response was lost.
+func (runner *ContainerRunner) retryDocker(label string, f func(attempt int) error) error {
+	backoff := runner.dockerRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := f(attempt)
+		if err == nil || attempt >= runner.dockerRetries || !isTransientDockerError(err) {
+			return err
+		}
+		runner.CrunchLog.Printf("%s failed (attempt %d of %d), retrying in %v: %s", label, attempt+1, runner.dockerRetries+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	dockernetwork "github.com/docker/docker/api/types/network"
+	. "gopkg.in/check.v1"
+)
+
+// flakyDockerClient fails ContainerCreate and ContainerStart calls
+// with the queued errors before passing them through to the
+// TestDockerClient.
+type flakyDockerClient struct {
+	*TestDockerClient
+	createErrs []error
+	startErrs  []error
+	// If true, a failed ContainerCreate call still creates the
+	// container, as if only the response had been lost.
+	createAnyway bool
+	created      bool
+	createCalls  int
+	startCalls   int
+}
+
+func (f *flakyDockerClient) ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig, networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error) {
+	f.createCalls++
+	if f.created {
+		return dockercontainer.ContainerCreateCreatedBody{}, fmt.Errorf("Error response from daemon: Conflict. The container name %q is already in use by container \"abcde\".", "/"+containerName)
+	}
+	if len(f.createErrs) > 0 {
+		err := f.createErrs[0]
+		f.createErrs = f.createErrs[1:]
+		f.created = f.createAnyway
+		return dockercontainer.ContainerCreateCreatedBody{}, err
+	}
+	f.created = true
+	return f.TestDockerClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, containerName)
+}
+
+func (f *flakyDockerClient) ContainerStart(ctx context.Context, container string, options dockertypes.ContainerStartOptions) error {
+	f.startCalls++
+	if len(f.startErrs) > 0 {
+		err := f.startErrs[0]
+		f.startErrs = f.startErrs[1:]
+		return err
+	}
+	return f.TestDockerClient.ContainerStart(ctx, container, options)
+}
+
+func (s *TestSuite) setupFlakyDocker(c *C, docker *flakyDockerClient) *ContainerRunner {
+	kc := &KeepTestClient{}
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, kc, docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.ContainerArvClient = &ArvTestClient{}
+	cr.ContainerKeepClient = &KeepTestClient{}
+	cr.dockerRetries = 2
+	cr.dockerRetryBackoff = time.Millisecond
+	var logs TestLogs
+	cr.NewLogWriter = logs.NewTestLoggingWriter
+	cr.Container.ContainerImage = hwPDH
+	cr.Container.Command = []string{"./hw"}
+	c.Assert(cr.LoadImage(), IsNil)
+	return cr
+}
+
+func (s *TestSuite) TestIsTransientDockerError(c *C) {
+	for _, trial := range []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?"), true},
+		{errors.New(`Post "http://%2Fvar%2Frun%2Fdocker.sock/v1.21/containers/create": EOF`), true},
+		{errors.New("read unix @->/var/run/docker.sock: read: connection reset by peer"), true},
+		{errors.New("dial unix /var/run/docker.sock: i/o timeout"), true},
+		{errors.New(`Error response from daemon: OCI runtime create failed: exec: "./hw": stat ./hw: no such file or directory: unknown`), false},
+		{errors.New("Error response from daemon: Conflict. The container name is already in use"), false},
+		{errors.New("While creating ManifestFileReader for container image: file not found"), false},
+	} {
+		c.Check(isTransientDockerError(trial.err), Equals, trial.transient, Commentf("%v", trial.err))
+	}
+}
+
+func (s *TestSuite) TestRetryTransientDockerErrors(c *C) {
+	s.docker.fn = func(t *TestDockerClient) {
+		t.logWriter.Write(dockerLog(1, "Hello world\n"))
+		t.logWriter.Close()
+	}
+	docker := &flakyDockerClient{
+		TestDockerClient: s.docker,
+		createErrs:       []error{io.EOF},
+		startErrs:        []error{errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")},
+	}
+	cr := s.setupFlakyDocker(c, docker)
+	c.Check(cr.CreateContainer(), IsNil)
+	c.Check(docker.createCalls, Equals, 2)
+	c.Check(cr.StartContainer(), IsNil)
+	c.Check(docker.startCalls, Equals, 2)
+	c.Check(cr.WaitFinish(), IsNil)
+}
+
+// If the daemon created the container but the response was lost, the
+// retry finds the existing container instead of failing with a name
+// conflict.
+func (s *TestSuite) TestRetryDockerCreateLostResponse(c *C) {
+	docker := &flakyDockerClient{
+		TestDockerClient: s.docker,
+		createErrs:       []error{io.ErrUnexpectedEOF},
+		createAnyway:     true,
+	}
+	cr := s.setupFlakyDocker(c, docker)
+	c.Check(cr.CreateContainer(), IsNil)
+	c.Check(docker.createCalls, Equals, 2)
+	c.Check(cr.ContainerID, Equals, "abcde")
+}
+
+func (s *TestSuite) TestNoRetryDockerUserError(c *C) {
+	docker := &flakyDockerClient{
+		TestDockerClient: s.docker,
+		startErrs:        []error{errors.New(`Error response from daemon: OCI runtime create failed: exec: "./hw": stat ./hw: no such file or directory: unknown`)},
+	}
+	cr := s.setupFlakyDocker(c, docker)
+	c.Check(cr.CreateContainer(), IsNil)
+	c.Check(cr.StartContainer(), ErrorMatches, `(?s)could not start container: .*no such file or directory.*Possible causes.*`)
+	c.Check(docker.startCalls, Equals, 1)
+}
+
+func (s *TestSuite) TestRetryDockerGivesUp(c *C) {
+	eof := errors.New(`Post "http://%2Fvar%2Frun%2Fdocker.sock/v1.21/containers/create": EOF`)
+	docker := &flakyDockerClient{
+		TestDockerClient: s.docker,
+		createErrs:       []error{eof, eof, eof, eof},
+	}
+	cr := s.setupFlakyDocker(c, docker)
+	c.Check(cr.CreateContainer(), ErrorMatches, `While creating container: .*: EOF`)
+	c.Check(docker.createCalls, Equals, 3)
+}
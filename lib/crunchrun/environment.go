@@ -0,0 +1,208 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	dockercontainer "github.com/docker/docker/api/types/container"
+)
+
+// Maximum time to wait for a single environment capture command.
+const envCaptureTimeout = 5 * time.Minute
+
+// Maximum number of bytes of stdout (and, separately, stderr) saved
+// from each environment capture command.
+const envCaptureMaxOutput = 1 << 20
+
+// stringListFlag is a flag.Value that accumulates the values of a
+// flag given multiple times on the command line.
+type stringListFlag []string
+
+func (sl *stringListFlag) String() string {
+	return strings.Join(*sl, ", ")
+}
+
+func (sl *stringListFlag) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
+// envCaptureResult is the environment.json entry for a single
+// environment capture command.
+type envCaptureResult struct {
+	Command  string `json:"command"`
+	ExitCode *int   `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CaptureEnvironment runs each of runner.envCaptureCommands in a
+// short-lived container using the container image (with the
+// container's environment variables, but no mounts and no network),
+// and saves their outputs in the log collection as environment.json.
+//
+// Failures of individual commands (e.g., "pip: not found") are
+// recorded in environment.json and do not prevent the container from
+// running.
+func (runner *ContainerRunner) CaptureEnvironment() error {
+	if len(runner.envCaptureCommands) == 0 {
+		return nil
+	}
+	runner.CrunchLog.Printf("Capturing environment (%d commands)", len(runner.envCaptureCommands))
+	results := []envCaptureResult{}
+	for _, command := range runner.envCaptureCommands {
+		if runner.IsCancelled() {
+			return ErrCancelled
+		}
+		res := runner.captureEnvironmentCommand(command)
+		if res.Error != "" {
+			runner.CrunchLog.Printf("Environment capture command %q: %s", command, res.Error)
+		}
+		results = append(results, res)
+	}
+
+	w, err := runner.LogCollection.OpenFile("environment.json", os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	err = enc.Encode(results)
+	if err != nil {
+		return fmt.Errorf("error writing environment.json: %v", err)
+	}
+	return w.Close()
+}
+
+func (runner *ContainerRunner) captureEnvironmentCommand(command string) (res envCaptureResult) {
+	res.Command = command
+	ctx, cancel := context.WithTimeout(context.Background(), envCaptureTimeout)
+	defer cancel()
+
+	var env []string
+	for k, v := range runner.Container.Environment {
+		env = append(env, k+"="+v)
+	}
+	id, err := runner.executor.Create(ctx, "", &dockercontainer.Config{
+		Image:        runner.ContainerConfig.Image,
+		Cmd:          []string{"/bin/sh", "-c", command},
+		Env:          env,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, &dockercontainer.HostConfig{
+		LogConfig:   dockercontainer.LogConfig{Type: "none"},
+		NetworkMode: dockercontainer.NetworkMode("none"),
+		Resources: dockercontainer.Resources{
+			CgroupParent: runner.setCgroupParent,
+		},
+	})
+	if err != nil {
+		res.Error = fmt.Sprintf("error creating container: %v", err)
+		return
+	}
+	defer func() {
+		err := runner.executor.Remove(context.Background(), id)
+		if err != nil {
+			runner.CrunchLog.Printf("error removing environment capture container %s: %v", id, err)
+		}
+	}()
+
+	resp, err := runner.executor.Attach(ctx, id, false)
+	if err != nil {
+		res.Error = fmt.Sprintf("error attaching container: %v", err)
+		return
+	}
+	defer resp.Close()
+
+	var stdout, stderr bytes.Buffer
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- demuxDockerStream(resp.Reader,
+			&limitedBuffer{buf: &stdout, max: envCaptureMaxOutput},
+			&limitedBuffer{buf: &stderr, max: envCaptureMaxOutput})
+	}()
+
+	err = runner.executor.Start(ctx, id)
+	if err != nil {
+		res.Error = fmt.Sprintf("error starting container: %v", err)
+		return
+	}
+
+	code, err := runner.executor.Wait(ctx, id)
+	if err == nil {
+		res.ExitCode = &code
+	} else if ctx.Err() != nil {
+		res.Error = fmt.Sprintf("timed out after %v", envCaptureTimeout)
+	} else {
+		res.Error = fmt.Sprintf("error waiting for container: %v", err)
+	}
+
+	// Collect whatever output was written before the container
+	// exited, without waiting forever for a stream that never
+	// reaches EOF.
+	select {
+	case err = <-readDone:
+		if err != nil && res.Error == "" {
+			res.Error = fmt.Sprintf("error reading container output: %v", err)
+		}
+	case <-time.After(time.Second):
+		resp.Close()
+		<-readDone
+	}
+	res.Stdout = stdout.String()
+	res.Stderr = stderr.String()
+	return
+}
+
+// demuxDockerStream copies the stdout and stderr frames of a docker
+// attach stream to stdout and stderr, respectively.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(header[7]) | (int64(header[6]) << 8) | (int64(header[5]) << 16) | (int64(header[4]) << 24)
+		w := stdout
+		if header[0] != 1 {
+			w = stderr
+		}
+		_, err = io.CopyN(w, r, size)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// limitedBuffer saves the first max bytes written to it, and
+// silently discards the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if room := lb.max - lb.buf.Len(); room < len(p) {
+		if room > 0 {
+			lb.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return lb.buf.Write(p)
+}
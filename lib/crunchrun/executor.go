@@ -0,0 +1,111 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+)
+
+// containerExecutor is the set of container engine operations
+// ContainerRunner uses to run a container. Implementations take care
+// of engine-specific options and quirks, so ContainerRunner only
+// deals with container IDs, the container/host config it builds,
+// and exit codes.
+type containerExecutor interface {
+	// ImageInspect returns information about an image in the
+	// engine's image store, or an error if it isn't there.
+	ImageInspect(ctx context.Context, image string) (dockertypes.ImageInspect, error)
+
+	// ImageLoad loads an image tarball into the engine's image
+	// store, and returns the engine's response message.
+	ImageLoad(ctx context.Context, tarball io.Reader) (string, error)
+
+	// Create creates (but does not start) a container, and
+	// returns its ID. If name is empty, the engine chooses one.
+	Create(ctx context.Context, name string, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig) (string, error)
+
+	// Attach returns a stream of the container's stdout/stderr,
+	// which also accepts writes to stdin if stdin is true.
+	Attach(ctx context.Context, id string, stdin bool) (dockertypes.HijackedResponse, error)
+
+	// Start starts a created container.
+	Start(ctx context.Context, id string) error
+
+	// Wait waits for the container to stop running, and returns
+	// its exit code.
+	Wait(ctx context.Context, id string) (int, error)
+
+	// Inspect returns the current state of the container.
+	Inspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error)
+
+	// Remove stops the container, if needed, and removes it.
+	Remove(ctx context.Context, id string) error
+}
+
+// dockerExecutor is a containerExecutor that uses the Docker API.
+type dockerExecutor struct {
+	client ThinDockerClient
+}
+
+func newDockerExecutor(client ThinDockerClient) *dockerExecutor {
+	return &dockerExecutor{client: client}
+}
+
+func (e *dockerExecutor) ImageInspect(ctx context.Context, image string) (dockertypes.ImageInspect, error) {
+	inspect, _, err := e.client.ImageInspectWithRaw(ctx, image)
+	return inspect, err
+}
+
+func (e *dockerExecutor) ImageLoad(ctx context.Context, tarball io.Reader) (string, error) {
+	response, err := e.client.ImageLoad(ctx, tarball, true)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	rbody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("Reading response to image load: %v", err)
+	}
+	return string(rbody), nil
+}
+
+func (e *dockerExecutor) Create(ctx context.Context, name string, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig) (string, error) {
+	created, err := e.client.ContainerCreate(ctx, config, hostConfig, nil, name)
+	return created.ID, err
+}
+
+func (e *dockerExecutor) Attach(ctx context.Context, id string, stdin bool) (dockertypes.HijackedResponse, error) {
+	return e.client.ContainerAttach(ctx, id, dockertypes.ContainerAttachOptions{Stream: true, Stdin: stdin, Stdout: true, Stderr: true})
+}
+
+func (e *dockerExecutor) Start(ctx context.Context, id string) error {
+	return e.client.ContainerStart(ctx, id, dockertypes.ContainerStartOptions{})
+}
+
+func (e *dockerExecutor) Wait(ctx context.Context, id string) (int, error) {
+	waitOk, waitErr := e.client.ContainerWait(ctx, id, dockercontainer.WaitConditionNotRunning)
+	select {
+	case body := <-waitOk:
+		return int(body.StatusCode), nil
+	case err := <-waitErr:
+		return -1, err
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+func (e *dockerExecutor) Inspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error) {
+	return e.client.ContainerInspect(ctx, id)
+}
+
+func (e *dockerExecutor) Remove(ctx context.Context, id string) error {
+	return e.client.ContainerRemove(ctx, id, dockertypes.ContainerRemoveOptions{Force: true})
+}
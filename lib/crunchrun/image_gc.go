@@ -0,0 +1,170 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+)
+
+// Images used more recently than this are never removed by image
+// GC, even if the size limit is exceeded. This protects an image that
+// another crunch-run process on the same node has just loaded but
+// not yet started a container with.
+var imageGCMinIdle = time.Hour
+
+// imageGCDocker is the subset of the docker client API used by
+// imageGC.
+type imageGCDocker interface {
+	ContainerList(ctx context.Context, options dockertypes.ContainerListOptions) ([]dockertypes.Container, error)
+	ImageList(ctx context.Context, options dockertypes.ImageListOptions) ([]dockertypes.ImageSummary, error)
+	ImageRemove(ctx context.Context, image string, options dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDeleteResponseItem, error)
+}
+
+// imageGC removes docker images that have not been used recently,
+// so the node's disk doesn't fill up with images loaded for old
+// containers.
+//
+// When an image was last used is taken from the usage records that
+// crunch-run writes in usageDir (see recordImageUsage) or, for images
+// without a usage record, the image's creation time.
+//
+// Images that are not used by any docker container (running or not)
+// are removed, least recently used first, if they have not been used
+// for maxAge, or while the total size of all images exceeds maxSize.
+// A zero maxAge or maxSize means no limit.
+type imageGC struct {
+	docker   imageGCDocker
+	usageDir string
+	maxAge   time.Duration
+	maxSize  int64
+	logf     func(string, ...interface{})
+}
+
+type imageGCCandidate struct {
+	id       string
+	tags     []string
+	size     int64
+	lastUsed time.Time
+}
+
+// Run does a single garbage collection pass. Errors removing
+// individual images are logged and otherwise ignored.
+func (gc *imageGC) Run(ctx context.Context) error {
+	containers, err := gc.docker.ContainerList(ctx, dockertypes.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	inUse := map[string]bool{}
+	for _, ctr := range containers {
+		inUse[imageIDHex(ctr.ImageID)] = true
+	}
+	images, err := gc.docker.ImageList(ctx, dockertypes.ImageListOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var total int64
+	var todo []imageGCCandidate
+	for _, img := range images {
+		total += img.Size
+		id := imageIDHex(img.ID)
+		lastUsed := time.Unix(img.Created, 0)
+		if fi, err := os.Stat(gc.usagePath(id)); err == nil {
+			lastUsed = fi.ModTime()
+		}
+		if inUse[id] || now.Sub(lastUsed) < imageGCMinIdle {
+			continue
+		}
+		var tags []string
+		for _, tag := range img.RepoTags {
+			if tag != "<none>:<none>" {
+				tags = append(tags, tag)
+			}
+		}
+		todo = append(todo, imageGCCandidate{id: id, tags: tags, size: img.Size, lastUsed: lastUsed})
+	}
+	sort.Slice(todo, func(i, j int) bool { return todo[i].lastUsed.Before(todo[j].lastUsed) })
+
+	removed := 0
+	var removedSize int64
+	for _, img := range todo {
+		tooOld := gc.maxAge > 0 && now.Sub(img.lastUsed) > gc.maxAge
+		tooBig := gc.maxSize > 0 && total > gc.maxSize
+		if !tooOld && !tooBig {
+			// Remaining candidates are more recently
+			// used, so they don't qualify either.
+			break
+		}
+		if err := gc.remove(ctx, img); err != nil {
+			gc.logf("image GC: error removing image %s (last used %s): %s", img.id, img.lastUsed.Format(time.RFC3339), err)
+			continue
+		}
+		gc.logf("image GC: removed image %s %q (%d bytes, last used %s)", img.id, img.tags, img.size, img.lastUsed.Format(time.RFC3339))
+		os.Remove(gc.usagePath(img.id))
+		total -= img.size
+		removed++
+		removedSize += img.size
+	}
+	gc.logf("image GC: removed %d images (%d bytes), %d bytes remaining", removed, removedSize, total)
+	return nil
+}
+
+// remove removes the given image. An image with multiple tags is
+// removed by untagging it, because docker refuses to remove such an
+// image by ID without the "force" flag, and the force flag would also
+// remove an image that a container has started using since we
+// checked.
+func (gc *imageGC) remove(ctx context.Context, img imageGCCandidate) error {
+	opts := dockertypes.ImageRemoveOptions{PruneChildren: true}
+	if len(img.tags) == 0 {
+		_, err := gc.docker.ImageRemove(ctx, "sha256:"+img.id, opts)
+		return err
+	}
+	for _, tag := range img.tags {
+		_, err := gc.docker.ImageRemove(ctx, tag, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gc *imageGC) usagePath(id string) string {
+	return filepath.Join(gc.usageDir, id)
+}
+
+// recordImageUsage updates the usage record for the given image in
+// dir, so imageGC knows it has been used recently.
+func recordImageUsage(dir, imageID string) error {
+	if dir == "" {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, imageIDHex(imageID))
+	err = ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// imageIDHex returns the given image ID without the "sha256:"
+// prefix used by the docker API.
+func imageIDHex(id string) string {
+	return strings.TrimPrefix(id, "sha256:")
+}
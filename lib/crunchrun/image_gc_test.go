@@ -0,0 +1,119 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ImageGCSuite{})
+
+type ImageGCSuite struct{}
+
+type imageGCFakeDocker struct {
+	containers []dockertypes.Container
+	images     []dockertypes.ImageSummary
+	removed    []string
+	failRemove map[string]bool
+}
+
+func (d *imageGCFakeDocker) ContainerList(context.Context, dockertypes.ContainerListOptions) ([]dockertypes.Container, error) {
+	return d.containers, nil
+}
+
+func (d *imageGCFakeDocker) ImageList(context.Context, dockertypes.ImageListOptions) ([]dockertypes.ImageSummary, error) {
+	return d.images, nil
+}
+
+func (d *imageGCFakeDocker) ImageRemove(_ context.Context, image string, _ dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDeleteResponseItem, error) {
+	if d.failRemove[image] {
+		return nil, errors.New("conflict")
+	}
+	d.removed = append(d.removed, image)
+	return nil, nil
+}
+
+func (s *ImageGCSuite) setup(c *C) (*imageGC, *imageGCFakeDocker) {
+	now := time.Now()
+	hoursAgo := func(h int) int64 { return now.Add(-time.Duration(h) * time.Hour).Unix() }
+	docker := &imageGCFakeDocker{
+		containers: []dockertypes.Container{{ImageID: "sha256:inuse"}},
+		images: []dockertypes.ImageSummary{
+			{ID: "sha256:inuse", Created: hoursAgo(1000), Size: 100, RepoTags: []string{"inuse:latest"}},
+			{ID: "sha256:old", Created: hoursAgo(100), Size: 100, RepoTags: []string{"<none>:<none>"}},
+			{ID: "sha256:older", Created: hoursAgo(200), Size: 100, RepoTags: []string{"a:1", "b:2"}},
+			{ID: "sha256:recent", Created: hoursAgo(10), Size: 100},
+			{ID: "sha256:used", Created: hoursAgo(1000), Size: 100},
+			{ID: "sha256:new", Created: hoursAgo(0), Size: 100},
+		},
+	}
+	gc := &imageGC{
+		docker:   docker,
+		usageDir: c.MkDir(),
+		logf:     c.Logf,
+	}
+	// "used" was created long ago, but used 5 hours ago.
+	c.Assert(recordImageUsage(gc.usageDir, "used"), IsNil)
+	t := now.Add(-5 * time.Hour)
+	c.Assert(os.Chtimes(filepath.Join(gc.usageDir, "used"), t, t), IsNil)
+	return gc, docker
+}
+
+func (s *ImageGCSuite) TestMaxAge(c *C) {
+	gc, docker := s.setup(c)
+	gc.maxAge = 50 * time.Hour
+	c.Check(gc.Run(context.Background()), IsNil)
+	c.Check(docker.removed, DeepEquals, []string{"a:1", "b:2", "sha256:old"})
+}
+
+func (s *ImageGCSuite) TestMaxSize(c *C) {
+	gc, docker := s.setup(c)
+	gc.maxSize = 350
+	c.Check(gc.Run(context.Background()), IsNil)
+	// Least recently used first, until total size <= maxSize
+	c.Check(docker.removed, DeepEquals, []string{"a:1", "b:2", "sha256:old", "sha256:recent"})
+
+	// Images that are in use, or were used very recently, are
+	// never removed.
+	gc, docker = s.setup(c)
+	gc.maxSize = 1
+	c.Check(gc.Run(context.Background()), IsNil)
+	c.Check(docker.removed, DeepEquals, []string{"a:1", "b:2", "sha256:old", "sha256:recent", "sha256:used"})
+}
+
+func (s *ImageGCSuite) TestRemoveError(c *C) {
+	gc, docker := s.setup(c)
+	gc.maxSize = 350
+	docker.failRemove = map[string]bool{"sha256:old": true}
+	c.Assert(recordImageUsage(gc.usageDir, "old"), IsNil)
+	t := time.Now().Add(-150 * time.Hour)
+	c.Assert(os.Chtimes(filepath.Join(gc.usageDir, "old"), t, t), IsNil)
+	c.Check(gc.Run(context.Background()), IsNil)
+	// Failure to remove "old" means "used" also gets removed to
+	// get under the size limit.
+	c.Check(docker.removed, DeepEquals, []string{"a:1", "b:2", "sha256:recent", "sha256:used"})
+	// Usage records are deleted along with images, but not when
+	// removal fails.
+	_, err := os.Stat(filepath.Join(gc.usageDir, "used"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(gc.usageDir, "old"))
+	c.Check(err, IsNil)
+}
+
+func (s *ImageGCSuite) TestRecordImageUsage(c *C) {
+	dir := filepath.Join(c.MkDir(), "images")
+	c.Check(recordImageUsage(dir, "sha256:abcdef"), IsNil)
+	fi, err := os.Stat(filepath.Join(dir, "abcdef"))
+	c.Assert(err, IsNil)
+	c.Check(time.Since(fi.ModTime()) < time.Minute, Equals, true)
+	c.Check(recordImageUsage("", "abcdef"), IsNil)
+}
@@ -0,0 +1,326 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	dockernetwork "github.com/docker/docker/api/types/network"
+	. "gopkg.in/check.v1"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite golden lifecycle transcripts in testdata/lifecycle instead of comparing")
+
+var _ = Suite(&LifecycleSuite{})
+
+// LifecycleSuite runs whole containers against a scripted fake
+// engine, and compares the resulting sequence of engine calls and
+// container record updates to the golden transcripts in
+// testdata/lifecycle. After an intentional change in behavior, run
+// "go test -update-golden" and review the diff.
+type LifecycleSuite struct{}
+
+// transcript is a list of events recorded during a container
+// lifecycle test.
+type transcript struct {
+	sync.Mutex
+	lines []string
+}
+
+func (t *transcript) add(format string, args ...interface{}) {
+	t.Lock()
+	defer t.Unlock()
+	t.lines = append(t.lines, fmt.Sprintf(format, args...))
+}
+
+func (t *transcript) String() string {
+	t.Lock()
+	defer t.Unlock()
+	return strings.Join(t.lines, "\n") + "\n"
+}
+
+// fakeEngine is a scripted ThinDockerClient. It records each call in
+// a transcript, and runs a single container according to the script
+// fields. Tests use it through the docker or podman executor, like a
+// real engine's API.
+type fakeEngine struct {
+	// Script
+	stdout          string // written to the container's stdout
+	exitCode        int    // returned by ContainerWait
+	oomKilled       bool   // reported by ContainerInspect after exit
+	runUntilRemoved bool   // keep running until ContainerRemove
+
+	transcript *transcript
+	image      string
+	logReader  io.ReadCloser
+	logWriter  io.WriteCloser
+	waiting    chan struct{} // closed when ContainerWait is called
+	removed    chan struct{} // closed when ContainerRemove is called
+	exited     chan struct{} // closed when the container exits
+	closeOnce  sync.Once
+}
+
+func newFakeEngine(t *transcript) *fakeEngine {
+	e := &fakeEngine{
+		transcript: t,
+		waiting:    make(chan struct{}),
+		removed:    make(chan struct{}),
+		exited:     make(chan struct{}),
+	}
+	e.logReader, e.logWriter = io.Pipe()
+	return e
+}
+
+func (e *fakeEngine) ContainerAttach(ctx context.Context, container string, options dockertypes.ContainerAttachOptions) (dockertypes.HijackedResponse, error) {
+	e.transcript.add("engine: ContainerAttach %s", container)
+	return dockertypes.HijackedResponse{Conn: NewMockConn(), Reader: bufio.NewReader(e.logReader)}, nil
+}
+
+func (e *fakeEngine) ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig, networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error) {
+	e.transcript.add("engine: ContainerCreate %s image=%s cmd=%q network=%s cgroup_parent=%q kernel_memory=%d", containerName, config.Image, []string(config.Cmd), hostConfig.NetworkMode, hostConfig.CgroupParent, hostConfig.KernelMemory)
+	return dockercontainer.ContainerCreateCreatedBody{ID: "abcde"}, nil
+}
+
+func (e *fakeEngine) ContainerStart(ctx context.Context, container string, options dockertypes.ContainerStartOptions) error {
+	e.transcript.add("engine: ContainerStart %s", container)
+	return nil
+}
+
+func (e *fakeEngine) ContainerRemove(ctx context.Context, container string, options dockertypes.ContainerRemoveOptions) error {
+	e.transcript.add("engine: ContainerRemove %s force=%v", container, options.Force)
+	e.closeOnce.Do(func() { close(e.removed) })
+	return nil
+}
+
+func (e *fakeEngine) ContainerWait(ctx context.Context, container string, condition dockercontainer.WaitCondition) (<-chan dockercontainer.ContainerWaitOKBody, <-chan error) {
+	e.transcript.add("engine: ContainerWait %s", container)
+	close(e.waiting)
+	body := make(chan dockercontainer.ContainerWaitOKBody, 1)
+	go func() {
+		if e.runUntilRemoved {
+			<-e.removed
+		}
+		if e.stdout != "" {
+			e.logWriter.Write(dockerLog(1, e.stdout))
+		}
+		e.logWriter.Close()
+		close(e.exited)
+		body <- dockercontainer.ContainerWaitOKBody{StatusCode: int64(e.exitCode)}
+	}()
+	return body, make(chan error)
+}
+
+func (e *fakeEngine) ContainerInspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error) {
+	e.transcript.add("engine: ContainerInspect %s", id)
+	var c dockertypes.ContainerJSON
+	c.ContainerJSONBase = &dockertypes.ContainerJSONBase{ID: id}
+	select {
+	case <-e.exited:
+		c.State = &dockertypes.ContainerState{Status: "exited", ExitCode: e.exitCode, OOMKilled: e.oomKilled}
+	default:
+		c.State = &dockertypes.ContainerState{Status: "running", Running: true, Pid: 1234}
+	}
+	return c, nil
+}
+
+func (e *fakeEngine) ImageInspectWithRaw(ctx context.Context, image string) (dockertypes.ImageInspect, []byte, error) {
+	e.transcript.add("engine: ImageInspectWithRaw %s", image)
+	if e.image != image {
+		return dockertypes.ImageInspect{}, nil, errors.New("no such image")
+	}
+	return dockertypes.ImageInspect{Os: "linux", Config: &dockercontainer.Config{}}, nil, nil
+}
+
+func (e *fakeEngine) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (dockertypes.ImageLoadResponse, error) {
+	e.transcript.add("engine: ImageLoad")
+	_, err := io.Copy(ioutil.Discard, input)
+	if err != nil {
+		return dockertypes.ImageLoadResponse{}, err
+	}
+	e.image = hwImageID
+	return dockertypes.ImageLoadResponse{Body: ioutil.NopCloser(input)}, nil
+}
+
+func (e *fakeEngine) ImageRemove(ctx context.Context, image string, options dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDeleteResponseItem, error) {
+	e.transcript.add("engine: ImageRemove %s", image)
+	return nil, nil
+}
+
+// transcriptArvClient records updates to the container record in a
+// transcript. Updates that only change the log are not recorded,
+// because their number depends on timing.
+type transcriptArvClient struct {
+	*ArvTestClient
+	transcript *transcript
+}
+
+func (client *transcriptArvClient) Update(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	if ctr, ok := parameters["container"].(arvadosclient.Dict); ok && resourceType == "containers" {
+		var attrs []string
+		for k, v := range ctr {
+			switch k {
+			case "state", "exit_code":
+				attrs = append(attrs, fmt.Sprintf("%s=%v", k, v))
+			case "runtime_status":
+				attrs = append(attrs, fmt.Sprintf("%s.error=%v", k, v.(arvadosclient.Dict)["error"]))
+			default:
+				// Values depend on timing, log content,
+				// etc.
+				attrs = append(attrs, k)
+			}
+		}
+		sort.Strings(attrs)
+		if len(attrs) > 1 || attrs[0] != "log" {
+			client.transcript.add("api: update container %s", strings.Join(attrs, " "))
+		}
+	}
+	return client.ArvTestClient.Update(resourceType, uuid, parameters, output)
+}
+
+func (s *LifecycleSuite) run(c *C, golden string, engine *fakeEngine, setup func(cr *ContainerRunner)) {
+	record := `{
+    "command": ["echo", "hello"],
+    "container_image": "` + hwPDH + `",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {"ram": 1000000},
+    "state": "Locked",
+    "uuid": "zzzzz-dz642-202301251234567"
+}`
+	var rec arvados.Container
+	err := json.Unmarshal([]byte(record), &rec)
+	c.Assert(err, IsNil)
+
+	api := &transcriptArvClient{ArvTestClient: &ArvTestClient{Container: rec}, transcript: engine.transcript}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, engine, rec.UUID)
+	c.Assert(err, IsNil)
+	cr.statInterval = time.Hour
+	cr.containerWatchdogInterval = time.Hour
+	cr.RunArvMount = func([]string, string) (*exec.Cmd, error) { return nil, nil }
+	cr.MkArvClient = func(token string) (IArvadosClient, IKeepClient, *arvados.Client, error) {
+		return &ArvTestClient{}, &KeepTestClient{}, nil, nil
+	}
+	tmpdir := c.MkDir()
+	cr.MkTempDir = func(_, prefix string) (string, error) {
+		return ioutil.TempDir(tmpdir, prefix)
+	}
+	if setup != nil {
+		setup(cr)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- cr.Run()
+	}()
+	select {
+	case <-time.After(20 * time.Second):
+		c.Fatal("timed out")
+	case err = <-done:
+		c.Check(err, IsNil)
+	}
+	for k, v := range api.Logs {
+		c.Logf("=== %s\n%s", k, v.String())
+	}
+
+	got := engine.transcript.String()
+	fnm := filepath.Join("testdata", "lifecycle", golden)
+	if *updateGolden {
+		c.Assert(os.MkdirAll(filepath.Dir(fnm), 0777), IsNil)
+		c.Assert(ioutil.WriteFile(fnm, []byte(got), 0666), IsNil)
+		return
+	}
+	want, err := ioutil.ReadFile(fnm)
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, string(want))
+}
+
+func (s *LifecycleSuite) TestHappyPath(c *C) {
+	engine := newFakeEngine(&transcript{})
+	engine.stdout = "hello\n"
+	s.run(c, "happy_path.txt", engine, nil)
+}
+
+func (s *LifecycleSuite) TestCancelMidRun(c *C) {
+	engine := newFakeEngine(&transcript{})
+	engine.runUntilRemoved = true
+	engine.exitCode = 137
+	s.run(c, "cancel_mid_run.txt", engine, func(cr *ContainerRunner) {
+		go func() {
+			<-engine.waiting
+			cr.SigChan <- syscall.SIGINT
+		}()
+	})
+}
+
+func (s *LifecycleSuite) TestArvMountDeath(c *C) {
+	engine := newFakeEngine(&transcript{})
+	engine.runUntilRemoved = true
+	engine.exitCode = 137
+	s.run(c, "arv_mount_death.txt", engine, func(cr *ContainerRunner) {
+		cr.ArvMountExit = make(chan error)
+		go func() {
+			<-engine.waiting
+			cr.ArvMountExit <- errors.New("arv-mount exited")
+			close(cr.ArvMountExit)
+		}()
+	})
+}
+
+func (s *LifecycleSuite) TestOutOfMemory(c *C) {
+	engine := newFakeEngine(&transcript{})
+	engine.exitCode = 137
+	engine.oomKilled = true
+	s.run(c, "out_of_memory.txt", engine, nil)
+}
+
+// The podman executor passes the same calls through to the engine,
+// except that rootless podman gets no cgroup parent, and podman
+// never gets a kernel memory limit.
+func (s *LifecycleSuite) TestPodmanRootlessHappyPath(c *C) {
+	engine := newFakeEngine(&transcript{})
+	engine.stdout = "hello\n"
+	s.run(c, "podman_rootless_happy_path.txt", engine, func(cr *ContainerRunner) {
+		cr.setCgroupParent = "/slurm/uid_1000/job_1"
+		cr.executor = newPodmanExecutor(engine, true)
+	})
+}
+
+func (s *LifecycleSuite) TestPodmanCancelMidRun(c *C) {
+	engine := newFakeEngine(&transcript{})
+	engine.runUntilRemoved = true
+	engine.exitCode = 137
+	s.run(c, "podman_cancel_mid_run.txt", engine, func(cr *ContainerRunner) {
+		cr.setCgroupParent = "/slurm/job_1"
+		cr.executor = newPodmanExecutor(engine, false)
+		go func() {
+			<-engine.waiting
+			cr.SigChan <- syscall.SIGINT
+		}()
+	})
+}
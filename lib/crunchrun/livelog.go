@@ -0,0 +1,288 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Maximum number of log lines queued for streaming. If the websocket
+// server is too slow or unreachable, further lines are dropped (and
+// counted) instead of holding up the container's logs.
+const liveLogQueueSize = 10000
+
+// Maximum number of bytes of log text sent in one message.
+const liveLogMaxMessageText = 1 << 16
+
+// Minimum time between attempts to (re)connect to the websocket
+// server. Lines queued while disconnected are dropped.
+const liveLogReconnectInterval = 5 * time.Second
+
+// How long closeLiveLogs waits for queued lines to be sent after the
+// container exits.
+const liveLogCloseTimeout = 5 * time.Second
+
+// errLiveLogsDisconnected is returned by connect while waiting to
+// reconnect after an error.
+var errLiveLogsDisconnected = errors.New("disconnected from websocket server")
+
+// liveLogLine is a timestamped log line queued for streaming.
+type liveLogLine struct {
+	EventType string
+	Text      string
+}
+
+// liveLogStreamer sends stdout, stderr, and crunch-run log lines to
+// the websocket server as they are written (see -live-logs), so
+// clients subscribed to the container's events with "live_logs":true
+// can tail a running container without waiting for the batched and
+// rate-limited entries in the logs table.
+//
+// Like logForwarder, it queues lines and sends them from a separate
+// goroutine, so a slow or unreachable websocket server never delays
+// or breaks the usual logs.
+type liveLogStreamer struct {
+	containerUUID string
+	dial          func() (io.ReadWriteCloser, error)
+	queue         chan liveLogLine
+	done          chan struct{}
+	logf          func(string, ...interface{})
+
+	// Used only by the run goroutine
+	conn     io.ReadWriteCloser
+	lastDial time.Time
+
+	mtx       sync.Mutex
+	closed    bool
+	sent      int64
+	dropped   int64
+	lastError string
+}
+
+// newLiveLogStreamer returns a liveLogStreamer that publishes log
+// lines for the given container to the websocket server at wsURL
+// (the cluster's Services.Websocket.ExternalURL), authenticating
+// with the container's runtime token.
+func newLiveLogStreamer(wsURL, token, containerUUID string, insecure bool, logf func(string, ...interface{})) (*liveLogStreamer, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket URL %q: %s", wsURL, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid websocket URL %q: scheme must be ws or wss", wsURL)
+	}
+	origin := "https://" + u.Host
+	q := u.Query()
+	q.Set("api_token", token)
+	u.RawQuery = q.Encode()
+	cfg, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: insecure}
+	lls := &liveLogStreamer{
+		containerUUID: containerUUID,
+		dial: func() (io.ReadWriteCloser, error) {
+			return websocket.DialConfig(cfg)
+		},
+		logf: logf,
+	}
+	lls.start()
+	return lls, nil
+}
+
+func (lls *liveLogStreamer) start() {
+	lls.queue = make(chan liveLogLine, liveLogQueueSize)
+	lls.done = make(chan struct{})
+	go lls.run()
+}
+
+// lineFunc returns a function that queues log lines with the given
+// event type, suitable for ThrottledLogger.live. A nil
+// *liveLogStreamer returns nil.
+func (lls *liveLogStreamer) lineFunc(eventType string) func(string) {
+	if lls == nil {
+		return nil
+	}
+	return func(text string) {
+		lls.mtx.Lock()
+		defer lls.mtx.Unlock()
+		if lls.closed {
+			return
+		}
+		select {
+		case lls.queue <- liveLogLine{EventType: eventType, Text: text}:
+		default:
+			lls.dropped++
+		}
+	}
+}
+
+func (lls *liveLogStreamer) run() {
+	defer close(lls.done)
+	defer func() {
+		if lls.conn != nil {
+			lls.conn.Close()
+		}
+	}()
+	for line := range lls.queue {
+		// Send consecutive queued lines with the same event
+		// type in one message.
+		lines := []liveLogLine{line}
+		size := len(line.Text)
+	fill:
+		for size < liveLogMaxMessageText {
+			select {
+			case line, ok := <-lls.queue:
+				if !ok {
+					break fill
+				}
+				if line.EventType != lines[0].EventType {
+					lls.send(lines)
+					lines, size = nil, 0
+				}
+				lines = append(lines, line)
+				size += len(line.Text)
+			default:
+				break fill
+			}
+		}
+		lls.send(lines)
+	}
+}
+
+// send publishes the given lines (which all have the same event type)
+// in one message, connecting to the websocket server first if needed.
+func (lls *liveLogStreamer) send(lines []liveLogLine) {
+	err := lls.connect()
+	if err == nil {
+		var text []byte
+		for _, line := range lines {
+			text = append(text, line.Text...)
+		}
+		msg, _ := json.Marshal(map[string]interface{}{
+			"method":      "publish",
+			"object_uuid": lls.containerUUID,
+			"event_type":  lines[0].EventType,
+			"properties":  map[string]string{"text": string(text)},
+		})
+		_, err = lls.conn.Write(msg)
+		if err != nil {
+			lls.conn.Close()
+			lls.conn = nil
+		}
+	}
+	lls.mtx.Lock()
+	report := false
+	if err == nil {
+		lls.sent += int64(len(lines))
+	} else {
+		lls.dropped += int64(len(lines))
+		if msg := err.Error(); err != errLiveLogsDisconnected && msg != lls.lastError {
+			// Report the first error, and any different
+			// error after that.
+			lls.lastError = msg
+			report = true
+		}
+	}
+	lls.mtx.Unlock()
+	// Don't hold mtx here: if logf writes to the crunch-run log,
+	// it will call our lineFunc.
+	if report {
+		lls.logf("error streaming live logs: %s", err)
+	}
+}
+
+// connect dials the websocket server, unless already connected or
+// the last attempt was less than liveLogReconnectInterval ago.
+func (lls *liveLogStreamer) connect() error {
+	if lls.conn != nil {
+		return nil
+	}
+	if time.Since(lls.lastDial) < liveLogReconnectInterval {
+		return errLiveLogsDisconnected
+	}
+	lls.lastDial = time.Now()
+	conn, err := lls.dial()
+	if err != nil {
+		return err
+	}
+	// The server sends periodic keepalive messages, and rejects
+	// invalid messages with a status message; neither needs a
+	// response, but they must be read so the connection doesn't
+	// stall. If the server closes the connection (e.g., because
+	// the token is not accepted), the next write fails.
+	go io.Copy(ioutil.Discard, conn)
+	lls.conn = conn
+	return nil
+}
+
+// close waits (up to the given timeout) for queued lines to be sent,
+// disconnects, and reports how many lines were sent and dropped.
+func (lls *liveLogStreamer) close(timeout time.Duration) {
+	lls.mtx.Lock()
+	lls.closed = true
+	close(lls.queue)
+	lls.mtx.Unlock()
+	select {
+	case <-lls.done:
+	case <-time.After(timeout):
+		lls.logf("timed out waiting for live logs to be sent")
+	}
+	lls.mtx.Lock()
+	sent, dropped := lls.sent, lls.dropped
+	lls.mtx.Unlock()
+	lls.logf("streamed %d live log lines (%d dropped)", sent, dropped)
+}
+
+// setupLiveLogs starts streaming the container's logs to the cluster's
+// websocket server. If the websocket server URL or the container's
+// token can't be retrieved, the error is noted in the crunch-run log
+// and the container runs without live logs.
+func (runner *ContainerRunner) setupLiveLogs(insecure bool) {
+	wsURL, err := runner.DispatcherArvClient.Discovery("websocketUrl")
+	if err != nil {
+		runner.CrunchLog.Printf("not streaming live logs: error getting websocket URL: %s", err)
+		return
+	}
+	wsURLString, _ := wsURL.(string)
+	if wsURLString == "" {
+		runner.CrunchLog.Printf("not streaming live logs: no websocket URL configured")
+		return
+	}
+	token, err := runner.ContainerToken()
+	if err != nil {
+		runner.CrunchLog.Printf("not streaming live logs: error getting container token: %s", err)
+		return
+	}
+	lls, err := newLiveLogStreamer(wsURLString, token, runner.Container.UUID, insecure, runner.CrunchLog.Printf)
+	if err != nil {
+		runner.CrunchLog.Printf("not streaming live logs: %s", err)
+		return
+	}
+	runner.liveLogs = lls
+	runner.CrunchLog.setLive(lls.lineFunc("crunch-run"))
+	runner.CrunchLog.Printf("streaming live logs to %s", wsURLString)
+}
+
+// closeLiveLogs waits for queued log lines to be sent (up to
+// liveLogCloseTimeout), then stops streaming.
+func (runner *ContainerRunner) closeLiveLogs() {
+	if runner.liveLogs != nil {
+		runner.CrunchLog.setLive(nil)
+		runner.liveLogs.close(liveLogCloseTimeout)
+		runner.liveLogs = nil
+	}
+}
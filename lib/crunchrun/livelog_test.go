@@ -0,0 +1,145 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&liveLogSuite{})
+
+type liveLogSuite struct{}
+
+type liveLogMessage struct {
+	Method     string
+	ObjectUUID string `json:"object_uuid"`
+	EventType  string `json:"event_type"`
+	Properties struct {
+		Text string
+	}
+}
+
+// stubWebsocketServer records "publish" messages and the api_token
+// given by each client.
+type stubWebsocketServer struct {
+	*httptest.Server
+	mtx      sync.Mutex
+	tokens   []string
+	messages []liveLogMessage
+}
+
+func newStubWebsocketServer() *stubWebsocketServer {
+	srv := &stubWebsocketServer{}
+	srv.Server = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		srv.mtx.Lock()
+		srv.tokens = append(srv.tokens, ws.Request().FormValue("api_token"))
+		srv.mtx.Unlock()
+		dec := json.NewDecoder(ws)
+		for {
+			var msg liveLogMessage
+			if dec.Decode(&msg) != nil {
+				return
+			}
+			srv.mtx.Lock()
+			srv.messages = append(srv.messages, msg)
+			srv.mtx.Unlock()
+		}
+	}))
+	return srv
+}
+
+func (s *liveLogSuite) TestStream(c *C) {
+	srv := newStubWebsocketServer()
+	defer srv.Close()
+
+	var logs []string
+	lls, err := newLiveLogStreamer("ws://"+srv.Listener.Addr().String()+"/websocket", "v2/zzzzz-gj3su-000000000000000/secret/zzzzz-dz642-202301130848001", "zzzzz-dz642-202301130848001", false, func(f string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(f, args...))
+	})
+	c.Assert(err, IsNil)
+
+	tl := &ThrottledLogger{Timestamper: func(time.Time) string { return "2023-01-13T08:48:00.000000000Z" }, live: lls.lineFunc("stdout")}
+	tl.Write([]byte("line one\nline two\n"))
+	lls.lineFunc("crunch-run")("2023-01-13T08:48:01.000000000Z crunch-run line\n")
+	lls.close(time.Second)
+
+	c.Check(logs, DeepEquals, []string{"streamed 3 live log lines (0 dropped)"})
+	// Lines written after close are ignored.
+	tl.Write([]byte("line three\n"))
+
+	// Wait for the server to receive the messages.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		srv.mtx.Lock()
+		n := len(srv.messages)
+		srv.mtx.Unlock()
+		if n > 0 && strings.Contains(srv.messages[n-1].Properties.Text, "crunch-run line") {
+			break
+		}
+	}
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	c.Check(srv.tokens, DeepEquals, []string{"v2/zzzzz-gj3su-000000000000000/secret/zzzzz-dz642-202301130848001"})
+	var stdout, crunchrun string
+	for _, msg := range srv.messages {
+		c.Check(msg.Method, Equals, "publish")
+		c.Check(msg.ObjectUUID, Equals, "zzzzz-dz642-202301130848001")
+		switch msg.EventType {
+		case "stdout":
+			stdout += msg.Properties.Text
+		case "crunch-run":
+			crunchrun += msg.Properties.Text
+		default:
+			c.Errorf("unexpected event type %q", msg.EventType)
+		}
+	}
+	c.Check(stdout, Equals, "2023-01-13T08:48:00.000000000Z line one\n2023-01-13T08:48:00.000000000Z line two\n")
+	c.Check(crunchrun, Equals, "2023-01-13T08:48:01.000000000Z crunch-run line\n")
+}
+
+func (s *liveLogSuite) TestUnreachable(c *C) {
+	srv := newStubWebsocketServer()
+	url := "ws://" + srv.Listener.Addr().String() + "/websocket"
+	srv.Close()
+
+	var logs []string
+	var mtx sync.Mutex
+	lls, err := newLiveLogStreamer(url, "tok", "zzzzz-dz642-202301130848001", false, func(f string, args ...interface{}) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		logs = append(logs, fmt.Sprintf(f, args...))
+	})
+	c.Assert(err, IsNil)
+	stdout := lls.lineFunc("stdout")
+	for i := 0; i < 10; i++ {
+		stdout("2023-01-13T08:48:00.000000000Z line\n")
+		time.Sleep(time.Millisecond)
+	}
+	lls.close(time.Second)
+
+	// The connection error is reported once, and lines are
+	// dropped without retrying until liveLogReconnectInterval
+	// has passed.
+	c.Assert(logs, HasLen, 2)
+	c.Check(logs[0], Matches, `error streaming live logs: .*connection refused.*`)
+	c.Check(logs[1], Equals, "streamed 0 live log lines (10 dropped)")
+}
+
+func (s *liveLogSuite) TestBadURL(c *C) {
+	_, err := newLiveLogStreamer("https://ws.example/websocket", "tok", "zzzzz-dz642-202301130848001", false, nil)
+	c.Check(err, ErrorMatches, `invalid websocket URL .*: scheme must be ws or wss`)
+}
+
+func (s *liveLogSuite) TestNilStreamer(c *C) {
+	var lls *liveLogStreamer
+	c.Check(lls.lineFunc("stdout"), IsNil)
+}
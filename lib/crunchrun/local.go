@@ -0,0 +1,198 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// localLogWriter is an io.WriteCloser that copies log data to a
+// shared writer (crunch-run's stderr in local mode), prefixing each
+// line with the name of the log.
+type localLogWriter struct {
+	name string
+	w    io.Writer
+	mtx  *sync.Mutex
+	buf  []byte // partial line not yet written
+}
+
+func (lw *localLogWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := lw.writeLine(lw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		lw.buf = lw.buf[i+1:]
+	}
+}
+
+func (lw *localLogWriter) Close() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
+	err := lw.writeLine(append(lw.buf, '\n'))
+	lw.buf = nil
+	return err
+}
+
+func (lw *localLogWriter) writeLine(line []byte) error {
+	lw.mtx.Lock()
+	defer lw.mtx.Unlock()
+	_, err := fmt.Fprintf(lw.w, "%s %s", lw.name, line)
+	return err
+}
+
+// newLocalRunner returns a ContainerRunner that runs the container
+// described by the JSON container record read from spec, without an
+// API server or Keep (see -local): the container image must already
+// be in the local Docker image store, "collection" and "git_tree"
+// mounts are not supported, the output is left in outputDir, and
+// logs are written to logw.
+func newLocalRunner(spec io.Reader, outputDir string, docker ThinDockerClient, logw io.Writer) (*ContainerRunner, error) {
+	buf, err := ioutil.ReadAll(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error reading container spec: %v", err)
+	}
+	cr := &ContainerRunner{
+		executor:       newDockerExecutor(docker),
+		local:          true,
+		localOutputDir: outputDir,
+		MkTempDir:      ioutil.TempDir,
+		secretTmpfs:    "/dev/shm",
+		scrubber:       &secretScrubber{},
+		token:          os.Getenv("ARVADOS_API_TOKEN"),
+	}
+	var sm struct {
+		SecretMounts map[string]arvados.Mount `json:"secret_mounts"`
+	}
+	for _, v := range []interface{}{&cr.Container, &sm} {
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		if err := dec.Decode(v); err != nil {
+			return nil, fmt.Errorf("error decoding container spec: %v", err)
+		}
+	}
+	cr.SecretMounts = sm.SecretMounts
+	if cr.Container.ContainerImage == "" {
+		return nil, fmt.Errorf("container spec has no container_image")
+	}
+	if len(cr.Container.Command) == 0 {
+		return nil, fmt.Errorf("container spec has no command")
+	}
+	if cr.Container.OutputPath == "" {
+		return nil, fmt.Errorf("container spec has no output_path")
+	}
+	if cr.Container.UUID == "" {
+		// Used as the docker container name.
+		cr.Container.UUID = fmt.Sprintf("crunch-run-local-%d", time.Now().UnixNano())
+	}
+	var mtx sync.Mutex
+	cr.NewLogWriter = func(name string) (io.WriteCloser, error) {
+		return &localLogWriter{name: name, w: logw, mtx: &mtx}, nil
+	}
+	w, _ := cr.NewLogWriter("crunch-run")
+	cr.CrunchLog = NewThrottledLogger(w)
+	cr.CrunchLog.scrubber = cr.scrubber
+	return cr, nil
+}
+
+// loadLocalImage checks that the container image (a name or ID
+// known to the local Docker image store, instead of a collection)
+// is available, and uses it for the container.
+func (runner *ContainerRunner) loadLocalImage() error {
+	runner.CrunchLog.Printf("Using Docker image '%s'", runner.Container.ContainerImage)
+	inspect, err := runner.executor.ImageInspect(context.TODO(), runner.Container.ContainerImage)
+	if err != nil {
+		return fmt.Errorf("container image %q is not in the local Docker image store (use \"docker pull\" or \"docker load\" first): %v", runner.Container.ContainerImage, err)
+	}
+	err = runner.checkImagePlatform(inspect.Os, inspect.Architecture)
+	if err != nil {
+		return err
+	}
+	runner.ContainerConfig.Image = runner.Container.ContainerImage
+	if inspect.Config != nil {
+		runner.imageEntrypoint = inspect.Config.Entrypoint
+	}
+	return nil
+}
+
+// runLocal runs the container like Run, but without updating a
+// container record, loading the image from Keep, or saving the
+// output and logs in collections. It returns the container's exit
+// code, or an error if the container could not be run.
+func (runner *ContainerRunner) runLocal() (exitCode int, err error) {
+	runner.CrunchLog.Printf("crunch-run %s started in local mode", cmd.Version.String())
+	runner.CrunchLog.Printf("Executing container '%s'", runner.Container.UUID)
+
+	defer func() {
+		if err != nil {
+			runner.CrunchLog.Printf("error in runLocal: %v", err)
+		}
+		runner.CleanupDirs()
+		runner.CrunchLog.Printf("crunch-run finished")
+		runner.CrunchLog.Close()
+	}()
+
+	runner.parentTemp, err = runner.MkTempDir("", "crunch-run-local.")
+	if err != nil {
+		return
+	}
+	if runner.Container.SchedulingParameters.OutputSnapshotInterval > 0 {
+		runner.CrunchLog.Printf("Ignoring output_snapshot_interval in local mode")
+		runner.Container.SchedulingParameters.OutputSnapshotInterval = 0
+	}
+
+	runner.setupSignals()
+	err = runner.loadLocalImage()
+	if err != nil {
+		return
+	}
+	err = runner.SetupMounts()
+	if err != nil {
+		err = fmt.Errorf("While setting up mounts: %v", err)
+		return
+	}
+	err = runner.CreateContainer()
+	if err != nil {
+		return
+	}
+	if runner.IsCancelled() {
+		err = ErrCancelled
+		return
+	}
+	err = runner.startCrunchstat()
+	if err != nil {
+		return
+	}
+	err = runner.StartContainer()
+	if err != nil {
+		return
+	}
+	err = runner.WaitFinish()
+	if err != nil {
+		return
+	}
+	if runner.IsCancelled() {
+		err = ErrCancelled
+		return
+	}
+	runner.CrunchLog.Printf("Container output is in %s", runner.HostOutputDir)
+	return *runner.ExitCode, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRunLocal(c *C) {
+	outdir := filepath.Join(c.MkDir(), "output")
+	s.docker.imageLoaded = "busybox:latest"
+	s.docker.fn = func(t *TestDockerClient) {
+		ioutil.WriteFile(filepath.Join(outdir, "result.txt"), []byte("42\n"), 0666)
+		t.logWriter.Write(dockerLog(1, "hello stdout\n"))
+		t.logWriter.Write(dockerLog(2, "hello stderr\n"))
+		t.logWriter.Close()
+	}
+	var logs bytes.Buffer
+	cr, err := newLocalRunner(strings.NewReader(`{
+		"container_image": "busybox:latest",
+		"command": ["sh", "-c", "echo 42 > /out/result.txt"],
+		"cwd": "/out",
+		"environment": {"FOO": "bar"},
+		"output_path": "/out",
+		"mounts": {
+			"/out": {"kind": "collection", "writable": true},
+			"/out/input.json": {"kind": "json", "content": {"x": 1}},
+			"stdout": {"kind": "file", "path": "/out/sub/stdout.txt"}
+		},
+		"secret_mounts": {
+			"/etc/secret.txt": {"kind": "text", "content": "mysecretvalue"}
+		},
+		"runtime_constraints": {"vcpus": 1, "ram": 1000000}
+	}`), outdir, s.docker, &logs)
+	c.Assert(err, IsNil)
+	code, err := cr.runLocal()
+	c.Check(err, IsNil)
+	c.Check(code, Equals, 0)
+	c.Check(cr.Container.UUID, Matches, `crunch-run-local-\d+`)
+	c.Check(cr.HostOutputDir, Equals, outdir)
+	c.Check(s.docker.cwd, Equals, "/out")
+	c.Check(s.docker.env, DeepEquals, []string{"FOO=bar"})
+	c.Check(cr.Binds, HasLen, 2)
+	c.Check(cr.Binds[0], Matches, `/.*/mountdata\.text:/etc/secret\.txt:ro`)
+	c.Check(cr.Binds[1], Equals, outdir+":/out")
+
+	for fnm, content := range map[string]string{
+		"result.txt":     "42\n",
+		"input.json":     `{"x":1}`,
+		"sub/stdout.txt": "hello stdout\n",
+	} {
+		buf, err := ioutil.ReadFile(filepath.Join(outdir, fnm))
+		c.Check(err, IsNil)
+		c.Check(string(buf), Equals, content)
+	}
+	c.Check(logs.String(), Matches, `(?ms).*^stderr \S+ hello stderr$.*`)
+	c.Check(logs.String(), Matches, `(?ms).*^crunch-run \S+ Container output is in `+outdir+`$.*`)
+}
+
+func (s *TestSuite) TestRunLocalOutputDirPermissions(c *C) {
+	s.docker.imageLoaded = "busybox:latest"
+	s.docker.fn = func(t *TestDockerClient) {
+		t.logWriter.Close()
+	}
+	record := `{
+		"container_image": "busybox:latest",
+		"command": ["true"],
+		"output_path": "/out",
+		"mounts": {"/out": {"kind": "tmp"}}
+	}`
+
+	// A directory created by crunch-run is made writable by the
+	// container user.
+	outdir := filepath.Join(c.MkDir(), "output")
+	cr, err := newLocalRunner(strings.NewReader(record), outdir, s.docker, ioutil.Discard)
+	c.Assert(err, IsNil)
+	_, err = cr.runLocal()
+	c.Check(err, IsNil)
+	st, err := os.Stat(outdir)
+	c.Assert(err, IsNil)
+	c.Check(st.Mode()&(os.ModeSetgid|os.ModePerm), Equals, os.ModeSetgid|0777)
+
+	// An existing directory is left alone.
+	outdir = c.MkDir()
+	c.Assert(os.Chmod(outdir, 0750), IsNil)
+	cr, err = newLocalRunner(strings.NewReader(record), outdir, s.docker, ioutil.Discard)
+	c.Assert(err, IsNil)
+	_, err = cr.runLocal()
+	c.Check(err, IsNil)
+	st, err = os.Stat(outdir)
+	c.Assert(err, IsNil)
+	c.Check(st.Mode()&(os.ModeSetgid|os.ModePerm), Equals, os.FileMode(0750))
+}
+
+func (s *TestSuite) TestRunLocalExitCode(c *C) {
+	s.docker.imageLoaded = "busybox:latest"
+	s.docker.exitCode = 3
+	s.docker.fn = func(t *TestDockerClient) {
+		t.logWriter.Close()
+	}
+	cr, err := newLocalRunner(strings.NewReader(`{
+		"container_image": "busybox:latest",
+		"command": ["false"],
+		"output_path": "/out",
+		"mounts": {"/out": {"kind": "tmp"}}
+	}`), c.MkDir(), s.docker, ioutil.Discard)
+	c.Assert(err, IsNil)
+	// exitCode 3 makes TestDockerClient fail ContainerStart.
+	_, err = cr.runLocal()
+	c.Check(err, ErrorMatches, `could not start container: .*`)
+
+	s.docker = NewTestDockerClient()
+	s.docker.imageLoaded = "busybox:latest"
+	s.docker.exitCode = 7
+	s.docker.fn = func(t *TestDockerClient) {
+		t.logWriter.Close()
+	}
+	cr, err = newLocalRunner(strings.NewReader(`{
+		"container_image": "busybox:latest",
+		"command": ["false"],
+		"output_path": "/out",
+		"mounts": {"/out": {"kind": "tmp"}}
+	}`), c.MkDir(), s.docker, ioutil.Discard)
+	c.Assert(err, IsNil)
+	code, err := cr.runLocal()
+	c.Check(err, IsNil)
+	c.Check(code, Equals, 7)
+}
+
+func (s *TestSuite) TestRunLocalErrors(c *C) {
+	s.docker.imageLoaded = "busybox:latest"
+	for _, trial := range []struct {
+		spec string
+		err  string
+	}{
+		{`{"command": ["true"], "output_path": "/out"}`, `container spec has no container_image`},
+		{`{"container_image": "busybox:latest", "output_path": "/out"}`, `container spec has no command`},
+		{`{"container_image": "busybox:latest", "command": ["true"]`, `error decoding container spec: .*`},
+	} {
+		_, err := newLocalRunner(strings.NewReader(trial.spec), c.MkDir(), s.docker, ioutil.Discard)
+		c.Check(err, ErrorMatches, trial.err)
+	}
+
+	for _, trial := range []struct {
+		spec string
+		err  string
+	}{
+		{`{"container_image": "debian:11", "command": ["true"], "output_path": "/out", "mounts": {"/out": {"kind": "tmp"}}}`,
+			`container image "debian:11" is not in the local Docker image store .*`},
+		{`{"container_image": "busybox:latest", "command": ["true"], "output_path": "/out", "mounts": {"/out": {"kind": "tmp"}, "/in": {"kind": "collection", "portable_data_hash": "` + otherPDH + `"}}}`,
+			`While setting up mounts: mount "/in": kind "collection" is not supported in local mode`},
+		{`{"container_image": "busybox:latest", "command": ["true"], "output_path": "/out", "mounts": {"/out": {"kind": "tmp"}, "/src": {"kind": "git_tree"}}}`,
+			`While setting up mounts: mount "/src": kind "git_tree" is not supported in local mode`},
+		{`{"container_image": "busybox:latest", "command": ["true"], "output_path": "/out", "mounts": {"/out": {"kind": "tmp"}}, "runtime_constraints": {"API": true}}`,
+			`no API token available in local mode .*`},
+	} {
+		cr, err := newLocalRunner(strings.NewReader(trial.spec), c.MkDir(), s.docker, ioutil.Discard)
+		c.Assert(err, IsNil)
+		cr.token = ""
+		_, err = cr.runLocal()
+		c.Check(err, ErrorMatches, trial.err)
+	}
+}
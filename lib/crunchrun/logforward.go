@@ -0,0 +1,376 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of log lines queued for each forwarder. If a
+// forwarder's collector is too slow or unreachable, further lines
+// are dropped (and counted) instead of holding up the container's
+// logs in Keep.
+const logForwardQueueSize = 10000
+
+// Maximum number of lines sent to a collector in one request.
+const logForwardBatchSize = 500
+
+// Time limit for each request to a collector.
+const logForwardTimeout = 10 * time.Second
+
+// How long closeLogForwarders waits for queued lines to be sent
+// after the container exits.
+const logForwardCloseTimeout = 10 * time.Second
+
+// forwardedLine is a container log line queued for forwarding.
+type forwardedLine struct {
+	Stream string
+	Time   time.Time
+	Text   string
+}
+
+// A logSink sends log lines to an external log collector.
+type logSink interface {
+	send(lines []forwardedLine) error
+	close() error
+}
+
+// logForwarder sends container stdout and stderr lines to an
+// external log collector (see -log-forward), in addition to the
+// usual logs in Keep.
+//
+// Lines are queued and sent by a separate goroutine, so a slow or
+// failing collector never delays or breaks the primary logs: when
+// the queue is full, lines are dropped, and errors are counted and
+// reported in the crunch-run log.
+type logForwarder struct {
+	url   string
+	sink  logSink
+	queue chan forwardedLine
+	stop  chan struct{} // closed by close() if run() is too slow
+	done  chan struct{} // closed when run() has closed the sink
+	logf  func(string, ...interface{})
+
+	mtx       sync.Mutex
+	forwarded int64
+	dropped   int64
+	errors    int64
+	lastError string
+	closed    bool // close() has returned, so logf must not be called
+}
+
+// newLogForwarder returns a logForwarder for the collector at the
+// given URL:
+//
+//	syslog://host[:port]         syslog over UDP (default port 514)
+//	syslog+udp://host[:port]     same as syslog://
+//	syslog+tcp://host[:port]     syslog over TCP
+//	fluentd://host[:port]/tag    fluentd in_http input (default port 9880)
+//	fluentd+https://host/tag     fluentd in_http input over HTTPS
+//
+// Errors sending to the collector are reported using logf.
+func newLogForwarder(rawurl, containerUUID string, logf func(string, ...interface{})) (*logForwarder, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid log forwarding URL %q: no host", rawurl)
+	}
+	var sink logSink
+	switch u.Scheme {
+	case "syslog", "syslog+udp", "syslog+tcp":
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		sink = &syslogSink{
+			network:       network,
+			addr:          hostWithDefaultPort(u, "514"),
+			containerUUID: containerUUID,
+		}
+	case "fluentd", "fluentd+http", "fluentd+https":
+		scheme := "http"
+		if u.Scheme == "fluentd+https" {
+			scheme = "https"
+		}
+		tag := strings.Trim(u.Path, "/")
+		if tag == "" {
+			tag = "arvados.container"
+		}
+		sink = &fluentdSink{
+			url:           scheme + "://" + hostWithDefaultPort(u, "9880") + "/" + tag,
+			client:        &http.Client{Timeout: logForwardTimeout},
+			containerUUID: containerUUID,
+		}
+	default:
+		return nil, fmt.Errorf("invalid log forwarding URL %q: unsupported scheme %q", rawurl, u.Scheme)
+	}
+	fwd := &logForwarder{
+		url:   u.Scheme + "://" + u.Host + u.Path,
+		sink:  sink,
+		queue: make(chan forwardedLine, logForwardQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		logf:  logf,
+	}
+	go fwd.run()
+	return fwd, nil
+}
+
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return u.Host + ":" + port
+}
+
+// enqueue adds a line to the queue without blocking. If the queue is
+// full, the line is dropped.
+func (fwd *logForwarder) enqueue(line forwardedLine) {
+	select {
+	case fwd.queue <- line:
+	default:
+		fwd.mtx.Lock()
+		fwd.dropped++
+		fwd.mtx.Unlock()
+	}
+}
+
+// run sends queued lines to the collector until the queue is closed
+// and empty, or stop is closed, and then closes the sink. The sink is
+// only ever used by this goroutine.
+func (fwd *logForwarder) run() {
+	defer close(fwd.done)
+	defer fwd.sink.close()
+	for {
+		select {
+		case <-fwd.stop:
+			return
+		default:
+		}
+		var line forwardedLine
+		var ok bool
+		select {
+		case line, ok = <-fwd.queue:
+		case <-fwd.stop:
+			return
+		}
+		if !ok {
+			return
+		}
+		batch := []forwardedLine{line}
+	fill:
+		for len(batch) < logForwardBatchSize {
+			select {
+			case line, ok := <-fwd.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, line)
+			default:
+				break fill
+			}
+		}
+		err := fwd.sink.send(batch)
+		fwd.mtx.Lock()
+		if err == nil {
+			fwd.forwarded += int64(len(batch))
+		} else {
+			fwd.dropped += int64(len(batch))
+			fwd.errors++
+			if msg := err.Error(); msg != fwd.lastError && !fwd.closed {
+				// Report the first error, and any
+				// different error after that.
+				fwd.lastError = msg
+				fwd.logf("error forwarding logs to %s: %s", fwd.url, err)
+			}
+		}
+		fwd.mtx.Unlock()
+	}
+}
+
+// close waits (up to the given timeout) for queued lines to be sent
+// and the connection to the collector to be closed, and reports how
+// many lines were forwarded and dropped.
+//
+// If the timeout is reached, the run goroutine is told to give up,
+// and closes the connection itself after the send in progress (if
+// any) returns. It doesn't call logf after close returns.
+func (fwd *logForwarder) close(timeout time.Duration) {
+	close(fwd.queue)
+	select {
+	case <-fwd.done:
+	case <-time.After(timeout):
+		fwd.logf("timed out waiting for logs to be forwarded to %s", fwd.url)
+		close(fwd.stop)
+	}
+	fwd.mtx.Lock()
+	defer fwd.mtx.Unlock()
+	fwd.closed = true
+	fwd.logf("forwarded %d log lines to %s (%d dropped, %d errors)", fwd.forwarded, fwd.url, fwd.dropped, fwd.errors)
+}
+
+// syslogSink sends log lines to a syslog server, tagged with the
+// container UUID. stderr lines are sent with "notice" severity,
+// stdout lines with "info".
+type syslogSink struct {
+	network       string
+	addr          string
+	containerUUID string
+	writer        *syslog.Writer
+}
+
+func (s *syslogSink) send(lines []forwardedLine) error {
+	if s.writer == nil {
+		w, err := syslog.Dial(s.network, s.addr, syslog.LOG_INFO|syslog.LOG_USER, s.containerUUID)
+		if err != nil {
+			return err
+		}
+		s.writer = w
+	}
+	for _, line := range lines {
+		msg := line.Stream + ": " + line.Text
+		var err error
+		if line.Stream == "stderr" {
+			err = s.writer.Notice(msg)
+		} else {
+			err = s.writer.Info(msg)
+		}
+		if err != nil {
+			// syslog.Writer has already tried to
+			// reconnect once, so start over with a new
+			// connection next time.
+			s.writer.Close()
+			s.writer = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) close() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Close()
+}
+
+// fluentdSink sends log lines to fluentd's in_http input as a JSON
+// array of records, one per line.
+type fluentdSink struct {
+	url           string
+	client        *http.Client
+	containerUUID string
+}
+
+type fluentdRecord struct {
+	ContainerUUID string `json:"container_uuid"`
+	Stream        string `json:"stream"`
+	Time          string `json:"time"`
+	Log           string `json:"log"`
+}
+
+func (s *fluentdSink) send(lines []forwardedLine) error {
+	records := make([]fluentdRecord, len(lines))
+	for i, line := range lines {
+		records[i] = fluentdRecord{
+			ContainerUUID: s.containerUUID,
+			Stream:        line.Stream,
+			Time:          line.Time.Format(RFC3339NanoFixed),
+			Log:           line.Text,
+		}
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *fluentdSink) close() error { return nil }
+
+// forwardingLogWriter is an io.WriteCloser that passes writes through
+// to another io.WriteCloser (the log in Keep), and also queues a
+// sample of the lines for each logForwarder. Each write is expected
+// to consist of complete lines with timestamps, as written by a
+// ThrottledLogger.
+//
+// The forwarders are not closed when the forwardingLogWriter is
+// closed, because they are shared by stdout and stderr; see
+// closeLogForwarders.
+type forwardingLogWriter struct {
+	io.WriteCloser
+	stream     string
+	forwarders []*logForwarder
+	sampleRate float64 // fraction of lines to forward (0 < sampleRate <= 1)
+	sampleAcc  float64
+}
+
+func (w *forwardingLogWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	for _, text := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if text == "" {
+			continue
+		}
+		// Forward sampleRate*N of every N lines, evenly
+		// spaced.
+		w.sampleAcc += w.sampleRate
+		if w.sampleAcc < 1 {
+			continue
+		}
+		w.sampleAcc--
+		line := forwardedLine{Stream: w.stream, Time: time.Now().UTC(), Text: text}
+		if i := strings.IndexByte(text, ' '); i > 0 {
+			if t, err := time.Parse(RFC3339NanoFixed, text[:i]); err == nil {
+				line.Time, line.Text = t, text[i+1:]
+			}
+		}
+		for _, fwd := range w.forwarders {
+			fwd.enqueue(line)
+		}
+	}
+	return n, err
+}
+
+// setupLogForwarders starts a logForwarder for each of the given
+// collector URLs. If a URL is invalid, the error is noted in the
+// crunch-run log and the container runs without that forwarder.
+func (runner *ContainerRunner) setupLogForwarders(urls []string) {
+	for _, u := range urls {
+		fwd, err := newLogForwarder(u, runner.Container.UUID, runner.CrunchLog.Printf)
+		if err != nil {
+			runner.CrunchLog.Printf("not forwarding logs: %s", err)
+			continue
+		}
+		runner.logForwarders = append(runner.logForwarders, fwd)
+	}
+}
+
+// closeLogForwarders waits for queued log lines to be forwarded (up
+// to logForwardCloseTimeout), then stops the forwarders.
+func (runner *ContainerRunner) closeLogForwarders() {
+	for _, fwd := range runner.logForwarders {
+		fwd.close(logForwardCloseTimeout)
+	}
+	runner.logForwarders = nil
+}
@@ -0,0 +1,230 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&LogForwardSuite{})
+
+type LogForwardSuite struct{}
+
+type nopWriteCloser struct{ strings.Builder }
+
+func (*nopWriteCloser) Close() error { return nil }
+
+// stubSink records the lines it's asked to send. If block is not
+// nil, send waits for it to be closed first.
+type stubSink struct {
+	mtx    sync.Mutex
+	lines  []forwardedLine
+	err    error
+	block  chan struct{}
+	closed bool
+}
+
+func (s *stubSink) send(lines []forwardedLine) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.lines = append(s.lines, lines...)
+	return nil
+}
+
+func (s *stubSink) close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	return nil
+}
+
+func newStubForwarder(sink logSink, logf func(string, ...interface{})) *logForwarder {
+	fwd := &logForwarder{
+		url:   "stub://",
+		sink:  sink,
+		queue: make(chan forwardedLine, logForwardQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		logf:  logf,
+	}
+	go fwd.run()
+	return fwd
+}
+
+func (s *LogForwardSuite) TestSampling(c *C) {
+	sink := &stubSink{}
+	var logged []string
+	fwd := newStubForwarder(sink, func(f string, args ...interface{}) { logged = append(logged, fmt.Sprintf(f, args...)) })
+	keep := &nopWriteCloser{}
+	w := &forwardingLogWriter{WriteCloser: keep, stream: "stderr", forwarders: []*logForwarder{fwd}, sampleRate: 0.25}
+	var input string
+	for i := 0; i < 12; i++ {
+		input += fmt.Sprintf("2021-01-02T03:04:05.%09dZ line %d\n", i, i)
+	}
+	n, err := w.Write([]byte(input))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len(input))
+	c.Check(w.Close(), IsNil)
+	fwd.close(time.Second)
+
+	// All lines are written to Keep, but only every 4th line is
+	// forwarded.
+	c.Check(keep.String(), Equals, input)
+	c.Assert(sink.lines, HasLen, 3)
+	for i, line := range sink.lines {
+		c.Check(line.Stream, Equals, "stderr")
+		c.Check(line.Text, Equals, fmt.Sprintf("line %d", i*4+3))
+		c.Check(line.Time, Equals, time.Date(2021, 1, 2, 3, 4, 5, i*4+3, time.UTC))
+	}
+	c.Check(logged, DeepEquals, []string{"forwarded 3 log lines to stub:// (0 dropped, 0 errors)"})
+}
+
+// A failing or stuck collector doesn't hold up or break the logs in
+// Keep.
+func (s *LogForwardSuite) TestFailureIsolation(c *C) {
+	var logged []string
+	var logmtx sync.Mutex
+	logf := func(f string, args ...interface{}) {
+		logmtx.Lock()
+		defer logmtx.Unlock()
+		logged = append(logged, fmt.Sprintf(f, args...))
+	}
+	failing := newStubForwarder(&stubSink{err: errors.New("connection refused")}, logf)
+	stuck := &stubSink{block: make(chan struct{})}
+	stuckfwd := newStubForwarder(stuck, logf)
+	keep := &nopWriteCloser{}
+	w := &forwardingLogWriter{WriteCloser: keep, stream: "stdout", forwarders: []*logForwarder{failing, stuckfwd}, sampleRate: 1}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < logForwardQueueSize*2; i++ {
+			_, err := w.Write([]byte("2021-01-02T03:04:05.000000000Z hello\n"))
+			c.Check(err, IsNil)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out writing logs")
+	}
+	c.Check(strings.Count(keep.String(), "\n"), Equals, logForwardQueueSize*2)
+
+	failing.close(time.Second)
+	stuckfwd.close(time.Millisecond)
+	close(stuck.block)
+	logmtx.Lock()
+	defer logmtx.Unlock()
+	c.Check(logged[0], Equals, "error forwarding logs to stub://: connection refused")
+	c.Check(logged, HasLen, 4)
+	c.Check(logged[1], Matches, `forwarded 0 log lines to stub:// \(20000 dropped, \d+ errors\)`)
+	c.Check(logged[2], Equals, "timed out waiting for logs to be forwarded to stub://")
+	c.Check(logged[3], Matches, `forwarded 0 log lines to stub:// \(\d+ dropped, 0 errors\)`)
+}
+
+// If close times out, the sink is closed by the run goroutine once
+// the send in progress returns, and errors from that send are not
+// logged.
+func (s *LogForwardSuite) TestCloseTimeout(c *C) {
+	var logged []string
+	var logmtx sync.Mutex
+	logf := func(f string, args ...interface{}) {
+		logmtx.Lock()
+		defer logmtx.Unlock()
+		logged = append(logged, fmt.Sprintf(f, args...))
+	}
+	sink := &stubSink{block: make(chan struct{}), err: errors.New("connection reset")}
+	fwd := newStubForwarder(sink, logf)
+	fwd.enqueue(forwardedLine{Stream: "stdout", Text: "line 1"})
+	fwd.enqueue(forwardedLine{Stream: "stdout", Text: "line 2"})
+	fwd.close(time.Millisecond)
+
+	sink.mtx.Lock()
+	c.Check(sink.closed, Equals, false)
+	sink.mtx.Unlock()
+	close(sink.block)
+	select {
+	case <-fwd.done:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for run to return")
+	}
+	c.Check(sink.closed, Equals, true)
+
+	logmtx.Lock()
+	defer logmtx.Unlock()
+	c.Assert(logged, HasLen, 2)
+	c.Check(logged[0], Equals, "timed out waiting for logs to be forwarded to stub://")
+	c.Check(logged[1], Matches, `forwarded 0 log lines to stub:// \(\d+ dropped, 0 errors\)`)
+}
+
+func (s *LogForwardSuite) TestFluentd(c *C) {
+	var reqs []string
+	var records []fluentdRecord
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqs = append(reqs, req.Method+" "+req.URL.Path+" "+req.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(req.Body)
+		var recs []fluentdRecord
+		c.Check(json.Unmarshal(body, &recs), IsNil)
+		records = append(records, recs...)
+	}))
+	defer srv.Close()
+
+	var logged []string
+	fwd, err := newLogForwarder(strings.Replace(srv.URL, "http://", "fluentd://", 1)+"/arvados.test", "zzzzz-dz642-logforward00001", func(f string, args ...interface{}) { logged = append(logged, fmt.Sprintf(f, args...)) })
+	c.Assert(err, IsNil)
+	w := &forwardingLogWriter{WriteCloser: &nopWriteCloser{}, stream: "stdout", forwarders: []*logForwarder{fwd}, sampleRate: 1}
+	w.Write([]byte("2021-01-02T03:04:05.000000000Z hello\n2021-01-02T03:04:06.000000000Z world\n"))
+	fwd.close(5 * time.Second)
+
+	c.Check(reqs, DeepEquals, []string{"POST /arvados.test application/json"})
+	c.Check(records, DeepEquals, []fluentdRecord{
+		{ContainerUUID: "zzzzz-dz642-logforward00001", Stream: "stdout", Time: "2021-01-02T03:04:05.000000000Z", Log: "hello"},
+		{ContainerUUID: "zzzzz-dz642-logforward00001", Stream: "stdout", Time: "2021-01-02T03:04:06.000000000Z", Log: "world"},
+	})
+	c.Check(logged, DeepEquals, []string{"forwarded 2 log lines to fluentd://" + strings.TrimPrefix(srv.URL, "http://") + "/arvados.test (0 dropped, 0 errors)"})
+}
+
+func (s *LogForwardSuite) TestSyslog(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	fwd, err := newLogForwarder("syslog://"+conn.LocalAddr().String(), "zzzzz-dz642-logforward00001", c.Logf)
+	c.Assert(err, IsNil)
+	w := &forwardingLogWriter{WriteCloser: &nopWriteCloser{}, stream: "stderr", forwarders: []*logForwarder{fwd}, sampleRate: 1}
+	w.Write([]byte("2021-01-02T03:04:05.000000000Z oops\n"))
+	fwd.close(5 * time.Second)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	// <13> = facility user (1), severity notice (5)
+	c.Check(string(buf[:n]), Matches, `<13>.* zzzzz-dz642-logforward00001\[\d+\]: stderr: oops\n`)
+}
+
+func (s *LogForwardSuite) TestBadURLs(c *C) {
+	for _, u := range []string{"logs.example:514", "http://logs.example/", "syslog:///"} {
+		_, err := newLogForwarder(u, "zzzzz-dz642-logforward00001", c.Logf)
+		c.Check(err, ErrorMatches, `invalid log forwarding URL .*`)
+	}
+}
@@ -10,11 +10,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 )
 
@@ -45,6 +47,13 @@ type ThrottledLogger struct {
 	Timestamper
 	Immediate    *log.Logger
 	pendingFlush bool
+
+	// If not nil, secret values are removed from each line.
+	scrubber *secretScrubber
+
+	// If not nil, called with each timestamped line as it is
+	// written (see liveLogStreamer).
+	live func(string)
 }
 
 // RFC3339NanoFixed is a fixed-width version of time.RFC3339Nano.
@@ -69,10 +78,13 @@ func (tl *ThrottledLogger) Write(p []byte) (n int, err error) {
 	now := tl.Timestamper(time.Now().UTC())
 	sc := bufio.NewScanner(bytes.NewBuffer(p))
 	for err == nil && sc.Scan() {
-		out := fmt.Sprintf("%s %s\n", now, sc.Bytes())
+		out := fmt.Sprintf("%s %s\n", now, tl.scrubber.Scrub(sc.Bytes()))
 		if tl.Immediate != nil {
 			tl.Immediate.Print(out[:len(out)-1])
 		}
+		if tl.live != nil {
+			tl.live(out)
+		}
 		_, err = io.WriteString(tl.buf, out)
 	}
 	if err == nil {
@@ -95,6 +107,13 @@ func (tl *ThrottledLogger) Write(p []byte) (n int, err error) {
 	return
 }
 
+// setLive sets tl.live, which may be nil.
+func (tl *ThrottledLogger) setLive(live func(string)) {
+	tl.Mutex.Lock()
+	defer tl.Mutex.Unlock()
+	tl.live = live
+}
+
 // Periodically check the current buffer; if not empty, send it on the
 // channel to the goWriter goroutine.
 func (tl *ThrottledLogger) flusher() {
@@ -298,6 +317,96 @@ func (arvlog *ArvLogWriter) Close() (err error) {
 	return err
 }
 
+// rotatingLogWriter is an io.WriteCloser that writes a log stream to
+// a sequence of files in a collection (stdout.0001.txt,
+// stdout.0002.txt, ...) instead of a single file. A new file is
+// started at a line boundary whenever the current file would
+// otherwise exceed maxBytes, and an index file (stdout.index.txt)
+// listing the files written so far is updated each time.
+type rotatingLogWriter struct {
+	fs       arvados.CollectionFileSystem
+	name     string
+	maxBytes int64
+
+	files    []string
+	current  arvados.File
+	curBytes int64
+	midLine  bool // last write did not end with a newline
+}
+
+func newRotatingLogWriter(fs arvados.CollectionFileSystem, name string, maxBytes int64) (*rotatingLogWriter, error) {
+	w := &rotatingLogWriter{
+		fs:       fs,
+		name:     name,
+		maxBytes: maxBytes,
+	}
+	return w, w.rotate()
+}
+
+func (w *rotatingLogWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		if !w.midLine && w.curBytes > 0 && w.curBytes+int64(len(line)) > w.maxBytes {
+			if err := w.rotate(); err != nil {
+				return n, err
+			}
+		}
+		wrote, err := w.current.Write(line)
+		n += wrote
+		w.curBytes += int64(wrote)
+		if err != nil {
+			return n, err
+		}
+		w.midLine = line[len(line)-1] != '\n'
+		p = p[len(line):]
+	}
+	return n, nil
+}
+
+// rotate closes the current file (if any), starts the next one, and
+// rewrites the index file.
+func (w *rotatingLogWriter) rotate() error {
+	if w.current != nil {
+		err := w.current.Close()
+		w.current = nil
+		if err != nil {
+			return err
+		}
+	}
+	fnm := fmt.Sprintf("%s.%04d.txt", w.name, len(w.files)+1)
+	f, err := w.fs.OpenFile(fnm, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w.current = f
+	w.curBytes = 0
+	w.files = append(w.files, fnm)
+
+	idx, err := w.fs.OpenFile(w.name+".index.txt", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = idx.Write([]byte(strings.Join(w.files, "\n") + "\n"))
+	if err != nil {
+		idx.Close()
+		return err
+	}
+	return idx.Close()
+}
+
+func (w *rotatingLogWriter) Close() error {
+	if w.current == nil {
+		return nil
+	}
+	err := w.current.Close()
+	w.current = nil
+	return err
+}
+
 var lineRegexp = regexp.MustCompile(`^\S+ (.*)`)
 
 // Test for hard cap on total output and for log throttling. Returns whether
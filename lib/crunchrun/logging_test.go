@@ -6,6 +6,8 @@ package crunchrun
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -131,6 +133,49 @@ func (s *LoggingTestSuite) TestWriteMultipleLogs(c *C) {
 	c.Check(mt, Equals, ". 48f9023dc683a850b1c9b482b14c4b97+163 0:83:crunch-run.txt 83:80:stdout.txt\n")
 }
 
+func (s *LoggingTestSuite) TestRotateStdout(c *C) {
+	api := &ArvTestClient{}
+	kc := &KeepTestClient{}
+	defer kc.Close()
+	cr, err := NewContainerRunner(s.client, api, kc, nil, "zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.logRotateSize = 80
+	ts := &TestTimestamper{}
+	w, err := cr.NewLogWriter("stdout")
+	c.Assert(err, IsNil)
+	stdout := NewThrottledLogger(w)
+	stdout.Timestamper = ts.Timestamp
+
+	stdout.Print("line one")
+	stdout.Print("line two")
+	stdout.Print("line 333")
+	stdout.Close()
+
+	logText := ""
+	for _, content := range api.Content {
+		log := content["log"].(arvadosclient.Dict)
+		logText += log["properties"].(map[string]string)["text"]
+	}
+	c.Check(logText, Equals, `2015-12-29T15:51:45.000000001Z line one
+2015-12-29T15:51:45.000000002Z line two
+2015-12-29T15:51:45.000000003Z line 333
+`)
+
+	for fnm, expect := range map[string]string{
+		"stdout.index.txt": "stdout.0001.txt\nstdout.0002.txt\n",
+		"stdout.0001.txt":  "2015-12-29T15:51:45.000000001Z line one\n2015-12-29T15:51:45.000000002Z line two\n",
+		"stdout.0002.txt":  "2015-12-29T15:51:45.000000003Z line 333\n",
+	} {
+		f, err := cr.LogCollection.Open(fnm)
+		c.Assert(err, IsNil)
+		buf, err := ioutil.ReadAll(f)
+		c.Check(err, IsNil)
+		c.Check(string(buf), Equals, expect, Commentf("%s", fnm))
+	}
+	_, err = cr.LogCollection.Stat("stdout.txt")
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
 func (s *LoggingTestSuite) TestLogUpdate(c *C) {
 	for _, trial := range []struct {
 		maxBytes    int64
@@ -0,0 +1,300 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+// plannedMount describes how SetupMounts provides a single mount
+// point to the container.
+type plannedMount struct {
+	bind string
+	mnt  arvados.Mount
+
+	// For "collection" mounts: the path of the data relative to
+	// the arv-mount mount point, e.g., "by_id/{pdh}/subdir" or
+	// "tmp0".
+	keepPath string
+
+	// Copy the data into the output directory, instead of
+	// bind-mounting it ("collection", "text", and "json" mounts
+	// underneath the output path).
+	copyToOutput bool
+
+	// For "text" and "json" mounts: the file content.
+	data []byte
+
+	// For "tmpfs" mounts: the tmpfs mount options.
+	tmpfsOpts string
+}
+
+// mountPlan is the result of validating the container's mounts. It
+// has everything SetupMounts needs to know to set them up, so any
+// problem with the mounts is reported before anything is created.
+type mountPlan struct {
+	// Mount points in the order they should be set up (parents
+	// before children).
+	mounts []plannedMount
+
+	// arv-mount command line arguments, except the mount point.
+	arvMountArgs []string
+
+	// "arvados-client" command line arguments to use instead of
+	// arv-mount with -keep-mount-engine=experimental-go, except
+	// the mount point and FUSE options, or nil if the mounts need
+	// a feature the Go driver doesn't have (writable collections).
+	goMountArgs []string
+
+	// The container can reach the API server but doesn't have
+	// its own CA certificates mount.
+	needCertMount bool
+
+	// The "tmp" output directory was replaced by a writable
+	// collection in arv-mount (see -output-arv-mount).
+	outputInArvMount bool
+}
+
+// planMounts validates the container's mounts and secret mounts, and
+// returns a mountPlan for SetupMounts. It has no side effects, other
+// than normalizing collection mounts that specify a path as part of
+// portable_data_hash.
+func (runner *ContainerRunner) planMounts() (*mountPlan, error) {
+	var binds []string
+	for bind := range runner.Container.Mounts {
+		binds = append(binds, bind)
+	}
+	for bind := range runner.SecretMounts {
+		if _, ok := runner.Container.Mounts[bind]; ok {
+			return nil, fmt.Errorf("secret mount %q conflicts with regular mount", bind)
+		}
+		if runner.SecretMounts[bind].Kind != "json" &&
+			runner.SecretMounts[bind].Kind != "text" &&
+			runner.SecretMounts[bind].Kind != "secret" {
+			return nil, fmt.Errorf("secret mount %q type is %q but only 'json', 'text', and 'secret' are permitted",
+				bind, runner.SecretMounts[bind].Kind)
+		}
+		binds = append(binds, bind)
+	}
+	sort.Strings(binds)
+
+	outputPath := runner.Container.OutputPath
+	plan := &mountPlan{
+		arvMountArgs: []string{
+			"--foreground",
+			"--allow-other",
+			"--read-write",
+			fmt.Sprintf("--crunchstat-interval=%v", runner.statInterval.Seconds())},
+		needCertMount: runner.Container.RuntimeConstraints.API,
+	}
+	if runner.Container.RuntimeConstraints.KeepCacheRAM > 0 {
+		plan.arvMountArgs = append(plan.arvMountArgs, "--file-cache", fmt.Sprintf("%d", runner.Container.RuntimeConstraints.KeepCacheRAM))
+	}
+
+	pdhOnly := true
+	tmpcount := 0
+	var tmpfsBytes int64
+	haveOutputDir := false
+	for _, bind := range binds {
+		mnt, ok := runner.Container.Mounts[bind]
+		if !ok {
+			mnt = runner.SecretMounts[bind]
+		} else if mnt.Kind == "secret" {
+			return nil, fmt.Errorf("mount %q: kind 'secret' is only permitted in secret_mounts", bind)
+		}
+		if runner.outputArvMount && bind == outputPath && mnt.Kind == "tmp" {
+			// Data written to the output directory goes
+			// straight to Keep, and copyOutput gets the
+			// manifest from arv-mount instead of reading
+			// the files back and uploading them.
+			mnt = arvados.Mount{Kind: "collection", Writable: true}
+			plan.outputInArvMount = true
+		}
+		if runner.local && bind == outputPath && mnt.Kind == "collection" && mnt.Writable && mnt.UUID == "" && mnt.PortableDataHash == "" {
+			// Without Keep, an output collection is just
+			// a directory.
+			mnt = arvados.Mount{Kind: "tmp"}
+		}
+		if runner.local && (mnt.Kind == "collection" || mnt.Kind == "git_tree") {
+			return nil, fmt.Errorf("mount %q: kind %q is not supported in local mode", bind, mnt.Kind)
+		}
+		underOutput := strings.HasPrefix(bind, outputPath+"/")
+
+		if bind == "stdout" || bind == "stderr" {
+			// Is it a "file" mount kind?
+			if mnt.Kind != "file" {
+				return nil, fmt.Errorf("unsupported mount kind '%s' for %s: only 'file' is supported", mnt.Kind, bind)
+			}
+
+			// Does path start with OutputPath?
+			prefix := outputPath
+			if !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+			if !strings.HasPrefix(mnt.Path, prefix) {
+				return nil, fmt.Errorf("%s path does not start with OutputPath: %s, %s", strings.Title(bind), mnt.Path, prefix)
+			}
+		}
+
+		if bind == "stdin" {
+			// Is it a "collection" mount kind?
+			if mnt.Kind != "collection" && mnt.Kind != "json" {
+				return nil, fmt.Errorf("unsupported mount kind '%s' for stdin: only 'collection' and 'json' are supported", mnt.Kind)
+			}
+		}
+
+		if bind == "/etc/arvados/ca-certificates.crt" {
+			plan.needCertMount = false
+		}
+
+		if underOutput && bind != outputPath+"/" {
+			if mnt.Kind != "collection" && mnt.Kind != "text" && mnt.Kind != "json" && mnt.Kind != "secret" {
+				return nil, fmt.Errorf("only mount points of kind 'collection', 'text', 'json' or 'secret' are supported underneath the output_path for %q, was %q", bind, mnt.Kind)
+			}
+		}
+
+		pm := plannedMount{bind: bind, mnt: mnt}
+		switch {
+		case mnt.Kind == "collection" && bind != "stdin":
+			if mnt.UUID != "" && mnt.PortableDataHash != "" {
+				return nil, fmt.Errorf("cannot specify both 'uuid' and 'portable_data_hash' for a collection mount")
+			}
+			if mnt.UUID != "" {
+				if mnt.Writable {
+					return nil, fmt.Errorf("writing to existing collections currently not permitted")
+				}
+				pdhOnly = false
+				pm.keepPath = "by_id/" + mnt.UUID
+			} else if mnt.PortableDataHash != "" {
+				if mnt.Writable && !underOutput {
+					return nil, fmt.Errorf("can never write to a collection specified by portable data hash")
+				}
+				idx := strings.Index(mnt.PortableDataHash, "/")
+				if idx > 0 {
+					mnt.Path = path.Clean(mnt.PortableDataHash[idx:])
+					mnt.PortableDataHash = mnt.PortableDataHash[0:idx]
+					runner.Container.Mounts[bind] = mnt
+				}
+				pm.keepPath = "by_id/" + mnt.PortableDataHash
+				if mnt.Path != "" && mnt.Path != "." {
+					if strings.HasPrefix(mnt.Path, "./") {
+						mnt.Path = mnt.Path[2:]
+					} else if strings.HasPrefix(mnt.Path, "/") {
+						mnt.Path = mnt.Path[1:]
+					}
+					pm.keepPath += "/" + mnt.Path
+				}
+			} else {
+				pm.keepPath = fmt.Sprintf("tmp%d", tmpcount)
+				plan.arvMountArgs = append(plan.arvMountArgs, "--mount-tmp", pm.keepPath)
+				tmpcount++
+			}
+			if mnt.Writable && bind == outputPath {
+				haveOutputDir = true
+			} else if mnt.Writable && underOutput {
+				pm.copyToOutput = true
+			}
+
+		case mnt.Kind == "tmp":
+			if bind == outputPath {
+				haveOutputDir = true
+			}
+
+		case mnt.Kind == "tmpfs":
+			if bind == outputPath {
+				return nil, fmt.Errorf("tmpfs mount cannot be used as output path %q", bind)
+			}
+			if mnt.Capacity <= 0 {
+				return nil, fmt.Errorf("tmpfs mount %q must specify a positive capacity", bind)
+			}
+			pm.tmpfsOpts = fmt.Sprintf("size=%d", mnt.Capacity)
+			if mnt.Mode != "" {
+				if mode, err := strconv.ParseUint(mnt.Mode, 8, 32); err != nil || mode > 07777 {
+					return nil, fmt.Errorf("tmpfs mount %q has invalid mode %q: must be an octal number like \"1777\"", bind, mnt.Mode)
+				}
+				pm.tmpfsOpts += ",mode=" + mnt.Mode
+			}
+			// Files stored in tmpfs count against the
+			// container's memory limit.
+			tmpfsBytes += mnt.Capacity
+
+		case mnt.Kind == "json" || mnt.Kind == "text":
+			if mnt.Kind == "json" {
+				data, err := json.Marshal(mnt.Content)
+				if err != nil {
+					return nil, fmt.Errorf("encoding json data: %v", err)
+				}
+				pm.data = data
+			} else {
+				text, ok := mnt.Content.(string)
+				if !ok {
+					return nil, fmt.Errorf("content for mount %q must be a string", bind)
+				}
+				pm.data = []byte(text)
+			}
+			pm.copyToOutput = underOutput
+
+		case mnt.Kind == "secret":
+			if _, _, err := secretContent(mnt.Content); err != nil {
+				return nil, fmt.Errorf("encoding content for secret mount %q: %v", bind, err)
+			}
+
+		case mnt.Kind == "git_tree":
+			if err := gitMount(mnt).validate(); err != nil {
+				return nil, err
+			}
+		}
+		plan.mounts = append(plan.mounts, pm)
+	}
+
+	if !haveOutputDir {
+		return nil, fmt.Errorf("output path does not correspond to a writable mount point")
+	}
+
+	if ram := runner.Container.RuntimeConstraints.RAM; tmpfsBytes > ram {
+		return nil, fmt.Errorf("total capacity of tmpfs mounts (%d bytes) exceeds the container's RAM constraint (%d bytes)", tmpfsBytes, ram)
+	}
+
+	if pdhOnly {
+		plan.arvMountArgs = append(plan.arvMountArgs, "--mount-by-pdh", "by_id")
+	} else {
+		plan.arvMountArgs = append(plan.arvMountArgs, "--mount-by-id", "by_id")
+	}
+
+	if tmpcount == 0 {
+		plan.goMountArgs = []string{"mount", "-experimental", "-ro"}
+		if ram := runner.Container.RuntimeConstraints.KeepCacheRAM; ram > 0 {
+			blocks := (ram + keepclient.BLOCKSIZE - 1) / keepclient.BLOCKSIZE
+			plan.goMountArgs = append(plan.goMountArgs, fmt.Sprintf("-block-cache=%d", blocks))
+		}
+	}
+	return plan, nil
+}
+
+// checkMountPoint returns nil if a filesystem is mounted at dir, i.e.,
+// dir is on a different device than its parent directory.
+func checkMountPoint(dir string) error {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return err
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+		return err
+	}
+	if st.Dev == parent.Dev {
+		return fmt.Errorf("%s is not a mount point", dir)
+	}
+	return nil
+}
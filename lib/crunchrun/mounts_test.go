@@ -0,0 +1,126 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestPlanMounts(c *C) {
+	cr := &ContainerRunner{statInterval: 5 * time.Second}
+	cr.Container.OutputPath = "/out"
+	cr.Container.RuntimeConstraints.API = true
+	cr.Container.RuntimeConstraints.RAM = 1 << 30
+	cr.Container.Mounts = map[string]arvados.Mount{
+		"/out":           {Kind: "collection", Writable: true},
+		"/out/input":     {Kind: "collection", PortableDataHash: otherPDH + "/subdir", Writable: true},
+		"/out/conf.json": {Kind: "json", Content: map[string]int{"x": 1}},
+		"/scratch":       {Kind: "tmpfs", Capacity: 1 << 20, Mode: "1777"},
+		"/ref":           {Kind: "collection", UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa"},
+	}
+	cr.SecretMounts = map[string]arvados.Mount{
+		"/etc/secret.txt": {Kind: "text", Content: "mysecret"},
+	}
+	plan, err := cr.planMounts()
+	c.Assert(err, IsNil)
+	c.Check(plan.arvMountArgs, DeepEquals, []string{"--foreground", "--allow-other", "--read-write", "--crunchstat-interval=5",
+		"--mount-tmp", "tmp0", "--mount-by-id", "by_id"})
+	c.Check(plan.needCertMount, Equals, true)
+	// The Go driver can't provide the writable output collection.
+	c.Check(plan.goMountArgs, IsNil)
+	var binds []string
+	for _, pm := range plan.mounts {
+		binds = append(binds, pm.bind)
+	}
+	c.Check(binds, DeepEquals, []string{"/etc/secret.txt", "/out", "/out/conf.json", "/out/input", "/ref", "/scratch"})
+	c.Check(string(plan.mounts[0].data), Equals, "mysecret")
+	c.Check(plan.mounts[0].copyToOutput, Equals, false)
+	c.Check(plan.mounts[1].keepPath, Equals, "tmp0")
+	c.Check(string(plan.mounts[2].data), Equals, `{"x":1}`)
+	c.Check(plan.mounts[2].copyToOutput, Equals, true)
+	c.Check(plan.mounts[3].keepPath, Equals, "by_id/"+otherPDH+"/subdir")
+	c.Check(plan.mounts[3].copyToOutput, Equals, true)
+	c.Check(plan.mounts[4].keepPath, Equals, "by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	c.Check(plan.mounts[5].tmpfsOpts, Equals, "size=1048576,mode=1777")
+}
+
+func (s *TestSuite) TestSetupMountsGoKeepMount(c *C) {
+	tmpdir, err := ioutil.TempDir("", "crunchrun_test-")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, &KeepTestClient{}, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	am := &ArvMountCmdLine{}
+	cr.RunArvMount = am.ArvMountTest
+	i := 0
+	cr.MkTempDir = func(_ string, prefix string) (string, error) {
+		i++
+		d := fmt.Sprintf("%s/%s%d", tmpdir, prefix, i)
+		return d, os.Mkdir(d, 0777)
+	}
+	cr.keepMountEngine = "experimental-go"
+	cr.Container.OutputPath = "/tmp"
+	cr.Container.RuntimeConstraints.KeepCacheRAM = 100 << 20
+	cr.Container.Mounts = map[string]arvados.Mount{
+		"/tmp":      {Kind: "tmp"},
+		"/etc/conf": {Kind: "text", Content: "x"},
+	}
+	c.Assert(cr.SetupMounts(), IsNil)
+	c.Check(cr.goKeepMount, Equals, true)
+	c.Check(am.Cmd, DeepEquals, []string{"mount", "-experimental", "-ro", "-block-cache=2", tmpdir + "/keep1", "-o", "allow_other"})
+}
+
+// A mount error is reported before any temporary directories are
+// created or arv-mount is started, even if it is found in a mount
+// point that sorts after valid ones.
+func (s *TestSuite) TestSetupMountsValidateFirst(c *C) {
+	cr := &ContainerRunner{}
+	cr.MkTempDir = func(string, string) (string, error) {
+		c.Error("MkTempDir called")
+		return "", errors.New("MkTempDir called")
+	}
+	cr.RunArvMount = func([]string, string) (*exec.Cmd, error) {
+		c.Error("RunArvMount called")
+		return nil, errors.New("RunArvMount called")
+	}
+	for _, trial := range []struct {
+		mounts map[string]arvados.Mount
+		err    string
+	}{
+		{map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp"},
+			"/zzz": {Kind: "tmpfs"},
+		}, `tmpfs mount "/zzz" must specify a positive capacity`},
+		{map[string]arvados.Mount{
+			"/tmp":  {Kind: "tmp"},
+			"/text": {Kind: "text", Content: 123},
+		}, `content for mount "/text" must be a string`},
+		{map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp"},
+			"/zzz": {Kind: "git_tree", Commit: "abc"},
+		}, `cannot mount git_tree with commit "abc" -- must be a 40-char SHA1`},
+		{map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp"},
+			"/zzz": {Kind: "collection", UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa", Writable: true},
+		}, `writing to existing collections currently not permitted`},
+		{map[string]arvados.Mount{
+			"/in": {Kind: "collection", PortableDataHash: otherPDH},
+		}, `output path does not correspond to a writable mount point`},
+	} {
+		cr.Container.OutputPath = "/tmp"
+		cr.Container.Mounts = trial.mounts
+		c.Check(cr.SetupMounts(), ErrorMatches, trial.err)
+		c.Check(cr.ArvMountPoint, Equals, "")
+	}
+}
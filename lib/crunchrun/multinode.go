@@ -0,0 +1,45 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"strconv"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// multiNodeEnv returns the environment variables that tell a
+// multi-node container (scheduling parameter nodes > 1) about its
+// allocation.
+//
+// crunch-run itself only runs on the first node of the allocation
+// ("rank 0"), which is where the container is started. The container
+// is responsible for starting any work on the other nodes, e.g., by
+// running mpirun with the host list. When running under SLURM, the
+// node list and task count come from the SLURM batch environment.
+func multiNodeEnv(sp arvados.SchedulingParameters, getenv func(string) string, hostname string) []string {
+	if sp.Nodes < 2 {
+		return nil
+	}
+	nodes := getenv("SLURM_JOB_NUM_NODES")
+	if nodes == "" {
+		nodes = strconv.Itoa(sp.Nodes)
+	}
+	tasks := getenv("SLURM_NTASKS")
+	if tasks == "" && sp.Tasks > 0 {
+		tasks = strconv.Itoa(sp.Tasks)
+	}
+	env := []string{
+		"ARVADOS_NODE_COUNT=" + nodes,
+		"ARVADOS_RANK0_HOST=" + hostname,
+	}
+	if tasks != "" {
+		env = append(env, "ARVADOS_TASK_COUNT="+tasks)
+	}
+	if nodelist := getenv("SLURM_JOB_NODELIST"); nodelist != "" {
+		env = append(env, "ARVADOS_NODELIST="+nodelist)
+	}
+	return env
+}
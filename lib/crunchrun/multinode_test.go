@@ -0,0 +1,37 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&MultiNodeSuite{})
+
+type MultiNodeSuite struct{}
+
+func (s *MultiNodeSuite) TestMultiNodeEnv(c *C) {
+	noenv := func(string) string { return "" }
+	c.Check(multiNodeEnv(arvados.SchedulingParameters{}, noenv, "node1"), HasLen, 0)
+	c.Check(multiNodeEnv(arvados.SchedulingParameters{Nodes: 1, Tasks: 4}, noenv, "node1"), HasLen, 0)
+
+	c.Check(multiNodeEnv(arvados.SchedulingParameters{Nodes: 2}, noenv, "node1"), DeepEquals, []string{
+		"ARVADOS_NODE_COUNT=2",
+		"ARVADOS_RANK0_HOST=node1",
+	})
+
+	slurmenv := map[string]string{
+		"SLURM_JOB_NUM_NODES": "3",
+		"SLURM_NTASKS":        "12",
+		"SLURM_JOB_NODELIST":  "compute[1-3]",
+	}
+	c.Check(multiNodeEnv(arvados.SchedulingParameters{Nodes: 3, Tasks: 12}, func(k string) string { return slurmenv[k] }, "compute1"), DeepEquals, []string{
+		"ARVADOS_NODE_COUNT=3",
+		"ARVADOS_RANK0_HOST=compute1",
+		"ARVADOS_TASK_COUNT=12",
+		"ARVADOS_NODELIST=compute[1-3]",
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// snapshotOutput copies the current contents of the container's
+// output directory to Keep, and saves them in the container's output
+// snapshot collection, creating the collection if needed.
+//
+// Each snapshot is saved as a new version of the same collection, so
+// (if collection versioning is enabled) earlier snapshots remain
+// available in its version history. Files that are being modified
+// while the snapshot is taken might be saved in an inconsistent
+// state.
+func (runner *ContainerRunner) snapshotOutput() (arvados.Collection, error) {
+	var coll arvados.Collection
+	runner.cStateLock.Lock()
+	running := runner.ContainerID != "" && runner.ExitCode == nil && !runner.cRemoved
+	runner.cStateLock.Unlock()
+	if !running || runner.HostOutputDir == "" {
+		return coll, errors.New("container is not running")
+	}
+
+	runner.snapshotMtx.Lock()
+	defer runner.snapshotMtx.Unlock()
+	if runner.OutputPDH != nil {
+		return coll, errors.New("container output has already been saved")
+	}
+	txt, err := runner.copyOutput()
+	if err != nil {
+		return coll, fmt.Errorf("error copying output: %w", err)
+	}
+	attrs := arvadosclient.Dict{
+		"name":             "output snapshot for " + runner.Container.UUID,
+		"manifest_text":    txt,
+		"preserve_version": true,
+		"properties": map[string]interface{}{
+			"type":           "intermediate",
+			"container_uuid": runner.Container.UUID,
+		},
+	}
+	if runner.snapshotUUID == "" {
+		err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
+			"ensure_unique_name": true,
+			"collection":         attrs,
+		}, &coll)
+	} else {
+		err = runner.ContainerArvClient.Update("collections", runner.snapshotUUID, arvadosclient.Dict{
+			"collection": attrs,
+		}, &coll)
+	}
+	if err != nil {
+		return coll, fmt.Errorf("error saving output snapshot collection: %w", err)
+	}
+	runner.snapshotUUID = coll.UUID
+	runner.CrunchLog.Printf("Saved output snapshot %s (%s)", coll.UUID, coll.PortableDataHash)
+	return coll, nil
+}
+
+// snapshotOutputLoop calls snapshotOutput at the given interval until
+// stop is closed.
+func (runner *ContainerRunner) snapshotOutputLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		_, err := runner.snapshotOutput()
+		if err != nil {
+			runner.CrunchLog.Printf("Error saving output snapshot: %s", err)
+		}
+	}
+}
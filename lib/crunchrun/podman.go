@@ -0,0 +1,81 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	dockercontainer "github.com/docker/docker/api/types/container"
+	dockerclient "github.com/docker/docker/client"
+)
+
+// podmanAPIVersion is the Docker API version requested from podman's
+// Docker-compatible API, which does not implement versions as old as
+// the one we use with Docker.
+const podmanAPIVersion = "1.40"
+
+// defaultPodmanSocket returns the path of the socket where "podman
+// system service" listens by default: the per-user socket if
+// crunch-run is not running as root (i.e., rootless podman),
+// otherwise the system-wide socket.
+func defaultPodmanSocket() string {
+	if os.Getuid() == 0 {
+		return "/run/podman/podman.sock"
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return dir + "/podman/podman.sock"
+}
+
+// newEngineClient returns a Docker API client for the given runtime
+// engine ("docker" or "podman"). For podman, socket is the path of
+// the podman API socket; if empty, defaultPodmanSocket() is used.
+func newEngineClient(engine, socket string) (*dockerclient.Client, error) {
+	switch engine {
+	case "docker":
+		// API version 1.21 corresponds to Docker 1.9, which is
+		// currently the minimum version we want to support.
+		return dockerclient.NewClient(dockerclient.DefaultDockerHost, "1.21", nil, nil)
+	case "podman":
+		if socket == "" {
+			socket = defaultPodmanSocket()
+		}
+		return dockerclient.NewClient("unix://"+socket, podmanAPIVersion, nil, nil)
+	default:
+		return nil, fmt.Errorf("unsupported runtime engine %q (must be docker or podman)", engine)
+	}
+}
+
+// podmanExecutor is a containerExecutor that runs containers with
+// podman, using the Docker-compatible API served by "podman system
+// service". Everything is passed through to the Docker API
+// unchanged, except for the container settings that podman does not
+// support.
+type podmanExecutor struct {
+	*dockerExecutor
+
+	// If true, podman runs as an unprivileged user, and can only
+	// create containers in the cgroup delegated to that user.
+	rootless bool
+}
+
+func newPodmanExecutor(client ThinDockerClient, rootless bool) *podmanExecutor {
+	return &podmanExecutor{dockerExecutor: newDockerExecutor(client), rootless: rootless}
+}
+
+func (e *podmanExecutor) Create(ctx context.Context, name string, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig) (string, error) {
+	hc := *hostConfig
+	// Kernel memory limits are deprecated, and podman rejects
+	// them on cgroup v2 hosts.
+	hc.KernelMemory = 0
+	if e.rootless {
+		hc.CgroupParent = ""
+	}
+	return e.dockerExecutor.Create(ctx, name, config, &hc)
+}
@@ -0,0 +1,86 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	dockercontainer "github.com/docker/docker/api/types/container"
+	dockernetwork "github.com/docker/docker/api/types/network"
+	. "gopkg.in/check.v1"
+)
+
+// hostConfigRecorder records the HostConfig passed to
+// ContainerCreate before passing the call through to the
+// TestDockerClient.
+type hostConfigRecorder struct {
+	*TestDockerClient
+	hostConfig dockercontainer.HostConfig
+}
+
+func (r *hostConfigRecorder) ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig, networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error) {
+	r.hostConfig = *hostConfig
+	return r.TestDockerClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, containerName)
+}
+
+func (s *TestSuite) TestDefaultPodmanSocket(c *C) {
+	if os.Getuid() == 0 {
+		c.Check(defaultPodmanSocket(), Equals, "/run/podman/podman.sock")
+		return
+	}
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1234")
+	c.Check(defaultPodmanSocket(), Equals, "/run/user/1234/podman/podman.sock")
+}
+
+func (s *TestSuite) TestNewEngineClient(c *C) {
+	client, err := newEngineClient("podman", "/tmp/podman-test.sock")
+	c.Assert(err, IsNil)
+	c.Check(client.DaemonHost(), Equals, "unix:///tmp/podman-test.sock")
+	c.Check(client.ClientVersion(), Equals, podmanAPIVersion)
+
+	client, err = newEngineClient("docker", "/tmp/podman-test.sock")
+	c.Assert(err, IsNil)
+	c.Check(client.ClientVersion(), Equals, "1.21")
+
+	_, err = newEngineClient("lxc", "")
+	c.Check(err, ErrorMatches, `unsupported runtime engine "lxc".*`)
+}
+
+func (s *TestSuite) TestPodmanRun(c *C) {
+	s.docker.fn = func(t *TestDockerClient) {
+		t.logWriter.Write(dockerLog(1, "Hello world\n"))
+		t.logWriter.Close()
+	}
+	rec := &hostConfigRecorder{TestDockerClient: s.docker}
+	cr, err := NewContainerRunner(s.client, &ArvTestClient{}, &KeepTestClient{}, rec, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(err, IsNil)
+	cr.executor = newPodmanExecutor(rec, true)
+	cr.ContainerArvClient = &ArvTestClient{}
+	cr.ContainerKeepClient = &KeepTestClient{}
+	cr.setCgroupParent = "/slurm/uid_1000/job_1"
+	var logs TestLogs
+	cr.NewLogWriter = logs.NewTestLoggingWriter
+	cr.Container.ContainerImage = hwPDH
+	cr.Container.Command = []string{"./hw"}
+	cr.Container.RuntimeConstraints.RAM = 1 << 30
+
+	c.Assert(cr.LoadImage(), IsNil)
+	c.Check(s.docker.imageLoaded, Equals, hwImageID)
+	c.Assert(cr.CreateContainer(), IsNil)
+	c.Assert(cr.StartContainer(), IsNil)
+	c.Assert(cr.WaitFinish(), IsNil)
+	c.Check(strings.HasSuffix(logs.Stdout.String(), "Hello world\n"), Equals, true)
+
+	// Rootless podman can't use the cgroup parent, and kernel
+	// memory limits are never passed to podman.
+	c.Check(rec.hostConfig.CgroupParent, Equals, "")
+	c.Check(rec.hostConfig.KernelMemory, Equals, int64(0))
+	c.Check(rec.hostConfig.Memory, Equals, int64(1<<30))
+	// The runner's own HostConfig is not modified.
+	c.Check(cr.HostConfig.CgroupParent, Equals, "/slurm/uid_1000/job_1")
+}
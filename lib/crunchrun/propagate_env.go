@@ -0,0 +1,42 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"strings"
+)
+
+// propagatedEnv returns the variables in environ (a list of
+// "NAME=value" strings, like os.Environ()) whose names match one of
+// the given patterns (see -propagate-env). A pattern ending in "*"
+// matches all names with that prefix; otherwise the name must match
+// exactly.
+//
+// Variables named in override (the container's own environment) are
+// omitted, so they take precedence. ARVADOS_* variables are always
+// omitted: crunch-run's environment includes the dispatcher's token,
+// and crunch-run sets the ones containers need itself.
+func propagatedEnv(patterns []string, environ []string, override map[string]string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	var env []string
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, "ARVADOS_") {
+			continue
+		}
+		if _, ok := override[name]; ok {
+			continue
+		}
+		for _, pattern := range patterns {
+			if pattern == name || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, pattern[:len(pattern)-1])) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
@@ -0,0 +1,42 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&propagateEnvSuite{})
+
+type propagateEnvSuite struct{}
+
+func (s *propagateEnvSuite) TestPropagatedEnv(c *C) {
+	environ := []string{
+		"HTTPS_PROXY=http://proxy.example:3128",
+		"HTTPS_PROXY_EXTRA=x",
+		"SLURM_JOB_ID=1234",
+		"SLURM_JOB_NAME=zzzzz-dz642-202301130848001",
+		"SLURM_NODEID=0",
+		"ARVADOS_API_TOKEN=secret",
+		"NO_PROXY=",
+		"PATH=/usr/bin",
+	}
+	c.Check(propagatedEnv(nil, environ, nil), HasLen, 0)
+	c.Check(propagatedEnv([]string{"HTTPS_PROXY", "NO_PROXY", "SLURM_JOB_*", "ARVADOS_*", "HOME"}, environ, nil), DeepEquals, []string{
+		"HTTPS_PROXY=http://proxy.example:3128",
+		"SLURM_JOB_ID=1234",
+		"SLURM_JOB_NAME=zzzzz-dz642-202301130848001",
+		"NO_PROXY=",
+	})
+	// The container's environment takes precedence, and
+	// ARVADOS_* variables are never propagated.
+	c.Check(propagatedEnv([]string{"*"}, environ, map[string]string{"PATH": "/bin", "SLURM_NODEID": ""}), DeepEquals, []string{
+		"HTTPS_PROXY=http://proxy.example:3128",
+		"HTTPS_PROXY_EXTRA=x",
+		"SLURM_JOB_ID=1234",
+		"SLURM_JOB_NAME=zzzzz-dz642-202301130848001",
+		"NO_PROXY=",
+	})
+}
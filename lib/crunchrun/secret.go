@@ -0,0 +1,146 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// tmpfsMagic is the filesystem type reported by statfs(2) for tmpfs.
+const tmpfsMagic = 0x01021994
+
+// Secret values shorter than this are not scrubbed from logs, because
+// replacing every occurrence of a very short string would make the
+// logs unreadable without hiding much.
+const minScrubLength = 4
+
+// scrubbedText replaces secret values in logs.
+const scrubbedText = "[secret]"
+
+// secretScrubber removes the values of "secret" mounts from log
+// lines. A nil *secretScrubber leaves lines unchanged.
+type secretScrubber struct {
+	mtx    sync.Mutex
+	values [][]byte
+}
+
+// Add adds the given secret values, and each line of each value, to
+// the list of values to scrub.
+func (s *secretScrubber) Add(values []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, v := range values {
+		for _, v := range append(strings.Split(v, "\n"), v) {
+			v = strings.TrimSpace(v)
+			if len(v) >= minScrubLength {
+				s.values = append(s.values, []byte(v))
+			}
+		}
+	}
+	// Replace longer values first, so a value that contains
+	// another one is scrubbed completely.
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+// Scrub returns line with all secret values replaced.
+func (s *secretScrubber) Scrub(line []byte) []byte {
+	if s == nil {
+		return line
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, v := range s.values {
+		if bytes.Contains(line, v) {
+			line = bytes.Replace(line, v, []byte(scrubbedText), -1)
+		}
+	}
+	return line
+}
+
+// secretContent returns the data to write to the file for a "secret"
+// mount (the content itself if it is a string, otherwise its JSON
+// encoding), and the values to scrub from logs (the file data, and
+// every string inside JSON content).
+func secretContent(content interface{}) ([]byte, []string, error) {
+	if text, ok := content.(string); ok {
+		return []byte(text), []string{text}, nil
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := []string{string(data)}
+	var walk func(interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			values = append(values, v)
+		case []interface{}:
+			for _, v := range v {
+				walk(v)
+			}
+		case map[string]interface{}:
+			for _, v := range v {
+				walk(v)
+			}
+		}
+	}
+	walk(content)
+	return data, values, nil
+}
+
+// writeSecretFile writes the content of the "secret" mount at bind to
+// a file in a private directory on a memory-backed (tmpfs)
+// filesystem, so the secret is never stored on disk, and adds its
+// values to runner.scrubber. It returns the path of the file.
+func (runner *ContainerRunner) writeSecretFile(bind string, mnt arvados.Mount) (string, error) {
+	data, values, err := secretContent(mnt.Content)
+	if err != nil {
+		return "", fmt.Errorf("encoding content for secret mount %q: %v", bind, err)
+	}
+	if runner.secretDir == "" {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(runner.secretTmpfs, &fs); err != nil {
+			return "", fmt.Errorf("cannot use %s for secret mounts: %v", runner.secretTmpfs, err)
+		} else if fs.Type != tmpfsMagic {
+			return "", fmt.Errorf("cannot use %s for secret mounts: not a tmpfs filesystem", runner.secretTmpfs)
+		}
+		// ioutil.TempDir creates the directory with mode
+		// 0700, so other users on the host can't read the
+		// secrets.
+		runner.secretDir, err = ioutil.TempDir(runner.secretTmpfs, "crunch-run-secrets-")
+		if err != nil {
+			return "", fmt.Errorf("creating secret mount directory: %v", err)
+		}
+	}
+	runner.scrubber.Add(values)
+	f, err := ioutil.TempFile(runner.secretDir, "secret")
+	if err != nil {
+		return "", fmt.Errorf("creating secret mount file: %v", err)
+	}
+	defer f.Close()
+	// The container might not run as the same user as
+	// crunch-run, so the file itself must be world-readable.
+	if err = f.Chmod(0444); err != nil {
+		return "", fmt.Errorf("writing secret mount file: %v", err)
+	}
+	if _, err = f.Write(data); err != nil {
+		return "", fmt.Errorf("writing secret mount file: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		return "", fmt.Errorf("writing secret mount file: %v", err)
+	}
+	return filepath.Clean(f.Name()), nil
+}
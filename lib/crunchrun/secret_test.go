@@ -0,0 +1,50 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"sort"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&secretSuite{})
+
+type secretSuite struct{}
+
+func (s *secretSuite) TestScrub(c *C) {
+	var nilScrubber *secretScrubber
+	c.Check(string(nilScrubber.Scrub([]byte("mypassword"))), Equals, "mypassword")
+
+	scrubber := &secretScrubber{}
+	scrubber.Add([]string{"abc", "password", "mypassword", "-----BEGIN KEY-----\nAAAABBBB\n  CCCCDDDD  \n-----END KEY-----\n"})
+	for in, out := range map[string]string{
+		"":                             "",
+		"nothing to see here":          "nothing to see here",
+		"abc is too short to scrub":    "abc is too short to scrub",
+		"mypassword, password":         "[secret], [secret]",
+		"key line CCCCDDDD in stderr":  "key line [secret] in stderr",
+		"-----BEGIN KEY-----AAAABBBB":  "[secret][secret]",
+		"passwordpassword mypasswordx": "[secret][secret] [secret]x",
+	} {
+		c.Check(string(scrubber.Scrub([]byte(in))), Equals, out)
+	}
+}
+
+func (s *secretSuite) TestSecretContent(c *C) {
+	data, values, err := secretContent("mypassword\n")
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "mypassword\n")
+	c.Check(values, DeepEquals, []string{"mypassword\n"})
+
+	var content interface{}
+	c.Assert(json.Unmarshal([]byte(`{"user": "me", "tokens": ["tok1", "tok2"], "port": 1234}`), &content), IsNil)
+	data, values, err = secretContent(content)
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, `{"port":1234,"tokens":["tok1","tok2"],"user":"me"}`)
+	sort.Strings(values)
+	c.Check(values, DeepEquals, []string{"me", "tok1", "tok2", `{"port":1234,"tokens":["tok1","tok2"],"user":"me"}`})
+}
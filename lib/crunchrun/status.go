@@ -0,0 +1,206 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+)
+
+// runtimeStatus tracks a container's progress so it can be reported
+// to the dispatcher on the status socket (see serveStatus) without
+// parsing logs.
+type runtimeStatus struct {
+	mtx             sync.Mutex
+	phase           string
+	phaseSince      time.Time
+	bytesDownloaded int64
+	bytesUploaded   int64
+	crunchstat      map[string]string
+}
+
+// statusReport is the JSON response served on the status socket.
+type statusReport struct {
+	UUID            string            `json:"uuid"`
+	PID             int               `json:"pid"`
+	Phase           string            `json:"phase"`
+	PhaseSince      time.Time         `json:"phase_since"`
+	BytesDownloaded int64             `json:"bytes_downloaded"`
+	BytesUploaded   int64             `json:"bytes_uploaded"`
+	Crunchstat      map[string]string `json:"crunchstat"`
+}
+
+func (s *runtimeStatus) setPhase(phase string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.phase = phase
+	s.phaseSince = time.Now()
+}
+
+func (s *runtimeStatus) addBytes(downloaded, uploaded int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.bytesDownloaded += int64(downloaded)
+	s.bytesUploaded += int64(uploaded)
+}
+
+func (s *runtimeStatus) report(uuid string) statusReport {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	rpt := statusReport{
+		UUID:            uuid,
+		PID:             os.Getpid(),
+		Phase:           s.phase,
+		PhaseSince:      s.phaseSince,
+		BytesDownloaded: s.bytesDownloaded,
+		BytesUploaded:   s.bytesUploaded,
+		Crunchstat:      map[string]string{},
+	}
+	for k, v := range s.crunchstat {
+		rpt.Crunchstat[k] = v
+	}
+	return rpt
+}
+
+// Write implements io.Writer. Each call is expected to be one line
+// logged by a crunchstat.Reporter, like "mem 1234 cache 0 swap ...".
+// The most recent line for each statistic (the first word of the
+// line) is saved for the status report.
+func (s *runtimeStatus) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	i := strings.IndexByte(line, ' ')
+	if i < 1 {
+		return len(p), nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.crunchstat == nil {
+		s.crunchstat = map[string]string{}
+	}
+	s.crunchstat[line[:i]] = line[i+1:]
+	return len(p), nil
+}
+
+// statusKeepClient wraps an IKeepClient, counting the bytes
+// transferred to and from Keep in a runtimeStatus.
+type statusKeepClient struct {
+	IKeepClient
+	status *runtimeStatus
+}
+
+func (kc *statusKeepClient) PutB(buf []byte) (string, int, error) {
+	locator, replicas, err := kc.IKeepClient.PutB(buf)
+	if err == nil {
+		kc.status.addBytes(0, len(buf))
+	}
+	return locator, replicas, err
+}
+
+func (kc *statusKeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
+	n, err := kc.IKeepClient.ReadAt(locator, p, off)
+	kc.status.addBytes(n, 0)
+	return n, err
+}
+
+func (kc *statusKeepClient) ManifestFileReader(m manifest.Manifest, filename string) (arvados.File, error) {
+	f, err := kc.IKeepClient.ManifestFileReader(m, filename)
+	if err != nil || f == nil {
+		return f, err
+	}
+	return &statusFile{File: f, status: kc.status}, nil
+}
+
+type statusFile struct {
+	arvados.File
+	status *runtimeStatus
+}
+
+func (f *statusFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.status.addBytes(n, 0)
+	return n, err
+}
+
+// statusSocketPath returns the path of the status socket for the
+// given container in dir.
+func statusSocketPath(dir, uuid string) string {
+	return filepath.Join(dir, uuid+".sock")
+}
+
+// serveStatus starts serving status reports for the container on a
+// unix socket in dir. Any GET request on the socket returns a
+// statusReport.
+//
+// The returned func stops the server and removes the socket.
+func (runner *ContainerRunner) serveStatus(dir string) (func(), error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	uuid := runner.Container.UUID
+	path := statusSocketPath(dir, uuid)
+	// A socket left behind by a previous crunch-run process for
+	// the same container would make Listen fail.
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(runner.status.report(uuid))
+		}),
+	}
+	go srv.Serve(ln)
+	return func() {
+		srv.Close()
+		os.Remove(path)
+	}, nil
+}
+
+// PrintStatus writes the status report of the crunch-run process
+// for the given container (see serveStatus) to stdout, as JSON.
+func PrintStatus(dir, uuid string, stdout, stderr io.Writer) int {
+	return exitcode(stderr, printStatus(dir, uuid, stdout))
+}
+
+func printStatus(dir, uuid string, stdout io.Writer) error {
+	path := statusSocketPath(dir, uuid)
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://crunch-run/")
+	if err != nil {
+		return fmt.Errorf("%s: %s", uuid, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", uuid, resp.Status)
+	}
+	_, err = io.Copy(stdout, resp.Body)
+	return err
+}
@@ -0,0 +1,75 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&StatusSuite{})
+
+type StatusSuite struct{}
+
+func (s *StatusSuite) TestCrunchstat(c *C) {
+	var st runtimeStatus
+	logger := log.New(&st, "", 0)
+	logger.Print("mem 1000 cache 0 swap 0 pgmajfault 1000 rss")
+	logger.Print("cpu 1.0000 user 0.5000 sys 2 cpus")
+	logger.Print("mem 2000 cache 0 swap 0 pgmajfault 2000 rss")
+	logger.Print("bogus")
+	c.Check(st.report("zzzzz-dz642-202301251234567").Crunchstat, DeepEquals, map[string]string{
+		"mem": "2000 cache 0 swap 0 pgmajfault 2000 rss",
+		"cpu": "1.0000 user 0.5000 sys 2 cpus",
+	})
+}
+
+func (s *StatusSuite) TestKeepCounters(c *C) {
+	var st runtimeStatus
+	kc := &statusKeepClient{IKeepClient: &KeepTestClient{}, status: &st}
+	_, _, err := kc.PutB([]byte("foobar"))
+	c.Check(err, IsNil)
+	f, err := kc.ManifestFileReader(manifest.Manifest{}, "/file1_in_main.txt")
+	c.Assert(err, IsNil)
+	buf, err := ioutil.ReadAll(f)
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "foo")
+	rpt := st.report("zzzzz-dz642-202301251234567")
+	c.Check(rpt.BytesUploaded, Equals, int64(6))
+	c.Check(rpt.BytesDownloaded, Equals, int64(3))
+}
+
+func (s *StatusSuite) TestServeStatus(c *C) {
+	dir := c.MkDir()
+	cr := &ContainerRunner{}
+	cr.Container.UUID = "zzzzz-dz642-202301251234567"
+	cr.status.setPhase("loading image")
+	cr.status.addBytes(1234, 0)
+	stop, err := cr.serveStatus(dir)
+	c.Assert(err, IsNil)
+
+	var stdout, stderr bytes.Buffer
+	c.Check(PrintStatus(dir, cr.Container.UUID, &stdout, &stderr), Equals, 0)
+	var rpt statusReport
+	c.Assert(json.Unmarshal(stdout.Bytes(), &rpt), IsNil)
+	c.Check(rpt.UUID, Equals, cr.Container.UUID)
+	c.Check(rpt.PID, Equals, os.Getpid())
+	c.Check(rpt.Phase, Equals, "loading image")
+	c.Check(rpt.PhaseSince.IsZero(), Equals, false)
+	c.Check(rpt.BytesDownloaded, Equals, int64(1234))
+
+	stop()
+	_, err = os.Stat(statusSocketPath(dir, cr.Container.UUID))
+	c.Check(os.IsNotExist(err), Equals, true)
+	stdout.Reset()
+	c.Check(PrintStatus(dir, cr.Container.UUID, &stdout, &stderr), Equals, 1)
+	c.Check(stderr.String(), Matches, `zzzzz-dz642-202301251234567: .*no such file or directory\n`)
+}
@@ -0,0 +1,206 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// updateQueueReplayMaxAge is the age after which a queued update
+// left behind by an earlier crunch-run process is discarded instead
+// of being replayed.
+var updateQueueReplayMaxAge = 24 * time.Hour
+
+// queuedUpdate is a container update saved in the update queue
+// directory.
+type queuedUpdate struct {
+	UUID     string             `json:"uuid"`
+	Attrs    arvadosclient.Dict `json:"attrs"`
+	QueuedAt time.Time          `json:"queued_at"`
+}
+
+// updateQueue sends container state updates to the API server,
+// retrying with exponential backoff until they are accepted. While
+// an update is outstanding, it is saved in dir (if not empty) so it
+// can be replayed by a later crunch-run process if this one dies.
+//
+// If an update has not been accepted after maxAge, onExpire is
+// called and the update is left in dir for replay. If maxAge is
+// zero, each update is attempted only once.
+type updateQueue struct {
+	arv        IArvadosClient
+	dir        string
+	maxAge     time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	logf       func(string, ...interface{})
+	onExpire   func()
+}
+
+// Update sends the given container attributes to the API server.
+func (q *updateQueue) Update(uuid string, attrs arvadosclient.Dict) error {
+	upd := queuedUpdate{UUID: uuid, Attrs: attrs, QueuedAt: time.Now()}
+	f, fnm, err := q.save(upd)
+	if err != nil {
+		q.logf("error saving container update in queue directory (will retry without saving): %s", err)
+	}
+	keep := false
+	defer func() {
+		if f == nil {
+			return
+		}
+		if !keep {
+			os.Remove(fnm)
+		}
+		f.Close()
+	}()
+
+	backoff := q.minBackoff
+	for {
+		err = q.arv.Update("containers", uuid, arvadosclient.Dict{"container": attrs}, nil)
+		if err == nil || !isTemporaryUpdateError(err) {
+			return err
+		}
+		if time.Since(upd.QueuedAt)+backoff > q.maxAge {
+			if q.maxAge > 0 {
+				q.logf("giving up on container update after %v: %s", time.Since(upd.QueuedAt).Round(time.Second), err)
+				keep = true
+				if q.onExpire != nil {
+					q.onExpire()
+				}
+			}
+			return err
+		}
+		q.logf("error updating container (will retry in %v): %s", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > q.maxBackoff {
+			backoff = q.maxBackoff
+		}
+	}
+}
+
+// save writes upd to a new file in q.dir and returns the file, with
+// an exclusive lock held so Replay (in another process) skips it,
+// and its name.
+//
+// The file is created with a name that Replay ignores, and only
+// renamed into place after it is locked and written, so Replay can't
+// lock or remove it in between.
+func (q *updateQueue) save(upd queuedUpdate) (*os.File, string, error) {
+	if q.dir == "" {
+		return nil, "", nil
+	}
+	buf, err := json.Marshal(upd)
+	if err != nil {
+		return nil, "", err
+	}
+	err = os.MkdirAll(q.dir, 0700)
+	if err != nil {
+		return nil, "", err
+	}
+	fnm := filepath.Join(q.dir, fmt.Sprintf("%s-%020d.json", upd.UUID, upd.QueuedAt.UnixNano()))
+	tmpfnm := fnm + ".tmp"
+	f, err := os.OpenFile(tmpfnm, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		_, err = f.Write(buf)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpfnm, fnm)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpfnm)
+		return nil, "", err
+	}
+	return f, fnm, nil
+}
+
+// Replay makes one attempt to send each update left in q.dir by
+// crunch-run processes that exited before their updates were
+// accepted. Updates that are accepted, rejected as invalid, or older
+// than updateQueueReplayMaxAge are removed from the queue; others
+// are left for the next attempt.
+func (q *updateQueue) Replay() {
+	if q.dir == "" {
+		return
+	}
+	ents, err := ioutil.ReadDir(q.dir)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		q.logf("error reading update queue directory: %s", err)
+		return
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), ".json") {
+			continue
+		}
+		q.replayFile(filepath.Join(q.dir, ent.Name()))
+	}
+}
+
+func (q *updateQueue) replayFile(fnm string) {
+	f, err := os.Open(fnm)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+		// Still being retried by a live process.
+		return
+	}
+	var upd queuedUpdate
+	err = json.NewDecoder(f).Decode(&upd)
+	if err != nil {
+		q.logf("removing unreadable queued update %s: %s", fnm, err)
+		os.Remove(fnm)
+		return
+	}
+	if time.Since(upd.QueuedAt) > updateQueueReplayMaxAge {
+		q.logf("discarding queued update for container %s from %s: too old", upd.UUID, upd.QueuedAt)
+		os.Remove(fnm)
+		return
+	}
+	err = q.arv.Update("containers", upd.UUID, arvadosclient.Dict{"container": upd.Attrs}, nil)
+	if err != nil && isTemporaryUpdateError(err) {
+		q.logf("error replaying queued update for container %s (will retry later): %s", upd.UUID, err)
+		return
+	} else if err != nil {
+		q.logf("discarding queued update for container %s: %s", upd.UUID, err)
+	} else {
+		q.logf("replayed queued update for container %s from %s", upd.UUID, upd.QueuedAt)
+	}
+	os.Remove(fnm)
+}
+
+// isTemporaryUpdateError returns false if err is an API error that
+// will not go away by retrying the same request (e.g., an invalid
+// state transition).
+func isTemporaryUpdateError(err error) bool {
+	if err, ok := err.(arvadosclient.APIServerError); ok {
+		code := err.HttpStatusCode
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return true
+}
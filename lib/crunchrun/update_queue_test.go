@@ -0,0 +1,159 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&UpdateQueueSuite{})
+
+type UpdateQueueSuite struct{}
+
+// flakyUpdateClient returns the given errors from the first calls
+// to Update, then succeeds.
+type flakyUpdateClient struct {
+	ArvTestClient
+	errs []error
+}
+
+func (client *flakyUpdateClient) Update(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	client.Calls++
+	if len(client.errs) > 0 {
+		err := client.errs[0]
+		client.errs = client.errs[1:]
+		return err
+	}
+	client.Content = append(client.Content, parameters)
+	return nil
+}
+
+func (s *UpdateQueueSuite) queue(c *C, api IArvadosClient, expired *int) *updateQueue {
+	return &updateQueue{
+		arv:        api,
+		dir:        c.MkDir(),
+		maxAge:     time.Second,
+		minBackoff: time.Millisecond,
+		maxBackoff: 10 * time.Millisecond,
+		logf:       c.Logf,
+		onExpire:   func() { *expired++ },
+	}
+}
+
+func (s *UpdateQueueSuite) queuedFiles(c *C, q *updateQueue) []string {
+	fnms, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	c.Assert(err, IsNil)
+	return fnms
+}
+
+func (s *UpdateQueueSuite) TestRetryUntilAccepted(c *C) {
+	api := &flakyUpdateClient{errs: []error{
+		errors.New("connection refused"),
+		arvadosclient.APIServerError{HttpStatusCode: 502},
+		arvadosclient.APIServerError{HttpStatusCode: 503},
+	}}
+	expired := 0
+	q := s.queue(c, api, &expired)
+	err := q.Update("zzzzz-dz642-queuedcontainer", arvadosclient.Dict{"state": "Complete"})
+	c.Check(err, IsNil)
+	c.Check(api.Calls, Equals, 4)
+	c.Assert(api.Content, HasLen, 1)
+	c.Check(api.Content[0]["container"].(arvadosclient.Dict)["state"], Equals, "Complete")
+	c.Check(expired, Equals, 0)
+	c.Check(s.queuedFiles(c, q), HasLen, 0)
+}
+
+func (s *UpdateQueueSuite) TestPermanentError(c *C) {
+	api := &flakyUpdateClient{errs: []error{
+		arvadosclient.APIServerError{HttpStatusCode: 422},
+	}}
+	expired := 0
+	q := s.queue(c, api, &expired)
+	err := q.Update("zzzzz-dz642-queuedcontainer", arvadosclient.Dict{"state": "Complete"})
+	c.Check(err, NotNil)
+	c.Check(api.Calls, Equals, 1)
+	c.Check(expired, Equals, 0)
+	c.Check(s.queuedFiles(c, q), HasLen, 0)
+}
+
+func (s *UpdateQueueSuite) TestExpireAndReplay(c *C) {
+	var errs []error
+	for i := 0; i < 1000; i++ {
+		errs = append(errs, errors.New("connection refused"))
+	}
+	api := &flakyUpdateClient{errs: errs}
+	expired := 0
+	q := s.queue(c, api, &expired)
+	q.maxAge = 50 * time.Millisecond
+	err := q.Update("zzzzz-dz642-queuedcontainer", arvadosclient.Dict{"state": "Complete", "exit_code": 0})
+	c.Check(err, NotNil)
+	c.Check(api.Calls > 1, Equals, true)
+	c.Check(expired, Equals, 1)
+	c.Assert(s.queuedFiles(c, q), HasLen, 1)
+
+	// Replay fails, update stays in the queue
+	api.errs = api.errs[:1]
+	q.Replay()
+	c.Check(api.Content, HasLen, 0)
+	c.Assert(s.queuedFiles(c, q), HasLen, 1)
+
+	// Replay succeeds, update is removed from the queue
+	q.Replay()
+	c.Assert(api.Content, HasLen, 1)
+	c.Check(api.Content[0]["container"].(arvadosclient.Dict)["state"], Equals, "Complete")
+	c.Check(s.queuedFiles(c, q), HasLen, 0)
+}
+
+func (s *UpdateQueueSuite) TestReplaySkipsLockedAndOld(c *C) {
+	api := &flakyUpdateClient{}
+	expired := 0
+	q := s.queue(c, api, &expired)
+
+	// An update that is still being retried by another process
+	f, fnm, err := q.save(queuedUpdate{UUID: "zzzzz-dz642-queuedcontainer", QueuedAt: time.Now()})
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	// An update left behind long ago
+	old, _, err := q.save(queuedUpdate{UUID: "zzzzz-dz642-oldcontainer00", QueuedAt: time.Now().Add(-2 * updateQueueReplayMaxAge)})
+	c.Assert(err, IsNil)
+	old.Close()
+
+	// Garbage
+	err = ioutil.WriteFile(filepath.Join(q.dir, "garbage.json"), []byte("{"), 0600)
+	c.Assert(err, IsNil)
+
+	// An update that is still being saved by another process
+	tmpfnm := filepath.Join(q.dir, "zzzzz-dz642-savingcontainer-00000000000000000000.json.tmp")
+	err = ioutil.WriteFile(tmpfnm, nil, 0600)
+	c.Assert(err, IsNil)
+
+	q.Replay()
+	c.Check(api.Calls, Equals, 0)
+	c.Check(s.queuedFiles(c, q), DeepEquals, []string{fnm})
+	_, err = os.Stat(fnm)
+	c.Check(err, IsNil)
+	_, err = os.Stat(tmpfnm)
+	c.Check(err, IsNil)
+}
+
+func (s *UpdateQueueSuite) TestNoRetry(c *C) {
+	api := &flakyUpdateClient{errs: []error{errors.New("connection refused")}}
+	expired := 0
+	q := s.queue(c, api, &expired)
+	q.maxAge = 0
+	err := q.Update("zzzzz-dz642-queuedcontainer", arvadosclient.Dict{"state": "Running"})
+	c.Check(err, NotNil)
+	c.Check(api.Calls, Equals, 1)
+	c.Check(expired, Equals, 0)
+	c.Check(s.queuedFiles(c, q), HasLen, 0)
+}
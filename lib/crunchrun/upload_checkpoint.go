@@ -0,0 +1,330 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// uploadCheckpointTTL is how long a checkpoint collection is kept
+// after it was last saved. Its trash_at is set this far in the
+// future, so checkpoints left behind by containers that are not
+// retried are cleaned up automatically.
+var uploadCheckpointTTL = 14 * 24 * time.Hour
+
+// A block recorded in a checkpoint is only reused if its signature is
+// valid for at least this long, so the output collection can be
+// saved before it expires.
+var uploadCheckpointMinTTL = time.Hour
+
+var signatureExpiryRegexp = regexp.MustCompile(`\+A[0-9a-f]+@([0-9a-f]+)`)
+
+// uploadCheckpoint is an IKeepClient that records the blocks written
+// while copying a container's output in a checkpoint collection, so
+// a later container for the same container request (a retry after
+// this one is cancelled, or after the node fails during a long
+// upload) can resume the upload instead of writing the same data to
+// Keep again.
+//
+// The checkpoint is saved at most once per interval while the upload
+// is in progress, and once more when the container finishes without
+// completing. It has properties {"type": "output_checkpoint",
+// "container_request": uuid}, so it can be found by any container
+// run for the same request, regardless of the container UUID and
+// token. Its manifest is signed by the API server for the token of
+// the container that loads it, so blocks are recorded by locator
+// only.
+//
+// When a block is written, PutB returns the signed locator from the
+// checkpoint for the same data, if any, without contacting Keep.
+type uploadCheckpoint struct {
+	IKeepClient
+	arv           IArvadosClient
+	containerUUID string
+	requestUUIDs  []string
+	interval      time.Duration
+	logf          func(string, ...interface{})
+
+	mtx         sync.Mutex
+	uuid        string            // checkpoint collection saved by this process
+	older       []string          // checkpoint collections saved by earlier containers
+	blocks      map[string]string // "md5+size" => signed locator
+	saved       int               // len(blocks) at last save
+	lastSave    time.Time
+	saving      bool
+	errored     bool
+	reused      int
+	reusedBytes int64
+}
+
+// openUploadCheckpoint finds the requests for the given container,
+// loads the blocks recorded in their checkpoint collections, and
+// returns an uploadCheckpoint that writes blocks using kc.
+func openUploadCheckpoint(arv IArvadosClient, containerUUID string, interval time.Duration, kc IKeepClient, logf func(string, ...interface{})) (*uploadCheckpoint, error) {
+	ck := &uploadCheckpoint{
+		IKeepClient:   kc,
+		arv:           arv,
+		containerUUID: containerUUID,
+		interval:      interval,
+		logf:          logf,
+		blocks:        map[string]string{},
+		lastSave:      time.Now(),
+	}
+	var crs arvados.ContainerRequestList
+	err := arv.Call("GET", "container_requests", "", "", arvadosclient.Dict{
+		"filters": [][]interface{}{{"container_uuid", "=", containerUUID}},
+		"select":  []string{"uuid"},
+		"limit":   1000,
+	}, &crs)
+	if err != nil {
+		return nil, fmt.Errorf("error listing container requests: %s", err)
+	}
+	for _, cr := range crs.Items {
+		ck.requestUUIDs = append(ck.requestUUIDs, cr.UUID)
+	}
+	if len(ck.requestUUIDs) == 0 {
+		return nil, fmt.Errorf("no container requests found for %s", containerUUID)
+	}
+	for offset := 0; ; {
+		var colls arvados.CollectionList
+		err := arv.Call("GET", "collections", "", "", arvadosclient.Dict{
+			"filters": [][]interface{}{
+				{"properties.type", "=", "output_checkpoint"},
+				{"properties.container_request", "in", ck.requestUUIDs},
+			},
+			"select": []string{"uuid", "manifest_text"},
+			"order":  "uuid",
+			"offset": offset,
+			"limit":  100,
+		}, &colls)
+		if err != nil {
+			return nil, fmt.Errorf("error listing checkpoint collections: %s", err)
+		}
+		for _, coll := range colls.Items {
+			ck.older = append(ck.older, coll.UUID)
+			for _, loc := range manifestBlocks(coll.ManifestText) {
+				if !signatureValidFor(loc, uploadCheckpointMinTTL) {
+					continue
+				}
+				if parts := strings.SplitN(loc, "+", 3); len(parts) >= 2 {
+					ck.blocks[parts[0]+"+"+parts[1]] = loc
+				}
+			}
+		}
+		offset += len(colls.Items)
+		if len(colls.Items) == 0 || offset >= colls.ItemsAvailable {
+			break
+		}
+	}
+	// The blocks loaded so far are already saved, so don't save
+	// a new checkpoint unless more blocks are added.
+	ck.saved = len(ck.blocks)
+	return ck, nil
+}
+
+// manifestBlocks returns the block locators in a manifest.
+func manifestBlocks(txt string) []string {
+	var locs []string
+	for _, line := range strings.Split(txt, "\n") {
+		for i, tok := range strings.Split(line, " ") {
+			if i > 0 && len(tok) > 33 && tok[32] == '+' {
+				locs = append(locs, tok)
+			}
+		}
+	}
+	return locs
+}
+
+// signatureValidFor returns true if locator has a permission
+// signature that does not expire for at least ttl.
+func signatureValidFor(locator string, ttl time.Duration) bool {
+	m := signatureExpiryRegexp.FindStringSubmatch(locator)
+	if m == nil {
+		return false
+	}
+	exp, err := strconv.ParseInt(m[1], 16, 64)
+	if err != nil {
+		return false
+	}
+	return time.Unix(exp, 0).After(time.Now().Add(ttl))
+}
+
+// PutB returns the recorded locator for buf if there is one,
+// otherwise writes buf to Keep and records its locator.
+func (ck *uploadCheckpoint) PutB(buf []byte) (string, int, error) {
+	key := fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf))
+	ck.mtx.Lock()
+	loc, ok := ck.blocks[key]
+	if ok {
+		ck.reused++
+		ck.reusedBytes += int64(len(buf))
+	}
+	ck.mtx.Unlock()
+	if ok {
+		return loc, 0, nil
+	}
+	loc, replicas, err := ck.IKeepClient.PutB(buf)
+	if err != nil {
+		return loc, replicas, err
+	}
+	ck.mtx.Lock()
+	ck.blocks[key] = loc
+	due := !ck.saving && time.Since(ck.lastSave) >= ck.interval
+	ck.mtx.Unlock()
+	if due {
+		ck.save()
+	}
+	return loc, replicas, nil
+}
+
+// save writes all recorded blocks to the checkpoint collection, if
+// any were added since the last save. Once it has been saved, the
+// checkpoints loaded from earlier containers are trashed, because
+// their blocks are included.
+func (ck *uploadCheckpoint) save() {
+	ck.mtx.Lock()
+	if ck.saving || len(ck.blocks) == ck.saved {
+		ck.mtx.Unlock()
+		return
+	}
+	ck.saving = true
+	uuid := ck.uuid
+	nblocks := len(ck.blocks)
+	locs := make([]string, 0, nblocks)
+	var size int64
+	for key, loc := range ck.blocks {
+		locs = append(locs, loc)
+		n, _ := strconv.ParseInt(strings.SplitN(key, "+", 2)[1], 10, 64)
+		size += n
+	}
+	ck.mtx.Unlock()
+
+	sort.Strings(locs)
+	attrs := arvadosclient.Dict{
+		"manifest_text": ". " + strings.Join(locs, " ") + fmt.Sprintf(" 0:%d:blocks\n", size),
+		"trash_at":      time.Now().Add(uploadCheckpointTTL).UTC().Format(time.RFC3339),
+	}
+	var coll arvados.Collection
+	var err error
+	if uuid == "" {
+		attrs["name"] = "output upload checkpoint for " + ck.containerUUID
+		attrs["properties"] = map[string]interface{}{
+			"type":              "output_checkpoint",
+			"container_request": ck.requestUUIDs[0],
+		}
+		err = ck.arv.Create("collections", arvadosclient.Dict{
+			"ensure_unique_name": true,
+			"collection":         attrs,
+		}, &coll)
+	} else {
+		err = ck.arv.Update("collections", uuid, arvadosclient.Dict{
+			"collection": attrs,
+		}, &coll)
+	}
+
+	ck.mtx.Lock()
+	defer ck.mtx.Unlock()
+	ck.saving = false
+	ck.lastSave = time.Now()
+	if err != nil {
+		if !ck.errored {
+			// The upload itself is fine, it just won't
+			// be resumable. Report the first error only.
+			ck.errored = true
+			ck.logf("error saving output upload checkpoint: %s", err)
+		}
+		return
+	}
+	ck.uuid = coll.UUID
+	ck.saved = nblocks
+	ck.trashOlder()
+}
+
+// trashOlder trashes the checkpoints loaded from earlier containers.
+//
+// Caller must hold ck.mtx.
+func (ck *uploadCheckpoint) trashOlder() {
+	for _, uuid := range ck.older {
+		err := ck.arv.Call("DELETE", "collections", uuid, "", nil, nil)
+		if err != nil {
+			ck.logf("error trashing output upload checkpoint %s: %s", uuid, err)
+		}
+	}
+	ck.older = nil
+}
+
+// report logs the number of blocks reused from earlier checkpoints
+// since the last report, if any.
+func (ck *uploadCheckpoint) report() {
+	ck.mtx.Lock()
+	defer ck.mtx.Unlock()
+	if ck.reused > 0 {
+		ck.logf("resumed output upload: reused %d blocks (%d bytes) written by an earlier attempt", ck.reused, ck.reusedBytes)
+	}
+	ck.reused, ck.reusedBytes = 0, 0
+}
+
+// close saves the checkpoint, so another container for the same
+// request can resume the upload, or, if done is true, trashes it
+// along with the checkpoints loaded from earlier containers.
+func (ck *uploadCheckpoint) close(done bool) {
+	if !done {
+		ck.save()
+		return
+	}
+	ck.mtx.Lock()
+	defer ck.mtx.Unlock()
+	if ck.uuid != "" {
+		ck.older = append(ck.older, ck.uuid)
+		ck.uuid = ""
+	}
+	ck.trashOlder()
+}
+
+// outputKeepClient returns the IKeepClient to use for copying the
+// container's output to Keep: an uploadCheckpoint if
+// runner.uploadCheckpointInterval is set, otherwise (or if the
+// checkpoint can't be opened) ContainerKeepClient.
+//
+// Caller must hold runner.snapshotMtx.
+func (runner *ContainerRunner) outputKeepClient() IKeepClient {
+	if runner.uploadCheckpoint != nil {
+		return runner.uploadCheckpoint
+	}
+	if runner.uploadCheckpointInterval <= 0 || runner.local {
+		return runner.ContainerKeepClient
+	}
+	ck, err := openUploadCheckpoint(runner.ContainerArvClient, runner.Container.UUID, runner.uploadCheckpointInterval, runner.ContainerKeepClient, runner.CrunchLog.Printf)
+	if err != nil {
+		runner.CrunchLog.Printf("error opening output upload checkpoint (output upload will not be resumable): %s", err)
+		runner.uploadCheckpointInterval = 0
+		return runner.ContainerKeepClient
+	}
+	runner.uploadCheckpoint = ck
+	return ck
+}
+
+// closeUploadCheckpoint closes the upload checkpoint, if any. If done
+// is true, the container's final state has been saved and it won't be
+// retried, so the checkpoint is trashed. Otherwise, it is saved for
+// the next container that runs for the same request.
+func (runner *ContainerRunner) closeUploadCheckpoint(done bool) {
+	runner.snapshotMtx.Lock()
+	defer runner.snapshotMtx.Unlock()
+	if runner.uploadCheckpoint != nil {
+		runner.uploadCheckpoint.close(done)
+		runner.uploadCheckpoint = nil
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&uploadCheckpointSuite{})
+
+type uploadCheckpointSuite struct {
+	arv  *checkpointArvClient
+	logs []string
+}
+
+// signingKeepClient returns signed locators that expire at the given
+// time, and counts PutB calls.
+type signingKeepClient struct {
+	KeepTestClient
+	expire time.Time
+	puts   int
+}
+
+func (kc *signingKeepClient) PutB(buf []byte) (string, int, error) {
+	kc.puts++
+	return fmt.Sprintf("%x+%d+A0123456789abcdef0123456789abcdef01234567@%x", md5.Sum(buf), len(buf), kc.expire.Unix()), 2, nil
+}
+
+// checkpointArvClient is a fake API server that knows which
+// container request each container belongs to, and stores
+// collections.
+type checkpointArvClient struct {
+	mtx         sync.Mutex
+	requests    map[string]string // container UUID => container request UUID
+	collections map[string]arvados.Collection
+	trashed     []string
+	nextUUID    int
+}
+
+func (arv *checkpointArvClient) Create(resourceType string, parameters arvadosclient.Dict, output interface{}) error {
+	arv.mtx.Lock()
+	defer arv.mtx.Unlock()
+	attrs := parameters["collection"].(arvadosclient.Dict)
+	arv.nextUUID++
+	coll := arvados.Collection{
+		UUID:         fmt.Sprintf("zzzzz-4zz18-%015d", arv.nextUUID),
+		ManifestText: attrs["manifest_text"].(string),
+		Properties:   attrs["properties"].(map[string]interface{}),
+	}
+	arv.collections[coll.UUID] = coll
+	*output.(*arvados.Collection) = coll
+	return nil
+}
+
+func (arv *checkpointArvClient) Update(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	arv.mtx.Lock()
+	defer arv.mtx.Unlock()
+	coll, ok := arv.collections[uuid]
+	if !ok {
+		return errors.New("not found")
+	}
+	coll.ManifestText = parameters["collection"].(arvadosclient.Dict)["manifest_text"].(string)
+	arv.collections[uuid] = coll
+	*output.(*arvados.Collection) = coll
+	return nil
+}
+
+func (arv *checkpointArvClient) Call(method, resourceType, uuid, action string, parameters arvadosclient.Dict, output interface{}) error {
+	arv.mtx.Lock()
+	defer arv.mtx.Unlock()
+	switch {
+	case method == "GET" && resourceType == "container_requests":
+		ctrUUID := parameters["filters"].([][]interface{})[0][2].(string)
+		crs := output.(*arvados.ContainerRequestList)
+		if cr, ok := arv.requests[ctrUUID]; ok {
+			crs.Items = []arvados.ContainerRequest{{UUID: cr}}
+		}
+		return nil
+	case method == "GET" && resourceType == "collections":
+		crUUIDs := parameters["filters"].([][]interface{})[1][2].([]string)
+		colls := output.(*arvados.CollectionList)
+		for _, coll := range arv.collections {
+			for _, cr := range crUUIDs {
+				if coll.Properties["container_request"] == cr {
+					colls.Items = append(colls.Items, coll)
+				}
+			}
+		}
+		colls.ItemsAvailable = len(colls.Items)
+		return nil
+	case method == "DELETE" && resourceType == "collections":
+		delete(arv.collections, uuid)
+		arv.trashed = append(arv.trashed, uuid)
+		return nil
+	}
+	return errors.New("not implemented")
+}
+
+func (arv *checkpointArvClient) Get(resourceType string, uuid string, parameters arvadosclient.Dict, output interface{}) error {
+	return errors.New("not implemented")
+}
+
+func (arv *checkpointArvClient) CallRaw(method string, resourceType string, uuid string, action string, parameters arvadosclient.Dict) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (arv *checkpointArvClient) Discovery(key string) (interface{}, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *uploadCheckpointSuite) SetUpTest(c *C) {
+	s.arv = &checkpointArvClient{
+		requests: map[string]string{
+			// Two containers run for the same request
+			// (e.g., the first one was cancelled and the
+			// request was retried), and one for another
+			// request.
+			"zzzzz-dz642-000000000000001": "zzzzz-xvhdp-000000000000001",
+			"zzzzz-dz642-000000000000002": "zzzzz-xvhdp-000000000000001",
+			"zzzzz-dz642-000000000000003": "zzzzz-xvhdp-000000000000003",
+		},
+		collections: map[string]arvados.Collection{},
+	}
+	s.logs = nil
+}
+
+func (s *uploadCheckpointSuite) open(c *C, ctrUUID string, interval time.Duration, kc IKeepClient) *uploadCheckpoint {
+	ck, err := openUploadCheckpoint(s.arv, ctrUUID, interval, kc, func(f string, args ...interface{}) {
+		s.logs = append(s.logs, fmt.Sprintf(f, args...))
+	})
+	c.Assert(err, IsNil)
+	return ck
+}
+
+func (s *uploadCheckpointSuite) TestResume(c *C) {
+	kc := &signingKeepClient{expire: time.Now().Add(24 * time.Hour)}
+	ck := s.open(c, "zzzzz-dz642-000000000000001", 0, kc)
+	locA, _, err := ck.PutB([]byte("block A"))
+	c.Check(err, IsNil)
+	_, _, err = ck.PutB([]byte("block B"))
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 2)
+	ck.close(false)
+	c.Assert(s.arv.collections, HasLen, 1)
+	for _, coll := range s.arv.collections {
+		c.Check(coll.Properties["type"], Equals, "output_checkpoint")
+		c.Check(coll.ManifestText, Matches, `\. [0-9a-f]{32}\+7\+A\S+ [0-9a-f]{32}\+7\+A\S+ 0:14:blocks\n`)
+	}
+
+	// A container for another request doesn't use the
+	// checkpoint.
+	ck = s.open(c, "zzzzz-dz642-000000000000003", 0, kc)
+	c.Check(ck.blocks, HasLen, 0)
+	ck.close(true)
+
+	// A retry container for the same request reuses the blocks.
+	ck = s.open(c, "zzzzz-dz642-000000000000002", 0, kc)
+	loc, _, err := ck.PutB([]byte("block A"))
+	c.Check(err, IsNil)
+	c.Check(loc, Equals, locA)
+	c.Check(kc.puts, Equals, 2)
+	_, _, err = ck.PutB([]byte("block C"))
+	c.Check(err, IsNil)
+	c.Check(kc.puts, Equals, 3)
+	ck.report()
+	c.Check(s.logs, DeepEquals, []string{"resumed output upload: reused 1 blocks (7 bytes) written by an earlier attempt"})
+
+	// The new checkpoint (saved when block C was written,
+	// because interval is 0) replaces the old one.
+	c.Check(s.arv.trashed, HasLen, 1)
+	c.Assert(s.arv.collections, HasLen, 1)
+	for _, coll := range s.arv.collections {
+		c.Check(strings.Count(coll.ManifestText, "+A"), Equals, 3)
+	}
+
+	// When the container is done, the checkpoint is trashed.
+	ck.close(true)
+	c.Check(s.arv.collections, HasLen, 0)
+	c.Check(s.arv.trashed, HasLen, 2)
+}
+
+func (s *uploadCheckpointSuite) TestSaveInterval(c *C) {
+	kc := &signingKeepClient{expire: time.Now().Add(24 * time.Hour)}
+	ck := s.open(c, "zzzzz-dz642-000000000000001", time.Hour, kc)
+	ck.PutB([]byte("block A"))
+	c.Check(s.arv.collections, HasLen, 0)
+	ck.lastSave = time.Now().Add(-time.Hour)
+	ck.PutB([]byte("block B"))
+	c.Check(s.arv.collections, HasLen, 1)
+	ck.PutB([]byte("block C"))
+	for _, coll := range s.arv.collections {
+		c.Check(strings.Count(coll.ManifestText, "+A"), Equals, 2)
+	}
+	ck.close(false)
+	c.Check(s.arv.collections, HasLen, 1)
+	for _, coll := range s.arv.collections {
+		c.Check(strings.Count(coll.ManifestText, "+A"), Equals, 3)
+	}
+	c.Check(s.logs, HasLen, 0)
+}
+
+func (s *uploadCheckpointSuite) TestNoReuse(c *C) {
+	// Locators whose signatures are about to expire are not
+	// reused.
+	kc := &signingKeepClient{expire: time.Now().Add(uploadCheckpointMinTTL / 2)}
+	ck := s.open(c, "zzzzz-dz642-000000000000001", 0, kc)
+	ck.PutB([]byte("block A"))
+	ck.close(false)
+	ck = s.open(c, "zzzzz-dz642-000000000000002", 0, kc)
+	c.Check(ck.blocks, HasLen, 0)
+	ck.PutB([]byte("block A"))
+	c.Check(kc.puts, Equals, 2)
+	ck.close(true)
+
+	// Unsigned locators are not reused.
+	ukc := &KeepTestClient{}
+	ck = s.open(c, "zzzzz-dz642-000000000000001", 0, ukc)
+	ck.PutB([]byte("block A"))
+	ck.close(false)
+	ck = s.open(c, "zzzzz-dz642-000000000000002", 0, ukc)
+	c.Check(ck.blocks, HasLen, 0)
+	ck.close(true)
+	c.Check(s.logs, HasLen, 0)
+}
+
+func (s *uploadCheckpointSuite) TestNoContainerRequest(c *C) {
+	_, err := openUploadCheckpoint(s.arv, "zzzzz-dz642-000000000000009", 0, &KeepTestClient{}, nil)
+	c.Check(err, ErrorMatches, `no container requests found for .*`)
+}
@@ -3,18 +3,27 @@
 // SPDX-License-Identifier: AGPL-3.0
 
 // Package crunchstat reports resource usage (CPU, memory, disk,
-// network) for a cgroup.
+// network, NFS, GPU) for a cgroup.
+//
+// Both cgroups v1 (a hierarchy per controller, e.g.,
+// /sys/fs/cgroup/memory/docker/{CID}) and cgroups v2 (a single
+// unified hierarchy, e.g., /sys/fs/cgroup/docker/{CID} or
+// /sys/fs/cgroup/system.slice/docker-{CID}.scope) are supported. The
+// statistics are reported in the same format in both cases.
 package crunchstat
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -44,7 +53,8 @@ type Reporter struct {
 	CIDFile string
 
 	// Where cgroup accounting files live on this system, e.g.,
-	// "/sys/fs/cgroup".
+	// "/sys/fs/cgroup". If it contains a cgroup.controllers file,
+	// it is a cgroups v2 (unified) hierarchy.
 	CgroupRoot string
 
 	// Parent cgroup, e.g., "docker".
@@ -59,11 +69,34 @@ type Reporter struct {
 	// Where to write statistics. Must not be nil.
 	Logger *log.Logger
 
+	// If greater than zero, also report this many processes with
+	// the largest resident set size, and this many processes that
+	// used the most CPU time since the previous sample, on each
+	// interval. This is meant for host statistics (CID and
+	// CIDFile empty), so admins can tell which processes on a
+	// node are using its memory and CPU.
+	TopProcesses int
+
+	// If non-empty, also report utilization and memory usage of
+	// these NVIDIA GPUs, using nvidia-smi: "all", or a
+	// comma-separated list of device indexes or UUIDs, as in
+	// CUDA_VISIBLE_DEVICES.
+	GPUs string
+
+	cgroupV2            bool
 	reportedStatFile    map[string]string
 	lastNetSample       map[string]ioSample
 	lastDiskIOSample    map[string]ioSample
+	lastNFSSample       map[string]nfsSample
+	lastProcSample      map[int]procSample
+	lastProcSampleTime  time.Time
+	procRoot            string // "/proc" if empty
 	lastCPUSample       cpuSample
 	lastDiskSpaceSample diskSpaceSample
+	nvidiaSMI           string // "nvidia-smi" if empty
+	gpuStatsFailed      bool   // nvidia-smi is not installed
+	gpuStatsSkip        int    // samples to skip before retrying nvidia-smi
+	gpuStatsBackoff     int    // samples to skip after the next nvidia-smi error
 
 	done    chan struct{} // closed when we should stop reporting
 	flushed chan struct{} // closed when we have made our last report
@@ -119,12 +152,27 @@ func (r *Reporter) readAllOrWarn(in io.Reader) ([]byte, error) {
 // to host-level stats during container setup and teardown.)
 func (r *Reporter) openStatFile(statgroup, stat string, verbose bool) (io.ReadCloser, error) {
 	var paths []string
-	if r.CID != "" {
+	if r.CID != "" && r.cgroupV2 {
+		// Collect container's stats. The cgroup is named
+		// {CID} with docker's cgroupfs driver, or
+		// docker-{CID}.scope (libpod-{CID}.scope for podman)
+		// with the systemd driver.
+		paths = []string{
+			fmt.Sprintf("%s/%s/%s/%s", r.CgroupRoot, r.CgroupParent, r.CID, stat),
+			fmt.Sprintf("%s/%s/docker-%s.scope/%s", r.CgroupRoot, r.CgroupParent, r.CID, stat),
+			fmt.Sprintf("%s/%s/libpod-%s.scope/%s", r.CgroupRoot, r.CgroupParent, r.CID, stat),
+		}
+	} else if r.CID != "" {
 		// Collect container's stats
 		paths = []string{
 			fmt.Sprintf("%s/%s/%s/%s/%s", r.CgroupRoot, statgroup, r.CgroupParent, r.CID, stat),
 			fmt.Sprintf("%s/%s/%s/%s", r.CgroupRoot, r.CgroupParent, r.CID, stat),
 		}
+	} else if r.cgroupV2 {
+		// Collect this host's stats
+		paths = []string{
+			fmt.Sprintf("%s/%s", r.CgroupRoot, stat),
+		}
 	} else {
 		// Collect this host's stats
 		paths = []string{
@@ -163,6 +211,15 @@ func (r *Reporter) openStatFile(statgroup, stat string, verbose bool) (io.ReadCl
 }
 
 func (r *Reporter) getContainerNetStats() (io.Reader, error) {
+	return r.readContainerProcFile("net/dev")
+}
+
+// readContainerProcFile returns the content of /proc/{pid}/{name} for
+// the first process in the container (or, if CID is empty, the root
+// cgroup) where it can be read. Files like net/dev and mountstats
+// reflect that process's network and mount namespaces, i.e., the
+// container's.
+func (r *Reporter) readContainerProcFile(name string) (io.Reader, error) {
 	procsFile, err := r.openStatFile("cpuacct", "cgroup.procs", true)
 	if err != nil {
 		return nil, err
@@ -171,7 +228,7 @@ func (r *Reporter) getContainerNetStats() (io.Reader, error) {
 	reader := bufio.NewScanner(procsFile)
 	for reader.Scan() {
 		taskPid := reader.Text()
-		statsFilename := fmt.Sprintf("/proc/%s/net/dev", taskPid)
+		statsFilename := fmt.Sprintf("/proc/%s/%s", taskPid, name)
 		stats, err := ioutil.ReadFile(statsFilename)
 		if err != nil {
 			r.Logger.Printf("notice: %v", err)
@@ -189,6 +246,10 @@ type ioSample struct {
 }
 
 func (r *Reporter) doBlkIOStats() {
+	if r.cgroupV2 {
+		r.doIOStatsV2()
+		return
+	}
 	c, err := r.openStatFile("blkio", "blkio.io_service_bytes", true)
 	if err != nil {
 		return
@@ -216,6 +277,40 @@ func (r *Reporter) doBlkIOStats() {
 		}
 		newSamples[device] = thisSample
 	}
+	r.reportBlkIOSamples(newSamples)
+}
+
+// doIOStatsV2 reads io.stat (cgroups v2), which has a line per device
+// like "8:0 rbytes=1234 wbytes=5678 rios=1 wios=2 dbytes=0 dios=0".
+func (r *Reporter) doIOStatsV2() {
+	c, err := r.openStatFile("io", "io.stat", true)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	b := bufio.NewScanner(c)
+	var sampleTime = time.Now()
+	newSamples := make(map[string]ioSample)
+	for b.Scan() {
+		fields := strings.Fields(b.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		thisSample := ioSample{sampleTime, -1, -1}
+		for _, kv := range fields[1:] {
+			var val int64
+			if n, _ := fmt.Sscanf(kv, "rbytes=%d", &val); n == 1 {
+				thisSample.rxBytes = val
+			} else if n, _ := fmt.Sscanf(kv, "wbytes=%d", &val); n == 1 {
+				thisSample.txBytes = val
+			}
+		}
+		newSamples[fields[0]] = thisSample
+	}
+	r.reportBlkIOSamples(newSamples)
+}
+
+func (r *Reporter) reportBlkIOSamples(newSamples map[string]ioSample) {
 	for dev, sample := range newSamples {
 		if sample.txBytes < 0 || sample.rxBytes < 0 {
 			continue
@@ -254,6 +349,18 @@ func (r *Reporter) doMemoryStats() {
 		}
 		thisSample.memStat[stat] = val
 	}
+	if r.cgroupV2 {
+		// Report the cgroups v2 equivalents of the v1 stats.
+		if val, ok := thisSample.memStat["file"]; ok {
+			thisSample.memStat["cache"] = val
+		}
+		if val, ok := thisSample.memStat["anon"]; ok {
+			thisSample.memStat["rss"] = val
+		}
+		if val, err := r.readInt("memory", "memory.swap.current"); err == nil {
+			thisSample.memStat["swap"] = val
+		}
+	}
 	var outstat bytes.Buffer
 	for _, key := range wantStats {
 		// Use "total_X" stats (entire hierarchy) if enabled,
@@ -312,6 +419,282 @@ func (r *Reporter) doNetworkStats() {
 	}
 }
 
+type nfsSample struct {
+	sampleTime time.Time
+	readBytes  int64
+	writeBytes int64
+	ops        int64
+}
+
+// parseMountStats returns a sample for each NFS mount listed in r,
+// which has the format of /proc/{pid}/mountstats, keyed by mount
+// point.
+//
+// Byte counts are the "serverreadbytes" and "serverwritebytes" fields
+// of the "bytes:" line, i.e., data actually transferred to and from
+// the server (not satisfied by the client's cache). The operation
+// count is the total of all "per-op statistics" lines. NFS counters
+// are kept per mount, so they include I/O by other processes on the
+// host that use the same mount.
+func parseMountStats(rdr io.Reader, sampleTime time.Time) map[string]nfsSample {
+	samples := map[string]nfsSample{}
+	var mountpoint string
+	var sample nfsSample
+	perOp := false
+	flush := func() {
+		if mountpoint != "" {
+			samples[mountpoint] = sample
+		}
+		mountpoint, perOp = "", false
+	}
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "device" {
+			flush()
+			// "device {dev} mounted on {mountpoint} with fstype {type} ..."
+			if len(fields) >= 8 && fields[2] == "mounted" && fields[3] == "on" && fields[5] == "with" && fields[6] == "fstype" && strings.HasPrefix(fields[7], "nfs") {
+				mountpoint = fields[4]
+				sample = nfsSample{sampleTime: sampleTime}
+			}
+			continue
+		}
+		if mountpoint == "" {
+			continue
+		}
+		switch {
+		case fields[0] == "bytes:" && len(fields) >= 7:
+			sample.readBytes, _ = strconv.ParseInt(fields[5], 10, 64)
+			sample.writeBytes, _ = strconv.ParseInt(fields[6], 10, 64)
+		case fields[0] == "per-op":
+			perOp = true
+		case perOp && strings.HasSuffix(fields[0], ":") && len(fields) >= 2:
+			ops, _ := strconv.ParseInt(fields[1], 10, 64)
+			sample.ops += ops
+		}
+	}
+	flush()
+	return samples
+}
+
+func (r *Reporter) doNFSStats() {
+	stats, err := r.readContainerProcFile("mountstats")
+	if err != nil {
+		return
+	}
+	samples := parseMountStats(stats, time.Now())
+	var mountpoints []string
+	for mnt := range samples {
+		mountpoints = append(mountpoints, mnt)
+	}
+	sort.Strings(mountpoints)
+	for _, mnt := range mountpoints {
+		sample := samples[mnt]
+		var delta string
+		if prev, ok := r.lastNFSSample[mnt]; ok {
+			delta = fmt.Sprintf(" -- interval %.4f seconds %d write %d read %d ops",
+				sample.sampleTime.Sub(prev.sampleTime).Seconds(),
+				sample.writeBytes-prev.writeBytes,
+				sample.readBytes-prev.readBytes,
+				sample.ops-prev.ops)
+		}
+		r.Logger.Printf("nfs:%s %d write %d read %d ops%s\n", mnt, sample.writeBytes, sample.readBytes, sample.ops, delta)
+		r.lastNFSSample[mnt] = sample
+	}
+}
+
+// parseGPUStats returns a line of statistics for each GPU listed
+// in buf, which is the output of "nvidia-smi
+// --query-gpu=index,utilization.gpu,memory.used,memory.total
+// --format=csv,noheader,nounits". Memory sizes are converted from
+// MiB to bytes. GPUs whose statistics aren't available (e.g.,
+// "[N/A]") are skipped.
+func parseGPUStats(buf []byte) []string {
+	var stats []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			continue
+		}
+		var vals [3]int64
+		var err error
+		for i := range vals {
+			vals[i], err = strconv.ParseInt(strings.TrimSpace(fields[i+1]), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		stats = append(stats, fmt.Sprintf("gpu:%s %d utilization %d used %d total",
+			strings.TrimSpace(fields[0]), vals[0], vals[1]<<20, vals[2]<<20))
+	}
+	return stats
+}
+
+// gpuStatsMaxBackoff is the maximum number of samples doGPUStats
+// skips after nvidia-smi fails repeatedly.
+const gpuStatsMaxBackoff = 64
+
+// doGPUStats reports the current utilization (percentage of the
+// last sample period, as reported by the driver) and memory usage
+// of each GPU listed in r.GPUs.
+//
+// If nvidia-smi fails or doesn't finish within half of PollPeriod,
+// it logs the error and skips some samples before trying again,
+// doubling the number of samples skipped after each consecutive
+// error (up to gpuStatsMaxBackoff). If nvidia-smi is not installed,
+// it stops trying.
+func (r *Reporter) doGPUStats() {
+	if r.GPUs == "" || r.gpuStatsFailed {
+		return
+	}
+	if r.gpuStatsSkip > 0 {
+		r.gpuStatsSkip--
+		return
+	}
+	nvidiaSMI := r.nvidiaSMI
+	if nvidiaSMI == "" {
+		nvidiaSMI = "nvidia-smi"
+	}
+	args := []string{"--query-gpu=index,utilization.gpu,memory.used,memory.total", "--format=csv,noheader,nounits"}
+	if r.GPUs != "all" {
+		args = append(args, "--id="+r.GPUs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.PollPeriod/2)
+	defer cancel()
+	buf, err := exec.CommandContext(ctx, nvidiaSMI, args...).Output()
+	if _, ok := err.(*exec.Error); ok || os.IsNotExist(err) {
+		r.Logger.Printf("notice: not reporting GPU statistics: %s\n", err)
+		r.gpuStatsFailed = true
+		return
+	} else if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if r.gpuStatsBackoff < 1 {
+			r.gpuStatsBackoff = 1
+		}
+		r.Logger.Printf("notice: error getting GPU statistics: %s: %s (skipping %d samples)\n", nvidiaSMI, err, r.gpuStatsBackoff)
+		r.gpuStatsSkip = r.gpuStatsBackoff
+		if r.gpuStatsBackoff < gpuStatsMaxBackoff {
+			r.gpuStatsBackoff *= 2
+		}
+		return
+	}
+	r.gpuStatsBackoff = 0
+	for _, line := range parseGPUStats(buf) {
+		r.Logger.Printf("%s\n", line)
+	}
+}
+
+// userHz returns the number of clock ticks per second, the unit of
+// CPU times in cpuacct.stat and /proc/{pid}/stat.
+func userHz() float64 {
+	return float64(C.sysconf(C._SC_CLK_TCK))
+}
+
+type procSample struct {
+	comm string
+	rss  int64   // bytes
+	cpu  float64 // user+system seconds since process started
+}
+
+// readProcSamples returns the current RSS and CPU time of each
+// process listed in procRoot (i.e., /proc).
+func readProcSamples(procRoot string, userHz float64, pageSize int64) map[int]procSample {
+	samples := map[int]procSample{}
+	ents, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return samples
+	}
+	for _, ent := range ents {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		// The process may exit at any time, so errors are
+		// ignored.
+		buf, err := ioutil.ReadFile(procRoot + "/" + ent.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// "{pid} ({comm}) {state} {ppid} ...": comm can
+		// contain spaces and parentheses, so find the last
+		// ")".
+		stat := string(buf)
+		lparen, rparen := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+		if lparen < 0 || rparen < lparen {
+			continue
+		}
+		fields := strings.Fields(stat[rparen+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		// fields[0] is field 3 (state) in proc(5).
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		samples[pid] = procSample{
+			comm: strings.Join(strings.Fields(stat[lparen+1:rparen]), "_"),
+			rss:  rss * pageSize,
+			cpu:  float64(utime+stime) / userHz,
+		}
+	}
+	return samples
+}
+
+// doProcessStats reports the TopProcesses processes with the largest
+// RSS, and the TopProcesses processes that used the most CPU time
+// since the previous sample (or since they started, if they didn't
+// exist then), ordered by PID.
+func (r *Reporter) doProcessStats() {
+	if r.TopProcesses < 1 {
+		return
+	}
+	procRoot := r.procRoot
+	if procRoot == "" {
+		procRoot = "/proc"
+	}
+	sampleTime := time.Now()
+	samples := readProcSamples(procRoot, userHz(), int64(os.Getpagesize()))
+	cpuDelta := make(map[int]float64, len(samples))
+	var pids []int
+	for pid, sample := range samples {
+		cpuDelta[pid] = sample.cpu - r.lastProcSample[pid].cpu
+		pids = append(pids, pid)
+	}
+	report := map[int]bool{}
+	sort.Slice(pids, func(i, j int) bool { return samples[pids[i]].rss > samples[pids[j]].rss })
+	for i := 0; i < len(pids) && i < r.TopProcesses; i++ {
+		report[pids[i]] = true
+	}
+	sort.Slice(pids, func(i, j int) bool { return cpuDelta[pids[i]] > cpuDelta[pids[j]] })
+	for i := 0; i < len(pids) && i < r.TopProcesses; i++ {
+		report[pids[i]] = true
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		if !report[pid] {
+			continue
+		}
+		sample := samples[pid]
+		var delta string
+		if _, ok := r.lastProcSample[pid]; ok {
+			delta = fmt.Sprintf(" -- interval %.4f seconds %.4f cpu",
+				sampleTime.Sub(r.lastProcSampleTime).Seconds(),
+				cpuDelta[pid])
+		}
+		r.Logger.Printf("proc:%d:%s %d rss %.4f cpu%s\n", pid, sample.comm, sample.rss, sample.cpu, delta)
+	}
+	r.lastProcSample = samples
+	r.lastProcSampleTime = sampleTime
+}
+
 type diskSpaceSample struct {
 	hasData    bool
 	sampleTime time.Time
@@ -359,6 +742,9 @@ type cpuSample struct {
 // Return the number of CPUs available in the container. Return 0 if
 // we can't figure out the real number of CPUs.
 func (r *Reporter) getCPUCount() int64 {
+	if r.cgroupV2 {
+		return r.getCPUCountV2()
+	}
 	cpusetFile, err := r.openStatFile("cpuset", "cpuset.cpus", true)
 	if err != nil {
 		return 0
@@ -368,7 +754,42 @@ func (r *Reporter) getCPUCount() int64 {
 	if err != nil {
 		return 0
 	}
-	sp := strings.Split(string(b), ",")
+	return countCPUs(string(b))
+}
+
+// getCPUCountV2 returns the number of CPUs available in a cgroups v2
+// cgroup: the number of CPUs in cpuset.cpus.effective if the cpuset
+// controller is enabled, otherwise the CPU quota in cpu.max (rounded
+// up), otherwise 0.
+func (r *Reporter) getCPUCountV2() int64 {
+	if f, err := r.openStatFile("cpuset", "cpuset.cpus.effective", false); err == nil {
+		defer f.Close()
+		b, err := r.readAllOrWarn(f)
+		if err == nil && strings.TrimSpace(string(b)) != "" {
+			return countCPUs(strings.TrimSpace(string(b)))
+		}
+	}
+	f, err := r.openStatFile("cpu", "cpu.max", false)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	b, err := r.readAllOrWarn(f)
+	if err != nil {
+		return 0
+	}
+	var quota, period int64
+	if n, _ := fmt.Sscanf(string(b), "%d %d", &quota, &period); n != 2 || quota <= 0 || period <= 0 {
+		// "max 100000" means no limit
+		return 0
+	}
+	return (quota + period - 1) / period
+}
+
+// countCPUs returns the number of CPUs in a cpuset list like
+// "0-3,8,10-11".
+func countCPUs(cpuset string) int64 {
+	sp := strings.Split(cpuset, ",")
 	cpus := int64(0)
 	for _, v := range sp {
 		var min, max int64
@@ -383,24 +804,36 @@ func (r *Reporter) getCPUCount() int64 {
 }
 
 func (r *Reporter) doCPUStats() {
-	statFile, err := r.openStatFile("cpuacct", "cpuacct.stat", true)
-	if err != nil {
-		return
-	}
-	defer statFile.Close()
-	b, err := r.readAllOrWarn(statFile)
-	if err != nil {
-		return
-	}
+	var user, sys float64
+	if r.cgroupV2 {
+		// cpu.stat has lines like "user_usec 1234".
+		stats, err := r.readKeyValues("cpu", "cpu.stat")
+		if err != nil {
+			return
+		}
+		user = float64(stats["user_usec"]) / 1e6
+		sys = float64(stats["system_usec"]) / 1e6
+	} else {
+		statFile, err := r.openStatFile("cpuacct", "cpuacct.stat", true)
+		if err != nil {
+			return
+		}
+		defer statFile.Close()
+		b, err := r.readAllOrWarn(statFile)
+		if err != nil {
+			return
+		}
 
-	var userTicks, sysTicks int64
-	fmt.Sscanf(string(b), "user %d\nsystem %d", &userTicks, &sysTicks)
-	userHz := float64(C.sysconf(C._SC_CLK_TCK))
+		var userTicks, sysTicks int64
+		fmt.Sscanf(string(b), "user %d\nsystem %d", &userTicks, &sysTicks)
+		user = float64(userTicks) / userHz()
+		sys = float64(sysTicks) / userHz()
+	}
 	nextSample := cpuSample{
 		hasData:    true,
 		sampleTime: time.Now(),
-		user:       float64(userTicks) / userHz,
-		sys:        float64(sysTicks) / userHz,
+		user:       user,
+		sys:        sys,
 		cpus:       r.getCPUCount(),
 	}
 
@@ -416,12 +849,51 @@ func (r *Reporter) doCPUStats() {
 	r.lastCPUSample = nextSample
 }
 
+// readInt returns the integer value in the given stat file, like
+// memory.swap.current.
+func (r *Reporter) readInt(statgroup, stat string) (int64, error) {
+	f, err := r.openStatFile(statgroup, stat, false)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b, err := r.readAllOrWarn(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// readKeyValues returns the values in the given stat file, which has
+// a "key value" pair on each line, like cpu.stat.
+func (r *Reporter) readKeyValues(statgroup, stat string) (map[string]int64, error) {
+	f, err := r.openStatFile(statgroup, stat, true)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := map[string]int64{}
+	b := bufio.NewScanner(f)
+	for b.Scan() {
+		var key string
+		var val int64
+		if _, err := fmt.Sscanf(b.Text(), "%s %d", &key, &val); err == nil {
+			stats[key] = val
+		}
+	}
+	return stats, b.Err()
+}
+
 // Report stats periodically until we learn (via r.done) that someone
 // called Stop.
 func (r *Reporter) run() {
 	defer close(r.flushed)
 
 	r.reportedStatFile = make(map[string]string)
+	if _, err := os.Stat(r.CgroupRoot + "/cgroup.controllers"); err == nil {
+		r.cgroupV2 = true
+		r.Logger.Printf("notice: %s is a cgroups v2 (unified) hierarchy\n", r.CgroupRoot)
+	}
 
 	if !r.waitForCIDFile() || !r.waitForCgroup() {
 		return
@@ -429,6 +901,7 @@ func (r *Reporter) run() {
 
 	r.lastNetSample = make(map[string]ioSample)
 	r.lastDiskIOSample = make(map[string]ioSample)
+	r.lastNFSSample = make(map[string]nfsSample)
 
 	if len(r.TempDir) == 0 {
 		// Temporary dir not provided, try to get it from the environment.
@@ -444,7 +917,10 @@ func (r *Reporter) run() {
 		r.doCPUStats()
 		r.doBlkIOStats()
 		r.doNetworkStats()
+		r.doNFSStats()
 		r.doDiskSpaceStats()
+		r.doProcessStats()
+		r.doGPUStats()
 		select {
 		case <-r.done:
 			return
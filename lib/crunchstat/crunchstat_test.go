@@ -6,11 +6,18 @@ package crunchstat
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func bufLogger() (*log.Logger, *bufio.Reader) {
@@ -64,3 +71,248 @@ func TestReadAllOrWarnSuccess(t *testing.T) {
 		t.Fatalf("data failed regexp: err %v, matched %v", err, matched)
 	}
 }
+
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mtx.Lock()
+	defer sb.mtx.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mtx.Lock()
+	defer sb.mtx.Unlock()
+	return sb.buf.String()
+}
+
+func TestCgroupV2(t *testing.T) {
+	root, err := ioutil.TempDir("", "crunchstat-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cid := "abcdef0123456789"
+	files := map[string]string{
+		"cgroup.controllers": "cpuset cpu io memory pids\n",
+		"system.slice/docker-" + cid + ".scope/cgroup.procs":        fmt.Sprintf("%d\n", os.Getpid()),
+		"system.slice/docker-" + cid + ".scope/cpu.stat":            "usage_usec 3500000\nuser_usec 2500000\nsystem_usec 1000000\n",
+		"system.slice/docker-" + cid + ".scope/cpu.max":             "150000 100000\n",
+		"system.slice/docker-" + cid + ".scope/memory.stat":         "anon 1048576\nfile 2097152\nkernel_stack 16384\npgmajfault 12\n",
+		"system.slice/docker-" + cid + ".scope/memory.swap.current": "4096\n",
+		"system.slice/docker-" + cid + ".scope/io.stat":             "8:0 rbytes=1000 wbytes=2000 rios=1 wios=2 dbytes=0 dios=0\n",
+	}
+	for name, content := range files {
+		fn := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &syncBuffer{}
+	rep := Reporter{
+		CID:          cid,
+		CgroupRoot:   root,
+		CgroupParent: "system.slice",
+		PollPeriod:   time.Hour,
+		Logger:       log.New(buf, "", 0),
+	}
+	rep.Start()
+	// Wait for the first round of stats.
+	for deadline := time.Now().Add(10 * time.Second); !strings.Contains(buf.String(), "blkio:") && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rep.Stop()
+	logs := buf.String()
+	for _, expect := range []string{
+		"notice: " + root + " is a cgroups v2 (unified) hierarchy\n",
+		"mem 2097152 cache 4096 swap 12 pgmajfault 1048576 rss\n",
+		"cpu 2.5000 user 1.0000 sys 2 cpus\n",
+		"blkio:8:0 2000 write 1000 read\n",
+	} {
+		if !strings.Contains(logs, expect) {
+			t.Errorf("expected %q in logs:\n%s", expect, logs)
+		}
+	}
+}
+
+func TestParseMountStats(t *testing.T) {
+	mountstats := `device sysfs mounted on /sys with fstype sysfs
+device nfs.example:/export/data mounted on /mnt/data with fstype nfs4 statvers=1.1
+	opts:	rw,vers=4.2,rsize=1048576,wsize=1048576
+	age:	12345
+	events:	1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20 21 22 23 24 25 26 27
+	bytes:	5000 6000 0 0 4096 8192 2 2
+	RPC iostats version: 1.1  p/v: 100003/4 (nfs)
+	xprt:	tcp 0 0 1 0 0 100 100 0 100 0 2 0 0
+	per-op statistics
+	        NULL: 1 1 0 44 24 0 0 0 0
+	        READ: 10 10 0 1600 41000 1 2 3 0
+	       WRITE: 5 5 0 82000 800 1 2 3 0
+
+device nfs.example:/home mounted on /home with fstype nfs statvers=1.1
+	bytes:	1 2 3 4 5 6 7 8
+	per-op statistics
+	     GETATTR: 7 7 0 0 0 0 0 0 0
+device /dev/sda1 mounted on / with fstype ext4
+`
+	now := time.Now()
+	samples := parseMountStats(strings.NewReader(mountstats), now)
+	expect := map[string]nfsSample{
+		"/mnt/data": {sampleTime: now, readBytes: 4096, writeBytes: 8192, ops: 16},
+		"/home":     {sampleTime: now, readBytes: 5, writeBytes: 6, ops: 7},
+	}
+	if len(samples) != len(expect) {
+		t.Errorf("expected %d samples, got %v", len(expect), samples)
+	}
+	for mnt, sample := range expect {
+		if samples[mnt] != sample {
+			t.Errorf("%s: expected %+v, got %+v", mnt, sample, samples[mnt])
+		}
+	}
+}
+
+func TestTopProcesses(t *testing.T) {
+	procRoot, err := ioutil.TempDir("", "crunchstat-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procRoot)
+	hz := userHz()
+	pageSize := int64(os.Getpagesize())
+	writeStat := func(pid int, comm string, cpuTicks, rssPages int64) {
+		dir := fmt.Sprintf("%s/%d", procRoot, pid)
+		os.Mkdir(dir, 0755)
+		stat := fmt.Sprintf("%d (%s) S 1 1 1 0 -1 4194560 100 0 0 0 %d 0 0 0 20 0 1 0 100 1000000 %d 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0\n", pid, comm, cpuTicks, rssPages)
+		if err := ioutil.WriteFile(dir+"/stat", []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeStat(1, "init", 1000, 10)
+	writeStat(100, "arv-mount", 10, 5000)
+	writeStat(200, "python (worker)", 500, 20000)
+	writeStat(300, "bash", 0, 100)
+
+	buf := &syncBuffer{}
+	rep := Reporter{Logger: log.New(buf, "", 0), TopProcesses: 1, procRoot: procRoot}
+	rep.doProcessStats()
+	// Largest RSS (200) and most CPU time (1).
+	expect := fmt.Sprintf("proc:1:init %d rss %.4f cpu\nproc:200:python_(worker) %d rss %.4f cpu\n", 10*pageSize, 1000/hz, 20000*pageSize, 500/hz)
+	if logs := buf.String(); logs != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, logs)
+	}
+
+	// Now arv-mount is using the most CPU.
+	buf.buf.Reset()
+	writeStat(100, "arv-mount", 2000, 5000)
+	rep.doProcessStats()
+	if logs := buf.String(); !regexp.MustCompile(`^proc:100:arv-mount \d+ rss \d+\.\d+ cpu -- interval \d+\.\d+ seconds \d+\.\d+ cpu\nproc:200:python_\(worker\) .*\n$`).MatchString(logs) {
+		t.Errorf("unexpected logs:\n%s", logs)
+	}
+}
+
+func TestGPUStats(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "crunchstat-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	fakeSMI := filepath.Join(tmpdir, "nvidia-smi")
+	err = ioutil.WriteFile(fakeSMI, []byte(`#!/bin/sh
+echo "$@" >`+tmpdir+`/args
+echo "1, 45, 1024, 16160"
+echo "3, [N/A], [N/A], [N/A]"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &syncBuffer{}
+	rep := Reporter{Logger: log.New(buf, "", 0), PollPeriod: time.Minute, GPUs: "1,3", nvidiaSMI: fakeSMI}
+	rep.doGPUStats()
+	if logs, expect := buf.String(), "gpu:1 45 utilization 1073741824 used 16944988160 total\n"; logs != expect {
+		t.Errorf("expected %q, got %q", expect, logs)
+	}
+	args, err := ioutil.ReadFile(tmpdir + "/args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(args), " --id=1,3\n") {
+		t.Errorf("unexpected nvidia-smi args %q", args)
+	}
+
+	// After an error, nvidia-smi isn't run again.
+	buf.buf.Reset()
+	rep = Reporter{Logger: log.New(buf, "", 0), PollPeriod: time.Minute, GPUs: "all", nvidiaSMI: filepath.Join(tmpdir, "missing")}
+	rep.doGPUStats()
+	rep.doGPUStats()
+	if logs := buf.String(); !strings.HasPrefix(logs, "notice: not reporting GPU statistics: ") || strings.Count(logs, "\n") != 1 {
+		t.Errorf("unexpected logs %q", logs)
+	}
+
+	// After other errors, nvidia-smi is retried after skipping
+	// 1, 2, 4, ... samples, until it succeeds.
+	failingSMI := filepath.Join(tmpdir, "failing-smi")
+	err = ioutil.WriteFile(failingSMI, []byte(`#!/bin/sh
+echo >>`+tmpdir+`/runs
+test -e `+tmpdir+`/ok || exit 1
+echo "0, 12, 1, 2"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.buf.Reset()
+	rep = Reporter{Logger: log.New(buf, "", 0), PollPeriod: time.Minute, GPUs: "all", nvidiaSMI: failingSMI}
+	for i := 0; i < 8; i++ {
+		rep.doGPUStats()
+	}
+	runs, err := ioutil.ReadFile(tmpdir + "/runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Run at samples 0, 2, 5.
+	if n := len(runs); n != 3 {
+		t.Errorf("expected 3 runs, got %d", n)
+	}
+	if logs := buf.String(); strings.Count(logs, "notice: error getting GPU statistics: ") != 3 || !strings.Contains(logs, "(skipping 4 samples)\n") {
+		t.Errorf("unexpected logs %q", logs)
+	}
+	err = ioutil.WriteFile(tmpdir+"/ok", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.buf.Reset()
+	for i := 0; i < 3; i++ {
+		rep.doGPUStats()
+	}
+	// Skip samples 8 and 9, run at sample 10.
+	if logs, expect := buf.String(), "gpu:0 12 utilization 1048576 used 2097152 total\n"; logs != expect {
+		t.Errorf("expected %q, got %q", expect, logs)
+	}
+	if rep.gpuStatsBackoff != 0 {
+		t.Errorf("backoff not reset after success: %d", rep.gpuStatsBackoff)
+	}
+
+	// If nvidia-smi hangs, it is killed before the next sample.
+	hangingSMI := filepath.Join(tmpdir, "hanging-smi")
+	err = ioutil.WriteFile(hangingSMI, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.buf.Reset()
+	rep = Reporter{Logger: log.New(buf, "", 0), PollPeriod: 200 * time.Millisecond, GPUs: "all", nvidiaSMI: hangingSMI}
+	t0 := time.Now()
+	rep.doGPUStats()
+	if elapsed := time.Since(t0); elapsed >= rep.PollPeriod {
+		t.Errorf("nvidia-smi ran for %v, longer than PollPeriod", elapsed)
+	}
+	if logs := buf.String(); !strings.Contains(logs, "context deadline exceeded (skipping 1 samples)") {
+		t.Errorf("unexpected logs %q", logs)
+	}
+}
@@ -73,6 +73,10 @@ type Queue struct {
 
 	// active notification subscribers (see Subscribe)
 	subscribers map[<-chan struct{}]chan struct{}
+
+	// number of containers that finished after being killed by
+	// the out-of-memory killer (nil if metrics are disabled)
+	mOOMKilled prometheus.Counter
 }
 
 // NewQueue returns a new Queue. When a new container appears in the
@@ -87,6 +91,13 @@ func NewQueue(logger logrus.FieldLogger, reg *prometheus.Registry, chooseType ty
 		subscribers: map[<-chan struct{}]chan struct{}{},
 	}
 	if reg != nil {
+		cq.mOOMKilled = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchcloud",
+			Name:      "containers_oom_killed",
+			Help:      "Number of containers that were killed by the out-of-memory killer.",
+		})
+		reg.MustRegister(cq.mOOMKilled)
 		go cq.runMetrics(reg)
 	}
 	return cq
@@ -196,6 +207,12 @@ func (cq *Queue) Update() error {
 		if cur, ok := cq.current[uuid]; !ok {
 			cq.addEnt(uuid, *ctr)
 		} else {
+			if cur.Container.State != arvados.ContainerStateComplete &&
+				ctr.State == arvados.ContainerStateComplete &&
+				ctr.RuntimeStatus["error"] == arvados.RuntimeStatusErrorOutOfMemory &&
+				cq.mOOMKilled != nil {
+				cq.mOOMKilled.Inc()
+			}
 			cur.Container = *ctr
 			cq.current[uuid] = cur
 		}
@@ -382,7 +399,7 @@ func (cq *Queue) poll() (map[string]*arvados.Container, error) {
 			*next[upd.UUID] = upd
 		}
 	}
-	selectParam := []string{"uuid", "state", "priority", "runtime_constraints", "container_image", "mounts", "scheduling_parameters", "created_at"}
+	selectParam := []string{"uuid", "state", "priority", "runtime_constraints", "container_image", "mounts", "scheduling_parameters", "created_at", "runtime_status"}
 	limitParam := 1000
 
 	mine, err := cq.fetchAll(arvados.ResourceListParams{
@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
@@ -83,8 +84,30 @@ func EstimateScratchSpace(ctr *arvados.Container) (needScratch int64) {
 	return
 }
 
+// versionLess returns true if version a is lower than version b,
+// comparing each dot-separated component numerically, e.g., "9.0" <
+// "11.0". A missing or non-numeric component counts as zero, so an
+// empty version is lower than any other.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an != bn {
+			return an < bn
+		}
+	}
+	return false
+}
+
 // ChooseInstanceType returns the cheapest available
-// arvados.InstanceType big enough to run ctr.
+// arvados.InstanceType big enough to run ctr, with the GPUs it
+// requests, if any.
 func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvados.InstanceType, err error) {
 	if len(cc.InstanceTypes) == 0 {
 		err = ErrInstanceTypesNotConfigured
@@ -107,6 +130,9 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) (best arvad
 		case int64(it.RAM) < needRAM:
 		case it.VCPUs < needVCPUs:
 		case it.Preemptible != ctr.SchedulingParameters.Preemptible:
+		case it.CUDA.DeviceCount < ctr.RuntimeConstraints.CUDA.DeviceCount:
+		case ctr.RuntimeConstraints.CUDA.DeviceCount > 0 && versionLess(it.CUDA.DriverVersion, ctr.RuntimeConstraints.CUDA.DriverVersion):
+		case ctr.RuntimeConstraints.CUDA.DeviceCount > 0 && versionLess(it.CUDA.HardwareCapability, ctr.RuntimeConstraints.CUDA.HardwareCapability):
 		case it.Price == best.Price && (it.RAM < best.RAM || it.VCPUs < best.VCPUs):
 			// Equal price, but worse specs
 		default:
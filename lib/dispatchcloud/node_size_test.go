@@ -126,6 +126,64 @@ func (*NodeSizeSuite) TestChoosePreemptable(c *check.C) {
 	c.Check(best.Preemptible, check.Equals, true)
 }
 
+func (*NodeSizeSuite) TestChooseGPU(c *check.C) {
+	menu := map[string]arvados.InstanceType{
+		"costly":         {Price: 4.4, RAM: 4000000000, VCPUs: 8, Scratch: 2 * GiB, Name: "costly", CUDA: arvados.CUDAFeatures{DeviceCount: 2, HardwareCapability: "9.0", DriverVersion: "11.0"}},
+		"low_capability": {Price: 2.1, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "low_capability", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "8.0", DriverVersion: "11.0"}},
+		"old_driver":     {Price: 2.0, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "old_driver", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "10.0"}},
+		"best":           {Price: 2.2, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "best", CUDA: arvados.CUDAFeatures{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "11.0"}},
+		"small":          {Price: 1.1, RAM: 2000000000, VCPUs: 2, Scratch: 2 * GiB, Name: "small"},
+	}
+	for _, trial := range []struct {
+		cuda   arvados.CUDARuntimeConstraints
+		expect string
+	}{
+		{arvados.CUDARuntimeConstraints{}, "small"},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "11.0"}, "best"},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "8.0", DriverVersion: "11.0"}, "low_capability"},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "7.5", DriverVersion: "9.2"}, "old_driver"},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 1}, "old_driver"},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 2, HardwareCapability: "9.0", DriverVersion: "11.0"}, "costly"},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 1, HardwareCapability: "9.0", DriverVersion: "11.2"}, ""},
+		{arvados.CUDARuntimeConstraints{DeviceCount: 3}, ""},
+	} {
+		best, err := ChooseInstanceType(&arvados.Cluster{InstanceTypes: menu}, &arvados.Container{
+			Mounts: map[string]arvados.Mount{
+				"/tmp": {Kind: "tmp", Capacity: 2 * int64(GiB)},
+			},
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 2,
+				RAM:   987654321,
+				CUDA:  trial.cuda,
+			},
+		})
+		if trial.expect == "" {
+			c.Check(err, check.FitsTypeOf, ConstraintsNotSatisfiableError{}, check.Commentf("%+v", trial.cuda))
+		} else {
+			c.Check(err, check.IsNil)
+			c.Check(best.Name, check.Equals, trial.expect, check.Commentf("%+v", trial.cuda))
+		}
+	}
+}
+
+func (*NodeSizeSuite) TestVersionLess(c *check.C) {
+	for _, trial := range []struct {
+		a, b   string
+		expect bool
+	}{
+		{"9.0", "11.0", true},
+		{"11.0", "9.0", false},
+		{"11.0", "11.0", false},
+		{"11", "11.0", false},
+		{"11.0", "11.4", true},
+		{"11.10", "11.4", false},
+		{"", "7.5", true},
+		{"7.5", "", false},
+	} {
+		c.Check(versionLess(trial.a, trial.b), check.Equals, trial.expect, check.Commentf("%q < %q", trial.a, trial.b))
+	}
+}
+
 func (*NodeSizeSuite) TestScratchForDockerImage(c *check.C) {
 	n := EstimateScratchSpace(&arvados.Container{
 		ContainerImage: "d5025c0f29f6eef304a7358afa82a822+342",
@@ -122,7 +122,7 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		installPublicKey:               installPublicKey,
 		tagKeyPrefix:                   cluster.Containers.CloudVMs.TagKeyPrefix,
 		runnerCmdDefault:               cluster.Containers.CrunchRunCommand,
-		runnerArgs:                     cluster.Containers.CrunchRunArgumentsList,
+		runnerArgs:                     cluster.Containers.CrunchRunArguments(),
 		stop:                           make(chan bool),
 	}
 	wp.registerMetrics(reg)
@@ -17,11 +17,20 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func tlsConfigWithCertUpdater(cluster *arvados.Cluster, logger logrus.FieldLogger) (*tls.Config, error) {
+// TLSConfigWithCertUpdater returns a TLS configuration that uses the
+// key and certificate files given in cluster.TLS, and reloads them
+// when the process receives SIGHUP.
+func TLSConfigWithCertUpdater(cluster *arvados.Cluster, logger logrus.FieldLogger) (*tls.Config, error) {
+	return TLSConfigWithCertFiles(cluster.TLS.Certificate, cluster.TLS.Key, logger)
+}
+
+// TLSConfigWithCertFiles is like TLSConfigWithCertUpdater, but uses
+// the given certificate and key ("file://..." URLs) instead of the
+// ones in cluster.TLS.
+func TLSConfigWithCertFiles(cert, key string, logger logrus.FieldLogger) (*tls.Config, error) {
 	currentCert := make(chan *tls.Certificate, 1)
 	loaded := false
 
-	key, cert := cluster.TLS.Key, cluster.TLS.Certificate
 	if !strings.HasPrefix(key, "file://") || !strings.HasPrefix(cert, "file://") {
 		return nil, errors.New("cannot use TLS certificate: TLS.Key and TLS.Certificate must be specified with a 'file://' prefix")
 	}
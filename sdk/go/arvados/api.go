@@ -24,28 +24,13 @@ var (
 	EndpointConfigGet                     = APIEndpoint{"GET", "arvados/v1/config", ""}
 	EndpointLogin                         = APIEndpoint{"GET", "login", ""}
 	EndpointLogout                        = APIEndpoint{"GET", "logout", ""}
-	EndpointCollectionCreate              = APIEndpoint{"POST", "arvados/v1/collections", "collection"}
-	EndpointCollectionUpdate              = APIEndpoint{"PATCH", "arvados/v1/collections/{uuid}", "collection"}
-	EndpointCollectionGet                 = APIEndpoint{"GET", "arvados/v1/collections/{uuid}", ""}
-	EndpointCollectionList                = APIEndpoint{"GET", "arvados/v1/collections", ""}
-	EndpointCollectionProvenance          = APIEndpoint{"GET", "arvados/v1/collections/{uuid}/provenance", ""}
-	EndpointCollectionUsedBy              = APIEndpoint{"GET", "arvados/v1/collections/{uuid}/used_by", ""}
-	EndpointCollectionDelete              = APIEndpoint{"DELETE", "arvados/v1/collections/{uuid}", ""}
-	EndpointCollectionTrash               = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/trash", ""}
-	EndpointCollectionUntrash             = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/untrash", ""}
 	EndpointSpecimenCreate                = APIEndpoint{"POST", "arvados/v1/specimens", "specimen"}
 	EndpointSpecimenUpdate                = APIEndpoint{"PATCH", "arvados/v1/specimens/{uuid}", "specimen"}
 	EndpointSpecimenGet                   = APIEndpoint{"GET", "arvados/v1/specimens/{uuid}", ""}
 	EndpointSpecimenList                  = APIEndpoint{"GET", "arvados/v1/specimens", ""}
 	EndpointSpecimenDelete                = APIEndpoint{"DELETE", "arvados/v1/specimens/{uuid}", ""}
-	EndpointContainerCreate               = APIEndpoint{"POST", "arvados/v1/containers", "container"}
-	EndpointContainerUpdate               = APIEndpoint{"PATCH", "arvados/v1/containers/{uuid}", "container"}
-	EndpointContainerGet                  = APIEndpoint{"GET", "arvados/v1/containers/{uuid}", ""}
-	EndpointContainerList                 = APIEndpoint{"GET", "arvados/v1/containers", ""}
-	EndpointContainerDelete               = APIEndpoint{"DELETE", "arvados/v1/containers/{uuid}", ""}
-	EndpointContainerLock                 = APIEndpoint{"POST", "arvados/v1/containers/{uuid}/lock", ""}
-	EndpointContainerUnlock               = APIEndpoint{"POST", "arvados/v1/containers/{uuid}/unlock", ""}
 	EndpointContainerSSH                  = APIEndpoint{"GET", "arvados/v1/connect/{uuid}/ssh", ""} // move to /containers after #17014 fixes routing
+	EndpointContainerSnapshotOutput       = APIEndpoint{"POST", "arvados/v1/containers/{uuid}/snapshot_output", ""}
 	EndpointContainerRequestCreate        = APIEndpoint{"POST", "arvados/v1/container_requests", "container_request"}
 	EndpointContainerRequestUpdate        = APIEndpoint{"PATCH", "arvados/v1/container_requests/{uuid}", "container_request"}
 	EndpointContainerRequestGet           = APIEndpoint{"GET", "arvados/v1/container_requests/{uuid}", ""}
@@ -68,6 +53,12 @@ var (
 	EndpointUserBatchUpdate               = APIEndpoint{"PATCH", "arvados/v1/users/batch_update", ""}
 	EndpointUserAuthenticate              = APIEndpoint{"POST", "arvados/v1/users/authenticate", ""}
 	EndpointAPIClientAuthorizationCurrent = APIEndpoint{"GET", "arvados/v1/api_client_authorizations/current", ""}
+	EndpointLinkCreate                    = APIEndpoint{"POST", "arvados/v1/links", "link"}
+	EndpointLinkList                      = APIEndpoint{"GET", "arvados/v1/links", ""}
+	EndpointLinkDelete                    = APIEndpoint{"DELETE", "arvados/v1/links/{uuid}", ""}
+	EndpointS3AccessKeyCreate             = APIEndpoint{"POST", "arvados/v1/s3_access_keys", "s3_access_key"}
+	EndpointS3AccessKeyList               = APIEndpoint{"GET", "arvados/v1/s3_access_keys", ""}
+	EndpointS3AccessKeyDelete             = APIEndpoint{"DELETE", "arvados/v1/s3_access_keys/{uuid}", ""}
 )
 
 type ContainerSSHOptions struct {
@@ -122,6 +113,7 @@ type UpdateOptions struct {
 	UUID             string                 `json:"uuid"`
 	Attrs            map[string]interface{} `json:"attrs"`
 	BypassFederation bool                   `json:"bypass_federation"`
+	MergeProperties  bool                   `json:"merge_properties"`
 }
 
 type UpdateUUIDOptions struct {
@@ -166,11 +158,19 @@ type LoginOptions struct {
 	Remote   string `json:"remote,omitempty"` // Salt token for remote Cluster ID
 	Code     string `json:"code,omitempty"`   // OAuth2 callback code
 	State    string `json:"state,omitempty"`  // OAuth2 callback state
+
+	// Login provider ID or issuer URL, if multiple OpenID Connect
+	// providers are configured
+	Provider string `json:"provider,omitempty"`
+
+	// Issue a token with the longer Login.RememberMeTokenLifetime
+	RememberMe bool `json:"remember_me,omitempty"`
 }
 
 type UserAuthenticateOptions struct {
-	Username string `json:"username,omitempty"` // PAM username
-	Password string `json:"password,omitempty"` // PAM password
+	Username   string `json:"username,omitempty"`    // PAM username
+	Password   string `json:"password,omitempty"`    // PAM password
+	RememberMe bool   `json:"remember_me,omitempty"` // Use Login.RememberMeTokenLifetime
 }
 
 type LogoutOptions struct {
@@ -198,6 +198,7 @@ type API interface {
 	ContainerLock(ctx context.Context, options GetOptions) (Container, error)
 	ContainerUnlock(ctx context.Context, options GetOptions) (Container, error)
 	ContainerSSH(ctx context.Context, options ContainerSSHOptions) (ContainerSSHConnection, error)
+	ContainerSnapshotOutput(ctx context.Context, options GetOptions) (Collection, error)
 	ContainerRequestCreate(ctx context.Context, options CreateOptions) (ContainerRequest, error)
 	ContainerRequestUpdate(ctx context.Context, options UpdateOptions) (ContainerRequest, error)
 	ContainerRequestGet(ctx context.Context, options GetOptions) (ContainerRequest, error)
@@ -223,4 +224,7 @@ type API interface {
 	UserBatchUpdate(context.Context, UserBatchUpdateOptions) (UserList, error)
 	UserAuthenticate(ctx context.Context, options UserAuthenticateOptions) (APIClientAuthorization, error)
 	APIClientAuthorizationCurrent(ctx context.Context, options GetOptions) (APIClientAuthorization, error)
+	S3AccessKeyCreate(ctx context.Context, options CreateOptions) (S3AccessKey, error)
+	S3AccessKeyList(ctx context.Context, options ListOptions) (S3AccessKeyList, error)
+	S3AccessKeyDelete(ctx context.Context, options DeleteOptions) (S3AccessKey, error)
 }
@@ -4,6 +4,11 @@
 
 package arvados
 
+import (
+	"context"
+	"time"
+)
+
 // APIClientAuthorization is an arvados#apiClientAuthorization resource.
 type APIClientAuthorization struct {
 	UUID      string   `json:"uuid"`
@@ -14,9 +19,76 @@ type APIClientAuthorization struct {
 
 // APIClientAuthorizationList is an arvados#apiClientAuthorizationList resource.
 type APIClientAuthorizationList struct {
-	Items []APIClientAuthorization `json:"items"`
+	Items          []APIClientAuthorization `json:"items"`
+	ItemsAvailable int                      `json:"items_available"`
+	Offset         int                      `json:"offset"`
+	Limit          int                      `json:"limit"`
 }
 
 func (aca APIClientAuthorization) TokenV2() string {
 	return "v2/" + aca.UUID + "/" + aca.APIToken
 }
+
+// CreateAPIClientAuthorizationOptions specifies the attributes of a
+// new token created by CreateAPIClientAuthorization.
+type CreateAPIClientAuthorizationOptions struct {
+	// Scopes restrict the requests the token can be used for,
+	// e.g., []string{"GET /arvados/v1/collections/" + uuid}. If
+	// nil, the token is not restricted (scope "all").
+	Scopes []string
+
+	// If non-zero, the token expires at this time.
+	ExpiresAt time.Time
+
+	// If non-empty, create the token on behalf of this user
+	// (admin only). Otherwise, the token belongs to the client's
+	// own user.
+	OwnerUUID string
+}
+
+// CreateAPIClientAuthorization calls
+// arvados.v1.api_client_authorizations.create and returns the new
+// token. Use TokenV2 to get a token string that can be passed to
+// other clients.
+func (c *Client) CreateAPIClientAuthorization(ctx context.Context, opts CreateAPIClientAuthorizationOptions) (APIClientAuthorization, error) {
+	attrs := map[string]interface{}{}
+	if opts.Scopes != nil {
+		attrs["scopes"] = opts.Scopes
+	}
+	if !opts.ExpiresAt.IsZero() {
+		attrs["expires_at"] = opts.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	if opts.OwnerUUID != "" {
+		attrs["owner_uuid"] = opts.OwnerUUID
+	}
+	var aca APIClientAuthorization
+	err := c.RequestAndDecodeContext(ctx, &aca, "POST", "arvados/v1/api_client_authorizations", nil, map[string]interface{}{
+		"api_client_authorization": attrs,
+	})
+	return aca, err
+}
+
+// ListAPIClientAuthorizations calls
+// arvados.v1.api_client_authorizations.list and returns one page of
+// results.
+func (c *Client) ListAPIClientAuthorizations(ctx context.Context, params ResourceListParams) (APIClientAuthorizationList, error) {
+	var resp APIClientAuthorizationList
+	err := c.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/api_client_authorizations", nil, params)
+	return resp, err
+}
+
+// CurrentAPIClientAuthorization calls
+// arvados.v1.api_client_authorizations.current and returns the
+// record for the client's own token.
+func (c *Client) CurrentAPIClientAuthorization(ctx context.Context) (APIClientAuthorization, error) {
+	var aca APIClientAuthorization
+	err := c.RequestAndDecodeContext(ctx, &aca, "GET", "arvados/v1/api_client_authorizations/current", nil, nil)
+	return aca, err
+}
+
+// DeleteAPIClientAuthorization calls
+// arvados.v1.api_client_authorizations.delete, revoking the token
+// with the given UUID.
+func (c *Client) DeleteAPIClientAuthorization(ctx context.Context, uuid string) error {
+	return c.RequestAndDecodeContext(ctx, nil, "DELETE", "arvados/v1/api_client_authorizations/"+uuid, nil, nil)
+}
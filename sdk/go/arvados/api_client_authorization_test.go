@@ -0,0 +1,90 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&APIClientAuthorizationSuite{})
+
+type APIClientAuthorizationSuite struct{}
+
+// recordingTransport records each request, and responds with the
+// given JSON body.
+type recordingTransport struct {
+	body     string
+	requests []*http.Request
+	forms    []map[string][]string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.ParseForm()
+	rt.requests = append(rt.requests, req)
+	rt.forms = append(rt.forms, req.Form)
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(rt.body))),
+	}, nil
+}
+
+func (s *APIClientAuthorizationSuite) client(rt *recordingTransport) *Client {
+	return &Client{
+		Client:    &http.Client{Transport: rt},
+		APIHost:   "zzzzz.arvadosapi.com",
+		AuthToken: "xyzzy",
+	}
+}
+
+func (s *APIClientAuthorizationSuite) TestCreate(c *check.C) {
+	rt := &recordingTransport{body: `{"uuid":"zzzzz-gj3su-000000000000000","api_token":"secret","scopes":["GET /arvados/v1/users/current"]}`}
+	client := s.client(rt)
+	aca, err := client.CreateAPIClientAuthorization(context.Background(), CreateAPIClientAuthorizationOptions{
+		Scopes:    []string{"GET /arvados/v1/users/current"},
+		ExpiresAt: time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("x", 3600)),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(aca.TokenV2(), check.Equals, "v2/zzzzz-gj3su-000000000000000/secret")
+	c.Check(aca.Scopes, check.DeepEquals, []string{"GET /arvados/v1/users/current"})
+	c.Assert(rt.requests, check.HasLen, 1)
+	c.Check(rt.requests[0].Method, check.Equals, "POST")
+	c.Check(rt.requests[0].URL.Path, check.Equals, "/arvados/v1/api_client_authorizations")
+	c.Check(rt.forms[0]["api_client_authorization"], check.DeepEquals, []string{`{"expires_at":"2030-01-02T02:04:05Z","scopes":["GET /arvados/v1/users/current"]}`})
+
+	// Zero-value options are omitted, so the server defaults
+	// apply.
+	_, err = client.CreateAPIClientAuthorization(context.Background(), CreateAPIClientAuthorizationOptions{})
+	c.Assert(err, check.IsNil)
+	c.Check(rt.forms[1]["api_client_authorization"], check.DeepEquals, []string{`{}`})
+}
+
+func (s *APIClientAuthorizationSuite) TestListAndDelete(c *check.C) {
+	rt := &recordingTransport{body: `{"items":[{"uuid":"zzzzz-gj3su-000000000000000"}],"items_available":1}`}
+	client := s.client(rt)
+	list, err := client.ListAPIClientAuthorizations(context.Background(), ResourceListParams{
+		Filters: []Filter{{"uuid", "=", "zzzzz-gj3su-000000000000000"}},
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(list.Items, check.HasLen, 1)
+	c.Check(list.ItemsAvailable, check.Equals, 1)
+	c.Check(rt.requests[0].Method, check.Equals, "GET")
+	c.Check(rt.requests[0].URL.Query().Get("filters"), check.Equals, `[["uuid","=","zzzzz-gj3su-000000000000000"]]`)
+
+	err = client.DeleteAPIClientAuthorization(context.Background(), list.Items[0].UUID)
+	c.Assert(err, check.IsNil)
+	c.Check(rt.requests[1].Method, check.Equals, "DELETE")
+	c.Check(rt.requests[1].URL.Path, check.Equals, "/arvados/v1/api_client_authorizations/zzzzz-gj3su-000000000000000")
+}
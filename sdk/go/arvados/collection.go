@@ -10,43 +10,10 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
-	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/blockdigest"
 )
 
-// Collection is an arvados#collection resource.
-type Collection struct {
-	UUID                      string                 `json:"uuid"`
-	Etag                      string                 `json:"etag"`
-	OwnerUUID                 string                 `json:"owner_uuid"`
-	TrashAt                   *time.Time             `json:"trash_at"`
-	ManifestText              string                 `json:"manifest_text"`
-	UnsignedManifestText      string                 `json:"unsigned_manifest_text"`
-	Name                      string                 `json:"name"`
-	CreatedAt                 time.Time              `json:"created_at"`
-	ModifiedAt                time.Time              `json:"modified_at"`
-	ModifiedByClientUUID      string                 `json:"modified_by_client_uuid"`
-	ModifiedByUserUUID        string                 `json:"modified_by_user_uuid"`
-	PortableDataHash          string                 `json:"portable_data_hash"`
-	ReplicationConfirmed      *int                   `json:"replication_confirmed"`
-	ReplicationConfirmedAt    *time.Time             `json:"replication_confirmed_at"`
-	ReplicationDesired        *int                   `json:"replication_desired"`
-	StorageClassesDesired     []string               `json:"storage_classes_desired"`
-	StorageClassesConfirmed   []string               `json:"storage_classes_confirmed"`
-	StorageClassesConfirmedAt *time.Time             `json:"storage_classes_confirmed_at"`
-	DeleteAt                  *time.Time             `json:"delete_at"`
-	IsTrashed                 bool                   `json:"is_trashed"`
-	Properties                map[string]interface{} `json:"properties"`
-	WritableBy                []string               `json:"writable_by,omitempty"`
-	FileCount                 int                    `json:"file_count"`
-	FileSizeTotal             int64                  `json:"file_size_total"`
-	Version                   int                    `json:"version"`
-	PreserveVersion           bool                   `json:"preserve_version"`
-	CurrentVersionUUID        string                 `json:"current_version_uuid"`
-	Description               string                 `json:"description"`
-}
-
 func (c Collection) resourceName() string {
 	return "collection"
 }
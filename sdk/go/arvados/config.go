@@ -57,6 +57,53 @@ func (sc *Config) GetCluster(clusterID string) (*Cluster, error) {
 	return &cc, nil
 }
 
+// UploadDownloadPermission specifies whether a client is allowed to
+// read and write data through a proxy service.
+type UploadDownloadPermission struct {
+	Download bool
+	Upload   bool
+}
+
+type KeepproxyPermissionConfig struct {
+	Default UploadDownloadPermission
+	ByUUID  map[string]UploadDownloadPermission
+}
+
+type KeepproxyClientCertificatesConfig struct {
+	CACertificates string
+	Default        UploadDownloadPermission
+	BySubject      map[string]UploadDownloadPermission
+}
+
+type BalanceHotDataConfig struct {
+	Sources          []string
+	ExtraReplication int
+	StorageClasses   []string
+}
+
+type GitCORSOrigin struct {
+	AllowCredentials bool
+	AllowWrite       bool
+}
+
+type KeepproxyAuditLogConfig struct {
+	File    string
+	APILogs bool
+}
+
+type KeepproxyTrafficStatsConfig struct {
+	Window      Duration
+	TopTalkers  int
+	LogInterval Duration
+}
+
+type WebDAVAccessRule struct {
+	Hosts          StringSet
+	PathPrefix     string
+	AllowAnonymous bool
+	AllowWrite     bool
+}
+
 type WebDAVCacheConfig struct {
 	TTL                  Duration
 	UUIDTTL              Duration
@@ -68,6 +115,21 @@ type WebDAVCacheConfig struct {
 	MaxSessions          int
 }
 
+type WebDAVCacheControlConfig struct {
+	ImmutableMaxAge Duration
+	MutableMaxAge   Duration
+}
+
+type WebDAVLocksConfig struct {
+	Hosts      StringSet
+	MaxTimeout Duration
+}
+
+type WebDAVTracingConfig struct {
+	Endpoint   URL
+	SampleRate float64
+}
+
 type Cluster struct {
 	ClusterID       string `json:"-"`
 	ManagementToken string
@@ -122,19 +184,47 @@ type Cluster struct {
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
 		S3FolderObjects              bool
+		S3Region                     string
+		S3ChecksumMaxSize            ByteSize
 
 		BlobMissingReport        string
+		BlobRecoveryReport       string
 		BalancePeriod            Duration
 		BalanceCollectionBatch   int
 		BalanceCollectionBuffers int
 		BalanceTimeout           Duration
-
-		WebDAVCache WebDAVCacheConfig
+		BalanceCommitRetries     int
+		BalanceWindows           []string
+		BalanceBlackouts         []string
+		BalancePlacementPolicy   string
+		BalanceHotData           BalanceHotDataConfig
+
+		KeepproxyPermission         KeepproxyPermissionConfig
+		KeepproxyClientCertificates KeepproxyClientCertificatesConfig
+		KeepproxyAuditLog           KeepproxyAuditLogConfig
+		KeepproxyLocalReplicas      int
+		KeepproxyLocalityAwareReads bool
+		KeepproxyAdminPassthrough   bool
+		KeepproxyTrafficStats       KeepproxyTrafficStatsConfig
+
+		WebDAVAccessRules  map[string]WebDAVAccessRule
+		WebDAVCache        WebDAVCacheConfig
+		WebDAVCacheControl WebDAVCacheControlConfig
+		WebDAVHedgeDelay   Duration
+		WebDAVLandingPage  bool
+		WebDAVLocks        WebDAVLocksConfig
+		WebDAVTracing      WebDAVTracingConfig
 	}
 	Git struct {
-		GitCommand   string
-		GitoliteHome string
-		Repositories string
+		GitCommand         string
+		GitoliteHome       string
+		Repositories       string
+		CredentialLifetime Duration
+		AnonymousRead      bool
+		CORS               struct {
+			Origins map[string]GitCORSOrigin
+			MaxAge  Duration
+		}
 	}
 	Login struct {
 		LDAP struct {
@@ -168,6 +258,8 @@ type Cluster struct {
 			EmailVerifiedClaim              string
 			UsernameClaim                   string
 			AuthenticationRequestParameters map[string]string
+			Providers                       map[string]OpenIDConnectProvider
+			OpaqueAccessTokenProvider       string
 		}
 		PAM struct {
 			Enable             bool
@@ -183,10 +275,12 @@ type Cluster struct {
 			Enable bool
 			Users  map[string]TestUser
 		}
-		LoginCluster       string
-		RemoteTokenRefresh Duration
-		TokenLifetime      Duration
-		TrustedClients     map[string]struct{}
+		LoginCluster            string
+		RemoteTokenRefresh      Duration
+		TokenLifetime           Duration
+		RememberMeTokenLifetime Duration
+		TokenScopes             []string
+		TrustedClients          map[string]struct{}
 	}
 	Mail struct {
 		MailchimpAPIKey                string
@@ -319,6 +413,7 @@ type Services struct {
 	Composer       Service
 	Controller     Service
 	DispatchCloud  Service
+	DispatchSLURM  Service
 	GitHTTP        Service
 	GitSSH         Service
 	Health         Service
@@ -340,6 +435,17 @@ type Service struct {
 	ExternalURL  URL
 }
 
+type OpenIDConnectProvider struct {
+	DisplayName                     string
+	Issuer                          string
+	ClientID                        string
+	ClientSecret                    string
+	EmailClaim                      string
+	EmailVerifiedClaim              string
+	UsernameClaim                   string
+	AuthenticationRequestParameters map[string]string
+}
+
 type TestUser struct {
 	Email    string
 	Password string
@@ -371,7 +477,12 @@ func (su URL) String() string {
 }
 
 type ServiceInstance struct {
-	Rendezvous string `json:",omitempty"`
+	Rendezvous     string `json:",omitempty"`
+	Zone           string `json:",omitempty"`
+	Rack           string `json:",omitempty"`
+	TLSCertificate string `json:",omitempty"`
+	TLSKey         string `json:",omitempty"`
+	TLSMinVersion  string `json:",omitempty"`
 }
 
 type PostgreSQL struct {
@@ -399,6 +510,16 @@ type InstanceType struct {
 	AddedScratch    ByteSize
 	Price           float64
 	Preemptible     bool
+	CUDA            CUDAFeatures
+}
+
+// CUDAFeatures describe the NVIDIA GPUs available on an instance
+// type: the number of devices, the CUDA driver version, and the
+// hardware compute capability.
+type CUDAFeatures struct {
+	DeviceCount        int
+	DriverVersion      string
+	HardwareCapability string
 }
 
 type ContainersConfig struct {
@@ -407,12 +528,19 @@ type ContainersConfig struct {
 	CrunchRunArgumentsList      []string
 	DefaultKeepCacheRAM         ByteSize
 	DispatchPrivateKey          string
+	DockerAPIRetries            int
+	DockerAPIRetryBackoff       Duration
+	KeepMountEngine             string
 	LogReuseDecisions           bool
 	MaxComputeVMs               int
 	MaxDispatchAttempts         int
+	MaxOutputSize               ByteSize
 	MaxRetryAttempts            int
 	MinRetryPeriod              Duration
+	PostRunHook                 string
+	PropagateEnvironment        []string
 	ReserveExtraRAM             ByteSize
+	RuntimeEngine               string
 	StaleLockTimeout            Duration
 	SupportedDockerImageFormats StringSet
 	UsePreemptibleInstances     bool
@@ -432,6 +560,10 @@ type ContainersConfig struct {
 		LogPartialLineThrottlePeriod Duration
 		LogUpdatePeriod              Duration
 		LogUpdateSize                ByteSize
+		ForwardURLs                  []string
+		ForwardSampleRate            float64
+		LiveLogs                     bool
+		LiveLogsMaxLinesPerSecond    int
 	}
 	ShellAccess struct {
 		Admin bool
@@ -441,6 +573,14 @@ type ContainersConfig struct {
 		PrioritySpread             int64
 		SbatchArgumentsList        []string
 		SbatchEnvironmentVariables map[string]string
+		Licenses                   map[string]SLURMLicense
+		BurstBuffers               map[string]SLURMBurstBuffer
+		SbatchMaxAttempts          int
+		SbatchRetryInitialDelay    Duration
+		SbatchRetryMaxDelay        Duration
+		SbatchFailureWebhookURL    string
+		StateFile                  string
+		PartitionCgroups           map[string]SLURMPartitionCgroups
 		Managed                    struct {
 			DNSServerConfDir       string
 			DNSServerConfTemplate  string
@@ -453,6 +593,19 @@ type ContainersConfig struct {
 	}
 }
 
+type SLURMLicense struct {
+	SLURMName string
+}
+
+type SLURMBurstBuffer struct {
+	Specification string
+}
+
+type SLURMPartitionCgroups struct {
+	ParentSubsystem string
+	Root            string
+}
+
 type CloudVMsConfig struct {
 	Enable bool
 
@@ -597,6 +750,46 @@ const (
 	ServiceNameKeepstore     ServiceName = "keepstore"
 )
 
+// CrunchRunArguments returns the extra command line arguments that
+// dispatchers should pass to crunch-run: CrunchRunArgumentsList,
+// followed by arguments corresponding to other crunch-run settings
+// such as PostRunHook, PropagateEnvironment, MaxOutputSize, Logging,
+// DockerAPIRetries, and RuntimeEngine.
+func (cc ContainersConfig) CrunchRunArguments() []string {
+	args := append([]string(nil), cc.CrunchRunArgumentsList...)
+	if cc.PostRunHook != "" {
+		args = append(args, "-post-run-hook="+cc.PostRunHook)
+	}
+	for _, name := range cc.PropagateEnvironment {
+		args = append(args, "-propagate-env="+name)
+	}
+	if cc.MaxOutputSize > 0 {
+		args = append(args, fmt.Sprintf("-max-output-size=%d", cc.MaxOutputSize))
+	}
+	for _, u := range cc.Logging.ForwardURLs {
+		args = append(args, "-log-forward="+u)
+	}
+	if len(cc.Logging.ForwardURLs) > 0 && cc.Logging.ForwardSampleRate > 0 && cc.Logging.ForwardSampleRate < 1 {
+		args = append(args, fmt.Sprintf("-log-forward-sample-rate=%v", cc.Logging.ForwardSampleRate))
+	}
+	if cc.Logging.LiveLogs {
+		args = append(args, "-live-logs")
+	}
+	if cc.DockerAPIRetries > 0 {
+		args = append(args, fmt.Sprintf("-docker-api-retries=%d", cc.DockerAPIRetries))
+		if cc.DockerAPIRetryBackoff > 0 {
+			args = append(args, "-docker-api-retry-backoff="+cc.DockerAPIRetryBackoff.String())
+		}
+	}
+	if cc.RuntimeEngine != "" && cc.RuntimeEngine != "docker" {
+		args = append(args, "-runtime-engine="+cc.RuntimeEngine)
+	}
+	if cc.KeepMountEngine != "" && cc.KeepMountEngine != "arv-mount" {
+		args = append(args, "-keep-mount-engine="+cc.KeepMountEngine)
+	}
+	return args
+}
+
 // Map returns all services as a map, suitable for iterating over all
 // services or looking up a service by name.
 func (svcs Services) Map() map[ServiceName]Service {
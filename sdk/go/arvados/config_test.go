@@ -6,6 +6,7 @@ package arvados
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/ghodss/yaml"
 	check "gopkg.in/check.v1"
@@ -80,3 +81,41 @@ func (s *ConfigSuite) TestURLTrailingSlash(c *check.C) {
 	json.Unmarshal([]byte(`{"https://foo.example/": true}`), &b)
 	c.Check(a, check.DeepEquals, b)
 }
+
+func (s *ConfigSuite) TestCrunchRunArguments(c *check.C) {
+	cc := ContainersConfig{CrunchRunArgumentsList: []string{"--cgroup-parent-subsystem=memory"}}
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory"})
+	cc.PostRunHook = "/usr/local/bin/post-run"
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-post-run-hook=/usr/local/bin/post-run"})
+	cc.PostRunHook = ""
+	cc.PropagateEnvironment = []string{"HTTPS_PROXY", "SLURM_JOB_*"}
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-propagate-env=HTTPS_PROXY", "-propagate-env=SLURM_JOB_*"})
+	cc.PropagateEnvironment = nil
+	cc.MaxOutputSize = 1 << 40
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-max-output-size=1099511627776"})
+	cc.MaxOutputSize = 0
+	cc.Logging.ForwardURLs = []string{"syslog://logs.example:514", "fluentd://logs.example/arvados"}
+	cc.Logging.ForwardSampleRate = 1
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-log-forward=syslog://logs.example:514", "-log-forward=fluentd://logs.example/arvados"})
+	cc.Logging.ForwardSampleRate = 0.25
+	c.Check(cc.CrunchRunArguments()[3:], check.DeepEquals, []string{"-log-forward-sample-rate=0.25"})
+	cc.Logging.ForwardURLs = nil
+	cc.Logging.LiveLogs = true
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-live-logs"})
+	cc.Logging.LiveLogs = false
+	cc.DockerAPIRetries = 3
+	cc.DockerAPIRetryBackoff = Duration(2 * time.Second)
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-docker-api-retries=3", "-docker-api-retry-backoff=2s"})
+	cc.DockerAPIRetries = 0
+	cc.RuntimeEngine = "docker"
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory"})
+	cc.RuntimeEngine = "podman"
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-runtime-engine=podman"})
+	cc.RuntimeEngine = ""
+	cc.KeepMountEngine = "arv-mount"
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory"})
+	cc.KeepMountEngine = "experimental-go"
+	c.Check(cc.CrunchRunArguments(), check.DeepEquals, []string{"--cgroup-parent-subsystem=memory", "-keep-mount-engine=experimental-go"})
+	// CrunchRunArgumentsList itself is not modified
+	c.Check(cc.CrunchRunArgumentsList, check.HasLen, 1)
+}
@@ -6,34 +6,6 @@ package arvados
 
 import "time"
 
-// Container is an arvados#container resource.
-type Container struct {
-	UUID                      string                 `json:"uuid"`
-	Etag                      string                 `json:"etag"`
-	CreatedAt                 time.Time              `json:"created_at"`
-	ModifiedByClientUUID      string                 `json:"modified_by_client_uuid"`
-	ModifiedByUserUUID        string                 `json:"modified_by_user_uuid"`
-	ModifiedAt                time.Time              `json:"modified_at"`
-	Command                   []string               `json:"command"`
-	ContainerImage            string                 `json:"container_image"`
-	Cwd                       string                 `json:"cwd"`
-	Environment               map[string]string      `json:"environment"`
-	LockedByUUID              string                 `json:"locked_by_uuid"`
-	Mounts                    map[string]Mount       `json:"mounts"`
-	Output                    string                 `json:"output"`
-	OutputPath                string                 `json:"output_path"`
-	Priority                  int64                  `json:"priority"`
-	RuntimeConstraints        RuntimeConstraints     `json:"runtime_constraints"`
-	State                     ContainerState         `json:"state"`
-	SchedulingParameters      SchedulingParameters   `json:"scheduling_parameters"`
-	ExitCode                  int                    `json:"exit_code"`
-	RuntimeStatus             map[string]interface{} `json:"runtime_status"`
-	StartedAt                 *time.Time             `json:"started_at"`  // nil if not yet started
-	FinishedAt                *time.Time             `json:"finished_at"` // nil if not yet finished
-	GatewayAddress            string                 `json:"gateway_address"`
-	InteractiveSessionStarted bool                   `json:"interactive_session_started"`
-}
-
 // ContainerRequest is an arvados#container_request resource.
 type ContainerRequest struct {
 	UUID                    string                 `json:"uuid"`
@@ -83,6 +55,7 @@ type Mount struct {
 	Content           interface{} `json:"content"`
 	ExcludeFromOutput bool        `json:"exclude_from_output"`
 	Capacity          int64       `json:"capacity"`
+	Mode              string      `json:"mode"`            // only if kind=="tmpfs"
 	Commit            string      `json:"commit"`          // only if kind=="git_tree"
 	RepositoryName    string      `json:"repository_name"` // only if kind=="git_tree"
 	GitURL            string      `json:"git_url"`         // only if kind=="git_tree"
@@ -95,14 +68,40 @@ type RuntimeConstraints struct {
 	RAM          int64 `json:"ram"`
 	VCPUs        int   `json:"vcpus"`
 	KeepCacheRAM int64 `json:"keep_cache_ram"`
+	// If not nil, overrides the ENTRYPOINT defined by the
+	// container image. An empty string means run the container
+	// command without any entrypoint.
+	Entrypoint *string `json:"entrypoint,omitempty"`
+	// GPUs needed by the container. If CUDA.DeviceCount is zero,
+	// the container does not get access to any GPUs.
+	CUDA CUDARuntimeConstraints `json:"cuda"`
+	// Number of output blocks crunch-run writes to Keep
+	// concurrently. If zero, crunch-run's -output-upload-threads
+	// setting is used.
+	OutputUploadThreads int `json:"output_upload_threads,omitempty"`
+}
+
+// CUDARuntimeConstraints specify the NVIDIA GPUs a container needs:
+// the number of devices, the minimum CUDA driver version (e.g.,
+// "11.0"), and the minimum hardware compute capability (e.g., "7.5").
+type CUDARuntimeConstraints struct {
+	DeviceCount        int    `json:"device_count"`
+	DriverVersion      string `json:"driver_version"`
+	HardwareCapability string `json:"hardware_capability"`
 }
 
 // SchedulingParameters specify a container's scheduling parameters
 // such as Partitions
 type SchedulingParameters struct {
-	Partitions  []string `json:"partitions"`
-	Preemptible bool     `json:"preemptible"`
-	MaxRunTime  int      `json:"max_run_time"`
+	Partitions             []string         `json:"partitions"`
+	Preemptible            bool             `json:"preemptible"`
+	MaxRunTime             int              `json:"max_run_time"`
+	Licenses               map[string]int   `json:"licenses,omitempty"`
+	BurstBuffers           map[string]int64 `json:"burst_buffers,omitempty"`
+	OutputSnapshotInterval int              `json:"output_snapshot_interval,omitempty"`
+	MaxOutputSize          int64            `json:"max_output_size,omitempty"`
+	Nodes                  int              `json:"nodes,omitempty"`
+	Tasks                  int              `json:"tasks,omitempty"`
 }
 
 // ContainerList is an arvados#containerList resource.
@@ -132,6 +131,22 @@ const (
 	ContainerStateCancelled = ContainerState("Cancelled")
 )
 
+// RuntimeStatusErrorOutOfMemory is the runtime_status["error"] value
+// reported by crunch-run when a container is killed by the kernel's
+// out-of-memory killer.
+const RuntimeStatusErrorOutOfMemory = "Out of memory"
+
+// RuntimeStatusErrorSignal is the runtime_status["error"] value
+// reported by crunch-run when a container's process is terminated by
+// a signal (other than an out-of-memory kill). The signal is given in
+// runtime_status["errorDetail"].
+const RuntimeStatusErrorSignal = "Terminated by signal"
+
+// RuntimeStatusErrorOutputTooLarge is the runtime_status["error"]
+// value reported by crunch-run when the files in a container's output
+// directory exceed the maximum output size.
+const RuntimeStatusErrorOutputTooLarge = "Output too large"
+
 // ContainerRequestState is a string corresponding to a valid Container Request state.
 type ContainerRequestState string
 
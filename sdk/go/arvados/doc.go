@@ -9,8 +9,12 @@
 //
 // The intent is to offer model types and API call functions that can
 // be generated automatically (or at least mostly automatically) from
-// a discovery document. For the time being, there is a manually
-// generated subset of those types and API calls with (approximately)
-// the right signatures, plus client/authentication support and some
-// convenience functions.
+// a discovery document. Some resource types and API endpoints (see
+// generated.go) are generated from a snapshot of the discovery
+// document (discovery.json) by generate.go; the rest are a manually
+// generated subset with (approximately) the right signatures. There
+// is also client/authentication support and some convenience
+// functions.
 package arvados
+
+//go:generate go run generate.go
@@ -0,0 +1,206 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/auth"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-z]{5}-[0-9a-z]{5}-[0-9a-z]{15}$`)
+
+// A FederatedClient sends API requests to the cluster that owns the
+// object being requested, as indicated by the cluster ID prefix of
+// its UUID. Requests for objects owned by the local cluster, and
+// requests that don't refer to a specific object, are sent to the
+// local cluster.
+//
+// Remote clusters are reached at the endpoints given in the local
+// cluster's RemoteClusters config. Tokens sent to a remote cluster
+// are salted for that cluster (see auth.SaltToken), so the remote
+// cluster can validate them with the local cluster without learning
+// the token's secret.
+//
+// A FederatedClient is safe for concurrent use.
+type FederatedClient struct {
+	// Client for the local cluster. Its AuthToken, and its other
+	// settings except APIHost, Scheme, and Insecure, are also used
+	// for remote clusters.
+	Local *Client
+
+	// ID of the local cluster.
+	ClusterID string
+
+	// Remote cluster endpoints, keyed by cluster ID.
+	RemoteClusters map[string]RemoteCluster
+
+	mtx     sync.Mutex
+	remotes map[string]remoteClient
+}
+
+// remoteClient is a Client for a remote cluster, and the local token
+// its AuthToken was salted from.
+type remoteClient struct {
+	client     *Client
+	localToken string
+}
+
+// NewFederatedClient returns a FederatedClient that uses the given
+// local client and the cluster's RemoteClusters config.
+func NewFederatedClient(cluster *Cluster, local *Client) *FederatedClient {
+	return &FederatedClient{
+		Local:          local,
+		ClusterID:      cluster.ClusterID,
+		RemoteClusters: cluster.RemoteClusters,
+	}
+}
+
+// ClusterIDFor returns the ID of the cluster that owns the object
+// with the given UUID. If id is not a UUID (e.g., it is a portable
+// data hash), ClusterIDFor returns the local cluster ID.
+func (fc *FederatedClient) ClusterIDFor(id string) string {
+	if uuidRegexp.MatchString(id) {
+		return id[:5]
+	}
+	return fc.ClusterID
+}
+
+// ClientFor returns a Client for the given cluster ID ("zzzzz") or
+// the cluster that owns the given object UUID
+// ("zzzzz-4zz18-abcdefghijklmno").
+//
+// Clients for remote clusters are cached, and replaced if the local
+// client's AuthToken changes.
+func (fc *FederatedClient) ClientFor(id string) (*Client, error) {
+	if len(id) != 5 {
+		id = fc.ClusterIDFor(id)
+	}
+	if id == fc.ClusterID {
+		return fc.Local, nil
+	}
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	if rc, ok := fc.remotes[id]; ok && rc.localToken == fc.Local.AuthToken {
+		return rc.client, nil
+	}
+	remote, ok := fc.RemoteClusters[id]
+	if !ok || remote.Host == "" {
+		return nil, fmt.Errorf("cannot route request to cluster %q: no RemoteClusters entry", id)
+	}
+	c := *fc.Local
+	c.APIHost = remote.Host
+	c.Scheme = remote.Scheme
+	c.Insecure = remote.Insecure
+	c.dd = nil
+	if c.AuthToken != "" {
+		var err error
+		c.AuthToken, err = fc.saltToken(context.Background(), c.AuthToken, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fc.remotes == nil {
+		fc.remotes = map[string]remoteClient{}
+	}
+	fc.remotes[id] = remoteClient{client: &c, localToken: fc.Local.AuthToken}
+	return &c, nil
+}
+
+// saltToken returns a version of token suitable for sending to the
+// given remote cluster. Tokens that are already salted (for that
+// cluster, or for another one, in which case the remote cluster
+// decides whether to accept it) are returned unchanged. Tokens in
+// the obsolete (v1) format are converted to v2 format by looking
+// them up on the local cluster.
+func (fc *FederatedClient) saltToken(ctx context.Context, token, remoteID string) (string, error) {
+	salted, err := auth.SaltToken(token, remoteID)
+	switch err {
+	case nil:
+		return salted, nil
+	case auth.ErrSalted:
+		return token, nil
+	case auth.ErrObsoleteToken:
+		var aca APIClientAuthorization
+		ctx = ContextWithAuthorization(ctx, "OAuth2 "+token)
+		err = fc.Local.RequestAndDecodeContext(ctx, &aca, "GET", "arvados/v1/api_client_authorizations/current", nil, nil)
+		if err != nil {
+			return "", fmt.Errorf("error looking up token to salt it for cluster %q: %s", remoteID, err)
+		}
+		if strings.HasPrefix(aca.UUID, remoteID) {
+			// The token was issued by the remote cluster
+			// itself.
+			return token, nil
+		}
+		return auth.SaltToken(aca.TokenV2(), remoteID)
+	default:
+		return "", fmt.Errorf("cannot salt token for cluster %q: %s", remoteID, err)
+	}
+}
+
+// clusterIDForRequest returns the ID of the cluster that should
+// handle a request: the "cluster_id" parameter if given (as used by
+// create and list APIs), otherwise the cluster that owns the first
+// UUID in the request path.
+func (fc *FederatedClient) clusterIDForRequest(path string, params interface{}) (string, error) {
+	if params != nil {
+		vals, err := anythingToValues(params)
+		if err != nil {
+			return "", err
+		}
+		if id := vals.Get("cluster_id"); id != "" {
+			return id, nil
+		}
+	}
+	for _, part := range strings.Split(path, "/") {
+		if uuidRegexp.MatchString(part) {
+			return part[:5], nil
+		}
+	}
+	return fc.ClusterID, nil
+}
+
+// RequestAndDecode is like (*Client)RequestAndDecode, but sends the
+// request to the cluster that owns the object being requested.
+func (fc *FederatedClient) RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error {
+	return fc.RequestAndDecodeContext(context.Background(), dst, method, path, body, params)
+}
+
+// RequestAndDecodeContext is like (*Client)RequestAndDecodeContext,
+// but sends the request to the cluster that owns the object being
+// requested.
+//
+// If ctx carries an Authorization value (see
+// ContextWithAuthorization), its token is salted for the remote
+// cluster too.
+func (fc *FederatedClient) RequestAndDecodeContext(ctx context.Context, dst interface{}, method, path string, body io.Reader, params interface{}) error {
+	id, err := fc.clusterIDForRequest(path, params)
+	if err != nil {
+		return err
+	}
+	c, err := fc.ClientFor(id)
+	if err != nil {
+		return err
+	}
+	if c != fc.Local {
+		if authz, _ := ctx.Value(contextKeyAuthorization{}).(string); authz != "" {
+			token := authz
+			for _, prefix := range []string{"OAuth2 ", "Bearer "} {
+				token = strings.TrimPrefix(token, prefix)
+			}
+			salted, err := fc.saltToken(ctx, token, id)
+			if err != nil {
+				return err
+			}
+			ctx = ContextWithAuthorization(ctx, "OAuth2 "+salted)
+		}
+	}
+	return c.RequestAndDecodeContext(ctx, dst, method, path, body, params)
+}
@@ -0,0 +1,139 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"context"
+	"net/http"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&federatedClientSuite{})
+
+type federatedClientSuite struct {
+	stub *stubTransport
+	fc   *FederatedClient
+}
+
+const fedTestToken = "v2/zzzzz-gj3su-077z32aux8dg2s1/3kg6k6lzmp9kj5cpkcoxie963cmvjahbt2fod9zru30k1jqdmi"
+
+func (s *federatedClientSuite) SetUpTest(c *check.C) {
+	s.stub = &stubTransport{Responses: map[string]string{
+		"/arvados/v1/collections/zzzzz-4zz18-fy296fx3hot09f7": `{"uuid":"zzzzz-4zz18-fy296fx3hot09f7"}`,
+		"/arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7": `{"uuid":"aaaaa-4zz18-fy296fx3hot09f7"}`,
+		"/arvados/v1/collections":                             `{"items":[]}`,
+		"/arvados/v1/api_client_authorizations/current":       `{"uuid":"zzzzz-gj3su-000000000000001","api_token":"obsoletetokenobsoletetokenobsoletetokenobsoletetoken"}`,
+	}}
+	cluster := &Cluster{
+		ClusterID: "zzzzz",
+		RemoteClusters: map[string]RemoteCluster{
+			"aaaaa": {Host: "aaaaa.example.com", Scheme: "https"},
+			"bbbbb": {Proxy: true},
+		},
+	}
+	s.fc = NewFederatedClient(cluster, &Client{
+		Client:    &http.Client{Transport: s.stub},
+		Scheme:    "https",
+		APIHost:   "zzzzz.example.com",
+		AuthToken: fedTestToken,
+	})
+}
+
+func (s *federatedClientSuite) lastRequest(c *check.C) (host, authz string) {
+	c.Assert(s.stub.Requests, check.Not(check.HasLen), 0)
+	req := s.stub.Requests[len(s.stub.Requests)-1]
+	return req.URL.Host, req.Header.Get("Authorization")
+}
+
+func (s *federatedClientSuite) TestRouteByUUID(c *check.C) {
+	var coll Collection
+	err := s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/zzzzz-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	host, authz := s.lastRequest(c)
+	c.Check(host, check.Equals, "zzzzz.example.com")
+	c.Check(authz, check.Equals, "OAuth2 "+fedTestToken)
+
+	err = s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	c.Check(coll.UUID, check.Equals, "aaaaa-4zz18-fy296fx3hot09f7")
+	host, authz = s.lastRequest(c)
+	c.Check(host, check.Equals, "aaaaa.example.com")
+	c.Check(authz, check.Equals, "OAuth2 v2/zzzzz-gj3su-077z32aux8dg2s1/8bab6f8d4b28e7ca7037912826434d679fd36ffa")
+
+	// PDHs, and requests with no UUID, go to the local cluster
+	s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/99999999999999999999999999999999+99", nil, nil)
+	host, _ = s.lastRequest(c)
+	c.Check(host, check.Equals, "zzzzz.example.com")
+	var colls CollectionList
+	err = s.fc.RequestAndDecode(&colls, "GET", "arvados/v1/collections", nil, nil)
+	c.Check(err, check.IsNil)
+	host, _ = s.lastRequest(c)
+	c.Check(host, check.Equals, "zzzzz.example.com")
+}
+
+func (s *federatedClientSuite) TestRouteByClusterIDParam(c *check.C) {
+	var colls CollectionList
+	err := s.fc.RequestAndDecode(&colls, "GET", "arvados/v1/collections", nil, map[string]interface{}{"cluster_id": "aaaaa"})
+	c.Check(err, check.IsNil)
+	host, _ := s.lastRequest(c)
+	c.Check(host, check.Equals, "aaaaa.example.com")
+}
+
+func (s *federatedClientSuite) TestUnknownCluster(c *check.C) {
+	for _, uuid := range []string{"ccccc-4zz18-fy296fx3hot09f7", "bbbbb-4zz18-fy296fx3hot09f7"} {
+		var coll Collection
+		err := s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+uuid, nil, nil)
+		c.Check(err, check.ErrorMatches, `cannot route request to cluster "`+uuid[:5]+`".*`)
+	}
+	c.Check(s.stub.Requests, check.HasLen, 0)
+}
+
+func (s *federatedClientSuite) TestContextAuthorization(c *check.C) {
+	var coll Collection
+	ctx := ContextWithAuthorization(context.Background(), "Bearer v2/zzzzz-gj3su-000000000000002/secretsecretsecret")
+	err := s.fc.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	_, authz := s.lastRequest(c)
+	c.Check(authz, check.Matches, `OAuth2 v2/zzzzz-gj3su-000000000000002/[0-9a-f]{40}`)
+}
+
+func (s *federatedClientSuite) TestSaltedToken(c *check.C) {
+	// A token salted for another cluster is passed through
+	// unchanged, like the controller's federation code does.
+	salted := "v2/zzzzz-gj3su-000000000000002/0123456789abcdef0123456789abcdef01234567"
+	var coll Collection
+	ctx := ContextWithAuthorization(context.Background(), "Bearer "+salted)
+	err := s.fc.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	_, authz := s.lastRequest(c)
+	c.Check(authz, check.Equals, "OAuth2 "+salted)
+}
+
+func (s *federatedClientSuite) TestLocalTokenChange(c *check.C) {
+	var coll Collection
+	err := s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	_, authz := s.lastRequest(c)
+	c.Check(authz, check.Equals, "OAuth2 v2/zzzzz-gj3su-077z32aux8dg2s1/8bab6f8d4b28e7ca7037912826434d679fd36ffa")
+
+	s.fc.Local.AuthToken = "v2/zzzzz-gj3su-000000000000002/secretsecretsecret"
+	err = s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	_, authz = s.lastRequest(c)
+	c.Check(authz, check.Matches, `OAuth2 v2/zzzzz-gj3su-000000000000002/[0-9a-f]{40}`)
+}
+
+func (s *federatedClientSuite) TestObsoleteToken(c *check.C) {
+	s.fc.Local.AuthToken = "obsoletetokenobsoletetokenobsoletetokenobsoletetoken"
+	var coll Collection
+	err := s.fc.RequestAndDecode(&coll, "GET", "arvados/v1/collections/aaaaa-4zz18-fy296fx3hot09f7", nil, nil)
+	c.Check(err, check.IsNil)
+	c.Assert(s.stub.Requests, check.HasLen, 2)
+	c.Check(s.stub.Requests[0].URL.Path, check.Equals, "/arvados/v1/api_client_authorizations/current")
+	c.Check(s.stub.Requests[0].Header.Get("Authorization"), check.Equals, "OAuth2 obsoletetokenobsoletetokenobsoletetokenobsoletetoken")
+	_, authz := s.lastRequest(c)
+	c.Check(authz, check.Matches, `OAuth2 v2/zzzzz-gj3su-000000000000001/[0-9a-f]{40}`)
+}
@@ -4,11 +4,15 @@
 
 package arvados
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 type fsBackend interface {
 	keepClient
 	apiClient
+	ReadAtContext(ctx context.Context, locator string, p []byte, off int) (int, error)
 }
 
 // Ideally *Client would do everything; meanwhile keepBackend
@@ -18,12 +22,28 @@ type keepBackend struct {
 	apiClient
 }
 
+// ReadAtContext calls the keepClient's ReadAtContext method if it has
+// one. Otherwise, it ignores ctx and calls ReadAt.
+func (kb keepBackend) ReadAtContext(ctx context.Context, locator string, p []byte, off int) (int, error) {
+	if kc, ok := kb.keepClient.(keepClientContext); ok {
+		return kc.ReadAtContext(ctx, locator, p, off)
+	}
+	return kb.keepClient.ReadAt(locator, p, off)
+}
+
 type keepClient interface {
 	ReadAt(locator string, p []byte, off int) (int, error)
 	PutB(p []byte) (string, int, error)
 	LocalLocator(locator string) (string, error)
 }
 
+// keepClientContext is implemented by keep clients (like
+// *keepclient.KeepClient) that can abandon a read when the caller's
+// context is cancelled.
+type keepClientContext interface {
+	ReadAtContext(ctx context.Context, locator string, p []byte, off int) (int, error)
+}
+
 type apiClient interface {
 	RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error
 }
@@ -5,6 +5,7 @@
 package arvados
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -71,6 +72,10 @@ type FileSystem interface {
 	// analogous to os.Stat()
 	Stat(name string) (os.FileInfo, error)
 
+	// Like Stat(), but return ctx.Err() without waiting for the
+	// lookup to finish if ctx is cancelled first.
+	StatContext(ctx context.Context, name string) (os.FileInfo, error)
+
 	// analogous to os.Create(): create/truncate a file and open it O_RDWR.
 	Create(name string) (File, error)
 
@@ -89,6 +94,12 @@ type FileSystem interface {
 	// be used by only one goroutine at a time.
 	OpenFile(name string, flag int, perm os.FileMode) (File, error)
 
+	// Like OpenFile(), but return ctx.Err() without waiting for
+	// the lookup to finish if ctx is cancelled first. Reads on
+	// the returned File abort pending Keep block fetches when
+	// ctx is cancelled.
+	OpenFileContext(ctx context.Context, name string, flag int, perm os.FileMode) (File, error)
+
 	Mkdir(name string, perm os.FileMode) error
 	Remove(name string) error
 	RemoveAll(name string) error
@@ -98,6 +109,11 @@ type FileSystem interface {
 	// all updates have been saved to persistent storage.
 	Sync() error
 
+	// Like Sync(), but return ctx.Err() without waiting for the
+	// sync to finish if ctx is cancelled first. The sync
+	// continues in the background.
+	SyncContext(ctx context.Context) error
+
 	// Write buffered data from memory to storage, but don't wait
 	// for all writes to finish before returning. If shortBlocks
 	// is true, flush everything; otherwise, if there's less than
@@ -115,7 +131,7 @@ type inode interface {
 	SetParent(parent inode, name string)
 	Parent() inode
 	FS() FileSystem
-	Read([]byte, filenodePtr) (int, filenodePtr, error)
+	Read(context.Context, []byte, filenodePtr) (int, filenodePtr, error)
 	Write([]byte, filenodePtr) (int, filenodePtr, error)
 	Truncate(int64) error
 	IsDir() bool
@@ -205,7 +221,7 @@ func (*nullnode) Mkdir(string, os.FileMode) error {
 	return ErrInvalidOperation
 }
 
-func (*nullnode) Read([]byte, filenodePtr) (int, filenodePtr, error) {
+func (*nullnode) Read(context.Context, []byte, filenodePtr) (int, filenodePtr, error) {
 	return 0, filenodePtr{}, ErrInvalidOperation
 }
 
@@ -363,6 +379,26 @@ func (fs *fileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, e
 	return fs.openFile(name, flag, perm)
 }
 
+// OpenFileContext is like OpenFile, but gives up when ctx is
+// cancelled. If the lookup finishes after ctx is cancelled, the
+// resulting file is closed.
+func (fs *fileSystem) OpenFileContext(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	var f *filehandle
+	err := waitContext(ctx, func() (err error) {
+		f, err = fs.openFile(name, flag, perm)
+		return
+	}, func() {
+		if f != nil {
+			f.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.ctx = ctx
+	return f, nil
+}
+
 func (fs *fileSystem) openFile(name string, flag int, perm os.FileMode) (*filehandle, error) {
 	if flag&os.O_SYNC != 0 {
 		return nil, ErrSyncNotSupported
@@ -483,6 +519,14 @@ func (fs *fileSystem) Stat(name string) (os.FileInfo, error) {
 	return node.FileInfo(), nil
 }
 
+func (fs *fileSystem) StatContext(ctx context.Context, name string) (fi os.FileInfo, err error) {
+	err = waitContext(ctx, func() (err error) {
+		fi, err = fs.Stat(name)
+		return
+	}, nil)
+	return
+}
+
 func (fs *fileSystem) Rename(oldname, newname string) error {
 	olddir, oldname := path.Split(oldname)
 	if oldname == "" || oldname == "." || oldname == ".." {
@@ -622,6 +666,10 @@ func (fs *fileSystem) Sync() error {
 	return ErrInvalidOperation
 }
 
+func (fs *fileSystem) SyncContext(ctx context.Context) error {
+	return waitContext(ctx, fs.Sync, nil)
+}
+
 func (fs *fileSystem) Flush(string, bool) error {
 	log.Printf("TODO: flush fileSystem")
 	return ErrInvalidOperation
@@ -631,6 +679,32 @@ func (fs *fileSystem) MemorySize() int64 {
 	return fs.root.MemorySize()
 }
 
+// waitContext calls fn and returns its error, or returns ctx.Err()
+// if ctx is cancelled before fn returns. In the latter case, fn
+// keeps running in a separate goroutine, and abandon (if not nil) is
+// called after fn returns.
+func waitContext(ctx context.Context, fn func() error, abandon func()) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			if abandon != nil {
+				abandon()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
 // rlookup (recursive lookup) returns the inode for the file/directory
 // with the given name (which may contain "/" separators). If no such
 // file/directory exists, the returned node is nil.
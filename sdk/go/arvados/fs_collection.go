@@ -153,7 +153,7 @@ func (fs *collectionFileSystem) Parent() inode {
 	return fs.rootnode().Parent()
 }
 
-func (fs *collectionFileSystem) Read(_ []byte, ptr filenodePtr) (int, filenodePtr, error) {
+func (fs *collectionFileSystem) Read(_ context.Context, _ []byte, ptr filenodePtr) (int, filenodePtr, error) {
 	return 0, ptr, ErrInvalidOperation
 }
 
@@ -197,6 +197,10 @@ func (fs *collectionFileSystem) Sync() error {
 	return nil
 }
 
+func (fs *collectionFileSystem) SyncContext(ctx context.Context) error {
+	return waitContext(ctx, fs.Sync, nil)
+}
+
 func (fs *collectionFileSystem) Flush(path string, shortBlocks bool) error {
 	node, err := rlookup(fs.fileSystem.root, path)
 	if err != nil {
@@ -252,6 +256,11 @@ func (fs *collectionFileSystem) Size() int64 {
 // corresponds to file offset filenodePtr.off. Otherwise, it is
 // necessary to reexamine len(filenode.segments[0]) etc. to find the
 // correct segment and offset.
+//
+// segmentOff can be negative, or beyond the end of the segment (e.g.,
+// after filehandle.Seek moves off without knowing segment sizes). In
+// that case it is measured from the start of segment segmentIdx, and
+// the correct segment can be found by walking from there.
 type filenodePtr struct {
 	off        int64
 	segmentIdx int
@@ -283,11 +292,17 @@ func (fn *filenode) seek(startPtr filenodePtr) (ptr filenodePtr) {
 		return
 	} else if ptr.repacked == fn.repacked {
 		// segmentIdx and segmentOff accurately reflect
-		// ptr.off, but might have fallen off the end of a
-		// segment
-		if ptr.segmentOff >= fn.segments[ptr.segmentIdx].Len() {
+		// ptr.off, but might be before the start or past the
+		// end of a segment. This is usually just one or two
+		// segments away, so walking is much faster than
+		// rescanning from the start of a big file.
+		for ptr.segmentOff < 0 {
+			ptr.segmentIdx--
+			ptr.segmentOff += fn.segments[ptr.segmentIdx].Len()
+		}
+		for ptr.segmentOff >= fn.segments[ptr.segmentIdx].Len() {
+			ptr.segmentOff -= fn.segments[ptr.segmentIdx].Len()
 			ptr.segmentIdx++
-			ptr.segmentOff = 0
 		}
 		return
 	}
@@ -358,7 +373,7 @@ func (fn *filenode) FS() FileSystem {
 // Read reads file data from a single segment, starting at startPtr,
 // into p. startPtr is assumed not to be up-to-date. Caller must have
 // RLock or Lock.
-func (fn *filenode) Read(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr, err error) {
+func (fn *filenode) Read(ctx context.Context, p []byte, startPtr filenodePtr) (n int, ptr filenodePtr, err error) {
 	ptr = fn.seek(startPtr)
 	if ptr.off < 0 {
 		err = ErrNegativeOffset
@@ -368,7 +383,7 @@ func (fn *filenode) Read(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr
 		err = io.EOF
 		return
 	}
-	n, err = fn.segments[ptr.segmentIdx].ReadAt(p, int64(ptr.segmentOff))
+	n, err = fn.segments[ptr.segmentIdx].ReadAtContext(ctx, p, int64(ptr.segmentOff))
 	if n > 0 {
 		ptr.off += int64(n)
 		ptr.segmentOff += n
@@ -395,6 +410,29 @@ func (fn *filenode) FileInfo() os.FileInfo {
 	return fn.fileinfo
 }
 
+// contentKey returns a string that identifies the file's content:
+// the block hash, size, offset, and length of each segment. It
+// returns false if some of the file's data is not stored in Keep
+// yet.
+func (fn *filenode) contentKey() (string, bool) {
+	fn.RLock()
+	defer fn.RUnlock()
+	var key strings.Builder
+	for _, seg := range fn.segments {
+		se, ok := seg.(storedSegment)
+		if !ok {
+			return "", false
+		}
+		loc := se.locator
+		if parts := strings.SplitN(loc, "+", 3); len(parts) == 3 {
+			// Omit hints, e.g., permission signatures.
+			loc = parts[0] + "+" + parts[1]
+		}
+		fmt.Fprintf(&key, "%s %d:%d\n", loc, se.offset, se.length)
+	}
+	return key.String(), true
+}
+
 func (fn *filenode) Truncate(size int64) error {
 	fn.Lock()
 	defer fn.Unlock()
@@ -1229,6 +1267,9 @@ func (dn *dirnode) TreeSize() (bytes int64) {
 
 type segment interface {
 	io.ReaderAt
+	// Like ReadAt, but abandon any network activity if ctx is
+	// cancelled.
+	ReadAtContext(ctx context.Context, p []byte, off int64) (int, error)
 	Len() int
 	// Return a new segment with a subsection of the data from this
 	// one. length<0 means length=Len()-off.
@@ -1299,6 +1340,10 @@ func (me *memSegment) WriteAt(p []byte, off int) {
 	copy(me.buf[off:], p)
 }
 
+func (me *memSegment) ReadAtContext(_ context.Context, p []byte, off int64) (int, error) {
+	return me.ReadAt(p, off)
+}
+
 func (me *memSegment) ReadAt(p []byte, off int64) (n int, err error) {
 	if off > int64(me.Len()) {
 		err = io.EOF
@@ -1333,19 +1378,23 @@ func (se storedSegment) Slice(n, size int) segment {
 }
 
 func (se storedSegment) ReadAt(p []byte, off int64) (n int, err error) {
+	return se.ReadAtContext(context.Background(), p, off)
+}
+
+func (se storedSegment) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
 	if off > int64(se.length) {
 		return 0, io.EOF
 	}
 	maxlen := se.length - int(off)
 	if len(p) > maxlen {
 		p = p[:maxlen]
-		n, err = se.kc.ReadAt(se.locator, p, int(off)+se.offset)
+		n, err = se.kc.ReadAtContext(ctx, se.locator, p, int(off)+se.offset)
 		if err == nil {
 			err = io.EOF
 		}
 		return
 	}
-	return se.kc.ReadAt(se.locator, p, int(off)+se.offset)
+	return se.kc.ReadAtContext(ctx, se.locator, p, int(off)+se.offset)
 }
 
 func canonicalName(name string) string {
@@ -6,6 +6,7 @@ package arvados
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -127,6 +128,42 @@ func (s *CollectionFSSuite) TestColonInFilename(c *check.C) {
 	c.Check(fis[0].Name(), check.Equals, "bar:bar")
 }
 
+func (s *CollectionFSSuite) TestContentKey(c *check.C) {
+	fs, err := (&Collection{
+		ManifestText: ". 3858f62230ac3c915f300c664312c63f+6+Afffffffffffffffffffffffffffffffffffffff@ffffffff 0:3:foo 3:3:bar 0:3:foo2\n" +
+			"./dir 3858f62230ac3c915f300c664312c63f+6 0:3:foo\n",
+	}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+	key := func(name string) (string, bool) {
+		f, err := fs.Open(name)
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		return f.(interface{ ContentKey() (string, bool) }).ContentKey()
+	}
+	foo, ok := key("foo")
+	c.Check(ok, check.Equals, true)
+	c.Check(foo, check.Equals, "3858f62230ac3c915f300c664312c63f+6 0:3\n")
+	bar, _ := key("bar")
+	c.Check(bar, check.Not(check.Equals), foo)
+	// Same content, different name/directory/signature
+	foo2, _ := key("foo2")
+	c.Check(foo2, check.Equals, foo)
+	dirfoo, _ := key("dir/foo")
+	c.Check(dirfoo, check.Equals, foo)
+	// Directories don't have content keys
+	_, ok = key("dir")
+	c.Check(ok, check.Equals, false)
+
+	// Unflushed data doesn't have a content key
+	f, err := fs.OpenFile("new", os.O_CREATE|os.O_RDWR, 0644)
+	c.Assert(err, check.IsNil)
+	_, err = f.Write([]byte("foo"))
+	c.Assert(err, check.IsNil)
+	f.Close()
+	_, ok = key("new")
+	c.Check(ok, check.Equals, false)
+}
+
 func (s *CollectionFSSuite) TestReaddirFull(c *check.C) {
 	f, err := s.fs.Open("/dir1")
 	c.Assert(err, check.IsNil)
@@ -1468,6 +1505,100 @@ func (s *CollectionFSUnitSuite) TestLargeManifest(c *check.C) {
 	c.Logf("%s Alloc=%d Sys=%d", time.Now(), memstats.Alloc, memstats.Sys)
 }
 
+func (s *CollectionFSUnitSuite) TestSeekManySegments(c *check.C) {
+	kc := &keepClientStub{blocks: map[string][]byte{}}
+	var data []byte
+	mtext := "."
+	for i := 0; i < 300; i++ {
+		block := make([]byte, 1+i*7%500)
+		for j := range block {
+			block[j] = byte(i + j)
+		}
+		hash := fmt.Sprintf("%x", md5.Sum(block))
+		kc.blocks[hash] = block
+		mtext += fmt.Sprintf(" %s+%d", hash, len(block))
+		data = append(data, block...)
+	}
+	mtext += fmt.Sprintf(" 0:%d:bigfile\n", len(data))
+	fs, err := (&Collection{ManifestText: mtext}).FileSystem(nil, kc)
+	c.Assert(err, check.IsNil)
+	f, err := fs.Open("bigfile")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	size := int64(len(data))
+	pos := int64(0)
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 1000)
+	for i := 0; i < 2000; i++ {
+		var off int64
+		whence := rnd.Intn(3)
+		switch whence {
+		case io.SeekStart:
+			off = rnd.Int63n(size)
+			pos = off
+		case io.SeekCurrent:
+			off = rnd.Int63n(size) - pos
+			pos += off
+		case io.SeekEnd:
+			off = -rnd.Int63n(size)
+			pos = size + off
+		}
+		got, err := f.Seek(off, whence)
+		c.Assert(err, check.IsNil)
+		c.Assert(got, check.Equals, pos)
+		n, err := io.ReadFull(f, buf[:rnd.Intn(len(buf))])
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		c.Assert(err, check.IsNil)
+		c.Assert(buf[:n], check.DeepEquals, data[pos:pos+int64(n)], check.Commentf("seek(%d, %d) to %d, read %d", off, whence, pos, n))
+		pos += int64(n)
+	}
+}
+
+// blockingKeepClientStub's reads block until the caller's context is
+// cancelled.
+type blockingKeepClientStub struct {
+	keepClientStub
+	reading chan struct{}
+}
+
+func (kcs *blockingKeepClientStub) ReadAtContext(ctx context.Context, locator string, p []byte, off int) (int, error) {
+	close(kcs.reading)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (s *CollectionFSUnitSuite) TestReadContextCancel(c *check.C) {
+	kc := &blockingKeepClientStub{reading: make(chan struct{})}
+	fs, err := (&Collection{
+		ManifestText: ". 3858f62230ac3c915f300c664312c63f+6 0:6:foobar\n",
+	}).FileSystem(nil, kc)
+	c.Assert(err, check.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fi, err := fs.StatContext(ctx, "foobar")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Size(), check.Equals, int64(6))
+
+	f, err := fs.OpenFileContext(ctx, "foobar", os.O_RDONLY, 0)
+	c.Assert(err, check.IsNil)
+	go func() {
+		<-kc.reading
+		cancel()
+	}()
+	n, err := f.Read(make([]byte, 6))
+	c.Check(n, check.Equals, 0)
+	c.Check(err, check.Equals, context.Canceled)
+
+	_, err = fs.StatContext(ctx, "foobar")
+	c.Check(err, check.Equals, context.Canceled)
+	_, err = fs.OpenFileContext(ctx, "foobar", os.O_RDONLY, 0)
+	c.Check(err, check.Equals, context.Canceled)
+	c.Check(fs.SyncContext(ctx), check.Equals, context.Canceled)
+}
+
 // Gocheck boilerplate
 func Test(t *testing.T) {
 	check.TestingT(t)
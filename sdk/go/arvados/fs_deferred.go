@@ -5,6 +5,7 @@
 package arvados
 
 import (
+	"context"
 	"log"
 	"os"
 	"sync"
@@ -75,8 +76,8 @@ func (dn *deferrednode) currentinode() inode {
 	return dn.wrapped
 }
 
-func (dn *deferrednode) Read(p []byte, pos filenodePtr) (int, filenodePtr, error) {
-	return dn.realinode().Read(p, pos)
+func (dn *deferrednode) Read(ctx context.Context, p []byte, pos filenodePtr) (int, filenodePtr, error) {
+	return dn.realinode().Read(ctx, p, pos)
 }
 
 func (dn *deferrednode) Write(p []byte, pos filenodePtr) (int, filenodePtr, error) {
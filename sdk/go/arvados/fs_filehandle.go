@@ -5,12 +5,14 @@
 package arvados
 
 import (
+	"context"
 	"io"
 	"os"
 )
 
 type filehandle struct {
 	inode
+	ctx        context.Context // nil means context.Background()
 	ptr        filenodePtr
 	append     bool
 	readable   bool
@@ -22,9 +24,13 @@ func (f *filehandle) Read(p []byte) (n int, err error) {
 	if !f.readable {
 		return 0, ErrWriteOnlyMode
 	}
+	ctx := f.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	f.inode.RLock()
 	defer f.inode.RUnlock()
-	n, f.ptr, err = f.inode.Read(p, f.ptr)
+	n, f.ptr, err = f.inode.Read(ctx, p, f.ptr)
 	return
 }
 
@@ -43,10 +49,12 @@ func (f *filehandle) Seek(off int64, whence int) (pos int64, err error) {
 		return f.ptr.off, ErrNegativeOffset
 	}
 	if ptr.off != f.ptr.off {
+		// Move segmentOff by the same amount as off, so
+		// filenode can find the new position relative to the
+		// current segment instead of scanning the whole file
+		// (this matters for ranged reads of large files).
+		ptr.segmentOff += int(ptr.off - f.ptr.off)
 		f.ptr = ptr
-		// force filenode to recompute f.ptr fields on next
-		// use
-		f.ptr.repacked = -1
 	}
 	return f.ptr.off, nil
 }
@@ -102,6 +110,19 @@ func (f *filehandle) Stat() (os.FileInfo, error) {
 	return f.inode.FileInfo(), nil
 }
 
+// ContentKey returns a string that identifies the file's content,
+// and true, if f is a regular file in a collection and all of its
+// data is stored in Keep. Files with the same content key have the
+// same content, regardless of their names, collections, and
+// modification times.
+func (f *filehandle) ContentKey() (string, bool) {
+	fn, ok := f.inode.(*filenode)
+	if !ok {
+		return "", false
+	}
+	return fn.contentKey()
+}
+
 func (f *filehandle) Close() error {
 	return nil
 }
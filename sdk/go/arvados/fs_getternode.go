@@ -6,6 +6,7 @@ package arvados
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"time"
 )
@@ -57,7 +58,7 @@ func (gn *getternode) FileInfo() os.FileInfo {
 	}
 }
 
-func (gn *getternode) Read(p []byte, ptr filenodePtr) (int, filenodePtr, error) {
+func (gn *getternode) Read(_ context.Context, p []byte, ptr filenodePtr) (int, filenodePtr, error) {
 	if err := gn.get(); err != nil {
 		return 0, ptr, err
 	}
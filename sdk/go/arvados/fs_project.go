@@ -88,6 +88,9 @@ func (fs *customFileSystem) projectsLoadAll(parent inode, uuid string) ([]inode,
 		Count:   "none",
 		Filters: filters,
 		Order:   "uuid",
+		// Manifests are loaded later, when a collection is
+		// accessed, so don't fetch them here.
+		Select: []string{"uuid", "name", "modified_at"},
 	}
 	for {
 		var resp CollectionList
@@ -113,6 +116,7 @@ func (fs *customFileSystem) projectsLoadAll(parent inode, uuid string) ([]inode,
 
 	filters = append(filters, Filter{"group_class", "=", "project"})
 	params.Filters = filters
+	params.Select = []string{"uuid", "name"}
 	for {
 		var resp GroupList
 		err = fs.RequestAndDecode(&resp, "GET", "arvados/v1/groups", nil, params)
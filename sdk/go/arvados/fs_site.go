@@ -5,6 +5,7 @@
 package arvados
 
 import (
+	"context"
 	"os"
 	"strings"
 	"sync"
@@ -118,6 +119,10 @@ func (fs *customFileSystem) Sync() error {
 	return fs.root.Sync()
 }
 
+func (fs *customFileSystem) SyncContext(ctx context.Context) error {
+	return waitContext(ctx, fs.Sync, nil)
+}
+
 // Stale returns true if information obtained at time t should be
 // considered stale.
 func (fs *customFileSystem) Stale(t time.Time) bool {
@@ -13,6 +13,7 @@ func (fs *customFileSystem) usersLoadOne(parent inode, name string) (inode, erro
 	err := fs.RequestAndDecode(&resp, "GET", "arvados/v1/users", nil, ResourceListParams{
 		Count:   "none",
 		Filters: []Filter{{"username", "=", name}},
+		Select:  []string{"uuid", "username"},
 	})
 	if err != nil {
 		return nil, err
@@ -25,8 +26,9 @@ func (fs *customFileSystem) usersLoadOne(parent inode, name string) (inode, erro
 
 func (fs *customFileSystem) usersLoadAll(parent inode) ([]inode, error) {
 	params := ResourceListParams{
-		Count: "none",
-		Order: "uuid",
+		Count:  "none",
+		Order:  "uuid",
+		Select: []string{"uuid", "username"},
 	}
 	var inodes []inode
 	for {
@@ -0,0 +1,403 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// +build ignore
+
+// Generate resource types and API endpoints from a snapshot of the
+// Arvados discovery document.
+//
+// Usage:
+//
+//	go run generate.go [-check]
+//	go run generate.go -fetch https://zzzzz.example.com/discovery/v1/apis/arvados/v1/rest
+//
+// With -fetch, discovery.json is replaced with the relevant parts
+// of the given discovery document (URL or local file) before
+// generating generated.go.
+//
+// With -check, generated.go is left alone, and the program exits
+// non-zero if it is out of date.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const (
+	snapshotFile  = "discovery.json"
+	generatedFile = "generated.go"
+)
+
+type discoveryDoc struct {
+	Kind        string              `json:"kind"`
+	Name        string              `json:"name"`
+	Version     string              `json:"version"`
+	ServicePath string              `json:"servicePath"`
+	Schemas     map[string]schema   `json:"schemas"`
+	Resources   map[string]resource `json:"resources"`
+}
+
+type schema struct {
+	ID         string              `json:"id"`
+	Type       string              `json:"type"`
+	UUIDPrefix string              `json:"uuidPrefix,omitempty"`
+	Properties map[string]property `json:"properties"`
+}
+
+type property struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+type resource struct {
+	Methods map[string]method `json:"methods"`
+}
+
+type method struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	HTTPMethod string `json:"httpMethod"`
+	Request    *struct {
+		Required   bool           `json:"required,omitempty"`
+		Properties map[string]ref `json:"properties"`
+	} `json:"request,omitempty"`
+	Response ref `json:"response"`
+}
+
+type ref struct {
+	Ref string `json:"$ref"`
+}
+
+// field is an attribute that isn't a database column (and therefore
+// isn't listed in the discovery document) but is returned by the
+// API server.
+type field struct {
+	name   string
+	goType string
+	tag    string
+}
+
+type resourceConfig struct {
+	schema   string
+	resource string
+	// columns that aren't returned by the API server
+	skip map[string]bool
+	// Go types that are more specific than the ones implied by
+	// the discovery document
+	types    map[string]string
+	extra    []field
+	comments map[string]string
+}
+
+var resources = []resourceConfig{
+	{
+		schema:   "Collection",
+		resource: "collections",
+		skip: map[string]bool{
+			"file_names": true,
+			"updated_at": true,
+		},
+		types: map[string]string{
+			"delete_at":                    "*time.Time",
+			"file_size_total":              "int64",
+			"replication_confirmed":        "*int",
+			"replication_confirmed_at":     "*time.Time",
+			"replication_desired":          "*int",
+			"storage_classes_confirmed":    "[]string",
+			"storage_classes_confirmed_at": "*time.Time",
+			"storage_classes_desired":      "[]string",
+			"trash_at":                     "*time.Time",
+		},
+		extra: []field{
+			{"unsigned_manifest_text", "string", `json:"unsigned_manifest_text"`},
+			{"writable_by", "[]string", `json:"writable_by,omitempty"`},
+		},
+	},
+	{
+		schema:   "Container",
+		resource: "containers",
+		skip: map[string]bool{
+			"runtime_token": true,
+			"updated_at":    true,
+		},
+		types: map[string]string{
+			"command":               "[]string",
+			"environment":           "map[string]string",
+			"finished_at":           "*time.Time",
+			"mounts":                "map[string]Mount",
+			"priority":              "int64",
+			"runtime_auth_scopes":   "[]string",
+			"runtime_constraints":   "RuntimeConstraints",
+			"scheduling_parameters": "SchedulingParameters",
+			"started_at":            "*time.Time",
+			"state":                 "ContainerState",
+		},
+		comments: map[string]string{
+			"finished_at": "nil if not yet finished",
+			"started_at":  "nil if not yet started",
+		},
+	},
+}
+
+// Go types for the types used in the discovery document.
+var goTypes = map[string]string{
+	"Array":    "[]interface{}",
+	"Hash":     "map[string]interface{}",
+	"boolean":  "bool",
+	"datetime": "time.Time",
+	"float":    "float64",
+	"integer":  "int",
+	"string":   "string",
+	"text":     "string",
+}
+
+// Words that are spelled in all caps in Go identifiers.
+var initialisms = map[string]bool{
+	"api":  true,
+	"id":   true,
+	"ssh":  true,
+	"ttl":  true,
+	"url":  true,
+	"uuid": true,
+}
+
+func main() {
+	checkOnly := flag.Bool("check", false, "exit non-zero if "+generatedFile+" is out of date, instead of updating it")
+	fetch := flag.String("fetch", "", "update "+snapshotFile+" from the given discovery document `URL` (or file) first")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: go run generate.go [-check] [-fetch URL]")
+		os.Exit(2)
+	}
+
+	if *fetch != "" {
+		err := updateSnapshot(*fetch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(snapshotFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var dd discoveryDoc
+	err = json.Unmarshal(buf, &dd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error decoding %s: %s\n", snapshotFile, err)
+		os.Exit(1)
+	}
+	src, err := generate(&dd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *checkOnly {
+		current, err := ioutil.ReadFile(generatedFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !bytes.Equal(current, src) {
+			diff := exec.Command("diff", "-u", generatedFile, "-")
+			diff.Stdin = bytes.NewReader(src)
+			diff.Stdout = os.Stdout
+			diff.Stderr = os.Stderr
+			diff.Run()
+			os.Exit(1)
+		}
+		return
+	}
+	err = ioutil.WriteFile(generatedFile, src, 0666)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// updateSnapshot replaces the discovery document snapshot with the
+// parts of the given document that are used by the generator.
+func updateSnapshot(source string) error {
+	var buf []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", source, resp.Status)
+		}
+		buf, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+	} else {
+		buf, err = ioutil.ReadFile(source)
+		if err != nil {
+			return err
+		}
+	}
+	var dd discoveryDoc
+	err = json.Unmarshal(buf, &dd)
+	if err != nil {
+		return fmt.Errorf("error decoding %s: %s", source, err)
+	}
+	trimmed := discoveryDoc{
+		Kind:        dd.Kind,
+		Name:        dd.Name,
+		Version:     dd.Version,
+		ServicePath: dd.ServicePath,
+		Schemas:     map[string]schema{},
+		Resources:   map[string]resource{},
+	}
+	for _, rc := range resources {
+		sch, ok := dd.Schemas[rc.schema]
+		if !ok {
+			return fmt.Errorf("%s: schema %q not found", source, rc.schema)
+		}
+		res, ok := dd.Resources[rc.resource]
+		if !ok {
+			return fmt.Errorf("%s: resource %q not found", source, rc.resource)
+		}
+		trimmed.Schemas[rc.schema] = sch
+		trimmed.Resources[rc.resource] = res
+	}
+	buf, err = json.MarshalIndent(trimmed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(snapshotFile, append(buf, '\n'), 0666)
+}
+
+func generate(dd *discoveryDoc) ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString(`// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//
+// -- this file is auto-generated -- do not edit -- edit generate.go or discovery.json and run "go generate" instead --
+//
+
+package arvados
+
+import "time"
+`)
+	var endpoints []string
+	for _, rc := range resources {
+		sch, ok := dd.Schemas[rc.schema]
+		if !ok {
+			return nil, fmt.Errorf("schema %q not found in %s", rc.schema, snapshotFile)
+		}
+		res, ok := dd.Resources[rc.resource]
+		if !ok {
+			return nil, fmt.Errorf("resource %q not found in %s", rc.resource, snapshotFile)
+		}
+
+		var fields []field
+		for name, prop := range sch.Properties {
+			if rc.skip[name] {
+				continue
+			}
+			goType, ok := rc.types[name]
+			if !ok {
+				goType, ok = goTypes[prop.Type]
+				if !ok {
+					return nil, fmt.Errorf("%s.%s: unsupported type %q", rc.schema, name, prop.Type)
+				}
+			}
+			fields = append(fields, field{name, goType, `json:"` + name + `"`})
+		}
+		fields = append(fields, rc.extra...)
+		sort.Slice(fields, func(i, j int) bool {
+			return fieldOrder(fields[i].name) < fieldOrder(fields[j].name)
+		})
+		fmt.Fprintf(&out, "\n// %s is an arvados#%s resource.\ntype %s struct {\n", rc.schema, lowerCamel(rc.schema), rc.schema)
+		for _, f := range fields {
+			fmt.Fprintf(&out, "\t%s %s `%s`", goName(f.name), f.goType, f.tag)
+			if comment, ok := rc.comments[f.name]; ok {
+				fmt.Fprintf(&out, " // %s", comment)
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString("}\n")
+
+		for name, m := range res.Methods {
+			if name == "index" {
+				// same as "list"
+				continue
+			}
+			httpMethod := m.HTTPMethod
+			if name == "update" {
+				// The API server accepts PUT and PATCH, and
+				// only updates the given attributes either
+				// way.
+				httpMethod = "PATCH"
+			}
+			attrsKey := ""
+			if m.Request != nil {
+				for key := range m.Request.Properties {
+					attrsKey = key
+				}
+			}
+			endpoints = append(endpoints, fmt.Sprintf("Endpoint%s%s = APIEndpoint{%q, %q, %q}",
+				rc.schema, goName(name), httpMethod, dd.ServicePath+m.Path, attrsKey))
+		}
+	}
+	sort.Strings(endpoints)
+	out.WriteString("\nvar (\n")
+	for _, ep := range endpoints {
+		out.WriteString("\t" + ep + "\n")
+	}
+	out.WriteString(")\n")
+	return format.Source(out.Bytes())
+}
+
+// fieldOrder returns a sort key that puts uuid and etag first, and
+// the rest in alphabetical order.
+func fieldOrder(name string) string {
+	switch name {
+	case "uuid":
+		return "0"
+	case "etag":
+		return "1"
+	default:
+		return "2" + name
+	}
+}
+
+// goName returns the Go identifier for an attribute or method name,
+// e.g., "modified_by_user_uuid" => "ModifiedByUserUUID".
+func goName(name string) string {
+	var s string
+	for _, word := range strings.Split(name, "_") {
+		if initialisms[word] {
+			s += strings.ToUpper(word)
+		} else if word != "" {
+			s += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return s
+}
+
+// lowerCamel returns the arvados#kind spelling of a schema name,
+// e.g., "ContainerRequest" => "containerRequest".
+func lowerCamel(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
@@ -0,0 +1,100 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//
+// -- this file is auto-generated -- do not edit -- edit generate.go or discovery.json and run "go generate" instead --
+//
+
+package arvados
+
+import "time"
+
+// Collection is an arvados#collection resource.
+type Collection struct {
+	UUID                      string                 `json:"uuid"`
+	Etag                      string                 `json:"etag"`
+	CreatedAt                 time.Time              `json:"created_at"`
+	CurrentVersionUUID        string                 `json:"current_version_uuid"`
+	DeleteAt                  *time.Time             `json:"delete_at"`
+	Description               string                 `json:"description"`
+	FileCount                 int                    `json:"file_count"`
+	FileSizeTotal             int64                  `json:"file_size_total"`
+	IsTrashed                 bool                   `json:"is_trashed"`
+	ManifestText              string                 `json:"manifest_text"`
+	ModifiedAt                time.Time              `json:"modified_at"`
+	ModifiedByClientUUID      string                 `json:"modified_by_client_uuid"`
+	ModifiedByUserUUID        string                 `json:"modified_by_user_uuid"`
+	Name                      string                 `json:"name"`
+	OwnerUUID                 string                 `json:"owner_uuid"`
+	PortableDataHash          string                 `json:"portable_data_hash"`
+	PreserveVersion           bool                   `json:"preserve_version"`
+	Properties                map[string]interface{} `json:"properties"`
+	ReplicationConfirmed      *int                   `json:"replication_confirmed"`
+	ReplicationConfirmedAt    *time.Time             `json:"replication_confirmed_at"`
+	ReplicationDesired        *int                   `json:"replication_desired"`
+	StorageClassesConfirmed   []string               `json:"storage_classes_confirmed"`
+	StorageClassesConfirmedAt *time.Time             `json:"storage_classes_confirmed_at"`
+	StorageClassesDesired     []string               `json:"storage_classes_desired"`
+	TrashAt                   *time.Time             `json:"trash_at"`
+	UnsignedManifestText      string                 `json:"unsigned_manifest_text"`
+	Version                   int                    `json:"version"`
+	WritableBy                []string               `json:"writable_by,omitempty"`
+}
+
+// Container is an arvados#container resource.
+type Container struct {
+	UUID                      string                 `json:"uuid"`
+	Etag                      string                 `json:"etag"`
+	AuthUUID                  string                 `json:"auth_uuid"`
+	Command                   []string               `json:"command"`
+	ContainerImage            string                 `json:"container_image"`
+	CreatedAt                 time.Time              `json:"created_at"`
+	Cwd                       string                 `json:"cwd"`
+	Environment               map[string]string      `json:"environment"`
+	ExitCode                  int                    `json:"exit_code"`
+	FinishedAt                *time.Time             `json:"finished_at"` // nil if not yet finished
+	GatewayAddress            string                 `json:"gateway_address"`
+	InteractiveSessionStarted bool                   `json:"interactive_session_started"`
+	LockCount                 int                    `json:"lock_count"`
+	LockedByUUID              string                 `json:"locked_by_uuid"`
+	Log                       string                 `json:"log"`
+	ModifiedAt                time.Time              `json:"modified_at"`
+	ModifiedByClientUUID      string                 `json:"modified_by_client_uuid"`
+	ModifiedByUserUUID        string                 `json:"modified_by_user_uuid"`
+	Mounts                    map[string]Mount       `json:"mounts"`
+	Output                    string                 `json:"output"`
+	OutputPath                string                 `json:"output_path"`
+	OwnerUUID                 string                 `json:"owner_uuid"`
+	Priority                  int64                  `json:"priority"`
+	Progress                  float64                `json:"progress"`
+	RuntimeAuthScopes         []string               `json:"runtime_auth_scopes"`
+	RuntimeConstraints        RuntimeConstraints     `json:"runtime_constraints"`
+	RuntimeStatus             map[string]interface{} `json:"runtime_status"`
+	RuntimeUserUUID           string                 `json:"runtime_user_uuid"`
+	SchedulingParameters      SchedulingParameters   `json:"scheduling_parameters"`
+	StartedAt                 *time.Time             `json:"started_at"` // nil if not yet started
+	State                     ContainerState         `json:"state"`
+}
+
+var (
+	EndpointCollectionCreate      = APIEndpoint{"POST", "arvados/v1/collections", "collection"}
+	EndpointCollectionDelete      = APIEndpoint{"DELETE", "arvados/v1/collections/{uuid}", ""}
+	EndpointCollectionGet         = APIEndpoint{"GET", "arvados/v1/collections/{uuid}", ""}
+	EndpointCollectionList        = APIEndpoint{"GET", "arvados/v1/collections", ""}
+	EndpointCollectionProvenance  = APIEndpoint{"GET", "arvados/v1/collections/{uuid}/provenance", ""}
+	EndpointCollectionTrash       = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/trash", ""}
+	EndpointCollectionUntrash     = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/untrash", ""}
+	EndpointCollectionUpdate      = APIEndpoint{"PATCH", "arvados/v1/collections/{uuid}", "collection"}
+	EndpointCollectionUsedBy      = APIEndpoint{"GET", "arvados/v1/collections/{uuid}/used_by", ""}
+	EndpointContainerAuth         = APIEndpoint{"GET", "arvados/v1/containers/{uuid}/auth", ""}
+	EndpointContainerCreate       = APIEndpoint{"POST", "arvados/v1/containers", "container"}
+	EndpointContainerCurrent      = APIEndpoint{"GET", "arvados/v1/containers/current", ""}
+	EndpointContainerDelete       = APIEndpoint{"DELETE", "arvados/v1/containers/{uuid}", ""}
+	EndpointContainerGet          = APIEndpoint{"GET", "arvados/v1/containers/{uuid}", ""}
+	EndpointContainerList         = APIEndpoint{"GET", "arvados/v1/containers", ""}
+	EndpointContainerLock         = APIEndpoint{"POST", "arvados/v1/containers/{uuid}/lock", ""}
+	EndpointContainerSecretMounts = APIEndpoint{"GET", "arvados/v1/containers/{uuid}/secret_mounts", ""}
+	EndpointContainerUnlock       = APIEndpoint{"POST", "arvados/v1/containers/{uuid}/unlock", ""}
+	EndpointContainerUpdate       = APIEndpoint{"PATCH", "arvados/v1/containers/{uuid}", "container"}
+)
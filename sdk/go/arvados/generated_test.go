@@ -0,0 +1,23 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"os/exec"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&UptodateSuite{})
+
+type UptodateSuite struct{}
+
+func (*UptodateSuite) TestUpToDate(c *check.C) {
+	output, err := exec.Command("go", "run", "generate.go", "-check").CombinedOutput()
+	if err != nil {
+		c.Log(string(output))
+		c.Error("generated.go is out of date -- run 'go generate' to update it")
+	}
+}
@@ -4,12 +4,24 @@
 
 package arvados
 
+import (
+	"context"
+	"time"
+)
+
 // Group is an arvados#group record
 type Group struct {
-	UUID       string `json:"uuid"`
-	Name       string `json:"name"`
-	OwnerUUID  string `json:"owner_uuid"`
-	GroupClass string `json:"group_class"`
+	UUID        string                 `json:"uuid"`
+	Name        string                 `json:"name"`
+	OwnerUUID   string                 `json:"owner_uuid"`
+	GroupClass  string                 `json:"group_class"`
+	Description string                 `json:"description"`
+	Properties  map[string]interface{} `json:"properties"`
+	IsTrashed   bool                   `json:"is_trashed"`
+	TrashAt     *time.Time             `json:"trash_at"`
+	DeleteAt    *time.Time             `json:"delete_at"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ModifiedAt  time.Time              `json:"modified_at"`
 }
 
 // GroupList is an arvados#groupList resource.
@@ -20,6 +32,94 @@ type GroupList struct {
 	Limit          int     `json:"limit"`
 }
 
+// GroupContentsParams expresses which results are requested from the
+// groups.contents API.
+type GroupContentsParams struct {
+	ResourceListParams
+
+	// Return items in subprojects as well as the given project.
+	Recursive bool `json:"recursive,omitempty"`
+
+	// Return the owners of the returned items in
+	// GroupContentsList.Included. Currently the only supported
+	// value is "owner_uuid".
+	Include string `json:"include,omitempty"`
+
+	// When listing the contents of all projects (empty project
+	// UUID), exclude items in the current user's home project.
+	ExcludeHomeProject bool `json:"exclude_home_project,omitempty"`
+}
+
+// GroupContentsList is a groups.contents API response. Items (and
+// Included) are of mixed types (collections, container requests,
+// projects, etc.) so they are returned as maps; the "kind" key
+// indicates the type of each item.
+type GroupContentsList struct {
+	Items          []map[string]interface{} `json:"items"`
+	Included       []map[string]interface{} `json:"included"`
+	ItemsAvailable int                      `json:"items_available"`
+	Offset         int                      `json:"offset"`
+	Limit          int                      `json:"limit"`
+}
+
 func (g Group) resourceName() string {
 	return "group"
 }
+
+// CreateGroup calls arvados.v1.groups.create with the given
+// attributes (e.g., "name", "group_class", "owner_uuid") and returns
+// the new Group record.
+func (c *Client) CreateGroup(ctx context.Context, attrs map[string]interface{}, ensureUniqueName bool) (Group, error) {
+	var g Group
+	err := c.RequestAndDecodeContext(ctx, &g, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+		"group":              attrs,
+		"ensure_unique_name": ensureUniqueName,
+	})
+	return g, err
+}
+
+// ListGroups calls arvados.v1.groups.list and returns one page of
+// results.
+func (c *Client) ListGroups(ctx context.Context, params ResourceListParams) (GroupList, error) {
+	var resp GroupList
+	err := c.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/groups", nil, params)
+	return resp, err
+}
+
+// GroupContents calls arvados.v1.groups.contents and returns one page
+// of the items owned by the given project (or, if uuid is empty, all
+// readable items).
+func (c *Client) GroupContents(ctx context.Context, uuid string, params GroupContentsParams) (GroupContentsList, error) {
+	path := "arvados/v1/groups/contents"
+	if uuid != "" {
+		path = "arvados/v1/groups/" + uuid + "/contents"
+	}
+	var resp GroupContentsList
+	err := c.RequestAndDecodeContext(ctx, &resp, "GET", path, nil, params)
+	return resp, err
+}
+
+// EachGroupContentsItem calls f once for every item returned by
+// GroupContents, fetching additional pages as needed. With
+// params.Recursive, this enumerates an entire project tree.
+//
+// EachGroupContentsItem stops if it encounters an error, such as f
+// returning a non-nil error.
+func (c *Client) EachGroupContentsItem(ctx context.Context, uuid string, params GroupContentsParams, f func(map[string]interface{}) error) error {
+	for {
+		page, err := c.GroupContents(ctx, uuid, params)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			err = f(item)
+			if err != nil {
+				return err
+			}
+		}
+		params.Offset = params.Offset + len(page.Items)
+		if len(page.Items) == 0 || params.Offset >= page.ItemsAvailable {
+			return nil
+		}
+	}
+}
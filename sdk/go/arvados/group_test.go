@@ -0,0 +1,105 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&GroupSuite{})
+
+type GroupSuite struct{}
+
+// contentsTransport serves groups.contents pages from a fixed list of
+// items, honoring the limit and offset parameters.
+type contentsTransport struct {
+	items    []map[string]interface{}
+	pageSize int
+	requests []*http.Request
+}
+
+func (ct *contentsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.requests = append(ct.requests, req)
+	offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+	end := offset + ct.pageSize
+	if end > len(ct.items) {
+		end = len(ct.items)
+	}
+	buf, _ := json.Marshal(GroupContentsList{
+		Items:          ct.items[offset:end],
+		ItemsAvailable: len(ct.items),
+		Offset:         offset,
+		Limit:          ct.pageSize,
+	})
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Body:       ioutil.NopCloser(bytes.NewReader(buf)),
+	}, nil
+}
+
+func (s *GroupSuite) TestEachGroupContentsItem(c *check.C) {
+	ct := &contentsTransport{pageSize: 3}
+	for i := 0; i < 7; i++ {
+		ct.items = append(ct.items, map[string]interface{}{
+			"kind": "arvados#collection",
+			"uuid": fmt.Sprintf("zzzzz-4zz18-%015d", i),
+		})
+	}
+	client := &Client{
+		Client:    &http.Client{Transport: ct},
+		APIHost:   "zzzzz.arvadosapi.com",
+		AuthToken: "xyzzy",
+	}
+	var got []string
+	err := client.EachGroupContentsItem(context.Background(), "zzzzz-j7d0g-000000000000000", GroupContentsParams{
+		ResourceListParams: ResourceListParams{
+			Filters:      []Filter{{"uuid", "is_a", "arvados#collection"}},
+			Order:        "name",
+			IncludeTrash: true,
+		},
+		Recursive: true,
+	}, func(item map[string]interface{}) error {
+		got = append(got, item["uuid"].(string))
+		return nil
+	})
+	c.Check(err, check.IsNil)
+	c.Check(got, check.HasLen, 7)
+	c.Check(got[6], check.Equals, "zzzzz-4zz18-000000000000006")
+	c.Assert(ct.requests, check.HasLen, 3)
+	for _, req := range ct.requests {
+		c.Check(req.URL.Path, check.Equals, "/arvados/v1/groups/zzzzz-j7d0g-000000000000000/contents")
+		q := req.URL.Query()
+		c.Check(q.Get("recursive"), check.Equals, "true")
+		c.Check(q.Get("include_trash"), check.Equals, "true")
+		c.Check(q.Get("order"), check.Equals, "name")
+		c.Check(q.Get("filters"), check.Equals, `[["uuid","is_a","arvados#collection"]]`)
+	}
+
+	// Stop early if f returns an error
+	got = nil
+	err = client.EachGroupContentsItem(context.Background(), "", GroupContentsParams{}, func(item map[string]interface{}) error {
+		got = append(got, item["uuid"].(string))
+		if len(got) == 2 {
+			return fmt.Errorf("stop")
+		}
+		return nil
+	})
+	c.Check(err, check.ErrorMatches, "stop")
+	c.Check(got, check.HasLen, 2)
+	c.Check(ct.requests[len(ct.requests)-1].URL.Path, check.Equals, "/arvados/v1/groups/contents")
+}
@@ -33,6 +33,17 @@ type KeepMount struct {
 	ReadOnly       bool            `json:"read_only"`
 	Replication    int             `json:"replication"`
 	StorageClasses map[string]bool `json:"storage_classes"`
+
+	// Keepstore's BlobSigningTTL and BlobTrashLifetime settings
+	// (zero if the server doesn't report them).
+	BlobSigningTTL    Duration `json:"blob_signing_ttl,omitempty"`
+	BlobTrashLifetime Duration `json:"blob_trash_lifetime,omitempty"`
+
+	// Space used and available on the underlying device, as
+	// reported by the volume driver when the mount list was
+	// retrieved (zero if the server doesn't report them).
+	BytesFree uint64 `json:"bytes_free,omitempty"`
+	BytesUsed uint64 `json:"bytes_used,omitempty"`
 }
 
 // KeepServiceList is an arvados#keepServiceList record
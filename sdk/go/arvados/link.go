@@ -4,6 +4,8 @@
 
 package arvados
 
+import "time"
+
 // Link is an arvados#link record
 type Link struct {
 	UUID       string                 `json:"uuid,omiempty"`
@@ -15,6 +17,7 @@ type Link struct {
 	TailUUID   string                 `json:"tail_uuid"`
 	TailKind   string                 `json:"tail_kind"`
 	Properties map[string]interface{} `json:"properties"`
+	CreatedAt  time.Time              `json:"created_at"`
 }
 
 // LinkList is an arvados#linkList resource.
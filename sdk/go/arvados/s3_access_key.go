@@ -0,0 +1,78 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// S3AccessKeyLinkClass is the link_class of the link records used
+// to store S3 access keys. The link name is the access key ID, the
+// tail is the user the key was issued to, and the head is the token
+// used to authorize requests signed with the key.
+const S3AccessKeyLinkClass = "s3_access_key"
+
+// S3AccessKeyIDPrefix is the prefix of all S3 access key IDs issued
+// by controller. It distinguishes them from the other kinds of
+// access key accepted by keep-web (token UUIDs and entire tokens).
+const S3AccessKeyIDPrefix = "ARVS3"
+
+var s3AccessKeyIDRegexp = regexp.MustCompile(`^` + S3AccessKeyIDPrefix + `[A-Z2-7]{15}$`)
+
+// S3AccessKey is an access key pair for the keep-web S3 API.
+type S3AccessKey struct {
+	UUID            string     `json:"uuid"`
+	AccessKeyID     string     `json:"access_key_id"`
+	SecretAccessKey string     `json:"secret_access_key,omitempty"` // only returned when the key is created
+	UserUUID        string     `json:"user_uuid"`
+	TokenUUID       string     `json:"token_uuid"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// S3AccessKeyList is an arvados#s3AccessKeyList resource.
+type S3AccessKeyList struct {
+	Items          []S3AccessKey `json:"items"`
+	ItemsAvailable int           `json:"items_available"`
+}
+
+// IsS3AccessKeyID returns true if id has the format of an S3 access
+// key ID issued by controller.
+func IsS3AccessKeyID(id string) bool {
+	return s3AccessKeyIDRegexp.MatchString(id)
+}
+
+// S3SecretAccessKey returns the secret key corresponding to the
+// given access key ID. The secret is derived from the cluster's
+// SystemRootToken, so it does not need to be stored, and it cannot
+// be used as an Arvados API token.
+func S3SecretAccessKey(systemRootToken, accessKeyID string) string {
+	h := hmac.New(sha256.New, []byte(systemRootToken))
+	io.WriteString(h, "s3-access-key:"+accessKeyID)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// S3AccessKeyFromLink returns the S3AccessKey stored in the given
+// link record. The returned key's SecretAccessKey is empty.
+func S3AccessKeyFromLink(link Link) S3AccessKey {
+	key := S3AccessKey{
+		UUID:        link.UUID,
+		AccessKeyID: link.Name,
+		UserUUID:    link.TailUUID,
+		TokenUUID:   link.HeadUUID,
+		CreatedAt:   link.CreatedAt,
+	}
+	if s, ok := link.Properties["expires_at"].(string); ok && s != "" {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			key.ExpiresAt = &t
+		}
+	}
+	return key
+}
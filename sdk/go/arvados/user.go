@@ -4,7 +4,10 @@
 
 package arvados
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // User is an arvados#user record
 type User struct {
@@ -43,3 +46,19 @@ func (c *Client) CurrentUser() (User, error) {
 	err := c.RequestAndDecode(&u, "GET", "arvados/v1/users/current", nil, nil)
 	return u, err
 }
+
+// GetUser calls arvados.v1.users.get and returns the User record
+// with the given UUID.
+func (c *Client) GetUser(ctx context.Context, uuid string) (User, error) {
+	var u User
+	err := c.RequestAndDecodeContext(ctx, &u, "GET", "arvados/v1/users/"+uuid, nil, nil)
+	return u, err
+}
+
+// ListUsers calls arvados.v1.users.list and returns one page of
+// results.
+func (c *Client) ListUsers(ctx context.Context, params ResourceListParams) (UserList, error) {
+	var resp UserList
+	err := c.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/users", nil, params)
+	return resp, err
+}
@@ -35,6 +35,7 @@ var PDHMatch StringMatcher = regexp.MustCompile(`^[0-9a-f]{32}\+\d+$`).MatchStri
 var MissingArvadosApiHost = errors.New("Missing required environment variable ARVADOS_API_HOST")
 var MissingArvadosApiToken = errors.New("Missing required environment variable ARVADOS_API_TOKEN")
 var ErrInvalidArgument = errors.New("Invalid argument")
+var ErrResponseTooLarge = errors.New("response body exceeds MaxResponseSize")
 
 // A common failure mode is to reuse a keepalive connection that has been
 // terminated (in a way that we can't detect) for being idle too long.
@@ -104,8 +105,15 @@ type ArvadosClient struct {
 	// Client object shared by client requests.  Supports HTTP KeepAlive.
 	Client *http.Client
 
-	// If true, sets the X-External-Client header to indicate
-	// the client is outside the cluster.
+	// Network zone hint sent to the API server, which uses it to
+	// choose between keepstore and keepproxy services during Keep
+	// service discovery. If empty, the API server decides.
+	NetworkZone NetworkZone
+
+	// If true, and NetworkZone is empty, the client behaves as if
+	// NetworkZone were NetworkZoneExternal.
+	//
+	// Deprecated: use NetworkZone instead.
 	External bool
 
 	// Base URIs of Keep services, e.g., {"https://host1:8443",
@@ -124,6 +132,12 @@ type ArvadosClient struct {
 
 	// X-Request-Id for outgoing requests
 	RequestID string
+
+	// If non-zero, reading more than this many bytes from a
+	// response body fails with ErrResponseTooLarge. This protects
+	// memory-constrained callers from unexpectedly large
+	// responses, e.g., list responses with large manifests.
+	MaxResponseSize int64
 }
 
 var CertFiles = []string{
@@ -188,14 +202,24 @@ func New(c *arvados.Client) (*ArvadosClient, error) {
 
 // MakeArvadosClient creates a new ArvadosClient using the standard
 // environment variables ARVADOS_API_HOST, ARVADOS_API_TOKEN,
-// ARVADOS_API_HOST_INSECURE, ARVADOS_EXTERNAL_CLIENT, and
+// ARVADOS_API_HOST_INSECURE, ARVADOS_NETWORK_ZONE, and
 // ARVADOS_KEEP_SERVICES.
+//
+// If ARVADOS_NETWORK_ZONE is not set, the deprecated
+// ARVADOS_EXTERNAL_CLIENT variable is used instead.
 func MakeArvadosClient() (ac *ArvadosClient, err error) {
 	ac, err = New(arvados.NewClientFromEnv())
 	if err != nil {
 		return
 	}
-	ac.External = StringBool(os.Getenv("ARVADOS_EXTERNAL_CLIENT"))
+	if zone := os.Getenv("ARVADOS_NETWORK_ZONE"); zone != "" {
+		ac.NetworkZone, err = ParseNetworkZone(zone)
+		if err != nil {
+			return nil, fmt.Errorf("ARVADOS_NETWORK_ZONE: %s", err)
+		}
+	} else if StringBool(os.Getenv("ARVADOS_EXTERNAL_CLIENT")) {
+		ac.NetworkZone = NetworkZoneExternal
+	}
 	return
 }
 
@@ -274,8 +298,13 @@ func (c *ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 		if c.RequestID != "" {
 			req.Header.Add("X-Request-Id", c.RequestID)
 		}
-		if c.External {
-			req.Header.Add("X-External-Client", "1")
+		if zone := c.EffectiveNetworkZone(); zone != NetworkZoneDefault {
+			req.Header.Add(NetworkZoneHeader, string(zone))
+			if zone == NetworkZoneExternal {
+				// Older API servers only recognize
+				// X-External-Client.
+				req.Header.Add("X-External-Client", "1")
+			}
 		}
 
 		resp, err = c.Client.Do(req)
@@ -289,6 +318,13 @@ func (c *ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 		}
 
 		if resp.StatusCode == http.StatusOK {
+			if c.MaxResponseSize > 0 {
+				if resp.ContentLength > c.MaxResponseSize {
+					resp.Body.Close()
+					return nil, ErrResponseTooLarge
+				}
+				return &limitedReadCloser{ReadCloser: resp.Body, remain: c.MaxResponseSize}, nil
+			}
 			return resp.Body, nil
 		}
 
@@ -309,6 +345,28 @@ func (c *ArvadosClient) CallRaw(method string, resourceType string, uuid string,
 	return nil, err
 }
 
+// limitedReadCloser returns ErrResponseTooLarge instead of reading
+// more than the given number of bytes.
+type limitedReadCloser struct {
+	io.ReadCloser
+	remain int64
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if r.remain < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > r.remain+1 {
+		p = p[:r.remain+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remain -= int64(n)
+	if r.remain < 0 {
+		return n + int(r.remain), ErrResponseTooLarge
+	}
+	return n, err
+}
+
 func newAPIServerError(ServerAddress string, resp *http.Response) APIServerError {
 
 	ase := APIServerError{
@@ -5,10 +5,13 @@
 package arvadosclient
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
@@ -344,3 +347,182 @@ func (s *MockArvadosServerSuite) TestWithRetries(c *C) {
 		}
 	}
 }
+
+func (s *UnitSuite) TestParseNetworkZone(c *C) {
+	for in, expect := range map[string]NetworkZone{
+		"":          NetworkZoneDefault,
+		"internal":  NetworkZoneInternal,
+		"External":  NetworkZoneExternal,
+		" external": NetworkZoneExternal,
+	} {
+		zone, err := ParseNetworkZone(in)
+		c.Check(err, IsNil)
+		c.Check(zone, Equals, expect)
+	}
+	_, err := ParseNetworkZone("outside")
+	c.Check(err, ErrorMatches, `invalid network zone "outside".*`)
+}
+
+func (s *MockArvadosServerSuite) TestNetworkZoneFromEnv(c *C) {
+	defer os.Unsetenv("ARVADOS_EXTERNAL_CLIENT")
+	defer os.Unsetenv("ARVADOS_NETWORK_ZONE")
+
+	os.Setenv("ARVADOS_EXTERNAL_CLIENT", "true")
+	arv, err := MakeArvadosClient()
+	c.Assert(err, IsNil)
+	c.Check(arv.EffectiveNetworkZone(), Equals, NetworkZoneExternal)
+
+	// ARVADOS_NETWORK_ZONE takes precedence
+	os.Setenv("ARVADOS_NETWORK_ZONE", "internal")
+	arv, err = MakeArvadosClient()
+	c.Assert(err, IsNil)
+	c.Check(arv.EffectiveNetworkZone(), Equals, NetworkZoneInternal)
+
+	os.Setenv("ARVADOS_NETWORK_ZONE", "bogus")
+	_, err = MakeArvadosClient()
+	c.Check(err, ErrorMatches, `ARVADOS_NETWORK_ZONE: invalid network zone.*`)
+}
+
+type headerRecorder struct {
+	header http.Header
+}
+
+func (h *headerRecorder) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.header = req.Header
+	resp.Write([]byte(`{}`))
+}
+
+func (s *MockArvadosServerSuite) TestNetworkZoneHeader(c *C) {
+	h := &headerRecorder{}
+	api, err := RunFakeArvadosServer(h)
+	c.Assert(err, IsNil)
+	defer api.listener.Close()
+
+	for _, trial := range []struct {
+		zone           NetworkZone
+		external       bool
+		expectZone     string
+		expectExternal string
+	}{
+		{NetworkZoneDefault, false, "", ""},
+		{NetworkZoneDefault, true, "external", "1"},
+		{NetworkZoneExternal, false, "external", "1"},
+		{NetworkZoneInternal, false, "internal", ""},
+		{NetworkZoneInternal, true, "internal", ""},
+	} {
+		arv := ArvadosClient{
+			Scheme:      "http",
+			ApiServer:   api.url,
+			ApiToken:    "abc123",
+			Client:      &http.Client{Transport: &http.Transport{}},
+			NetworkZone: trial.zone,
+			External:    trial.external,
+		}
+		err = arv.Call("GET", "keep_services", "", "accessible", nil, nil)
+		c.Check(err, IsNil)
+		c.Check(h.header.Get(NetworkZoneHeader), Equals, trial.expectZone)
+		c.Check(h.header.Get("X-External-Client"), Equals, trial.expectExternal)
+	}
+}
+
+func (s *UnitSuite) TestDecodeListItems(c *C) {
+	var uuids []string
+	other, err := DecodeListItems(strings.NewReader(`{"kind":"arvados#collectionList","items":[{"uuid":"a"},{"uuid":"b","x":[1,{}]}],"items_available":3}`), func(item json.RawMessage) error {
+		var v struct{ UUID string }
+		err := json.Unmarshal(item, &v)
+		uuids = append(uuids, v.UUID)
+		return err
+	})
+	c.Check(err, IsNil)
+	c.Check(uuids, DeepEquals, []string{"a", "b"})
+	c.Check(other, DeepEquals, Dict{"kind": "arvados#collectionList", "items_available": float64(3)})
+
+	// Error from callback stops decoding
+	calls := 0
+	_, err = DecodeListItems(strings.NewReader(`{"items":[{},{},{}]}`), func(json.RawMessage) error {
+		calls++
+		return errors.New("stop")
+	})
+	c.Check(err, ErrorMatches, "stop")
+	c.Check(calls, Equals, 1)
+
+	for _, bad := range []string{``, `[]`, `{"items":{}}`, `{"items":[{}`} {
+		_, err = DecodeListItems(strings.NewReader(bad), func(json.RawMessage) error { return nil })
+		c.Check(err, NotNil, Commentf("%q", bad))
+	}
+}
+
+type listStub struct {
+	body          string
+	contentLength bool
+}
+
+func (h *listStub) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if h.contentLength {
+		resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(h.body)))
+	} else if f, ok := resp.(http.Flusher); ok {
+		// Flush headers before writing the body, so the
+		// response is chunked and the client doesn't know
+		// its size in advance.
+		f.Flush()
+	}
+	resp.Write([]byte(h.body))
+}
+
+func (s *MockArvadosServerSuite) TestListEach(c *C) {
+	h := &listStub{body: `{"items":[{"uuid":"a"},{"uuid":"b"}],"items_available":2}`}
+	api, err := RunFakeArvadosServer(h)
+	c.Assert(err, IsNil)
+	defer api.listener.Close()
+	arv := ArvadosClient{
+		Scheme:    "http",
+		ApiServer: api.url,
+		ApiToken:  "abc123",
+		Client:    &http.Client{Transport: &http.Transport{}},
+	}
+	var items []string
+	other, err := arv.ListEach("collections", nil, func(item json.RawMessage) error {
+		items = append(items, string(item))
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(items, DeepEquals, []string{`{"uuid":"a"}`, `{"uuid":"b"}`})
+	c.Check(other["items_available"], Equals, float64(2))
+}
+
+func (s *MockArvadosServerSuite) TestMaxResponseSize(c *C) {
+	h := &listStub{body: `{"items":[{"uuid":"a"},{"uuid":"b"}]}`}
+	api, err := RunFakeArvadosServer(h)
+	c.Assert(err, IsNil)
+	defer api.listener.Close()
+	arv := ArvadosClient{
+		Scheme:    "http",
+		ApiServer: api.url,
+		ApiToken:  "abc123",
+		Client:    &http.Client{Transport: &http.Transport{}},
+	}
+	for _, trial := range []struct {
+		max           int64
+		contentLength bool
+		expectErr     error
+	}{
+		{0, false, nil},
+		{int64(len(h.body)), false, nil},
+		{int64(len(h.body)), true, nil},
+		{int64(len(h.body)) - 1, false, ErrResponseTooLarge},
+		{int64(len(h.body)) - 1, true, ErrResponseTooLarge},
+		{10, false, ErrResponseTooLarge},
+	} {
+		c.Logf("trial %+v", trial)
+		h.contentLength = trial.contentLength
+		arv.MaxResponseSize = trial.max
+		var resp Dict
+		err = arv.List("collections", nil, &resp)
+		if trial.expectErr == nil {
+			c.Check(err, IsNil)
+			c.Check(resp["items"], HasLen, 2)
+		} else {
+			c.Check(err, Equals, trial.expectErr)
+		}
+	}
+}
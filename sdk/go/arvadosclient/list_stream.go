@@ -0,0 +1,92 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadosclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DecodeListItems decodes a list response (an object with an "items"
+// array) from r, calling fn with each item in turn instead of
+// decoding the whole items array into memory at once. The other
+// top-level fields (e.g., "items_available") are returned in a Dict.
+//
+// If fn returns an error, DecodeListItems stops reading and returns
+// that error.
+func DecodeListItems(r io.Reader, fn func(item json.RawMessage) error) (Dict, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	other := Dict{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T in list response", tok)
+		}
+		if key != "items" {
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			other[key] = v
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+		for dec.More() {
+			var item json.RawMessage
+			if err := dec.Decode(&item); err != nil {
+				return nil, err
+			}
+			if err := fn(item); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return other, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q in list response, got %v", delim, tok)
+	}
+	return nil
+}
+
+// ListEach calls the List API for the given resource type, and calls
+// fn with each item in the response as it is decoded (see
+// DecodeListItems). It returns the other top-level fields of the
+// response, such as "items_available".
+//
+// Like List, ListEach retrieves a single page: use "offset" or
+// filters in parameters to retrieve subsequent pages.
+func (c *ArvadosClient) ListEach(resource string, parameters Dict, fn func(item json.RawMessage) error) (Dict, error) {
+	reader, err := c.CallRaw("GET", resource, "", "", parameters)
+	if reader != nil {
+		defer reader.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodeListItems(reader, fn)
+}
@@ -0,0 +1,62 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvadosclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NetworkZone indicates where a client is located relative to the
+// cluster's internal network. The API server uses it to decide which
+// Keep services to offer the client: keepstore servers for internal
+// clients, or keepproxy for external clients.
+type NetworkZone string
+
+const (
+	// NetworkZoneDefault leaves the decision to the API server
+	// (or the proxy in front of it, which typically sets
+	// X-External-Client based on the client's IP address).
+	NetworkZoneDefault NetworkZone = ""
+
+	// NetworkZoneInternal indicates the client can connect
+	// directly to keepstore servers. The API server ignores this
+	// hint if the proxy in front of it has marked the client as
+	// external.
+	NetworkZoneInternal NetworkZone = "internal"
+
+	// NetworkZoneExternal indicates the client is outside the
+	// cluster's internal network and should use keepproxy.
+	NetworkZoneExternal NetworkZone = "external"
+)
+
+// NetworkZoneHeader is the HTTP request header used to send the
+// client's network zone to the API server.
+const NetworkZoneHeader = "X-Arvados-Network-Zone"
+
+// ParseNetworkZone returns the NetworkZone corresponding to s
+// ("internal", "external", or "" for the default), or an error if s
+// is not a recognized network zone.
+func ParseNetworkZone(s string) (NetworkZone, error) {
+	switch zone := NetworkZone(strings.ToLower(strings.TrimSpace(s))); zone {
+	case NetworkZoneDefault, NetworkZoneInternal, NetworkZoneExternal:
+		return zone, nil
+	default:
+		return NetworkZoneDefault, fmt.Errorf("invalid network zone %q (must be %q or %q)", s, NetworkZoneInternal, NetworkZoneExternal)
+	}
+}
+
+// EffectiveNetworkZone returns c.NetworkZone if it is set. Otherwise,
+// it returns NetworkZoneExternal if the deprecated External flag is
+// set, and NetworkZoneDefault if not.
+func (c *ArvadosClient) EffectiveNetworkZone() NetworkZone {
+	if c.NetworkZone != NetworkZoneDefault {
+		return c.NetworkZone
+	}
+	if c.External {
+		return NetworkZoneExternal
+	}
+	return NetworkZoneDefault
+}
@@ -109,6 +109,10 @@ func (as *APIStub) ContainerSSH(ctx context.Context, options arvados.ContainerSS
 	as.appendCall(ctx, as.ContainerSSH, options)
 	return arvados.ContainerSSHConnection{}, as.Error
 }
+func (as *APIStub) ContainerSnapshotOutput(ctx context.Context, options arvados.GetOptions) (arvados.Collection, error) {
+	as.appendCall(ctx, as.ContainerSnapshotOutput, options)
+	return arvados.Collection{}, as.Error
+}
 func (as *APIStub) ContainerRequestCreate(ctx context.Context, options arvados.CreateOptions) (arvados.ContainerRequest, error) {
 	as.appendCall(ctx, as.ContainerRequestCreate, options)
 	return arvados.ContainerRequest{}, as.Error
@@ -209,6 +213,18 @@ func (as *APIStub) APIClientAuthorizationCurrent(ctx context.Context, options ar
 	as.appendCall(ctx, as.APIClientAuthorizationCurrent, options)
 	return arvados.APIClientAuthorization{}, as.Error
 }
+func (as *APIStub) S3AccessKeyCreate(ctx context.Context, options arvados.CreateOptions) (arvados.S3AccessKey, error) {
+	as.appendCall(ctx, as.S3AccessKeyCreate, options)
+	return arvados.S3AccessKey{}, as.Error
+}
+func (as *APIStub) S3AccessKeyList(ctx context.Context, options arvados.ListOptions) (arvados.S3AccessKeyList, error) {
+	as.appendCall(ctx, as.S3AccessKeyList, options)
+	return arvados.S3AccessKeyList{}, as.Error
+}
+func (as *APIStub) S3AccessKeyDelete(ctx context.Context, options arvados.DeleteOptions) (arvados.S3AccessKey, error) {
+	as.appendCall(ctx, as.S3AccessKeyDelete, options)
+	return arvados.S3AccessKey{}, as.Error
+}
 
 func (as *APIStub) appendCall(ctx context.Context, method interface{}, options interface{}) {
 	as.mtx.Lock()
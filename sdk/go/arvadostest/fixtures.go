@@ -26,6 +26,7 @@ const (
 	NonexistentCollection   = "zzzzz-4zz18-totallynotexist"
 	HelloWorldCollection    = "zzzzz-4zz18-4en62shvi99lxd4"
 	FooBarDirCollection     = "zzzzz-4zz18-foonbarfilesdir"
+	WazCollection           = "zzzzz-4zz18-25k12570yk134b3"
 	WazVersion1Collection   = "zzzzz-4zz18-25k12570yk1ver1"
 	UserAgreementPDH        = "b519d9cb706a29fc7ea24dbea2f05851+93"
 	HelloWorldPdh           = "55713e6a34081eb03609e7ad5fcad129+62"
@@ -72,6 +73,9 @@ const (
 	FooRepoName     = "active/foo"
 	Repository2UUID = "zzzzz-s0uqq-382brsig8rp3667"
 	Repository2Name = "active/foo2"
+	// Readable by the anonymous user
+	PublicRepoUUID = "zzzzz-s0uqq-382brsig8rp3668"
+	PublicRepoName = "active/shabranchnames"
 
 	FooCollectionSharingTokenUUID = "zzzzz-gj3su-gf02tdm4g1z3e3u"
 	FooCollectionSharingToken     = "iknqgmunrhgsyfok8uzjlwun9iscwm3xacmzmg65fa1j1lpdss"
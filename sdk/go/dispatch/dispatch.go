@@ -40,6 +40,13 @@ type Dispatcher struct {
 	// Batch size for container queries
 	BatchSize int
 
+	// Container attributes to retrieve when polling the queue
+	// (uuid, state, priority, and locked_by_uuid are always
+	// included). If empty, all attributes are retrieved.
+	// Selecting only the attributes RunContainer needs reduces
+	// the size of API responses when the queue is long.
+	Select []string
+
 	// Queue polling frequency
 	PollPeriod time.Duration
 
@@ -198,6 +205,9 @@ func (d *Dispatcher) checkForUpdates(filters [][]interface{}, todo map[string]*r
 		"count":   "none",
 		"limit":   d.BatchSize,
 		"order":   []string{"priority desc"}}
+	if len(d.Select) > 0 {
+		params["select"] = append([]string{"uuid", "state", "priority", "locked_by_uuid"}, d.Select...)
+	}
 	offset := 0
 	for {
 		params["offset"] = offset
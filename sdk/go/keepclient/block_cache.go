@@ -5,6 +5,7 @@
 package keepclient
 
 import (
+	"context"
 	"io"
 	"sort"
 	"strconv"
@@ -54,7 +55,12 @@ func (c *BlockCache) Sweep() {
 // ReadAt returns data from the cache, first retrieving it from Keep if
 // necessary.
 func (c *BlockCache) ReadAt(kc *KeepClient, locator string, p []byte, off int) (int, error) {
-	buf, err := c.Get(kc, locator)
+	return c.ReadAtContext(context.Background(), kc, locator, p, off)
+}
+
+// ReadAtContext is like ReadAt, but gives up when ctx is cancelled.
+func (c *BlockCache) ReadAtContext(ctx context.Context, kc *KeepClient, locator string, p []byte, off int) (int, error) {
+	buf, err := c.GetContext(ctx, kc, locator)
 	if err != nil {
 		return 0, err
 	}
@@ -67,6 +73,16 @@ func (c *BlockCache) ReadAt(kc *KeepClient, locator string, p []byte, off int) (
 // Get returns data from the cache, first retrieving it from Keep if
 // necessary.
 func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
+	return c.GetContext(context.Background(), kc, locator)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is cancelled
+// before the data is available.
+//
+// Concurrent callers asking for the same block share a single
+// fetch. The fetch is aborted only when every caller waiting for it
+// has given up.
+func (c *BlockCache) GetContext(ctx context.Context, kc *KeepClient, locator string) ([]byte, error) {
 	cacheKey := locator[:32]
 	bufsize := BLOCKSIZE
 	if parts := strings.SplitN(locator, "+", 3); len(parts) >= 2 {
@@ -81,13 +97,16 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 	}
 	b, ok := c.cache[cacheKey]
 	if !ok || b.err != nil {
+		fetchctx, cancel := context.WithCancel(context.Background())
 		b = &cacheBlock{
 			fetched: make(chan struct{}),
 			lastUse: time.Now(),
+			cancel:  cancel,
 		}
 		c.cache[cacheKey] = b
 		go func() {
-			rdr, size, _, err := kc.Get(locator)
+			defer cancel()
+			rdr, size, _, err := kc.GetContext(fetchctx, locator)
 			var data []byte
 			if err == nil {
 				data = make([]byte, size, bufsize)
@@ -104,18 +123,53 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 			go c.Sweep()
 		}()
 	}
+	b.waiters++
 	c.mtx.Unlock()
 
 	// Wait (with mtx unlocked) for the fetch goroutine to finish,
 	// in case it hasn't already.
-	<-b.fetched
+	select {
+	case <-b.fetched:
+	case <-ctx.Done():
+		c.mtx.Lock()
+		b.waiters--
+		if b.waiters == 0 {
+			select {
+			case <-b.fetched:
+			default:
+				// Nobody else wants this block;
+				// abort the fetch, and make sure
+				// the next caller starts a new one
+				// instead of waiting for this one.
+				b.cancel()
+				if c.cache[cacheKey] == b {
+					delete(c.cache, cacheKey)
+				}
+			}
+		}
+		c.mtx.Unlock()
+		return nil, ctx.Err()
+	}
 
 	c.mtx.Lock()
+	b.waiters--
 	b.lastUse = time.Now()
 	c.mtx.Unlock()
 	return b.data, b.err
 }
 
+// has returns true if the given block is in the cache, or is being
+// fetched.
+func (c *BlockCache) has(locator string) bool {
+	if len(locator) < 32 {
+		return false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, ok := c.cache[locator[:32]]
+	return ok && b.err == nil
+}
+
 func (c *BlockCache) Clear() {
 	c.mtx.Lock()
 	c.cache = nil
@@ -135,4 +189,6 @@ type cacheBlock struct {
 	err     error
 	fetched chan struct{}
 	lastUse time.Time
+	waiters int
+	cancel  func()
 }
@@ -120,7 +120,7 @@ func (ent *cachedSvcList) poll() {
 //
 // If an API call is made, the result is cached for 5 minutes or until
 // ClearCache() is called, and during this interval it is reused by
-// other KeepClients that use the same API server host.
+// other KeepClients that use the same API server host and network zone.
 func (kc *KeepClient) discoverServices() error {
 	if kc.disableDiscovery {
 		return nil
@@ -139,7 +139,7 @@ func (kc *KeepClient) discoverServices() error {
 	}
 
 	svcListCacheMtx.Lock()
-	cacheEnt, ok := svcListCache[kc.Arvados.ApiServer]
+	cacheEnt, ok := svcListCache[kc.svcListCacheKey()]
 	if !ok {
 		arv := *kc.Arvados
 		cacheEnt = cachedSvcList{
@@ -148,7 +148,7 @@ func (kc *KeepClient) discoverServices() error {
 			arv:    &arv,
 		}
 		go cacheEnt.poll()
-		svcListCache[kc.Arvados.ApiServer] = cacheEnt
+		svcListCache[kc.svcListCacheKey()] = cacheEnt
 	}
 	svcListCacheMtx.Unlock()
 
@@ -160,9 +160,16 @@ func (kc *KeepClient) discoverServices() error {
 	}
 }
 
+// svcListCacheKey returns the svcListCache key for kc. Clients in
+// different network zones can get different service lists from the
+// same API server, so they don't share cache entries.
+func (kc *KeepClient) svcListCacheKey() string {
+	return kc.Arvados.ApiServer + "/" + string(kc.Arvados.EffectiveNetworkZone())
+}
+
 func (kc *KeepClient) RefreshServiceDiscovery() {
 	svcListCacheMtx.Lock()
-	ent, ok := svcListCache[kc.Arvados.ApiServer]
+	ent, ok := svcListCache[kc.svcListCacheKey()]
 	svcListCacheMtx.Unlock()
 	if !ok || kc.Arvados.KeepServiceURIs != nil || kc.disableDiscovery {
 		return
@@ -189,6 +196,7 @@ func (kc *KeepClient) loadKeepServers(list svcList) error {
 	localRoots := make(map[string]string)
 	gatewayRoots := make(map[string]string)
 	writableLocalRoots := make(map[string]string)
+	locality := make(map[string]Locality)
 
 	// replicasPerService is 1 for disks; unknown or unlimited otherwise
 	kc.replicasPerService = 1
@@ -207,6 +215,9 @@ func (kc *KeepClient) loadKeepServers(list svcList) error {
 		listed[url] = true
 
 		localRoots[service.Uuid] = url
+		if service.Properties.Zone != "" {
+			locality[url] = Locality{Zone: service.Properties.Zone, Rack: service.Properties.Rack}
+		}
 		if service.ReadOnly == false {
 			writableLocalRoots[service.Uuid] = url
 			if service.SvcType != "disk" {
@@ -227,5 +238,8 @@ func (kc *KeepClient) loadKeepServers(list svcList) error {
 	}
 
 	kc.setServiceRoots(localRoots, writableLocalRoots, gatewayRoots)
+	kc.lock.Lock()
+	kc.serviceLocality = locality
+	kc.lock.Unlock()
 	return nil
 }
@@ -8,6 +8,7 @@ package keepclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -97,6 +99,7 @@ type KeepClient struct {
 	localRoots         map[string]string
 	writableLocalRoots map[string]string
 	gatewayRoots       map[string]string
+	serviceLocality    map[string]Locality // from keep_services properties
 	lock               sync.RWMutex
 	HTTPClient         HTTPClient
 	Retries            int
@@ -104,6 +107,45 @@ type KeepClient struct {
 	RequestID          string
 	StorageClasses     []string
 
+	// If non-zero, GET requests that haven't received a
+	// response from the first server after HedgeDelay are also
+	// sent to the next server in probe order, and whichever
+	// responds first is used. This reduces tail latency at the
+	// expense of extra load on keepstore servers.
+	HedgeDelay time.Duration
+
+	// If PreferredWriteReplicas is non-zero, PUT requests write
+	// the first PreferredWriteReplicas replicas of each block to
+	// servers listed in PreferredWriteRoots (e.g., servers in the
+	// same datacenter as the client) if possible, instead of
+	// strictly following rendezvous order. Keys are service roots
+	// as returned by WritableLocalRoots.
+	PreferredWriteRoots    map[string]bool
+	PreferredWriteReplicas int
+
+	// If ClientLocality.Zone is not empty, GET and HEAD requests
+	// try servers in the client's zone first (and, among those,
+	// servers in the client's rack), before servers in other
+	// zones. Within each group, servers are tried in rendezvous
+	// order. PUT requests are not affected.
+	//
+	// The zone and rack of each server are taken from the
+	// "properties" of the keep_services records returned by
+	// service discovery. Entries in ServiceLocality (keyed by
+	// service root, as returned by LocalRoots) take precedence;
+	// they are needed when discovery is disabled, e.g., with
+	// KeepServiceURIs.
+	ClientLocality  Locality
+	ServiceLocality map[string]Locality
+
+	// If non-zero, ReadAt calls that ask for at most
+	// RangeReadMaxBytes bytes from a block that is not already in
+	// the block cache fetch only the requested bytes (see
+	// GetRange) instead of fetching and caching the whole
+	// block. This reduces latency and bandwidth for random access
+	// workloads, but makes sequential reads slower.
+	RangeReadMaxBytes int
+
 	// set to 1 if all writable services are of disk type, otherwise 0
 	replicasPerService int
 
@@ -199,7 +241,7 @@ func (kc *KeepClient) PutR(r io.Reader) (locator string, replicas int, err error
 	return kc.PutB(buffer)
 }
 
-func (kc *KeepClient) getOrHead(method string, locator string, header http.Header) (io.ReadCloser, int64, string, http.Header, error) {
+func (kc *KeepClient) getOrHead(ctx context.Context, method string, locator string, header http.Header) (io.ReadCloser, int64, string, http.Header, error) {
 	if strings.HasPrefix(locator, "d41d8cd98f00b204e9800998ecf8427e+0") {
 		return ioutil.NopCloser(bytes.NewReader(nil)), 0, "", nil, nil
 	}
@@ -224,30 +266,88 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 	numServers := len(serversToTry)
 	count404 := 0
 
+	// Every request context is cancelled when we return, except
+	// the one whose response body is returned to the caller,
+	// which is cancelled when the caller closes the body.
+	var cancelFuncs []context.CancelFunc
+	keepCancel := -1
+	defer func() {
+		for i, cancel := range cancelFuncs {
+			if i != keepCancel {
+				cancel()
+			}
+		}
+	}()
+
 	var retryList []string
 
 	for triesRemaining > 0 {
 		triesRemaining--
 		retryList = nil
 
-		for _, host := range serversToTry {
-			url := host + "/" + locator
-
-			req, err := http.NewRequest(method, url, nil)
-			if err != nil {
-				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
-				continue
+		// Send requests to serversToTry one at a time, except
+		// that (if HedgeDelay is set) a GET request that hasn't
+		// received a response after HedgeDelay is "hedged" by
+		// sending the same request to the next server. The
+		// first successful response wins.
+		results := make(chan hedgeResult, len(serversToTry))
+		cancels := map[string]int{} // host => index in cancelFuncs
+		next, pending := 0, 0
+		startNext := func() {
+			host := serversToTry[next]
+			next++
+			pending++
+			reqctx, cancel := context.WithCancel(ctx)
+			cancels[host] = len(cancelFuncs)
+			cancelFuncs = append(cancelFuncs, cancel)
+			go func() {
+				resp, err := kc.doGetOrHead(reqctx, method, host+"/"+locator, header, reqid)
+				results <- hedgeResult{host: host, resp: resp, err: err}
+			}()
+		}
+		// abandon cancels all outstanding requests except
+		// keep, and closes their response bodies.
+		abandon := func(keep string) {
+			for host, i := range cancels {
+				if host != keep {
+					cancelFuncs[i]()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-results; r.resp != nil {
+						r.resp.Body.Close()
+					}
+				}
+			}(pending)
+		}
+		for next < len(serversToTry) || pending > 0 {
+			if pending == 0 {
+				startNext()
 			}
-			for k, v := range header {
-				req.Header[k] = append([]string(nil), v...)
+			var hedge <-chan time.Time
+			if kc.HedgeDelay > 0 && method == "GET" && next < len(serversToTry) {
+				hedge = time.After(kc.HedgeDelay)
 			}
-			if req.Header.Get("Authorization") == "" {
-				req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+			var r hedgeResult
+			select {
+			case <-hedge:
+				startNext()
+				continue
+			case r = <-results:
+				pending--
 			}
-			if req.Header.Get("X-Request-Id") == "" {
-				req.Header.Set("X-Request-Id", reqid)
+			host, resp, err := r.host, r.resp, r.err
+			url := host + "/" + locator
+			if ctx.Err() != nil {
+				// Caller gave up; don't try other
+				// servers.
+				if err == nil {
+					resp.Body.Close()
+				}
+				abandon("")
+				return nil, 0, "", nil, ctx.Err()
 			}
-			resp, err := kc.httpClient().Do(req)
 			if err != nil {
 				// Probably a network error, may be transient,
 				// can try again.
@@ -255,7 +355,7 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 				retryList = append(retryList, host)
 				continue
 			}
-			if resp.StatusCode != http.StatusOK {
+			if resp.StatusCode != http.StatusOK && (resp.StatusCode != http.StatusPartialContent || header.Get("Range") == "") {
 				var respbody []byte
 				respbody, _ = ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
 				resp.Body.Close()
@@ -274,6 +374,15 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 				}
 				continue
 			}
+			abandon(host)
+			keepCancel = cancels[host]
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancelFuncs[keepCancel]}
+			if resp.StatusCode == http.StatusPartialContent {
+				// Response to a Range request (see
+				// GetRange). The content can't be
+				// checked against the locator's hash.
+				return resp.Body, resp.ContentLength, url, resp.Header, nil
+			}
 			if expectLength < 0 {
 				if resp.ContentLength < 0 {
 					resp.Body.Close()
@@ -311,6 +420,44 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 	return nil, 0, "", nil, err
 }
 
+type hedgeResult struct {
+	host string
+	resp *http.Response
+	err  error
+}
+
+// cancelOnClose calls cancel after closing the wrapped ReadCloser,
+// releasing the resources associated with a request context.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (coc cancelOnClose) Close() error {
+	err := coc.ReadCloser.Close()
+	coc.cancel()
+	return err
+}
+
+// doGetOrHead sends a single GET or HEAD request to a keepstore
+// server.
+func (kc *KeepClient) doGetOrHead(ctx context.Context, method, url string, header http.Header, reqid string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+	}
+	if req.Header.Get("X-Request-Id") == "" {
+		req.Header.Set("X-Request-Id", reqid)
+	}
+	return kc.httpClient().Do(req)
+}
+
 // LocalLocator returns a locator equivalent to the one supplied, but
 // with a valid signature from the local cluster. If the given locator
 // already has a local signature, it is returned unchanged.
@@ -322,7 +469,7 @@ func (kc *KeepClient) LocalLocator(locator string) (string, error) {
 		return locator, nil
 	}
 	sighdr := fmt.Sprintf("local, time=%s", time.Now().UTC().Format(time.RFC3339))
-	_, _, url, hdr, err := kc.getOrHead("HEAD", locator, http.Header{"X-Keep-Signature": []string{sighdr}})
+	_, _, url, hdr, err := kc.getOrHead(context.Background(), "HEAD", locator, http.Header{"X-Keep-Signature": []string{sighdr}})
 	if err != nil {
 		return "", err
 	}
@@ -341,14 +488,102 @@ func (kc *KeepClient) LocalLocator(locator string) (string, error) {
 // reader returned by this method will return a BadChecksum error
 // instead of EOF.
 func (kc *KeepClient) Get(locator string) (io.ReadCloser, int64, string, error) {
-	rdr, size, url, _, err := kc.getOrHead("GET", locator, nil)
+	return kc.GetContext(context.Background(), locator)
+}
+
+// GetContext is like Get, but aborts the request (and any remaining
+// retries) when ctx is cancelled. Reading the returned reader after
+// ctx is cancelled also returns an error.
+func (kc *KeepClient) GetContext(ctx context.Context, locator string) (io.ReadCloser, int64, string, error) {
+	rdr, size, url, _, err := kc.getOrHead(ctx, "GET", locator, nil)
 	return rdr, size, url, err
 }
 
+// GetRange retrieves length bytes of a block, starting at offset
+// off, using an HTTP Range request. It returns a reader for the
+// requested data and the URL it is being fetched from.
+//
+// Unlike Get, GetRange does not verify the data against the hash in
+// the locator. If the server does not support Range requests, the
+// whole block is requested, and the data outside the requested range
+// is discarded.
+func (kc *KeepClient) GetRange(ctx context.Context, locator string, off, length int64) (io.ReadCloser, string, error) {
+	if off < 0 || length < 0 {
+		return nil, "", fmt.Errorf("invalid range: offset %d, length %d", off, length)
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), "", nil
+	}
+	hdr := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+length-1)}}
+	rdr, _, url, resphdr, err := kc.getOrHead(ctx, "GET", locator, hdr)
+	if err != nil {
+		return nil, "", err
+	}
+	if resphdr.Get("Content-Range") == "" {
+		// Server sent the whole block.
+		_, err = io.CopyN(ioutil.Discard, rdr, off)
+		if err != nil {
+			rdr.Close()
+			return nil, "", err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rdr, length), rdr}, url, nil
+}
+
 // ReadAt retrieves a portion of block from the cache if it's
 // present, otherwise from the network.
 func (kc *KeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
-	return kc.cache().ReadAt(kc, locator, p, off)
+	return kc.ReadAtContext(context.Background(), locator, p, off)
+}
+
+// ReadAtContext is like ReadAt, but returns ctx.Err() if ctx is
+// cancelled before the block is available. The underlying network
+// request is aborted if no other callers are waiting for the same
+// block.
+//
+// If RangeReadMaxBytes is set, small reads from blocks that are not
+// already cached are done with GetRange instead.
+func (kc *KeepClient) ReadAtContext(ctx context.Context, locator string, p []byte, off int) (int, error) {
+	if kc.RangeReadMaxBytes > 0 && len(p) <= kc.RangeReadMaxBytes && !kc.cache().has(locator) {
+		return kc.readRange(ctx, locator, p, off)
+	}
+	return kc.cache().ReadAtContext(ctx, kc, locator, p, off)
+}
+
+// readRange is like ReadAtContext, but fetches only the requested
+// part of the block, bypassing the block cache.
+func (kc *KeepClient) readRange(ctx context.Context, locator string, p []byte, off int) (int, error) {
+	length := len(p)
+	if parts := strings.SplitN(locator, "+", 3); len(parts) >= 2 {
+		if size, err := strconv.Atoi(parts[1]); err == nil {
+			// Behave like BlockCache.ReadAt when the
+			// request extends past the end of the block.
+			if off > size {
+				return 0, io.ErrUnexpectedEOF
+			} else if off+length > size {
+				length = size - off
+			}
+		}
+	}
+	if length == 0 {
+		return 0, nil
+	}
+	rdr, _, err := kc.GetRange(ctx, locator, int64(off), int64(length))
+	if err != nil {
+		return 0, err
+	}
+	defer rdr.Close()
+	n, err := io.ReadFull(rdr, p[:length])
+	if err == io.EOF {
+		// ReadFull only returns EOF if nothing was read,
+		// which means the server sent less data than the
+		// requested range (length is never 0 here).
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
 // Ask verifies that a block with the given hash is available and
@@ -359,7 +594,7 @@ func (kc *KeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
 // Returns the data size (content length) reported by the Keep service
 // and the URI reporting the data size.
 func (kc *KeepClient) Ask(locator string) (int64, string, error) {
-	_, size, url, _, err := kc.getOrHead("HEAD", locator, nil)
+	_, size, url, _, err := kc.getOrHead(context.Background(), "HEAD", locator, nil)
 	return size, url, err
 }
 
@@ -486,10 +721,50 @@ func (kc *KeepClient) getSortedRoots(locator string) []string {
 		}
 	}
 	// After trying all usable service hints, fall back to local roots.
-	found = append(found, NewRootSorter(kc.LocalRoots(), locator[0:32]).GetSortedRoots()...)
+	found = append(found, kc.localityOrder(NewRootSorter(kc.LocalRoots(), locator[0:32]).GetSortedRoots())...)
 	return found
 }
 
+// Locality describes where a client or Keep service is located in
+// the network topology.
+type Locality struct {
+	Zone string
+	Rack string
+}
+
+// localityOrder returns the given roots (in probe order) sorted by
+// distance from ClientLocality: same rack, then same zone, then
+// everything else. Otherwise, probe order is preserved.
+func (kc *KeepClient) localityOrder(roots []string) []string {
+	client := kc.ClientLocality
+	if client.Zone == "" {
+		return roots
+	}
+	kc.lock.RLock()
+	discovered := kc.serviceLocality
+	kc.lock.RUnlock()
+	if len(kc.ServiceLocality) == 0 && len(discovered) == 0 {
+		return roots
+	}
+	distance := func(root string) int {
+		svc, ok := kc.ServiceLocality[root]
+		if !ok {
+			svc = discovered[root]
+		}
+		if svc.Zone != client.Zone {
+			return 2
+		} else if svc.Rack == "" || svc.Rack != client.Rack {
+			return 1
+		}
+		return 0
+	}
+	sorted := append([]string(nil), roots...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return distance(sorted[i]) < distance(sorted[j])
+	})
+	return sorted
+}
+
 func (kc *KeepClient) cache() *BlockCache {
 	if kc.BlockCache != nil {
 		return kc.BlockCache
@@ -6,6 +6,7 @@ package keepclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -354,6 +355,141 @@ func (s *StandaloneSuite) TestPutHR(c *C) {
 		true)
 }
 
+func (s *StandaloneSuite) TestPutPreferredWriteRoots(c *C) {
+	hash := Md5String("foo")
+
+	st := StubPutHandler{
+		c,
+		hash,
+		"abc123",
+		"foo",
+		"",
+		make(chan string, 5)}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+
+	kc.Want_replicas = 2
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+
+	ks := RunSomeFakeKeepServers(st, 5)
+
+	for i, k := range ks {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	shuff := NewRootSorter(kc.LocalRoots(), hash).GetSortedRoots()
+
+	// Only the first replica goes to a preferred server, and
+	// preferred servers are used in probe order.
+	kc.PreferredWriteRoots = map[string]bool{shuff[3]: true, shuff[4]: true}
+	kc.PreferredWriteReplicas = 1
+	c.Check(kc.preferWriteRoots(shuff), DeepEquals, []string{shuff[3], shuff[0], shuff[1], shuff[2], shuff[4]})
+
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 2)
+
+	s1 := <-st.handled
+	s2 := <-st.handled
+	c.Check((s1 == shuff[3] && s2 == shuff[0]) ||
+		(s1 == shuff[0] && s2 == shuff[3]),
+		Equals,
+		true)
+}
+
+func (s *StandaloneSuite) TestGetLocalityAware(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+
+	st := StubGetHandler{
+		c,
+		hash,
+		"abc123",
+		http.StatusOK,
+		[]byte("foo")}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(arv)
+
+	localRoots := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = fmt.Sprintf("http://keep%d.example", i)
+	}
+	kc.SetServiceRoots(localRoots, localRoots, nil)
+	shuff := NewRootSorter(localRoots, hash[:32]).GetSortedRoots()
+
+	// Without a client zone, rendezvous order is used.
+	kc.ServiceLocality = map[string]Locality{shuff[4]: {Zone: "east"}}
+	c.Check(kc.getSortedRoots(hash), DeepEquals, shuff)
+
+	// Same rack first, then same zone, then the rest, each in
+	// rendezvous order.
+	kc.ClientLocality = Locality{Zone: "east", Rack: "r1"}
+	kc.ServiceLocality = map[string]Locality{
+		shuff[1]: {Zone: "west", Rack: "r1"},
+		shuff[2]: {Zone: "east"},
+		shuff[3]: {Zone: "east", Rack: "r1"},
+		shuff[4]: {Zone: "east", Rack: "r2"},
+	}
+	c.Check(kc.getSortedRoots(hash), DeepEquals, []string{shuff[3], shuff[2], shuff[4], shuff[0], shuff[1]})
+
+	// Gateway hints still come first.
+	c.Check(kc.getSortedRoots(hash + "+K@zzzzz")[0], Equals, "https://keep.zzzzz.arvadosapi.com")
+
+	// Reads go to the closest server first.
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+	for uuid, root := range localRoots {
+		if root == shuff[3] {
+			localRoots[uuid] = ks.url
+		}
+	}
+	kc.SetServiceRoots(localRoots, localRoots, nil)
+	kc.ServiceLocality = map[string]Locality{ks.url: {Zone: "east"}}
+	r, n, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(3))
+	buf, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "foo")
+}
+
+func (s *StandaloneSuite) TestGetLocalityFromDiscovery(c *C) {
+	hash := fmt.Sprintf("%x+3", md5.Sum([]byte("foo")))
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+	err := kc.LoadKeepServicesFromJSON(`{"items":[
+		{"uuid":"zzzzz-bi6l4-fakefakefake000","service_host":"keep0.example","service_port":25107,"service_type":"disk","properties":{"zone":"west"}},
+		{"uuid":"zzzzz-bi6l4-fakefakefake001","service_host":"keep1.example","service_port":25107,"service_type":"disk","properties":{"zone":"east","rack":"r1"}},
+		{"uuid":"zzzzz-bi6l4-fakefakefake002","service_host":"keep2.example","service_port":25107,"service_type":"disk","properties":{"zone":"east"}},
+		{"uuid":"zzzzz-bi6l4-fakefakefake003","service_host":"keep3.example","service_port":25107,"service_type":"disk"}]}`)
+	c.Assert(err, IsNil)
+	shuff := NewRootSorter(kc.LocalRoots(), hash[:32]).GetSortedRoots()
+	c.Check(kc.getSortedRoots(hash), DeepEquals, shuff)
+
+	kc.ClientLocality = Locality{Zone: "east", Rack: "r1"}
+	// Same rack, then same zone, then the rest in rendezvous
+	// order.
+	want := []string{"http://keep1.example:25107", "http://keep2.example:25107"}
+	for _, root := range shuff {
+		if root != want[0] && root != want[1] {
+			want = append(want, root)
+		}
+	}
+	c.Check(kc.getSortedRoots(hash), DeepEquals, want)
+
+	// ServiceLocality overrides discovered labels.
+	kc.ServiceLocality = map[string]Locality{"http://keep1.example:25107": {Zone: "west"}}
+	c.Check(kc.getSortedRoots(hash)[0], Equals, "http://keep2.example:25107")
+}
+
 func (s *StandaloneSuite) TestPutWithFail(c *C) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
 
@@ -614,6 +750,214 @@ func (s *StandaloneSuite) TestGetFailRetry(c *C) {
 	}
 }
 
+type SlowGetHandler struct {
+	requests  chan *http.Request
+	cancelled chan struct{}
+}
+
+func (h SlowGetHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.requests <- req
+	<-req.Context().Done()
+	close(h.cancelled)
+}
+
+func (s *StandaloneSuite) TestReadAtContextCancel(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	st := SlowGetHandler{
+		requests:  make(chan *http.Request, 1),
+		cancelled: make(chan struct{}),
+	}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+	kc.BlockCache = &BlockCache{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-st.requests
+		cancel()
+	}()
+	n, err := kc.ReadAtContext(ctx, hash+"+3", make([]byte, 3), 0)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(n, Equals, 0)
+
+	select {
+	case <-st.cancelled:
+	case <-time.After(5 * time.Second):
+		c.Error("timed out waiting for keep request to be cancelled")
+	}
+
+	// The next caller should start a new fetch rather than
+	// getting the cancelled one's error.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = kc.ReadAtContext(ctx, hash+"+3", make([]byte, 3), 0)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(<-st.requests, NotNil)
+}
+
+// rangeGetHandler serves a block, supporting Range requests if
+// acceptRanges is true. Range headers of received requests are sent
+// to ranges.
+type rangeGetHandler struct {
+	data         []byte
+	acceptRanges bool
+	ranges       chan string
+}
+
+func (h rangeGetHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.ranges <- req.Header.Get("Range")
+	if h.acceptRanges {
+		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(h.data))
+		return
+	}
+	resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(h.data)))
+	resp.Write(h.data)
+}
+
+func (s *StandaloneSuite) TestGetRange(c *C) {
+	data := []byte("foobarbaz")
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	for _, acceptRanges := range []bool{true, false} {
+		c.Logf("acceptRanges=%v", acceptRanges)
+		st := rangeGetHandler{data: data, acceptRanges: acceptRanges, ranges: make(chan string, 10)}
+		ks := RunFakeKeepServer(st)
+		defer ks.listener.Close()
+
+		arv, err := arvadosclient.MakeArvadosClient()
+		c.Check(err, IsNil)
+		kc, _ := MakeKeepClient(arv)
+		arv.ApiToken = "abc123"
+		kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+		kc.BlockCache = &BlockCache{}
+
+		rdr, url, err := kc.GetRange(context.Background(), locator, 3, 3)
+		c.Assert(err, IsNil)
+		c.Check(url, Equals, ks.url+"/"+locator)
+		buf, err := ioutil.ReadAll(rdr)
+		c.Check(err, IsNil)
+		c.Check(string(buf), Equals, "bar")
+		c.Check(rdr.Close(), IsNil)
+		c.Check(<-st.ranges, Equals, "bytes=3-5")
+
+		kc.RangeReadMaxBytes = 4
+		buf = make([]byte, 4)
+		n, err := kc.ReadAt(locator, buf, 3)
+		c.Check(err, IsNil)
+		c.Check(string(buf[:n]), Equals, "barb")
+		c.Check(<-st.ranges, Equals, "bytes=3-6")
+
+		// Reads past the end of the block behave like
+		// BlockCache.ReadAt.
+		n, err = kc.ReadAt(locator, buf, 7)
+		c.Check(err, IsNil)
+		c.Check(string(buf[:n]), Equals, "az")
+		c.Check(<-st.ranges, Equals, "bytes=7-8")
+		n, err = kc.ReadAt(locator, buf, 9)
+		c.Check(err, IsNil)
+		c.Check(n, Equals, 0)
+		_, err = kc.ReadAt(locator, buf, 10)
+		c.Check(err, Equals, io.ErrUnexpectedEOF)
+		c.Check(kc.BlockCache.has(locator), Equals, false)
+
+		// Larger reads fetch and cache the whole block.
+		buf = make([]byte, 5)
+		n, err = kc.ReadAt(locator, buf, 0)
+		c.Check(err, IsNil)
+		c.Check(string(buf[:n]), Equals, "fooba")
+		c.Check(<-st.ranges, Equals, "")
+		c.Check(kc.BlockCache.has(locator), Equals, true)
+
+		// Once the block is cached, small reads use the
+		// cache too.
+		n, err = kc.ReadAt(locator, buf[:2], 1)
+		c.Check(err, IsNil)
+		c.Check(string(buf[:n]), Equals, "oo")
+		c.Check(len(st.ranges), Equals, 0)
+	}
+}
+
+func (s *StandaloneSuite) TestReadRangeTruncated(c *C) {
+	data := []byte("foobarbaz")
+	// The locator says the block is longer than the data the
+	// server actually has.
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data)+3)
+	st := rangeGetHandler{data: data, acceptRanges: true, ranges: make(chan string, 10)}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+	kc.BlockCache = &BlockCache{}
+	kc.RangeReadMaxBytes = 4
+
+	buf := make([]byte, 4)
+	n, err := kc.ReadAt(locator, buf, 3)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "barb")
+	c.Check(<-st.ranges, Equals, "bytes=3-6")
+
+	n, err = kc.ReadAt(locator, buf, 7)
+	c.Check(err, Equals, io.ErrUnexpectedEOF)
+	c.Check(string(buf[:n]), Equals, "az")
+	c.Check(<-st.ranges, Equals, "bytes=7-10")
+}
+
+func (s *StandaloneSuite) TestGetHedged(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	slow := SlowGetHandler{
+		requests:  make(chan *http.Request, 1),
+		cancelled: make(chan struct{}),
+	}
+	slowks := RunFakeKeepServer(slow)
+	defer slowks.listener.Close()
+	fastks := RunFakeKeepServer(StubGetHandler{c, hash, "abc123", http.StatusOK, []byte("foo")})
+	defer fastks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.HedgeDelay = 50 * time.Millisecond
+	// Make sure the slow server is first in probe order.
+	roots := map[string]string{"zzzzz-bi6l4-000000000000000": slowks.url, "zzzzz-bi6l4-000000000000001": fastks.url}
+	kc.SetServiceRoots(roots, nil, nil)
+	if kc.getSortedRoots(hash)[0] != slowks.url {
+		roots = map[string]string{"zzzzz-bi6l4-000000000000000": fastks.url, "zzzzz-bi6l4-000000000000001": slowks.url}
+		kc.SetServiceRoots(roots, nil, nil)
+	}
+	c.Assert(kc.getSortedRoots(hash)[0], Equals, slowks.url)
+
+	t0 := time.Now()
+	r, n, url, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(3))
+	c.Check(url, Equals, fastks.url+"/"+hash)
+	c.Check(time.Since(t0) < time.Second, Equals, true)
+	content, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(content, DeepEquals, []byte("foo"))
+	c.Check(r.Close(), IsNil)
+	c.Check(<-slow.requests, NotNil)
+
+	// The losing request is cancelled.
+	select {
+	case <-slow.cancelled:
+	case <-time.After(5 * time.Second):
+		c.Error("timed out waiting for slow request to be cancelled")
+	}
+}
+
 func (s *StandaloneSuite) TestGetNetError(c *C) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
 
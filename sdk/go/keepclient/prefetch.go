@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+)
+
+const defaultPrefetchConcurrency = 4
+
+// PrefetchProgress reports the progress of a Prefetch call.
+type PrefetchProgress struct {
+	Blocks     int   // number of distinct blocks to fetch
+	BlocksDone int   // number of blocks fetched so far
+	Bytes      int64 // total size of all blocks to fetch
+	BytesDone  int64 // total size of blocks fetched so far
+}
+
+// Prefetch warms kc's block cache with the data blocks needed to
+// read the given paths (files or directories) in the collection
+// described by m. If paths is empty, all blocks in the manifest are
+// fetched. If any of the paths does not exist, Prefetch returns an
+// error without fetching anything.
+//
+// Up to concurrency blocks are fetched at a time (if concurrency is
+// zero or negative, a default is used). If progress is not nil, it
+// is called once before fetching starts, and again after each block
+// is fetched.
+//
+// The cache only keeps BlockCache.MaxBlocks blocks, so callers
+// prefetching many blocks should use a BlockCache with a suitable
+// MaxBlocks.
+//
+// Prefetch returns the first error encountered, or ctx.Err() if ctx
+// is cancelled before all blocks are fetched.
+func (kc *KeepClient) Prefetch(ctx context.Context, m manifest.Manifest, paths []string, concurrency int, progress func(PrefetchProgress)) error {
+	locators, err := prefetchLocators(m, paths)
+	if err != nil {
+		return err
+	}
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+
+	var prog PrefetchProgress
+	prog.Blocks = len(locators)
+	for _, loc := range locators {
+		prog.Bytes += locatorSize(loc)
+	}
+	if progress != nil {
+		progress(prog)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mtx sync.Mutex
+	var firstErr error
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for loc := range todo {
+				_, err := kc.cache().GetContext(ctx, kc, loc)
+				mtx.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else if firstErr == nil {
+					prog.BlocksDone++
+					prog.BytesDone += locatorSize(loc)
+					if progress != nil {
+						progress(prog)
+					}
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, loc := range locators {
+		select {
+		case todo <- loc:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// prefetchLocators returns the distinct block locators needed to read
+// the given paths in m, in manifest order.
+func prefetchLocators(m manifest.Manifest, paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var locators []string
+	var err error
+	seen := map[string]bool{}
+	for _, path := range paths {
+		sub := m.Extract(path, ".")
+		if sub.Err != nil {
+			return nil, sub.Err
+		} else if sub.Text == "" {
+			return nil, fmt.Errorf("%q: %w", path, os.ErrNotExist)
+		}
+		// Keep reading after an error, so the StreamIter
+		// goroutine can finish.
+		for stream := range sub.StreamIter() {
+			if stream.Err != nil && err == nil {
+				err = stream.Err
+			}
+			for _, loc := range stream.Blocks {
+				if len(loc) < 32 || seen[loc[:32]] {
+					continue
+				}
+				seen[loc[:32]] = true
+				locators = append(locators, loc)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return locators, nil
+}
+
+// locatorSize returns the size hint from a block locator, or 0 if the
+// locator has no size hint.
+func locatorSize(loc string) int64 {
+	parts := strings.SplitN(loc, "+", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
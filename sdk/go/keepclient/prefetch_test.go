@@ -0,0 +1,63 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *CollectionReaderUnit) TestPrefetch(c *check.C) {
+	s.kc.BlockCache = &BlockCache{MaxBlocks: 10}
+	for _, data := range []string{"foo", "bar", "baz"} {
+		_, _, err := s.kc.PutB([]byte(data))
+		c.Assert(err, check.IsNil)
+	}
+	m := manifest.Manifest{Text: ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 3:3:bar\n" +
+		"./dir 73feffa4b7f6bb68e44cf984c85f6e88+3 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:baz 3:3:foo\n"}
+
+	opsBefore := *s.handler.ops
+	var progress []PrefetchProgress
+	err := s.kc.Prefetch(context.Background(), m, []string{"foo", "dir"}, 2, func(p PrefetchProgress) {
+		progress = append(progress, p)
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(*s.handler.ops, check.Equals, opsBefore+2)
+	c.Assert(progress, check.HasLen, 3)
+	c.Check(progress[0], check.Equals, PrefetchProgress{Blocks: 2, Bytes: 6})
+	c.Check(progress[2], check.Equals, PrefetchProgress{Blocks: 2, BlocksDone: 2, Bytes: 6, BytesDone: 6})
+
+	// Prefetched blocks are served from the cache.
+	buf, err := s.kc.cache().Get(s.kc, "73feffa4b7f6bb68e44cf984c85f6e88+3")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "baz")
+	c.Check(*s.handler.ops, check.Equals, opsBefore+2)
+
+	// Fetch the whole collection: only "bar" is not cached yet.
+	err = s.kc.Prefetch(context.Background(), m, nil, 0, nil)
+	c.Check(err, check.IsNil)
+	c.Check(*s.handler.ops, check.Equals, opsBefore+3)
+}
+
+func (s *CollectionReaderUnit) TestPrefetchErrors(c *check.C) {
+	s.kc.BlockCache = &BlockCache{}
+	m := manifest.Manifest{Text: ". ffffffffffffffffffffffffffffffff+1 0:1:notfound.txt\n"}
+
+	err := s.kc.Prefetch(context.Background(), m, []string{"nonexistent.txt"}, 1, nil)
+	c.Check(errors.Is(err, os.ErrNotExist), check.Equals, true)
+	c.Check(err, check.ErrorMatches, `.*nonexistent.txt.*`)
+
+	err = s.kc.Prefetch(context.Background(), m, []string{"notfound.txt"}, 1, nil)
+	c.Check(err, check.NotNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.kc.Prefetch(ctx, m, nil, 1, nil)
+	c.Check(err, check.Equals, context.Canceled)
+}
@@ -0,0 +1,249 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrNoFileStarted is returned by (*StreamWriter)Write if StartFile
+// has not been called.
+var ErrNoFileStarted = errors.New("StreamWriter: Write called before StartFile")
+
+// BlockWriter is the subset of *KeepClient used by StreamWriter.
+type BlockWriter interface {
+	PutB(buf []byte) (string, int, error)
+}
+
+// StreamWriter writes a sequence of files to Keep and returns a
+// manifest stream that references them. Consecutive files share
+// blocks, so a stream of many small files is stored in a few
+// full-size blocks instead of one short block per file.
+//
+// Blocks are filled up to BlockSize bytes before being written. If
+// the size of a file is given to StartFile, and the file fits in a
+// single block but not in the space remaining in the current block,
+// the current (short) block is written first so the file's content
+// is not split across two blocks.
+//
+// If Writers is set, blocks are written in the background, so the
+// caller can fill the next block while earlier ones are being
+// written.
+//
+// Use:
+//
+//	sw := keepclient.NewStreamWriter(kc, "./dir")
+//	_, err := sw.WriteFile("foo.txt", reader, size)
+//	...
+//	text, err := sw.Finish()
+type StreamWriter struct {
+	// Maximum size of each block written to Keep. The default is
+	// BLOCKSIZE.
+	BlockSize int
+
+	// If not nil, blocks are written to Keep in background
+	// goroutines, and Writers limits how many are written at
+	// once: a block write starts after sending a value to
+	// Writers (waiting if the channel is full), and receives it
+	// again when done. StreamWriters that share a Writers channel
+	// share its limit. If nil, each block is written before the
+	// Write (or StartFile) call that filled it returns.
+	Writers chan struct{}
+
+	kc    BlockWriter
+	name  string
+	buf   []byte
+	pos   int64 // stream offset of buf[0]
+	files []streamFile
+	err   error
+
+	// Background writes (see Writers) fill in locators and set
+	// err (if err is not already set).
+	mtx      sync.Mutex
+	wg       sync.WaitGroup
+	locators []string
+}
+
+type streamFile struct {
+	name string
+	pos  int64
+	size int64
+}
+
+// NewStreamWriter returns a StreamWriter that writes blocks using
+// kc. The stream name must be "." or start with "./".
+func NewStreamWriter(kc BlockWriter, name string) *StreamWriter {
+	return &StreamWriter{kc: kc, name: name}
+}
+
+// Name returns the stream name given to NewStreamWriter.
+func (sw *StreamWriter) Name() string {
+	return sw.name
+}
+
+func (sw *StreamWriter) blockSize() int {
+	if sw.BlockSize > 0 {
+		return sw.BlockSize
+	}
+	return BLOCKSIZE
+}
+
+// StartFile starts a new file. Subsequent writes are appended to it.
+//
+// If size is known, it is used to decide whether to write the
+// current block before starting the new file; otherwise, size should
+// be -1.
+func (sw *StreamWriter) StartFile(name string, size int64) error {
+	if err := sw.error(); err != nil {
+		return err
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("StreamWriter: invalid file name %q", name)
+	}
+	bs := int64(sw.blockSize())
+	if len(sw.buf) > 0 && size >= 0 && size <= bs && int64(len(sw.buf))+size > bs {
+		if err := sw.flushBlock(); err != nil {
+			return err
+		}
+	}
+	sw.files = append(sw.files, streamFile{name: name, pos: sw.pos + int64(len(sw.buf))})
+	return nil
+}
+
+// Write appends data to the current file.
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if err := sw.error(); err != nil {
+		return 0, err
+	}
+	if len(sw.files) == 0 {
+		return 0, ErrNoFileStarted
+	}
+	bs := sw.blockSize()
+	written := 0
+	for len(p) > 0 {
+		if sw.buf == nil {
+			sw.buf = make([]byte, 0, bs)
+		}
+		n := bs - len(sw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		sw.buf = append(sw.buf, p[:n]...)
+		sw.files[len(sw.files)-1].size += int64(n)
+		written += n
+		p = p[n:]
+		if len(sw.buf) >= bs {
+			if err := sw.flushBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// WriteFile starts a new file and copies its content from r. See
+// StartFile.
+func (sw *StreamWriter) WriteFile(name string, r io.Reader, size int64) (int64, error) {
+	err := sw.StartFile(name, size)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(sw, r)
+}
+
+// error returns the first error encountered while writing blocks, if
+// any.
+func (sw *StreamWriter) error() error {
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	return sw.err
+}
+
+// flushBlock writes the buffered data to Keep as a single block, or
+// (if Writers is set) starts writing it in the background.
+func (sw *StreamWriter) flushBlock() error {
+	buf := sw.buf
+	sw.pos += int64(len(buf))
+	// Don't reuse the buffer: PutB implementations are allowed
+	// to hang on to it.
+	sw.buf = nil
+	if sw.Writers == nil {
+		locator, _, err := sw.kc.PutB(buf)
+		if err != nil {
+			sw.err = fmt.Errorf("StreamWriter: error writing block: %w", err)
+			return sw.err
+		}
+		sw.locators = append(sw.locators, locator)
+		return nil
+	}
+	sw.Writers <- struct{}{}
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	if sw.err != nil {
+		<-sw.Writers
+		return sw.err
+	}
+	idx := len(sw.locators)
+	sw.locators = append(sw.locators, "")
+	sw.wg.Add(1)
+	go func() {
+		defer sw.wg.Done()
+		locator, _, err := sw.kc.PutB(buf)
+		<-sw.Writers
+		sw.mtx.Lock()
+		defer sw.mtx.Unlock()
+		if err != nil && sw.err == nil {
+			sw.err = fmt.Errorf("StreamWriter: error writing block: %w", err)
+		}
+		sw.locators[idx] = locator
+	}()
+	return nil
+}
+
+// Finish writes any buffered data to Keep, waits for background
+// writes (if any) to finish, and returns the manifest text for the
+// stream, including the trailing newline. If no files were written,
+// it returns "".
+//
+// The StreamWriter must not be used after calling Finish.
+func (sw *StreamWriter) Finish() (string, error) {
+	if len(sw.buf) > 0 && sw.error() == nil {
+		sw.flushBlock()
+	}
+	sw.wg.Wait()
+	if sw.err != nil {
+		return "", sw.err
+	}
+	if len(sw.files) == 0 {
+		return "", nil
+	}
+	if len(sw.locators) == 0 {
+		sw.locators = []string{"d41d8cd98f00b204e9800998ecf8427e+0"}
+	}
+	var b strings.Builder
+	b.WriteString(streamEscape(sw.name))
+	for _, locator := range sw.locators {
+		b.WriteString(" " + locator)
+	}
+	for _, f := range sw.files {
+		fmt.Fprintf(&b, " %d:%d:%s", f.pos, f.size, streamEscape(f.name))
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+var streamEscapedChar = regexp.MustCompile(`[\000-\040:\s\\]`)
+
+// streamEscape escapes a stream or file name for use in a manifest.
+func streamEscape(s string) string {
+	return streamEscapedChar.ReplaceAllStringFunc(s, func(seq string) string {
+		return fmt.Sprintf("\\%03o", byte(seq[0]))
+	})
+}
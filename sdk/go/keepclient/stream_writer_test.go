@@ -0,0 +1,207 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&StreamWriterSuite{})
+
+type StreamWriterSuite struct{}
+
+type memBlockWriter struct {
+	blocks map[string][]byte
+	puts   []string
+	err    error
+	delay  func(buf []byte) time.Duration
+
+	mtx     sync.Mutex
+	writing int
+	maxBusy int
+}
+
+func (bw *memBlockWriter) PutB(buf []byte) (string, int, error) {
+	if bw.delay != nil {
+		bw.mtx.Lock()
+		bw.writing++
+		if bw.writing > bw.maxBusy {
+			bw.maxBusy = bw.writing
+		}
+		bw.mtx.Unlock()
+		time.Sleep(bw.delay(buf))
+		bw.mtx.Lock()
+		bw.writing--
+		bw.mtx.Unlock()
+	}
+	bw.mtx.Lock()
+	defer bw.mtx.Unlock()
+	if bw.err != nil {
+		return "", 0, bw.err
+	}
+	locator := fmt.Sprintf("%x+%d", md5.Sum(buf), len(buf))
+	if bw.blocks == nil {
+		bw.blocks = map[string][]byte{}
+	}
+	bw.blocks[locator] = append([]byte(nil), buf...)
+	bw.puts = append(bw.puts, locator)
+	return locator, 1, nil
+}
+
+func (bw *memBlockWriter) ReadAt(locator string, p []byte, off int) (int, error) {
+	bw.mtx.Lock()
+	defer bw.mtx.Unlock()
+	buf, ok := bw.blocks[locator]
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	n := copy(p, buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (bw *memBlockWriter) LocalLocator(locator string) (string, error) {
+	return locator, nil
+}
+
+func (s *StreamWriterSuite) TestPackSmallFiles(c *check.C) {
+	bw := &memBlockWriter{}
+	sw := NewStreamWriter(bw, "./dir")
+	sw.BlockSize = 8
+	for _, f := range []struct {
+		name string
+		data string
+	}{
+		{"a", "aaa"},
+		{"b", "bbb"},
+		{"c", "cc"},
+		{"empty", ""},
+		{"d", "dddd"},
+	} {
+		_, err := sw.WriteFile(f.name, strings.NewReader(f.data), int64(len(f.data)))
+		c.Assert(err, check.IsNil)
+	}
+	text, err := sw.Finish()
+	c.Assert(err, check.IsNil)
+	// a, b, and c fill the first block exactly; d goes in a new
+	// block.
+	c.Check(bw.puts, check.HasLen, 2)
+	c.Check(text, check.Equals, fmt.Sprintf("./dir %s %s 0:3:a 3:3:b 6:2:c 8:0:empty 8:4:d\n", bw.puts[0], bw.puts[1]))
+	c.Check(string(bw.blocks[bw.puts[0]]), check.Equals, "aaabbbcc")
+}
+
+func (s *StreamWriterSuite) TestSmallFileNotSplit(c *check.C) {
+	bw := &memBlockWriter{}
+	sw := NewStreamWriter(bw, ".")
+	sw.BlockSize = 8
+	_, err := sw.WriteFile("a", strings.NewReader("aaaaa"), 5)
+	c.Assert(err, check.IsNil)
+	// b would fit in a block by itself, so it starts a new block
+	// instead of being split.
+	_, err = sw.WriteFile("b", strings.NewReader("bbbb"), 4)
+	c.Assert(err, check.IsNil)
+	// size unknown, so c fills the remaining space in b's block
+	_, err = sw.WriteFile("c", strings.NewReader("cccccc"), -1)
+	c.Assert(err, check.IsNil)
+	// big files span blocks
+	_, err = sw.WriteFile("d", strings.NewReader("dddddddddddd"), 12)
+	c.Assert(err, check.IsNil)
+	text, err := sw.Finish()
+	c.Assert(err, check.IsNil)
+	c.Check(text, check.Equals, ". "+strings.Join(bw.puts, " ")+" 0:5:a 5:4:b 9:6:c 15:12:d\n")
+	var blocks []string
+	for _, locator := range bw.puts {
+		blocks = append(blocks, string(bw.blocks[locator]))
+	}
+	c.Check(blocks, check.DeepEquals, []string{"aaaaa", "bbbbcccc", "ccdddddd", "dddddd"})
+
+	// The resulting manifest is readable by a collection
+	// filesystem.
+	fs, err := (&arvados.Collection{ManifestText: text}).FileSystem(nil, bw)
+	c.Assert(err, check.IsNil)
+	for name, expect := range map[string]string{"a": "aaaaa", "b": "bbbb", "c": "cccccc", "d": "dddddddddddd"} {
+		f, err := fs.Open(name)
+		c.Assert(err, check.IsNil)
+		buf := make([]byte, 64)
+		n, _ := io.ReadFull(f, buf)
+		c.Check(string(buf[:n]), check.Equals, expect)
+		f.Close()
+	}
+}
+
+func (s *StreamWriterSuite) TestEscapeNames(c *check.C) {
+	bw := &memBlockWriter{}
+	sw := NewStreamWriter(bw, "./dir with space")
+	_, err := sw.WriteFile(`a:b\c d`, strings.NewReader(""), 0)
+	c.Assert(err, check.IsNil)
+	text, err := sw.Finish()
+	c.Assert(err, check.IsNil)
+	c.Check(text, check.Equals, `./dir\040with\040space d41d8cd98f00b204e9800998ecf8427e+0 0:0:a\072b\134c\040d`+"\n")
+	c.Check(bw.puts, check.HasLen, 0)
+}
+
+func (s *StreamWriterSuite) TestErrors(c *check.C) {
+	bw := &memBlockWriter{}
+	sw := NewStreamWriter(bw, ".")
+	_, err := sw.Write([]byte("foo"))
+	c.Check(err, check.Equals, ErrNoFileStarted)
+	c.Check(sw.StartFile("a/b", 0), check.ErrorMatches, `.*invalid file name.*`)
+	text, err := sw.Finish()
+	c.Check(err, check.IsNil)
+	c.Check(text, check.Equals, "")
+
+	bw.err = errors.New("oops")
+	sw = NewStreamWriter(bw, ".")
+	_, err = sw.WriteFile("foo", strings.NewReader("foo"), 3)
+	c.Check(err, check.IsNil)
+	_, err = sw.Finish()
+	c.Check(err, check.ErrorMatches, `.*error writing block: oops`)
+}
+
+func (s *StreamWriterSuite) TestConcurrentWriters(c *check.C) {
+	// Earlier blocks take longer to write, so they finish out of
+	// order.
+	bw := &memBlockWriter{delay: func(buf []byte) time.Duration {
+		return time.Duration('z'-buf[0]) * time.Millisecond
+	}}
+	writers := make(chan struct{}, 3)
+	sw1 := NewStreamWriter(bw, ".")
+	sw1.BlockSize = 4
+	sw1.Writers = writers
+	sw2 := NewStreamWriter(bw, "./dir")
+	sw2.BlockSize = 4
+	sw2.Writers = writers
+	_, err := sw1.WriteFile("foo", strings.NewReader("aaaabbbbccccdd"), -1)
+	c.Check(err, check.IsNil)
+	_, err = sw2.WriteFile("bar", strings.NewReader("eeeeffffgg"), -1)
+	c.Check(err, check.IsNil)
+	text1, err := sw1.Finish()
+	c.Check(err, check.IsNil)
+	text2, err := sw2.Finish()
+	c.Check(err, check.IsNil)
+	c.Check(text1, check.Equals, ". 74b87337454200d4d33f80c4663dc5e5+4 65ba841e01d6db7733e90a5b7f9e6f80+4 41fcba09f2bdcdf315ba4119dc7978dd+4 1aabac6d068eef6a7bad3fdf50a05cc8+2 0:14:foo\n")
+	c.Check(text2, check.Matches, `\./dir [0-9a-f]{32}\+4 [0-9a-f]{32}\+4 [0-9a-f]{32}\+2 0:10:bar\n`)
+	c.Check(bw.maxBusy > 1, check.Equals, true)
+	c.Check(bw.maxBusy <= 3, check.Equals, true)
+
+	bw = &memBlockWriter{err: errors.New("oops"), delay: func([]byte) time.Duration { return 0 }}
+	sw := NewStreamWriter(bw, ".")
+	sw.BlockSize = 4
+	sw.Writers = make(chan struct{}, 2)
+	sw.WriteFile("foo", strings.NewReader("aaaabbbbcc"), -1)
+	_, err = sw.Finish()
+	c.Check(err, check.ErrorMatches, `.*error writing block: oops`)
+}
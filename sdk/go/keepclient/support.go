@@ -36,6 +36,12 @@ type keepService struct {
 	SSL      bool   `json:"service_ssl_flag"`
 	SvcType  string `json:"service_type"`
 	ReadOnly bool   `json:"read_only"`
+
+	// Zone and rack labels (see KeepClient.ClientLocality)
+	Properties struct {
+		Zone string `json:"zone"`
+		Rack string `json:"rack"`
+	} `json:"properties"`
 }
 
 // Md5String returns md5 hash for the bytes in the given string
@@ -124,7 +130,7 @@ func (kc *KeepClient) putReplicas(
 	reqid := kc.getRequestID()
 
 	// Calculate the ordering for uploading to servers
-	sv := NewRootSorter(kc.WritableLocalRoots(), hash).GetSortedRoots()
+	sv := kc.preferWriteRoots(NewRootSorter(kc.WritableLocalRoots(), hash).GetSortedRoots())
 
 	// The next server to try contacting
 	nextServer := 0
@@ -222,3 +228,22 @@ func (kc *KeepClient) putReplicas(
 
 	return locator, replicasDone, nil
 }
+
+// preferWriteRoots returns the given roots (in probe order) with up to
+// PreferredWriteReplicas of the PreferredWriteRoots moved to the
+// front. Otherwise, probe order is preserved.
+func (kc *KeepClient) preferWriteRoots(roots []string) []string {
+	if kc.PreferredWriteReplicas < 1 || len(kc.PreferredWriteRoots) == 0 {
+		return roots
+	}
+	sorted := make([]string, 0, len(roots))
+	var rest []string
+	for _, root := range roots {
+		if len(sorted) < kc.PreferredWriteReplicas && kc.PreferredWriteRoots[root] {
+			sorted = append(sorted, root)
+		} else {
+			rest = append(rest, root)
+		}
+	}
+	return append(sorted, rest...)
+}
@@ -118,7 +118,18 @@ class ApplicationController < ActionController::Base
     attrs_to_update = resource_attrs.reject { |k,v|
       [:kind, :etag, :href].index k
     }
-    @object.update_attributes! attrs_to_update
+    props = attrs_to_update[:properties]
+    props = props.to_unsafe_h if props.is_a? ActionController::Parameters
+    if params[:merge_properties] && props.is_a?(Hash) && @object.respond_to?(:properties)
+      # Reload the row with a lock, so concurrent merges don't
+      # overwrite each other's keys.
+      @object.with_lock do
+        attrs_to_update[:properties] = (@object.properties || {}).merge(props.stringify_keys)
+        @object.update_attributes! attrs_to_update
+      end
+    else
+      @object.update_attributes! attrs_to_update
+    end
     show
   end
 
@@ -643,7 +654,15 @@ class ApplicationController < ActionController::Base
   end
 
   def self._update_requires_parameters
-    {}
+    {
+      merge_properties: {
+        type: 'boolean',
+        description: "Add the given properties to the object's existing properties, instead of replacing them.",
+        location: "query",
+        required: false,
+        default: false
+      },
+    }
   end
 
   def self._index_requires_parameters
@@ -15,11 +15,23 @@ class Arvados::V1::KeepServicesController < ApplicationController
   end
 
   def accessible
-    if request.headers['X-External-Client'] == '1'
+    if external_client?
       @objects = KeepService.where('service_type=?', 'proxy')
     else
       @objects = KeepService.where('service_type<>?', 'proxy')
     end
     render_list
   end
+
+  protected
+
+  # The X-External-Client header is typically set by the reverse
+  # proxy based on the client's IP address. A network zone hint
+  # supplied by the client can ask for the proxy even if the reverse
+  # proxy considers it internal, but it can't make an external client
+  # internal.
+  def external_client?
+    request.headers['X-External-Client'] == '1' ||
+      request.headers['X-Arvados-Network-Zone'] == 'external'
+  end
 end
@@ -329,6 +329,36 @@ class ContainerRequest < ArvadosModel
                      "[#{k}]=#{v.inspect} must be a positive integer")
         end
       end
+      if runtime_constraints.include?('entrypoint') and
+        !runtime_constraints['entrypoint'].nil? and
+        !runtime_constraints['entrypoint'].is_a?(String)
+        errors.add(:runtime_constraints,
+                   "[entrypoint]=#{runtime_constraints['entrypoint'].inspect} must be a string")
+      end
+      if runtime_constraints.include?('cuda') and !runtime_constraints['cuda'].nil?
+        cuda = runtime_constraints['cuda']
+        if !cuda.is_a?(Hash)
+          errors.add(:runtime_constraints,
+                     "[cuda]=#{cuda.inspect} must be a hash")
+        else
+          (cuda.keys - ['device_count', 'driver_version', 'hardware_capability']).each do |k|
+            errors.add(:runtime_constraints,
+                       "[cuda][#{k}] is not a valid CUDA constraint")
+          end
+          v = cuda['device_count']
+          if !v.nil? && (!v.is_a?(Integer) || v < 0)
+            errors.add(:runtime_constraints,
+                       "[cuda][device_count]=#{v.inspect} must be a non-negative integer")
+          end
+          ['driver_version', 'hardware_capability'].each do |k|
+            v = cuda[k]
+            if !v.nil? && (!v.is_a?(String) || !(v.empty? || v =~ /\A\d+(\.\d+)*\z/))
+              errors.add(:runtime_constraints,
+                         "[cuda][#{k}]=#{v.inspect} must be a version number like \"11.0\"")
+            end
+          end
+        end
+      end
     end
   end
 
@@ -385,6 +415,35 @@ class ContainerRequest < ArvadosModel
           scheduling_parameters['max_run_time'] < 0)
           errors.add :scheduling_parameters, "max_run_time must be positive integer"
       end
+      if scheduling_parameters.include? 'output_snapshot_interval' and
+        (!scheduling_parameters['output_snapshot_interval'].is_a?(Integer) ||
+          scheduling_parameters['output_snapshot_interval'] < 0)
+          errors.add :scheduling_parameters, "output_snapshot_interval must be positive integer"
+      end
+      if scheduling_parameters.include? 'max_output_size' and
+        (!scheduling_parameters['max_output_size'].is_a?(Integer) ||
+          scheduling_parameters['max_output_size'] < 0)
+          errors.add :scheduling_parameters, "max_output_size must be positive integer"
+      end
+      ['nodes', 'tasks'].each do |k|
+        if scheduling_parameters.include? k and
+          (!scheduling_parameters[k].is_a?(Integer) ||
+           scheduling_parameters[k] < 1)
+          errors.add :scheduling_parameters, "#{k} must be positive integer"
+        end
+      end
+      if scheduling_parameters['nodes'].is_a?(Integer) and
+        scheduling_parameters['tasks'].is_a?(Integer) and
+        scheduling_parameters['tasks'] < scheduling_parameters['nodes']
+        errors.add :scheduling_parameters, "tasks must not be less than nodes"
+      end
+      ['licenses', 'burst_buffers'].each do |k|
+        if scheduling_parameters.include? k and
+          (!scheduling_parameters[k].is_a?(Hash) ||
+           scheduling_parameters[k].any? { |name, n| !n.is_a?(Integer) || n < 1 })
+          errors.add :scheduling_parameters, "#{k} must be a hash of positive integers"
+        end
+      end
     end
   end
 
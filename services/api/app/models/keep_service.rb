@@ -17,6 +17,7 @@ class KeepService < ArvadosModel
     t.add  :service_ssl_flag
     t.add  :service_type
     t.add  :read_only
+    t.add  :properties
   end
   api_accessible :superuser, :extend => :user do |t|
   end
@@ -36,6 +37,25 @@ class KeepService < ArvadosModel
     all.where *args
   end
 
+  def self.attributes_required_columns
+    super.merge("properties" => ["service_host", "service_port", "service_ssl_flag"])
+  end
+
+  # Zone and rack labels from the Services.Keepstore.InternalURLs
+  # config entry for this service, if any. Clients can use them to
+  # read from nearby servers first.
+  def properties
+    Rails.configuration.Services.Keepstore.InternalURLs.each do |url, info|
+      uri = URI::parse(url.to_s)
+      next if uri.host != service_host || uri.port != service_port || (uri.scheme == 'https') != service_ssl_flag
+      props = {}
+      props["zone"] = info.Zone if !info.Zone.blank?
+      props["rack"] = info.Rack if !info.Rack.blank?
+      return props
+    end
+    {}
+  end
+
   protected
 
   def permission_to_create
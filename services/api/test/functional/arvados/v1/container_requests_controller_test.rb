@@ -165,4 +165,26 @@ class Arvados::V1::ContainerRequestsControllerTest < ActionController::TestCase
     assert_response :success
     assert_equal [ctr.uuid], json_response['items'].collect { |cr| cr['container_uuid'] }.uniq
   end
+
+  [true, false].each do |merge|
+    test "update properties with merge_properties=#{merge}" do
+      authorize_with :active
+      cr = container_requests(:uncommitted)
+      act_as_system_user do
+        cr.update_attributes!(properties: {'foo' => 'bar'})
+      end
+      patch :update, params: {
+              id: cr.uuid,
+              merge_properties: merge,
+              container_request: {properties: {baz: 'waz'}},
+            }
+      assert_response :success
+      if merge
+        assert_equal({'foo' => 'bar', 'baz' => 'waz'}, json_response['properties'])
+      else
+        assert_equal({'baz' => 'waz'}, json_response['properties'])
+      end
+      assert_equal json_response['properties'], cr.reload.properties
+    end
+  end
 end
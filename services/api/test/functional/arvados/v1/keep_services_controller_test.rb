@@ -36,6 +36,27 @@ class Arvados::V1::KeepServicesControllerTest < ActionController::TestCase
     end
   end
 
+  [
+    [{'X-External-Client' => '1'}, true],
+    [{'X-Arvados-Network-Zone' => 'external'}, true],
+    [{'X-Arvados-Network-Zone' => 'internal'}, false],
+    [{'X-Arvados-Network-Zone' => 'internal', 'X-External-Client' => '1'}, true],
+    [{'X-Arvados-Network-Zone' => 'external', 'X-External-Client' => '0'}, true],
+  ].each do |headers, want_proxy|
+    test "accessible with headers #{headers.inspect}" do
+      authorize_with :active
+      headers.each do |k, v|
+        @request.headers[k] = v
+      end
+      get :accessible
+      assert_response :success
+      assert_not_empty json_response['items']
+      json_response['items'].each do |ks|
+        assert_equal want_proxy, ks['service_type'] == 'proxy'
+      end
+    end
+  end
+
   test "report configured servers if db is empty" do
     KeepService.unscoped.all.delete_all
     expect_rvz = {}
@@ -64,4 +85,24 @@ class Arvados::V1::KeepServicesControllerTest < ActionController::TestCase
     assert_equal({}, expect_rvz, "all configured Keepstore and Keepproxy services should be returned")
   end
 
+  test "report zone and rack labels from config" do
+    KeepService.unscoped.all.delete_all
+    url = Rails.configuration.Services.Keepstore.InternalURLs.keys.first
+    Rails.configuration.Services.Keepstore.InternalURLs[url].Zone = "east"
+    Rails.configuration.Services.Keepstore.InternalURLs[url].Rack = "r1"
+    authorize_with :active
+    get :accessible
+    assert_response :success
+    found = false
+    json_response['items'].each do |svc|
+      if "#{svc['service_ssl_flag'] ? 'https' : 'http'}://#{svc['service_host']}:#{svc['service_port']}/" == url.to_s
+        assert_equal({"zone" => "east", "rack" => "r1"}, svc['properties'])
+        found = true
+      else
+        assert_equal({}, svc['properties'])
+      end
+    end
+    assert found, "configured service #{url} not returned"
+  end
+
 end
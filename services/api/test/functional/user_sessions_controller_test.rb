@@ -25,8 +25,21 @@ class UserSessionsControllerTest < ActionController::TestCase
     assert_not_nil assigns(:api_client)
   end
 
-  test "login creates token without expiration by default" do
-    assert_equal Rails.configuration.Login.TokenLifetime, 0
+  test "login creates token with 12 hour lifetime by default" do
+    assert_equal Rails.configuration.Login.TokenLifetime, 12.hours
+    authorize_with :inactive
+    api_client_page = 'http://client.example.com/home'
+    get :login, params: {return_to: api_client_page}
+    assert_response :redirect
+    assert_not_nil assigns(:api_client)
+    api_client_auth = assigns(:api_client_auth)
+    assert_in_delta(api_client_auth.expires_at,
+                    api_client_auth.updated_at + 12.hours,
+                    1.second)
+  end
+
+  test "login creates token without expiration if TokenLifetime is zero" do
+    Rails.configuration.Login.TokenLifetime = 0
     authorize_with :inactive
     api_client_page = 'http://client.example.com/home'
     get :login, params: {return_to: api_client_page}
@@ -81,11 +81,48 @@ class ContainerRequestTest < ActiveSupport::TestCase
     assert_nil cr.container_uuid
   end
 
+  [
+    "",
+    "/bin/sh",
+  ].each do |entrypoint|
+    test "Create with runtime_constraints entrypoint #{entrypoint.inspect}" do
+      set_user_from_auth :active
+      cr = create_minimal_req!(state: "Committed",
+                               priority: 1,
+                               runtime_constraints: {"vcpus" => 1, "ram" => 123, "entrypoint" => entrypoint})
+      assert_equal entrypoint, cr.runtime_constraints["entrypoint"]
+      c = Container.find_by_uuid cr.container_uuid
+      assert_equal entrypoint, c.runtime_constraints["entrypoint"]
+    end
+  end
+
+  [
+    {"device_count" => 1, "driver_version" => "11.0", "hardware_capability" => "7.5"},
+    {"device_count" => 0},
+  ].each do |cuda|
+    test "Create with runtime_constraints cuda #{cuda.inspect}" do
+      set_user_from_auth :active
+      cr = create_minimal_req!(state: "Committed",
+                               priority: 1,
+                               runtime_constraints: {"vcpus" => 1, "ram" => 123, "cuda" => cuda})
+      assert_equal cuda, cr.runtime_constraints["cuda"]
+      c = Container.find_by_uuid cr.container_uuid
+      assert_equal cuda, c.runtime_constraints["cuda"]
+    end
+  end
+
   [
     {"runtime_constraints" => {"vcpus" => 1}},
     {"runtime_constraints" => {"vcpus" => 1, "ram" => nil}},
     {"runtime_constraints" => {"vcpus" => 0, "ram" => 123}},
     {"runtime_constraints" => {"vcpus" => "1", "ram" => "123"}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "entrypoint" => ["/bin/sh"]}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "cuda" => 1}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "cuda" => {"device_count" => -1}}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "cuda" => {"device_count" => "1"}}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "cuda" => {"device_count" => 1, "driver_version" => 11.0}}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "cuda" => {"device_count" => 1, "hardware_capability" => "latest"}}},
+    {"runtime_constraints" => {"vcpus" => 1, "ram" => 123, "cuda" => {"devices" => 1}}},
     {"mounts" => {"FOO" => "BAR"}},
     {"mounts" => {"FOO" => {}}},
     {"mounts" => {"FOO" => {"kind" => "tmp", "capacity" => 42.222}}},
@@ -1021,6 +1058,24 @@ class ContainerRequestTest < ActiveSupport::TestCase
     [{"max_run_time" => -1}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
     [{"max_run_time" => -1}, ContainerRequest::Uncommitted],
     [{"max_run_time" => 86400}, ContainerRequest::Committed],
+    [{"licenses" => ["matlab"]}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"licenses" => {"matlab" => 0}}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"licenses" => {"matlab" => 0}}, ContainerRequest::Uncommitted],
+    [{"licenses" => {"matlab" => 2}}, ContainerRequest::Committed],
+    [{"burst_buffers" => {"scratch" => "100G"}}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"burst_buffers" => {"scratch" => 107374182400}}, ContainerRequest::Committed],
+    [{"output_snapshot_interval" => "hourly"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"output_snapshot_interval" => -1}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"output_snapshot_interval" => 3600}, ContainerRequest::Committed],
+    [{"max_output_size" => "1T"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"max_output_size" => -1}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"max_output_size" => 1099511627776}, ContainerRequest::Committed],
+    [{"nodes" => 0}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"nodes" => "4"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"nodes" => 4, "tasks" => 2}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"nodes" => 4, "tasks" => 2}, ContainerRequest::Uncommitted],
+    [{"nodes" => 4, "tasks" => 16}, ContainerRequest::Committed],
+    [{"tasks" => 8}, ContainerRequest::Committed],
   ].each do |sp, state, expected|
     test "create container request with scheduling_parameters #{sp} in state #{state} and verify #{expected}" do
       common_attrs = {cwd: "test",
@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// archiveFormats maps archive filename extensions to "git archive"
+// formats and response content types.
+var archiveFormats = []struct {
+	ext         string
+	format      string
+	contentType string
+}{
+	{".tar.gz", "tar.gz", "application/gzip"},
+	{".zip", "zip", "application/zip"},
+}
+
+// Refs are passed to git on the command line, so they must not look
+// like options. This also rules out refs that git itself would
+// reject, like "a..b".
+var archiveRefRegexp = regexp.MustCompile(`^[0-9A-Za-z_][-0-9A-Za-z_./]*$`)
+
+// archiveHandler is an http.Handler that responds to requests for
+// "/{repo}.git/archive/{ref}.tar.gz" and
+// "/{repo}.git/archive/{ref}.zip" (relative to the repository root
+// directory) with an archive of the given commit, generated by "git
+// archive".
+//
+// It doesn't do any authorization checks: authHandler takes care of
+// that, and rewrites the client's "/repo/{name}/archive/..." path to
+// the repository's directory.
+type archiveHandler struct {
+	gitCommand string
+	root       string
+}
+
+func newArchiveHandler(cluster *arvados.Cluster) http.Handler {
+	// GitCommand might be gitolite-shell, which doesn't know
+	// how to make archives.
+	git := cluster.Git.GitCommand
+	if filepath.Base(git) != "git" {
+		git = "git"
+	}
+	return &archiveHandler{
+		gitCommand: git,
+		root:       cluster.Git.Repositories,
+	}
+}
+
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	i := strings.LastIndex(r.URL.Path, ".git/archive/")
+	if i < 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	gitDir := h.root + r.URL.Path[:i+4]
+	filename := r.URL.Path[i+len(".git/archive/"):]
+	var ref, format, contentType string
+	for _, f := range archiveFormats {
+		if strings.HasSuffix(filename, f.ext) {
+			ref = strings.TrimSuffix(filename, f.ext)
+			format, contentType = f.format, f.contentType
+			break
+		}
+	}
+	if format == "" {
+		http.Error(w, "unsupported archive format", http.StatusNotFound)
+		return
+	}
+	if !archiveRefRegexp.MatchString(ref) || strings.Contains(ref, "..") {
+		http.Error(w, "invalid ref", http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the ref before sending any response headers, so
+	// we can return 404 for nonexistent refs.
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(r.Context(), h.gitCommand, "--git-dir", gitDir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		http.Error(w, "ref not found", http.StatusNotFound)
+		return
+	}
+	commit := strings.TrimSpace(string(out))
+
+	name := strings.Replace(ref, "/", "-", -1)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+filename[len(ref):]+`"`)
+	// The ETag identifies the commit, so a client that fetches
+	// a branch (e.g., "main") repeatedly can tell whether it has
+	// moved.
+	w.Header().Set("Etag", `"`+commit+`"`)
+	if r.Header.Get("If-None-Match") == `"`+commit+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	stderr.Reset()
+	cmd = exec.CommandContext(r.Context(), h.gitCommand, "--git-dir", gitDir, "archive", "--format="+format, "--prefix="+name+"/", commit)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		// Headers have probably been sent already, so all we
+		// can do is log the error. The client will see a
+		// truncated archive.
+		log.Printf("git archive %s %s (%s) failed: %s: %q", gitDir, ref, commit, err, stderr.String())
+	}
+}
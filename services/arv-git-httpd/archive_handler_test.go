@@ -0,0 +1,143 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ArchiveHandlerSuite{})
+
+type ArchiveHandlerSuite struct {
+	handler *archiveHandler
+	commit  string
+}
+
+func (s *ArchiveHandlerSuite) SetUpTest(c *check.C) {
+	root := c.MkDir()
+	work := c.MkDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = []string{
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example",
+			"HOME=" + work,
+		}
+		out, err := cmd.CombinedOutput()
+		c.Assert(err, check.IsNil, check.Commentf("git %q: %s", args, out))
+		return strings.TrimSpace(string(out))
+	}
+	git(work, "init", "-q", ".")
+	c.Assert(ioutil.WriteFile(filepath.Join(work, "foo.txt"), []byte("foo\n"), 0644), check.IsNil)
+	git(work, "add", "foo.txt")
+	git(work, "commit", "-q", "-m", "first")
+	git(work, "tag", "release/1.0")
+	c.Assert(ioutil.WriteFile(filepath.Join(work, "bar.txt"), []byte("bar\n"), 0644), check.IsNil)
+	git(work, "add", "bar.txt")
+	git(work, "commit", "-q", "-m", "second")
+	git(work, "branch", "-M", "main")
+	s.commit = git(work, "rev-parse", "HEAD")
+	git(root, "clone", "-q", "--bare", work, "zzzzz-s0uqq-382brsig8rp3666.git")
+
+	cluster := &arvados.Cluster{}
+	cluster.Git.GitCommand = "/usr/bin/git"
+	cluster.Git.Repositories = root
+	s.handler = newArchiveHandler(cluster).(*archiveHandler)
+}
+
+func (s *ArchiveHandlerSuite) get(c *check.C, method, path string, hdr http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/zzzzz-s0uqq-382brsig8rp3666.git/archive/"+path, nil)
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	resp := httptest.NewRecorder()
+	s.handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *ArchiveHandlerSuite) TestTarGz(c *check.C) {
+	resp := s.get(c, "GET", "main.tar.gz", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/gzip")
+	c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename="main.tar.gz"`)
+	c.Check(resp.Header().Get("Etag"), check.Equals, `"`+s.commit+`"`)
+	gz, err := gzip.NewReader(resp.Body)
+	c.Assert(err, check.IsNil)
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		if hdr.Typeflag == tar.TypeReg {
+			buf, err := ioutil.ReadAll(tr)
+			c.Assert(err, check.IsNil)
+			files[hdr.Name] = string(buf)
+		}
+	}
+	c.Check(files, check.DeepEquals, map[string]string{
+		"main/foo.txt": "foo\n",
+		"main/bar.txt": "bar\n",
+	})
+}
+
+func (s *ArchiveHandlerSuite) TestZipTag(c *check.C) {
+	resp := s.get(c, "GET", "release/1.0.zip", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/zip")
+	c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename="release-1.0.zip"`)
+	zr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	c.Check(names, check.DeepEquals, []string{"release-1.0/", "release-1.0/foo.txt"})
+}
+
+func (s *ArchiveHandlerSuite) TestNotModified(c *check.C) {
+	resp := s.get(c, "GET", s.commit+".tar.gz", http.Header{"If-None-Match": {`"` + s.commit + `"`}})
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+	c.Check(resp.Body.Len(), check.Equals, 0)
+
+	resp = s.get(c, "HEAD", "main.zip", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.Len(), check.Equals, 0)
+}
+
+func (s *ArchiveHandlerSuite) TestErrors(c *check.C) {
+	for _, trial := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "nonexistent.tar.gz", http.StatusNotFound},
+		{"GET", "main.tar.bz2", http.StatusNotFound},
+		{"GET", "--output=x.tar.gz", http.StatusBadRequest},
+		{"GET", "main..HEAD.zip", http.StatusBadRequest},
+		{"POST", "main.tar.gz", http.StatusMethodNotAllowed},
+	} {
+		resp := s.get(c, trial.method, trial.path, nil)
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%s %s", trial.method, trial.path))
+	}
+}
@@ -18,27 +18,24 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type authHandler struct {
 	handler    http.Handler
+	archive    http.Handler
 	clientPool *arvadosclient.ClientPool
 	cluster    *arvados.Cluster
+	metrics    *metrics
 	setupOnce  sync.Once
 }
 
 func (h *authHandler) setup() {
-	client, err := arvados.NewClientFromConfig(h.cluster)
-	if err != nil {
-		log.Fatal(err)
-	}
+	h.clientPool = newClientPool(h.cluster)
 
-	ac, err := arvadosclient.New(client)
-	if err != nil {
-		log.Fatalf("Error setting up arvados client prototype %v", err)
+	if h.metrics == nil {
+		h.metrics = newMetrics(prometheus.NewRegistry())
 	}
-
-	h.clientPool = &arvadosclient.ClientPool{Prototype: ac}
 }
 
 func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
@@ -49,32 +46,39 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	var apiToken string
 	var repoName string
 	var validApiToken bool
+	var anonymous bool
+	var authFailure string
 
 	w := httpserver.WrapResponseWriter(wOrig)
 
 	if r.Method == "OPTIONS" {
-		method := r.Header.Get("Access-Control-Request-Method")
-		if method != "GET" && method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		w.WriteHeader(http.StatusOK)
+		h.serveCORSPreflight(w, r)
 		return
 	}
 
-	if r.Header.Get("Origin") != "" {
-		// Allow simple cross-origin requests without user
-		// credentials ("user credentials" as defined by CORS,
-		// i.e., cookies, HTTP authentication, and client-side
-		// SSL certificates. See
-		// http://www.w3.org/TR/cors/#user-credentials).
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Cross-origin requests are allowed according to
+	// Git.CORS.Origins. "User credentials" as defined by CORS
+	// (cookies, cached HTTP authentication, and client-side SSL
+	// certificates) are only accepted from origins with
+	// AllowCredentials. Clients can always send an explicit
+	// Authorization header, e.g., basic auth with a token as the
+	// password.
+	origin := r.Header.Get("Origin")
+	corsAllowWrite := true
+	if origin != "" {
+		policy, ok := corsPolicy(h.cluster, origin)
+		if ok {
+			setCORSHeaders(w, origin, policy)
+			w.Header().Set("Access-Control-Expose-Headers", "WWW-Authenticate")
+		}
+		corsAllowWrite = ok && policy.AllowWrite
 	}
 
+	op := gitOperation(r)
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	h.metrics.active.Inc()
+
 	defer func() {
 		if w.WroteStatus() == 0 {
 			// Nobody has called WriteHeader yet: that
@@ -87,8 +91,11 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 
 		// If the given password is a valid token, log the first 10 characters of the token.
 		// Otherwise: log the string <invalid> if a password is given, else an empty string.
+		// Log <anonymous> if the anonymous token was used.
 		passwordToLog := ""
-		if !validApiToken {
+		if anonymous {
+			passwordToLog = "<anonymous>"
+		} else if !validApiToken {
 			if len(apiToken) > 0 {
 				passwordToLog = "<invalid>"
 			}
@@ -97,24 +104,56 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		}
 
 		httpserver.Log(r.RemoteAddr, passwordToLog, w.WroteStatus(), statusText, repoName, r.Method, r.URL.Path)
+
+		h.metrics.active.Dec()
+		h.metrics.requests.WithLabelValues(op).Inc()
+		h.metrics.bytesIn.WithLabelValues(op).Add(float64(body.Count()))
+		h.metrics.bytesOut.WithLabelValues(op).Add(float64(w.WroteBodyBytes()))
+		if authFailure != "" {
+			h.metrics.authFailures.WithLabelValues(authFailure).Inc()
+		}
 	}()
 
+	if !corsAllowWrite && isPush(r) {
+		statusCode, statusText = http.StatusForbidden, "push not allowed from origin "+origin
+		return
+	}
+
 	creds := auth.CredentialsFromRequest(r)
-	if len(creds.Tokens) == 0 {
+	if len(creds.Tokens) > 0 {
+		apiToken = creds.Tokens[0]
+	} else if h.cluster.Git.AnonymousRead && h.cluster.Users.AnonymousUserToken != "" && !isPush(r) {
+		// Try the anonymous token. If the repository isn't
+		// readable by the anonymous user, we respond as if
+		// this option were disabled (below).
+		anonymous = true
+		apiToken = h.cluster.Users.AnonymousUserToken
+	} else {
+		authFailure = "no_credentials"
 		statusCode, statusText = http.StatusUnauthorized, "no credentials provided"
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"git\"")
 		return
 	}
-	apiToken = creds.Tokens[0]
 
 	// Access to paths "/foo/bar.git/*" and "/foo/bar/.git/*" are
 	// protected by the permissions on the repository named
-	// "foo/bar".
-	pathParts := strings.SplitN(r.URL.Path[1:], ".git/", 2)
-	if len(pathParts) != 2 {
+	// "foo/bar". So are archive downloads from
+	// "/repo/foo/bar/archive/*", which we serve from
+	// "{repodir}/archive/*".
+	var pathParts []string
+	isArchive := isArchiveRequest(r)
+	if isArchive {
+		pathParts = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/repo/"), "/archive/", 2)
+	} else {
+		pathParts = strings.SplitN(r.URL.Path[1:], ".git/", 2)
+	}
+	if len(pathParts) != 2 || (isArchive && h.archive == nil) {
 		statusCode, statusText = http.StatusNotFound, "not found"
 		return
 	}
+	if isArchive {
+		pathParts[1] = "archive/" + pathParts[1]
+	}
 	repoName = pathParts[0]
 	repoName = strings.TrimRight(repoName, "/")
 
@@ -126,21 +165,43 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	defer h.clientPool.Put(arv)
 
 	// Ask API server whether the repository is readable using
-	// this token (by trying to read it!)
+	// this token (by trying to read it!) If the username is a
+	// repository UUID, as it is when the client uses a credential
+	// from the credential endpoint, look up the repository by UUID:
+	// the credential's token can't be used to list repositories.
 	arv.ApiToken = apiToken
-	repoUUID, err := h.lookupRepo(arv, repoName)
+	var repoUUID string
+	var err error
+	if username, _, ok := r.BasicAuth(); ok && uuidRegexp.MatchString(username) {
+		repoUUID, err = lookupRepoByUUID(arv, username, repoName)
+	} else {
+		repoUUID, err = lookupRepo(arv, repoName)
+	}
 	if err != nil {
+		if err, ok := err.(arvadosclient.APIServerError); ok && err.HttpStatusCode == http.StatusUnauthorized {
+			authFailure = "invalid_token"
+		}
 		statusCode, statusText = http.StatusInternalServerError, err.Error()
 		return
 	}
-	validApiToken = true
+	validApiToken = !anonymous
+	if repoUUID == "" && anonymous {
+		// Ask for credentials, without revealing whether
+		// the repository exists.
+		authFailure = "no_credentials"
+		statusCode, statusText = http.StatusUnauthorized, "no credentials provided"
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"git\"")
+		return
+	}
 	if repoUUID == "" {
 		statusCode, statusText = http.StatusNotFound, "not found"
 		return
 	}
 
 	isWrite := strings.HasSuffix(r.URL.Path, "/git-receive-pack")
-	if !isWrite {
+	if anonymous {
+		statusText = "anonymous read"
+	} else if !isWrite {
 		statusText = "read"
 	} else {
 		err := arv.Update("repositories", repoUUID, arvadosclient.Dict{
@@ -149,6 +210,7 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			},
 		}, &arvadosclient.Dict{})
 		if err != nil {
+			authFailure = "permission_denied"
 			statusCode, statusText = http.StatusForbidden, err.Error()
 			return
 		}
@@ -189,12 +251,36 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 	r.URL.Path = rewrittenPath
 
-	h.handler.ServeHTTP(w, r)
+	if isArchive {
+		h.archive.ServeHTTP(w, r)
+	} else {
+		h.handler.ServeHTTP(w, r)
+	}
+}
+
+// isArchiveRequest returns true if r is a request for a repository
+// archive, i.e., "/repo/{name}/archive/{ref}.{ext}".
+func isArchiveRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/repo/") && strings.Contains(r.URL.Path, "/archive/")
 }
 
 var uuidRegexp = regexp.MustCompile(`^[0-9a-z]{5}-s0uqq-[0-9a-z]{15}$`)
 
-func (h *authHandler) lookupRepo(arv *arvadosclient.ArvadosClient, repoName string) (string, error) {
+func newClientPool(cluster *arvados.Cluster) *arvadosclient.ClientPool {
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ac, err := arvadosclient.New(client)
+	if err != nil {
+		log.Fatalf("Error setting up arvados client prototype %v", err)
+	}
+
+	return &arvadosclient.ClientPool{Prototype: ac}
+}
+
+func lookupRepo(arv *arvadosclient.ArvadosClient, repoName string) (string, error) {
 	reposFound := arvadosclient.Dict{}
 	var column string
 	if uuidRegexp.MatchString(repoName) {
@@ -216,3 +302,22 @@ func (h *authHandler) lookupRepo(arv *arvadosclient.ArvadosClient, repoName stri
 	}
 	return reposFound["items"].([]interface{})[0].(map[string]interface{})["uuid"].(string), nil
 }
+
+// lookupRepoByUUID returns repoUUID if the repository with that UUID
+// is readable and is the one called repoName (which can be either
+// its name or its UUID), otherwise "".
+func lookupRepoByUUID(arv *arvadosclient.ArvadosClient, repoUUID, repoName string) (string, error) {
+	var repo struct {
+		UUID string `json:"uuid"`
+		Name string `json:"name"`
+	}
+	err := arv.Get("repositories", repoUUID, nil, &repo)
+	if apiErr, ok := err.(arvadosclient.APIServerError); ok && apiErr.HttpStatusCode == http.StatusNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	} else if repo.UUID != repoName && repo.Name != repoName {
+		return "", nil
+	}
+	return repo.UUID, nil
+}
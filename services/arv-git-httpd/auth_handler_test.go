@@ -51,10 +51,11 @@ func (s *AuthHandlerSuite) SetUpTest(c *check.C) {
 }
 
 func (s *AuthHandlerSuite) TestPermission(c *check.C) {
-	h := &authHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	echoPath := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%v", r.URL)
 		io.WriteString(w, r.URL.Path)
-	}), cluster: s.cluster}
+	})
+	h := &authHandler{handler: echoPath, archive: echoPath, cluster: s.cluster}
 	baseURL, err := url.Parse("http://git.example/")
 	c.Assert(err, check.IsNil)
 	for _, trial := range []struct {
@@ -106,6 +107,30 @@ func (s *AuthHandlerSuite) TestPermission(c *check.C) {
 			pathIn:  arvadostest.FooRepoName + ".git/git-upload-pack",
 			pathOut: arvadostest.FooRepoUUID + "/.git/git-upload-pack",
 		},
+		{
+			label:   "archive by name",
+			token:   arvadostest.ActiveToken,
+			pathIn:  "repo/" + arvadostest.Repository2Name + "/archive/main.tar.gz",
+			pathOut: arvadostest.Repository2UUID + ".git/archive/main.tar.gz",
+		},
+		{
+			label:   "archive read-only repo",
+			token:   arvadostest.SpectatorToken,
+			pathIn:  "repo/" + arvadostest.FooRepoName + "/archive/v1/x.zip",
+			pathOut: arvadostest.FooRepoUUID + "/.git/archive/v1/x.zip",
+		},
+		{
+			label:  "archive name not found",
+			token:  arvadostest.ActiveToken,
+			pathIn: "repo/nonexistent-bogus/archive/main.tar.gz",
+			status: http.StatusNotFound,
+		},
+		{
+			label:  "archive with no repo name",
+			token:  arvadostest.ActiveToken,
+			pathIn: "repo/archive/main.tar.gz",
+			status: http.StatusNotFound,
+		},
 		{
 			label:  "write read-only repo",
 			token:  arvadostest.SpectatorToken,
@@ -136,6 +161,73 @@ func (s *AuthHandlerSuite) TestPermission(c *check.C) {
 	}
 }
 
+func (s *AuthHandlerSuite) TestAnonymousRead(c *check.C) {
+	echoPath := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})
+	s.cluster.Users.AnonymousUserToken = arvadostest.AnonymousToken
+	h := &authHandler{handler: echoPath, archive: echoPath, cluster: s.cluster}
+	baseURL, err := url.Parse("http://git.example/")
+	c.Assert(err, check.IsNil)
+	for _, trial := range []struct {
+		label   string
+		enable  bool
+		pathIn  string
+		pathOut string
+		status  int
+	}{
+		{
+			label:   "read public repo",
+			enable:  true,
+			pathIn:  arvadostest.PublicRepoName + ".git/git-upload-pack",
+			pathOut: arvadostest.PublicRepoUUID + ".git/git-upload-pack",
+		},
+		{
+			label:   "archive public repo",
+			enable:  true,
+			pathIn:  "repo/" + arvadostest.PublicRepoName + "/archive/main.tar.gz",
+			pathOut: arvadostest.PublicRepoUUID + ".git/archive/main.tar.gz",
+		},
+		{
+			label:  "read private repo",
+			enable: true,
+			pathIn: arvadostest.Repository2Name + ".git/git-upload-pack",
+			status: http.StatusUnauthorized,
+		},
+		{
+			label:  "write public repo",
+			enable: true,
+			pathIn: arvadostest.PublicRepoName + ".git/git-receive-pack",
+			status: http.StatusUnauthorized,
+		},
+		{
+			label:  "read public repo, anonymous read disabled",
+			pathIn: arvadostest.PublicRepoName + ".git/git-upload-pack",
+			status: http.StatusUnauthorized,
+		},
+	} {
+		c.Logf("trial label: %q", trial.label)
+		s.cluster.Git.AnonymousRead = trial.enable
+		u, err := baseURL.Parse(trial.pathIn)
+		c.Assert(err, check.IsNil)
+		resp := httptest.NewRecorder()
+		req := &http.Request{
+			Method: "POST",
+			URL:    u,
+			Header: http.Header{}}
+		h.ServeHTTP(resp, req)
+		if trial.status == 0 {
+			trial.status = http.StatusOK
+		}
+		c.Check(resp.Code, check.Equals, trial.status)
+		if trial.status < 400 {
+			c.Check(resp.Body.String(), check.Equals, "/"+trial.pathOut)
+		} else {
+			c.Check(resp.Header().Get("WWW-Authenticate"), check.Not(check.Equals), "")
+		}
+	}
+}
+
 func (s *AuthHandlerSuite) TestCORS(c *check.C) {
 	h := &authHandler{cluster: s.cluster}
 
@@ -151,7 +243,7 @@ func (s *AuthHandlerSuite) TestCORS(c *check.C) {
 	h.ServeHTTP(resp, req)
 	c.Check(resp.Code, check.Equals, http.StatusOK)
 	c.Check(resp.Header().Get("Access-Control-Allow-Methods"), check.Equals, "GET, POST")
-	c.Check(resp.Header().Get("Access-Control-Allow-Headers"), check.Equals, "Authorization, Content-Type")
+	c.Check(resp.Header().Get("Access-Control-Allow-Headers"), check.Equals, "Accept, Authorization, Content-Encoding, Content-Type, Git-Protocol")
 	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
 	c.Check(resp.Body.String(), check.Equals, "")
 
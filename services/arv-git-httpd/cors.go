@@ -0,0 +1,76 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Request headers that browser-based git clients send on smart HTTP
+// requests, in addition to CORS-safelisted headers.
+const corsAllowHeaders = "Accept, Authorization, Content-Encoding, Content-Type, Git-Protocol"
+
+// corsPolicy returns the policy configured in Git.CORS.Origins for
+// the given request origin. If no origins are configured, any origin
+// is allowed to read and write, without credentials.
+func corsPolicy(cluster *arvados.Cluster, origin string) (arvados.GitCORSOrigin, bool) {
+	origins := cluster.Git.CORS.Origins
+	if len(origins) == 0 {
+		return arvados.GitCORSOrigin{AllowWrite: true}, true
+	}
+	if policy, ok := origins[origin]; ok {
+		return policy, true
+	}
+	policy, ok := origins["*"]
+	return policy, ok
+}
+
+// setCORSHeaders adds the response headers that allow a browser to
+// read the response to a cross-origin request from the given origin
+// (or a preflight request for one), according to policy.
+func setCORSHeaders(w http.ResponseWriter, origin string, policy arvados.GitCORSOrigin) {
+	if policy.AllowCredentials {
+		// "*" is not allowed in combination with
+		// credentials, so the origin has to be echoed.
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+}
+
+// serveCORSPreflight responds to a CORS preflight (OPTIONS) request.
+func (h *authHandler) serveCORSPreflight(w http.ResponseWriter, r *http.Request) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method != "GET" && method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	origin := r.Header.Get("Origin")
+	policy, ok := corsPolicy(h.cluster, origin)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	setCORSHeaders(w, origin, policy)
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	if maxAge := h.cluster.Git.CORS.MaxAge.Duration(); maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// isPush returns true if r is part of a push (git-receive-pack)
+// operation.
+func isPush(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/git-receive-pack") ||
+		(strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == "git-receive-pack")
+}
@@ -0,0 +1,110 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CORSSuite{})
+
+// Tests that don't need any Arvados services
+type CORSSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *CORSSuite) SetUpTest(c *check.C) {
+	s.cluster = &arvados.Cluster{}
+	s.cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: "zzzzz.example"}
+	s.cluster.Git.CORS.MaxAge = arvados.Duration(time.Hour)
+	s.cluster.Git.CORS.Origins = map[string]arvados.GitCORSOrigin{
+		"https://ide.example":  {AllowCredentials: true, AllowWrite: true},
+		"https://view.example": {},
+	}
+}
+
+func (s *CORSSuite) preflight(origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("OPTIONS", "https://git.example/foo/bar.git/git-upload-pack", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "authorization,content-type,git-protocol")
+	resp := httptest.NewRecorder()
+	(&authHandler{cluster: s.cluster}).ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *CORSSuite) TestPreflight(c *check.C) {
+	resp := s.preflight("https://ide.example")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "https://ide.example")
+	c.Check(resp.Header().Get("Access-Control-Allow-Credentials"), check.Equals, "true")
+	c.Check(resp.Header().Get("Access-Control-Allow-Headers"), check.Matches, `.*Authorization.*Git-Protocol.*`)
+	c.Check(resp.Header().Get("Access-Control-Allow-Methods"), check.Equals, "GET, POST")
+	c.Check(resp.Header().Get("Access-Control-Max-Age"), check.Equals, "3600")
+	c.Check(resp.Header().Get("Vary"), check.Equals, "Origin")
+
+	resp = s.preflight("https://view.example")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
+	c.Check(resp.Header().Get("Access-Control-Allow-Credentials"), check.Equals, "")
+
+	// Origins that aren't listed are refused, unless there is a
+	// "*" entry.
+	resp = s.preflight("https://evil.example")
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "")
+
+	s.cluster.Git.CORS.Origins["*"] = arvados.GitCORSOrigin{}
+	resp = s.preflight("https://evil.example")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
+
+	// With no origins configured, any origin is allowed, without
+	// credentials.
+	s.cluster.Git.CORS.Origins = nil
+	resp = s.preflight("https://evil.example")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
+	c.Check(resp.Header().Get("Access-Control-Allow-Credentials"), check.Equals, "")
+}
+
+// Requests below have no credentials or are refused for pushing,
+// so authHandler responds without calling the wrapped (nil)
+// handlers.
+func (s *CORSSuite) TestRequest(c *check.C) {
+	for _, trial := range []struct {
+		origin      string
+		url         string
+		status      int
+		allowOrigin string
+	}{
+		{"https://ide.example", "/foo/bar.git/info/refs?service=git-upload-pack", http.StatusUnauthorized, "https://ide.example"},
+		{"https://ide.example", "/foo/bar.git/info/refs?service=git-receive-pack", http.StatusUnauthorized, "https://ide.example"},
+		{"https://view.example", "/foo/bar.git/info/refs?service=git-upload-pack", http.StatusUnauthorized, "*"},
+		{"https://view.example", "/foo/bar.git/info/refs?service=git-receive-pack", http.StatusForbidden, "*"},
+		{"https://view.example", "/foo/bar.git/git-receive-pack", http.StatusForbidden, "*"},
+		{"https://evil.example", "/foo/bar.git/info/refs?service=git-upload-pack", http.StatusUnauthorized, ""},
+		{"https://evil.example", "/foo/bar.git/git-receive-pack", http.StatusForbidden, ""},
+		{"", "/foo/bar.git/git-receive-pack", http.StatusUnauthorized, ""},
+	} {
+		c.Logf("trial: %+v", trial)
+		req := httptest.NewRequest("GET", "https://git.example"+trial.url, nil)
+		if trial.origin != "" {
+			req.Header.Set("Origin", trial.origin)
+		}
+		resp := httptest.NewRecorder()
+		(&authHandler{cluster: s.cluster}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status)
+		c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, trial.allowOrigin)
+		if trial.allowOrigin != "" {
+			c.Check(resp.Header().Get("Access-Control-Expose-Headers"), check.Equals, "WWW-Authenticate")
+		}
+	}
+}
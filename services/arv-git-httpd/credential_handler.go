@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+)
+
+// Maximum size of a credential request body.
+const credentialRequestMaxBytes = 1 << 16
+
+// credentialHandler exchanges an Arvados API token for a git
+// credential that can only be used to access a single repository,
+// and expires after Git.CredentialLifetime.
+//
+// The request and response bodies use the git credential helper
+// format (see gitcredentials(7)), so a credential helper only needs
+// to pass its input along with an API token, e.g.:
+//
+//	curl -fsS -H "Authorization: Bearer $ARVADOS_API_TOKEN" --data-binary @- https://git.zzzzz.example.com/_credential
+//
+// The username in the returned credential is the repository UUID,
+// and the password is a new API token whose scopes only allow
+// reading and updating that repository record.
+type credentialHandler struct {
+	cluster    *arvados.Cluster
+	clientPool *arvadosclient.ClientPool
+	setupOnce  sync.Once
+}
+
+func (h *credentialHandler) setup() {
+	h.clientPool = newClientPool(h.cluster)
+}
+
+func (h *credentialHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
+	h.setupOnce.Do(h.setup)
+
+	var statusCode int
+	var statusText string
+	var repoName string
+
+	w := httpserver.WrapResponseWriter(wOrig)
+	defer func() {
+		if w.WroteStatus() == 0 {
+			w.WriteHeader(statusCode)
+			w.Write([]byte(statusText))
+		}
+		httpserver.Log(r.RemoteAddr, "", w.WroteStatus(), statusText, repoName, r.Method, r.URL.Path)
+	}()
+
+	if r.Method != "POST" {
+		statusCode, statusText = http.StatusMethodNotAllowed, "method not allowed"
+		return
+	}
+	creds := auth.CredentialsFromRequest(r)
+	if len(creds.Tokens) == 0 {
+		statusCode, statusText = http.StatusUnauthorized, "no credentials provided"
+		return
+	}
+
+	attrs, err := readCredentialAttrs(io.LimitReader(r.Body, credentialRequestMaxBytes))
+	if err != nil {
+		statusCode, statusText = http.StatusBadRequest, err.Error()
+		return
+	}
+	repoName = repoNameFromCredentialPath(attrs["path"])
+	if repoName == "" {
+		statusCode, statusText = http.StatusBadRequest, "repository path not provided (is credential.useHttpPath enabled?)"
+		return
+	}
+
+	arv := h.clientPool.Get()
+	if arv == nil {
+		statusCode, statusText = http.StatusInternalServerError, "connection pool failed: "+h.clientPool.Err().Error()
+		return
+	}
+	defer h.clientPool.Put(arv)
+	arv.ApiToken = creds.Tokens[0]
+
+	repoUUID, err := lookupRepo(arv, repoName)
+	if apiErr, ok := err.(arvadosclient.APIServerError); ok && apiErr.HttpStatusCode == http.StatusUnauthorized {
+		statusCode, statusText = http.StatusUnauthorized, err.Error()
+		return
+	} else if err != nil {
+		statusCode, statusText = http.StatusInternalServerError, err.Error()
+		return
+	} else if repoUUID == "" {
+		statusCode, statusText = http.StatusNotFound, "not found"
+		return
+	}
+
+	expiresAt := time.Now().Add(h.cluster.Git.CredentialLifetime.Duration())
+	var aca arvados.APIClientAuthorization
+	err = arv.Create("api_client_authorizations", arvadosclient.Dict{
+		"api_client_authorization": arvadosclient.Dict{
+			"scopes": []string{
+				"GET /arvados/v1/repositories/" + repoUUID,
+				"PUT /arvados/v1/repositories/" + repoUUID,
+			},
+			"expires_at": expiresAt.UTC().Format(time.RFC3339Nano),
+		},
+	}, &aca)
+	if apiErr, ok := err.(arvadosclient.APIServerError); ok && apiErr.HttpStatusCode == http.StatusForbidden {
+		statusCode, statusText = http.StatusForbidden, "cannot create credential using this token: "+err.Error()
+		return
+	} else if err != nil {
+		statusCode, statusText = http.StatusInternalServerError, err.Error()
+		return
+	}
+
+	statusCode, statusText = http.StatusOK, "issued"
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "username=%s\npassword=%s\npassword_expiry_utc=%d\n", repoUUID, aca.TokenV2(), expiresAt.Unix())
+}
+
+// readCredentialAttrs parses a git credential description, i.e.,
+// "key=value" lines terminated by a blank line or EOF.
+func readCredentialAttrs(r io.Reader) (map[string]string, error) {
+	attrs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid credential attribute line %q", line)
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	return attrs, scanner.Err()
+}
+
+// repoNameFromCredentialPath returns the repository name for the
+// given URL path, which can be "foo/bar.git", "foo/bar/.git", or
+// either of those followed by the path of a git request.
+func repoNameFromCredentialPath(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path+"/", ".git/"); i >= 0 {
+		path = path[:i]
+	}
+	return strings.TrimRight(path, "/")
+}
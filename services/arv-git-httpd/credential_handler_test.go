@@ -0,0 +1,123 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CredentialSuite{})
+
+// Tests that don't need any Arvados services
+type CredentialSuite struct{}
+
+func (s *CredentialSuite) TestReadCredentialAttrs(c *check.C) {
+	attrs, err := readCredentialAttrs(strings.NewReader("protocol=https\nhost=git.example\npath=foo/bar.git\n\nignored=1\n"))
+	c.Check(err, check.IsNil)
+	c.Check(attrs, check.DeepEquals, map[string]string{
+		"protocol": "https",
+		"host":     "git.example",
+		"path":     "foo/bar.git",
+	})
+
+	_, err = readCredentialAttrs(strings.NewReader("protocol=https\nbogus\n"))
+	c.Check(err, check.ErrorMatches, `invalid credential attribute line "bogus"`)
+}
+
+func (s *CredentialSuite) TestRepoNameFromCredentialPath(c *check.C) {
+	for path, expect := range map[string]string{
+		"foo/bar.git":                        "foo/bar",
+		"/foo/bar.git":                       "foo/bar",
+		"foo/bar/.git":                       "foo/bar",
+		"foo/bar.git/info/refs":              "foo/bar",
+		"zzzzz-s0uqq-382brsig8rp3666.git":    "zzzzz-s0uqq-382brsig8rp3666",
+		"foo/bar":                            "foo/bar",
+		"":                                   "",
+		".git":                               "",
+		"zzzzz-s0uqq-382brsig8rp3666/.git/x": "zzzzz-s0uqq-382brsig8rp3666",
+	} {
+		c.Check(repoNameFromCredentialPath(path), check.Equals, expect, check.Commentf("%q", path))
+	}
+}
+
+func (s *AuthHandlerSuite) getCredential(c *check.C, token, body string) *httptest.ResponseRecorder {
+	s.cluster.Git.CredentialLifetime = arvados.Duration(time.Hour)
+	h := &credentialHandler{cluster: s.cluster}
+	req := httptest.NewRequest("POST", "http://git.example/_credential", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *AuthHandlerSuite) TestCredential(c *check.C) {
+	resp := s.getCredential(c, arvadostest.ActiveToken, "protocol=https\nhost=git.example\npath="+arvadostest.Repository2Name+".git\n\n")
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	attrs, err := readCredentialAttrs(resp.Body)
+	c.Assert(err, check.IsNil)
+	c.Check(attrs["username"], check.Equals, arvadostest.Repository2UUID)
+	c.Check(attrs["password"], check.Matches, `v2/zzzzz-gj3su-[0-9a-z]{15}/.*`)
+	c.Check(attrs["password_expiry_utc"], check.Matches, `[0-9]+`)
+
+	h := &authHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}), cluster: s.cluster}
+	for _, trial := range []struct {
+		label    string
+		username string
+		path     string
+		status   int
+	}{
+		{"read by name", attrs["username"], arvadostest.Repository2Name + ".git/git-upload-pack", http.StatusOK},
+		{"read by uuid", attrs["username"], arvadostest.Repository2UUID + ".git/git-upload-pack", http.StatusOK},
+		{"write by name", attrs["username"], arvadostest.Repository2Name + ".git/git-receive-pack", http.StatusOK},
+		{"username does not match path", attrs["username"], arvadostest.FooRepoName + ".git/git-upload-pack", http.StatusNotFound},
+		{"credential used for other repo", arvadostest.FooRepoUUID, arvadostest.FooRepoName + ".git/git-upload-pack", http.StatusInternalServerError},
+		{"credential used without username", "", arvadostest.Repository2Name + ".git/git-upload-pack", http.StatusInternalServerError},
+	} {
+		c.Logf("trial label: %q", trial.label)
+		req := httptest.NewRequest("POST", "http://git.example/"+trial.path, nil)
+		req.SetBasicAuth(trial.username, attrs["password"])
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status)
+	}
+}
+
+func (s *AuthHandlerSuite) TestCredentialErrors(c *check.C) {
+	resp := s.getCredential(c, "", "path="+arvadostest.Repository2Name+".git\n")
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	resp = s.getCredential(c, arvadostest.ActiveToken, "protocol=https\nhost=git.example\n")
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+	c.Check(resp.Body.String(), check.Matches, `.*credential.useHttpPath.*`)
+
+	resp = s.getCredential(c, arvadostest.ActiveToken, "path=nonexistent-bogus.git\n")
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	resp = s.getCredential(c, "bogustoken", "path="+arvadostest.Repository2Name+".git\n")
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	// Credentials expire after CredentialLifetime
+	resp = s.getCredential(c, arvadostest.ActiveToken, "path="+arvadostest.Repository2Name+".git\n")
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	attrs, err := readCredentialAttrs(resp.Body)
+	c.Assert(err, check.IsNil)
+	expiry, err := strconv.ParseInt(attrs["password_expiry_utc"], 10, 64)
+	c.Check(err, check.IsNil)
+	c.Check(expiry > time.Now().Unix(), check.Equals, true)
+	c.Check(expiry <= time.Now().Add(time.Hour).Unix(), check.Equals, true)
+}
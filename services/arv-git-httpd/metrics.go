@@ -0,0 +1,87 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	requests     *prometheus.CounterVec
+	authFailures *prometheus.CounterVec
+	bytesIn      *prometheus.CounterVec
+	bytesOut     *prometheus.CounterVec
+	active       prometheus.Gauge
+}
+
+func newMetrics(reg *prometheus.Registry) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "githttpd",
+			Name:      "requests_total",
+			Help:      "Number of git requests, by operation (fetch, push, or archive).",
+		}, []string{"operation"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "githttpd",
+			Name:      "auth_failures_total",
+			Help:      "Number of git requests rejected because of missing/invalid credentials or insufficient permission.",
+		}, []string{"reason"}),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "githttpd",
+			Name:      "received_bytes_total",
+			Help:      "Number of request body bytes received from git clients, by operation (fetch, push, or archive).",
+		}, []string{"operation"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "githttpd",
+			Name:      "sent_bytes_total",
+			Help:      "Number of response body bytes sent to git clients, by operation (fetch, push, or archive).",
+		}, []string{"operation"}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "githttpd",
+			Name:      "active_connections",
+			Help:      "Number of git requests currently being handled.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.authFailures, m.bytesIn, m.bytesOut, m.active)
+	return m
+}
+
+// gitOperation returns "push" if r is part of a git push, "archive"
+// if r is an archive download, otherwise "fetch".
+func gitOperation(r *http.Request) string {
+	if isArchiveRequest(r) {
+		return "archive"
+	}
+	if strings.HasSuffix(r.URL.Path, "/git-receive-pack") || r.URL.Query().Get("service") == "git-receive-pack" {
+		return "push"
+	}
+	return "fetch"
+}
+
+// countingReader counts the bytes read from an io.ReadCloser.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func (cr *countingReader) Count() int64 {
+	return atomic.LoadInt64(&cr.n)
+}
@@ -8,8 +8,11 @@ import (
 	"net/http"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type server struct {
@@ -18,12 +21,17 @@ type server struct {
 }
 
 func (srv *server) Start() error {
+	reg := prometheus.NewRegistry()
 	mux := http.NewServeMux()
-	mux.Handle("/", &authHandler{handler: newGitHandler(srv.cluster), cluster: srv.cluster})
+	mux.Handle("/", &authHandler{handler: newGitHandler(srv.cluster), archive: newArchiveHandler(srv.cluster), cluster: srv.cluster, metrics: newMetrics(reg)})
+	if srv.cluster.Git.CredentialLifetime > 0 {
+		mux.Handle("/_credential", &credentialHandler{cluster: srv.cluster})
+	}
 	mux.Handle("/_health/", &health.Handler{
 		Token:  srv.cluster.ManagementToken,
 		Prefix: "/_health/",
 	})
+	mux.Handle("/metrics", auth.RequireLiteralToken(srv.cluster.ManagementToken, promhttp.HandlerFor(reg, promhttp.HandlerOpts{})))
 
 	var listen arvados.URL
 	for listen = range srv.cluster.Services.GitHTTP.InternalURLs {
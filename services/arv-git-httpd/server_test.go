@@ -121,3 +121,34 @@ func (s *GitSuite) TestHealthCheckPing(c *check.C) {
 	c.Check(resp.Code, check.Equals, 200)
 	c.Check(resp.Body.String(), check.Matches, `{"health":"OK"}\n`)
 }
+
+func (s *GitSuite) TestMetrics(c *check.C) {
+	err := s.RunGit(c, spectatorToken, "fetch", "active/foo.git")
+	c.Assert(err, check.Equals, nil)
+	err = s.RunGit(c, spectatorToken, "push", "active/foo.git", "master:newbranchfail")
+	c.Assert(err, check.NotNil)
+
+	req, err := http.NewRequest("GET", "http://"+s.testServer.Addr+"/active/foo.git/info/refs", nil)
+	c.Assert(err, check.Equals, nil)
+	resp := httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	req, err = http.NewRequest("GET", "http://"+s.testServer.Addr+"/metrics", nil)
+	c.Assert(err, check.Equals, nil)
+	resp = httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	req.Header.Set("Authorization", "Bearer "+arvadostest.ManagementToken)
+	resp = httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	body := resp.Body.String()
+	c.Check(body, check.Matches, `(?ms).*\narvados_githttpd_requests_total{operation="fetch"} [1-9][0-9]*\n.*`)
+	c.Check(body, check.Matches, `(?ms).*\narvados_githttpd_requests_total{operation="push"} [1-9][0-9]*\n.*`)
+	c.Check(body, check.Matches, `(?ms).*\narvados_githttpd_auth_failures_total{reason="no_credentials"} [1-9][0-9]*\n.*`)
+	c.Check(body, check.Matches, `(?ms).*\narvados_githttpd_auth_failures_total{reason="permission_denied"} [1-9][0-9]*\n.*`)
+	c.Check(body, check.Matches, `(?ms).*\narvados_githttpd_sent_bytes_total{operation="fetch"} [1-9][0-9]*\n.*`)
+	c.Check(body, check.Matches, `(?ms).*\narvados_githttpd_active_connections 0\n.*`)
+}
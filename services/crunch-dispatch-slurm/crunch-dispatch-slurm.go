@@ -9,12 +9,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,6 +29,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/dispatch"
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/ghodss/yaml"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -47,6 +52,13 @@ type Dispatcher struct {
 	slurm   Slurm
 
 	Client arvados.Client
+
+	registry *prometheus.Registry
+	metrics  *dispatcherMetrics
+
+	// If non-empty, print the sbatch command and script for
+	// this container instead of running the dispatcher.
+	dryRunContainer string
 }
 
 func main() {
@@ -69,6 +81,9 @@ func (disp *Dispatcher) Run(prog string, args []string) error {
 		return err
 	}
 	disp.setup()
+	if disp.dryRunContainer != "" {
+		return disp.dryRun(os.Stdout, disp.dryRunContainer)
+	}
 	return disp.run()
 }
 
@@ -91,6 +106,10 @@ func (disp *Dispatcher) configure(prog string, args []string) error {
 		"version",
 		false,
 		"Print version information and exit.")
+	dryRunContainer := flags.String(
+		"dry-run-container",
+		"",
+		"Print the sbatch command and script that would be used to run the given container `uuid`, and exit without submitting it.")
 
 	args = loader.MungeLegacyConfigArgs(logrus.StandardLogger(), args, "-legacy-crunch-dispatch-slurm-config")
 
@@ -107,7 +126,10 @@ func (disp *Dispatcher) configure(prog string, args []string) error {
 		return nil
 	}
 
-	disp.logger.Printf("crunch-dispatch-slurm %s started", version)
+	disp.dryRunContainer = *dryRunContainer
+	if disp.dryRunContainer == "" {
+		disp.logger.Printf("crunch-dispatch-slurm %s started", version)
+	}
 
 	cfg, err := loader.Load()
 	if err != nil {
@@ -133,6 +155,7 @@ func (disp *Dispatcher) configure(prog string, args []string) error {
 			os.Setenv("ARVADOS_API_HOST_INSECURE", "1")
 		}
 		os.Setenv("ARVADOS_EXTERNAL_CLIENT", "")
+		os.Setenv("ARVADOS_NETWORK_ZONE", "")
 		for k, v := range disp.cluster.Containers.SLURM.SbatchEnvironmentVariables {
 			os.Setenv(k, v)
 		}
@@ -162,17 +185,22 @@ func (disp *Dispatcher) setup() {
 	}
 	arv.Retries = 25
 
+	disp.registry = prometheus.NewRegistry()
+	disp.metrics = newDispatcherMetrics(disp.registry)
 	disp.slurm = NewSlurmCLI()
 	disp.sqCheck = &SqueueChecker{
 		Logger:         disp.logger,
 		Period:         time.Duration(disp.cluster.Containers.CloudVMs.PollInterval),
 		PrioritySpread: disp.cluster.Containers.SLURM.PrioritySpread,
 		Slurm:          disp.slurm,
+		LogEvent:       disp.logDispatchEvent,
+		StateFile:      disp.cluster.Containers.SLURM.StateFile,
 	}
 	disp.Dispatcher = &dispatch.Dispatcher{
 		Arv:            arv,
 		Logger:         disp.logger,
 		BatchSize:      disp.cluster.API.MaxItemsPerResponse,
+		Select:         []string{"created_at", "started_at", "runtime_constraints", "scheduling_parameters", "mounts", "container_image", "runtime_status", "lock_count"},
 		RunContainer:   disp.runContainer,
 		PollPeriod:     time.Duration(disp.cluster.Containers.CloudVMs.PollInterval),
 		MinRetryPeriod: time.Duration(disp.cluster.Containers.MinRetryPeriod),
@@ -186,6 +214,9 @@ func (disp *Dispatcher) run() error {
 		go SlurmNodeTypeFeatureKludge(disp.cluster)
 	}
 
+	if err := disp.serveManagement(); err != nil {
+		return err
+	}
 	if _, err := daemon.SdNotify(false, "READY=1"); err != nil {
 		log.Printf("Error notifying init daemon: %v", err)
 	}
@@ -248,22 +279,164 @@ func (disp *Dispatcher) sbatchArgs(container arvados.Container) ([]string, error
 		args = append(args, "--partition="+strings.Join(container.SchedulingParameters.Partitions, ","))
 	}
 
+	resArgs, err := disp.slurmResourceArgs(container)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, resArgs...)
+
+	return args, nil
+}
+
+// schedulingParametersError indicates that a container's scheduling
+// parameters request resources that are not configured, so it can
+// never be submitted.
+type schedulingParametersError struct {
+	error
+}
+
+// slurmResourceArgs returns sbatch arguments for the node/task
+// counts, licenses, and burst buffers requested in the container's
+// scheduling parameters, using the mappings in the Containers.SLURM
+// config, and for the GPUs requested in its runtime constraints.
+func (disp *Dispatcher) slurmResourceArgs(container arvados.Container) ([]string, error) {
+	var args []string
+	sp := container.SchedulingParameters
+
+	if sp.Nodes < 0 || sp.Tasks < 0 {
+		return nil, schedulingParametersError{fmt.Errorf("invalid node count %d or task count %d", sp.Nodes, sp.Tasks)}
+	}
+	if sp.Tasks > 0 && sp.Tasks < sp.Nodes {
+		return nil, schedulingParametersError{fmt.Errorf("task count %d is less than node count %d", sp.Tasks, sp.Nodes)}
+	}
+	if sp.Nodes > 1 {
+		args = append(args, fmt.Sprintf("--nodes=%d", sp.Nodes))
+	}
+	if sp.Tasks > 0 {
+		args = append(args, fmt.Sprintf("--ntasks=%d", sp.Tasks))
+	}
+	if n := container.RuntimeConstraints.CUDA.DeviceCount; n < 0 {
+		return nil, schedulingParametersError{fmt.Errorf("invalid CUDA device count %d", n)}
+	} else if n > 0 {
+		args = append(args, fmt.Sprintf("--gres=gpu:%d", n))
+	}
+
+	var licenses []string
+	for name, count := range sp.Licenses {
+		lic, ok := disp.cluster.Containers.SLURM.Licenses[name]
+		if !ok {
+			return nil, schedulingParametersError{fmt.Errorf("license %q is not configured", name)}
+		}
+		if count < 1 {
+			return nil, schedulingParametersError{fmt.Errorf("invalid count %d for license %q", count, name)}
+		}
+		if lic.SLURMName == "" {
+			lic.SLURMName = name
+		}
+		licenses = append(licenses, fmt.Sprintf("%s:%d", lic.SLURMName, count))
+	}
+	if len(licenses) > 0 {
+		sort.Strings(licenses)
+		args = append(args, "--licenses="+strings.Join(licenses, ","))
+	}
+
+	var bbs []string
+	for name, size := range sp.BurstBuffers {
+		bb, ok := disp.cluster.Containers.SLURM.BurstBuffers[name]
+		if !ok || bb.Specification == "" {
+			return nil, schedulingParametersError{fmt.Errorf("burst buffer %q is not configured", name)}
+		}
+		if size < 1 {
+			return nil, schedulingParametersError{fmt.Errorf("invalid size %d for burst buffer %q", size, name)}
+		}
+		mib := int64(math.Ceil(float64(size) / float64(1048576)))
+		bbs = append(bbs, strings.Replace(bb.Specification, "${size}", fmt.Sprintf("%dM", mib), -1))
+	}
+	if len(bbs) > 0 {
+		sort.Strings(bbs)
+		args = append(args, "--bb="+strings.Join(bbs, " "))
+	}
 	return args, nil
 }
 
-func (disp *Dispatcher) submit(container arvados.Container, crunchRunCommand []string) error {
+func (disp *Dispatcher) crunchRunCommand() []string {
+	cmd := []string{disp.cluster.Containers.CrunchRunCommand}
+	return append(cmd, disp.cluster.Containers.CrunchRunArguments()...)
+}
+
+// sbatchScript returns the sbatch arguments and batch script used to
+// submit the given container.
+func (disp *Dispatcher) sbatchScript(container arvados.Container, crunchRunCommand []string) ([]string, string, error) {
 	// append() here avoids modifying crunchRunCommand's
 	// underlying array, which is shared with other goroutines.
 	crArgs := append([]string(nil), crunchRunCommand...)
-	crArgs = append(crArgs, container.UUID)
-	crScript := strings.NewReader(execScript(crArgs))
 
 	sbArgs, err := disp.sbatchArgs(container)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	byPartition := map[string][]string{}
+	for partition, args := range disp.partitionCgroupArgs(container) {
+		byPartition[partition] = append(append(append([]string(nil), crArgs...), args...), container.UUID)
+	}
+	return sbArgs, partitionExecScript(append(crArgs, container.UUID), byPartition), nil
+}
+
+// partitionCgroupArgs returns the crunch-run cgroup arguments
+// configured in Containers.SLURM.PartitionCgroups, for each partition
+// the container might run in.
+func (disp *Dispatcher) partitionCgroupArgs(container arvados.Container) map[string][]string {
+	requested := map[string]bool{}
+	for _, p := range container.SchedulingParameters.Partitions {
+		requested[p] = true
+	}
+	byPartition := map[string][]string{}
+	for partition, cg := range disp.cluster.Containers.SLURM.PartitionCgroups {
+		if len(requested) > 0 && !requested[partition] {
+			continue
+		}
+		var args []string
+		if cg.ParentSubsystem != "" {
+			args = append(args, "-cgroup-parent-subsystem="+cg.ParentSubsystem)
+		}
+		if cg.Root != "" {
+			args = append(args, "-cgroup-root="+cg.Root)
+		}
+		if len(args) > 0 {
+			byPartition[partition] = args
+		}
+	}
+	return byPartition
+}
+
+func (disp *Dispatcher) submit(container arvados.Container, crunchRunCommand []string) (string, error) {
+	sbArgs, script, err := disp.sbatchScript(container, crunchRunCommand)
+	if err != nil {
+		return "", err
 	}
 	log.Printf("running sbatch %+q", sbArgs)
-	return disp.slurm.Batch(crScript, sbArgs)
+	return disp.slurm.Batch(strings.NewReader(script), sbArgs)
+}
+
+// dryRun fetches the container with the given UUID and writes the
+// sbatch command and batch script that would be used to submit it,
+// without submitting anything.
+func (disp *Dispatcher) dryRun(w io.Writer, uuid string) error {
+	var ctr arvados.Container
+	err := disp.Arv.Get("containers", uuid, nil, &ctr)
+	if err != nil {
+		return fmt.Errorf("error getting container %s: %s", uuid, err)
+	}
+	sbArgs, script, err := disp.sbatchScript(ctr, disp.crunchRunCommand())
+	if err != nil {
+		return fmt.Errorf("cannot submit container %s: %s", uuid, err)
+	}
+	cmd := "sbatch"
+	for _, arg := range sbArgs {
+		cmd += " " + shellQuote(arg)
+	}
+	_, err = fmt.Fprintf(w, "%s <<'EOF'\n%sEOF\n", cmd, script)
+	return err
 }
 
 // Submit a container to the slurm queue (or resume monitoring if it's
@@ -274,43 +447,25 @@ func (disp *Dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Contain
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// timing is non-nil if this dispatcher submitted the slurm
+	// job, and the container has not yet been seen in Running
+	// state.
+	var timing *dispatchTiming
+
 	if ctr.State == dispatch.Locked && !disp.sqCheck.HasUUID(ctr.UUID) {
+		timing = &dispatchTiming{QueuedAt: ctr.CreatedAt, LockedAt: time.Now()}
 		log.Printf("Submitting container %s to slurm", ctr.UUID)
-		cmd := []string{disp.cluster.Containers.CrunchRunCommand}
-		cmd = append(cmd, disp.cluster.Containers.CrunchRunArgumentsList...)
-		if err := disp.submit(ctr, cmd); err != nil {
-			var text string
-			switch err := err.(type) {
-			case dispatchcloud.ConstraintsNotSatisfiableError:
-				var logBuf bytes.Buffer
-				fmt.Fprintf(&logBuf, "cannot run container %s: %s\n", ctr.UUID, err)
-				if len(err.AvailableTypes) == 0 {
-					fmt.Fprint(&logBuf, "No instance types are configured.\n")
-				} else {
-					fmt.Fprint(&logBuf, "Available instance types:\n")
-					for _, t := range err.AvailableTypes {
-						fmt.Fprintf(&logBuf,
-							"Type %q: %d VCPUs, %d RAM, %d Scratch, %f Price\n",
-							t.Name, t.VCPUs, t.RAM, t.Scratch, t.Price,
-						)
-					}
-				}
-				text = logBuf.String()
-				disp.UpdateState(ctr.UUID, dispatch.Cancelled)
-			default:
-				text = fmt.Sprintf("Error submitting container %s to slurm: %s", ctr.UUID, err)
-			}
-			log.Print(text)
-
-			lr := arvadosclient.Dict{"log": arvadosclient.Dict{
-				"object_uuid": ctr.UUID,
-				"event_type":  "dispatch",
-				"properties":  map[string]string{"text": text}}}
-			disp.Arv.Create("logs", lr, nil)
-
-			disp.Unlock(ctr.UUID)
+		jobID, ok := disp.submitWithRetry(ctr, status)
+		if !ok {
 			return
 		}
+		timing.SubmittedAt = time.Now()
+		if jobID != "" {
+			disp.recordJobID(ctr, jobID)
+		}
+		if resArgs, _ := disp.slurmResourceArgs(ctr); len(resArgs) > 0 {
+			disp.logDispatchEvent(ctr.UUID, fmt.Sprintf("Requested slurm resources: %s", strings.Join(resArgs, " ")))
+		}
 	}
 
 	log.Printf("Start monitoring container %v in state %q", ctr.UUID, ctr.State)
@@ -325,6 +480,7 @@ func (disp *Dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Contain
 		cancel()
 	}(ctr.UUID)
 
+	var lastCancelError string
 	for {
 		select {
 		case <-ctx.Done():
@@ -340,12 +496,20 @@ func (disp *Dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Contain
 			}
 			return
 		case updated, ok := <-status:
+			if ok && timing != nil && updated.State == dispatch.Running {
+				timing.StartedAt = time.Now()
+				if updated.StartedAt != nil {
+					timing.StartedAt = *updated.StartedAt
+				}
+				disp.recordTiming(ctr.UUID, *timing)
+				timing = nil
+			}
 			if !ok {
 				log.Printf("container %s is done: cancel slurm job", ctr.UUID)
-				disp.scancel(ctr)
+				disp.scancel(ctr, &lastCancelError)
 			} else if updated.Priority == 0 {
 				log.Printf("container %s has state %q, priority %d: cancel slurm job", ctr.UUID, updated.State, updated.Priority)
-				disp.scancel(ctr)
+				disp.scancel(ctr, &lastCancelError)
 			} else {
 				p := int64(updated.Priority)
 				if p <= 1000 {
@@ -356,16 +520,319 @@ func (disp *Dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Contain
 					p = int64(p)<<50 - (updated.CreatedAt.UnixNano() >> 14)
 				}
 				disp.sqCheck.SetPriority(ctr.UUID, p)
+				if updated.State == dispatch.Locked || updated.State == dispatch.Running {
+					disp.updateEstimatedStartTime(updated)
+				}
+			}
+		}
+	}
+}
+
+// submitWithRetry submits the container to slurm. If sbatch fails,
+// it keeps the container locked and retries with exponential backoff
+// (see sbatchRetryDelay), until the container is submitted, or
+// Containers.SLURM.SbatchMaxAttempts is reached, or the container is
+// cancelled.
+//
+// It returns false if the container was not submitted, in which case
+// the container has been cancelled or unlocked.
+func (disp *Dispatcher) submitWithRetry(ctr arvados.Container, status <-chan arvados.Container) (string, bool) {
+	cmd := disp.crunchRunCommand()
+	var lastText string
+	for attempt := 1; ; attempt++ {
+		jobID, err := disp.submit(ctr, cmd)
+		if attempt > 1 {
+			disp.metrics.sbatchRetrying.Dec()
+		}
+		if err == nil {
+			return jobID, true
+		}
+		var text string
+		switch err := err.(type) {
+		case dispatchcloud.ConstraintsNotSatisfiableError:
+			var logBuf bytes.Buffer
+			fmt.Fprintf(&logBuf, "cannot run container %s: %s\n", ctr.UUID, err)
+			if len(err.AvailableTypes) == 0 {
+				fmt.Fprint(&logBuf, "No instance types are configured.\n")
+			} else {
+				fmt.Fprint(&logBuf, "Available instance types:\n")
+				for _, t := range err.AvailableTypes {
+					fmt.Fprintf(&logBuf,
+						"Type %q: %d VCPUs, %d RAM, %d Scratch, %f Price\n",
+						t.Name, t.VCPUs, t.RAM, t.Scratch, t.Price,
+					)
+				}
+			}
+			text = logBuf.String()
+			disp.UpdateState(ctr.UUID, dispatch.Cancelled)
+		case schedulingParametersError:
+			text = fmt.Sprintf("cannot run container %s: %s", ctr.UUID, err)
+			disp.UpdateState(ctr.UUID, dispatch.Cancelled)
+		default:
+			disp.metrics.sbatchFailures.Inc()
+			text = fmt.Sprintf("Error submitting container %s to slurm: %s", ctr.UUID, err)
+			log.Print(text)
+			// Don't fill the dispatch log with identical
+			// messages.
+			if text != lastText {
+				lastText = text
+				disp.logDispatchEvent(ctr.UUID, text)
+			}
+			if max := disp.cluster.Containers.SLURM.SbatchMaxAttempts; max > 0 && attempt >= max {
+				disp.giveUpSbatch(ctr, attempt, err)
+				return "", false
+			}
+			delay := disp.sbatchRetryDelay(attempt)
+			log.Printf("container %s: sbatch attempt %d failed, retrying in %v", ctr.UUID, attempt, delay)
+			disp.metrics.sbatchRetrying.Inc()
+			if waitForRetry(delay, status) {
+				continue
+			}
+			disp.metrics.sbatchRetrying.Dec()
+			log.Printf("container %s was cancelled or deprioritized while waiting to retry sbatch", ctr.UUID)
+			disp.Unlock(ctr.UUID)
+			return "", false
+		}
+		log.Print(text)
+		disp.logDispatchEvent(ctr.UUID, text)
+		disp.Unlock(ctr.UUID)
+		return "", false
+	}
+}
+
+// sbatchRetryDelay returns the time to wait before the next sbatch
+// attempt, after the given number of consecutive failed attempts.
+func (disp *Dispatcher) sbatchRetryDelay(attempt int) time.Duration {
+	delay := disp.cluster.Containers.SLURM.SbatchRetryInitialDelay.Duration()
+	max := disp.cluster.Containers.SLURM.SbatchRetryMaxDelay.Duration()
+	for i := 1; i < attempt && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// waitForRetry waits for the given delay and returns true, or returns
+// false early if status indicates the container no longer needs to
+// run (it has been cancelled, or its priority is zero).
+func waitForRetry(delay time.Duration, status <-chan arvados.Container) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case updated, ok := <-status:
+			if !ok || updated.Priority == 0 {
+				return false
 			}
 		}
 	}
 }
-func (disp *Dispatcher) scancel(ctr arvados.Container) {
+
+// giveUpSbatch stops trying to submit a container after the given
+// number of consecutive sbatch failures, and sends an alert to
+// Containers.SLURM.SbatchFailureWebhookURL if configured.
+//
+// The container is unlocked, so it counts as a failed dispatch
+// attempt, and will be locked and submitted again later. If it has
+// already been locked MaxDispatchAttempts times, it is cancelled
+// instead, and the reason is recorded in its runtime_status.
+func (disp *Dispatcher) giveUpSbatch(ctr arvados.Container, attempts int, err error) {
+	if ctr.LockCount < disp.cluster.Containers.MaxDispatchAttempts {
+		text := fmt.Sprintf("Unlocking container %s after %d failed attempts to submit to slurm (dispatch attempt %d of %d). Last error: %s", ctr.UUID, attempts, ctr.LockCount, disp.cluster.Containers.MaxDispatchAttempts, err)
+		log.Print(text)
+		disp.logDispatchEvent(ctr.UUID, text)
+		disp.Unlock(ctr.UUID)
+		disp.metrics.sbatchGiveUps.WithLabelValues("unlocked").Inc()
+		disp.sendSbatchFailureAlert(ctr.UUID, attempts, err, "unlocked")
+		return
+	}
+	text := fmt.Sprintf("Cancelled container %s after %d failed attempts to submit to slurm. Last error: %s", ctr.UUID, attempts, err)
+	log.Print(text)
+	disp.logDispatchEvent(ctr.UUID, text)
+
+	rs := map[string]interface{}{}
+	for k, v := range ctr.RuntimeStatus {
+		rs[k] = v
+	}
+	rs["error"] = fmt.Sprintf("Failed to submit container to slurm after %d attempts", attempts)
+	rs["errorDetail"] = err.Error()
+	uerr := disp.Arv.Update("containers", ctr.UUID, arvadosclient.Dict{
+		"container": arvadosclient.Dict{"runtime_status": rs}}, nil)
+	if uerr != nil {
+		log.Printf("error saving sbatch failure in container %s runtime_status: %s", ctr.UUID, uerr)
+	}
+	disp.UpdateState(ctr.UUID, dispatch.Cancelled)
+	disp.metrics.sbatchGiveUps.WithLabelValues("cancelled").Inc()
+	disp.sendSbatchFailureAlert(ctr.UUID, attempts, err, "cancelled")
+}
+
+// sendSbatchFailureAlert POSTs a JSON message describing the failure
+// and the action taken ("unlocked" or "cancelled") to
+// Containers.SLURM.SbatchFailureWebhookURL, if configured.
+func (disp *Dispatcher) sendSbatchFailureAlert(uuid string, attempts int, err error, action string) {
+	url := disp.cluster.Containers.SLURM.SbatchFailureWebhookURL
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"cluster_id":     disp.cluster.ClusterID,
+		"container_uuid": uuid,
+		"attempts":       attempts,
+		"error":          err.Error(),
+		"action":         action,
+	})
+	client := &http.Client{Timeout: time.Minute}
+	resp, herr := client.Post(url, "application/json", bytes.NewReader(body))
+	if herr != nil {
+		log.Printf("error sending sbatch failure alert for container %s: %s", uuid, herr)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("error sending sbatch failure alert for container %s: webhook returned %s", uuid, resp.Status)
+	}
+}
+
+// recordJobID adds the slurm job ID to the container's runtime_status
+// and dispatch log, so operators can find the corresponding job in
+// sacct/squeue output.
+func (disp *Dispatcher) recordJobID(ctr arvados.Container, jobID string) {
+	text := fmt.Sprintf("Submitted container %s to slurm as job %s", ctr.UUID, jobID)
+	log.Print(text)
+	disp.logDispatchEvent(ctr.UUID, text)
+
+	rs := map[string]interface{}{}
+	for k, v := range ctr.RuntimeStatus {
+		rs[k] = v
+	}
+	rs["slurmJobID"] = jobID
+	err := disp.Arv.Update("containers", ctr.UUID, arvadosclient.Dict{
+		"container": arvadosclient.Dict{"runtime_status": rs}}, nil)
+	if err != nil {
+		log.Printf("error saving slurm job ID in container %s runtime_status: %s", ctr.UUID, err)
+	}
+}
+
+// updateEstimatedStartTime saves the time slurm expects to start a
+// pending container's job (see SqueueChecker.EstimatedStartTime) in
+// the container's runtime_status, so users can see how long it is
+// likely to wait in the queue. Once the container is running, the
+// estimate is removed. The API is only called when the estimate
+// changes.
+func (disp *Dispatcher) updateEstimatedStartTime(ctr arvados.Container) {
+	var want string
+	if ctr.State != dispatch.Running {
+		if t, ok := disp.sqCheck.EstimatedStartTime(ctr.UUID); ok {
+			want = t.UTC().Format(time.RFC3339)
+		}
+	}
+	have, _ := ctr.RuntimeStatus["estimated_start_time"].(string)
+	if want == have {
+		return
+	}
+	rs := map[string]interface{}{}
+	for k, v := range ctr.RuntimeStatus {
+		rs[k] = v
+	}
+	if want == "" {
+		delete(rs, "estimated_start_time")
+	} else {
+		rs["estimated_start_time"] = want
+	}
+	err := disp.Arv.Update("containers", ctr.UUID, arvadosclient.Dict{
+		"container": arvadosclient.Dict{"runtime_status": rs}}, nil)
+	if err != nil {
+		log.Printf("error saving estimated start time in container %s runtime_status: %s", ctr.UUID, err)
+	}
+}
+
+// dispatchTiming records when a container reached each stage of the
+// dispatch process.
+type dispatchTiming struct {
+	QueuedAt    time.Time // container created
+	LockedAt    time.Time // locked by this dispatcher
+	SubmittedAt time.Time // sbatch succeeded
+	StartedAt   time.Time // container state changed to Running
+}
+
+// properties returns a summary of t suitable for saving in a
+// container request's properties.
+func (t dispatchTiming) properties() map[string]interface{} {
+	seconds := func(from, to time.Time) float64 {
+		return math.Max(0, to.Sub(from).Seconds())
+	}
+	return map[string]interface{}{
+		"queued_at":           t.QueuedAt.UTC().Format(time.RFC3339Nano),
+		"locked_at":           t.LockedAt.UTC().Format(time.RFC3339Nano),
+		"submitted_at":        t.SubmittedAt.UTC().Format(time.RFC3339Nano),
+		"started_at":          t.StartedAt.UTC().Format(time.RFC3339Nano),
+		"queue_seconds":       seconds(t.QueuedAt, t.LockedAt),
+		"submit_seconds":      seconds(t.LockedAt, t.SubmittedAt),
+		"slurm_queue_seconds": seconds(t.SubmittedAt, t.StartedAt),
+		"total_seconds":       seconds(t.QueuedAt, t.StartedAt),
+	}
+}
+
+// recordTiming saves a summary of the container's dispatch timing in
+// the "dispatch_timing" property of each container request that uses
+// the container, for workflow-level performance analysis.
+func (disp *Dispatcher) recordTiming(uuid string, timing dispatchTiming) {
+	var crs arvados.ContainerRequestList
+	err := disp.Arv.List("container_requests", arvadosclient.Dict{
+		"filters": [][]interface{}{{"container_uuid", "=", uuid}},
+		"select":  []string{"uuid", "properties"},
+		"limit":   1000,
+	}, &crs)
+	if err != nil {
+		log.Printf("error listing container requests for container %s: %s", uuid, err)
+		return
+	}
+	summary := timing.properties()
+	for _, cr := range crs.Items {
+		props := map[string]interface{}{}
+		for k, v := range cr.Properties {
+			props[k] = v
+		}
+		props["dispatch_timing"] = summary
+		err = disp.Arv.Update("container_requests", cr.UUID, arvadosclient.Dict{
+			"container_request": arvadosclient.Dict{"properties": props}}, nil)
+		if err != nil {
+			log.Printf("error saving dispatch timing in container request %s: %s", cr.UUID, err)
+		}
+	}
+}
+
+// logDispatchEvent adds text to the container's dispatch log.
+func (disp *Dispatcher) logDispatchEvent(uuid, text string) {
+	lr := arvadosclient.Dict{"log": arvadosclient.Dict{
+		"object_uuid": uuid,
+		"event_type":  "dispatch",
+		"properties":  map[string]string{"text": text}}}
+	if err := disp.Arv.Create("logs", lr, nil); err != nil {
+		log.Printf("error creating dispatch log entry for container %s: %s", uuid, err)
+	}
+}
+
+// scancel cancels the container's slurm job. If scancel fails, the
+// error is added to the container's dispatch log, unless it is the
+// same as *lastError (the error reported by the previous attempt).
+func (disp *Dispatcher) scancel(ctr arvados.Container, lastError *string) {
 	err := disp.slurm.Cancel(ctr.UUID)
 	if err != nil {
 		log.Printf("scancel: %s", err)
+		if err.Error() != *lastError {
+			*lastError = err.Error()
+			disp.logDispatchEvent(ctr.UUID, fmt.Sprintf("Error cancelling slurm job: %s", err))
+		}
 		time.Sleep(time.Second)
-	} else if disp.sqCheck.HasUUID(ctr.UUID) {
+		return
+	}
+	*lastError = ""
+	if disp.sqCheck.HasUUID(ctr.UUID) {
 		log.Printf("container %s is still in squeue after scancel", ctr.UUID)
 		time.Sleep(time.Second)
 	}
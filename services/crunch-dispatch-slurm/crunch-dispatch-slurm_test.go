@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/dispatch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	. "gopkg.in/check.v1"
 )
@@ -66,11 +68,16 @@ type slurmFake struct {
 	onCancel func()
 	// Error returned by Batch()
 	errBatch error
+	// Job ID returned by Batch()
+	jobID string
 }
 
-func (sf *slurmFake) Batch(script io.Reader, args []string) error {
+func (sf *slurmFake) Batch(script io.Reader, args []string) (string, error) {
 	sf.didBatch = append(sf.didBatch, args)
-	return sf.errBatch
+	if sf.errBatch != nil {
+		return "", sf.errBatch
+	}
+	return sf.jobID, nil
 }
 
 func (sf *slurmFake) QueueCommand(args []string) *exec.Cmd {
@@ -140,9 +147,10 @@ func (s *IntegrationSuite) integrationTest(c *C,
 
 	s.disp.slurm = &s.slurm
 	s.disp.sqCheck = &SqueueChecker{
-		Logger: logrus.StandardLogger(),
-		Period: 500 * time.Millisecond,
-		Slurm:  s.disp.slurm,
+		Logger:   logrus.StandardLogger(),
+		Period:   500 * time.Millisecond,
+		Slurm:    s.disp.slurm,
+		LogEvent: s.disp.logDispatchEvent,
 	}
 
 	err = s.disp.Dispatcher.Run(ctx)
@@ -196,9 +204,21 @@ func (s *IntegrationSuite) TestCancel(c *C) {
 	c.Check(container.State, Equals, arvados.ContainerStateCancelled)
 	c.Check(len(s.slurm.didCancel) > 1, Equals, true)
 	c.Check(s.slurm.didCancel[:2], DeepEquals, []string{"zzzzz-dz642-queuedcontainer", "zzzzz-dz642-queuedcontainer"})
+
+	// The first (failed) scancel attempt should be reported in
+	// the container's dispatch log.
+	var ll arvados.LogList
+	err := s.disp.Arv.List("logs", arvadosclient.Dict{"filters": [][]string{
+		{"object_uuid", "=", container.UUID},
+		{"event_type", "=", "dispatch"},
+	}}, &ll)
+	c.Assert(err, IsNil)
+	c.Assert(len(ll.Items), Equals, 1)
+	c.Check(ll.Items[0].Properties["text"], Matches, `Error cancelling slurm job: something terrible happened`)
 }
 
 func (s *IntegrationSuite) TestMissingFromSqueue(c *C) {
+	s.slurm = slurmFake{jobID: "1234"}
 	container := s.integrationTest(c,
 		[][]string{{
 			fmt.Sprintf("--job-name=%s", "zzzzz-dz642-queuedcontainer"),
@@ -214,28 +234,59 @@ func (s *IntegrationSuite) TestMissingFromSqueue(c *C) {
 			dispatcher.UpdateState(container.UUID, dispatch.Complete)
 		})
 	c.Check(container.State, Equals, arvados.ContainerStateCancelled)
+	c.Check(container.RuntimeStatus["slurmJobID"], Equals, "1234")
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, IsNil)
+	var ll arvados.LogList
+	err = arv.List("logs", arvadosclient.Dict{"filters": [][]string{
+		{"object_uuid", "=", container.UUID},
+		{"event_type", "=", "dispatch"},
+	}}, &ll)
+	c.Assert(err, IsNil)
+	c.Assert(len(ll.Items), Equals, 1)
+	c.Check(ll.Items[0].Properties["text"], Matches, `Submitted container .* to slurm as job 1234`)
 }
 
 func (s *IntegrationSuite) TestSbatchFail(c *C) {
+	var alerts []map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]interface{}
+		c.Check(json.NewDecoder(r.Body).Decode(&msg), IsNil)
+		alerts = append(alerts, msg)
+	}))
+	defer webhook.Close()
+	s.disp.cluster.Containers.SLURM.SbatchMaxAttempts = 3
+	s.disp.cluster.Containers.SLURM.SbatchRetryInitialDelay = arvados.Duration(10 * time.Millisecond)
+	s.disp.cluster.Containers.SLURM.SbatchFailureWebhookURL = webhook.URL
+
 	s.slurm = slurmFake{errBatch: errors.New("something terrible happened")}
+	sbatchArgs := []string{"--job-name=zzzzz-dz642-queuedcontainer", "--nice=10000", "--no-requeue", "--mem=11445", "--cpus-per-task=4", "--tmp=45777"}
 	container := s.integrationTest(c,
-		[][]string{{"--job-name=zzzzz-dz642-queuedcontainer", "--nice=10000", "--no-requeue", "--mem=11445", "--cpus-per-task=4", "--tmp=45777"}},
-		func(dispatcher *dispatch.Dispatcher, container arvados.Container) {
-			dispatcher.UpdateState(container.UUID, dispatch.Running)
-			dispatcher.UpdateState(container.UUID, dispatch.Complete)
-		})
-	c.Check(container.State, Equals, arvados.ContainerStateComplete)
+		[][]string{sbatchArgs, sbatchArgs, sbatchArgs},
+		func(dispatcher *dispatch.Dispatcher, container arvados.Container) {})
+	c.Check(container.State, Equals, arvados.ContainerStateCancelled)
+	c.Check(container.RuntimeStatus["error"], Equals, "Failed to submit container to slurm after 3 attempts")
+	c.Check(container.RuntimeStatus["errorDetail"], Equals, "something terrible happened")
+
+	c.Assert(alerts, HasLen, 1)
+	c.Check(alerts[0]["container_uuid"], Equals, container.UUID)
+	c.Check(alerts[0]["attempts"], Equals, float64(3))
+	c.Check(alerts[0]["error"], Equals, "something terrible happened")
 
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, IsNil)
 
+	// Identical sbatch errors are logged once.
 	var ll arvados.LogList
 	err = arv.List("logs", arvadosclient.Dict{"filters": [][]string{
 		{"object_uuid", "=", container.UUID},
 		{"event_type", "=", "dispatch"},
-	}}, &ll)
+	}, "order": "id"}, &ll)
 	c.Assert(err, IsNil)
-	c.Assert(len(ll.Items), Equals, 1)
+	c.Assert(len(ll.Items), Equals, 2)
+	c.Check(ll.Items[0].Properties["text"], Matches, `Error submitting container .* to slurm: something terrible happened`)
+	c.Check(ll.Items[1].Properties["text"], Matches, `Cancelled container .* after 3 failed attempts .*`)
 }
 
 type StubbedSuite struct {
@@ -304,6 +355,192 @@ func (s *StubbedSuite) testWithServerStub(c *C, apiStubResponses map[string]arva
 	c.Check(buf.String(), Matches, `(?ms).*`+expected+`.*`)
 }
 
+func (s *StubbedSuite) TestSbatchRetryDelay(c *C) {
+	s.disp.cluster.Containers.SLURM.SbatchRetryInitialDelay = arvados.Duration(10 * time.Second)
+	s.disp.cluster.Containers.SLURM.SbatchRetryMaxDelay = arvados.Duration(time.Minute)
+	for attempt, expect := range map[int]time.Duration{
+		1:   10 * time.Second,
+		2:   20 * time.Second,
+		3:   40 * time.Second,
+		4:   time.Minute,
+		100: time.Minute,
+	} {
+		c.Check(s.disp.sbatchRetryDelay(attempt), Equals, expect, Commentf("attempt %d", attempt))
+	}
+}
+
+func (s *StubbedSuite) TestWaitForRetry(c *C) {
+	status := make(chan arvados.Container, 1)
+	status <- arvados.Container{Priority: 1}
+	c.Check(waitForRetry(10*time.Millisecond, status), Equals, true)
+
+	status <- arvados.Container{Priority: 0}
+	c.Check(waitForRetry(time.Minute, status), Equals, false)
+
+	close(status)
+	c.Check(waitForRetry(time.Minute, status), Equals, false)
+}
+
+func (s *StubbedSuite) TestUpdateEstimatedStartTime(c *C) {
+	var updates []map[string]interface{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "PUT")
+		c.Check(r.URL.Path, Equals, "/arvados/v1/containers/zzzzz-dz642-queuedcontainer")
+		var upd map[string]interface{}
+		c.Check(json.Unmarshal([]byte(r.FormValue("container")), &upd), IsNil)
+		updates = append(updates, upd)
+		w.Write([]byte(`{}`))
+	}))
+	defer api.Close()
+	s.disp.Arv = &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: api.URL[7:],
+		ApiToken:  "abc123",
+		Client:    &http.Client{Transport: &http.Transport{}},
+	}
+
+	ctr := arvados.Container{
+		UUID:          "zzzzz-dz642-queuedcontainer",
+		RuntimeStatus: map[string]interface{}{"slurmJobID": "1234"},
+	}
+	// No estimate: no update
+	s.disp.updateEstimatedStartTime(ctr)
+	c.Check(updates, HasLen, 0)
+
+	s.disp.sqCheck.startTimes = map[string]time.Time{ctr.UUID: time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)}
+	s.disp.updateEstimatedStartTime(ctr)
+	c.Assert(updates, HasLen, 1)
+	c.Check(updates[0]["runtime_status"], DeepEquals, map[string]interface{}{
+		"slurmJobID":           "1234",
+		"estimated_start_time": "2021-02-03T04:05:06Z",
+	})
+
+	// Unchanged estimate: no update
+	ctr.RuntimeStatus = updates[0]["runtime_status"].(map[string]interface{})
+	s.disp.updateEstimatedStartTime(ctr)
+	c.Check(updates, HasLen, 1)
+
+	// Estimate disappears: remove it from runtime_status
+	s.disp.sqCheck.startTimes = nil
+	s.disp.updateEstimatedStartTime(ctr)
+	c.Assert(updates, HasLen, 2)
+	c.Check(updates[1]["runtime_status"], DeepEquals, map[string]interface{}{"slurmJobID": "1234"})
+
+	// Container starts running: remove the estimate, even if
+	// slurm still reports one
+	s.disp.sqCheck.startTimes = map[string]time.Time{ctr.UUID: time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)}
+	ctr.RuntimeStatus = updates[0]["runtime_status"].(map[string]interface{})
+	ctr.State = arvados.ContainerStateRunning
+	s.disp.updateEstimatedStartTime(ctr)
+	c.Assert(updates, HasLen, 3)
+	c.Check(updates[2]["runtime_status"], DeepEquals, map[string]interface{}{"slurmJobID": "1234"})
+
+	// Already removed: no update
+	ctr.RuntimeStatus = updates[2]["runtime_status"].(map[string]interface{})
+	s.disp.updateEstimatedStartTime(ctr)
+	c.Check(updates, HasLen, 3)
+}
+
+func (s *StubbedSuite) TestSbatchFailureAlert(c *C) {
+	var alert map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+		c.Check(json.NewDecoder(r.Body).Decode(&alert), IsNil)
+	}))
+	defer webhook.Close()
+	s.disp.cluster.ClusterID = "zzzzz"
+	s.disp.cluster.Containers.SLURM.SbatchFailureWebhookURL = webhook.URL
+	s.disp.sendSbatchFailureAlert("zzzzz-dz642-queuedcontainer", 4, errors.New("oops"), "unlocked")
+	c.Check(alert, DeepEquals, map[string]interface{}{
+		"cluster_id":     "zzzzz",
+		"container_uuid": "zzzzz-dz642-queuedcontainer",
+		"attempts":       float64(4),
+		"error":          "oops",
+		"action":         "unlocked",
+	})
+}
+
+func (s *StubbedSuite) TestSbatchGiveUp(c *C) {
+	var reqs []string
+	var alerts []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/webhook" {
+			var alert map[string]interface{}
+			c.Check(json.NewDecoder(r.Body).Decode(&alert), IsNil)
+			alerts = append(alerts, alert["action"].(string))
+			return
+		}
+		r.ParseForm()
+		if r.URL.Path != "/arvados/v1/logs" {
+			reqs = append(reqs, r.Method+" "+r.URL.Path+" "+r.FormValue("container"))
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer api.Close()
+	s.disp.Dispatcher = &dispatch.Dispatcher{
+		Arv: &arvadosclient.ArvadosClient{
+			Scheme:    "http",
+			ApiServer: api.URL[7:],
+			ApiToken:  "abc123",
+			Client:    &http.Client{Transport: &http.Transport{}},
+		},
+		Logger: logrus.StandardLogger(),
+	}
+	s.disp.cluster.Containers.MaxDispatchAttempts = 2
+	s.disp.cluster.Containers.SLURM.SbatchMaxAttempts = 2
+	s.disp.cluster.Containers.SLURM.SbatchRetryInitialDelay = arvados.Duration(time.Millisecond)
+	s.disp.cluster.Containers.SLURM.SbatchFailureWebhookURL = api.URL + "/webhook"
+	slurm := &slurmFake{errBatch: errors.New("something terrible happened")}
+	s.disp.slurm = slurm
+
+	// First dispatch attempt: give up and unlock, so the
+	// attempt is counted by the API server.
+	ctr := arvados.Container{UUID: "zzzzz-dz642-queuedcontainer", LockCount: 1}
+	_, ok := s.disp.submitWithRetry(ctr, make(chan arvados.Container))
+	c.Check(ok, Equals, false)
+	c.Check(slurm.didBatch, HasLen, 2)
+	c.Check(reqs, DeepEquals, []string{"POST /arvados/v1/containers/zzzzz-dz642-queuedcontainer/unlock "})
+
+	// Last dispatch attempt: cancel, and explain why.
+	reqs = nil
+	ctr.LockCount = 2
+	_, ok = s.disp.submitWithRetry(ctr, make(chan arvados.Container))
+	c.Check(ok, Equals, false)
+	c.Check(slurm.didBatch, HasLen, 4)
+	c.Assert(reqs, HasLen, 2)
+	c.Check(reqs[0], Matches, `PUT /arvados/v1/containers/zzzzz-dz642-queuedcontainer .*"error":"Failed to submit container to slurm after 2 attempts".*`)
+	c.Check(reqs[1], Matches, `PUT /arvados/v1/containers/zzzzz-dz642-queuedcontainer .*"state":"Cancelled".*`)
+
+	c.Check(alerts, DeepEquals, []string{"unlocked", "cancelled"})
+	c.Check(testutil.ToFloat64(s.disp.metrics.sbatchFailures), Equals, float64(4))
+	c.Check(testutil.ToFloat64(s.disp.metrics.sbatchGiveUps.WithLabelValues("unlocked")), Equals, float64(1))
+	c.Check(testutil.ToFloat64(s.disp.metrics.sbatchGiveUps.WithLabelValues("cancelled")), Equals, float64(1))
+	c.Check(testutil.ToFloat64(s.disp.metrics.sbatchRetrying), Equals, float64(0))
+}
+
+func (s *StubbedSuite) TestManagementHandler(c *C) {
+	s.disp.metrics.sbatchFailures.Inc()
+	resp := httptest.NewRecorder()
+	s.disp.managementHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+
+	s.disp.cluster.ManagementToken = "abcdefg"
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer abcdefg")
+	resp = httptest.NewRecorder()
+	s.disp.managementHandler().ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, `(?ms).*\narvados_dispatchslurm_sbatch_failures_total 1\n.*`)
+
+	req = httptest.NewRequest("GET", "/_health/ping", nil)
+	req.Header.Set("Authorization", "Bearer abcdefg")
+	resp = httptest.NewRecorder()
+	s.disp.managementHandler().ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, `{"health":"OK"}`+"\n")
+}
+
 func (s *StubbedSuite) TestSbatchArgs(c *C) {
 	container := arvados.Container{
 		UUID:               "123",
@@ -325,6 +562,107 @@ func (s *StubbedSuite) TestSbatchArgs(c *C) {
 	}
 }
 
+func (s *StubbedSuite) TestDryRun(c *C) {
+	uuid := "zzzzz-dz642-queuedcontainer"
+	apiStub := arvadostest.ServerStub{Responses: map[string]arvadostest.StubResponse{
+		"/arvados/v1/containers/" + uuid: {
+			Status: 200,
+			Body:   `{"uuid":"` + uuid + `","runtime_constraints":{"ram":250000000,"vcpus":2},"scheduling_parameters":{"partitions":["blurb"]}}`,
+		},
+	}}
+	api := httptest.NewServer(&apiStub)
+	defer api.Close()
+	s.disp.Arv = &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: api.URL[7:],
+		ApiToken:  "abc123",
+		Client:    &http.Client{Transport: &http.Transport{}},
+	}
+	s.disp.cluster.Containers.CrunchRunCommand = "crunch-run"
+	s.disp.cluster.Containers.CrunchRunArgumentsList = []string{"-cgroup-parent-subsystem=cpu's"}
+	s.disp.cluster.Containers.SLURM.SbatchArgumentsList = []string{"--arg1=v1"}
+
+	var buf bytes.Buffer
+	err := s.disp.dryRun(&buf, uuid)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, `sbatch '--arg1=v1' '--job-name=`+uuid+`' '--nice=10000' '--no-requeue' '--mem=239' '--cpus-per-task=2' '--tmp=0' '--partition=blurb' <<'EOF'
+#!/bin/sh
+exec 'crunch-run' '-cgroup-parent-subsystem=cpu'\''s' '`+uuid+`'
+EOF
+`)
+
+	err = s.disp.dryRun(&buf, "zzzzz-dz642-nonexistentctr00")
+	c.Check(err, ErrorMatches, `error getting container .*`)
+}
+
+func (s *StubbedSuite) TestPartitionCgroups(c *C) {
+	s.disp.cluster.Containers.CrunchRunCommand = "crunch-run"
+	s.disp.cluster.Containers.CrunchRunArgumentsList = []string{"-cgroup-parent-subsystem=cpu"}
+	s.disp.cluster.Containers.SLURM.PartitionCgroups = map[string]arvados.SLURMPartitionCgroups{
+		"gpu":   {ParentSubsystem: "cpuset", Root: "/sys/fs/cgroup"},
+		"big":   {Root: "/cgroup"},
+		"plain": {},
+	}
+	ctr := arvados.Container{
+		UUID:               "zzzzz-dz642-queuedcontainer",
+		RuntimeConstraints: arvados.RuntimeConstraints{RAM: 250000000, VCPUs: 2},
+	}
+
+	// No partitions requested: the job might run in any
+	// configured partition.
+	_, script, err := s.disp.sbatchScript(ctr, s.disp.crunchRunCommand())
+	c.Assert(err, IsNil)
+	c.Check(script, Equals, `#!/bin/sh
+case "$SLURM_JOB_PARTITION" in
+'big')
+	exec 'crunch-run' '-cgroup-parent-subsystem=cpu' '-cgroup-root=/cgroup' 'zzzzz-dz642-queuedcontainer'
+	;;
+'gpu')
+	exec 'crunch-run' '-cgroup-parent-subsystem=cpu' '-cgroup-parent-subsystem=cpuset' '-cgroup-root=/sys/fs/cgroup' 'zzzzz-dz642-queuedcontainer'
+	;;
+esac
+exec 'crunch-run' '-cgroup-parent-subsystem=cpu' 'zzzzz-dz642-queuedcontainer'
+`)
+
+	// Only the requested partitions are considered.
+	ctr.SchedulingParameters.Partitions = []string{"gpu", "other"}
+	_, script, err = s.disp.sbatchScript(ctr, s.disp.crunchRunCommand())
+	c.Assert(err, IsNil)
+	c.Check(script, Matches, `(?s).*'gpu'\)\n.*`)
+	c.Check(script, Not(Matches), `(?s).*'big'.*`)
+
+	ctr.SchedulingParameters.Partitions = []string{"other"}
+	_, script, err = s.disp.sbatchScript(ctr, s.disp.crunchRunCommand())
+	c.Assert(err, IsNil)
+	c.Check(script, Equals, "#!/bin/sh\nexec 'crunch-run' '-cgroup-parent-subsystem=cpu' 'zzzzz-dz642-queuedcontainer'\n")
+}
+
+func (s *StubbedSuite) TestDispatchTimingProperties(c *C) {
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	props := dispatchTiming{
+		QueuedAt:    t0,
+		LockedAt:    t0.Add(2 * time.Second),
+		SubmittedAt: t0.Add(3 * time.Second),
+		StartedAt:   t0.Add(10 * time.Second),
+	}.properties()
+	c.Check(props["queued_at"], Equals, "2020-01-02T03:04:05Z")
+	c.Check(props["started_at"], Equals, "2020-01-02T03:04:15Z")
+	c.Check(props["queue_seconds"], Equals, 2.0)
+	c.Check(props["submit_seconds"], Equals, 1.0)
+	c.Check(props["slurm_queue_seconds"], Equals, 7.0)
+	c.Check(props["total_seconds"], Equals, 10.0)
+
+	// Clock skew between the API server and dispatcher must not
+	// produce negative durations.
+	props = dispatchTiming{
+		QueuedAt:    t0,
+		LockedAt:    t0.Add(-time.Second),
+		SubmittedAt: t0,
+		StartedAt:   t0,
+	}.properties()
+	c.Check(props["queue_seconds"], Equals, 0.0)
+}
+
 func (s *StubbedSuite) TestSbatchInstanceTypeConstraint(c *C) {
 	container := arvados.Container{
 		UUID:               "123",
@@ -390,6 +728,97 @@ func (s *StubbedSuite) TestSbatchPartition(c *C) {
 	c.Check(err, IsNil)
 }
 
+func (s *StubbedSuite) TestSbatchLicensesAndBurstBuffers(c *C) {
+	s.disp.cluster.Containers.SLURM.Licenses = map[string]arvados.SLURMLicense{
+		"matlab": {SLURMName: "matlab@licserver"},
+		"ansys":  {},
+	}
+	s.disp.cluster.Containers.SLURM.BurstBuffers = map[string]arvados.SLURMBurstBuffer{
+		"scratch": {Specification: "capacity=${size} access_mode=striped"},
+	}
+	container := arvados.Container{
+		UUID:               "123",
+		RuntimeConstraints: arvados.RuntimeConstraints{RAM: 250000000, VCPUs: 1},
+		SchedulingParameters: arvados.SchedulingParameters{
+			Licenses:     map[string]int{"matlab": 2, "ansys": 1},
+			BurstBuffers: map[string]int64{"scratch": 1<<30 + 1},
+		},
+		Priority: 1,
+	}
+
+	args, err := s.disp.sbatchArgs(container)
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"--job-name=123", "--nice=10000", "--no-requeue",
+		"--mem=239", "--cpus-per-task=1", "--tmp=0",
+		"--licenses=ansys:1,matlab@licserver:2",
+		"--bb=capacity=1025M access_mode=striped",
+	})
+
+	for _, sp := range []arvados.SchedulingParameters{
+		{Licenses: map[string]int{"comsol": 1}},
+		{Licenses: map[string]int{"matlab": 0}},
+		{BurstBuffers: map[string]int64{"persistent": 1 << 30}},
+		{BurstBuffers: map[string]int64{"scratch": -1}},
+		{Nodes: -1},
+		{Nodes: 4, Tasks: 2},
+	} {
+		c.Logf("%#v", sp)
+		container.SchedulingParameters = sp
+		_, err = s.disp.sbatchArgs(container)
+		c.Check(err, FitsTypeOf, schedulingParametersError{})
+	}
+}
+
+func (s *StubbedSuite) TestSbatchMultiNode(c *C) {
+	container := arvados.Container{
+		UUID:                 "123",
+		RuntimeConstraints:   arvados.RuntimeConstraints{RAM: 250000000, VCPUs: 1},
+		SchedulingParameters: arvados.SchedulingParameters{Nodes: 4, Tasks: 16},
+		Priority:             1,
+	}
+
+	args, err := s.disp.sbatchArgs(container)
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"--job-name=123", "--nice=10000", "--no-requeue",
+		"--mem=239", "--cpus-per-task=1", "--tmp=0",
+		"--nodes=4", "--ntasks=16",
+	})
+
+	// A single node doesn't need --nodes
+	container.SchedulingParameters = arvados.SchedulingParameters{Nodes: 1, Tasks: 4}
+	args, err = s.disp.sbatchArgs(container)
+	c.Check(err, IsNil)
+	c.Check(args[len(args)-1], Equals, "--ntasks=4")
+	c.Check(args[len(args)-2], Equals, "--tmp=0")
+}
+
+func (s *StubbedSuite) TestSbatchGPU(c *C) {
+	container := arvados.Container{
+		UUID: "123",
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			RAM:   250000000,
+			VCPUs: 1,
+			CUDA:  arvados.CUDARuntimeConstraints{DeviceCount: 2, DriverVersion: "11.0", HardwareCapability: "7.5"},
+		},
+		SchedulingParameters: arvados.SchedulingParameters{Nodes: 2},
+		Priority:             1,
+	}
+
+	args, err := s.disp.sbatchArgs(container)
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"--job-name=123", "--nice=10000", "--no-requeue",
+		"--mem=239", "--cpus-per-task=1", "--tmp=0",
+		"--nodes=2", "--gres=gpu:2",
+	})
+
+	container.RuntimeConstraints.CUDA.DeviceCount = -1
+	_, err = s.disp.sbatchArgs(container)
+	c.Check(err, FitsTypeOf, schedulingParametersError{})
+}
+
 func (s *StubbedSuite) TestLoadLegacyConfig(c *C) {
 	content := []byte(`
 Client:
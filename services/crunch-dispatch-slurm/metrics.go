@@ -0,0 +1,102 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/health"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type dispatcherMetrics struct {
+	sbatchFailures prometheus.Counter
+	sbatchGiveUps  *prometheus.CounterVec
+	sbatchRetrying prometheus.Gauge
+}
+
+func newDispatcherMetrics(reg *prometheus.Registry) *dispatcherMetrics {
+	m := &dispatcherMetrics{
+		sbatchFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchslurm",
+			Name:      "sbatch_failures_total",
+			Help:      "Number of failed attempts to submit a container to slurm.",
+		}),
+		sbatchGiveUps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchslurm",
+			Name:      "sbatch_give_ups_total",
+			Help:      "Number of times the dispatcher stopped retrying sbatch for a container after SbatchMaxAttempts failures, by action taken (unlocked or cancelled).",
+		}, []string{"action"}),
+		sbatchRetrying: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "dispatchslurm",
+			Name:      "sbatch_retrying_containers",
+			Help:      "Number of containers waiting to retry sbatch after a failure.",
+		}),
+	}
+	reg.MustRegister(m.sbatchFailures)
+	reg.MustRegister(m.sbatchGiveUps)
+	reg.MustRegister(m.sbatchRetrying)
+	return m
+}
+
+// managementHandler returns a handler for the /metrics and
+// /_health/ping endpoints, which require Cluster.ManagementToken.
+func (disp *Dispatcher) managementHandler() http.Handler {
+	if disp.cluster.ManagementToken == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Management API authentication is not configured", http.StatusForbidden)
+		})
+	}
+	mux := httprouter.New()
+	metricsH := promhttp.HandlerFor(disp.registry, promhttp.HandlerOpts{
+		ErrorLog: disp.logger,
+	})
+	mux.Handler("GET", "/metrics", metricsH)
+	mux.Handler("GET", "/metrics.json", metricsH)
+	mux.Handler("GET", "/_health/:check", &health.Handler{
+		Token:  disp.cluster.ManagementToken,
+		Prefix: "/_health/",
+		Routes: health.Routes{"ping": func() error { return nil }},
+	})
+	return auth.RequireLiteralToken(disp.cluster.ManagementToken, mux)
+}
+
+// serveManagement serves managementHandler at the
+// Services.DispatchSLURM.InternalURLs entry for this host, if any.
+func (disp *Dispatcher) serveManagement() error {
+	var listener net.Listener
+	var listenURL arvados.URL
+	for u := range disp.cluster.Services.DispatchSLURM.InternalURLs {
+		ln, err := net.Listen("tcp", u.Host)
+		if err == nil {
+			listener, listenURL = ln, u
+			break
+		} else if !strings.Contains(err.Error(), "cannot assign requested address") {
+			// If Host specifies a different server than
+			// this one, it fails this way; otherwise,
+			// report the error.
+			return fmt.Errorf("cannot listen on %s: %s", u.Host, err)
+		}
+	}
+	if listener == nil {
+		return nil
+	}
+	disp.logger.Printf("serving metrics at %s", listenURL.String())
+	go func() {
+		err := http.Serve(listener, disp.managementHandler())
+		disp.logger.Errorf("management server stopped: %s", err)
+	}()
+	return nil
+}
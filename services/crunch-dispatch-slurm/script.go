@@ -5,15 +5,41 @@
 package main
 
 import (
+	"sort"
 	"strings"
 )
 
 func execScript(args []string) string {
-	s := "#!/bin/sh\nexec"
+	return "#!/bin/sh\n" + execLine(args) + "\n"
+}
+
+// partitionExecScript returns a script that execs the command given
+// in byPartition for the slurm partition the job is running in
+// ($SLURM_JOB_PARTITION), or args if that partition is not listed.
+func partitionExecScript(args []string, byPartition map[string][]string) string {
+	if len(byPartition) == 0 {
+		return execScript(args)
+	}
+	var partitions []string
+	for p := range byPartition {
+		partitions = append(partitions, p)
+	}
+	sort.Strings(partitions)
+	s := "#!/bin/sh\ncase \"$SLURM_JOB_PARTITION\" in\n"
+	for _, p := range partitions {
+		s += shellQuote(p) + ")\n\t" + execLine(byPartition[p]) + "\n\t;;\n"
+	}
+	return s + "esac\n" + execLine(args) + "\n"
+}
+
+func execLine(args []string) string {
+	s := "exec"
 	for _, w := range args {
-		s += ` '`
-		s += strings.Replace(w, `'`, `'\''`, -1)
-		s += `'`
+		s += " " + shellQuote(w)
 	}
-	return s + "\n"
+	return s
+}
+
+func shellQuote(w string) string {
+	return `'` + strings.Replace(w, `'`, `'\''`, -1) + `'`
 }
@@ -26,3 +26,22 @@ func (s *ScriptSuite) TestExecScript(c *C) {
 		c.Check(execScript(test.args), Equals, "#!/bin/sh\n"+test.script+"\n")
 	}
 }
+
+func (s *ScriptSuite) TestPartitionExecScript(c *C) {
+	args := []string{"crunch-run", "zzzzz-dz642-queuedcontainer"}
+	c.Check(partitionExecScript(args, nil), Equals, execScript(args))
+	c.Check(partitionExecScript(args, map[string][]string{
+		"gpu":   {"crunch-run", "-cgroup-root=/cg", "zzzzz-dz642-queuedcontainer"},
+		"a'b c": {"crunch-run", "-cgroup-parent-subsystem=cpuset", "zzzzz-dz642-queuedcontainer"},
+	}), Equals, `#!/bin/sh
+case "$SLURM_JOB_PARTITION" in
+'a'\''b c')
+	exec 'crunch-run' '-cgroup-parent-subsystem=cpuset' 'zzzzz-dz642-queuedcontainer'
+	;;
+'gpu')
+	exec 'crunch-run' '-cgroup-root=/cg' 'zzzzz-dz642-queuedcontainer'
+	;;
+esac
+exec 'crunch-run' 'zzzzz-dz642-queuedcontainer'
+`)
+}
@@ -9,11 +9,13 @@ import (
 	"io"
 	"log"
 	"os/exec"
+	"regexp"
 	"strings"
 )
 
 type Slurm interface {
-	Batch(script io.Reader, args []string) error
+	// Batch submits a job and returns its slurm job ID.
+	Batch(script io.Reader, args []string) (string, error)
 	Cancel(name string) error
 	QueueCommand(args []string) *exec.Cmd
 	Release(name string) error
@@ -30,10 +32,28 @@ func NewSlurmCLI() *slurmCLI {
 	}
 }
 
-func (scli *slurmCLI) Batch(script io.Reader, args []string) error {
-	return scli.run(script, "sbatch", args)
+func (scli *slurmCLI) Batch(script io.Reader, args []string) (string, error) {
+	out, err := scli.run(script, "sbatch", append([]string{"--parsable"}, args...))
+	if err != nil {
+		return "", err
+	}
+	// With --parsable, sbatch prints "jobid" or
+	// "jobid;clustername". Output might also include
+	// warnings, so we use the last line that looks right.
+	jobID := ""
+	for _, line := range strings.Split(out, "\n") {
+		if m := parsableJobIDRegexp.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			jobID = m[1]
+		}
+	}
+	if jobID == "" {
+		log.Printf("sbatch succeeded but did not report a job ID: %q", out)
+	}
+	return jobID, nil
 }
 
+var parsableJobIDRegexp = regexp.MustCompile(`^(\d+)(;.*)?$`)
+
 func (scli *slurmCLI) Cancel(name string) error {
 	for _, args := range [][]string{
 		// If the slurm job hasn't started yet, remove it from
@@ -48,7 +68,7 @@ func (scli *slurmCLI) Cancel(name string) error {
 		{"--batch", "--signal=TERM", "--state=running"},
 		{"--batch", "--signal=TERM", "--state=suspended"},
 	} {
-		err := scli.run(nil, "scancel", append([]string{"--name=" + name}, args...))
+		_, err := scli.run(nil, "scancel", append([]string{"--name=" + name}, args...))
 		if err != nil {
 			// scancel exits 0 if no job matches the given
 			// name and state. Any error from scancel here
@@ -64,14 +84,16 @@ func (scli *slurmCLI) QueueCommand(args []string) *exec.Cmd {
 }
 
 func (scli *slurmCLI) Release(name string) error {
-	return scli.run(nil, "scontrol", []string{"release", "Name=" + name})
+	_, err := scli.run(nil, "scontrol", []string{"release", "Name=" + name})
+	return err
 }
 
 func (scli *slurmCLI) Renice(name string, nice int64) error {
-	return scli.run(nil, "scontrol", []string{"update", "JobName=" + name, fmt.Sprintf("Nice=%d", nice)})
+	_, err := scli.run(nil, "scontrol", []string{"update", "JobName=" + name, fmt.Sprintf("Nice=%d", nice)})
+	return err
 }
 
-func (scli *slurmCLI) run(stdin io.Reader, prog string, args []string) error {
+func (scli *slurmCLI) run(stdin io.Reader, prog string, args []string) (string, error) {
 	scli.runSemaphore <- true
 	defer func() { <-scli.runSemaphore }()
 	cmd := exec.Command(prog, args...)
@@ -84,5 +106,5 @@ func (scli *slurmCLI) run(stdin io.Reader, prog string, args []string) error {
 	if err != nil {
 		err = fmt.Errorf("%s: %s (%q)", cmd.Path, err, outTrim)
 	}
-	return err
+	return outTrim, err
 }
@@ -21,6 +21,7 @@ type slurmJob struct {
 	priority     int64 // current slurm priority (incorporates nice value)
 	nice         int64 // current slurm nice value
 	hitNiceLimit bool
+	lastError    string // most recent slurm command error reported via LogEvent
 }
 
 // SqueueChecker implements asynchronous polling monitor of the SLURM queue
@@ -30,7 +31,11 @@ type SqueueChecker struct {
 	Period         time.Duration
 	PrioritySpread int64
 	Slurm          Slurm
+	LogEvent       func(uuid, text string) // if non-nil, called to add a message to a container's dispatch log when a slurm command fails
+	StateFile      string                  // if non-empty, job state is saved here and reloaded at startup (see saveState)
 	queue          map[string]*slurmJob
+	startTimes     map[string]time.Time // expected start times of pending jobs, as reported by squeue
+	savedState     []byte               // content of StateFile as of last load/save
 	startOnce      sync.Once
 	done           chan struct{}
 	lock           sync.RWMutex
@@ -52,6 +57,16 @@ func (sqc *SqueueChecker) HasUUID(uuid string) bool {
 	return exists
 }
 
+// EstimatedStartTime returns the time slurm expects to start the
+// given container's job, as of the last squeue update. It returns
+// false if the job is not pending, or slurm has no estimate for it.
+func (sqc *SqueueChecker) EstimatedStartTime(uuid string) (time.Time, bool) {
+	sqc.lock.RLock()
+	defer sqc.lock.RUnlock()
+	t, ok := sqc.startTimes[uuid]
+	return t, ok
+}
+
 // SetPriority sets or updates the desired (Arvados) priority for a
 // container.
 func (sqc *SqueueChecker) SetPriority(uuid string, want int64) {
@@ -119,6 +134,7 @@ func (sqc *SqueueChecker) reniceAll() {
 			continue
 		}
 		err := sqc.Slurm.Renice(job.uuid, niceNew)
+		sqc.logCommandError(job, "Error adjusting slurm job priority", err)
 		if err != nil && niceNew > slurm15NiceLimit && strings.Contains(err.Error(), "Invalid nice value") {
 			sqc.Logger.Warnf("container %q clamping nice values at %d, priority order will not be correct -- see https://dev.arvados.org/projects/arvados/wiki/SLURM_integration#Limited-nice-values-SLURM-15", job.uuid, slurm15NiceLimit)
 			job.hitNiceLimit = true
@@ -126,6 +142,22 @@ func (sqc *SqueueChecker) reniceAll() {
 	}
 }
 
+// logCommandError reports a failed slurm command to the job's
+// dispatch log. To avoid filling the log with repeated messages, an
+// error is not reported again until a different error occurs or a
+// command succeeds.
+func (sqc *SqueueChecker) logCommandError(job *slurmJob, msg string, err error) {
+	if err == nil {
+		job.lastError = ""
+		return
+	}
+	if sqc.LogEvent == nil || err.Error() == job.lastError {
+		return
+	}
+	job.lastError = err.Error()
+	sqc.LogEvent(job.uuid, fmt.Sprintf("%s: %s", msg, err))
+}
+
 // Stop stops the squeue monitoring goroutine. Do not call HasUUID
 // after calling Stop.
 func (sqc *SqueueChecker) Stop() {
@@ -138,7 +170,7 @@ func (sqc *SqueueChecker) Stop() {
 // queued). If it succeeds, it updates sqc.queue and wakes up any
 // goroutines that are waiting in HasUUID() or All().
 func (sqc *SqueueChecker) check() {
-	cmd := sqc.Slurm.QueueCommand([]string{"--all", "--noheader", "--format=%j %y %Q %T %r"})
+	cmd := sqc.Slurm.QueueCommand([]string{"--all", "--noheader", "--format=%j %y %Q %T %r %S"})
 	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
 	cmd.Stdout, cmd.Stderr = stdout, stderr
 	if err := cmd.Run(); err != nil {
@@ -148,6 +180,7 @@ func (sqc *SqueueChecker) check() {
 
 	lines := strings.Split(stdout.String(), "\n")
 	newq := make(map[string]*slurmJob, len(lines))
+	startTimes := map[string]time.Time{}
 	for _, line := range lines {
 		if line == "" {
 			continue
@@ -169,6 +202,11 @@ func (sqc *SqueueChecker) check() {
 		replacing.priority = p
 		replacing.nice = n
 		newq[uuid] = replacing
+		if state == "PENDING" {
+			if t, ok := parseSqueueStartTime(line); ok {
+				startTimes[uuid] = t
+			}
+		}
 
 		if state == "PENDING" && ((reason == "BadConstraints" && p <= 2*slurm15NiceLimit) || reason == "launch failed requeued held") && replacing.wantPriority > 0 {
 			// When using SLURM 14.x or 15.x, our queued
@@ -192,22 +230,52 @@ func (sqc *SqueueChecker) check() {
 			// another manifestation of this problem,
 			// resolved the same way.
 			sqc.Logger.Printf("releasing held job %q (priority=%d, state=%q, reason=%q)", uuid, p, state, reason)
-			sqc.Slurm.Release(uuid)
+			err := sqc.Slurm.Release(uuid)
+			sqc.logCommandError(replacing, "Error releasing held slurm job", err)
 		} else if state != "RUNNING" && p <= 2*slurm15NiceLimit && replacing.wantPriority > 0 {
 			sqc.Logger.Warnf("job %q has low priority %d, nice %d, state %q, reason %q", uuid, p, n, state, reason)
 		}
 	}
 	sqc.lock.Lock()
 	sqc.queue = newq
+	sqc.startTimes = startTimes
 	sqc.lock.Unlock()
 	sqc.notify.Broadcast()
 }
 
+// parseSqueueStartTime returns the expected start time (%S) at the
+// end of a line of squeue output. For a pending job, this is the
+// estimate that "squeue --start" would show. It returns false if
+// slurm has no estimate ("N/A" or "Unknown"). The time is in the
+// local time zone.
+func parseSqueueStartTime(line string) (time.Time, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", fields[len(fields)-1], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
 // Initialize, and start a goroutine to call check() once per
 // squeue.Period until terminated by calling Stop().
 func (sqc *SqueueChecker) start() {
 	sqc.notify.L = sqc.lock.RLocker()
 	sqc.done = make(chan struct{})
+	// Reload the job state saved by a previous dispatcher
+	// process, so jobs that are still in the slurm queue keep
+	// their priorities instead of being reniced back and forth
+	// while the dispatcher catches up.
+	queue, err := sqc.loadState()
+	if err != nil {
+		sqc.Logger.Warnf("error loading state file %q, starting with empty state: %s", sqc.StateFile, err)
+	} else if len(queue) > 0 {
+		sqc.Logger.Printf("loaded state of %d jobs from state file %q", len(queue), sqc.StateFile)
+		sqc.queue = queue
+	}
 	go func() {
 		ticker := time.NewTicker(sqc.Period)
 		for {
@@ -218,6 +286,9 @@ func (sqc *SqueueChecker) start() {
 			case <-ticker.C:
 				sqc.check()
 				sqc.reniceAll()
+				if err := sqc.saveState(); err != nil {
+					sqc.Logger.Warnf("error saving state file %q: %s", sqc.StateFile, err)
+				}
 				select {
 				case <-ticker.C:
 					// If this iteration took
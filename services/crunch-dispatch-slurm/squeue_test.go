@@ -5,6 +5,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -114,11 +115,15 @@ func (s *SqueueSuite) TestReniceInvalidNiceValue(c *C) {
 		queue:         uuids[0] + " 0 4294000222 PENDING Resources\n" + uuids[1] + " 0 4294555222 PENDING Resources\n",
 		rejectNice10K: true,
 	}
+	var logged []string
 	sqc := &SqueueChecker{
 		Logger:         logrus.StandardLogger(),
 		Slurm:          slurm,
 		PrioritySpread: 1,
 		Period:         time.Hour,
+		LogEvent: func(uuid, text string) {
+			logged = append(logged, uuid+": "+text)
+		},
 	}
 	sqc.startOnce.Do(sqc.start)
 	sqc.check()
@@ -128,6 +133,8 @@ func (s *SqueueSuite) TestReniceInvalidNiceValue(c *C) {
 	// First attempt should renice to 555001, which will fail
 	sqc.reniceAll()
 	c.Check(slurm.didRenice, DeepEquals, [][]string{{uuids[1], "555001"}})
+	c.Assert(logged, HasLen, 1)
+	c.Check(logged[0], Matches, uuids[1]+`: Error adjusting slurm job priority: .*Invalid nice value.*`)
 
 	// Next attempt should renice to 10K, which will succeed
 	sqc.reniceAll()
@@ -147,6 +154,7 @@ func (s *SqueueSuite) TestReniceInvalidNiceValue(c *C) {
 	sqc.check()
 	sqc.reniceAll()
 	c.Check(slurm.didRenice, DeepEquals, [][]string{{uuids[1], "555001"}, {uuids[1], "10000"}, {uuids[1], "9890"}})
+	c.Check(logged, HasLen, 1)
 
 	sqc.Stop()
 }
@@ -203,6 +211,109 @@ func (s *SqueueSuite) TestSetPriorityBeforeQueued(c *C) {
 	}
 }
 
+// Job state saved by one SqueueChecker is used by the next one, so a
+// restarted dispatcher doesn't forget priorities and nice limits.
+func (s *SqueueSuite) TestStateFile(c *C) {
+	uuids := []string{"zzzzz-dz642-fake0fake0fake0", "zzzzz-dz642-fake1fake1fake1", "zzzzz-dz642-fake2fake2fake2"}
+	stateFile := c.MkDir() + "/state.json"
+	squeue := uuids[0] + " 0 4294000222 PENDING Resources\n" + uuids[1] + " 0 4294555222 PENDING Resources\n"
+
+	slurm := &slurmFake{queue: squeue, rejectNice10K: true}
+	sqc := &SqueueChecker{
+		Logger:         logrus.StandardLogger(),
+		Slurm:          slurm,
+		PrioritySpread: 1,
+		Period:         time.Hour,
+		StateFile:      stateFile,
+	}
+	sqc.startOnce.Do(sqc.start)
+	sqc.check()
+	sqc.SetPriority(uuids[0], 2)
+	sqc.SetPriority(uuids[1], 1)
+	sqc.reniceAll()
+	c.Check(slurm.didRenice, DeepEquals, [][]string{{uuids[1], "555001"}})
+	c.Check(sqc.saveState(), IsNil)
+	sqc.Stop()
+
+	buf, err := ioutil.ReadFile(stateFile)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, `{"jobs":{"`+uuids[0]+`":{"want_priority":2},"`+uuids[1]+`":{"want_priority":1,"hit_nice_limit":true}}}`)
+
+	// The restarted checker reniceAll()s using the saved
+	// priorities (without waiting for SetPriority), remembers the
+	// nice limit, and forgets jobs that are no longer queued.
+	slurm = &slurmFake{queue: squeue + uuids[2] + " 0 4294000111 PENDING Resources\n", rejectNice10K: true}
+	sqc = &SqueueChecker{
+		Logger:         logrus.StandardLogger(),
+		Slurm:          slurm,
+		PrioritySpread: 1,
+		Period:         time.Hour,
+		StateFile:      stateFile,
+	}
+	sqc.startOnce.Do(sqc.start)
+	defer sqc.Stop()
+	sqc.check()
+	c.Check(sqc.queue[uuids[0]].wantPriority, Equals, int64(2))
+	c.Check(sqc.queue[uuids[2]].wantPriority, Equals, int64(0))
+	sqc.reniceAll()
+	c.Check(slurm.didRenice, DeepEquals, [][]string{{uuids[1], "10000"}})
+
+	slurm.queue = uuids[2] + " 0 4294000111 PENDING Resources\n"
+	sqc.check()
+	c.Check(sqc.saveState(), IsNil)
+	buf, err = ioutil.ReadFile(stateFile)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, `{"jobs":{"`+uuids[2]+`":{}}}`)
+
+	// A corrupt state file is ignored.
+	c.Assert(ioutil.WriteFile(stateFile, []byte("{"), 0600), IsNil)
+	sqc = &SqueueChecker{
+		Logger:    logrus.StandardLogger(),
+		Slurm:     slurm,
+		Period:    time.Hour,
+		StateFile: stateFile,
+	}
+	sqc.startOnce.Do(sqc.start)
+	defer sqc.Stop()
+	c.Check(sqc.queue, HasLen, 0)
+}
+
+func (s *SqueueSuite) TestEstimatedStartTime(c *C) {
+	uuids := []string{"zzzzz-dz642-fake0fake0fake0", "zzzzz-dz642-fake1fake1fake1", "zzzzz-dz642-fake2fake2fake2", "zzzzz-dz642-fake3fake3fake3"}
+	slurm := &slurmFake{
+		queue: uuids[0] + " 10000 4294000000 PENDING Resources 2021-02-03T04:05:06\n" +
+			uuids[1] + " 10000 4294000111 PENDING Priority N/A\n" +
+			uuids[2] + " 10000 4294000222 PENDING launch failed requeued held 2021-02-03T05:00:00\n" +
+			uuids[3] + " 10000 4294000333 RUNNING None 2021-02-03T01:00:00\n",
+	}
+	sqc := &SqueueChecker{
+		Logger: logrus.StandardLogger(),
+		Slurm:  slurm,
+		Period: time.Hour,
+	}
+	sqc.startOnce.Do(sqc.start)
+	defer sqc.Stop()
+	sqc.check()
+
+	t, ok := sqc.EstimatedStartTime(uuids[0])
+	c.Check(ok, Equals, true)
+	c.Check(t.Equal(time.Date(2021, 2, 3, 4, 5, 6, 0, time.Local)), Equals, true)
+	_, ok = sqc.EstimatedStartTime(uuids[1])
+	c.Check(ok, Equals, false)
+	t, ok = sqc.EstimatedStartTime(uuids[2])
+	c.Check(ok, Equals, true)
+	c.Check(t.Equal(time.Date(2021, 2, 3, 5, 0, 0, 0, time.Local)), Equals, true)
+	// Running jobs don't have an estimate
+	_, ok = sqc.EstimatedStartTime(uuids[3])
+	c.Check(ok, Equals, false)
+
+	// Estimates are forgotten when the job starts
+	slurm.queue = uuids[0] + " 10000 4294000000 RUNNING None 2021-02-03T04:05:06\n"
+	sqc.check()
+	_, ok = sqc.EstimatedStartTime(uuids[0])
+	c.Check(ok, Equals, false)
+}
+
 func callUntilReady(fn func(), done <-chan struct{}) {
 	tick := time.NewTicker(time.Millisecond)
 	defer tick.Stop()
@@ -0,0 +1,110 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// savedJob is the part of a slurmJob's state that is saved in the
+// state file (see SqueueChecker.StateFile). Everything else is
+// refreshed from squeue.
+type savedJob struct {
+	WantPriority int64  `json:"want_priority,omitempty"`
+	HitNiceLimit bool   `json:"hit_nice_limit,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// savedState is the content of the state file.
+type savedState struct {
+	Jobs map[string]savedJob `json:"jobs"`
+}
+
+// loadState reads the state file, if one is configured, and returns
+// the saved jobs. A missing state file is not an error: it just
+// means nothing has been saved yet.
+func (sqc *SqueueChecker) loadState() (map[string]*slurmJob, error) {
+	jobs := map[string]*slurmJob{}
+	if sqc.StateFile == "" {
+		return jobs, nil
+	}
+	buf, err := ioutil.ReadFile(sqc.StateFile)
+	if os.IsNotExist(err) {
+		return jobs, nil
+	} else if err != nil {
+		return jobs, err
+	}
+	var state savedState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return jobs, err
+	}
+	for uuid, sj := range state.Jobs {
+		jobs[uuid] = &slurmJob{
+			uuid:         uuid,
+			wantPriority: sj.WantPriority,
+			hitNiceLimit: sj.HitNiceLimit,
+			lastError:    sj.LastError,
+		}
+	}
+	sqc.savedState = buf
+	return jobs, nil
+}
+
+// saveState writes the current state of all jobs in the queue to the
+// state file, if one is configured and the state has changed since
+// it was last saved.
+//
+// The new state is written to a temporary file which is then renamed
+// over the old one, so a crash never leaves a partially written state
+// file behind.
+func (sqc *SqueueChecker) saveState() error {
+	if sqc.StateFile == "" {
+		return nil
+	}
+	state := savedState{Jobs: map[string]savedJob{}}
+	sqc.lock.RLock()
+	for uuid, job := range sqc.queue {
+		state.Jobs[uuid] = savedJob{
+			WantPriority: job.wantPriority,
+			HitNiceLimit: job.hitNiceLimit,
+			LastError:    job.lastError,
+		}
+	}
+	sqc.lock.RUnlock()
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(buf, sqc.savedState) {
+		return nil
+	}
+	dir, base := filepath.Split(sqc.StateFile)
+	f, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), sqc.StateFile)
+	if err != nil {
+		return err
+	}
+	sqc.savedState = buf
+	return nil
+}
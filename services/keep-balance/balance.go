@@ -34,13 +34,16 @@ import (
 // collection is replicated at least as many times as desired by the
 // collection; there are no unreferenced data blocks older than
 // BlobSignatureTTL; and all N existing replicas of a given data block
-// are in the N best positions in rendezvous probe order.
+// are in the N best positions in rendezvous probe order (or the
+// order chosen by the configured placement policy; see
+// placementPolicy).
 type Balancer struct {
 	Logger  logrus.FieldLogger
 	Dumper  logrus.FieldLogger
 	Metrics *metrics
 
-	LostBlocksFile string
+	LostBlocksFile     string
+	RecoveryReportFile string
 
 	*BlockStateMap
 	KeepServices       map[string]*KeepService
@@ -56,6 +59,35 @@ type Balancer struct {
 	stats         balancerStats
 	mutex         sync.Mutex
 	lostBlocks    io.Writer
+	lostList      []lostBlock
+
+	// Wall clock time taken by each phase of the run, in
+	// seconds (see time).
+	timings    map[string]float64
+	timingsMtx sync.Mutex
+
+	// If non-empty, send pull/trash lists only to these
+	// services (see RunOptions.CommitKeepServices).
+	commitOnly []string
+
+	// Number of times to retry sending a pull/trash list to a
+	// server after an error (see Collections.BalanceCommitRetries).
+	commitRetries int
+
+	// If not nil, report the effect of the given configuration
+	// changes (see RunOptions.Simulate).
+	simulation       *Simulation
+	simulating       bool
+	blobSignatureTTL time.Duration
+
+	// Decides where replicas should be stored. If nil,
+	// rendezvousPolicy is used.
+	placement placementPolicy
+
+	// Collections whose blocks get extra replicas and pull
+	// priority (see Collections.BalanceHotData). Nil if none are
+	// configured.
+	hot *hotData
 }
 
 // Run performs a balance operation using the given config and
@@ -104,6 +136,34 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		return
 	}
 
+	for _, uuid := range runOptions.CommitKeepServices {
+		if bal.KeepServices[uuid] == nil {
+			err = fmt.Errorf("requested keep service %q is not a known keepstore server", uuid)
+			return
+		}
+	}
+	bal.commitOnly = runOptions.CommitKeepServices
+	bal.commitRetries = cluster.Collections.BalanceCommitRetries
+	bal.placement, err = newPlacementPolicy(cluster, bal.KeepServices)
+	if err != nil {
+		return
+	}
+	if name := bal.placement.name(); name != "rendezvous" {
+		bal.logf("using %s placement policy", name)
+	}
+	bal.hot, err = resolveHotData(ctx, client, cluster.Collections.BalanceHotData, bal.logf)
+	if err != nil {
+		return
+	}
+	if bal.hot != nil {
+		bal.logf("hot data: %d collections", len(bal.hot.pdhs))
+	}
+	bal.simulation = runOptions.Simulate
+	if bal.simulation != nil && (runOptions.CommitPulls || runOptions.CommitTrash) {
+		err = fmt.Errorf("cannot commit pull/trash lists in simulation mode")
+		return
+	}
+
 	for _, srv := range bal.KeepServices {
 		err = srv.discoverMounts(client)
 		if err != nil {
@@ -135,8 +195,12 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		// The current rendezvous state becomes "safe" (i.e.,
 		// OK to compute changes for that state without
 		// clearing existing trash lists) only now, after we
-		// succeed in clearing existing trash lists.
-		nextRunOptions.SafeRendezvousState = rs
+		// succeed in clearing existing trash lists -- and
+		// only if we cleared them on all servers, not just
+		// the CommitKeepServices subset.
+		if len(runOptions.CommitKeepServices) == 0 {
+			nextRunOptions.SafeRendezvousState = rs
+		}
 	}
 
 	if err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers); err != nil {
@@ -158,15 +222,27 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		}
 		lbFile = nil
 	}
-	if runOptions.CommitPulls {
-		err = bal.CommitPulls(ctx, client)
+	if bal.RecoveryReportFile != "" {
+		err = bal.writeRecoveryReport(ctx, client, cluster)
 		if err != nil {
-			// Skip trash if we can't pull. (Too cautious?)
 			return
 		}
 	}
+	if bal.simulation != nil {
+		bal.simulate()
+		return
+	}
+	if runOptions.CommitPulls {
+		// If a server's pull list can't be sent, CommitTrash
+		// skips that server's trash list, but the other
+		// servers' trash lists are still sent.
+		err = bal.CommitPulls(ctx, client)
+	}
 	if runOptions.CommitTrash {
-		err = bal.CommitTrash(ctx, client)
+		trashErr := bal.CommitTrash(ctx, client)
+		if err == nil {
+			err = trashErr
+		}
 	}
 	return
 }
@@ -282,6 +358,11 @@ func (bal *Balancer) rendezvousState() string {
 		srvs = append(srvs, srv.String())
 	}
 	sort.Strings(srvs)
+	if bal.placement != nil {
+		if state := bal.placement.state(); state != "" {
+			srvs = append(srvs, state)
+		}
+	}
 	return strings.Join(srvs, "; ")
 }
 
@@ -306,6 +387,50 @@ func (bal *Balancer) ClearTrashLists(ctx context.Context, c *arvados.Client) err
 	return bal.CommitTrash(ctx, c)
 }
 
+// setBlobSigningTTLs records the BlobSigningTTL reported by each
+// keepstore server's mounts (see trashThreshold), and logs servers
+// whose BlobSigningTTL is longer than apiTTL, the API server's. A
+// server that doesn't report its BlobSigningTTL is assumed to use
+// the cluster-wide value, apiTTL.
+func (bal *Balancer) setBlobSigningTTLs(apiTTL time.Duration) {
+	for _, srv := range bal.KeepServices {
+		var srvTTL, srvTrashLifetime time.Duration
+		for _, mnt := range srv.mounts {
+			if t := mnt.BlobSigningTTL.Duration(); t > srvTTL {
+				srvTTL = t
+			}
+			if t := mnt.BlobTrashLifetime.Duration(); t > srvTrashLifetime {
+				srvTrashLifetime = t
+			}
+		}
+		if srvTTL == 0 {
+			srvTTL = apiTTL
+		} else if srvTrashLifetime == 0 {
+			bal.logf("%s: BlobTrashLifetime is zero, trashed blocks will be deleted immediately", srv)
+		}
+		if srvTTL > apiTTL {
+			bal.logf("%s: BlobSigningTTL %v is longer than API server's %v, not trashing blocks stored there until they are %v old", srv, srvTTL, apiTTL, srvTTL)
+		}
+		srv.blobSigningTTL = srvTTL
+	}
+}
+
+// trashThreshold returns the Mtime before which replicas of blk are
+// old enough to trash. This is normally MinMtime, but if any of the
+// servers that store a replica of blk use a longer BlobSigningTTL
+// than the API server, a signature issued by that server when the
+// block was written might still be valid, so the block is kept until
+// that signature has expired.
+func (bal *Balancer) trashThreshold(blk *BlockState) int64 {
+	var extra time.Duration
+	for _, repl := range blk.Replicas {
+		if d := repl.KeepService.blobSigningTTL - bal.blobSignatureTTL; d > extra {
+			extra = d
+		}
+	}
+	return bal.MinMtime - int64(extra)
+}
+
 // GetCurrentState determines the current replication state, and the
 // desired replication level, for every block that is either
 // retrievable or referenced.
@@ -329,7 +454,9 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 		return err
 	}
 	bal.DefaultReplication = dd.DefaultCollectionReplication
-	bal.MinMtime = time.Now().UnixNano() - dd.BlobSignatureTTL*1e9
+	bal.blobSignatureTTL = time.Duration(dd.BlobSignatureTTL) * time.Second
+	bal.MinMtime = time.Now().UnixNano() - int64(bal.blobSignatureTTL)
+	bal.setBlobSigningTTLs(bal.blobSignatureTTL)
 
 	errs := make(chan error, 1)
 	wg := sync.WaitGroup{}
@@ -364,7 +491,9 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 		go func(mounts []*KeepMount) {
 			defer wg.Done()
 			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
+			t0 := time.Now()
 			idx, err := mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, "")
+			mounts[0].indexDuration = time.Since(t0)
 			if err != nil {
 				select {
 				case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
@@ -461,13 +590,36 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 		repl = *coll.ReplicationDesired
 	}
 	bal.Logger.Debugf("%v: %d block x%d", coll.UUID, len(blkids), repl)
-	// Pass pdh to IncreaseDesired only if LostBlocksFile is being
-	// written -- otherwise it's just a waste of memory.
+	// Pass pdh to IncreaseDesired only if LostBlocksFile or
+	// RecoveryReportFile is being written -- otherwise it's just a
+	// waste of memory.
 	pdh := ""
-	if bal.LostBlocksFile != "" {
+	if bal.LostBlocksFile != "" || bal.RecoveryReportFile != "" {
 		pdh = coll.PortableDataHash
 	}
-	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
+	hot := bal.hot.isHot(coll.PortableDataHash)
+	if hot {
+		bal.BlockStateMap.MarkHot(blkids)
+	}
+	want := []replication{{coll.StorageClassesDesired, repl}}
+	if hot {
+		want = bal.hot.desired(coll.StorageClassesDesired, repl)
+	}
+	for _, r := range want {
+		bal.BlockStateMap.IncreaseDesired(pdh, r.classes, r.n, blkids)
+	}
+	if bal.simulation != nil {
+		if coll.ReplicationDesired == nil && bal.simulation.DefaultReplication > 0 {
+			repl = bal.simulation.DefaultReplication
+		}
+		want = []replication{{coll.StorageClassesDesired, repl}}
+		if hot {
+			want = bal.hot.desired(coll.StorageClassesDesired, repl)
+		}
+		for _, r := range want {
+			bal.BlockStateMap.IncreaseSimulatedDesired(r.classes, r.n, blkids)
+		}
+	}
 	return nil
 }
 
@@ -514,9 +666,13 @@ func (bal *Balancer) ComputeChangeSets() {
 		close(results)
 	}()
 	bal.collectStatistics(results)
+	bal.prioritizeHotPulls()
 }
 
 func (bal *Balancer) setupLookupTables() {
+	if bal.placement == nil {
+		bal.placement = rendezvousPolicy{}
+	}
 	bal.serviceRoots = make(map[string]string)
 	bal.classes = defaultClasses
 	bal.mountsByClass = map[string]map[*KeepMount]bool{"default": {}}
@@ -616,10 +772,14 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 	}
 
 	uuids := keepclient.NewRootSorter(bal.serviceRoots, string(blkid[:32])).GetSortedRoots()
-	srvRendezvous := make(map[*KeepService]int, len(uuids))
+	rendezvous := make([]*KeepService, len(uuids))
 	for i, uuid := range uuids {
-		srv := bal.KeepServices[uuid]
-		srvRendezvous[srv] = i
+		rendezvous[i] = bal.KeepServices[uuid]
+	}
+	order := bal.placement.order(rendezvous)
+	srvOrder := make(map[*KeepService]int, len(order))
+	for i, srv := range order {
+		srvOrder[srv] = i
 	}
 
 	// Below we set underreplicated=true if we find any storage
@@ -649,9 +809,10 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				// already need it to satisfy a
 				// different storage class.
 				return si.want
-			} else if orderi, orderj := srvRendezvous[si.mnt.KeepService], srvRendezvous[sj.mnt.KeepService]; orderi != orderj {
-				// Prefer a better rendezvous
-				// position.
+			} else if orderi, orderj := srvOrder[si.mnt.KeepService], srvOrder[sj.mnt.KeepService]; orderi != orderj {
+				// Prefer a better position in the
+				// placement policy's order (normally
+				// rendezvous order).
 				return orderi < orderj
 			} else if repli, replj := si.repl != nil, sj.repl != nil; repli != replj {
 				// Prefer a mount that already has a
@@ -670,6 +831,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		// Servers/mounts/devices (with or without existing
 		// replicas) that are part of the best achievable
 		// layout for this storage class.
+		wantDomain := map[string]bool{}
 		wantSrv := map[*KeepService]bool{}
 		wantMnt := map[*KeepMount]bool{}
 		wantDev := map[string]bool{}
@@ -701,6 +863,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 			}
 			if replWant < desired && (slot.repl != nil || !slot.mnt.ReadOnly) {
 				slots[i].want = true
+				wantDomain[bal.placement.domain(slot.mnt.KeepService)] = true
 				wantSrv[slot.mnt.KeepService] = true
 				wantMnt[slot.mnt] = true
 				if slot.mnt.DeviceID != "" {
@@ -712,8 +875,18 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 
 		// First try to achieve desired replication without
-		// using the same server twice.
+		// using the same failure domain (e.g., zone, if the
+		// placement policy uses zones) or server twice.
 		done := false
+		for i := 0; i < len(slots) && !done; i++ {
+			if srv := slots[i].mnt.KeepService; !wantSrv[srv] && !wantDomain[bal.placement.domain(srv)] {
+				done = trySlot(i)
+			}
+		}
+
+		// If that didn't suffice, allow multiple servers in
+		// the same failure domain, but still without using
+		// the same server twice.
 		for i := 0; i < len(slots) && !done; i++ {
 			if !wantSrv[slots[i].mnt.KeepService] {
 				done = trySlot(i)
@@ -774,13 +947,14 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 	}
 	blockState := computeBlockState(slots, nil, len(blk.Replicas), 0)
 
+	minMtime := bal.trashThreshold(blk)
 	var lost bool
 	var changes []string
 	for _, slot := range slots {
 		// TODO: request a Touch if Mtime is duplicated.
 		var change int
 		switch {
-		case !slot.want && slot.repl != nil && slot.repl.Mtime < bal.MinMtime:
+		case !slot.want && slot.repl != nil && slot.repl.Mtime < minMtime:
 			slot.mnt.KeepService.AddTrash(Trash{
 				SizedDigest: blkid,
 				Mtime:       slot.repl.Mtime,
@@ -795,6 +969,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				SizedDigest: blkid,
 				From:        blk.Replicas[0].KeepMount.KeepService,
 				To:          slot.mnt,
+				Hot:         blk.Hot,
 			})
 			change = changePull
 		case slot.repl != nil:
@@ -812,7 +987,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 	}
 	if bal.Dumper != nil {
-		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, blk.Desired, changes)
+		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v placement=%s", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, blk.Desired, changes, bal.placement.explain(order))
 	}
 	return balanceResult{
 		blk:        blk,
@@ -871,6 +1046,14 @@ type replicationStats struct {
 	unachievable blocksNBytes
 }
 
+// mountStats reports utilization of a single keepstore mount, and
+// the changes planned for it.
+type mountStats struct {
+	stored  blocksNBytes
+	pulls   int
+	trashes int
+}
+
 type balancerStats struct {
 	lost          blocksNBytes
 	overrep       blocksNBytes
@@ -879,12 +1062,14 @@ type balancerStats struct {
 	underrep      blocksNBytes
 	unachievable  blocksNBytes
 	justright     blocksNBytes
+	hot           blocksNBytes
 	desired       blocksNBytes
 	current       blocksNBytes
 	pulls         int
 	trashes       int
 	replHistogram []int
 	classStats    map[string]replicationStats
+	mountStats    map[*KeepMount]mountStats
 
 	// collectionBytes / collectionBlockBytes = deduplication ratio
 	collectionBytes      int64 // sum(bytes in referenced blocks) across all collections
@@ -911,9 +1096,23 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	var s balancerStats
 	s.replHistogram = make([]int, 2)
 	s.classStats = make(map[string]replicationStats, len(bal.classes))
+	s.mountStats = make(map[*KeepMount]mountStats, bal.mounts)
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			s.mountStats[mnt] = mountStats{}
+		}
+	}
 	for result := range results {
 		bytes := result.blkid.Size()
 
+		for _, repl := range result.blk.Replicas {
+			ms := s.mountStats[repl.KeepMount]
+			ms.stored.replicas += repl.KeepMount.Replication
+			ms.stored.blocks++
+			ms.stored.bytes += bytes
+			s.mountStats[repl.KeepMount] = ms
+		}
+
 		if rc := int64(result.blk.RefCount); rc > 0 {
 			s.collectionBytes += rc * bytes
 			s.collectionBlockBytes += bytes
@@ -957,6 +1156,14 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 				fmt.Fprintf(bal.lostBlocks, " %s", pdh)
 			}
 			fmt.Fprint(bal.lostBlocks, "\n")
+			if bal.RecoveryReportFile != "" && !bal.simulating {
+				lb := lostBlock{hash: strings.SplitN(string(result.blkid), "+", 2)[0]}
+				for pdh := range result.blk.Refs {
+					lb.pdhs = append(lb.pdhs, pdh)
+				}
+				sort.Strings(lb.pdhs)
+				bal.lostList = append(bal.lostList, lb)
+			}
 		case bs.pulling > 0:
 			s.underrep.replicas += bs.pulling
 			s.underrep.blocks++
@@ -970,8 +1177,9 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			// enough to trash, otherwise count as
 			// "unref".
 			counter := &s.garbage
+			minMtime := bal.trashThreshold(result.blk)
 			for _, r := range result.blk.Replicas {
-				if r.Mtime >= bal.MinMtime {
+				if r.Mtime >= minMtime {
 					counter = &s.unref
 					break
 				}
@@ -989,6 +1197,12 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			s.justright.bytes += bytes * int64(bs.needed)
 		}
 
+		if result.blk.Hot {
+			s.hot.replicas += bs.needed + bs.pulling
+			s.hot.blocks++
+			s.hot.bytes += bytes * int64(bs.needed+bs.pulling)
+		}
+
 		if bs.needed > 0 {
 			s.desired.replicas += bs.needed
 			s.desired.blocks++
@@ -1008,9 +1222,21 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	for _, srv := range bal.KeepServices {
 		s.pulls += len(srv.ChangeSet.Pulls)
 		s.trashes += len(srv.ChangeSet.Trashes)
+		for _, pull := range srv.ChangeSet.Pulls {
+			ms := s.mountStats[pull.To]
+			ms.pulls++
+			s.mountStats[pull.To] = ms
+		}
+		for _, trash := range srv.ChangeSet.Trashes {
+			ms := s.mountStats[trash.From]
+			ms.trashes++
+			s.mountStats[trash.From] = ms
+		}
 	}
 	bal.stats = s
-	bal.Metrics.UpdateStats(s)
+	if !bal.simulating {
+		bal.Metrics.UpdateStats(s)
+	}
 }
 
 // PrintStatistics writes statistics about the computed changes to
@@ -1024,6 +1250,9 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("%s overreplicated (have>want>0)", bal.stats.overrep)
 	bal.logf("%s unreferenced (have>want=0, new)", bal.stats.unref)
 	bal.logf("%s garbage (have>want=0, old)", bal.stats.garbage)
+	if bal.hot != nil {
+		bal.logf("%s hot (referenced by Collections.BalanceHotData)", bal.stats.hot)
+	}
 	for _, class := range bal.classes {
 		cs := bal.stats.classStats[class]
 		bal.logf("===")
@@ -1040,6 +1269,13 @@ func (bal *Balancer) PrintStatistics() {
 		bal.logf("%s: %v\n", srv, srv.ChangeSet)
 	}
 	bal.logf("===")
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			ms := bal.stats.mountStats[mnt]
+			bal.logf("mount %s: %s stored, %d pulls, %d trashes", mnt, ms.stored, ms.pulls, ms.trashes)
+		}
+	}
+	bal.logf("===")
 	bal.printHistogram(60)
 	bal.logf("===")
 }
@@ -1105,38 +1341,77 @@ func (bal *Balancer) CheckSanityLate() error {
 // distributed according to rendezvous hashing.
 func (bal *Balancer) CommitPulls(ctx context.Context, c *arvados.Client) error {
 	defer bal.time("send_pull_lists", "wall clock time to send pull lists")()
-	return bal.commitAsync(c, "send pull list",
+	return bal.commitAsync(ctx, "pull",
 		func(srv *KeepService) error {
-			return srv.CommitPulls(ctx, c)
+			err := srv.CommitPulls(ctx, c)
+			srv.pullsFailed = err != nil
+			return err
 		})
 }
 
 // CommitTrash sends the computed lists of trash requests to the
 // keepstore servers. This has the effect of deleting blocks that are
 // overreplicated or unreferenced.
+//
+// Servers whose pull lists could not be sent by CommitPulls are
+// skipped.
 func (bal *Balancer) CommitTrash(ctx context.Context, c *arvados.Client) error {
 	defer bal.time("send_trash_lists", "wall clock time to send trash lists")()
-	return bal.commitAsync(c, "send trash list",
+	return bal.commitAsync(ctx, "trash",
 		func(srv *KeepService) error {
+			if srv.pullsFailed {
+				bal.logf("%s: not sending trash list because pull list was not sent", srv)
+				return nil
+			}
 			return srv.CommitTrash(ctx, c)
 		})
 }
 
-func (bal *Balancer) commitAsync(c *arvados.Client, label string, f func(srv *KeepService) error) error {
+// Initial delay between attempts to send a pull/trash list to a
+// server. The delay doubles after each failed attempt.
+var commitRetryDelay = time.Second
+
+// commitAsync calls f for each server concurrently. If f fails, it is
+// retried (up to bal.commitRetries times) without waiting for the
+// other servers, and the other servers are not affected. The last
+// error is returned after all servers are done.
+func (bal *Balancer) commitAsync(ctx context.Context, list string, f func(srv *KeepService) error) error {
+	todo := bal.KeepServices
+	if len(bal.commitOnly) > 0 {
+		todo = map[string]*KeepService{}
+		for _, uuid := range bal.commitOnly {
+			todo[uuid] = bal.KeepServices[uuid]
+		}
+	}
 	errs := make(chan error)
-	for _, srv := range bal.KeepServices {
+	for _, srv := range todo {
 		go func(srv *KeepService) {
 			var err error
 			defer func() { errs <- err }()
-			label := fmt.Sprintf("%s: %v", srv, label)
-			err = f(srv)
+			t0 := time.Now()
+			delay := commitRetryDelay
+			attempts := 0
+			for {
+				attempts++
+				err = f(srv)
+				if err == nil || attempts > bal.commitRetries || ctx.Err() != nil {
+					break
+				}
+				bal.logf("%s: send %s list: attempt %d failed, retrying in %v: %v", srv, list, attempts, delay, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+				delay *= 2
+			}
+			bal.Metrics.ObserveCommit(srv.UUID, list, attempts, time.Since(t0), err)
 			if err != nil {
-				err = fmt.Errorf("%s: %v", label, err)
+				err = fmt.Errorf("%s: send %s list: %v", srv, list, err)
 			}
 		}(srv)
 	}
 	var lastErr error
-	for range bal.KeepServices {
+	for range todo {
 		if err := <-errs; err != nil {
 			bal.logf("%v", err)
 			lastErr = err
@@ -1159,6 +1434,12 @@ func (bal *Balancer) time(name, help string) func() {
 	return func() {
 		dur := time.Since(t0)
 		observer.Observe(dur.Seconds())
+		bal.timingsMtx.Lock()
+		if bal.timings == nil {
+			bal.timings = map[string]float64{}
+		}
+		bal.timings[name] = dur.Seconds()
+		bal.timingsMtx.Unlock()
 		bal.Logger.Printf("%s: took %vs", name, dur.Seconds())
 	}
 }
@@ -86,8 +86,10 @@ var stubServices = []arvados.KeepService{
 
 var stubMounts = map[string][]arvados.KeepMount{
 	"keep0.zzzzz.arvadosapi.com:25107": {{
-		UUID:     "zzzzz-ivpuk-000000000000000",
-		DeviceID: "keep0-vol0",
+		UUID:      "zzzzz-ivpuk-000000000000000",
+		DeviceID:  "keep0-vol0",
+		BytesFree: 3000,
+		BytesUsed: 1000,
 	}},
 	"keep1.zzzzz.arvadosapi.com:25107": {{
 		UUID:     "zzzzz-ivpuk-100000000000000",
@@ -186,18 +188,22 @@ func (s *stubServer) serveFooBarFileCollections() *reqTracker {
 	s.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		rt.Add(r)
-		if strings.Contains(r.Form.Get("filters"), `modified_at`) {
-			io.WriteString(w, `{"items_available":0,"items":[]}`)
-		} else {
-			io.WriteString(w, `{"items_available":3,"items":[
-				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
-				{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
-				{"uuid":"zzzzz-4zz18-znfnqtbbv4spc3w","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
-		}
+		s.serveFooBarFileCollectionsPage(w, r)
 	})
 	return rt
 }
 
+func (s *stubServer) serveFooBarFileCollectionsPage(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Form.Get("filters"), `modified_at`) {
+		io.WriteString(w, `{"items_available":0,"items":[]}`)
+	} else {
+		io.WriteString(w, `{"items_available":3,"items":[
+			{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
+			{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
+			{"uuid":"zzzzz-4zz18-znfnqtbbv4spc3w","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+	}
+}
+
 func (s *stubServer) serveCollectionsButSkipOne() *reqTracker {
 	rt := &reqTracker{}
 	s.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
@@ -360,7 +366,7 @@ func (s *runSuite) TestRefuseZeroCollections(c *check.C) {
 	trashReqs := s.stub.serveKeepstoreTrash()
 	pullReqs := s.stub.serveKeepstorePull()
 	srv := s.newServer(&opts)
-	_, err := srv.runOnce()
+	_, err := srv.runOnce(nil)
 	c.Check(err, check.ErrorMatches, "received zero collections")
 	c.Check(trashReqs.Count(), check.Equals, 4)
 	c.Check(pullReqs.Count(), check.Equals, 0)
@@ -379,7 +385,7 @@ func (s *runSuite) TestRefuseNonAdmin(c *check.C) {
 	trashReqs := s.stub.serveKeepstoreTrash()
 	pullReqs := s.stub.serveKeepstorePull()
 	srv := s.newServer(&opts)
-	_, err := srv.runOnce()
+	_, err := srv.runOnce(nil)
 	c.Check(err, check.ErrorMatches, "current user .* is not .* admin user")
 	c.Check(trashReqs.Count(), check.Equals, 0)
 	c.Check(pullReqs.Count(), check.Equals, 0)
@@ -399,7 +405,7 @@ func (s *runSuite) TestDetectSkippedCollections(c *check.C) {
 	trashReqs := s.stub.serveKeepstoreTrash()
 	pullReqs := s.stub.serveKeepstorePull()
 	srv := s.newServer(&opts)
-	_, err := srv.runOnce()
+	_, err := srv.runOnce(nil)
 	c.Check(err, check.ErrorMatches, `Retrieved 2 collections with modtime <= .* but server now reports there are 3 collections.*`)
 	c.Check(trashReqs.Count(), check.Equals, 4)
 	c.Check(pullReqs.Count(), check.Equals, 0)
@@ -424,13 +430,58 @@ func (s *runSuite) TestWriteLostBlocks(c *check.C) {
 	s.stub.serveKeepstorePull()
 	srv := s.newServer(&opts)
 	c.Assert(err, check.IsNil)
-	_, err = srv.runOnce()
+	_, err = srv.runOnce(nil)
 	c.Check(err, check.IsNil)
 	lost, err := ioutil.ReadFile(lostf.Name())
 	c.Assert(err, check.IsNil)
 	c.Check(string(lost), check.Equals, "37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45\n")
 }
 
+func (s *runSuite) TestWriteRecoveryReport(c *check.C) {
+	reportf := c.MkDir() + "/recovery.sh"
+	s.config.Collections.BlobRecoveryReport = reportf
+	s.config.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	s.config.RemoteClusters = map[string]arvados.RemoteCluster{
+		"zzzzz": {},
+		"aaaaa": {Proxy: true},
+		"bbbbb": {Proxy: true},
+	}
+	opts := RunOptions{
+		Logger: ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("cluster_id") {
+		case "aaaaa":
+			c.Check(r.Form.Get("filters"), check.Equals, `[["portable_data_hash","in",["fa7aeb5140e2848d39b416daeef4ffc5+45"]]]`)
+			io.WriteString(w, `{"items":[{"portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45"}]}`)
+		case "bbbbb":
+			http.Error(w, "remote cluster unavailable", http.StatusBadGateway)
+		case "":
+			s.stub.serveFooBarFileCollectionsPage(w, r)
+		default:
+			c.Errorf("unexpected cluster_id %q", r.Form.Get("cluster_id"))
+		}
+	})
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo1()
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce(nil)
+	c.Check(err, check.IsNil)
+	report, err := ioutil.ReadFile(reportf)
+	c.Assert(err, check.IsNil)
+	c.Check(string(report), check.Matches, `(?ms)#!/bin/sh\n.*`+
+		`\n# block 37b51d194a7513e45b56f6524f2d51f2 referenced by \[fa7aeb5140e2848d39b416daeef4ffc5\+45\]\n`+
+		`# collection fa7aeb5140e2848d39b416daeef4ffc5\+45 exists on remote cluster aaaaa\n`+
+		`arv-copy --src aaaaa --dst zzzzz fa7aeb5140e2848d39b416daeef4ffc5\+45\n`+
+		`# block may still be in trash\n`+
+		`curl .* http://keep0.zzzzz.arvadosapi.com:25107/untrash/37b51d194a7513e45b56f6524f2d51f2\n`+
+		`(curl .*\n){3}$`)
+	c.Check(strings.Contains(string(report), "acbd18db4cc2f85cedef654fccc4a4d8"), check.Equals, false)
+}
+
 func (s *runSuite) TestDryRun(c *check.C) {
 	opts := RunOptions{
 		CommitPulls: false,
@@ -445,7 +496,7 @@ func (s *runSuite) TestDryRun(c *check.C) {
 	trashReqs := s.stub.serveKeepstoreTrash()
 	pullReqs := s.stub.serveKeepstorePull()
 	srv := s.newServer(&opts)
-	bal, err := srv.runOnce()
+	bal, err := srv.runOnce(nil)
 	c.Check(err, check.IsNil)
 	for _, req := range collReqs.reqs {
 		c.Check(req.Form.Get("include_trash"), check.Equals, "true")
@@ -458,6 +509,75 @@ func (s *runSuite) TestDryRun(c *check.C) {
 	c.Check(bal.stats.overrep.replicas, check.Not(check.Equals), 0)
 }
 
+// runSimulation runs a balancing operation in simulation mode and
+// returns the log output.
+func (s *runSuite) runSimulation(c *check.C, sim Simulation) string {
+	var logBuf bytes.Buffer
+	opts := RunOptions{
+		Logger:   ctxlog.New(io.MultiWriter(&logBuf, ctxlog.LogWriter(c.Log)), "text", "info"),
+		Simulate: &sim,
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce(nil)
+	c.Check(err, check.IsNil)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+	return logBuf.String()
+}
+
+func (s *runSuite) TestSimulateDefaultReplication(c *check.C) {
+	logs := s.runSimulation(c, Simulation{DefaultReplication: 4})
+	c.Check(logs, check.Matches, `(?ms).*DefaultReplication: current 2, simulated 4.*`)
+	c.Check(logs, check.Matches, `(?ms).*pulls: current 2 replicas \(2 blocks, 6 bytes\); simulated 3 replicas \(3 blocks, 9 bytes\); change \+3 bytes.*`)
+	c.Check(logs, check.Matches, `(?ms).*trashes: current 2 replicas \(2 blocks, 6 bytes\); simulated 0 replicas \(0 blocks, 0 bytes\); change -6 bytes.*`)
+}
+
+func (s *runSuite) TestSimulateBlobSigningTTL(c *check.C) {
+	logs := s.runSimulation(c, Simulation{BlobSigningTTL: 100 * 365 * 24 * time.Hour})
+	c.Check(logs, check.Matches, `(?ms).*BlobSigningTTL: current 0s, simulated 876000h0m0s.*`)
+	c.Check(logs, check.Matches, `(?ms).*trashes: current 2 replicas \(2 blocks, 6 bytes\); simulated 0 replicas \(0 blocks, 0 bytes\); change -6 bytes.*`)
+}
+
+func (s *runSuite) TestSimulateShorterBlobSigningTTL(c *check.C) {
+	// The keepstore servers report a BlobSigningTTL longer than
+	// the age of any block, so nothing is trashed with the
+	// current configuration. The simulated TTL overrides them.
+	defer func(orig map[string][]arvados.KeepMount) { stubMounts = orig }(stubMounts)
+	longTTL := map[string][]arvados.KeepMount{}
+	for host, mounts := range stubMounts {
+		for _, mnt := range mounts {
+			mnt.BlobSigningTTL = arvados.Duration(100 * 365 * 24 * time.Hour)
+			longTTL[host] = append(longTTL[host], mnt)
+		}
+	}
+	stubMounts = longTTL
+	logs := s.runSimulation(c, Simulation{BlobSigningTTL: time.Hour})
+	c.Check(logs, check.Matches, `(?ms).*BlobSigningTTL: current 0s, simulated 1h0m0s.*`)
+	c.Check(logs, check.Matches, `(?ms).*trashes: current 0 replicas \(0 blocks, 0 bytes\); simulated 2 replicas \(2 blocks, 6 bytes\); change \+6 bytes.*`)
+}
+
+func (s *runSuite) TestSimulateRefuseCommit(c *check.C) {
+	opts := RunOptions{
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+		Simulate:    &Simulation{DefaultReplication: 3},
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveKeepServices(stubServices)
+	trashReqs := s.stub.serveKeepstoreTrash()
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce(nil)
+	c.Check(err, check.ErrorMatches, `.*simulation mode.*`)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+}
+
 func (s *runSuite) TestCommit(c *check.C) {
 	lostf, err := ioutil.TempFile("", "keep-balance-lost-blocks-test-")
 	c.Assert(err, check.IsNil)
@@ -479,7 +599,7 @@ func (s *runSuite) TestCommit(c *check.C) {
 	trashReqs := s.stub.serveKeepstoreTrash()
 	pullReqs := s.stub.serveKeepstorePull()
 	srv := s.newServer(&opts)
-	bal, err := srv.runOnce()
+	bal, err := srv.runOnce(nil)
 	c.Check(err, check.IsNil)
 	c.Check(trashReqs.Count(), check.Equals, 8)
 	c.Check(pullReqs.Count(), check.Equals, 4)
@@ -500,6 +620,179 @@ func (s *runSuite) TestCommit(c *check.C) {
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_changeset_compute_seconds_count 1\n.*`)
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_dedup_byte_ratio 1\.5\n.*`)
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_dedup_block_ratio 1\.5\n.*`)
+	// keep0 has foo and bar; the other mounts have foo only
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_mount_usage_bytes{keep_service="zzzzz-bi6l4-000000000000000",mount_uuid="zzzzz-ivpuk-000000000000000"} 6\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_mount_usage_blocks{keep_service="zzzzz-bi6l4-000000000000001",mount_uuid="zzzzz-ivpuk-100000000000000"} 1\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_mount_trashes{keep_service="zzzzz-bi6l4-[0-9]+",mount_uuid="zzzzz-ivpuk-[0-9]+"} 1\n.*`)
+	// keep0 reports space usage; the others don't
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_mount_bytes_free{keep_service="zzzzz-bi6l4-000000000000000",mount_uuid="zzzzz-ivpuk-000000000000000"} 3000\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_mount_bytes_used{keep_service="zzzzz-bi6l4-000000000000000",mount_uuid="zzzzz-ivpuk-000000000000000"} 1000\n.*`)
+	c.Check(buf, check.Not(check.Matches), `(?ms).*\narvados_keep_mount_bytes_free{keep_service="zzzzz-bi6l4-000000000000001".*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_index_duration_seconds{keep_service="zzzzz-bi6l4-000000000000003"} [0-9\.e-]+\n.*`)
+}
+
+func (s *runSuite) TestCommitFailures(c *check.C) {
+	defer func(d time.Duration) { commitRetryDelay = d }(commitRetryDelay)
+	commitRetryDelay = time.Millisecond
+	s.config.Collections.BalanceCommitRetries = 2
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+		Dumper:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+
+	// keep1 never accepts a pull list; keep2 accepts it on the
+	// second attempt.
+	var mtx sync.Mutex
+	pullReqs := map[string]int{}
+	s.stub.mux.HandleFunc("/pull", func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		pullReqs[r.URL.Host]++
+		n := pullReqs[r.URL.Host]
+		mtx.Unlock()
+		if strings.HasPrefix(r.URL.Host, "keep1.") || (strings.HasPrefix(r.URL.Host, "keep2.") && n == 1) {
+			http.Error(w, "stub error", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{}`)
+	})
+
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce(nil)
+	c.Check(err, check.ErrorMatches, `zzzzz-bi6l4-000000000000001 .*: send pull list: .*503 Service Unavailable`)
+	c.Check(pullReqs, check.DeepEquals, map[string]int{
+		"keep0.zzzzz.arvadosapi.com:25107": 1,
+		"keep1.zzzzz.arvadosapi.com:25107": 3,
+		"keep2.zzzzz.arvadosapi.com:25107": 2,
+		"keep3.zzzzz.arvadosapi.com:25107": 1,
+	})
+	// 4 to clear trash lists at the start of the run, then 3
+	// (none to keep1, because its pull list wasn't sent)
+	c.Check(trashReqs.Count(), check.Equals, 7)
+	for _, req := range trashReqs.reqs[4:] {
+		c.Check(req.URL.Host, check.Not(check.Matches), `keep1\..*`)
+	}
+
+	buf, err := s.getMetrics(c, srv)
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_commit_attempts{keep_service="zzzzz-bi6l4-000000000000001",list="pull"} 3\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_commit_attempts{keep_service="zzzzz-bi6l4-000000000000002",list="pull"} 2\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_commit_failures_total{keep_service="zzzzz-bi6l4-000000000000001",list="pull"} 1\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_commit_failures_total{keep_service="zzzzz-bi6l4-000000000000002",list="pull"} 0\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_commit_duration_seconds{keep_service="zzzzz-bi6l4-000000000000000",list="trash"} [0-9\.e-]+\n.*`)
+}
+
+func (s *runSuite) TestHotData(c *check.C) {
+	// The second source doesn't exist (the stub server responds
+	// 404). It should be skipped without affecting the rest of
+	// the run.
+	s.config.Collections.BalanceHotData.Sources = []string{"zzzzz-xvhdz-000000000000000", "zzzzz-4zz18-000000000000404"}
+	s.config.Collections.BalanceHotData.ExtraReplication = 1
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	// A workflow runner with one step, which mounts the "bar"
+	// collection.
+	s.stub.serveStatic("/arvados/v1/container_requests/zzzzz-xvhdz-000000000000000",
+		`{"uuid":"zzzzz-xvhdz-000000000000000","container_uuid":"zzzzz-dz642-000000000000000","container_image":"arvados/jobs","mounts":{"/tmp":{"kind":"tmp"}}}`)
+	childReqs := &reqTracker{}
+	s.stub.mux.HandleFunc("/arvados/v1/container_requests", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		childReqs.Add(r)
+		if strings.Contains(r.Form.Get("filters"), `"uuid"`) {
+			io.WriteString(w, `{"items":[]}`)
+		} else if strings.Contains(r.Form.Get("filters"), `"zzzzz-dz642-000000000000000"`) {
+			io.WriteString(w, `{"items":[{"uuid":"zzzzz-xvhdz-000000000000001","container_uuid":"zzzzz-dz642-000000000000001","mounts":{"/in":{"kind":"collection","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45"}}}]}`)
+		} else if strings.Contains(r.Form.Get("filters"), `"zzzzz-dz642-000000000000001"`) {
+			// The step's container lists the workflow
+			// runner's request as one of its own, which
+			// must not cause an endless loop.
+			io.WriteString(w, `{"items":[{"uuid":"zzzzz-xvhdz-000000000000000","container_uuid":"zzzzz-dz642-000000000000000"}]}`)
+		} else {
+			io.WriteString(w, `{"items":[]}`)
+		}
+	})
+	srv := s.newServer(&opts)
+	bal, err := srv.runOnce(nil)
+	c.Check(err, check.IsNil)
+	c.Check(childReqs.Count(), check.Equals, 4)
+	c.Check(bal.hot.pdhs, check.DeepEquals, map[string]bool{"fa7aeb5140e2848d39b416daeef4ffc5+45": true})
+	// "bar" block is hot, so it gets 3 replicas instead of 2:
+	// the existing one, which is now in one of the 3 best
+	// rendezvous positions, and 2 new ones
+	c.Check(bal.stats.hot.blocks, check.Equals, 1)
+	c.Check(bal.stats.hot.replicas, check.Equals, 3)
+	c.Check(bal.stats.pulls, check.Equals, 2)
+	for _, srv := range bal.KeepServices {
+		for _, pull := range srv.ChangeSet.Pulls {
+			c.Check(pull.Hot, check.Equals, true)
+		}
+	}
+}
+
+func (s *runSuite) TestHotDataBadSource(c *check.C) {
+	s.config.Collections.BalanceHotData.Sources = []string{"zzzzz-tpzed-000000000000000"}
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce(nil)
+	c.Check(err, check.ErrorMatches, `.*"zzzzz-tpzed-000000000000000" is not a collection PDH.*`)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+}
+
+func (s *runSuite) TestHotDataAPIError(c *check.C) {
+	s.config.Collections.BalanceHotData.Sources = []string{"zzzzz-4zz18-000000000000000"}
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	s.stub.mux.HandleFunc("/arvados/v1/collections/zzzzz-4zz18-000000000000000", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"errors":["database is down"]}`, http.StatusInternalServerError)
+	})
+	srv := s.newServer(&opts)
+	// Proceeding without the hot data would trash its extra
+	// replicas, so the run is aborted instead.
+	_, err := srv.runOnce(nil)
+	c.Check(err, check.ErrorMatches, `error resolving Collections.BalanceHotData.Sources entry "zzzzz-4zz18-000000000000000": .*database is down.*`)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+	c.Check(pullReqs.Count(), check.Equals, 0)
 }
 
 func (s *runSuite) TestRunForever(c *check.C) {
@@ -545,6 +838,195 @@ func (s *runSuite) TestRunForever(c *check.C) {
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_changeset_compute_seconds_count `+fmt.Sprintf("%d", pullReqs.Count()/4)+`\n.*`)
 }
 
+func (s *runSuite) TestRunForeverOutsideWindow(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+
+	stop := make(chan interface{})
+	s.config.Collections.BalancePeriod = arvados.Duration(time.Millisecond)
+	s.config.Collections.BalanceWindows = []string{time.Now().UTC().Add(48*time.Hour).Format("Mon") + " *"}
+	srv := s.newServer(&opts)
+
+	done := make(chan bool)
+	go func() {
+		srv.runForever(stop)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	stop <- true
+	<-done
+	c.Check(pullReqs.Count(), check.Equals, 0)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+
+	buf, err := s.getMetrics(c, srv)
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keepbalance_next_run_timestamp_seconds [0-9\.e\+]+\n.*`)
+}
+
+func (s *runSuite) TestRunRequestedViaAPI(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+
+	stop := make(chan interface{})
+	s.config.Collections.BalancePeriod = arvados.Duration(time.Hour)
+	s.config.Collections.BalanceWindows = []string{time.Now().UTC().Add(48*time.Hour).Format("Mon") + " *"}
+	srv := s.newServer(&opts)
+	srv.setupHandler()
+
+	done := make(chan bool)
+	go func() {
+		srv.runForever(stop)
+		close(done)
+	}()
+	defer func() {
+		stop <- true
+		<-done
+	}()
+
+	post := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/run", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		srv.ServeHTTP(resp, req)
+		return resp
+	}
+	waitForRuns := func(n int) {
+		for t0 := time.Now(); time.Since(t0) < 10*time.Second; time.Sleep(time.Millisecond) {
+			buf, err := s.getMetrics(c, srv)
+			c.Assert(err, check.IsNil)
+			if strings.Contains(buf.String(), fmt.Sprintf("\narvados_keepbalance_sweep_seconds_count %d\n", n)) {
+				return
+			}
+		}
+		c.Fatalf("timed out waiting for run %d", n)
+	}
+
+	c.Check(post("", "").Code, check.Equals, http.StatusUnauthorized)
+	c.Check(post("wrongtoken", "").Code, check.Equals, http.StatusForbidden)
+	c.Check(post("xyzzy", "dry_run=maybe").Code, check.Equals, http.StatusBadRequest)
+
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, httptest.NewRequest("GET", "/run", nil))
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	// Dry run, outside balance window: changes are computed but
+	// not sent to keepstore servers.
+	c.Check(post("xyzzy", "dry_run=true").Code, check.Equals, http.StatusAccepted)
+	waitForRuns(1)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+
+	// Send pull/trash lists to one keepstore server only.
+	resp = post("xyzzy", "keep_services="+stubServices[1].UUID)
+	c.Check(resp.Code, check.Equals, http.StatusAccepted)
+	c.Check(resp.Body.String(), check.Equals, `{"dry_run":false,"keep_services":["zzzzz-bi6l4-000000000000001"]}`+"\n")
+	waitForRuns(2)
+	c.Check(pullReqs.Count(), check.Equals, 1)
+	c.Check(trashReqs.Count(), check.Equals, 2)
+	for _, req := range append(pullReqs.reqs, trashReqs.reqs...) {
+		c.Check(req.URL.Host, check.Equals, "keep1.zzzzz.arvadosapi.com:25107")
+	}
+}
+
+func (s *runSuite) TestLastRun(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	srv.setupHandler()
+
+	get := func(token string) (*httptest.ResponseRecorder, lastRunStatus) {
+		req := httptest.NewRequest("GET", "/last-run", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		srv.ServeHTTP(resp, req)
+		var status lastRunStatus
+		if resp.Code == http.StatusOK {
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, "application/json")
+			c.Check(json.Unmarshal(resp.Body.Bytes(), &status), check.IsNil)
+		}
+		return resp, status
+	}
+
+	resp, _ := get("")
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	resp, _ = get("wrongtoken")
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+	resp, status := get("xyzzy")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, `{"last_run":null,"running":false,"next_run_at":null}`+"\n")
+
+	t0 := time.Now()
+	_, err := srv.runOnce(nil)
+	c.Assert(err, check.IsNil)
+	next := time.Now().Add(time.Hour)
+	srv.setNextRun(next)
+
+	resp, status = get("xyzzy")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(status.Running, check.Equals, false)
+	c.Assert(status.NextRunAt, check.NotNil)
+	c.Check(status.NextRunAt.Equal(next), check.Equals, true)
+	c.Assert(status.LastRun, check.NotNil)
+	lr := status.LastRun
+	c.Check(lr.StartedAt.Before(t0), check.Equals, false)
+	c.Check(lr.FinishedAt.Before(lr.StartedAt), check.Equals, false)
+	c.Check(lr.DryRun, check.Equals, false)
+	c.Check(lr.Error, check.Equals, "")
+	c.Check(lr.CollectionsScanned, check.Equals, 3)
+	c.Check(lr.LostBlocks, check.Equals, 0)
+	c.Check(lr.Pulls, check.Equals, 2)
+	c.Check(lr.Trashes, check.Equals, 2)
+	c.Check(lr.Counters["current"].Bytes, check.Equals, int64(15))
+	c.Check(lr.Counters["overreplicated"].Blocks, check.Equals, 1)
+	for _, phase := range []string{"sweep", "get_state", "changeset_compute", "send_pull_lists", "send_trash_lists"} {
+		c.Check(lr.Timings[phase] > 0, check.Equals, true, check.Commentf("%s", phase))
+	}
+
+	resp = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/last-run", nil)
+	req.Header.Set("Authorization", "Bearer xyzzy")
+	srv.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusMethodNotAllowed)
+}
+
 func (s *runSuite) getMetrics(c *check.C, srv *Server) (*bytes.Buffer, error) {
 	mfs, err := srv.Metrics.reg.Gather()
 	if err != nil {
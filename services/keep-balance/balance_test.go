@@ -94,6 +94,8 @@ func (bal *balancerSuite) SetUpTest(c *check.C) {
 	}
 
 	bal.MinMtime = time.Now().UnixNano() - bal.signatureTTL*1e9
+	bal.blobSignatureTTL = time.Duration(bal.signatureTTL) * time.Second
+	bal.placement = nil
 	bal.cleanupMounts()
 }
 
@@ -108,6 +110,36 @@ func (bal *balancerSuite) TestPerfect(c *check.C) {
 		}})
 }
 
+func (bal *balancerSuite) TestSetBlobSigningTTLs(c *check.C) {
+	bal.srvs[3].mounts[0].BlobSigningTTL = arvados.Duration(30 * time.Minute)
+	bal.srvs[5].mounts[0].BlobSigningTTL = arvados.Duration(3 * time.Hour)
+	bal.setBlobSigningTTLs(time.Hour)
+	c.Check(bal.srvs[0].blobSigningTTL, check.Equals, time.Hour)
+	c.Check(bal.srvs[3].blobSigningTTL, check.Equals, 30*time.Minute)
+	c.Check(bal.srvs[5].blobSigningTTL, check.Equals, 3*time.Hour)
+}
+
+// Replicas are not trashed while a signature issued by a server with
+// a longer BlobSigningTTL than the API server's might still be
+// valid -- but other servers' TTLs don't hold up trash.
+func (bal *balancerSuite) TestTrashWithLongerServerTTL(c *check.C) {
+	t := tester{
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 2, 1},
+		shouldTrash: slots{2},
+	}
+	bal.srvList(0, slots{5})[0].blobSigningTTL = 7 * 24 * time.Hour
+	bal.try(c, t)
+
+	bal.srvList(0, slots{2})[0].blobSigningTTL = 7 * 24 * time.Hour
+	t.shouldTrash = nil
+	bal.try(c, t)
+	bal.srvList(0, slots{2})[0].blobSigningTTL = 0
+
+	bal.srvList(0, slots{0})[0].blobSigningTTL = 7 * 24 * time.Hour
+	bal.try(c, t)
+}
+
 func (bal *balancerSuite) TestDecreaseRepl(c *check.C) {
 	bal.try(c, tester{
 		desired:     map[string]int{"default": 2},
@@ -27,6 +27,11 @@ type BlockState struct {
 	RefCount int
 	Replicas []Replica
 	Desired  map[string]int
+	// Referenced by a hot collection (see hotData)
+	Hot bool
+	// Desired replication under the settings being simulated
+	// (see Simulation). Nil unless running a simulation.
+	SimulatedDesired map[string]int
 	// TODO: Support combinations of classes ("private + durable")
 	// by replacing the map[string]int with a map[*[]string]int
 	// here, where the map keys come from a pool of semantically
@@ -57,14 +62,20 @@ func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 		bs.Refs[pdh] = true
 	}
 	bs.RefCount++
+	increaseDesired(&bs.Desired, classes, n)
+}
+
+// increaseDesired updates *desired to indicate the desired
+// replication for each of the given classes is at least n.
+func increaseDesired(desired *map[string]int, classes []string, n int) {
 	if len(classes) == 0 {
 		classes = defaultClasses
 	}
 	for _, class := range classes {
-		if bs.Desired == nil {
-			bs.Desired = map[string]int{class: n}
-		} else if d, ok := bs.Desired[class]; !ok || d < n {
-			bs.Desired[class] = n
+		if *desired == nil {
+			*desired = map[string]int{class: n}
+		} else if d, ok := (*desired)[class]; !ok || d < n {
+			(*desired)[class] = n
 		}
 	}
 }
@@ -133,3 +144,25 @@ func (bsm *BlockStateMap) IncreaseDesired(pdh string, classes []string, n int, b
 		bsm.get(blkid).increaseDesired(pdh, classes, n)
 	}
 }
+
+// MarkHot updates the map to indicate the given blocks are referenced
+// by a hot collection.
+func (bsm *BlockStateMap) MarkHot(blocks []arvados.SizedDigest) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	for _, blkid := range blocks {
+		bsm.get(blkid).Hot = true
+	}
+}
+
+// IncreaseSimulatedDesired is like IncreaseDesired, but updates
+// SimulatedDesired instead of Desired.
+func (bsm *BlockStateMap) IncreaseSimulatedDesired(classes []string, n int, blocks []arvados.SizedDigest) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	for _, blkid := range blocks {
+		increaseDesired(&bsm.get(blkid).SimulatedDesired, classes, n)
+	}
+}
@@ -18,6 +18,7 @@ type Pull struct {
 	arvados.SizedDigest
 	From *KeepService
 	To   *KeepMount
+	Hot  bool // block is referenced by a hot collection
 }
 
 // MarshalJSON formats a pull request the way keepstore wants to see
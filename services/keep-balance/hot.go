@@ -0,0 +1,250 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+var (
+	pdhRegexp  = regexp.MustCompile(`^[0-9a-f]{32}\+\d+$`)
+	uuidRegexp = regexp.MustCompile(`^[0-9a-z]{5}-([0-9a-z]{5})-[0-9a-z]{15}$`)
+)
+
+// hotData is the set of collections whose blocks should be kept at
+// higher replication and/or in additional storage classes (see
+// Collections.BalanceHotData).
+type hotData struct {
+	pdhs             map[string]bool
+	extraReplication int
+	classes          []string
+}
+
+// isHot returns true if the collection with the given PDH is hot.
+func (hd *hotData) isHot(pdh string) bool {
+	return hd != nil && hd.pdhs[pdh]
+}
+
+// replication is a number of replicas to store in each of a set of
+// storage classes.
+type replication struct {
+	classes []string
+	n       int
+}
+
+// desired returns the replication needed by a hot collection with
+// the given storage classes and replication level.
+//
+// If no hot storage classes are configured, the collection gets
+// ExtraReplication more replicas in its own storage classes.
+// Otherwise, it keeps its usual replication in its own storage
+// classes, and gets ExtraReplication replicas (at least one) in each
+// hot storage class. The hot classes are not added to the
+// collection's own classes, which would store the collection's full
+// replication level in each of them.
+func (hd *hotData) desired(classes []string, repl int) []replication {
+	if len(hd.classes) == 0 {
+		return []replication{{classes, repl + hd.extraReplication}}
+	}
+	n := hd.extraReplication
+	if n < 1 {
+		n = 1
+	}
+	return []replication{{classes, repl}, {hd.classes, n}}
+}
+
+// resolveHotData looks up the portable data hashes of the collections
+// referenced by the configured Collections.BalanceHotData sources. It
+// returns nil if no sources are configured.
+//
+// A source that doesn't exist (e.g., it has been deleted) is logged
+// and skipped. Any other error is returned, so the balancing run is
+// aborted instead of proceeding without some hot data -- which would
+// trash its extra replicas.
+func resolveHotData(ctx context.Context, c *arvados.Client, cfg arvados.BalanceHotDataConfig, logf func(string, ...interface{})) (*hotData, error) {
+	if len(cfg.Sources) == 0 {
+		return nil, nil
+	}
+	hd := &hotData{
+		pdhs:             map[string]bool{},
+		extraReplication: cfg.ExtraReplication,
+		classes:          cfg.StorageClasses,
+	}
+	for _, src := range cfg.Sources {
+		var err error
+		m := uuidRegexp.FindStringSubmatch(src)
+		switch {
+		case pdhRegexp.MatchString(src):
+			hd.pdhs[src] = true
+		case m != nil && m[1] == "4zz18":
+			err = hd.addCollection(ctx, c, src)
+		case m != nil && m[1] == "j7d0g":
+			err = hd.addProject(ctx, c, src)
+		case m != nil && m[1] == "xvhdz":
+			err = hd.addContainerRequest(ctx, c, src)
+		default:
+			return nil, fmt.Errorf("Collections.BalanceHotData.Sources entry %q is not a collection PDH, or a collection, project, or container request UUID", src)
+		}
+		if isNotFound(err) {
+			logf("skipping Collections.BalanceHotData.Sources entry %q: %s", src, err)
+		} else if err != nil {
+			return nil, fmt.Errorf("error resolving Collections.BalanceHotData.Sources entry %q: %s", src, err)
+		}
+	}
+	return hd, nil
+}
+
+// isNotFound returns true if err is an API response indicating the
+// requested object does not exist.
+func isNotFound(err error) bool {
+	herr, ok := err.(interface{ HTTPStatus() int })
+	return ok && herr.HTTPStatus() == http.StatusNotFound
+}
+
+func (hd *hotData) addCollection(ctx context.Context, c *arvados.Client, uuid string) error {
+	var coll arvados.Collection
+	err := c.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+uuid, nil, arvados.GetOptions{
+		Select: []string{"portable_data_hash"},
+	})
+	if err != nil {
+		return err
+	}
+	hd.pdhs[coll.PortableDataHash] = true
+	return nil
+}
+
+// addProject adds all collections in the given project and its
+// subprojects.
+func (hd *hotData) addProject(ctx context.Context, c *arvados.Client, uuid string) error {
+	projects := []interface{}{uuid}
+	for len(projects) > 0 {
+		err := eachPage([]arvados.Filter{{Attr: "owner_uuid", Operator: "in", Operand: projects}}, func(params arvados.ResourceListParams) (string, error) {
+			var resp arvados.CollectionList
+			params.Select = []string{"uuid", "portable_data_hash"}
+			err := c.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/collections", nil, params)
+			if err != nil || len(resp.Items) == 0 {
+				return "", err
+			}
+			for _, coll := range resp.Items {
+				hd.pdhs[coll.PortableDataHash] = true
+			}
+			return resp.Items[len(resp.Items)-1].UUID, nil
+		})
+		if err != nil {
+			return err
+		}
+		var subprojects []interface{}
+		err = eachPage([]arvados.Filter{{Attr: "owner_uuid", Operator: "in", Operand: projects}, {Attr: "group_class", Operator: "=", Operand: "project"}}, func(params arvados.ResourceListParams) (string, error) {
+			var resp arvados.GroupList
+			params.Select = []string{"uuid"}
+			err := c.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/groups", nil, params)
+			if err != nil || len(resp.Items) == 0 {
+				return "", err
+			}
+			for _, grp := range resp.Items {
+				subprojects = append(subprojects, grp.UUID)
+			}
+			return resp.Items[len(resp.Items)-1].UUID, nil
+		})
+		if err != nil {
+			return err
+		}
+		projects = subprojects
+	}
+	return nil
+}
+
+// addContainerRequest adds the collections and container image
+// mounted by the given container request, and by all container
+// requests submitted by its container (e.g., workflow steps).
+//
+// Mounted collections that no longer exist are skipped.
+func (hd *hotData) addContainerRequest(ctx context.Context, c *arvados.Client, uuid string) error {
+	var cr arvados.ContainerRequest
+	err := c.RequestAndDecodeContext(ctx, &cr, "GET", "arvados/v1/container_requests/"+uuid, nil, nil)
+	if err != nil {
+		return err
+	}
+	// Container requests are visited once each, even if the same
+	// container (and therefore the same child requests) is used
+	// by more than one of them.
+	visited := map[string]bool{cr.UUID: true}
+	todo := []arvados.ContainerRequest{cr}
+	for len(todo) > 0 {
+		cr, todo = todo[0], todo[1:]
+		if pdhRegexp.MatchString(cr.ContainerImage) {
+			hd.pdhs[cr.ContainerImage] = true
+		}
+		for _, mnt := range cr.Mounts {
+			if mnt.Kind != "collection" {
+				continue
+			}
+			if mnt.PortableDataHash != "" {
+				hd.pdhs[mnt.PortableDataHash] = true
+			} else if mnt.UUID != "" {
+				if err := hd.addCollection(ctx, c, mnt.UUID); err != nil && !isNotFound(err) {
+					return err
+				}
+			}
+		}
+		if cr.ContainerUUID == "" {
+			continue
+		}
+		err = eachPage([]arvados.Filter{{Attr: "requesting_container_uuid", Operator: "=", Operand: cr.ContainerUUID}}, func(params arvados.ResourceListParams) (string, error) {
+			var resp arvados.ContainerRequestList
+			err := c.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/container_requests", nil, params)
+			if err != nil || len(resp.Items) == 0 {
+				return "", err
+			}
+			for _, child := range resp.Items {
+				if !visited[child.UUID] {
+					visited[child.UUID] = true
+					todo = append(todo, child)
+				}
+			}
+			return resp.Items[len(resp.Items)-1].UUID, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachPage calls get with the parameters for successive pages of
+// items matching the given filters, in UUID order. get returns the
+// UUID of the last item on the page it retrieved, or "" if the page
+// was empty.
+func eachPage(filters []arvados.Filter, get func(arvados.ResourceListParams) (string, error)) error {
+	params := arvados.ResourceListParams{
+		Filters: filters,
+		Order:   "uuid",
+		Count:   "none",
+	}
+	for {
+		last, err := get(params)
+		if err != nil || last == "" {
+			return err
+		}
+		params.Filters = append(append([]arvados.Filter(nil), filters...), arvados.Filter{Attr: "uuid", Operator: ">", Operand: last})
+	}
+}
+
+// prioritizeHotPulls moves pull requests for hot blocks to the front
+// of each keepstore server's pull list, so they are processed first.
+func (bal *Balancer) prioritizeHotPulls() {
+	for _, srv := range bal.KeepServices {
+		pulls := srv.ChangeSet.Pulls
+		sort.SliceStable(pulls, func(i, j int) bool {
+			return pulls[i].Hot && !pulls[j].Hot
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&hotSuite{})
+
+type hotSuite struct{}
+
+func (s *hotSuite) TestDesired(c *check.C) {
+	var hd *hotData
+	c.Check(hd.isHot("fa7aeb5140e2848d39b416daeef4ffc5+45"), check.Equals, false)
+
+	hd = &hotData{pdhs: map[string]bool{"fa7aeb5140e2848d39b416daeef4ffc5+45": true}, extraReplication: 1}
+	c.Check(hd.isHot("fa7aeb5140e2848d39b416daeef4ffc5+45"), check.Equals, true)
+	c.Check(hd.isHot("1f4b0bc7583c2a7f9102c395f4ffc5e3+45"), check.Equals, false)
+	c.Check(hd.desired(nil, 2), check.DeepEquals, []replication{{nil, 3}})
+	c.Check(hd.desired([]string{"archival"}, 2), check.DeepEquals, []replication{{[]string{"archival"}, 3}})
+
+	// With hot storage classes, the collection's own classes keep
+	// their usual replication, and each hot class gets
+	// extraReplication replicas (at least one).
+	hd.classes = []string{"fast"}
+	c.Check(hd.desired(nil, 2), check.DeepEquals, []replication{{nil, 2}, {[]string{"fast"}, 1}})
+	hd.extraReplication = 0
+	c.Check(hd.desired([]string{"archival"}, 2), check.DeepEquals, []replication{{[]string{"archival"}, 2}, {[]string{"fast"}, 1}})
+	hd.extraReplication = 2
+	c.Check(hd.desired([]string{"archival"}, 3), check.DeepEquals, []replication{{[]string{"archival"}, 3}, {[]string{"fast"}, 2}})
+}
+
+func (s *hotSuite) TestPrioritizeHotPulls(c *check.C) {
+	srv := &KeepService{ChangeSet: &ChangeSet{}}
+	for i, hot := range []bool{false, true, false, true} {
+		srv.AddPull(Pull{SizedDigest: knownBlkid(i), Hot: hot})
+	}
+	bal := &Balancer{KeepServices: map[string]*KeepService{"zzzzz-bi6l4-000000000000000": srv}}
+	bal.prioritizeHotPulls()
+	var order []int
+	for _, pull := range srv.ChangeSet.Pulls {
+		for i := 0; i < 4; i++ {
+			if pull.SizedDigest == knownBlkid(i) {
+				order = append(order, i)
+			}
+		}
+	}
+	c.Check(order, check.DeepEquals, []int{1, 3, 0, 2})
+}
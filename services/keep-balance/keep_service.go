@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
@@ -20,6 +21,14 @@ type KeepService struct {
 	arvados.KeepService
 	mounts []*KeepMount
 	*ChangeSet
+
+	// True if the pull list could not be sent during the current
+	// run (see Balancer.CommitPulls).
+	pullsFailed bool
+
+	// BlobSigningTTL used by this server (see
+	// Balancer.setBlobSigningTTLs).
+	blobSigningTTL time.Duration
 }
 
 // String implements fmt.Stringer.
@@ -99,6 +108,11 @@ func (srv *KeepService) discoverMounts(c *arvados.Client) error {
 type KeepMount struct {
 	arvados.KeepMount
 	KeepService *KeepService
+
+	// Time taken to retrieve this mount's index during the most
+	// recent GetCurrentState (zero if the index was retrieved
+	// via an equivalent mount on the same device).
+	indexDuration time.Duration
 }
 
 // String implements fmt.Stringer.
@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// blockCounts is the JSON representation of a blocksNBytes.
+type blockCounts struct {
+	Blocks   int   `json:"blocks"`
+	Bytes    int64 `json:"bytes"`
+	Replicas int   `json:"replicas"`
+}
+
+func (bb blocksNBytes) counts() blockCounts {
+	return blockCounts{Blocks: bb.blocks, Bytes: bb.bytes, Replicas: bb.replicas}
+}
+
+// runSummary describes a completed (or failed) balancing run.
+type runSummary struct {
+	StartedAt          time.Time              `json:"started_at"`
+	FinishedAt         time.Time              `json:"finished_at"`
+	DryRun             bool                   `json:"dry_run"`
+	Error              string                 `json:"error,omitempty"`
+	Timings            map[string]float64     `json:"timings"`
+	CollectionsScanned int                    `json:"collections_scanned"`
+	LostBlocks         int                    `json:"lost_blocks"`
+	Pulls              int                    `json:"pulls"`
+	Trashes            int                    `json:"trashes"`
+	Counters           map[string]blockCounts `json:"counters"`
+}
+
+// lastRunStatus is the response to a GET /last-run request.
+type lastRunStatus struct {
+	// Most recent run, or nil if no run has finished since
+	// keep-balance started.
+	LastRun *runSummary `json:"last_run"`
+
+	// A run is in progress now.
+	Running bool `json:"running"`
+
+	// Scheduled start time of the next run, or nil if not known
+	// yet (e.g., during the first run).
+	NextRunAt *time.Time `json:"next_run_at"`
+}
+
+// newRunSummary returns a summary of the given run.
+func newRunSummary(bal *Balancer, started time.Time, dryRun bool, err error) *runSummary {
+	s := bal.stats
+	sum := &runSummary{
+		StartedAt:          started.UTC(),
+		FinishedAt:         time.Now().UTC(),
+		DryRun:             dryRun,
+		Timings:            map[string]float64{},
+		CollectionsScanned: bal.collScanned,
+		LostBlocks:         s.lost.blocks,
+		Pulls:              s.pulls,
+		Trashes:            s.trashes,
+		Counters: map[string]blockCounts{
+			"lost":            s.lost.counts(),
+			"underreplicated": s.underrep.counts(),
+			"unachievable":    s.unachievable.counts(),
+			"justright":       s.justright.counts(),
+			"overreplicated":  s.overrep.counts(),
+			"unreferenced":    s.unref.counts(),
+			"garbage":         s.garbage.counts(),
+			"hot":             s.hot.counts(),
+			"desired":         s.desired.counts(),
+			"current":         s.current.counts(),
+		},
+	}
+	if err != nil {
+		sum.Error = err.Error()
+	}
+	bal.timingsMtx.Lock()
+	for name, secs := range bal.timings {
+		sum.Timings[name] = secs
+	}
+	bal.timingsMtx.Unlock()
+	return sum
+}
+
+// startRun records that a run is in progress.
+func (srv *Server) startRun() {
+	srv.statusMtx.Lock()
+	defer srv.statusMtx.Unlock()
+	srv.status.Running = true
+}
+
+// finishRun records the summary of the run that just finished.
+func (srv *Server) finishRun(sum *runSummary) {
+	srv.statusMtx.Lock()
+	defer srv.statusMtx.Unlock()
+	srv.status.Running = false
+	srv.status.LastRun = sum
+}
+
+// setNextRun records the scheduled start time of the next run, and
+// updates the corresponding metric.
+func (srv *Server) setNextRun(t time.Time) {
+	srv.Metrics.SetNextRun(t)
+	t = t.UTC()
+	srv.statusMtx.Lock()
+	defer srv.statusMtx.Unlock()
+	srv.status.NextRunAt = &t
+}
+
+// handleLastRun handles a GET /last-run request by reporting the
+// summary of the most recent run, whether a run is in progress, and
+// when the next run is scheduled to start.
+func (srv *Server) handleLastRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	srv.statusMtx.Lock()
+	buf, err := json.Marshal(srv.status)
+	srv.statusMtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(buf, '\n'))
+}
@@ -15,7 +15,6 @@ import (
 	"git.arvados.org/arvados.git/lib/service"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
-	"git.arvados.org/arvados.git/sdk/go/health"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -37,6 +36,11 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 		"send trash requests (delete unreferenced old blocks, and excess replicas of overreplicated blocks)")
 	flags.Bool("version", false, "Write version information to stdout and exit 0")
 	dumpFlag := flags.Bool("dump", false, "dump details for each block to stdout")
+	var sim Simulation
+	flags.DurationVar(&sim.BlobSigningTTL, "simulate-blob-signing-ttl", 0,
+		"report the effect of changing BlobSigningTTL to the given `duration` (implies -once, and disables -commit-pulls and -commit-trash)")
+	flags.IntVar(&sim.DefaultReplication, "simulate-default-replication", 0,
+		"report the effect of changing DefaultReplication to the given value (implies -once, and disables -commit-pulls and -commit-trash)")
 
 	loader := config.NewLoader(os.Stdin, logger)
 	loader.SetupFlags(flags)
@@ -51,6 +55,13 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 		options.Dumper = dumper
 	}
 
+	if sim.BlobSigningTTL > 0 || sim.DefaultReplication > 0 {
+		options.Simulate = &sim
+		options.Once = true
+		options.CommitPulls = false
+		options.CommitTrash = false
+	}
+
 	// Drop our custom args that would be rejected by the generic
 	// service.Command
 	args = nil
@@ -59,6 +70,9 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 		"commit-pulls": true,
 		"commit-trash": true,
 		"dump":         true,
+
+		"simulate-blob-signing-ttl":    true,
+		"simulate-default-replication": true,
 	}
 	flags.Visit(func(f *flag.Flag) {
 		if !dropFlag[f.Name] {
@@ -72,6 +86,10 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 				return service.ErrorHandler(ctx, cluster, fmt.Errorf("cannot start service: Collections.BalancePeriod is zero (if you want to run once and then exit, use the -once flag)"))
 			}
 
+			if _, err := newSchedule(cluster.Collections.BalanceWindows, cluster.Collections.BalanceBlackouts); err != nil {
+				return service.ErrorHandler(ctx, cluster, fmt.Errorf("cannot start service: %s", err))
+			}
+
 			ac, err := arvados.NewClientFromConfig(cluster)
 			ac.AuthToken = token
 			if err != nil {
@@ -90,11 +108,7 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 				Logger:     options.Logger,
 				Dumper:     options.Dumper,
 			}
-			srv.Handler = &health.Handler{
-				Token:  cluster.ManagementToken,
-				Prefix: "/_health/",
-				Routes: health.Routes{"ping": srv.CheckHealth},
-			}
+			srv.setupHandler()
 
 			go srv.run()
 			return srv
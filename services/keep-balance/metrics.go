@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -19,7 +20,11 @@ type setter interface{ Set(float64) }
 type metrics struct {
 	reg         *prometheus.Registry
 	statsGauges map[string]setter
+	mountGauges map[string]*prometheus.GaugeVec
+	indexTime   *prometheus.GaugeVec
+	commitVecs  *commitVecs
 	observers   map[string]observer
+	nextRun     setter
 	setupOnce   sync.Once
 	mtx         sync.Mutex
 }
@@ -28,6 +33,7 @@ func newMetrics(registry *prometheus.Registry) *metrics {
 	return &metrics{
 		reg:         registry,
 		statsGauges: map[string]setter{},
+		mountGauges: map[string]*prometheus.GaugeVec{},
 		observers:   map[string]observer{},
 	}
 }
@@ -49,6 +55,24 @@ func (m *metrics) DurationObserver(name, help string) observer {
 	return summary
 }
 
+// SetNextRun updates the gauge that reports when the next
+// scan/balance operation is scheduled to start.
+func (m *metrics) SetNextRun(t time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.nextRun == nil {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Name:      "next_run_timestamp_seconds",
+			Subsystem: "keepbalance",
+			Help:      "scheduled start time of the next scan/balance operation",
+		})
+		m.reg.MustRegister(g)
+		m.nextRun = g
+	}
+	m.nextRun.Set(float64(t.UnixNano()) / 1e9)
+}
+
 // UpdateStats updates prometheus metrics using the given
 // balancerStats. It creates and registers the needed gauges on its
 // first invocation.
@@ -91,6 +115,32 @@ func (m *metrics) UpdateStats(s balancerStats) {
 				panic(fmt.Sprintf("bad gauge type %T", gauge.Value))
 			}
 		}
+		// Register per-mount gauges.
+		for name, help := range map[string]string{
+			"mount_usage_blocks":   "blocks stored on each mount",
+			"mount_usage_bytes":    "bytes stored on each mount",
+			"mount_usage_replicas": "replicas stored on each mount",
+			"mount_pulls":          "pull requests for each mount",
+			"mount_trashes":        "trash requests for each mount",
+			"mount_bytes_free":     "free space on each mount's device, as reported by keepstore",
+			"mount_bytes_used":     "used space on each mount's device, as reported by keepstore",
+		} {
+			g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Name:      name,
+				Subsystem: "keep",
+				Help:      help,
+			}, []string{"keep_service", "mount_uuid"})
+			m.reg.MustRegister(g)
+			m.mountGauges[name] = g
+		}
+		m.indexTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Name:      "index_duration_seconds",
+			Subsystem: "keepbalance",
+			Help:      "time taken to retrieve the slowest mount index from each keep service during the last run",
+		}, []string{"keep_service"})
+		m.reg.MustRegister(m.indexTime)
 	})
 	// Set gauges to values from s.
 	for name, gauge := range s2g {
@@ -109,6 +159,78 @@ func (m *metrics) UpdateStats(s balancerStats) {
 			panic(fmt.Sprintf("bad gauge type %T", gauge.Value))
 		}
 	}
+	// Reset per-mount gauges, so mounts that have been removed
+	// since the last run are not reported.
+	for _, g := range m.mountGauges {
+		g.Reset()
+	}
+	m.indexTime.Reset()
+	indexTime := map[string]time.Duration{}
+	for mnt, ms := range s.mountStats {
+		labels := prometheus.Labels{"keep_service": mnt.KeepService.UUID, "mount_uuid": mnt.UUID}
+		m.mountGauges["mount_usage_blocks"].With(labels).Set(float64(ms.stored.blocks))
+		m.mountGauges["mount_usage_bytes"].With(labels).Set(float64(ms.stored.bytes))
+		m.mountGauges["mount_usage_replicas"].With(labels).Set(float64(ms.stored.replicas))
+		m.mountGauges["mount_pulls"].With(labels).Set(float64(ms.pulls))
+		m.mountGauges["mount_trashes"].With(labels).Set(float64(ms.trashes))
+		if mnt.BytesFree > 0 || mnt.BytesUsed > 0 {
+			// Older keepstore versions don't report
+			// space usage.
+			m.mountGauges["mount_bytes_free"].With(labels).Set(float64(mnt.BytesFree))
+			m.mountGauges["mount_bytes_used"].With(labels).Set(float64(mnt.BytesUsed))
+		}
+		if d := mnt.indexDuration; d > indexTime[mnt.KeepService.UUID] {
+			indexTime[mnt.KeepService.UUID] = d
+		}
+	}
+	for uuid, d := range indexTime {
+		m.indexTime.With(prometheus.Labels{"keep_service": uuid}).Set(d.Seconds())
+	}
+}
+
+type commitVecs struct {
+	duration *prometheus.GaugeVec
+	attempts *prometheus.GaugeVec
+	failures *prometheus.CounterVec
+}
+
+// ObserveCommit updates the per-server metrics for sending a pull or
+// trash list (list is "pull" or "trash") to a keepstore server.
+// attempts and dur include retries; err is the final error, if any.
+func (m *metrics) ObserveCommit(srvUUID, list string, attempts int, dur time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.commitVecs == nil {
+		labels := []string{"keep_service", "list"}
+		m.commitVecs = &commitVecs{
+			duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Name:      "commit_duration_seconds",
+				Subsystem: "keepbalance",
+				Help:      "time taken to send the most recent pull/trash list to each keep service, including retries",
+			}, labels),
+			attempts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Name:      "commit_attempts",
+				Subsystem: "keepbalance",
+				Help:      "number of attempts needed to send the most recent pull/trash list to each keep service",
+			}, labels),
+			failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: "arvados",
+				Name:      "commit_failures_total",
+				Subsystem: "keepbalance",
+				Help:      "number of pull/trash lists that could not be sent to each keep service, even after retrying",
+			}, labels),
+		}
+		m.reg.MustRegister(m.commitVecs.duration, m.commitVecs.attempts, m.commitVecs.failures)
+	}
+	labels := prometheus.Labels{"keep_service": srvUUID, "list": list}
+	m.commitVecs.duration.With(labels).Set(dur.Seconds())
+	m.commitVecs.attempts.With(labels).Set(float64(attempts))
+	failures := m.commitVecs.failures.With(labels)
+	if err != nil {
+		failures.Inc()
+	}
 }
 
 func (m *metrics) Handler(log promhttp.Logger) http.Handler {
@@ -0,0 +1,167 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A placementPolicy decides which keepstore servers are the best
+// places to store replicas of a block. balanceBlock ranks mounts by
+// storage class and existing untrashable replicas first, and then by
+// the policy's preference order.
+//
+// The default policy (rendezvousPolicy) uses rendezvous order, so
+// clients can find blocks by probing servers in the same order.
+// Other policies should deviate from rendezvous order only as much as
+// necessary, because clients have to probe further to find replicas
+// that are not in their rendezvous positions.
+type placementPolicy interface {
+	// name identifies the policy in logs and config
+	// (Collections.BalancePlacementPolicy).
+	name() string
+
+	// state returns a fingerprint of the policy's configuration,
+	// which is included in the balancer's rendezvous state (see
+	// rendezvousState), so existing trash lists are cleared if
+	// it changes.
+	state() string
+
+	// order returns the given services, which are sorted in
+	// rendezvous order for a block, sorted in order of preference
+	// for storing replicas of that block.
+	order(rendezvous []*KeepService) []*KeepService
+
+	// domain returns a label for the failure domain (e.g., zone)
+	// srv belongs to. balanceBlock tries to place replicas in
+	// distinct failure domains before resorting to distinct
+	// servers in the same domain.
+	domain(srv *KeepService) string
+
+	// explain returns a short description of a preference order
+	// returned by order, for the -dump output.
+	explain(order []*KeepService) string
+}
+
+// newPlacementPolicy returns the placement policy selected by
+// Collections.BalancePlacementPolicy.
+func newPlacementPolicy(cluster *arvados.Cluster, srvs map[string]*KeepService) (placementPolicy, error) {
+	switch cluster.Collections.BalancePlacementPolicy {
+	case "", "rendezvous":
+		return rendezvousPolicy{}, nil
+	case "zone-spread":
+		return newZoneSpreadPolicy(cluster, srvs)
+	default:
+		return nil, fmt.Errorf("unknown placement policy %q in Collections.BalancePlacementPolicy", cluster.Collections.BalancePlacementPolicy)
+	}
+}
+
+// rendezvousPolicy places replicas in rendezvous order.
+type rendezvousPolicy struct{}
+
+func (rendezvousPolicy) name() string                                   { return "rendezvous" }
+func (rendezvousPolicy) state() string                                  { return "" }
+func (rendezvousPolicy) order(rendezvous []*KeepService) []*KeepService { return rendezvous }
+func (rendezvousPolicy) domain(srv *KeepService) string                 { return srv.UUID }
+func (rendezvousPolicy) explain([]*KeepService) string                  { return "rendezvous" }
+
+// zoneSpreadPolicy spreads replicas across zones (as configured in
+// the Zone field of the Services.Keepstore.InternalURLs entries).
+// Within each zone, servers are preferred in rendezvous order. The
+// preference order takes the best server in each zone (with zones in
+// the order their best servers appear in rendezvous order), then the
+// second best server in each zone, and so on.
+//
+// Servers with no configured zone are each treated as a zone of
+// their own.
+type zoneSpreadPolicy struct {
+	zones map[*KeepService]string
+}
+
+func newZoneSpreadPolicy(cluster *arvados.Cluster, srvs map[string]*KeepService) (*zoneSpreadPolicy, error) {
+	zoneOf := map[string]string{}
+	for u, si := range cluster.Services.Keepstore.InternalURLs {
+		if si.Zone != "" {
+			zoneOf[hostPort(u)] = si.Zone
+		}
+	}
+	p := &zoneSpreadPolicy{zones: map[*KeepService]string{}}
+	for _, srv := range srvs {
+		if zone := zoneOf[fmt.Sprintf("%s:%d", srv.ServiceHost, srv.ServicePort)]; zone != "" {
+			p.zones[srv] = zone
+		}
+	}
+	if len(p.zones) == 0 {
+		return nil, fmt.Errorf("zone-spread placement policy requires Zone to be configured in Services.Keepstore.InternalURLs entries matching keepstore servers")
+	}
+	return p, nil
+}
+
+// hostPort returns u's host and port, using the default port for
+// u's scheme if u has no explicit port.
+func hostPort(u arvados.URL) string {
+	if (*url.URL)(&u).Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return u.Host + ":443"
+	}
+	return u.Host + ":80"
+}
+
+func (p *zoneSpreadPolicy) name() string { return "zone-spread" }
+
+func (p *zoneSpreadPolicy) state() string {
+	var zones []string
+	for srv, zone := range p.zones {
+		zones = append(zones, srv.UUID+"="+zone)
+	}
+	sort.Strings(zones)
+	return "zone-spread(" + strings.Join(zones, ",") + ")"
+}
+
+func (p *zoneSpreadPolicy) domain(srv *KeepService) string {
+	if zone, ok := p.zones[srv]; ok {
+		return "zone:" + zone
+	}
+	return srv.UUID
+}
+
+func (p *zoneSpreadPolicy) order(rendezvous []*KeepService) []*KeepService {
+	var domains []string
+	byDomain := map[string][]*KeepService{}
+	for _, srv := range rendezvous {
+		d := p.domain(srv)
+		if byDomain[d] == nil {
+			domains = append(domains, d)
+		}
+		byDomain[d] = append(byDomain[d], srv)
+	}
+	order := make([]*KeepService, 0, len(rendezvous))
+	for i := 0; len(order) < len(rendezvous); i++ {
+		for _, d := range domains {
+			if i < len(byDomain[d]) {
+				order = append(order, byDomain[d][i])
+			}
+		}
+	}
+	return order
+}
+
+func (p *zoneSpreadPolicy) explain(order []*KeepService) string {
+	zones := make([]string, len(order))
+	for i, srv := range order {
+		zones[i] = p.zones[srv]
+		if zones[i] == "" {
+			zones[i] = "-"
+		}
+	}
+	return "zone-spread[" + strings.Join(zones, ",") + "]"
+}
@@ -0,0 +1,118 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+// zoneSpread returns a zoneSpreadPolicy with the servers at the
+// given rendezvous positions (for knownBlkid(0)) in zone "a", and
+// all other servers in zone "b".
+func (bal *balancerSuite) zoneSpread(zoneA slots) *zoneSpreadPolicy {
+	p := &zoneSpreadPolicy{zones: map[*KeepService]string{}}
+	for _, srv := range bal.srvs {
+		p.zones[srv] = "b"
+	}
+	for _, srv := range bal.srvList(0, zoneA) {
+		p.zones[srv] = "a"
+	}
+	return p
+}
+
+func (bal *balancerSuite) TestZoneSpreadOrder(c *check.C) {
+	p := bal.zoneSpread(slots{0, 1, 2})
+	order := p.order(bal.srvList(0, slots{0, 1, 2, 3, 4, 5}))
+	c.Check(order, check.DeepEquals, bal.srvList(0, slots{0, 3, 1, 4, 2, 5}))
+	c.Check(p.explain(order), check.Equals, "zone-spread[a,b,a,b,a,b]")
+
+	// Servers with no zone are their own failure domains.
+	delete(p.zones, bal.srvList(0, slots{4})[0])
+	order = p.order(bal.srvList(0, slots{0, 1, 2, 3, 4, 5}))
+	c.Check(order, check.DeepEquals, bal.srvList(0, slots{0, 3, 4, 1, 5, 2}))
+	c.Check(p.explain(order), check.Equals, "zone-spread[a,b,-,a,b,a]")
+}
+
+func (bal *balancerSuite) TestZoneSpreadMovesReplica(c *check.C) {
+	// With the default policy, the best two positions are fine,
+	// even though they're in the same zone.
+	bal.try(c, tester{
+		desired: map[string]int{"default": 2},
+		current: slots{0, 1},
+	})
+
+	// With zone-spread, the second replica belongs in the best
+	// server in zone b.
+	bal.placement = bal.zoneSpread(slots{0, 1})
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 1},
+		shouldPull: slots{2},
+	})
+	// Once the pull succeeds, the extra zone-a replica is trashed.
+	bal.try(c, tester{
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 1, 2},
+		shouldTrash: slots{1},
+	})
+	bal.try(c, tester{
+		desired: map[string]int{"default": 2},
+		current: slots{0, 2},
+	})
+
+	// A third replica can go in either zone, so it goes to the
+	// next server in rendezvous order.
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 3},
+		current:    slots{0, 2},
+		shouldPull: slots{1},
+	})
+}
+
+func (bal *balancerSuite) TestZoneSpreadUnderreplicatedZone(c *check.C) {
+	// If the only zone-b server is read-only, both replicas have
+	// to go in zone a.
+	bal.placement = bal.zoneSpread(slots{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14})
+	bal.srvList(0, slots{15})[0].ReadOnly = true
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0},
+		shouldPull: slots{1},
+	})
+}
+
+func (bal *balancerSuite) TestNewPlacementPolicy(c *check.C) {
+	cluster := &arvados.Cluster{}
+	p, err := newPlacementPolicy(cluster, bal.KeepServices)
+	c.Check(err, check.IsNil)
+	c.Check(p.name(), check.Equals, "rendezvous")
+
+	cluster.Collections.BalancePlacementPolicy = "bogus"
+	_, err = newPlacementPolicy(cluster, bal.KeepServices)
+	c.Check(err, check.ErrorMatches, `unknown placement policy "bogus".*`)
+
+	cluster.Collections.BalancePlacementPolicy = "zone-spread"
+	_, err = newPlacementPolicy(cluster, bal.KeepServices)
+	c.Check(err, check.ErrorMatches, `zone-spread placement policy requires Zone.*`)
+
+	bal.srvs[0].ServiceHost, bal.srvs[0].ServicePort = "keep0.zzzzz.example", 25107
+	bal.srvs[1].ServiceHost, bal.srvs[1].ServicePort = "keep1.zzzzz.example", 443
+	cluster.Services.Keepstore.InternalURLs = map[arvados.URL]arvados.ServiceInstance{
+		{Scheme: "http", Host: "keep0.zzzzz.example:25107"}: {Zone: "a"},
+		{Scheme: "https", Host: "keep1.zzzzz.example"}:      {Zone: "b"},
+		{Scheme: "http", Host: "keep2.zzzzz.example:25107"}: {},
+	}
+	p, err = newPlacementPolicy(cluster, bal.KeepServices)
+	c.Assert(err, check.IsNil)
+	c.Check(p.(*zoneSpreadPolicy).zones, check.DeepEquals, map[*KeepService]string{
+		bal.srvs[0]: "a",
+		bal.srvs[1]: "b",
+	})
+	c.Check(p.state(), check.Equals, "zone-spread("+bal.srvs[0].UUID+"=a,"+bal.srvs[1].UUID+"=b)")
+
+	bal.placement = p
+	c.Check(bal.rendezvousState(), check.Matches, `.*; zone-spread\(.*\)`)
+}
@@ -0,0 +1,153 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Number of PDHs to look up in a single request to a remote cluster.
+var recoveryLookupBatch = 100
+
+// lostBlock is a block that has no replicas on any keepstore server,
+// along with the portable data hashes of the collections that
+// reference it.
+type lostBlock struct {
+	hash string
+	pdhs []string
+}
+
+// writeRecoveryReport looks for ways to recover the lost blocks
+// found during the current run, and writes them as a shell script
+// to bal.RecoveryReportFile.
+//
+// A lost block can be recovered from a remote cluster that has a
+// collection with the same PDH as a collection referencing the block
+// (by copying the collection with arv-copy), or, if it was trashed
+// recently, by untrashing it on whichever keepstore server still has
+// it. Keepstore does not report trashed blocks in its index, so
+// untrash commands are suggested for every server when
+// BlobTrashLifetime is non-zero.
+func (bal *Balancer) writeRecoveryReport(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster) error {
+	sort.Slice(bal.lostList, func(i, j int) bool { return bal.lostList[i].hash < bal.lostList[j].hash })
+	remotePDHs := bal.findRemotePDHs(ctx, c, cluster)
+
+	var servers []*KeepService
+	if cluster.Collections.BlobTrashLifetime > 0 {
+		for _, srv := range bal.KeepServices {
+			servers = append(servers, srv)
+		}
+		sort.Slice(servers, func(i, j int) bool { return servers[i].UUID < servers[j].UUID })
+	}
+
+	tmpfn := bal.RecoveryReportFile + ".tmp"
+	f, err := os.OpenFile(tmpfn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfn)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#!/bin/sh\n")
+	fmt.Fprintf(w, "# Lost block recovery suggestions generated by keep-balance at %s.\n", time.Now().UTC().Format(time.RFC3339))
+	if len(servers) > 0 {
+		fmt.Fprintf(w, "# Untrash commands must be run with ARVADOS_API_TOKEN set to the SystemRootToken.\n")
+		fmt.Fprintf(w, "# Trashed blocks are deleted permanently after BlobTrashLifetime (%v).\n", cluster.Collections.BlobTrashLifetime)
+	}
+	for _, lb := range bal.lostList {
+		fmt.Fprintf(w, "\n# block %s referenced by %v\n", lb.hash, lb.pdhs)
+		found := false
+		for _, pdh := range lb.pdhs {
+			for _, clusterID := range remotePDHs[pdh] {
+				fmt.Fprintf(w, "# collection %s exists on remote cluster %s\n", pdh, clusterID)
+				fmt.Fprintf(w, "arv-copy --src %s --dst %s %s\n", clusterID, cluster.ClusterID, pdh)
+				found = true
+			}
+		}
+		if len(servers) > 0 {
+			fmt.Fprintf(w, "# block may still be in trash\n")
+			for _, srv := range servers {
+				fmt.Fprintf(w, "curl -fsS -X PUT -H \"Authorization: Bearer $ARVADOS_API_TOKEN\" %s/untrash/%s\n", srv.URLBase(), lb.hash)
+			}
+			found = true
+		}
+		if !found {
+			fmt.Fprintf(w, "# no recovery options found\n")
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfn, bal.RecoveryReportFile)
+}
+
+// findRemotePDHs returns a map of PDH => list of remote cluster IDs
+// that have a collection with that PDH, for each PDH that references
+// a lost block. Errors contacting remote clusters are logged and
+// otherwise ignored.
+func (bal *Balancer) findRemotePDHs(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster) map[string][]string {
+	var clusterIDs []string
+	for id := range cluster.RemoteClusters {
+		if id != cluster.ClusterID && id != "*" {
+			clusterIDs = append(clusterIDs, id)
+		}
+	}
+	sort.Strings(clusterIDs)
+
+	found := map[string][]string{}
+	if len(clusterIDs) == 0 {
+		return found
+	}
+	var pdhs []interface{}
+	seen := map[string]bool{}
+	for _, lb := range bal.lostList {
+		for _, pdh := range lb.pdhs {
+			if !seen[pdh] {
+				seen[pdh] = true
+				pdhs = append(pdhs, pdh)
+			}
+		}
+	}
+	for _, clusterID := range clusterIDs {
+		for start := 0; start < len(pdhs); start += recoveryLookupBatch {
+			end := start + recoveryLookupBatch
+			if end > len(pdhs) {
+				end = len(pdhs)
+			}
+			var page arvados.CollectionList
+			err := c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/collections", nil, arvados.ListOptions{
+				ClusterID: clusterID,
+				Filters:   []arvados.Filter{{Attr: "portable_data_hash", Operator: "in", Operand: pdhs[start:end]}},
+				Select:    []string{"portable_data_hash"},
+				Distinct:  true,
+				Count:     "none",
+				Limit:     int64(end - start),
+			})
+			if err != nil {
+				bal.logf("error looking up lost blocks on remote cluster %s: %s", clusterID, err)
+				break
+			}
+			for _, coll := range page.Items {
+				pdh := coll.PortableDataHash
+				if seen[pdh] && (len(found[pdh]) == 0 || found[pdh][len(found[pdh])-1] != clusterID) {
+					found[pdh] = append(found[pdh], clusterID)
+				}
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,182 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// A timeWindow is a recurring weekly time range, like "Mon-Fri
+// 22:00-06:00". A window whose end is not after its start wraps
+// around midnight into the following day.
+type timeWindow struct {
+	days  [7]bool
+	start int // minutes after midnight UTC
+	end   int // minutes after midnight UTC
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	var w timeWindow
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("invalid time window %q: expected a day specification and a time range, like \"Mon-Fri 22:00-06:00\"", spec)
+	}
+	for _, dayspec := range strings.Split(fields[0], ",") {
+		if dayspec == "*" {
+			for d := range w.days {
+				w.days[d] = true
+			}
+			continue
+		}
+		ends := strings.SplitN(dayspec, "-", 2)
+		first, ok := weekdayNames[strings.ToLower(ends[0])]
+		if !ok {
+			return w, fmt.Errorf("invalid time window %q: unknown day %q", spec, ends[0])
+		}
+		last := first
+		if len(ends) == 2 {
+			last, ok = weekdayNames[strings.ToLower(ends[1])]
+			if !ok {
+				return w, fmt.Errorf("invalid time window %q: unknown day %q", spec, ends[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	if fields[1] == "*" {
+		w.start, w.end = 0, minutesPerDay
+		return w, nil
+	}
+	ends := strings.SplitN(fields[1], "-", 2)
+	if len(ends) != 2 {
+		return w, fmt.Errorf("invalid time window %q: time range must be \"*\" or \"HH:MM-HH:MM\"", spec)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(ends[0]); err != nil {
+		return w, fmt.Errorf("invalid time window %q: %s", spec, err)
+	}
+	if w.end, err = parseTimeOfDay(ends[1]); err != nil {
+		return w, fmt.Errorf("invalid time window %q: %s", spec, err)
+	}
+	return w, nil
+}
+
+// parseTimeOfDay returns the number of minutes after midnight
+// represented by "HH:MM". "24:00" is accepted as the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains returns true if t falls inside the window.
+func (w timeWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// Window wraps past midnight: the part before midnight
+	// belongs to today, the part after midnight belongs to the
+	// previous day.
+	return (w.days[day] && minute >= w.start) ||
+		(w.days[(day+6)%7] && minute < w.end)
+}
+
+// A schedule determines when keep-balance is allowed to start a
+// scan/balance operation, according to the BalanceWindows and
+// BalanceBlackouts configs.
+type schedule struct {
+	windows   []timeWindow
+	blackouts []timeWindow
+}
+
+func newSchedule(windows, blackouts []string) (*schedule, error) {
+	sched := &schedule{}
+	for _, spec := range windows {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("BalanceWindows: %s", err)
+		}
+		sched.windows = append(sched.windows, w)
+	}
+	for _, spec := range blackouts {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("BalanceBlackouts: %s", err)
+		}
+		sched.blackouts = append(sched.blackouts, w)
+	}
+	if sched.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("BalanceBlackouts exclude all BalanceWindows: no time is available for balancing")
+	}
+	return sched, nil
+}
+
+// Allows returns true if a scan/balance operation can start at time
+// t.
+func (sched *schedule) Allows(t time.Time) bool {
+	if sched == nil {
+		return true
+	}
+	for _, w := range sched.blackouts {
+		if w.contains(t) {
+			return false
+		}
+	}
+	if len(sched.windows) == 0 {
+		return true
+	}
+	for _, w := range sched.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the earliest time no earlier than t when a
+// scan/balance operation is allowed to start. It returns the zero
+// time if the schedule never allows balancing.
+func (sched *schedule) Next(t time.Time) time.Time {
+	if sched.Allows(t) {
+		return t
+	}
+	// Windows have one-minute granularity and repeat weekly, so
+	// checking each minute boundary in the next week (plus a
+	// day, for windows that wrap past midnight) is sufficient.
+	next := t.Truncate(time.Minute)
+	for i := 0; i < 8*minutesPerDay; i++ {
+		next = next.Add(time.Minute)
+		if sched.Allows(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
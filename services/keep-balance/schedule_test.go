@@ -0,0 +1,93 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&scheduleSuite{})
+
+type scheduleSuite struct{}
+
+// 2020-11-02 is a Monday.
+func (s *scheduleSuite) at(c *check.C, str string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", str)
+	c.Assert(err, check.IsNil)
+	return t
+}
+
+func (s *scheduleSuite) TestParseErrors(c *check.C) {
+	for _, spec := range []string{
+		"",
+		"Mon",
+		"Mon 22:00",
+		"Funday 22:00-23:00",
+		"Mon-Funday 22:00-23:00",
+		"Mon 22:00-25:00",
+		"Mon 22:60-23:00",
+		"Mon 2:00-3:00",
+		"Mon 22:00-23:00 extra",
+	} {
+		_, err := newSchedule([]string{spec}, nil)
+		c.Check(err, check.ErrorMatches, `BalanceWindows: invalid time.*`, check.Commentf("spec %q", spec))
+		_, err = newSchedule(nil, []string{spec})
+		c.Check(err, check.ErrorMatches, `BalanceBlackouts: invalid time.*`, check.Commentf("spec %q", spec))
+	}
+}
+
+func (s *scheduleSuite) TestNoWindows(c *check.C) {
+	sched, err := newSchedule(nil, nil)
+	c.Assert(err, check.IsNil)
+	t := s.at(c, "2020-11-04 13:14")
+	c.Check(sched.Allows(t), check.Equals, true)
+	c.Check(sched.Next(t), check.Equals, t)
+
+	var nilsched *schedule
+	c.Check(nilsched.Allows(t), check.Equals, true)
+}
+
+func (s *scheduleSuite) TestWindows(c *check.C) {
+	sched, err := newSchedule([]string{"Mon-Fri 22:00-06:00", "Sat,Sun *"}, nil)
+	c.Assert(err, check.IsNil)
+	for _, trial := range []struct {
+		t       string
+		allowed bool
+		next    string
+	}{
+		{"2020-11-02 21:59", false, "2020-11-02 22:00"},
+		{"2020-11-02 22:00", true, "2020-11-02 22:00"},
+		{"2020-11-03 05:59", true, "2020-11-03 05:59"},
+		{"2020-11-03 06:00", false, "2020-11-03 22:00"},
+		{"2020-11-02 05:00", false, "2020-11-02 22:00"}, // Sunday night's window is "Sun *", which ends at midnight
+		{"2020-11-07 05:00", true, "2020-11-07 05:00"},  // Friday night's window continues into Saturday
+		{"2020-11-08 23:59", true, "2020-11-08 23:59"},
+	} {
+		t := s.at(c, trial.t)
+		c.Check(sched.Allows(t), check.Equals, trial.allowed, check.Commentf("%s", trial.t))
+		c.Check(sched.Next(t), check.Equals, s.at(c, trial.next), check.Commentf("%s", trial.t))
+	}
+}
+
+func (s *scheduleSuite) TestBlackouts(c *check.C) {
+	sched, err := newSchedule(nil, []string{"Wed 12:00-13:30"})
+	c.Assert(err, check.IsNil)
+	c.Check(sched.Allows(s.at(c, "2020-11-04 11:59")), check.Equals, true)
+	c.Check(sched.Allows(s.at(c, "2020-11-04 12:00")), check.Equals, false)
+	c.Check(sched.Next(s.at(c, "2020-11-04 12:15")), check.Equals, s.at(c, "2020-11-04 13:30"))
+	c.Check(sched.Allows(s.at(c, "2020-11-05 12:15")), check.Equals, true)
+
+	sched, err = newSchedule([]string{"* 01:00-02:00"}, []string{"Sat 01:30-02:00"})
+	c.Assert(err, check.IsNil)
+	c.Check(sched.Allows(s.at(c, "2020-11-07 01:29")), check.Equals, true)
+	c.Check(sched.Next(s.at(c, "2020-11-07 01:30")), check.Equals, s.at(c, "2020-11-08 01:00"))
+}
+
+func (s *scheduleSuite) TestBlackoutsCoverEverything(c *check.C) {
+	_, err := newSchedule([]string{"Mon 01:00-02:00"}, []string{"* *"})
+	c.Check(err, check.ErrorMatches, `.*no time is available.*`)
+}
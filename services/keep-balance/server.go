@@ -5,13 +5,19 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/health"
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,11 +35,22 @@ type RunOptions struct {
 	Logger      logrus.FieldLogger
 	Dumper      logrus.FieldLogger
 
+	// If non-empty, pull and trash lists are sent only to these
+	// keepstore servers. Changes are still computed using all
+	// servers. Set by the POST /run management endpoint.
+	CommitKeepServices []string
+
 	// SafeRendezvousState from the most recent balance operation,
 	// or "" if unknown. If this changes from one run to the next,
 	// we need to watch out for races. See
 	// (*Balancer)ClearTrashLists.
 	SafeRendezvousState string
+
+	// If not nil, compute changes as usual, then recompute them
+	// using the given proposed configuration and report the
+	// differences. Pull and trash lists are never sent in this
+	// mode.
+	Simulate *Simulation
 }
 
 type Server struct {
@@ -46,6 +63,92 @@ type Server struct {
 
 	Logger logrus.FieldLogger
 	Dumper logrus.FieldLogger
+
+	// On-demand runs requested via the management API (see
+	// handleRun). Nil if the management API is not set up.
+	runRequests chan runRequest
+
+	// Reported by the GET /last-run management endpoint.
+	status    lastRunStatus
+	statusMtx sync.Mutex
+}
+
+// runRequest is an on-demand balancing run requested via the
+// management API.
+type runRequest struct {
+	DryRun       bool     `json:"dry_run"`
+	KeepServices []string `json:"keep_services"`
+}
+
+// setupHandler sets up srv.Handler to serve the health check and
+// management API endpoints.
+func (srv *Server) setupHandler() {
+	mux := http.NewServeMux()
+	mux.Handle("/_health/", &health.Handler{
+		Token:  srv.Cluster.ManagementToken,
+		Prefix: "/_health/",
+		Routes: health.Routes{"ping": srv.CheckHealth},
+	})
+	if srv.Cluster.ManagementToken == "" {
+		notConfigured := func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Management API authentication is not configured", http.StatusForbidden)
+		}
+		mux.HandleFunc("/run", notConfigured)
+		mux.HandleFunc("/last-run", notConfigured)
+	} else {
+		srv.runRequests = make(chan runRequest, 1)
+		mux.Handle("/run", auth.RequireLiteralToken(srv.Cluster.ManagementToken, http.HandlerFunc(srv.handleRun)))
+		mux.Handle("/last-run", auth.RequireLiteralToken(srv.Cluster.ManagementToken, http.HandlerFunc(srv.handleLastRun)))
+	}
+	srv.Handler = mux
+}
+
+// handleRun handles a POST /run request by starting a balancing run
+// as soon as the current one (if any) finishes.
+//
+// Optional form parameters: dry_run=true (compute changes and report
+// statistics, but don't send pull/trash lists), and keep_services=uuid
+// (send pull/trash lists only to the given keepstore server; may be
+// given multiple times).
+func (srv *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if srv.RunOptions.Once {
+		http.Error(w, "cannot start a run: keep-balance is running in -once mode", http.StatusServiceUnavailable)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req runRequest
+	if v := r.Form.Get("dry_run"); v != "" {
+		req.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid dry_run value: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, v := range r.Form["keep_services"] {
+		for _, uuid := range strings.Split(v, ",") {
+			if uuid = strings.TrimSpace(uuid); uuid != "" {
+				req.KeepServices = append(req.KeepServices, uuid)
+			}
+		}
+	}
+	select {
+	case srv.runRequests <- req:
+	default:
+		http.Error(w, "a requested run is already pending", http.StatusConflict)
+		return
+	}
+	srv.Logger.WithField("DryRun", req.DryRun).WithField("KeepServices", req.KeepServices).Info("run requested via management API")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(req)
 }
 
 // CheckHealth implements service.Handler.
@@ -61,7 +164,7 @@ func (srv *Server) Done() <-chan struct{} {
 func (srv *Server) run() {
 	var err error
 	if srv.RunOptions.Once {
-		_, err = srv.runOnce()
+		_, err = srv.runOnce(nil)
 	} else {
 		err = srv.runForever(nil)
 	}
@@ -73,15 +176,30 @@ func (srv *Server) run() {
 	}
 }
 
-func (srv *Server) runOnce() (*Balancer, error) {
+// runOnce performs a balancing run. If req is not nil, its dry-run
+// and keepstore subset options override srv.RunOptions for this run
+// only.
+func (srv *Server) runOnce(req *runRequest) (*Balancer, error) {
 	bal := &Balancer{
-		Logger:         srv.Logger,
-		Dumper:         srv.Dumper,
-		Metrics:        srv.Metrics,
-		LostBlocksFile: srv.Cluster.Collections.BlobMissingReport,
+		Logger:             srv.Logger,
+		Dumper:             srv.Dumper,
+		Metrics:            srv.Metrics,
+		LostBlocksFile:     srv.Cluster.Collections.BlobMissingReport,
+		RecoveryReportFile: srv.Cluster.Collections.BlobRecoveryReport,
 	}
-	var err error
-	srv.RunOptions, err = bal.Run(srv.ArvClient, srv.Cluster, srv.RunOptions)
+	opts := srv.RunOptions
+	if req != nil {
+		if req.DryRun {
+			opts.CommitPulls = false
+			opts.CommitTrash = false
+		}
+		opts.CommitKeepServices = req.KeepServices
+	}
+	started := time.Now()
+	srv.startRun()
+	nextOpts, err := bal.Run(srv.ArvClient, srv.Cluster, opts)
+	srv.finishRun(newRunSummary(bal, started, !opts.CommitPulls && !opts.CommitTrash, err))
+	srv.RunOptions.SafeRendezvousState = nextOpts.SafeRendezvousState
 	return bal, err
 }
 
@@ -90,7 +208,14 @@ func (srv *Server) runOnce() (*Balancer, error) {
 func (srv *Server) runForever(stop <-chan interface{}) error {
 	logger := srv.Logger
 
-	ticker := time.NewTicker(time.Duration(srv.Cluster.Collections.BalancePeriod))
+	sched, err := newSchedule(srv.Cluster.Collections.BalanceWindows, srv.Cluster.Collections.BalanceBlackouts)
+	if err != nil {
+		return err
+	}
+
+	period := time.Duration(srv.Cluster.Collections.BalancePeriod)
+	ticker := time.NewTicker(period)
+	nextTick := time.Now().Add(period)
 
 	// The unbuffered channel here means we only hear SIGUSR1 if
 	// it arrives while we're waiting in select{}.
@@ -99,32 +224,67 @@ func (srv *Server) runForever(stop <-chan interface{}) error {
 
 	logger.Printf("starting up: will scan every %v and on SIGUSR1", srv.Cluster.Collections.BalancePeriod)
 
+	// Run requested via management API, if any.
+	var req *runRequest
+
 	for {
 		if !srv.RunOptions.CommitPulls && !srv.RunOptions.CommitTrash {
 			logger.Print("WARNING: Will scan periodically, but no changes will be committed.")
 			logger.Print("=======  Consider using -commit-pulls and -commit-trash flags.")
 		}
 
-		_, err := srv.runOnce()
+		if next := sched.Next(time.Now()); req == nil && time.Until(next) > 0 {
+			logger.Printf("outside balance window, sleeping until %v", next.UTC())
+			srv.setNextRun(next)
+			select {
+			case <-stop:
+				signal.Stop(sigUSR1)
+				return nil
+			case <-time.After(time.Until(next)):
+				logger.Print("balance window opened")
+			case <-sigUSR1:
+				logger.Print("received SIGUSR1, starting run outside balance window")
+			case r := <-srv.runRequests:
+				logger.Print("run requested via management API, starting run outside balance window")
+				req = &r
+			}
+		}
+
+		_, err := srv.runOnce(req)
+		req = nil
 		if err != nil {
 			logger.Print("run failed: ", err)
 		} else {
 			logger.Print("run succeeded")
 		}
 
+		next := nextTick
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		srv.setNextRun(sched.Next(next))
+
 		select {
 		case <-stop:
 			signal.Stop(sigUSR1)
 			return nil
-		case <-ticker.C:
+		case nextTick = <-ticker.C:
 			logger.Print("timer went off")
+			nextTick = nextTick.Add(period)
 		case <-sigUSR1:
 			logger.Print("received SIGUSR1, resetting timer")
 			// Reset the timer so we don't start the N+1st
 			// run too soon after the Nth run is triggered
 			// by SIGUSR1.
 			ticker.Stop()
-			ticker = time.NewTicker(time.Duration(srv.Cluster.Collections.BalancePeriod))
+			ticker = time.NewTicker(period)
+			nextTick = time.Now().Add(period)
+		case r := <-srv.runRequests:
+			logger.Print("run requested via management API, resetting timer")
+			req = &r
+			ticker.Stop()
+			ticker = time.NewTicker(period)
+			nextTick = time.Now().Add(period)
 		}
 		logger.Print("starting next run")
 	}
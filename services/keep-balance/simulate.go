@@ -0,0 +1,126 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Simulation specifies proposed configuration changes whose effect
+// on the computed change sets should be reported, for capacity
+// planning. Zero values mean "same as the current configuration".
+type Simulation struct {
+	BlobSigningTTL     time.Duration
+	DefaultReplication int
+}
+
+// simulationSummary is the subset of balancer statistics that are
+// compared in a simulation report.
+type simulationSummary struct {
+	desired   blocksNBytes
+	current   blocksNBytes
+	pulls     blocksNBytes
+	trashes   blocksNBytes
+	garbage   blocksNBytes
+	unref     blocksNBytes
+	overrep   blocksNBytes
+	underrep  blocksNBytes
+	lost      blocksNBytes
+	projected int64 // bytes stored after applying pulls and trashes
+}
+
+func (bal *Balancer) simulationSummary() simulationSummary {
+	sum := simulationSummary{
+		desired:  bal.stats.desired,
+		current:  bal.stats.current,
+		garbage:  bal.stats.garbage,
+		unref:    bal.stats.unref,
+		overrep:  bal.stats.overrep,
+		underrep: bal.stats.underrep,
+		lost:     bal.stats.lost,
+	}
+	for _, srv := range bal.KeepServices {
+		for _, pull := range srv.ChangeSet.Pulls {
+			sum.pulls.replicas += pull.To.Replication
+			sum.pulls.blocks++
+			sum.pulls.bytes += pull.SizedDigest.Size()
+		}
+		for _, trash := range srv.ChangeSet.Trashes {
+			sum.trashes.replicas += trash.From.Replication
+			sum.trashes.blocks++
+			sum.trashes.bytes += trash.SizedDigest.Size()
+		}
+	}
+	sum.projected = sum.current.bytes + sum.pulls.bytes - sum.trashes.bytes
+	return sum
+}
+
+// simulate recomputes the change sets using the settings in
+// bal.simulation instead of the current configuration, and logs the
+// differences. It must be called after ComputeChangeSets.
+//
+// Afterwards, the change sets and statistics reflect the simulated
+// configuration, so they must not be committed.
+func (bal *Balancer) simulate() {
+	sim := bal.simulation
+	ttl := bal.blobSignatureTTL
+	if sim.BlobSigningTTL > 0 {
+		ttl = sim.BlobSigningTTL
+	}
+	defaultRepl := bal.DefaultReplication
+	if sim.DefaultReplication > 0 {
+		defaultRepl = sim.DefaultReplication
+	}
+
+	before := bal.simulationSummary()
+
+	bal.BlockStateMap.Apply(func(_ arvados.SizedDigest, blk *BlockState) {
+		blk.Desired, blk.SimulatedDesired = blk.SimulatedDesired, blk.Desired
+	})
+	bal.MinMtime += int64(bal.blobSignatureTTL - ttl)
+	current := bal.blobSignatureTTL
+	bal.blobSignatureTTL = ttl
+	for _, srv := range bal.KeepServices {
+		srv.ChangeSet = &ChangeSet{}
+		if sim.BlobSigningTTL > 0 {
+			// The simulated TTL applies to all servers,
+			// including those whose mounts report a
+			// longer one.
+			srv.blobSigningTTL = ttl
+		}
+	}
+	// Don't report simulated results in metrics or the lost
+	// blocks file.
+	bal.simulating = true
+	bal.lostBlocks = ioutil.Discard
+	bal.ComputeChangeSets()
+
+	after := bal.simulationSummary()
+
+	bal.logf("=== simulation")
+	bal.logf("BlobSigningTTL: current %v, simulated %v", current, ttl)
+	bal.logf("DefaultReplication: current %d, simulated %d", bal.DefaultReplication, defaultRepl)
+	for _, row := range []struct {
+		label         string
+		before, after blocksNBytes
+	}{
+		{"desired", before.desired, after.desired},
+		{"current", before.current, after.current},
+		{"pulls", before.pulls, after.pulls},
+		{"trashes", before.trashes, after.trashes},
+		{"garbage", before.garbage, after.garbage},
+		{"unref", before.unref, after.unref},
+		{"overrep", before.overrep, after.overrep},
+		{"underrep", before.underrep, after.underrep},
+		{"lost", before.lost, after.lost},
+	} {
+		bal.logf("%s: current %s; simulated %s; change %+d bytes", row.label, row.before, row.after, row.after.bytes-row.before.bytes)
+	}
+	bal.logf("storage after changes: current %d bytes; simulated %d bytes; change %+d bytes", before.projected, after.projected, after.projected-before.projected)
+	bal.logf("===")
+}
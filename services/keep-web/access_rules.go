@@ -0,0 +1,91 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// accessRule returns the Collections.WebDAVAccessRules entry that
+// applies to the given host and path, or nil if none matches.
+//
+// The path is cleaned first, so "/public/../private" is subject to
+// the rules for "/private", which is where the request would
+// actually go. A PathPrefix only matches at a path segment boundary:
+// "/public" matches "/public" and "/public/foo", but not
+// "/publicity".
+func (h *handler) accessRule(host, reqpath string) *arvados.WebDAVAccessRule {
+	if hostonly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostonly
+	}
+	// Cleaning a rooted path removes all ".." elements.
+	reqpath = path.Clean("/" + reqpath)
+	var best *arvados.WebDAVAccessRule
+	var bestName string
+	for name, rule := range h.Config.cluster.Collections.WebDAVAccessRules {
+		rule := rule
+		if !pathHasPrefix(reqpath, rule.PathPrefix) {
+			continue
+		}
+		if len(rule.Hosts) > 0 && !webdavLockingHost(rule.Hosts, host) {
+			continue
+		}
+		if best == nil || betterAccessRule(&rule, name, best, bestName) {
+			best, bestName = &rule, name
+		}
+	}
+	return best
+}
+
+// pathHasPrefix returns true if prefix is p, or a directory that
+// contains p. A trailing slash on prefix is optional.
+func pathHasPrefix(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// betterAccessRule returns true if rule a is more specific than
+// rule b. Ties are broken by name so the result doesn't depend on map
+// iteration order.
+func betterAccessRule(a *arvados.WebDAVAccessRule, aName string, b *arvados.WebDAVAccessRule, bName string) bool {
+	if len(a.PathPrefix) != len(b.PathPrefix) {
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	}
+	if (len(a.Hosts) > 0) != (len(b.Hosts) > 0) {
+		return len(a.Hosts) > 0
+	}
+	return aName < bName
+}
+
+// checkAccessRules returns false (after sending an error response)
+// if the given access rule, or the rule for the destination of a
+// MOVE or COPY request, forbids the request.
+func (h *handler) checkAccessRules(w http.ResponseWriter, r *http.Request, rule *arvados.WebDAVAccessRule) bool {
+	if !writeMethod[r.Method] {
+		return true
+	}
+	if rule != nil && !rule.AllowWrite {
+		http.Error(w, errReadOnly.Error(), http.StatusMethodNotAllowed)
+		return false
+	}
+	if r.Method == "MOVE" || r.Method == "COPY" {
+		if dst, err := url.Parse(r.Header.Get("Destination")); err == nil && dst.Path != "" {
+			host := r.Host
+			if dst.Host != "" {
+				host = dst.Host
+			}
+			if rule := h.accessRule(host, dst.Path); rule != nil && !rule.AllowWrite {
+				http.Error(w, errReadOnly.Error(), http.StatusMethodNotAllowed)
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var testAccessRules = map[string]arvados.WebDAVAccessRule{
+	"public": {
+		Hosts:          arvados.StringSet{"*.collections.example.com": {}},
+		PathPrefix:     "/public/",
+		AllowAnonymous: true,
+	},
+	"upload": {
+		Hosts:      arvados.StringSet{"*.collections.example.com": {}},
+		PathPrefix: "/upload/",
+		AllowWrite: true,
+	},
+	"default": {
+		Hosts:      arvados.StringSet{"*.collections.example.com": {}},
+		PathPrefix: "/",
+	},
+	"anyhost": {
+		PathPrefix: "/upload/",
+	},
+	"shared": {
+		Hosts:          arvados.StringSet{"*.collections.example.com": {}},
+		PathPrefix:     "/shared",
+		AllowAnonymous: true,
+	},
+}
+
+func (s *UnitSuite) TestAccessRuleSelection(c *check.C) {
+	cfg := newConfig(s.Config)
+	cfg.cluster.Collections.WebDAVAccessRules = testAccessRules
+	h := handler{Config: cfg}
+	for _, trial := range []struct {
+		host   string
+		path   string
+		expect string
+	}{
+		{"abc.collections.example.com", "/public/foo", "public"},
+		{"abc.collections.example.com:443", "/public/foo", "public"},
+		{"ABC.Collections.Example.COM", "/public/foo", "public"},
+		{"abc.collections.example.com", "/public", "default"},
+		{"abc.collections.example.com", "/upload/foo", "upload"},
+		{"abc.collections.example.com", "/foo", "default"},
+		{"download.example.com", "/upload/foo", "anyhost"},
+		{"download.example.com", "/foo", ""},
+		// Paths are cleaned before matching
+		{"abc.collections.example.com", "/public/../upload/foo", "upload"},
+		{"abc.collections.example.com", "/public/../../foo", "default"},
+		{"abc.collections.example.com", "/public/./foo", "public"},
+		{"abc.collections.example.com", "//public/foo", "public"},
+		{"abc.collections.example.com", "public/../foo", "default"},
+		// Prefixes match at path segment boundaries
+		{"abc.collections.example.com", "/shared", "shared"},
+		{"abc.collections.example.com", "/shared/", "shared"},
+		{"abc.collections.example.com", "/shared/foo", "shared"},
+		{"abc.collections.example.com", "/sharedfoo", "default"},
+		{"abc.collections.example.com", "/shared-not/foo", "default"},
+	} {
+		c.Logf("%+v", trial)
+		rule := h.accessRule(trial.host, trial.path)
+		if trial.expect == "" {
+			c.Check(rule, check.IsNil)
+			continue
+		}
+		c.Assert(rule, check.NotNil)
+		c.Check(*rule, check.DeepEquals, testAccessRules[trial.expect])
+	}
+}
+
+func (s *UnitSuite) TestAccessRuleReadOnly(c *check.C) {
+	cfg := newConfig(s.Config)
+	cfg.cluster.Collections.WebDAVAccessRules = testAccessRules
+	h := handler{Config: cfg}
+	for _, trial := range []struct {
+		method      string
+		url         string
+		destination string
+	}{
+		{"PUT", "http://abc.collections.example.com/foo", ""},
+		{"DELETE", "http://abc.collections.example.com/public/foo", ""},
+		{"PUT", "http://abc.collections.example.com/upload/../foo", ""},
+		{"PUT", "http://abc.collections.example.com/uploadfoo", ""},
+		{"MKCOL", "http://abc.collections.example.com/bar/", ""},
+		{"MOVE", "http://abc.collections.example.com/upload/foo", "http://abc.collections.example.com/foo"},
+		{"COPY", "http://abc.collections.example.com/upload/foo", "/public/foo"},
+	} {
+		c.Logf("%+v", trial)
+		u := mustParseURL(trial.url)
+		req := &http.Request{
+			Method:     trial.method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+			Body:       http.NoBody,
+		}
+		if trial.destination != "" {
+			req.Header.Set("Destination", trial.destination)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusMethodNotAllowed)
+		c.Check(strings.TrimSpace(resp.Body.String()), check.Equals, errReadOnly.Error())
+	}
+}
+
+func (s *IntegrationSuite) TestAccessRuleAnonymous(c *check.C) {
+	s.testServer.Config.cluster.Users.AnonymousUserToken = arvadostest.AnonymousToken
+	s.testServer.Config.cluster.Collections.WebDAVAccessRules = map[string]arvados.WebDAVAccessRule{
+		"public": {
+			Hosts:          arvados.StringSet{"*.example.com": {}},
+			PathPrefix:     "/Hello world.txt",
+			AllowAnonymous: true,
+		},
+		"default": {
+			Hosts:      arvados.StringSet{"*.example.com": {}},
+			PathPrefix: "/",
+		},
+	}
+	s.testVhostRedirectTokenToCookie(c, "GET",
+		arvadostest.HelloWorldCollection+".example.com/Hello%20world.txt",
+		"",
+		"",
+		"",
+		http.StatusOK,
+		"Hello world\n",
+	)
+
+	s.testServer.Config.cluster.Collections.WebDAVAccessRules["public"] = arvados.WebDAVAccessRule{
+		Hosts:      arvados.StringSet{"*.example.com": {}},
+		PathPrefix: "/Hello world.txt",
+	}
+	s.testVhostRedirectTokenToCookie(c, "GET",
+		arvadostest.HelloWorldCollection+".example.com/Hello%20world.txt",
+		"",
+		"",
+		"",
+		http.StatusUnauthorized,
+		unauthorizedMessage+"\n",
+	)
+}
@@ -5,6 +5,9 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,9 +30,27 @@ type cache struct {
 	collections *lru.TwoQueueCache
 	permissions *lru.TwoQueueCache
 	sessions    *lru.TwoQueueCache
+	checksums   *lru.TwoQueueCache
+	versions    *lru.TwoQueueCache
+	listings    *lru.TwoQueueCache
+	s3keys      *lru.TwoQueueCache
 	setupOnce   sync.Once
 }
 
+// Number of files whose S3 checksums are cached. Entries are small,
+// so this is not configurable.
+const s3ChecksumCacheEntries = 4096
+
+// Number of directory listings cached for S3 ListObjects requests
+// (see GetS3Listing). Only large directories are cached, and each
+// entry can be big, so this is small.
+const s3ListingCacheEntries = 16
+
+// Number of controller-issued S3 access keys whose tokens are
+// cached (see GetS3AccessKey). Entries are small, so this is not
+// configurable.
+const s3AccessKeyCacheEntries = 1000
+
 type cacheMetrics struct {
 	requests          prometheus.Counter
 	collectionBytes   prometheus.Gauge
@@ -130,6 +151,12 @@ type cachedPermission struct {
 	expire time.Time
 }
 
+type cachedS3AccessKey struct {
+	expire time.Time
+	s3key  arvados.S3AccessKey
+	aca    arvados.APIClientAuthorization
+}
+
 type cachedSession struct {
 	expire time.Time
 	fs     atomic.Value
@@ -153,6 +180,22 @@ func (c *cache) setup() {
 	if err != nil {
 		panic(err)
 	}
+	c.checksums, err = lru.New2Q(s3ChecksumCacheEntries)
+	if err != nil {
+		panic(err)
+	}
+	c.versions, err = lru.New2Q(c.config.MaxUUIDEntries)
+	if err != nil {
+		panic(err)
+	}
+	c.listings, err = lru.New2Q(s3ListingCacheEntries)
+	if err != nil {
+		panic(err)
+	}
+	c.s3keys, err = lru.New2Q(s3AccessKeyCacheEntries)
+	if err != nil {
+		panic(err)
+	}
 
 	reg := c.registry
 	if reg == nil {
@@ -203,6 +246,78 @@ func (c *cache) Update(client *arvados.Client, coll arvados.Collection, fs arvad
 	return err
 }
 
+// GetS3Checksums returns the cached checksums for the file content
+// with the given key (see setS3ChecksumHeaders), if any.
+func (c *cache) GetS3Checksums(key string) (s3Checksums, bool) {
+	c.setupOnce.Do(c.setup)
+	ent, ok := c.checksums.Get(key)
+	if !ok {
+		return s3Checksums{}, false
+	}
+	return ent.(s3Checksums), true
+}
+
+// PutS3Checksums caches the checksums for the file content with the
+// given key. The key identifies the content itself, so entries never
+// become stale.
+func (c *cache) PutS3Checksums(key string, sums s3Checksums) {
+	c.setupOnce.Do(c.setup)
+	c.checksums.Add(key, sums)
+}
+
+// GetS3Listing returns the cached, sorted entries of the directory
+// with the given path in the collection with the given PDH, if any.
+//
+// The caller is responsible for checking that the client has
+// permission to read the collection.
+func (c *cache) GetS3Listing(pdh, path string) ([]os.FileInfo, bool) {
+	c.setupOnce.Do(c.setup)
+	ent, ok := c.listings.Get(pdh + "\000" + path)
+	if !ok {
+		return nil, false
+	}
+	return ent.([]os.FileInfo), true
+}
+
+// PutS3Listing caches the sorted entries of the directory with the
+// given path in the collection with the given PDH. The content of a
+// PDH never changes, so entries never become stale.
+func (c *cache) PutS3Listing(pdh, path string, fis []os.FileInfo) {
+	c.setupOnce.Do(c.setup)
+	c.listings.Add(pdh+"\000"+path, fis)
+}
+
+// GetS3AccessKey returns the cached access key record and token for
+// the controller-issued S3 access key with the given ID, if any.
+//
+// The caller is responsible for checking the access key's expiry
+// time.
+func (c *cache) GetS3AccessKey(key string) (arvados.S3AccessKey, arvados.APIClientAuthorization, bool) {
+	c.setupOnce.Do(c.setup)
+	ent, ok := c.s3keys.Get(key)
+	if !ok {
+		return arvados.S3AccessKey{}, arvados.APIClientAuthorization{}, false
+	}
+	if ent := ent.(*cachedS3AccessKey); time.Now().Before(ent.expire) {
+		return ent.s3key, ent.aca, true
+	}
+	c.s3keys.Remove(key)
+	return arvados.S3AccessKey{}, arvados.APIClientAuthorization{}, false
+}
+
+// PutS3AccessKey caches the access key record and token for the
+// controller-issued S3 access key with the given ID. Like other
+// token lookups, the entry expires after TTL, so a revoked key can
+// be used until then.
+func (c *cache) PutS3AccessKey(key string, s3key arvados.S3AccessKey, aca arvados.APIClientAuthorization) {
+	c.setupOnce.Do(c.setup)
+	c.s3keys.Add(key, &cachedS3AccessKey{
+		expire: time.Now().Add(time.Duration(c.config.TTL)),
+		s3key:  s3key,
+		aca:    aca,
+	})
+}
+
 // ResetSession unloads any potentially stale state. Should be called
 // after write operations, so subsequent reads don't return stale
 // data.
@@ -385,6 +500,52 @@ func (c *cache) Get(arv *arvadosclient.ArvadosClient, targetID string, forceRelo
 	return collection, nil
 }
 
+// GetVersion returns the given version of the collection with the
+// given UUID, as recorded in the collection's version history (see
+// current_version_uuid and version in the collections API).
+//
+// If the version does not exist, or the token does not have
+// permission to read it, GetVersion returns a 404 APIServerError, so
+// callers can handle it the same way as an error from Get.
+func (c *cache) GetVersion(arv *arvadosclient.ArvadosClient, uuid string, version int, forceReload bool) (*arvados.Collection, error) {
+	c.setupOnce.Do(c.setup)
+	key := fmt.Sprintf("%s\000%d", uuid, version)
+	if ent, cached := c.versions.Get(key); cached && !forceReload {
+		// The permission check is done by Get.
+		return c.Get(arv, ent.(string), forceReload)
+	}
+	c.metrics.apiCalls.Inc()
+	var resp arvados.CollectionList
+	err := arv.List("collections", arvadosclient.Dict{
+		"filters": [][]interface{}{
+			{"current_version_uuid", "=", uuid},
+			{"version", "=", version},
+		},
+		"include_old_versions": true,
+		"select":               []string{"uuid"},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Items) == 0 {
+		return nil, arvadosclient.APIServerError{
+			ServerAddress:     arv.ApiServer,
+			HttpStatusCode:    http.StatusNotFound,
+			HttpStatusMessage: fmt.Sprintf("collection %s version %d not found", uuid, version),
+		}
+	}
+	versionUUID := resp.Items[0].UUID
+	if versionUUID != uuid {
+		// Old versions are never modified, so this mapping
+		// won't change. (The current version is the
+		// collection itself, which gets a new version number
+		// the next time it is modified, so we don't cache
+		// that.)
+		c.versions.Add(key, versionUUID)
+	}
+	return c.Get(arv, versionUUID, forceReload)
+}
+
 // pruneCollections checks the total bytes occupied by manifest_text
 // in the collection cache and removes old entries as needed to bring
 // the total size down to CollectionBytes. It also deletes all expired
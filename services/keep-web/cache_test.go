@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
@@ -33,7 +34,7 @@ func (s *UnitSuite) TestCache(c *check.C) {
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, check.Equals, nil)
 
-	cache := newConfig(s.Config).Cache
+	cache := &newConfig(s.Config).Cache
 	cache.registry = prometheus.NewRegistry()
 
 	// Hit the same collection 5 times using the same token. Only
@@ -114,7 +115,7 @@ func (s *UnitSuite) TestCacheForceReloadByPDH(c *check.C) {
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, check.Equals, nil)
 
-	cache := newConfig(s.Config).Cache
+	cache := &newConfig(s.Config).Cache
 	cache.registry = prometheus.NewRegistry()
 
 	for _, forceReload := range []bool{false, true, false, true} {
@@ -134,7 +135,7 @@ func (s *UnitSuite) TestCacheForceReloadByUUID(c *check.C) {
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, check.Equals, nil)
 
-	cache := newConfig(s.Config).Cache
+	cache := &newConfig(s.Config).Cache
 	cache.registry = prometheus.NewRegistry()
 
 	for _, forceReload := range []bool{false, true, false, true} {
@@ -149,3 +150,26 @@ func (s *UnitSuite) TestCacheForceReloadByUUID(c *check.C) {
 		"pdh_hits 3",
 		"api_calls 3")
 }
+
+func (s *UnitSuite) TestCacheS3AccessKey(c *check.C) {
+	cache := &newConfig(s.Config).Cache
+	cache.registry = prometheus.NewRegistry()
+
+	_, _, ok := cache.GetS3AccessKey("AKIAEXAMPLE1")
+	c.Check(ok, check.Equals, false)
+
+	s3key := arvados.S3AccessKey{AccessKeyID: "AKIAEXAMPLE1", TokenUUID: "zzzzz-gj3su-000000000000001"}
+	aca := arvados.APIClientAuthorization{UUID: "zzzzz-gj3su-000000000000001", APIToken: "secret1"}
+	cache.PutS3AccessKey("AKIAEXAMPLE1", s3key, aca)
+	gotKey, gotACA, ok := cache.GetS3AccessKey("AKIAEXAMPLE1")
+	c.Check(ok, check.Equals, true)
+	c.Check(gotKey, check.DeepEquals, s3key)
+	c.Check(gotACA, check.DeepEquals, aca)
+
+	// Entries expire after TTL.
+	cache.config.TTL = arvados.Duration(-time.Second)
+	cache.PutS3AccessKey("AKIAEXAMPLE2", s3key, aca)
+	_, _, ok = cache.GetS3AccessKey("AKIAEXAMPLE2")
+	c.Check(ok, check.Equals, false)
+	c.Check(cache.s3keys.Contains("AKIAEXAMPLE2"), check.Equals, false)
+}
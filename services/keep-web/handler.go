@@ -5,10 +5,15 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html"
 	"html/template"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,6 +22,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
@@ -36,6 +42,8 @@ type handler struct {
 	setupOnce     sync.Once
 	healthHandler http.Handler
 	webdavLS      webdav.LockSystem
+	webdavLocks   *lockSystemSet
+	tracer        *tracer
 }
 
 // parseCollectionIDFromDNSName returns a UUID or PDH if s begins with
@@ -78,6 +86,16 @@ func parseCollectionIDFromURL(s string) string {
 	return ""
 }
 
+// parseCollectionVersion returns the collection version number given
+// in a "v=N" path segment or "version=N" query parameter.
+func parseCollectionVersion(s string) (int, error) {
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid collection version %q", s)
+	}
+	return version, nil
+}
+
 func (h *handler) setup() {
 	// Errors will be handled at the client pool.
 	arv, _ := arvados.NewClientFromConfig(h.Config.cluster)
@@ -91,9 +109,18 @@ func (h *handler) setup() {
 		Prefix: "/_health/",
 	}
 
-	// Even though we don't accept LOCK requests, every webdav
-	// handler must have a non-nil LockSystem.
+	// Every webdav handler must have a non-nil LockSystem. On
+	// hosts where locking is not enabled, LOCK requests succeed
+	// without actually locking anything.
 	h.webdavLS = &noLockSystem{}
+	h.webdavLocks = &lockSystemSet{
+		maxTimeout: h.Config.cluster.Collections.WebDAVLocks.MaxTimeout.Duration(),
+	}
+	if h.webdavLocks.maxTimeout <= 0 {
+		h.webdavLocks.maxTimeout = time.Hour
+	}
+
+	h.tracer = newTracer(h.Config.cluster.Collections.WebDAVTracing, ctxlog.FromContext(context.Background()))
 }
 
 func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
@@ -199,6 +226,13 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	r, span := h.tracer.startRequest(r)
+	defer func() {
+		span.SetAttribute("http.status_code", w.WroteStatus())
+		span.SetAttribute("http.response_bytes", w.WroteBodyBytes())
+		span.End(nil)
+	}()
+
 	if method := r.Header.Get("Access-Control-Request-Method"); method != "" && r.Method == "OPTIONS" {
 		if !browserMethod[method] && !webdavMethod[method] {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -216,6 +250,11 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accessRule := h.accessRule(r.Host, r.URL.Path)
+	if !h.checkAccessRules(w, r, accessRule) {
+		return
+	}
+
 	if r.Header.Get("Origin") != "" {
 		// Allow simple cross-origin requests without user
 		// credentials ("user credentials" as defined by CORS,
@@ -285,6 +324,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		http.Error(w, notFoundMessage, http.StatusNotFound)
 		return
 	}
+	span.SetAttribute("arvados.collection_id", collectionID)
 
 	forceReload := false
 	if cc := r.Header.Get("Cache-Control"); strings.Contains(cc, "no-cache") || strings.Contains(cc, "must-revalidate") {
@@ -326,6 +366,13 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if useSiteFS && r.URL.Path == "/" && r.Method == "GET" &&
+		h.Config.cluster.Collections.WebDAVLandingPage &&
+		r.Host != "" && r.Host == h.Config.cluster.Services.WebDAVDownload.ExternalURL.Host {
+		h.serveLandingPage(w, r, reqTokens)
+		return
+	}
+
 	if useSiteFS {
 		h.serveSiteFS(w, r, reqTokens, credentialsOK, attachment)
 		return
@@ -345,8 +392,32 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		stripParts++
 	}
 
+	// Requests can be pinned to a specific version of a
+	// collection, either with a "v=N" path segment
+	// (http://ID.example/v=N/PATH..., /c=ID/v=N/PATH...) or
+	// with a "version=N" query parameter.
+	var version int
+	var versionErr error
+	if len(targetPath) > 0 && strings.HasPrefix(targetPath[0], "v=") {
+		version, versionErr = parseCollectionVersion(targetPath[0][2:])
+		targetPath = targetPath[1:]
+		stripParts++
+	} else if v := r.URL.Query().Get("version"); v != "" {
+		version, versionErr = parseCollectionVersion(v)
+	}
+	if versionErr != nil {
+		http.Error(w, versionErr.Error(), http.StatusBadRequest)
+		return
+	} else if version > 0 && arvadosclient.PDHMatch(collectionID) {
+		http.Error(w, "cannot select a version of a collection specified by portable data hash", http.StatusBadRequest)
+		return
+	}
+
 	if tokens == nil {
-		tokens = append(reqTokens, h.Config.cluster.Users.AnonymousUserToken)
+		tokens = reqTokens
+		if accessRule == nil || accessRule.AllowAnonymous {
+			tokens = append(tokens, h.Config.cluster.Users.AnonymousUserToken)
+		}
 	}
 
 	if len(targetPath) > 0 && targetPath[0] == "_" {
@@ -355,7 +426,8 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		// //collections.example/_/t=foo/ or
 		// //collections.example/_/_/ respectively:
 		// //collections.example/t=foo/ won't work because
-		// t=foo will be interpreted as a token "foo".
+		// t=foo will be interpreted as a token "foo". The same
+		// goes for a directory called "v=N".
 		targetPath = targetPath[1:]
 		stripParts++
 	}
@@ -369,9 +441,17 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 
 	var collection *arvados.Collection
 	tokenResult := make(map[string]int)
+	lookupCtx, lookupSpan := startSpan(r.Context(), "token lookup")
+	lookupSpan.SetAttribute("tokens", len(tokens))
 	for _, arv.ApiToken = range tokens {
+		_, fetchSpan := startSpan(lookupCtx, "collection fetch")
 		var err error
-		collection, err = h.Config.Cache.Get(arv, collectionID, forceReload)
+		if version > 0 {
+			collection, err = h.Config.Cache.GetVersion(arv, collectionID, version, forceReload)
+		} else {
+			collection, err = h.Config.Cache.Get(arv, collectionID, forceReload)
+		}
+		fetchSpan.End(err)
 		if err == nil {
 			// Success
 			break
@@ -386,9 +466,12 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			}
 		}
 		// Something more serious is wrong
+		lookupSpan.End(err)
 		http.Error(w, "cache error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	lookupSpan.SetAttribute("found", collection != nil)
+	lookupSpan.End(nil)
 	if collection == nil {
 		if pathToken || !credentialsOK {
 			// Either the URL is a "secret sharing link"
@@ -427,6 +510,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 	kc.RequestID = r.Header.Get("X-Request-Id")
+	kc.HedgeDelay = h.Config.cluster.Collections.WebDAVHedgeDelay.Duration()
 
 	var basename string
 	if len(targetPath) > 0 {
@@ -440,7 +524,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		Insecure:  arv.ApiInsecure,
 	}).WithRequestID(r.Header.Get("X-Request-Id"))
 
-	fs, err := collection.FileSystem(client, kc)
+	fs, err := collection.FileSystem(client, &tracingKeepClient{KeepClient: kc, ctx: r.Context()})
 	if err != nil {
 		http.Error(w, "error creating collection filesystem: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -448,7 +532,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 
 	writefs, writeOK := fs.(arvados.CollectionFileSystem)
 	targetIsPDH := arvadosclient.PDHMatch(collectionID)
-	if (targetIsPDH || !writeOK) && writeMethod[r.Method] {
+	if (targetIsPDH || version > 0 || !writeOK) && writeMethod[r.Method] {
 		http.Error(w, errReadOnly.Error(), http.StatusMethodNotAllowed)
 		return
 	}
@@ -473,19 +557,21 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 				writing:       writeMethod[r.Method],
 				alwaysReadEOF: r.Method == "PROPFIND",
 			},
-			LockSystem: h.webdavLS,
+			LockSystem: h.lockSystem(r.Host, collectionID),
 			Logger: func(_ *http.Request, err error) {
 				if err != nil {
 					ctxlog.FromContext(r.Context()).WithError(err).Error("error reported by webdav handler")
 				}
 			},
 		}
+		_, respSpan := startSpan(r.Context(), "response")
 		h.ServeHTTP(w, r)
+		respSpan.End(nil)
 		return
 	}
 
 	openPath := "/" + strings.Join(targetPath, "/")
-	if f, err := fs.Open(openPath); os.IsNotExist(err) {
+	if f, err := fs.OpenFileContext(r.Context(), openPath, os.O_RDONLY, 0); os.IsNotExist(err) {
 		// Requested non-existent path
 		http.Error(w, notFoundMessage, http.StatusNotFound)
 	} else if err != nil {
@@ -501,10 +587,27 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		// "dirname/fnm".
 		h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
 	} else if stat.IsDir() {
+		_, respSpan := startSpan(r.Context(), "response")
 		h.serveDirectory(w, r, collection.Name, fs, openPath, true)
+		respSpan.End(nil)
 	} else {
-		http.ServeContent(w, r, basename, stat.ModTime(), f)
-		if wrote := int64(w.WroteBodyBytes()); wrote != stat.Size() && r.Header.Get("Range") == "" {
+		if collection.PortableDataHash != "" {
+			// Setting a strong ETag lets ServeContent
+			// honor "If-Range: <etag>" requests.
+			w.Header().Set("ETag", fileETag(collection.PortableDataHash, openPath))
+		}
+		public := arv.ApiToken != "" && arv.ApiToken == h.Config.cluster.Users.AnonymousUserToken
+		w.Header().Set("Cache-Control", cacheControl(h.Config.cluster.Collections.WebDAVCacheControl, targetIsPDH || version > 0, public))
+		_, respSpan := startSpan(r.Context(), "response")
+		respSpan.SetAttribute("file.size", stat.Size())
+		if r.Method == "HEAD" {
+			serveHead(w, r, basename, stat.ModTime(), f)
+		} else {
+			http.ServeContent(w, r, basename, stat.ModTime(), f)
+		}
+		respSpan.SetAttribute("http.response_bytes", w.WroteBodyBytes())
+		respSpan.End(nil)
+		if wrote := int64(w.WroteBodyBytes()); wrote != stat.Size() && r.Header.Get("Range") == "" && r.Method != "HEAD" {
 			// If we wrote fewer bytes than expected, it's
 			// too late to change the real response code
 			// or send an error message to the client, but
@@ -517,6 +620,15 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// lockSystem returns the webdav lock system to use for the given
+// collection when it is accessed via the given Host.
+func (h *handler) lockSystem(host, collectionID string) webdav.LockSystem {
+	if !webdavLockingHost(h.Config.cluster.Collections.WebDAVLocks.Hosts, host) {
+		return h.webdavLS
+	}
+	return h.webdavLocks.get(collectionID, time.Now())
+}
+
 func (h *handler) getClients(reqID, token string) (arv *arvadosclient.ArvadosClient, kc *keepclient.KeepClient, client *arvados.Client, release func(), err error) {
 	arv = h.clientPool.Get()
 	if arv == nil {
@@ -531,6 +643,7 @@ func (h *handler) getClients(reqID, token string) (arv *arvadosclient.ArvadosCli
 		return
 	}
 	kc.RequestID = reqID
+	kc.HedgeDelay = h.Config.cluster.Collections.WebDAVHedgeDelay.Duration()
 	client = (&arvados.Client{
 		APIHost:   arv.ApiServer,
 		AuthToken: arv.ApiToken,
@@ -549,13 +662,15 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		http.Error(w, errReadOnly.Error(), http.StatusMethodNotAllowed)
 		return
 	}
+	_, lookupSpan := startSpan(r.Context(), "token lookup")
 	fs, err := h.Config.Cache.GetSession(tokens[0])
+	lookupSpan.End(err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	fs.ForwardSlashNameSubstitution(h.Config.cluster.Collections.ForwardSlashNameSubstitution)
-	f, err := fs.Open(r.URL.Path)
+	f, err := fs.OpenFileContext(r.Context(), r.URL.Path, os.O_RDONLY, 0)
 	if os.IsNotExist(err) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -564,7 +679,8 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		return
 	}
 	defer f.Close()
-	if fi, err := f.Stat(); err == nil && fi.IsDir() && r.Method == "GET" {
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() && r.Method == "GET" {
 		if !strings.HasSuffix(r.URL.Path, "/") {
 			h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
 		} else {
@@ -576,6 +692,14 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		_, basename := filepath.Split(r.URL.Path)
 		applyContentDispositionHdr(w, r, basename, attachment)
 	}
+	if err == nil && !fi.IsDir() && (r.Method == "GET" || r.Method == "HEAD") {
+		// Files under /by_id/{pdh}/ are immutable. The
+		// session token is never the anonymous token, so
+		// responses are always private.
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+		immutable := len(parts) == 3 && parts[0] == "by_id" && arvadosclient.PDHMatch(parts[1])
+		w.Header().Set("Cache-Control", cacheControl(h.Config.cluster.Collections.WebDAVCacheControl, immutable, false))
+	}
 	wh := webdav.Handler{
 		Prefix: "/",
 		FileSystem: &webdavFS{
@@ -726,6 +850,73 @@ func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, collect
 	})
 }
 
+// fileETag returns a strong ETag for the file at the given path in a
+// collection. A collection's content cannot change without changing
+// its portable data hash, so the ETag changes whenever the file
+// content might have changed.
+func fileETag(pdh, path string) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum([]byte(pdh+path)))
+}
+
+// cacheControl returns the Cache-Control header to send with a file
+// from a collection. If immutable is true, the collection was
+// addressed by portable data hash or pinned to a specific version, so
+// the file content can never change. If public is true, the file was
+// retrieved using the anonymous token, so shared caches may store it.
+//
+// Files that might change are cached only for MutableMaxAge (by
+// default, clients must revalidate them using the ETag before each
+// use).
+func cacheControl(cfg arvados.WebDAVCacheControlConfig, immutable, public bool) string {
+	scope := "private"
+	if public {
+		scope = "public"
+	}
+	if maxAge := cfg.ImmutableMaxAge.Duration(); immutable && maxAge > 0 {
+		return fmt.Sprintf("%s, max-age=%d, immutable", scope, int64(maxAge.Seconds()))
+	}
+	if maxAge := cfg.MutableMaxAge.Duration(); maxAge > 0 {
+		return fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge.Seconds()))
+	}
+	return scope + ", no-cache"
+}
+
+// errHeadRead is returned by headFile's Read method.
+var errHeadRead = errors.New("reading file data is not needed to respond to a HEAD request")
+
+// headFile is a file being served in response to a HEAD request. It
+// can seek (which ServeContent uses to find the file size) but
+// refuses to read, so a HEAD request never causes file data to be
+// fetched from Keep.
+type headFile struct {
+	io.Seeker
+}
+
+func (headFile) Read([]byte) (int, error) {
+	return 0, errHeadRead
+}
+
+// serveHead responds to a HEAD request for the given file using
+// only metadata (size, modification time, and any ETag already set
+// in the response headers).
+//
+// The Content-Type is determined by the file name extension. If the
+// extension doesn't indicate a type, the Content-Type header is
+// omitted instead of reading the start of the file to detect it, as
+// ServeContent would otherwise do.
+func serveHead(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, f io.Seeker) {
+	if _, ok := w.Header()["Content-Type"]; !ok {
+		if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		} else {
+			// A nil value stops ServeContent from
+			// sniffing, and is not sent.
+			w.Header()["Content-Type"] = nil
+		}
+	}
+	http.ServeContent(w, r, name, modtime, headFile{f})
+}
+
 func applyContentDispositionHdr(w http.ResponseWriter, r *http.Request, filename string, isAttachment bool) {
 	disposition := "inline"
 	if isAttachment {
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -16,6 +17,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -41,6 +43,87 @@ func (s *UnitSuite) SetUpTest(c *check.C) {
 	s.Config = cfg
 }
 
+// seekOnlyFile can seek, but fails the test if anything tries to
+// read it.
+type seekOnlyFile struct {
+	c    *check.C
+	size int64
+	pos  int64
+}
+
+func (f *seekOnlyFile) Read([]byte) (int, error) {
+	f.c.Error("unexpected Read")
+	return 0, io.EOF
+}
+
+func (f *seekOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.pos = f.size + offset
+	}
+	return f.pos, nil
+}
+
+func (s *UnitSuite) TestServeHead(c *check.C) {
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, trial := range []struct {
+		name        string
+		reqHeader   http.Header
+		status      int
+		contentType string
+		length      string
+	}{
+		{"foo.txt", nil, http.StatusOK, "text/plain; charset=utf-8", "12345"},
+		{"foo", nil, http.StatusOK, "", "12345"},
+		{"foo", http.Header{"Range": {"bytes=10-19"}}, http.StatusPartialContent, "", "10"},
+		{"foo", http.Header{"Range": {"bytes=10-19,30-39"}}, http.StatusPartialContent, "multipart/byteranges; .*", ""},
+		{"foo", http.Header{"If-None-Match": {`"abc"`}}, http.StatusNotModified, "", ""},
+		{"foo", http.Header{"If-Match": {`"def"`}}, http.StatusPreconditionFailed, "", ""},
+		{"foo", http.Header{"If-Modified-Since": {modtime.Format(http.TimeFormat)}}, http.StatusNotModified, "", ""},
+	} {
+		c.Logf("%+v", trial)
+		req := httptest.NewRequest("HEAD", "http://example/"+trial.name, nil)
+		for k, v := range trial.reqHeader {
+			req.Header[k] = v
+		}
+		resp := httptest.NewRecorder()
+		resp.Header().Set("ETag", `"abc"`)
+		serveHead(resp, req, trial.name, modtime, &seekOnlyFile{c: c, size: 12345})
+		c.Check(resp.Code, check.Equals, trial.status)
+		c.Check(resp.Body.Len(), check.Equals, 0)
+		c.Check(resp.Header().Get("Content-Type"), check.Matches, trial.contentType)
+		if trial.length != "" {
+			c.Check(resp.Header().Get("Content-Length"), check.Equals, trial.length)
+		}
+		if trial.status == http.StatusOK {
+			c.Check(resp.Header().Get("Last-Modified"), check.Equals, modtime.Format(http.TimeFormat))
+		}
+	}
+}
+
+func (s *UnitSuite) TestCacheControl(c *check.C) {
+	cfg := arvados.WebDAVCacheControlConfig{ImmutableMaxAge: arvados.Duration(24 * time.Hour)}
+	c.Check(cacheControl(cfg, true, true), check.Equals, "public, max-age=86400, immutable")
+	c.Check(cacheControl(cfg, true, false), check.Equals, "private, max-age=86400, immutable")
+	c.Check(cacheControl(cfg, false, true), check.Equals, "public, no-cache")
+	c.Check(cacheControl(cfg, false, false), check.Equals, "private, no-cache")
+
+	cfg.MutableMaxAge = arvados.Duration(time.Minute)
+	c.Check(cacheControl(cfg, false, true), check.Equals, "public, max-age=60")
+
+	// With ImmutableMaxAge disabled, PDH-addressed content is
+	// cached like UUID-addressed content.
+	cfg.ImmutableMaxAge = 0
+	c.Check(cacheControl(cfg, true, false), check.Equals, "private, max-age=60")
+
+	// Default config
+	c.Check(cacheControl(s.Config.Clusters["zzzzz"].Collections.WebDAVCacheControl, true, false), check.Equals, "private, max-age=31536000, immutable")
+}
+
 func (s *UnitSuite) TestCORSPreflight(c *check.C) {
 	h := handler{Config: newConfig(s.Config)}
 	u := mustParseURL("http://keep-web.example/c=" + arvadostest.FooCollection + "/foo")
@@ -390,6 +473,45 @@ func (s *IntegrationSuite) TestPastCollectionVersionFileAccess(c *check.C) {
 	c.Check(resp.Header().Get("Content-Disposition"), check.Matches, "attachment(;.*)?")
 }
 
+func (s *IntegrationSuite) TestPinnedCollectionVersion(c *check.C) {
+	s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "download.example.com"
+	for _, trial := range []struct {
+		method string
+		uri    string
+		status int
+		body   string
+	}{
+		{"GET", "download.example.com/c=" + arvadostest.WazCollection + "/v=1/waz", http.StatusOK, "waz"},
+		{"GET", "download.example.com/c=" + arvadostest.WazCollection + "/waz?version=1", http.StatusOK, "waz"},
+		{"GET", arvadostest.WazCollection + ".example.com/v=1/waz", http.StatusOK, "waz"},
+		{"GET", "download.example.com/c=" + arvadostest.WazCollection + "/v=1/w%20a%20z", http.StatusNotFound, ""},
+		{"GET", "download.example.com/c=" + arvadostest.WazCollection + "/v=3/waz", http.StatusNotFound, ""},
+		{"GET", "download.example.com/c=" + arvadostest.WazCollection + "/v=0/waz", http.StatusBadRequest, ""},
+		{"GET", "download.example.com/c=" + arvadostest.WazCollection + "/waz?version=x", http.StatusBadRequest, ""},
+		{"GET", "download.example.com/c=" + arvadostest.FooCollectionPDH + "/v=1/foo", http.StatusBadRequest, ""},
+		{"PUT", "download.example.com/c=" + arvadostest.WazCollection + "/v=1/newfile", http.StatusMethodNotAllowed, ""},
+	} {
+		comment := check.Commentf("%s %s", trial.method, trial.uri)
+		u := mustParseURL("http://" + trial.uri)
+		req := &http.Request{
+			Method:     trial.method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + arvadostest.ActiveToken},
+			},
+			Body: ioutil.NopCloser(&bytes.Buffer{}),
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status, comment)
+		if trial.body != "" {
+			c.Check(resp.Body.String(), check.Equals, trial.body, comment)
+		}
+	}
+}
+
 func (s *IntegrationSuite) TestVhostRedirectQueryTokenTrustAllContent(c *check.C) {
 	s.testServer.Config.cluster.Collections.TrustAllContent = true
 	s.testVhostRedirectTokenToCookie(c, "GET",
@@ -994,11 +1116,37 @@ func (s *IntegrationSuite) TestFileContentType(c *check.C) {
 		resp := httptest.NewRecorder()
 		s.testServer.Handler.ServeHTTP(resp, req)
 		c.Check(resp.Code, check.Equals, http.StatusOK)
-		c.Check(resp.Header().Get("Content-Type"), check.Equals, trial.contentType)
+		c.Check(resp.Header().Get("Content-Type"), check.Matches, trial.contentType)
 		c.Check(resp.Body.String(), check.Equals, trial.content)
 	}
 }
 
+func (s *IntegrationSuite) TestCacheControlHeaders(c *check.C) {
+	s.testServer.Config.cluster.Users.AnonymousUserToken = arvadostest.AnonymousToken
+	for _, trial := range []struct {
+		path   string
+		token  string
+		expect string
+	}{
+		{"/c=" + arvadostest.FooCollectionPDH + "/foo", arvadostest.ActiveToken, "private, max-age=31536000, immutable"},
+		{"/c=" + arvadostest.FooCollection + "/foo", arvadostest.ActiveToken, "private, no-cache"},
+		{"/c=" + arvadostest.HelloWorldPdh + "/Hello%20world.txt", "", "public, max-age=31536000, immutable"},
+		{"/c=" + arvadostest.HelloWorldCollection + "/Hello%20world.txt", "", "public, no-cache"},
+		{"/by_id/" + arvadostest.FooCollectionPDH + "/foo", arvadostest.ActiveToken, "private, max-age=31536000, immutable"},
+		{"/by_id/" + arvadostest.FooCollection + "/foo", arvadostest.ActiveToken, "private, no-cache"},
+	} {
+		c.Logf("trial %+v", trial)
+		req := httptest.NewRequest("GET", "http://collections.example.com"+trial.path, nil)
+		if trial.token != "" {
+			req.Header.Set("Authorization", "Bearer "+trial.token)
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Cache-Control"), check.Equals, trial.expect)
+	}
+}
+
 func (s *IntegrationSuite) TestKeepClientBlockCache(c *check.C) {
 	s.testServer.Config.cluster.Collections.WebDAVCache.MaxBlockEntries = 42
 	c.Check(keepclient.DefaultBlockCache.MaxBlocks, check.Not(check.Equals), 42)
@@ -0,0 +1,216 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// Maximum number of recently modified collections shown on the
+// landing page.
+const landingPageRecentLimit = 20
+
+// Maximum number of favorite collections shown on the landing page.
+const landingPageFavoritesLimit = 100
+
+var landingCollectionSelect = []string{"uuid", "name", "portable_data_hash", "modified_at", "file_count", "file_size_total"}
+
+// landingPage is the data shown on the landing page (see
+// serveLandingPage).
+type landingPage struct {
+	User      arvados.User
+	Favorites []arvados.Collection
+	Recent    []arvados.Collection
+}
+
+// getLandingPage retrieves the user's favorite collections (those
+// with a "star" link from the user, as created by Workbench) and most
+// recently modified collections.
+func getLandingPage(arv *arvadosclient.ArvadosClient) (*landingPage, error) {
+	var page landingPage
+	err := arv.Call("GET", "users", "", "current", nil, &page.User)
+	if err != nil {
+		return nil, err
+	}
+
+	var links arvados.LinkList
+	err = arv.List("links", arvadosclient.Dict{
+		"filters": [][]interface{}{
+			{"link_class", "=", "star"},
+			{"tail_uuid", "=", page.User.UUID},
+			{"head_uuid", "is_a", "arvados#collection"},
+		},
+		"select": []string{"head_uuid"},
+		"limit":  landingPageFavoritesLimit,
+	}, &links)
+	if err != nil {
+		return nil, err
+	}
+	if len(links.Items) > 0 {
+		var uuids []string
+		for _, link := range links.Items {
+			uuids = append(uuids, link.HeadUUID)
+		}
+		var favorites arvados.CollectionList
+		err = arv.List("collections", arvadosclient.Dict{
+			"filters": [][]interface{}{{"uuid", "in", uuids}},
+			"select":  landingCollectionSelect,
+			"order":   []string{"name", "uuid"},
+			"limit":   len(uuids),
+		}, &favorites)
+		if err != nil {
+			return nil, err
+		}
+		page.Favorites = favorites.Items
+	}
+
+	var recent arvados.CollectionList
+	err = arv.List("collections", arvadosclient.Dict{
+		"select": landingCollectionSelect,
+		"order":  []string{"modified_at desc", "uuid"},
+		"limit":  landingPageRecentLimit,
+		"count":  "none",
+	}, &recent)
+	if err != nil {
+		return nil, err
+	}
+	page.Recent = recent.Items
+	return &page, nil
+}
+
+// serveLandingPage serves a list of the user's favorite and recently
+// modified collections, with links to browse them. It is used for
+// GET requests for "/" on the download/attachment host when
+// Collections.WebDAVLandingPage is enabled.
+//
+// The first of the given tokens that the API server accepts is used
+// to retrieve the lists.
+func (h *handler) serveLandingPage(w http.ResponseWriter, r *http.Request, tokens []string) {
+	if len(tokens) == 0 {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
+		http.Error(w, unauthorizedMessage, http.StatusUnauthorized)
+		return
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		http.Error(w, "client pool error: "+h.clientPool.Err().Error(), http.StatusInternalServerError)
+		return
+	}
+	defer h.clientPool.Put(arv)
+	arv.RequestID = r.Header.Get("X-Request-Id")
+
+	var page *landingPage
+	var err error
+	for _, arv.ApiToken = range tokens {
+		page, err = getLandingPage(arv)
+		if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusUnauthorized {
+			continue
+		}
+		break
+	}
+	if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusUnauthorized {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
+		http.Error(w, unauthorizedMessage, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "error getting collection lists: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	tmpl, err := template.New("landing").Funcs(template.FuncMap{
+		"timestamp": func(t time.Time) string {
+			return t.UTC().Format("2006-01-02 15:04:05")
+		},
+	}).Parse(landingPageTemplate)
+	if err != nil {
+		http.Error(w, "error parsing template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	tmpl.Execute(w, page)
+}
+
+var landingPageTemplate = `<!DOCTYPE HTML>
+<HTML><HEAD>
+  <META name="robots" content="NOINDEX">
+  <TITLE>Collections</TITLE>
+  <STYLE type="text/css">
+    body {
+      margin: 1.5em;
+    }
+    .footer p {
+      font-size: 82%;
+    }
+    table {
+      border-collapse: collapse;
+    }
+    td, th {
+      padding: .25em 1em .25em 0;
+      text-align: left;
+    }
+    td.num {
+      text-align: right;
+    }
+    td.id {
+      font-family: monospace;
+    }
+  </STYLE>
+</HEAD>
+<BODY>
+
+<H1>Collections</H1>
+
+<P>{{if .User.FullName}}Signed in as {{.User.FullName}} ({{.User.UUID}}).{{else}}Signed in as {{.User.UUID}}.{{end}}
+You can browse and download files from the collections listed below,
+or browse <A href="./users/">all projects</A> and
+<A href="./by_id/">collections by ID</A>.</P>
+
+{{define "collections"}}
+<TABLE>
+  <TR><TH>Name</TH><TH>Files</TH><TH>Bytes</TH><TH>Modified (UTC)</TH><TH>ID</TH></TR>
+{{range .}}
+  <TR>
+    <TD><A href="./c={{.UUID}}/">{{if .Name}}{{.Name}}{{else}}{{.UUID}}{{end}}</A></TD>
+    <TD class="num">{{.FileCount}}</TD>
+    <TD class="num">{{.FileSizeTotal}}</TD>
+    <TD>{{timestamp .ModifiedAt}}</TD>
+    <TD class="id">{{.UUID}}</TD>
+  </TR>
+{{end}}
+</TABLE>
+{{end}}
+
+<H2>Favorites</H2>
+
+{{if .Favorites}}
+{{template "collections" .Favorites}}
+{{else}}
+<P>(No favorite collections. Mark collections as favorites in Workbench to list them here.)</P>
+{{end}}
+
+<H2>Recently modified</H2>
+
+{{if .Recent}}
+{{template "collections" .Recent}}
+{{else}}
+<P>(No collections.)</P>
+{{end}}
+
+<HR noshade>
+<DIV class="footer">
+  <P>
+    About Arvados:
+    Arvados is a free and open source software bioinformatics platform.
+    To learn more, visit arvados.org.
+  </P>
+</DIV>
+
+</BODY>
+`
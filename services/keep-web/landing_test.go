@@ -0,0 +1,112 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"gopkg.in/check.v1"
+)
+
+// stubLandingAPI returns a fake API server that responds to the
+// requests made by getLandingPage, and a pointer to a slice of the
+// requests it receives ("METHOD /path filters").
+func stubLandingAPI(c *check.C, token string) (*httptest.Server, *[]string) {
+	var reqs []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		reqs = append(reqs, r.Method+" "+r.URL.Path+" "+r.Form.Get("filters"))
+		if r.Header.Get("Authorization") != "OAuth2 "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":["Not logged in"]}`))
+			return
+		}
+		var resp interface{}
+		switch {
+		case r.URL.Path == "/arvados/v1/users/current":
+			resp = arvados.User{UUID: "zzzzz-tpzed-000000000000000", FullName: "Test <User>"}
+		case r.URL.Path == "/arvados/v1/links":
+			resp = arvados.LinkList{Items: []arvados.Link{{HeadUUID: "zzzzz-4zz18-starredstarred1"}}}
+		case r.URL.Path == "/arvados/v1/collections" && strings.Contains(r.Form.Get("filters"), "uuid"):
+			resp = arvados.CollectionList{Items: []arvados.Collection{{UUID: "zzzzz-4zz18-starredstarred1", Name: "starred", FileCount: 3}}}
+		case r.URL.Path == "/arvados/v1/collections":
+			c.Check(r.Form.Get("order"), check.Equals, `["modified_at desc","uuid"]`)
+			resp = arvados.CollectionList{Items: []arvados.Collection{
+				{UUID: "zzzzz-4zz18-recentrecent0001", Name: "recent <1>"},
+				{UUID: "zzzzz-4zz18-recentrecent0002"},
+			}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return srv, &reqs
+}
+
+func (s *UnitSuite) TestLandingPage(c *check.C) {
+	apiStub, reqs := stubLandingAPI(c, "goodtoken")
+	defer apiStub.Close()
+
+	cluster, err := s.Config.GetCluster("")
+	c.Assert(err, check.IsNil)
+	cluster.TLS.Insecure = true
+	cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: strings.TrimPrefix(apiStub.URL, "https://")}
+	cluster.Services.WebDAVDownload.ExternalURL = arvados.URL{Scheme: "https", Host: "download.example"}
+	cluster.Collections.WebDAVLandingPage = true
+	s.Config.Clusters[cluster.ClusterID] = *cluster
+	h := handler{Config: newConfig(s.Config)}
+
+	do := func(method, host, path, token string) *httptest.ResponseRecorder {
+		*reqs = nil
+		req := httptest.NewRequest(method, "https://"+host+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := do("GET", "download.example", "/", "goodtoken")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	body := resp.Body.String()
+	c.Check(body, check.Matches, `(?ms).*Signed in as Test &lt;User&gt; \(zzzzz-tpzed-000000000000000\).*`)
+	c.Check(body, check.Matches, `(?ms).*Favorites.*href="\./c=zzzzz-4zz18-starredstarred1/">starred</A>.*Recently modified.*`)
+	c.Check(body, check.Matches, `(?ms).*Recently modified.*href="\./c=zzzzz-4zz18-recentrecent0001/">recent &lt;1&gt;</A>.*href="\./c=zzzzz-4zz18-recentrecent0002/">zzzzz-4zz18-recentrecent0002</A>.*`)
+	c.Check(*reqs, check.HasLen, 4)
+	if len(*reqs) == 4 {
+		c.Check((*reqs)[1], check.Matches, `GET /arvados/v1/links .*"tail_uuid","=","zzzzz-tpzed-000000000000000".*`)
+	}
+
+	// Token rejected by the API server
+	resp = do("GET", "download.example", "/", "badtoken")
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	c.Check(resp.Header().Get("WWW-Authenticate"), check.Equals, `Basic realm="collections"`)
+
+	// No token
+	resp = do("GET", "download.example", "/", "")
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	c.Check(*reqs, check.HasLen, 0)
+
+	// Other hosts, paths, and methods don't get the landing page
+	for _, trial := range []struct{ method, host, path string }{
+		{"GET", "collections.example", "/"},
+		{"GET", "download.example", "/users/"},
+		{"PROPFIND", "download.example", "/"},
+	} {
+		resp = do(trial.method, trial.host, trial.path, "goodtoken")
+		c.Check(resp.Body.String(), check.Not(check.Matches), `(?ms).*Recently modified.*`)
+	}
+
+	// Disabled by config
+	h.Config.cluster.Collections.WebDAVLandingPage = false
+	resp = do("GET", "download.example", "/", "goodtoken")
+	c.Check(resp.Body.String(), check.Not(check.Matches), `(?ms).*Recently modified.*`)
+}
@@ -6,6 +6,10 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 
@@ -92,3 +96,74 @@ func (s *IntegrationSuite) TestRanges(c *check.C) {
 		}
 	}
 }
+
+func (s *IntegrationSuite) TestIfRange(c *check.C) {
+	url := mustParseURL("http://" + arvadostest.FooCollection + ".collections.example.com/foo")
+	get := func(hdr http.Header) *httptest.ResponseRecorder {
+		hdr.Set("Authorization", "OAuth2 "+arvadostest.ActiveToken)
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, &http.Request{
+			Method:     "GET",
+			URL:        url,
+			Host:       url.Host,
+			RequestURI: url.RequestURI(),
+			Header:     hdr,
+		})
+		return resp
+	}
+
+	resp := get(http.Header{})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	etag := resp.Header().Get("Etag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}"`)
+
+	// matching ETag: range is honored
+	resp = get(http.Header{"Range": {"bytes=1-2"}, "If-Range": {etag}})
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "oo")
+
+	// stale ETag: whole file is returned
+	resp = get(http.Header{"Range": {"bytes=1-2"}, "If-Range": {`"0123456789abcdef0123456789abcdef"`}})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+
+	// If-None-Match uses the same ETag
+	resp = get(http.Header{"If-None-Match": {etag}})
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+}
+
+func (s *IntegrationSuite) TestMultipleRanges(c *check.C) {
+	url := mustParseURL("http://" + arvadostest.FooCollection + ".collections.example.com/foo")
+	resp := httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(resp, &http.Request{
+		Method:     "GET",
+		URL:        url,
+		Host:       url.Host,
+		RequestURI: url.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+			"Range":         {"bytes=2-2,0-0"},
+		},
+	})
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	mediatype, params, err := mime.ParseMediaType(resp.Header().Get("Content-Type"))
+	c.Assert(err, check.IsNil)
+	c.Check(mediatype, check.Equals, "multipart/byteranges")
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for _, expect := range []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 2-2/3", "o"},
+		{"bytes 0-0/3", "f"},
+	} {
+		part, err := mr.NextPart()
+		c.Assert(err, check.IsNil)
+		c.Check(part.Header.Get("Content-Range"), check.Equals, expect.contentRange)
+		body, err := ioutil.ReadAll(part)
+		c.Check(err, check.IsNil)
+		c.Check(string(body), check.Equals, expect.body)
+	}
+	_, err = mr.NextPart()
+	c.Check(err, check.Equals, io.EOF)
+}
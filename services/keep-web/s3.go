@@ -5,12 +5,17 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"net/http"
 	"net/url"
@@ -23,6 +28,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"github.com/AdRoll/goamz/s3"
 )
@@ -118,6 +124,14 @@ func s3signature(secretKey, scope, signedHeaders, stringToSign string) (string,
 	return hashdigest(hmac.New(sha256.New, key), stringToSign), nil
 }
 
+// s3region returns the region name to report to S3 clients.
+func (h *handler) s3region() string {
+	if r := h.Config.cluster.Collections.S3Region; r != "" {
+		return r
+	}
+	return h.Config.cluster.ClusterID
+}
+
 var v2tokenUnderscore = regexp.MustCompile(`^v2_[a-z0-9]{5}-gj3su-[a-z0-9]{15}_`)
 
 func unescapeKey(key string) string {
@@ -165,7 +179,13 @@ func (h *handler) checks3signature(r *http.Request) (string, error) {
 	var aca arvados.APIClientAuthorization
 	var secret string
 	var err error
-	if len(key) == 27 && key[5:12] == "-gj3su-" {
+	if arvados.IsS3AccessKeyID(key) {
+		// Access key was issued by controller, secret key is
+		// derived from the access key ID.
+		ctx := arvados.ContextWithAuthorization(r.Context(), "Bearer "+h.Config.cluster.SystemRootToken)
+		aca, err = h.s3AccessKeyToken(ctx, client, key)
+		secret = arvados.S3SecretAccessKey(h.Config.cluster.SystemRootToken, key)
+	} else if len(key) == 27 && key[5:12] == "-gj3su-" {
 		// Access key is the UUID of an Arvados token, secret
 		// key is the secret part.
 		ctx := arvados.ContextWithAuthorization(r.Context(), "Bearer "+h.Config.cluster.SystemRootToken)
@@ -195,6 +215,40 @@ func (h *handler) checks3signature(r *http.Request) (string, error) {
 	return aca.TokenV2(), nil
 }
 
+// s3AccessKeyToken returns the token that the given
+// controller-issued access key maps to, or an error if the key has
+// been revoked or has expired. Successful lookups are cached.
+func (h *handler) s3AccessKeyToken(ctx context.Context, client *arvados.Client, key string) (arvados.APIClientAuthorization, error) {
+	s3key, aca, ok := h.Config.Cache.GetS3AccessKey(key)
+	if !ok {
+		var links arvados.LinkList
+		err := client.RequestAndDecodeContext(ctx, &links, "GET", "arvados/v1/links", nil, arvados.ListOptions{
+			Limit: 1,
+			Count: "none",
+			Filters: []arvados.Filter{
+				{Attr: "link_class", Operator: "=", Operand: arvados.S3AccessKeyLinkClass},
+				{Attr: "name", Operator: "=", Operand: key},
+			},
+		})
+		if err != nil {
+			return aca, err
+		}
+		if len(links.Items) == 0 {
+			return aca, errors.New("access key not found")
+		}
+		s3key = arvados.S3AccessKeyFromLink(links.Items[0])
+		err = client.RequestAndDecodeContext(ctx, &aca, "GET", "arvados/v1/api_client_authorizations/"+s3key.TokenUUID, nil, nil)
+		if err != nil {
+			return aca, err
+		}
+		h.Config.Cache.PutS3AccessKey(key, s3key, aca)
+	}
+	if s3key.ExpiresAt != nil && s3key.ExpiresAt.Before(time.Now()) {
+		return arvados.APIClientAuthorization{}, fmt.Errorf("access key expired at %s", s3key.ExpiresAt.Format(time.RFC3339))
+	}
+	return aca, nil
+}
+
 func s3ErrorResponse(w http.ResponseWriter, s3code string, message string, resource string, code int) {
 	w.Header().Set("Content-Type", "application/xml")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -224,6 +278,75 @@ var SignatureDoesNotMatch = "SignatureDoesNotMatch"
 
 var reRawQueryIndicatesAPI = regexp.MustCompile(`^[a-z]+(&|$)`)
 
+// s3ETag returns an ETag for the file at fspath, based on its path,
+// size, and modification time, so it can be computed without reading
+// any data.
+//
+// It has a "-1" suffix, like the ETag of a multipart upload, so
+// clients don't mistake it for the MD5 hash of the file content.
+func s3ETag(fspath string, fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-1"`, md5.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", fspath, fi.Size(), fi.ModTime().UnixNano()))))
+}
+
+// s3Checksums holds the checksums of a file's content, base64
+// encoded as in x-amz-checksum-* headers.
+type s3Checksums struct {
+	SHA256 string
+	CRC32  string
+}
+
+// setS3ChecksumHeaders adds x-amz-checksum-sha256 and
+// x-amz-checksum-crc32 headers to the response, if the client asked
+// for them (x-amz-checksum-mode: ENABLED) and the whole file (not a
+// range) is being requested.
+//
+// Files larger than Collections.S3ChecksumMaxSize are skipped. The
+// checksums of other files are computed by reading the file, and
+// cached by content (the blocks and byte ranges the file consists
+// of), so they are shared by identical files in different
+// collections, and never become stale.
+func (h *handler) setS3ChecksumHeaders(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, fspath string, fi os.FileInfo) error {
+	if !strings.EqualFold(r.Header.Get("X-Amz-Checksum-Mode"), "ENABLED") ||
+		r.Header.Get("Range") != "" ||
+		fi.Size() > int64(h.Config.cluster.Collections.S3ChecksumMaxSize) {
+		return nil
+	}
+	f, err := fs.OpenFileContext(r.Context(), fspath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var cacheKey string
+	if f, ok := f.(interface{ ContentKey() (string, bool) }); ok {
+		if key, ok := f.ContentKey(); ok {
+			cacheKey = fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+		}
+	}
+	var sums s3Checksums
+	var ok bool
+	if cacheKey != "" {
+		sums, ok = h.Config.Cache.GetS3Checksums(cacheKey)
+	}
+	if !ok {
+		sha := sha256.New()
+		crc := crc32.NewIEEE()
+		_, err = io.Copy(io.MultiWriter(sha, crc), f)
+		if err != nil {
+			return fmt.Errorf("error computing checksum: %w", err)
+		}
+		sums = s3Checksums{
+			SHA256: base64.StdEncoding.EncodeToString(sha.Sum(nil)),
+			CRC32:  base64.StdEncoding.EncodeToString(crc.Sum(nil)),
+		}
+		if cacheKey != "" {
+			h.Config.Cache.PutS3Checksums(cacheKey, sums)
+		}
+	}
+	w.Header().Set("X-Amz-Checksum-Sha256", sums.SHA256)
+	w.Header().Set("X-Amz-Checksum-Crc32", sums.CRC32)
+	return nil
+}
+
 // serveS3 handles r and returns true if r is a request from an S3
 // client, otherwise it returns false.
 func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
@@ -234,6 +357,10 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, InvalidRequest, "malformed Authorization header", r.URL.Path, http.StatusUnauthorized)
 			return true
 		}
+		if arvados.IsS3AccessKeyID(split[0]) {
+			s3ErrorResponse(w, InvalidRequest, "access keys issued by controller require V4 signatures", r.URL.Path, http.StatusUnauthorized)
+			return true
+		}
 		token = unescapeKey(split[0])
 	} else if strings.HasPrefix(auth, s3SignAlgorithm+" ") {
 		t, err := h.checks3signature(r)
@@ -294,16 +421,17 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		} else if _, ok = r.URL.Query()["location"]; ok {
 			// GetBucketLocation
 			w.Header().Set("Content-Type", "application/xml")
+			w.Header().Set("X-Amz-Bucket-Region", h.s3region())
 			io.WriteString(w, xml.Header)
 			fmt.Fprintln(w, `<LocationConstraint><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`+
-				h.Config.cluster.ClusterID+
+				h.s3region()+
 				`</LocationConstraint></LocationConstraint>`)
 		} else if reRawQueryIndicatesAPI.MatchString(r.URL.RawQuery) {
 			// GetBucketWebsite ("GET /bucketid/?website"), GetBucketTagging, etc.
 			s3ErrorResponse(w, InvalidRequest, "API not supported", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
 		} else {
 			// ListObjects
-			h.s3list(bucketName, w, r, fs)
+			h.s3list(bucketName, w, r, fs, token)
 		}
 		return true
 	case r.Method == http.MethodGet || r.Method == http.MethodHead:
@@ -312,10 +440,11 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, InvalidRequest, "API not supported", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
 			return true
 		}
-		fi, err := fs.Stat(fspath)
+		fi, err := fs.StatContext(r.Context(), fspath)
 		if r.Method == "HEAD" && !objectNameGiven {
 			// HeadBucket
 			if err == nil && fi.IsDir() {
+				w.Header().Set("X-Amz-Bucket-Region", h.s3region())
 				w.WriteHeader(http.StatusOK)
 			} else if os.IsNotExist(err) {
 				s3ErrorResponse(w, NoSuchBucket, "The specified bucket does not exist.", r.URL.Path, http.StatusNotFound)
@@ -335,10 +464,27 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, NoSuchKey, "The specified key does not exist.", r.URL.Path, http.StatusNotFound)
 			return true
 		}
+		etag := s3ETag(fspath, fi)
+		w.Header().Set("ETag", etag)
+		if err := h.setS3ChecksumHeaders(w, r, fs, fspath, fi); err != nil {
+			s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+			return true
+		}
+		if r.Method == http.MethodHead {
+			// HeadObject
+			f, err := fs.OpenFileContext(r.Context(), fspath, os.O_RDONLY, 0)
+			if err != nil {
+				s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+				return true
+			}
+			defer f.Close()
+			serveHead(w, r, fi.Name(), fi.ModTime(), f)
+			return true
+		}
 		// shallow copy r, and change URL path
 		r := *r
 		r.URL.Path = fspath
-		http.FileServer(fs).ServeHTTP(w, &r)
+		http.FileServer(contextFS{ctx: r.Context(), fs: fs}).ServeHTTP(w, &r)
 		return true
 	case r.Method == http.MethodPut:
 		if reRawQueryIndicatesAPI.MatchString(r.URL.RawQuery) {
@@ -501,14 +647,53 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
-// Call fn on the given path (directory) and its contents, in
-// lexicographic order.
+// Directories with at least this many entries have their sorted
+// listings cached while a ListObjectsV2 request is paging through a
+// collection snapshot (see s3ListCursor).
+var s3ListingCacheMinEntries = 1000
+
+// s3KeyName returns the name of the given file or directory as it
+// appears in S3 keys. Directory names have a "/" appended, so that
+// sorting entries by s3KeyName puts them in the same order as the
+// keys of the files they contain.
+func s3KeyName(fi os.FileInfo) string {
+	if fi.IsDir() {
+		return fi.Name() + "/"
+	}
+	return fi.Name()
+}
+
+// readdirS3Order returns the entries of the given directory, sorted
+// by s3KeyName.
+func readdirS3Order(fs arvados.FileSystem, path string) ([]os.FileInfo, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool { return s3KeyName(fis[i]) < s3KeyName(fis[j]) })
+	return fis, nil
+}
+
+// Call fn on the given path (directory) and its contents, in S3 key
+// order (see s3KeyName). Directory contents are obtained by calling
+// readdir, which must return them in that order.
 //
 // If isRoot==true and path is not a directory, return nil.
 //
 // If fn returns filepath.SkipDir when called on a directory, don't
 // descend into that directory.
-func walkFS(fs arvados.CustomFileSystem, path string, isRoot bool, fn func(path string, fi os.FileInfo) error) error {
+//
+// If after is not empty, skip the entries (and don't descend into
+// the directories) whose paths and contents are all less than after,
+// so resuming a walk takes time proportional to the depth of after
+// rather than the number of preceding entries. fn is still called
+// on the directories that contain after.
+func walkFS(fs arvados.FileSystem, path string, isRoot bool, after string, readdir func(path string) ([]os.FileInfo, error), fn func(path string, fi os.FileInfo) error) error {
 	if isRoot {
 		fi, err := fs.Stat(path)
 		if os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
@@ -523,21 +708,22 @@ func walkFS(fs arvados.CustomFileSystem, path string, isRoot bool, fn func(path
 			return err
 		}
 	}
-	f, err := fs.Open(path)
+	fis, err := readdir(path)
 	if os.IsNotExist(err) && isRoot {
 		return nil
 	} else if err != nil {
 		return fmt.Errorf("open %q: %w", path, err)
 	}
-	defer f.Close()
 	if path == "/" {
 		path = ""
 	}
-	fis, err := f.Readdir(-1)
-	if err != nil {
-		return err
+	if after != "" {
+		start := sort.Search(len(fis), func(i int) bool { return path+"/"+s3KeyName(fis[i]) >= after })
+		if start > 0 && fis[start-1].IsDir() && strings.HasPrefix(after, path+"/"+s3KeyName(fis[start-1])) {
+			start--
+		}
+		fis = fis[start:]
 	}
-	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
 	for _, fi := range fis {
 		err = fn(path+"/"+fi.Name(), fi)
 		if err == filepath.SkipDir {
@@ -546,7 +732,7 @@ func walkFS(fs arvados.CustomFileSystem, path string, isRoot bool, fn func(path
 			return err
 		}
 		if fi.IsDir() {
-			err = walkFS(fs, path+"/"+fi.Name(), false, fn)
+			err = walkFS(fs, path+"/"+fi.Name(), false, after, readdir, fn)
 			if err != nil {
 				return err
 			}
@@ -555,17 +741,95 @@ func walkFS(fs arvados.CustomFileSystem, path string, isRoot bool, fn func(path
 	return nil
 }
 
+// s3ListCursor is the position of a ListObjectsV2 listing, encoded
+// in the continuation token returned with each truncated page.
+type s3ListCursor struct {
+	// PDH of the collection when the first page was requested.
+	// Subsequent pages list the same snapshot, even if the
+	// collection is modified in the meantime, and can use cached
+	// directory listings.
+	PDH string `json:"pdh,omitempty"`
+	// The first key to return on the next page.
+	Next string `json:"next"`
+}
+
+func (cur s3ListCursor) encode() string {
+	buf, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeS3ListCursor(token string) (cur s3ListCursor, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &cur)
+	if err == nil && cur.Next == "" {
+		err = errors.New("missing position")
+	}
+	return
+}
+
+// s3ListSnapshot returns the current PDH of the given bucket, if it
+// is a collection, or "" if it is not or the PDH can't be retrieved.
+func (h *handler) s3ListSnapshot(r *http.Request, token, bucket string) string {
+	if arvadosclient.PDHMatch(bucket) {
+		return bucket
+	} else if !strings.Contains(bucket, "-4zz18-") {
+		return ""
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		ctxlog.FromContext(r.Context()).WithError(h.clientPool.Err()).Warn("error getting client for collection snapshot lookup")
+		return ""
+	}
+	defer h.clientPool.Put(arv)
+	arv.ApiToken = token
+	arv.RequestID = r.Header.Get("X-Request-Id")
+	var coll arvados.Collection
+	err := arv.Get("collections", bucket, selectPDH, &coll)
+	if err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Warn("error looking up collection snapshot; listing current content")
+		return ""
+	}
+	return coll.PortableDataHash
+}
+
 var errDone = errors.New("done")
 
-func (h *handler) s3list(bucket string, w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem) {
+func (h *handler) s3list(bucket string, w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, token string) {
 	var params struct {
 		delimiter string
-		marker    string
+		marker    string // first key to return
 		maxKeys   int
 		prefix    string
+
+		// ListObjectsV2
+		v2                bool
+		continuationToken string
+		startAfter        string
 	}
 	params.delimiter = r.FormValue("delimiter")
-	params.marker = r.FormValue("marker")
+	params.v2 = r.FormValue("list-type") == "2"
+	var snapshot string
+	if !params.v2 {
+		params.marker = r.FormValue("marker")
+	} else if params.continuationToken = r.FormValue("continuation-token"); params.continuationToken != "" {
+		cur, err := decodeS3ListCursor(params.continuationToken)
+		if err != nil {
+			s3ErrorResponse(w, InvalidArgument, "invalid continuation token: "+err.Error(), r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		params.marker = cur.Next
+		snapshot = cur.PDH
+	} else {
+		params.startAfter = r.FormValue("start-after")
+		if params.startAfter != "" {
+			// Unlike marker, start-after is exclusive.
+			params.marker = params.startAfter + "\x00"
+		}
+		snapshot = h.s3ListSnapshot(r, token, bucket)
+	}
 	if mk, _ := strconv.ParseInt(r.FormValue("max-keys"), 10, 64); mk > 0 && mk < s3MaxKeys {
 		params.maxKeys = int(mk)
 	} else {
@@ -574,6 +838,32 @@ func (h *handler) s3list(bucket string, w http.ResponseWriter, r *http.Request,
 	params.prefix = r.FormValue("prefix")
 
 	bucketdir := "by_id/" + bucket
+	readdir := func(path string) ([]os.FileInfo, error) {
+		return readdirS3Order(fs, path)
+	}
+	if snapshot != "" {
+		if fi, err := fs.Stat("by_id/" + snapshot); err != nil || !fi.IsDir() {
+			// The snapshot is no longer readable
+			// (perhaps the collection was modified and
+			// no other collection has the old content),
+			// so continue with the current content.
+			snapshot = ""
+		} else {
+			// Having checked that the client can read
+			// the snapshot, we can use cached listings.
+			bucketdir = "by_id/" + snapshot
+			readdir = func(path string) ([]os.FileInfo, error) {
+				if fis, ok := h.Config.Cache.GetS3Listing(snapshot, path); ok {
+					return fis, nil
+				}
+				fis, err := readdirS3Order(fs, path)
+				if err == nil && len(fis) >= s3ListingCacheMinEntries {
+					h.Config.Cache.PutS3Listing(snapshot, path, fis)
+				}
+				return fis, err
+			}
+		}
+	}
 	// walkpath is the directory (relative to bucketdir) we need
 	// to walk: the innermost directory that is guaranteed to
 	// contain all paths that have the requested prefix. Examples:
@@ -605,18 +895,36 @@ func (h *handler) s3list(bucket string, w http.ResponseWriter, r *http.Request,
 		NextMarker string `xml:"NextMarker,omitempty"`
 		// ListObjectsV2 has a KeyCount response field.
 		KeyCount int
+		// Other ListObjectsV2 fields.
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
 	}
 	resp := listResp{
 		ListResp: s3.ListResp{
 			Name:      bucket,
 			Prefix:    params.prefix,
 			Delimiter: params.delimiter,
-			Marker:    params.marker,
 			MaxKeys:   params.maxKeys,
 		},
 	}
+	if params.v2 {
+		resp.ContinuationToken = params.continuationToken
+		resp.StartAfter = params.startAfter
+	} else {
+		resp.Marker = params.marker
+	}
+	// Skip everything before the marker (or prefix) without
+	// walking it.
+	after := params.marker
+	if params.prefix > after {
+		after = params.prefix
+	}
+	if after != "" {
+		after = bucketdir + "/" + after
+	}
 	commonPrefixes := map[string]bool{}
-	err := walkFS(fs, strings.TrimSuffix(bucketdir+"/"+walkpath, "/"), true, func(path string, fi os.FileInfo) error {
+	err := walkFS(fs, strings.TrimSuffix(bucketdir+"/"+walkpath, "/"), true, after, readdir, func(path string, fi os.FileInfo) error {
 		if path == bucketdir {
 			return nil
 		}
@@ -678,7 +986,9 @@ func (h *handler) s3list(bucket string, w http.ResponseWriter, r *http.Request,
 		}
 		if len(resp.Contents)+len(commonPrefixes) >= params.maxKeys {
 			resp.IsTruncated = true
-			if params.delimiter != "" {
+			if params.v2 {
+				resp.NextContinuationToken = s3ListCursor{PDH: snapshot, Next: path}.encode()
+			} else if params.delimiter != "" {
 				resp.NextMarker = path
 			}
 			return errDone
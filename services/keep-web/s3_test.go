@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,6 +16,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -147,6 +149,64 @@ func (s *IntegrationSuite) TestS3Signatures(c *check.C) {
 	}
 }
 
+func (s *IntegrationSuite) TestS3AccessKeys(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	var key, expiredKey arvados.S3AccessKey
+	err := stage.arv.RequestAndDecode(&key, "POST", "arvados/v1/s3_access_keys", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(key.SecretAccessKey, check.Not(check.Equals), "")
+	err = stage.arv.RequestAndDecode(&expiredKey, "POST", "arvados/v1/s3_access_keys", nil, map[string]interface{}{
+		"s3_access_key": map[string]interface{}{
+			"expires_at": time.Now().Add(2 * time.Second).Format(time.RFC3339Nano),
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	bucket := stage.collbucket
+	for _, trial := range []struct {
+		success   bool
+		signature int
+		accesskey string
+		secretkey string
+	}{
+		{true, aws.V4Signature, key.AccessKeyID, key.SecretAccessKey},
+		{false, aws.V4Signature, key.AccessKeyID, "none"},
+		{false, aws.V4Signature, key.AccessKeyID, arvadostest.ActiveToken},
+		{false, aws.V4Signature, key.SecretAccessKey, key.SecretAccessKey},
+		{false, aws.V2Signature, key.AccessKeyID, key.SecretAccessKey},
+	} {
+		c.Logf("%#v", trial)
+		bucket.S3.Auth = *(aws.NewAuth(trial.accesskey, trial.secretkey, "", time.Now().Add(time.Hour)))
+		bucket.S3.Signature = trial.signature
+		_, err := bucket.GetReader("emptyfile")
+		if trial.success {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.NotNil)
+		}
+	}
+
+	// Expired key
+	time.Sleep(time.Until(*expiredKey.ExpiresAt))
+	bucket.S3.Auth = *(aws.NewAuth(expiredKey.AccessKeyID, expiredKey.SecretAccessKey, "", time.Now().Add(time.Hour)))
+	_, err = bucket.GetReader("emptyfile")
+	c.Check(err, check.NotNil)
+
+	// Revoked key: keep-web's cached lookup is still used until
+	// it expires (here, until we purge the cache).
+	var deleted arvados.S3AccessKey
+	err = stage.arv.RequestAndDecode(&deleted, "DELETE", "arvados/v1/s3_access_keys/"+key.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	bucket.S3.Auth = *(aws.NewAuth(key.AccessKeyID, key.SecretAccessKey, "", time.Now().Add(time.Hour)))
+	_, err = bucket.GetReader("emptyfile")
+	c.Check(err, check.IsNil)
+	s.testServer.Config.Cache.s3keys.Purge()
+	_, err = bucket.GetReader("emptyfile")
+	c.Check(err, check.NotNil)
+}
+
 func (s *IntegrationSuite) TestS3HeadBucket(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -156,6 +216,14 @@ func (s *IntegrationSuite) TestS3HeadBucket(c *check.C) {
 		exists, err := bucket.Exists("")
 		c.Check(err, check.IsNil)
 		c.Check(exists, check.Equals, true)
+
+		req, err := http.NewRequest("HEAD", bucket.URL("/"), nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+		c.Check(resp.Header.Get("X-Amz-Bucket-Region"), check.Equals, "zzzzz")
 	}
 }
 
@@ -203,6 +271,37 @@ func (s *IntegrationSuite) testS3GetObject(c *check.C, bucket *s3.Bucket, prefix
 	c.Check(err, check.IsNil)
 	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
 	c.Check(resp.ContentLength, check.Equals, int64(4))
+	c.Check(resp.Header.Get("Content-Type"), check.Matches, `text/plain.*`)
+	c.Check(resp.Header.Get("Last-Modified"), check.Not(check.Equals), "")
+	etag := resp.Header.Get("ETag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}-1"`)
+
+	// GetObject returns the same ETag
+	getResp, err := bucket.GetResponse(prefix + "sailboat.txt")
+	c.Assert(err, check.IsNil)
+	getResp.Body.Close()
+	c.Check(getResp.Header.Get("ETag"), check.Equals, etag)
+	c.Check(getResp.Header.Get("X-Amz-Checksum-Sha256"), check.Equals, "")
+
+	// Checksums are computed on request
+	for _, method := range []string{"HEAD", "GET"} {
+		var resp *http.Response
+		hdr := map[string][]string{"X-Amz-Checksum-Mode": {"ENABLED"}}
+		if method == "HEAD" {
+			resp, err = bucket.Head(prefix+"sailboat.txt", hdr)
+		} else {
+			resp, err = bucket.GetResponseWithHeaders(prefix+"sailboat.txt", hdr)
+		}
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		c.Check(resp.Header.Get("X-Amz-Checksum-Sha256"), check.Equals, "vSkmYYPeYPfwxDEJia0P9ibmWQeM7CGWHmbI8Y1gePE=")
+		c.Check(resp.Header.Get("X-Amz-Checksum-Crc32"), check.Equals, "1ROyXQ==")
+	}
+	s.testServer.Config.cluster.Collections.S3ChecksumMaxSize = 3
+	resp, err = bucket.Head(prefix+"sailboat.txt", map[string][]string{"X-Amz-Checksum-Mode": {"ENABLED"}})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Header.Get("X-Amz-Checksum-Sha256"), check.Equals, "")
+	s.testServer.Config.cluster.Collections.S3ChecksumMaxSize = 1 << 30
 
 	// HeadObject with superfluous leading slashes
 	exists, err = bucket.Exists(prefix + "//sailboat.txt")
@@ -596,6 +695,22 @@ func (s *IntegrationSuite) TestS3GetBucketLocation(c *check.C) {
 	}
 }
 
+func (s *IntegrationSuite) TestS3GetBucketLocationRegion(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testServer.Config.cluster.Collections.S3Region = "us-east-1"
+	req, err := http.NewRequest("GET", stage.collbucket.URL("/"), nil)
+	c.Check(err, check.IsNil)
+	req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+	req.URL.RawQuery = "location"
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Header.Get("X-Amz-Bucket-Region"), check.Equals, "us-east-1")
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Matches, `(?ms).*>us-east-1</LocationConstraint></LocationConstraint>\n`)
+}
+
 func (s *IntegrationSuite) TestS3GetBucketVersioning(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -752,6 +867,83 @@ func (s *IntegrationSuite) testS3List(c *check.C, bucket *s3.Bucket, prefix stri
 	c.Check(len(gotKeys), check.Equals, expectFiles)
 }
 
+// ListObjectsV2 pages through a snapshot of the collection taken when
+// the first page was requested.
+func (s *IntegrationSuite) TestS3ListObjectsV2(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	stage.writeBigDirs(c, 2, 150)
+
+	list := func(query url.Values) (keys []string, truncated bool, next string) {
+		req, err := http.NewRequest("GET", stage.collbucket.URL("/"), nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+		query.Set("list-type", "2")
+		req.URL.RawQuery = query.Encode()
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK, check.Commentf("%s", buf))
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		c.Assert(xml.Unmarshal(buf, &result), check.IsNil)
+		for _, k := range result.Contents {
+			keys = append(keys, k.Key)
+		}
+		return keys, result.IsTruncated, result.NextContinuationToken
+	}
+
+	var allKeys []string
+	token := ""
+	for pages := 0; pages < 10; pages++ {
+		query := url.Values{"max-keys": {"50"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		keys, truncated, next := list(query)
+		c.Check(len(keys) <= 50, check.Equals, true)
+		allKeys = append(allKeys, keys...)
+		if !truncated {
+			c.Check(next, check.Equals, "")
+			break
+		}
+		c.Assert(next, check.Not(check.Equals), "")
+		token = next
+		if pages == 0 {
+			err := stage.collbucket.PutReader("dir0/added", &bytes.Buffer{}, 0, "application/octet-stream", s3.Private, s3.Options{})
+			c.Assert(err, check.IsNil)
+		}
+	}
+	// emptyfile, sailboat.txt, and 2*150 files in dir0 and dir1,
+	// but not the file added after the first page.
+	c.Check(allKeys, check.HasLen, 302)
+	c.Check(sort.StringsAreSorted(allKeys), check.Equals, true)
+	for _, k := range allKeys {
+		c.Check(k, check.Not(check.Equals), "dir0/added")
+	}
+
+	// A new listing includes the added file.
+	keys, _, _ := list(url.Values{"prefix": {"dir0/a"}})
+	c.Check(keys, check.DeepEquals, []string{"dir0/added"})
+
+	// start-after is exclusive.
+	keys, _, _ = list(url.Values{"start-after": {"dir1/file98.txt"}})
+	c.Check(keys, check.DeepEquals, []string{"dir1/file99.txt", "emptyfile", "sailboat.txt"})
+
+	req, err := http.NewRequest("GET", stage.collbucket.URL("/")+"?list-type=2&continuation-token=bogus", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
 func (s *IntegrationSuite) TestS3CollectionListRollup(c *check.C) {
 	for _, s.testServer.Config.cluster.Collections.S3FolderObjects = range []bool{false, true} {
 		s.testS3CollectionListRollup(c)
@@ -913,3 +1105,63 @@ func (s *IntegrationSuite) TestS3BucketInHost(c *check.C) {
 	c.Check(hdr, check.Matches, `(?s)HTTP/1.1 200 OK\r\n.*`)
 	c.Check(body, check.Equals, "⛵\n")
 }
+
+func (s *UnitSuite) TestS3WalkFSResume(c *check.C) {
+	fs, err := (&arvados.Collection{}).FileSystem(arvados.NewClientFromEnv(), nil)
+	c.Assert(err, check.IsNil)
+	// "a" sorts before "a.txt" by name, but "a/..." keys sort
+	// after "a.txt".
+	for _, dir := range []string{"a", "a/b", "c"} {
+		c.Assert(fs.Mkdir(dir, 0755), check.IsNil)
+	}
+	var allFiles []string
+	for _, name := range []string{"a.txt", "a/b/x", "a/b/y", "a/z", "b", "c/d"} {
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		c.Assert(err, check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+		allFiles = append(allFiles, "/"+name)
+	}
+	var readdirs []string
+	readdir := func(path string) ([]os.FileInfo, error) {
+		readdirs = append(readdirs, path)
+		return readdirS3Order(fs, path)
+	}
+	walk := func(after string) (files []string) {
+		readdirs = nil
+		err := walkFS(fs, "/", true, after, readdir, func(path string, fi os.FileInfo) error {
+			if !fi.IsDir() && path >= after {
+				files = append(files, path)
+			}
+			return nil
+		})
+		c.Check(err, check.IsNil)
+		return
+	}
+
+	c.Check(walk(""), check.DeepEquals, allFiles)
+	c.Check(readdirs, check.DeepEquals, []string{"/", "/a", "/a/b", "/c"})
+
+	for i, after := range allFiles {
+		c.Check(walk(after), check.DeepEquals, allFiles[i:], check.Commentf("after %q", after))
+	}
+	// Resuming in "a/z" doesn't read "a/b".
+	walk("/a/z")
+	c.Check(readdirs, check.DeepEquals, []string{"/", "/a", "/c"})
+	// Resuming at "b" doesn't read "a" or its subdirectories.
+	walk("/b")
+	c.Check(readdirs, check.DeepEquals, []string{"/", "/c"})
+	// Resuming at "a/b0" (not an existing key) skips "a/b".
+	c.Check(walk("/a/b0"), check.DeepEquals, []string{"/a/z", "/b", "/c/d"})
+	c.Check(walk("/zzz"), check.HasLen, 0)
+}
+
+func (s *UnitSuite) TestS3ListCursor(c *check.C) {
+	cur := s3ListCursor{PDH: "d41d8cd98f00b204e9800998ecf8427e+0", Next: "dir0/file14.txt"}
+	got, err := decodeS3ListCursor(cur.encode())
+	c.Check(err, check.IsNil)
+	c.Check(got, check.Equals, cur)
+	for _, bad := range []string{"", "!!!", s3ListCursor{PDH: cur.PDH}.encode(), "e30"} {
+		_, err = decodeS3ListCursor(bad)
+		c.Check(err, check.NotNil, check.Commentf("%q", bad))
+	}
+}
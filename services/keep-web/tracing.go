@@ -0,0 +1,387 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/sirupsen/logrus"
+)
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+const (
+	traceQueueSize     = 1000
+	traceBatchSize     = 200
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+)
+
+// A tracer sends request trace spans to an OpenTelemetry collector,
+// using the OTLP/HTTP protocol with JSON encoding.
+//
+// Spans are queued and sent in batches by a background goroutine. If
+// the queue fills up (e.g., because the collector is slow or
+// unreachable), new spans are dropped rather than delaying requests.
+type tracer struct {
+	endpoint      string
+	sampleRate    float64
+	client        *http.Client
+	logger        logrus.FieldLogger
+	queue         chan *traceSpan
+	flushInterval time.Duration
+}
+
+// newTracer returns a tracer that sends spans to the configured
+// endpoint, or nil if tracing is not enabled.
+func newTracer(cfg arvados.WebDAVTracingConfig, logger logrus.FieldLogger) *tracer {
+	if cfg.Endpoint.String() == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint:      cfg.Endpoint.String(),
+		sampleRate:    cfg.SampleRate,
+		client:        &http.Client{Timeout: traceExportTimeout},
+		logger:        logger,
+		queue:         make(chan *traceSpan, traceQueueSize),
+		flushInterval: traceFlushInterval,
+	}
+	go t.run()
+	return t
+}
+
+// traceSpan is one timed operation within a traced request. All
+// methods are no-ops on a nil *traceSpan, so callers don't need to
+// check whether the request is being traced.
+type traceSpan struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+	mtx      sync.Mutex
+}
+
+type traceSpanKey struct{}
+
+// traceSpanFromContext returns the span stored in ctx by
+// startRequest or startSpan, or nil if the request is not being
+// traced.
+func traceSpanFromContext(ctx context.Context) *traceSpan {
+	span, _ := ctx.Value(traceSpanKey{}).(*traceSpan)
+	return span
+}
+
+// startRequest decides whether to trace the given request and, if
+// so, returns a copy of r whose context carries a new server span.
+//
+// If the request has a valid W3C traceparent header, the new span
+// joins that trace. Otherwise, the trace ID is derived from the
+// X-Request-Id header, so a trace can be found using the request ID
+// that appears in keep-web's logs.
+func (t *tracer) startRequest(r *http.Request) (*http.Request, *traceSpan) {
+	if t == nil {
+		return r, nil
+	}
+	reqID := r.Header.Get("X-Request-Id")
+	span := &traceSpan{
+		tracer: t,
+		name:   "keep-web " + r.Method,
+		kind:   spanKindServer,
+		start:  time.Now(),
+		attrs: map[string]interface{}{
+			"http.method":     r.Method,
+			"http.host":       r.Host,
+			"http.request_id": reqID,
+		},
+	}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		if !sampled {
+			return r, nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	} else if rand.Float64() >= t.sampleRate {
+		return r, nil
+	} else if reqID != "" {
+		span.traceID = md5.Sum([]byte(reqID))
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return r.WithContext(context.WithValue(r.Context(), traceSpanKey{}, span)), span
+}
+
+// startSpan starts a child of the span in ctx, and returns a context
+// carrying the new span. If ctx has no span, it returns ctx and a nil
+// span.
+func startSpan(ctx context.Context, name string) (context.Context, *traceSpan) {
+	parent := traceSpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &traceSpan{
+		tracer:   parent.tracer,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    time.Now(),
+		attrs:    map[string]interface{}{},
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, traceSpanKey{}, span), span
+}
+
+// SetAttribute attaches a key/value pair to the span. Values should
+// be strings, bools, or integers.
+func (s *traceSpan) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.attrs[key] = value
+}
+
+// End records the end time of the span (and err, if not nil) and
+// queues the span to be sent to the collector.
+func (s *traceSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mtx.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// Queue is full. Dropping spans is better than
+		// slowing down requests.
+	}
+}
+
+// parseTraceparent parses a W3C trace context header, e.g.,
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(s string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	var batch []*traceSpan
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := t.export(batch)
+		if err != nil {
+			t.logger.WithError(err).WithField("spans", len(batch)).Warn("error sending trace spans")
+		}
+		batch = nil
+	}
+}
+
+// export sends the given spans to the collector.
+func (t *tracer) export(spans []*traceSpan) error {
+	var otlpSpans []otlpSpan
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttribute("service.name", "keep-web"),
+			otlpAttribute("service.version", version),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "keep-web"},
+			Spans: otlpSpans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON encoding, see
+// https://github.com/open-telemetry/opentelemetry-proto
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 0=unset, 2=error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	switch v := value.(type) {
+	case bool:
+		return otlpKeyValue{key, map[string]interface{}{"boolValue": v}}
+	case int:
+		return otlpKeyValue{key, map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpKeyValue{key, map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+	default:
+		return otlpKeyValue{key, map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func (s *traceSpan) otlp() otlpSpan {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		span.Attributes = append(span.Attributes, otlpAttribute(k, v))
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return span
+}
+
+// tracingKeepClient wraps a KeepClient, adding a span to the
+// request trace the first time each block is read.
+type tracingKeepClient struct {
+	*keepclient.KeepClient
+	ctx  context.Context // request context, used if ReadAt's caller doesn't provide one
+	mtx  sync.Mutex
+	seen map[string]bool
+}
+
+func (kc *tracingKeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
+	return kc.ReadAtContext(kc.ctx, locator, p, off)
+}
+
+func (kc *tracingKeepClient) ReadAtContext(ctx context.Context, locator string, p []byte, off int) (int, error) {
+	spanctx := ctx
+	if traceSpanFromContext(spanctx) == nil {
+		spanctx = kc.ctx
+	}
+	if traceSpanFromContext(spanctx) == nil || len(locator) < 32 {
+		return kc.KeepClient.ReadAtContext(ctx, locator, p, off)
+	}
+	kc.mtx.Lock()
+	first := !kc.seen[locator[:32]]
+	if first {
+		if kc.seen == nil {
+			kc.seen = map[string]bool{}
+		}
+		kc.seen[locator[:32]] = true
+	}
+	kc.mtx.Unlock()
+	if !first {
+		return kc.KeepClient.ReadAtContext(ctx, locator, p, off)
+	}
+	_, span := startSpan(spanctx, "keep block read")
+	// Omit the permission signature from the recorded locator.
+	if parts := strings.SplitN(locator, "+", 3); len(parts) >= 2 {
+		span.SetAttribute("keep.locator", parts[0]+"+"+parts[1])
+	} else {
+		span.SetAttribute("keep.locator", parts[0])
+	}
+	n, err := kc.KeepClient.ReadAtContext(ctx, locator, p, off)
+	span.End(err)
+	return n, err
+}
@@ -0,0 +1,119 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestParseTraceparent(c *check.C) {
+	traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.Check(ok, check.Equals, true)
+	c.Check(sampled, check.Equals, true)
+	c.Check(fmt.Sprintf("%x", traceID), check.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(fmt.Sprintf("%x", parentID), check.Equals, "00f067aa0ba902b7")
+
+	_, _, sampled, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	c.Check(ok, check.Equals, true)
+	c.Check(sampled, check.Equals, false)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, _, _, ok = parseTraceparent(bad)
+		c.Check(ok, check.Equals, false, check.Commentf("%q", bad))
+	}
+}
+
+func (s *UnitSuite) TestTracerSampling(c *check.C) {
+	t := &tracer{sampleRate: 0, queue: make(chan *traceSpan, 10)}
+	req := httptest.NewRequest("GET", "http://keep-web.example/foo", nil)
+	_, span := t.startRequest(req)
+	c.Check(span, check.IsNil)
+
+	// A sampled traceparent overrides SampleRate.
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req, span = t.startRequest(req)
+	c.Assert(span, check.NotNil)
+	c.Check(fmt.Sprintf("%x", span.parentID), check.Equals, "00f067aa0ba902b7")
+	c.Check(traceSpanFromContext(req.Context()), check.Equals, span)
+
+	// Tracing disabled entirely.
+	t = nil
+	_, span = t.startRequest(req)
+	c.Check(span, check.IsNil)
+	_, child := startSpan(context.Background(), "foo")
+	c.Check(child, check.IsNil)
+	child.SetAttribute("foo", "bar")
+	child.End(nil)
+}
+
+func (s *UnitSuite) TestTracerExport(c *check.C) {
+	received := make(chan otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Content-Type"), check.Equals, "application/json")
+		var traces otlpTraces
+		c.Check(json.NewDecoder(r.Body).Decode(&traces), check.IsNil)
+		received <- traces
+	}))
+	defer collector.Close()
+
+	t := &tracer{
+		endpoint:      collector.URL,
+		sampleRate:    1,
+		client:        http.DefaultClient,
+		logger:        ctxlog.TestLogger(c),
+		queue:         make(chan *traceSpan, 10),
+		flushInterval: 10 * time.Millisecond,
+	}
+	go t.run()
+
+	req := httptest.NewRequest("GET", "http://keep-web.example/foo", nil)
+	req.Header.Set("X-Request-Id", "req-abcdefghijklmnopqrst")
+	req, root := t.startRequest(req)
+	c.Assert(root, check.NotNil)
+	_, child := startSpan(req.Context(), "collection fetch")
+	child.SetAttribute("found", true)
+	child.End(fmt.Errorf("oops"))
+	root.SetAttribute("http.status_code", 200)
+	root.End(nil)
+
+	var spans []otlpSpan
+	for len(spans) < 2 {
+		select {
+		case traces := <-received:
+			c.Assert(traces.ResourceSpans, check.HasLen, 1)
+			c.Assert(traces.ResourceSpans[0].ScopeSpans, check.HasLen, 1)
+			spans = append(spans, traces.ResourceSpans[0].ScopeSpans[0].Spans...)
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for spans")
+		}
+	}
+	c.Assert(spans, check.HasLen, 2)
+	c.Check(spans[0].Name, check.Equals, "collection fetch")
+	c.Check(spans[0].Status, check.Equals, otlpStatus{Code: 2, Message: "oops"})
+	c.Check(spans[0].Attributes, check.DeepEquals, []otlpKeyValue{otlpAttribute("found", true)})
+	c.Check(spans[1].Name, check.Equals, "keep-web GET")
+	c.Check(spans[1].Kind, check.Equals, spanKindServer)
+	c.Check(spans[1].ParentSpanID, check.Equals, "")
+	c.Check(spans[0].ParentSpanID, check.Equals, spans[1].SpanID)
+	expectTraceID := fmt.Sprintf("%x", md5.Sum([]byte("req-abcdefghijklmnopqrst")))
+	c.Check(spans[0].TraceID, check.Equals, expectTraceID)
+	c.Check(spans[1].TraceID, check.Equals, expectTraceID)
+}
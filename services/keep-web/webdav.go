@@ -10,9 +10,12 @@ import (
 	"fmt"
 	"io"
 	prand "math/rand"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -73,7 +76,7 @@ func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os
 	if writing {
 		fs.makeparents(name)
 	}
-	f, err = fs.collfs.OpenFile(name, flag, perm)
+	f, err = fs.collfs.OpenFileContext(ctx, name, flag, perm)
 	if !fs.writing {
 		// webdav module returns 404 on all OpenFile errors,
 		// but returns 405 Method Not Allowed if OpenFile()
@@ -113,7 +116,19 @@ func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error)
 	if fs.writing {
 		fs.makeparents(name)
 	}
-	return fs.collfs.Stat(name)
+	return fs.collfs.StatContext(ctx, name)
+}
+
+// contextFS is an http.FileSystem that opens files using the given
+// context, so pending Keep reads are abandoned when the client
+// disconnects.
+type contextFS struct {
+	ctx context.Context
+	fs  arvados.FileSystem
+}
+
+func (cfs contextFS) Open(name string) (http.File, error) {
+	return cfs.fs.OpenFileContext(cfs.ctx, name, os.O_RDONLY, 0)
 }
 
 type writeFailer struct {
@@ -148,10 +163,8 @@ func (readEOF) Read(p []byte) (int, error) {
 // read-only webdav filesystem because webdav locks only apply to
 // writes.
 //
-// This is more suitable than webdav.NewMemLS() for two reasons:
-// First, it allows keep-web to use one locker for all collections
-// even though coll1.vhost/foo and coll2.vhost/foo have the same path
-// but represent different resources. Additionally, it returns valid
+// This is used on hosts where WebDAV locking is not enabled (see
+// Collections.WebDAVLocks in the cluster config). It returns valid
 // tokens (rfc2518 specifies that tokens are represented as URIs and
 // are unique across all resources for all time), which might improve
 // client compatibility.
@@ -159,10 +172,6 @@ func (readEOF) Read(p []byte) (int, error) {
 // However, it does also permit impossible operations, like acquiring
 // conflicting locks and releasing non-existent locks.  This might
 // confuse some clients if they try to probe for correctness.
-//
-// Currently this is a moot point: the LOCK and UNLOCK methods are not
-// accepted by keep-web, so it suffices to implement the
-// webdav.LockSystem interface.
 type noLockSystem struct{}
 
 func (*noLockSystem) Confirm(time.Time, string, string, ...webdav.Condition) (func(), error) {
@@ -183,6 +192,151 @@ func (*noLockSystem) Unlock(now time.Time, token string) error {
 
 func noop() {}
 
+// lockSystemSet holds a separate webdav lock system for each
+// collection, so coll1.vhost/foo and coll2.vhost/foo -- which have
+// the same path but represent different resources -- can be locked
+// independently.
+//
+// Locks are held in memory, so they are not shared between multiple
+// keep-web processes.
+type lockSystemSet struct {
+	maxTimeout time.Duration
+
+	mtx       sync.Mutex
+	byID      map[string]*collectionLockSystem
+	nextSweep time.Time
+}
+
+// get returns the lock system for the given collection, creating it
+// if needed.
+func (lss *lockSystemSet) get(collectionID string, now time.Time) webdav.LockSystem {
+	lss.mtx.Lock()
+	defer lss.mtx.Unlock()
+	if lss.byID == nil {
+		lss.byID = map[string]*collectionLockSystem{}
+	}
+	if now.After(lss.nextSweep) {
+		// Every lock expires within maxTimeout of the last
+		// time it was created or refreshed, so a lock system
+		// that hasn't been used in that long is empty and can
+		// be discarded.
+		for id, ls := range lss.byID {
+			if now.Sub(ls.lastUsed) > lss.maxTimeout {
+				delete(lss.byID, id)
+			}
+		}
+		lss.nextSweep = now.Add(lss.maxTimeout)
+	}
+	ls := lss.byID[collectionID]
+	if ls == nil {
+		ls = &collectionLockSystem{
+			LockSystem: webdav.NewMemLS(),
+			prefix:     "opaquelocktoken:" + uuid() + "-",
+			maxTimeout: lss.maxTimeout,
+		}
+		lss.byID[collectionID] = ls
+	}
+	ls.lastUsed = now
+	return ls
+}
+
+// collectionLockSystem wraps a webdav.NewMemLS() lock system for a
+// single collection. It limits lock durations to maxTimeout, and
+// converts the memLS tokens (which are just sequence numbers) to URIs
+// that are unique across all collections.
+type collectionLockSystem struct {
+	webdav.LockSystem
+	prefix     string
+	maxTimeout time.Duration
+	lastUsed   time.Time // protected by lockSystemSet.mtx
+}
+
+func (ls *collectionLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	conds := make([]webdav.Condition, len(conditions))
+	for i, cond := range conditions {
+		if cond.Token != "" {
+			token, ok := ls.memToken(cond.Token)
+			if !ok {
+				// Token from a different collection,
+				// or not issued by us at all: use a
+				// token memLS can't match.
+				token = "-"
+			}
+			cond.Token = token
+		}
+		conds[i] = cond
+	}
+	return ls.LockSystem.Confirm(now, name0, name1, conds...)
+}
+
+func (ls *collectionLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Duration = ls.limitDuration(details.Duration)
+	token, err := ls.LockSystem.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+	return ls.prefix + token, nil
+}
+
+func (ls *collectionLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	token, ok := ls.memToken(token)
+	if !ok {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	return ls.LockSystem.Refresh(now, token, ls.limitDuration(duration))
+}
+
+func (ls *collectionLockSystem) Unlock(now time.Time, token string) error {
+	token, ok := ls.memToken(token)
+	if !ok {
+		return webdav.ErrNoSuchLock
+	}
+	return ls.LockSystem.Unlock(now, token)
+}
+
+// memToken returns the memLS token corresponding to the given token
+// URI, and false if the token URI was not issued by this lock system.
+func (ls *collectionLockSystem) memToken(token string) (string, bool) {
+	if !strings.HasPrefix(token, ls.prefix) {
+		return "", false
+	}
+	return token[len(ls.prefix):], true
+}
+
+// limitDuration returns d, or maxTimeout if d is longer than
+// maxTimeout or infinite (negative).
+func (ls *collectionLockSystem) limitDuration(d time.Duration) time.Duration {
+	if d < 0 || d > ls.maxTimeout {
+		return ls.maxTimeout
+	}
+	return d
+}
+
+// webdavLockingHost returns true if the given Host header (which may
+// include a port number) matches one of the hostnames in hosts. A
+// hostname "*.example.com" matches any hostname ending in
+// ".example.com", and "*" matches all hostnames.
+func webdavLockingHost(hosts arvados.StringSet, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for pattern := range hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost returns true if the given hostname (without port)
+// matches pattern, which is either a hostname, "*", or "*" followed
+// by a hostname suffix.
+func matchHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	return pattern == host || pattern == "*" ||
+		(strings.HasPrefix(pattern, "*") && strings.HasSuffix(host, pattern[1:]))
+}
+
 // Return a version 1 variant 4 UUID, meaning all bits are random
 // except the ones indicating the version and variant.
 func uuid() string {
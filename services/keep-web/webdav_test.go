@@ -4,6 +4,86 @@
 
 package main
 
-import "golang.org/x/net/webdav"
+import (
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"golang.org/x/net/webdav"
+	check "gopkg.in/check.v1"
+)
 
 var _ webdav.FileSystem = &webdavFS{}
+var _ webdav.LockSystem = &collectionLockSystem{}
+
+func (s *UnitSuite) TestWebDAVLockingHost(c *check.C) {
+	hosts := arvados.StringSet{
+		"*.collections.example.com": {},
+		"download.example.com":      {},
+	}
+	for host, expect := range map[string]bool{
+		"zzzzz-4zz18-abcdeabcdeabcde.collections.example.com":     true,
+		"zzzzz-4zz18-abcdeabcdeabcde.collections.example.com:443": true,
+		"Download.Example.COM":      true,
+		"download.example.com:8443": true,
+		"collections.example.com":   false,
+		"example.com":               false,
+		"upload.example.com":        false,
+		"":                          false,
+	} {
+		c.Check(webdavLockingHost(hosts, host), check.Equals, expect, check.Commentf("host %q", host))
+		c.Check(webdavLockingHost(arvados.StringSet{"*": {}}, host), check.Equals, true)
+		c.Check(webdavLockingHost(nil, host), check.Equals, false)
+	}
+}
+
+func (s *UnitSuite) TestLockSystemSet(c *check.C) {
+	lss := &lockSystemSet{maxTimeout: time.Minute}
+	now := time.Now()
+	ls1 := lss.get("zzzzz-4zz18-000000000000001", now)
+	ls2 := lss.get("zzzzz-4zz18-000000000000002", now)
+
+	// Locks on the same path in different collections don't
+	// conflict.
+	token1, err := ls1.Create(now, webdav.LockDetails{Root: "/foo", Duration: -1})
+	c.Assert(err, check.IsNil)
+	c.Check(token1, check.Matches, `opaquelocktoken:.*`)
+	token2, err := ls2.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Second})
+	c.Assert(err, check.IsNil)
+	c.Check(token2, check.Not(check.Equals), token1)
+
+	// A conflicting lock in the same collection is refused.
+	_, err = lss.get("zzzzz-4zz18-000000000000001", now).Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Second})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+
+	// Writes require the right token.
+	_, err = ls1.Confirm(now, "/foo", "")
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+	_, err = ls1.Confirm(now, "/foo", "", webdav.Condition{Token: token2})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+	release, err := ls1.Confirm(now, "/foo", "", webdav.Condition{Token: token1})
+	c.Check(err, check.IsNil)
+	release()
+
+	// Tokens from other collections can't be used to refresh or
+	// unlock.
+	_, err = ls1.Refresh(now, token2, time.Second)
+	c.Check(err, check.Equals, webdav.ErrNoSuchLock)
+	c.Check(ls1.Unlock(now, token2), check.Equals, webdav.ErrNoSuchLock)
+
+	// Infinite timeout is limited to maxTimeout.
+	details, err := ls1.Refresh(now, token1, -1)
+	c.Check(err, check.IsNil)
+	c.Check(details.Duration, check.Equals, time.Minute)
+	_, err = ls1.Refresh(now.Add(2*time.Minute), token1, time.Second)
+	c.Check(err, check.Equals, webdav.ErrNoSuchLock)
+
+	// Unlock releases the lock.
+	c.Check(ls2.Unlock(now, token2), check.IsNil)
+	_, err = ls2.Create(now, webdav.LockDetails{Root: "/foo", Duration: time.Second})
+	c.Check(err, check.IsNil)
+
+	// Unused lock systems are discarded after maxTimeout.
+	c.Check(lss.byID, check.HasLen, 2)
+	lss.get("zzzzz-4zz18-000000000000003", now.Add(2*time.Minute))
+	c.Check(lss.byID, check.HasLen, 1)
+}
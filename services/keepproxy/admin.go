@@ -0,0 +1,240 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+var errAdminPassthroughDisabled = errors.New("Trash and untrash requests are not enabled on this keepproxy (see Collections.KeepproxyAdminPassthrough config)")
+var errAdminRequired = errors.New("Trash and untrash requests require an admin token with unlimited scope")
+
+// isAdminToken returns true if arv.ApiToken belongs to an admin user
+// and is not restricted by scopes.
+func isAdminToken(arv *arvadosclient.ArvadosClient) (bool, error) {
+	var auth arvados.APIClientAuthorization
+	err := arv.Call("GET", "api_client_authorizations", "", "current", nil, &auth)
+	if isNotPermitted(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(auth.Scopes) != 1 || auth.Scopes[0] != "all" {
+		return false, nil
+	}
+	var user arvados.User
+	err = arv.Call("GET", "users", "", "current", nil, &user)
+	if isNotPermitted(err) {
+		return false, nil
+	}
+	return user.IsAdmin, err
+}
+
+// adminResponse is a keepstore server's response to a trash or
+// untrash request.
+type adminResponse struct {
+	uuid   string
+	status int
+	body   []byte
+	err    error
+}
+
+func (ar adminResponse) String() string {
+	if ar.err != nil {
+		return fmt.Sprintf("%s: %s", ar.uuid, ar.err)
+	}
+	return fmt.Sprintf("%s: %d %s", ar.uuid, ar.status, strings.TrimSpace(string(ar.body)))
+}
+
+// checkAdmin checks that admin passthrough is enabled and the
+// client's token belongs to an admin. If not, it returns an HTTP
+// status and error to send to the client.
+func (h *proxyHandler) checkAdmin(kc *keepclient.KeepClient, req *http.Request) (tok string, status int, err error) {
+	if !h.adminPassthrough {
+		return "", http.StatusMethodNotAllowed, errAdminPassthroughDisabled
+	}
+	if perm, err := h.clientCerts.Permission(req); err != nil {
+		return "", http.StatusForbidden, err
+	} else if !perm.Upload {
+		return "", http.StatusForbidden, errCertUploadNotPermitted
+	}
+	var pass bool
+	if pass, tok = CheckAuthorizationHeader(kc, h.APITokenCache, req); !pass {
+		return tok, http.StatusForbidden, errBadAuthorizationHeader
+	}
+	arvclient := *kc.Arvados
+	arvclient.ApiToken = tok
+	arvclient.RequestID = req.Header.Get("X-Request-Id")
+	if ok, err := h.isAdmin(&arvclient); err != nil {
+		return tok, http.StatusBadGateway, err
+	} else if !ok {
+		return tok, http.StatusForbidden, errAdminRequired
+	}
+	return tok, 0, nil
+}
+
+// sendAdminRequest sends the given request (using the system root
+// token) to every keepstore server, and returns their responses,
+// sorted by server UUID.
+func (h *proxyHandler) sendAdminRequest(kc *keepclient.KeepClient, req *http.Request, method, path string) []adminResponse {
+	var resps []adminResponse
+	for uuid, root := range kc.LocalRoots() {
+		ar := adminResponse{uuid: uuid}
+		ar.status, ar.body, ar.err = h.sendToKeepstore(kc, req, method, root+path)
+		resps = append(resps, ar)
+	}
+	sort.Slice(resps, func(i, j int) bool { return resps[i].uuid < resps[j].uuid })
+	return resps
+}
+
+func (h *proxyHandler) sendToKeepstore(kc *keepclient.KeepClient, req *http.Request, method, url string) (int, []byte, error) {
+	ksreq, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	ksreq.Header.Set("Authorization", "OAuth2 "+h.systemRootToken)
+	ksreq.Header.Set("X-Request-Id", req.Header.Get("X-Request-Id"))
+	resp, err := kc.HTTPClient.Do(ksreq)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, body, err
+}
+
+// Delete passes a trash request ("DELETE /{hash}") through to all
+// keepstore servers, and responds with the total number of copies
+// trashed, in the same form as keepstore's response.
+func (h *proxyHandler) Delete(resp http.ResponseWriter, req *http.Request) {
+	if err := h.checkLoop(resp, req); err != nil {
+		return
+	}
+	resp.Header().Set("Via", req.Proto+" "+viaAlias)
+
+	hash := mux.Vars(req)["locator"][:32]
+	kc := h.makeKeepClient(req)
+	var err error
+	var status int
+	var tok string
+	defer func() {
+		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, err)
+		rec := auditRecord{Locator: hash, Status: status}
+		if err != nil {
+			rec.Result = err.Error()
+		}
+		h.audit.Record(req, kc, tok, rec)
+		if err != nil {
+			http.Error(resp, err.Error(), status)
+		}
+	}()
+
+	if tok, status, err = h.checkAdmin(kc, req); err != nil {
+		return
+	}
+
+	var result struct {
+		Deleted int      `json:"copies_deleted"`
+		Failed  int      `json:"copies_failed"`
+		Errors  []string `json:"errors,omitempty"`
+	}
+	found := false
+	for _, ar := range h.sendAdminRequest(kc, req, "DELETE", "/"+hash) {
+		switch {
+		case ar.err == nil && ar.status == http.StatusOK:
+			var ksresult struct {
+				Deleted int `json:"copies_deleted"`
+				Failed  int `json:"copies_failed"`
+			}
+			if jerr := json.Unmarshal(ar.body, &ksresult); jerr != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: error decoding response: %s", ar.uuid, jerr))
+				continue
+			}
+			found = true
+			result.Deleted += ksresult.Deleted
+			result.Failed += ksresult.Failed
+		case ar.err == nil && ar.status == http.StatusNotFound:
+		default:
+			result.Errors = append(result.Errors, ar.String())
+		}
+	}
+	if !found && len(result.Errors) > 0 {
+		status, err = http.StatusBadGateway, errors.New(strings.Join(result.Errors, "; "))
+		return
+	} else if !found {
+		status, err = http.StatusNotFound, keepclient.BlockNotFound
+		return
+	}
+	status = http.StatusOK
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(result)
+}
+
+// Untrash passes an untrash request ("PUT /untrash/{hash}") through
+// to all keepstore servers.
+func (h *proxyHandler) Untrash(resp http.ResponseWriter, req *http.Request) {
+	if err := h.checkLoop(resp, req); err != nil {
+		return
+	}
+	resp.Header().Set("Via", req.Proto+" "+viaAlias)
+
+	hash := mux.Vars(req)["hash"]
+	kc := h.makeKeepClient(req)
+	var err error
+	var status int
+	var tok string
+	defer func() {
+		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, err)
+		rec := auditRecord{Locator: hash, Status: status}
+		if err != nil {
+			rec.Result = err.Error()
+		}
+		h.audit.Record(req, kc, tok, rec)
+		if err != nil {
+			http.Error(resp, err.Error(), status)
+		}
+	}()
+
+	if tok, status, err = h.checkAdmin(kc, req); err != nil {
+		return
+	}
+
+	var untrashed, errs []string
+	for _, ar := range h.sendAdminRequest(kc, req, "PUT", "/untrash/"+hash) {
+		switch {
+		case ar.err == nil && ar.status == http.StatusOK:
+			untrashed = append(untrashed, ar.uuid)
+		case ar.err == nil && ar.status == http.StatusNotFound:
+		default:
+			errs = append(errs, ar.String())
+		}
+	}
+	if len(errs) > 0 {
+		msg := "Failed to untrash on: " + strings.Join(errs, "; ")
+		if len(untrashed) > 0 {
+			msg = "Successfully untrashed on: " + strings.Join(untrashed, ", ") + "; " + msg
+		}
+		status, err = http.StatusBadGateway, errors.New(msg)
+		return
+	} else if len(untrashed) == 0 {
+		status, err = http.StatusNotFound, keepclient.BlockNotFound
+		return
+	}
+	status = http.StatusOK
+	io.WriteString(resp, "Successfully untrashed on: "+strings.Join(untrashed, ", "))
+}
@@ -0,0 +1,165 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AdminSuite{})
+
+// Tests that don't need any Arvados services
+type AdminSuite struct {
+	cluster  *arvados.Cluster
+	stubs    []*httptest.Server
+	requests []string
+	replies  map[string]map[string]stubReply // server index => path => reply
+}
+
+type stubReply struct {
+	status int
+	body   string
+}
+
+const (
+	adminToken    = "admintoken"
+	userToken     = "usertoken"
+	errorToken    = "errortoken"
+	testBlockHash = "acbd18db4cc2f85cedef654fccc4a4d8"
+)
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	s.cluster = &arvados.Cluster{SystemRootToken: "systemroottoken"}
+	s.cluster.Collections.KeepproxyAdminPassthrough = true
+	s.requests = nil
+	s.replies = map[string]map[string]stubReply{}
+	s.stubs = nil
+	for _, idx := range []string{"0", "1"} {
+		idx := idx
+		s.replies[idx] = map[string]stubReply{}
+		s.stubs = append(s.stubs, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.requests = append(s.requests, idx+" "+req.Method+" "+req.URL.Path+" "+req.Header.Get("Authorization"))
+			reply, ok := s.replies[idx][req.Method+" "+req.URL.Path]
+			if !ok {
+				reply = stubReply{http.StatusNotFound, "not found"}
+			}
+			w.WriteHeader(reply.status)
+			w.Write([]byte(reply.body))
+		})))
+	}
+}
+
+func (s *AdminSuite) TearDownTest(c *C) {
+	for _, srv := range s.stubs {
+		srv.Close()
+	}
+}
+
+func (s *AdminSuite) do(c *C, method, path, token string) *httptest.ResponseRecorder {
+	kc := &keepclient.KeepClient{Arvados: &arvadosclient.ArvadosClient{}}
+	kc.SetServiceRoots(map[string]string{
+		"zzzzz-bi6l4-000000000000000": s.stubs[0].URL,
+		"zzzzz-bi6l4-000000000000001": s.stubs[1].URL,
+	}, nil, nil)
+	rtr, err := MakeRESTRouter(kc, 10*time.Second, s.cluster)
+	c.Assert(err, IsNil)
+	h := rtr.(*proxyHandler)
+	// Skip the API calls that check tokens.
+	h.RememberToken("write:" + adminToken)
+	h.RememberToken("write:" + userToken)
+	h.RememberToken("write:" + errorToken)
+	h.isAdmin = func(arv *arvadosclient.ArvadosClient) (bool, error) {
+		switch arv.ApiToken {
+		case adminToken:
+			return true, nil
+		case userToken:
+			return false, nil
+		default:
+			return false, errors.New("API unavailable")
+		}
+	}
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp := httptest.NewRecorder()
+	rtr.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *AdminSuite) TestDisabled(c *C) {
+	s.cluster.Collections.KeepproxyAdminPassthrough = false
+	resp := s.do(c, "DELETE", "/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusMethodNotAllowed)
+	c.Check(resp.Body.String(), Matches, `.*KeepproxyAdminPassthrough.*\n`)
+	resp = s.do(c, "PUT", "/untrash/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusMethodNotAllowed)
+	c.Check(s.requests, HasLen, 0)
+}
+
+func (s *AdminSuite) TestNotAdmin(c *C) {
+	resp := s.do(c, "DELETE", "/"+testBlockHash+"+3", userToken)
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+	c.Check(resp.Body.String(), Matches, `.*require an admin token.*\n`)
+	resp = s.do(c, "PUT", "/untrash/"+testBlockHash, userToken)
+	c.Check(resp.Code, Equals, http.StatusForbidden)
+
+	// Error checking whether the token belongs to an admin
+	resp = s.do(c, "PUT", "/untrash/"+testBlockHash, errorToken)
+	c.Check(resp.Code, Equals, http.StatusBadGateway)
+	c.Check(s.requests, HasLen, 0)
+}
+
+func (s *AdminSuite) TestDelete(c *C) {
+	s.replies["1"]["DELETE /"+testBlockHash] = stubReply{http.StatusOK, `{"copies_deleted":2,"copies_failed":1}`}
+	resp := s.do(c, "DELETE", "/"+testBlockHash+"+3+Afake@12345678", adminToken)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, `{"copies_deleted":2,"copies_failed":1}`+"\n")
+	c.Check(s.requests, HasLen, 2)
+	for _, r := range s.requests {
+		c.Check(r, Matches, `[01] DELETE /`+testBlockHash+` OAuth2 systemroottoken`)
+	}
+
+	// A keepstore error is reported along with the successes.
+	s.replies["0"]["DELETE /"+testBlockHash] = stubReply{http.StatusMethodNotAllowed, "Method disabled"}
+	resp = s.do(c, "DELETE", "/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, `{"copies_deleted":2,"copies_failed":1,"errors":["zzzzz-bi6l4-000000000000000: 405 Method disabled"]}`+"\n")
+
+	// Not found anywhere, and errors only.
+	delete(s.replies["1"], "DELETE /"+testBlockHash)
+	resp = s.do(c, "DELETE", "/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusBadGateway)
+	delete(s.replies["0"], "DELETE /"+testBlockHash)
+	resp = s.do(c, "DELETE", "/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestUntrash(c *C) {
+	s.replies["0"]["PUT /untrash/"+testBlockHash] = stubReply{http.StatusOK, "Successfully untrashed on: /mnt/keep0"}
+	resp := s.do(c, "PUT", "/untrash/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, "Successfully untrashed on: zzzzz-bi6l4-000000000000000")
+	c.Check(s.requests, HasLen, 2)
+	for _, r := range s.requests {
+		c.Check(r, Matches, `[01] PUT /untrash/`+testBlockHash+` OAuth2 systemroottoken`)
+	}
+
+	s.replies["1"]["PUT /untrash/"+testBlockHash] = stubReply{http.StatusInternalServerError, "Failed to untrash on all writable volumes"}
+	resp = s.do(c, "PUT", "/untrash/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusBadGateway)
+	c.Check(strings.TrimSpace(resp.Body.String()), Equals, "Successfully untrashed on: zzzzz-bi6l4-000000000000000; Failed to untrash on: zzzzz-bi6l4-000000000000001: 500 Failed to untrash on all writable volumes")
+
+	s.replies = map[string]map[string]stubReply{"0": {}, "1": {}}
+	resp = s.do(c, "PUT", "/untrash/"+testBlockHash, adminToken)
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+}
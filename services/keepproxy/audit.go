@@ -0,0 +1,199 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// auditTokenCacheSize is the maximum number of token UUIDs
+	// remembered by an auditLogger.
+	auditTokenCacheSize = 1000
+
+	// auditQueueSize is the number of records that can wait to be
+	// written as API log entries before new records are dropped.
+	auditQueueSize = 1000
+)
+
+// auditRecord describes a single block read or write through
+// keepproxy.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	TokenUUID  string    `json:"token_uuid"`
+	Locator    string    `json:"locator"`
+	Bytes      int64     `json:"bytes"`
+	Status     int       `json:"status"`
+	Result     string    `json:"result"` // "ok", or an error message
+}
+
+var removePermissionHint = regexp.MustCompile(`\+A[^+]*`)
+
+// auditLogger writes audit records according to the
+// Collections.KeepproxyAuditLog config. A nil *auditLogger discards
+// all records.
+type auditLogger struct {
+	file io.WriteCloser
+	mtx  sync.Mutex // serializes writes to file
+
+	apiLogs   chan auditRecord
+	createLog func(auditRecord) error
+	dropped   int64 // records dropped because apiLogs was full (atomic)
+
+	lookupTokenUUID func(arv *arvadosclient.ArvadosClient) (string, error)
+	tokenUUIDs      *lru.TwoQueueCache // token => cachedTokenUUID
+	ttl             time.Duration      // how long to cache a token UUID
+	errorTTL        time.Duration      // how long to cache a failed lookup
+}
+
+type cachedTokenUUID struct {
+	uuid    string
+	expires time.Time
+}
+
+// newAuditLogger returns an auditLogger for the given config, or nil
+// if audit logging is disabled. API log entries are created using
+// the given client, which must have a token that is allowed to
+// create logs.
+func newAuditLogger(cfg arvados.KeepproxyAuditLogConfig, arv *arvadosclient.ArvadosClient) (*auditLogger, error) {
+	if cfg.File == "" && !cfg.APILogs {
+		return nil, nil
+	}
+	tokenUUIDs, err := lru.New2Q(auditTokenCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	al := &auditLogger{
+		lookupTokenUUID: currentTokenUUID,
+		tokenUUIDs:      tokenUUIDs,
+		ttl:             5 * time.Minute,
+		errorTTL:        10 * time.Second,
+	}
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		al.file = f
+	}
+	if cfg.APILogs {
+		al.createLog = func(rec auditRecord) error {
+			return arv.Create("logs", arvadosclient.Dict{"log": arvadosclient.Dict{
+				"object_uuid": rec.TokenUUID,
+				"event_type":  "keepproxy_access",
+				"properties":  rec,
+			}}, nil)
+		}
+		al.apiLogs = make(chan auditRecord, auditQueueSize)
+		go al.runAPILogs()
+	}
+	return al, nil
+}
+
+// Record fills in the request-related fields of rec and writes it
+// to the configured destinations. tok is the client's API token, or
+// "" if the request had no valid token. kc is used to look up the
+// token's UUID if needed.
+//
+// If API logs are enabled and the API server is not keeping up,
+// Record drops the API log entry rather than delaying the client's
+// request. Dropped entries are counted and reported in the
+// keepproxy log. Records are never dropped from the audit log file.
+func (al *auditLogger) Record(req *http.Request, kc *keepclient.KeepClient, tok string, rec auditRecord) {
+	if al == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	rec.RequestID = req.Header.Get("X-Request-Id")
+	rec.RemoteAddr = GetRemoteAddress(req)
+	rec.Method = req.Method
+	rec.TokenUUID = al.tokenUUID(kc, tok)
+	rec.Locator = removePermissionHint.ReplaceAllString(rec.Locator, "")
+	if rec.Result == "" {
+		rec.Result = "ok"
+	}
+	if al.file != nil {
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("error encoding audit record: %s", err)
+		} else {
+			al.mtx.Lock()
+			_, err = al.file.Write(append(buf, '\n'))
+			al.mtx.Unlock()
+			if err != nil {
+				log.Printf("error writing audit log: %s", err)
+			}
+		}
+	}
+	if al.apiLogs != nil {
+		select {
+		case al.apiLogs <- rec:
+		default:
+			atomic.AddInt64(&al.dropped, 1)
+		}
+	}
+}
+
+func (al *auditLogger) runAPILogs() {
+	var reported int64
+	for rec := range al.apiLogs {
+		err := al.createLog(rec)
+		if err != nil {
+			log.Printf("error creating audit log entry: %s (record: %+v)", err, rec)
+		}
+		if dropped := atomic.LoadInt64(&al.dropped); dropped > reported {
+			log.Printf("audit log queue full: dropped %d API log entries (%d total)", dropped-reported, dropped)
+			reported = dropped
+		}
+	}
+}
+
+// tokenUUID returns the UUID of the given token. The UUID of a v2
+// token is taken from the token itself; others are looked up using
+// the API and cached. Failed lookups are cached for a shorter time,
+// so a bad token doesn't cause an API call on every request.
+func (al *auditLogger) tokenUUID(kc *keepclient.KeepClient, tok string) string {
+	if tok == "" {
+		return ""
+	}
+	if strings.HasPrefix(tok, "v2/") {
+		if parts := strings.Split(tok, "/"); len(parts) >= 3 {
+			return parts[1]
+		}
+	}
+	if ent, ok := al.tokenUUIDs.Get(tok); ok {
+		if ent := ent.(cachedTokenUUID); time.Now().Before(ent.expires) {
+			return ent.uuid
+		}
+		al.tokenUUIDs.Remove(tok)
+	}
+	arv := *kc.Arvados
+	arv.ApiToken = tok
+	uuid, err := al.lookupTokenUUID(&arv)
+	ttl := al.ttl
+	if err != nil {
+		log.Printf("error looking up token UUID for audit log: %s", err)
+		uuid, ttl = "", al.errorTTL
+	}
+	al.tokenUUIDs.Add(tok, cachedTokenUUID{uuid: uuid, expires: time.Now().Add(ttl)})
+	return uuid
+}
@@ -0,0 +1,174 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AuditSuite{})
+
+// Tests that don't need any Arvados services
+type AuditSuite struct{}
+
+func (s *AuditSuite) stubLookup(al *auditLogger, uuids map[string]string, calls *int) {
+	al.lookupTokenUUID = func(arv *arvadosclient.ArvadosClient) (string, error) {
+		*calls++
+		uuid, ok := uuids[arv.ApiToken]
+		if !ok {
+			return "", errors.New("API unavailable")
+		}
+		return uuid, nil
+	}
+}
+
+func (s *AuditSuite) readRecords(c *C, fnm string) []auditRecord {
+	buf, err := ioutil.ReadFile(fnm)
+	c.Assert(err, IsNil)
+	var recs []auditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n") {
+		var rec auditRecord
+		c.Assert(json.Unmarshal([]byte(line), &rec), IsNil)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func (s *AuditSuite) TestDisabled(c *C) {
+	al, err := newAuditLogger(arvados.KeepproxyAuditLogConfig{}, nil)
+	c.Check(err, IsNil)
+	c.Check(al, IsNil)
+	// Recording to a nil logger is a no-op.
+	al.Record(httptest.NewRequest("GET", "/", nil), nil, "", auditRecord{})
+}
+
+func (s *AuditSuite) TestFile(c *C) {
+	fnm := filepath.Join(c.MkDir(), "audit.log")
+	al, err := newAuditLogger(arvados.KeepproxyAuditLogConfig{File: fnm}, nil)
+	c.Assert(err, IsNil)
+	calls := 0
+	s.stubLookup(al, map[string]string{"oldtoken": "zzzzz-gj3su-000000000000001"}, &calls)
+	kc := &keepclient.KeepClient{Arvados: &arvadosclient.ArvadosClient{}}
+
+	req := httptest.NewRequest("GET", "/acbd18db4cc2f85cedef654fccc4a4d8+3+Aabcdef@12345678", nil)
+	req.Header.Set("X-Request-Id", "req-abcdefghijklmnopqrst")
+	for i := 0; i < 2; i++ {
+		al.Record(req, kc, "oldtoken", auditRecord{
+			Locator: "acbd18db4cc2f85cedef654fccc4a4d8+3+Aabcdef@12345678+Kzzzzz",
+			Bytes:   3,
+			Status:  200,
+		})
+	}
+	al.Record(httptest.NewRequest("PUT", "/acbd18db4cc2f85cedef654fccc4a4d8", nil), kc, "v2/zzzzz-gj3su-000000000000002/secret", auditRecord{
+		Locator: "acbd18db4cc2f85cedef654fccc4a4d8",
+		Status:  403,
+		Result:  "Forbidden",
+	})
+	for i := 0; i < 2; i++ {
+		al.Record(httptest.NewRequest("GET", "/acbd18db4cc2f85cedef654fccc4a4d8", nil), kc, "badtoken", auditRecord{
+			Locator: "acbd18db4cc2f85cedef654fccc4a4d8",
+			Status:  403,
+			Result:  "Missing or invalid Authorization header",
+		})
+	}
+	// oldtoken and badtoken were looked up once each, then
+	// cached (badtoken's failure is cached too); the v2 token
+	// needed no lookup.
+	c.Check(calls, Equals, 2)
+
+	// Once the failure expires from the cache, badtoken is looked
+	// up again.
+	al.tokenUUIDs.Purge()
+	al.errorTTL = -time.Second
+	for i := 0; i < 2; i++ {
+		al.Record(httptest.NewRequest("GET", "/", nil), kc, "badtoken", auditRecord{})
+	}
+	c.Check(calls, Equals, 4)
+
+	recs := s.readRecords(c, fnm)
+	c.Assert(recs, HasLen, 7)
+	c.Check(recs[0].Method, Equals, "GET")
+	c.Check(recs[0].RequestID, Equals, "req-abcdefghijklmnopqrst")
+	c.Check(recs[0].RemoteAddr, Not(Equals), "")
+	c.Check(recs[0].TokenUUID, Equals, "zzzzz-gj3su-000000000000001")
+	c.Check(recs[0].Locator, Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3+Kzzzzz")
+	c.Check(recs[0].Bytes, Equals, int64(3))
+	c.Check(recs[0].Status, Equals, 200)
+	c.Check(recs[0].Result, Equals, "ok")
+	c.Check(recs[0].Time.IsZero(), Equals, false)
+	c.Check(recs[2].Method, Equals, "PUT")
+	c.Check(recs[2].TokenUUID, Equals, "zzzzz-gj3su-000000000000002")
+	c.Check(recs[2].Result, Equals, "Forbidden")
+	c.Check(recs[3].TokenUUID, Equals, "")
+}
+
+func (s *AuditSuite) TestAPILogs(c *C) {
+	al, err := newAuditLogger(arvados.KeepproxyAuditLogConfig{APILogs: true}, nil)
+	c.Assert(err, IsNil)
+	created := make(chan auditRecord, 1)
+	al.createLog = func(rec auditRecord) error {
+		created <- rec
+		return nil
+	}
+	kc := &keepclient.KeepClient{Arvados: &arvadosclient.ArvadosClient{}}
+	al.Record(httptest.NewRequest("GET", "/", nil), kc, "v2/zzzzz-gj3su-000000000000002/secret", auditRecord{
+		Locator: "acbd18db4cc2f85cedef654fccc4a4d8+3",
+		Bytes:   3,
+		Status:  200,
+	})
+	rec := <-created
+	c.Check(rec.TokenUUID, Equals, "zzzzz-gj3su-000000000000002")
+	c.Check(rec.Locator, Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3")
+
+	buf, err := json.Marshal(rec)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Contains(buf, []byte(`"token_uuid":"zzzzz-gj3su-000000000000002"`)), Equals, true)
+}
+
+func (s *AuditSuite) TestAPILogsQueueFull(c *C) {
+	al, err := newAuditLogger(arvados.KeepproxyAuditLogConfig{APILogs: true}, nil)
+	c.Assert(err, IsNil)
+	unblock := make(chan bool)
+	created := make(chan auditRecord, auditQueueSize+10)
+	al.createLog = func(rec auditRecord) error {
+		<-unblock
+		created <- rec
+		return nil
+	}
+	kc := &keepclient.KeepClient{Arvados: &arvadosclient.ArvadosClient{}}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < auditQueueSize+10; i++ {
+			al.Record(httptest.NewRequest("GET", "/", nil), kc, "", auditRecord{})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		c.Fatal("Record blocked while API log queue was full")
+	}
+	// One record is being written by runAPILogs, and the queue
+	// is full; the rest are dropped.
+	c.Check(atomic.LoadInt64(&al.dropped) >= 9, Equals, true)
+	// The records that weren't dropped are still written.
+	close(unblock)
+	for i := atomic.LoadInt64(&al.dropped); i < auditQueueSize+10; i++ {
+		<-created
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+var errClientCertificateRequired = errors.New("A valid TLS client certificate is required to use this keepproxy (see Collections.KeepproxyClientCertificates config)")
+var errCertDownloadNotPermitted = errors.New("Downloading data through this keepproxy is not permitted for this client certificate (see Collections.KeepproxyClientCertificates config)")
+var errCertUploadNotPermitted = errors.New("Uploading data through this keepproxy is not permitted for this client certificate (see Collections.KeepproxyClientCertificates config)")
+
+// clientCertChecker decides whether a client may download and/or
+// upload data through keepproxy, according to the TLS client
+// certificate it presented and the
+// Collections.KeepproxyClientCertificates config.
+type clientCertChecker struct {
+	config arvados.KeepproxyClientCertificatesConfig
+}
+
+// newClientCertChecker returns nil if client certificates are not
+// required.
+func newClientCertChecker(config arvados.KeepproxyClientCertificatesConfig) *clientCertChecker {
+	if config.CACertificates == "" {
+		return nil
+	}
+	return &clientCertChecker{config: config}
+}
+
+// Permission returns the permissions granted by the verified client
+// certificate of the given request. If client certificates are not
+// required (cc is nil), all operations are permitted.
+func (cc *clientCertChecker) Permission(req *http.Request) (arvados.UploadDownloadPermission, error) {
+	if cc == nil {
+		return arvados.UploadDownloadPermission{Download: true, Upload: true}, nil
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return arvados.UploadDownloadPermission{}, errClientCertificateRequired
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if perm, ok := cc.config.BySubject[subject.String()]; ok {
+		return perm, nil
+	}
+	if perm, ok := cc.config.BySubject[subject.CommonName]; ok {
+		return perm, nil
+	}
+	return cc.config.Default, nil
+}
+
+// setupClientCertificates configures tlsConfig to verify client
+// certificates against the CA certificates in the given file, if
+// any. Clients that don't present a certificate can still connect,
+// so health checks and management endpoints keep working; data
+// requests from those clients are rejected by clientCertChecker.
+func setupClientCertificates(tlsConfig *tls.Config, config arvados.KeepproxyClientCertificatesConfig) error {
+	if config.CACertificates == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(config.CACertificates)
+	if err != nil {
+		return fmt.Errorf("error reading Collections.KeepproxyClientCertificates.CACertificates: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in Collections.KeepproxyClientCertificates.CACertificates file %q", config.CACertificates)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ClientCertSuite{})
+
+// Tests that don't need any Arvados services
+type ClientCertSuite struct{}
+
+func (s *ClientCertSuite) requestWithCert(subject pkix.Name) *http.Request {
+	req, _ := http.NewRequest("GET", "https://keep.example/", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}},
+	}
+	return req
+}
+
+func (s *ClientCertSuite) TestNotRequired(c *C) {
+	cc := newClientCertChecker(arvados.KeepproxyClientCertificatesConfig{})
+	c.Check(cc, IsNil)
+	req, _ := http.NewRequest("GET", "http://keep.example/", nil)
+	perm, err := cc.Permission(req)
+	c.Check(err, IsNil)
+	c.Check(perm, Equals, arvados.UploadDownloadPermission{Download: true, Upload: true})
+}
+
+func (s *ClientCertSuite) TestPermission(c *C) {
+	cc := newClientCertChecker(arvados.KeepproxyClientCertificatesConfig{
+		CACertificates: "/etc/arvados/client-ca.pem",
+		Default:        arvados.UploadDownloadPermission{Download: true},
+		BySubject: map[string]arvados.UploadDownloadPermission{
+			"CN=uploader,O=Example":  {Download: true, Upload: true},
+			"readonly.example":       {Download: true},
+			"writeonly.example":      {Upload: true},
+			"CN=nothing,O=Elsewhere": {},
+		},
+	})
+	c.Assert(cc, NotNil)
+
+	// No TLS, or TLS without a verified client certificate
+	req, _ := http.NewRequest("GET", "http://keep.example/", nil)
+	_, err := cc.Permission(req)
+	c.Check(err, Equals, errClientCertificateRequired)
+	req.TLS = &tls.ConnectionState{}
+	_, err = cc.Permission(req)
+	c.Check(err, Equals, errClientCertificateRequired)
+
+	for _, trial := range []struct {
+		subject pkix.Name
+		expect  arvados.UploadDownloadPermission
+	}{
+		{pkix.Name{CommonName: "uploader", Organization: []string{"Example"}}, arvados.UploadDownloadPermission{Download: true, Upload: true}},
+		// Full subject doesn't match, falls back to default
+		{pkix.Name{CommonName: "uploader", Organization: []string{"Other"}}, arvados.UploadDownloadPermission{Download: true}},
+		// Match by common name
+		{pkix.Name{CommonName: "writeonly.example", Organization: []string{"Example"}}, arvados.UploadDownloadPermission{Upload: true}},
+		{pkix.Name{CommonName: "readonly.example"}, arvados.UploadDownloadPermission{Download: true}},
+		{pkix.Name{CommonName: "nothing", Organization: []string{"Elsewhere"}}, arvados.UploadDownloadPermission{}},
+		{pkix.Name{CommonName: "unlisted"}, arvados.UploadDownloadPermission{Download: true}},
+	} {
+		c.Logf("subject %q", trial.subject.String())
+		perm, err := cc.Permission(s.requestWithCert(trial.subject))
+		c.Check(err, IsNil)
+		c.Check(perm, Equals, trial.expect)
+	}
+}
+
+func (s *ClientCertSuite) TestBadCAFile(c *C) {
+	tmpdir := c.MkDir()
+	err := setupClientCertificates(&tls.Config{}, arvados.KeepproxyClientCertificatesConfig{CACertificates: filepath.Join(tmpdir, "missing.pem")})
+	c.Check(err, ErrorMatches, `error reading Collections.KeepproxyClientCertificates.CACertificates: .*`)
+
+	empty := filepath.Join(tmpdir, "empty.pem")
+	c.Assert(ioutil.WriteFile(empty, nil, 0600), IsNil)
+	err = setupClientCertificates(&tls.Config{}, arvados.KeepproxyClientCertificatesConfig{CACertificates: empty})
+	c.Check(err, ErrorMatches, `no certificates found in .*`)
+}
+
+// Clients that present a certificate signed by the configured CA are
+// verified; clients that don't present a certificate can still
+// connect.
+func (s *ClientCertSuite) TestHandshake(c *C) {
+	tmpdir := c.MkDir()
+	ls := &ListenSuite{}
+	cluster := ls.cluster()
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "https", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{}
+	ls.writeSelfSignedCert(c, tmpdir, cluster)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+	caCert, err := x509.ParseCertificate(caDER)
+	c.Assert(err, IsNil)
+	caFile := filepath.Join(tmpdir, "client-ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+	c.Assert(err, IsNil)
+	cluster.Collections.KeepproxyClientCertificates.CACertificates = caFile
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	clientTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTmpl, caCert, &clientKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+
+	lns, _, err := listen(ctxlog.TestLogger(c), cluster)
+	c.Assert(err, IsNil)
+	c.Assert(lns, HasLen, 1)
+	stop := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- serve(lns, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+			} else {
+				w.Write([]byte("anonymous"))
+			}
+		}), stop)
+	}()
+
+	url := "https://" + lns[0].Addr().String() + "/"
+	for _, trial := range []struct {
+		certs  []tls.Certificate
+		expect string
+	}{
+		{nil, "anonymous"},
+		{[]tls.Certificate{{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}}, "client.example"},
+	} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       trial.certs,
+		}}}
+		resp, err := client.Get(url)
+		if c.Check(err, IsNil) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			c.Check(string(body), Equals, trial.expect)
+		}
+	}
+
+	// A certificate that isn't signed by the configured CA is
+	// rejected during the handshake. (GetClientCertificate makes
+	// the client send it even though the server doesn't list its
+	// issuer as acceptable.)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	otherDER, err := x509.CreateCertificate(rand.Reader, clientTmpl, clientTmpl, &otherKey.PublicKey, otherKey)
+	c.Assert(err, IsNil)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{otherDER}, PrivateKey: otherKey}, nil
+		},
+	}}}
+	_, err = client.Get(url)
+	c.Check(err, NotNil)
+
+	stop <- syscall.SIGTERM
+	c.Check(<-done, IsNil)
+}
@@ -5,24 +5,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/lib/service"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
@@ -35,10 +40,14 @@ import (
 var version = "dev"
 
 var (
-	listener net.Listener
-	router   http.Handler
+	listeners []net.Listener
+	router    http.Handler
 )
 
+// Maximum time to wait for active requests to finish when shutting
+// down.
+var shutdownTimeout = time.Minute
+
 const rfc3339NanoFixed = "2006-01-02T15:04:05.000000000Z07:00"
 
 func configure(logger log.FieldLogger, args []string) (*arvados.Cluster, error) {
@@ -135,36 +144,218 @@ func run(logger log.FieldLogger, cluster *arvados.Cluster) error {
 		kc.Want_replicas = cluster.Collections.DefaultReplication
 	}
 
-	var listen arvados.URL
-	for listen = range cluster.Services.Keepproxy.InternalURLs {
-		break
+	// Start serving requests.
+	router, err = MakeRESTRouter(kc, time.Duration(keepclient.DefaultProxyRequestTimeout), cluster)
+	if err != nil {
+		return err
 	}
 
-	var lErr error
-	listener, lErr = net.Listen("tcp", listen.Host)
-	if lErr != nil {
-		return fmt.Errorf("listen(%s): %v", listen.Host, lErr)
+	lns, urls, err := listen(logger, cluster)
+	if err != nil {
+		return err
 	}
+	listeners = lns
+	setupLocalReplicas(logger, kc, cluster, urls)
+	setupLocalityAwareReads(logger, kc, cluster, urls)
 
 	if _, err := daemon.SdNotify(false, "READY=1"); err != nil {
 		log.Printf("Error notifying init daemon: %v", err)
 	}
-	log.Println("listening at", listener.Addr())
 
-	// Shut down the server gracefully (by closing the listener)
-	// if SIGTERM is received.
+	// Shut down the server gracefully if SIGTERM is received.
 	term := make(chan os.Signal, 1)
-	go func(sig <-chan os.Signal) {
-		s := <-sig
-		log.Println("caught signal:", s)
-		listener.Close()
-	}(term)
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, syscall.SIGINT)
 
-	// Start serving requests.
-	router = MakeRESTRouter(kc, time.Duration(keepclient.DefaultProxyRequestTimeout), cluster.ManagementToken)
-	return http.Serve(listener, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	return serve(listeners, httpserver.AddRequestIDs(httpserver.LogRequests(router)), term)
+}
+
+// listen returns a listener for each of the configured
+// Services.Keepproxy.InternalURLs that refers to an address on this
+// host, along with the corresponding URLs. Each https listener has
+// its own TLS config (see listenerTLSConfig).
+func listen(logger log.FieldLogger, cluster *arvados.Cluster) ([]net.Listener, []arvados.URL, error) {
+	var urls []arvados.URL
+	for u := range cluster.Services.Keepproxy.InternalURLs {
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i].String() < urls[j].String() })
+
+	var lns []net.Listener
+	var localURLs []arvados.URL
+	var anyHTTPS bool
+	var err error
+	defer func() {
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+		}
+	}()
+	for _, u := range urls {
+		var ln net.Listener
+		ln, err = net.Listen("tcp", u.Host)
+		if err != nil && strings.Contains(err.Error(), "cannot assign requested address") {
+			// This InternalURL is for a different host.
+			err = nil
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("listen(%s): %v", u.Host, err)
+		}
+		if u.Scheme == "https" {
+			var tlsConfig *tls.Config
+			tlsConfig, err = listenerTLSConfig(logger, cluster, cluster.Services.Keepproxy.InternalURLs[u])
+			if err != nil {
+				ln.Close()
+				return nil, nil, fmt.Errorf("cannot listen at %s: %s", u.String(), err)
+			}
+			ln = tls.NewListener(ln, tlsConfig)
+			anyHTTPS = true
+		}
+		log.Printf("listening at %s (%s)", ln.Addr(), u.Scheme)
+		lns = append(lns, ln)
+		localURLs = append(localURLs, u)
+	}
+	if len(lns) == 0 {
+		err = errors.New("none of the configured Services.Keepproxy.InternalURLs is an address on this host")
+		return nil, nil, err
+	}
+	if cluster.Collections.KeepproxyClientCertificates.CACertificates != "" && !anyHTTPS {
+		logger.Warn("Collections.KeepproxyClientCertificates is configured, but there are no https Services.Keepproxy.InternalURLs -- all data requests will be rejected")
+	}
+	return lns, localURLs, nil
+}
+
+// listenerTLSConfig returns the TLS config for an https InternalURL
+// with the given settings. The certificate and key default to the
+// ones in the cluster's TLS section. Client certificates are
+// verified if Collections.KeepproxyClientCertificates is configured.
+func listenerTLSConfig(logger log.FieldLogger, cluster *arvados.Cluster, si arvados.ServiceInstance) (*tls.Config, error) {
+	cert, key := cluster.TLS.Certificate, cluster.TLS.Key
+	if si.TLSCertificate != "" || si.TLSKey != "" {
+		cert, key = si.TLSCertificate, si.TLSKey
+	}
+	tlsConfig, err := service.TLSConfigWithCertFiles(cert, key, logger)
+	if err != nil {
+		return nil, err
+	}
+	switch si.TLSMinVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLSMinVersion %q (must be \"1.2\" or \"1.3\")", si.TLSMinVersion)
+	}
+	err = setupClientCertificates(tlsConfig, cluster.Collections.KeepproxyClientCertificates)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// setupLocalReplicas configures kc to write the first
+// Collections.KeepproxyLocalReplicas replicas of each block to
+// keepstore servers in the same zone as this proxy. The proxy's zone
+// is the Zone of the (local) InternalURLs it listens on.
+func setupLocalReplicas(logger log.FieldLogger, kc *keepclient.KeepClient, cluster *arvados.Cluster, localURLs []arvados.URL) {
+	n := cluster.Collections.KeepproxyLocalReplicas
+	if n < 1 {
+		return
+	}
+	zone := localInstance(cluster, localURLs).Zone
+	if zone == "" {
+		logger.Warn("Collections.KeepproxyLocalReplicas is set, but Zone is not configured for this keepproxy server's InternalURLs -- ignoring")
+		return
+	}
+	roots := map[string]bool{}
+	for u, si := range cluster.Services.Keepstore.InternalURLs {
+		if si.Zone == zone {
+			// Same form as arv.KeepServiceURIs in run()
+			roots[strings.TrimRight(u.String(), "/")] = true
+		}
+	}
+	if len(roots) == 0 {
+		logger.Warnf("Collections.KeepproxyLocalReplicas is set, but no Services.Keepstore.InternalURLs are in zone %q -- ignoring", zone)
+		return
+	}
+	kc.PreferredWriteRoots = roots
+	kc.PreferredWriteReplicas = n
+	logger.Infof("writing up to %d replicas of each block to %d keepstore servers in zone %q", n, len(roots), zone)
+}
+
+// setupLocalityAwareReads configures kc to read blocks from keepstore
+// servers in the same rack or zone as this proxy first, if
+// Collections.KeepproxyLocalityAwareReads is set.
+func setupLocalityAwareReads(logger log.FieldLogger, kc *keepclient.KeepClient, cluster *arvados.Cluster, localURLs []arvados.URL) {
+	if !cluster.Collections.KeepproxyLocalityAwareReads {
+		return
+	}
+	local := localInstance(cluster, localURLs)
+	if local.Zone == "" {
+		logger.Warn("Collections.KeepproxyLocalityAwareReads is set, but Zone is not configured for this keepproxy server's InternalURLs -- ignoring")
+		return
+	}
+	services := map[string]keepclient.Locality{}
+	for u, si := range cluster.Services.Keepstore.InternalURLs {
+		if si.Zone != "" {
+			// Same form as arv.KeepServiceURIs in run()
+			services[strings.TrimRight(u.String(), "/")] = keepclient.Locality{Zone: si.Zone, Rack: si.Rack}
+		}
+	}
+	kc.ClientLocality = keepclient.Locality{Zone: local.Zone, Rack: local.Rack}
+	kc.ServiceLocality = services
+	logger.Infof("reading blocks from keepstore servers in zone %q (rack %q) first", local.Zone, local.Rack)
+}
+
+// localInstance returns the first of the given (local)
+// Services.Keepproxy.InternalURLs entries that has a Zone.
+func localInstance(cluster *arvados.Cluster, localURLs []arvados.URL) arvados.ServiceInstance {
+	for _, u := range localURLs {
+		if si := cluster.Services.Keepproxy.InternalURLs[u]; si.Zone != "" {
+			return si
+		}
+	}
+	return arvados.ServiceInstance{}
+}
+
+// serve serves requests on all of the given listeners until one of
+// them fails or a signal is received on stop. It then stops accepting
+// new connections on all listeners, and waits (up to
+// shutdownTimeout) for active requests to finish.
+func serve(lns []net.Listener, handler http.Handler, stop <-chan os.Signal) error {
+	servers := make([]*http.Server, len(lns))
+	errs := make(chan error, len(lns))
+	for i, ln := range lns {
+		srv := &http.Server{Handler: handler}
+		servers[i] = srv
+		go func(ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(ln)
+	}
+
+	var err error
+	select {
+	case sig := <-stop:
+		log.Println("caught signal:", sig)
+	case err = <-errs:
+		log.Printf("error serving requests: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("error shutting down: %s", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	return err
 }
 
 type APITokenCache struct {
@@ -271,15 +462,41 @@ type proxyHandler struct {
 	http.Handler
 	*keepclient.KeepClient
 	*APITokenCache
-	timeout   time.Duration
-	transport *http.Transport
+	timeout    time.Duration
+	transport  *http.Transport
+	permission *permissionChecker
+	audit      *auditLogger
+	traffic    *trafficStats
+
+	// TLS client certificate permissions (see
+	// Collections.KeepproxyClientCertificates), or nil if client
+	// certificates are not required.
+	clientCerts *clientCertChecker
+
+	// If blobSigningKey is not nil, signatures on locators in GET
+	// and HEAD requests are checked before forwarding them to
+	// keepstore.
+	blobSigningKey []byte
+	blobSigningTTL time.Duration
+
+	// If adminPassthrough is true, trash and untrash requests
+	// from admin users are passed through to keepstore servers
+	// using systemRootToken (see Delete and Untrash).
+	adminPassthrough bool
+	systemRootToken  string
+	isAdmin          func(*arvadosclient.ArvadosClient) (bool, error)
 }
 
 // MakeRESTRouter returns an http.Handler that passes GET and PUT
 // requests to the appropriate handlers.
-func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken string) http.Handler {
+func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, cluster *arvados.Cluster) (http.Handler, error) {
 	rest := mux.NewRouter()
 
+	audit, err := newAuditLogger(cluster.Collections.KeepproxyAuditLog, kc.Arvados)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up audit log: %s", err)
+	}
+
 	transport := defaultTransport
 	transport.DialContext = (&net.Dialer{
 		Timeout:   keepclient.DefaultConnectTimeout,
@@ -298,6 +515,24 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken
 			tokens:     make(map[string]int64),
 			expireTime: 300,
 		},
+		permission:       newPermissionChecker(cluster.Collections.KeepproxyPermission),
+		clientCerts:      newClientCertChecker(cluster.Collections.KeepproxyClientCertificates),
+		audit:            audit,
+		adminPassthrough: cluster.Collections.KeepproxyAdminPassthrough,
+		systemRootToken:  cluster.SystemRootToken,
+		isAdmin:          isAdminToken,
+	}
+	h.traffic = newTrafficStats(cluster.Collections.KeepproxyTrafficStats, func(tok string) (string, error) {
+		arv := *kc.Arvados
+		arv.ApiToken = tok
+		return currentTokenUUID(&arv)
+	})
+	if h.traffic != nil && cluster.Collections.KeepproxyTrafficStats.LogInterval > 0 {
+		go h.traffic.runLogger(cluster.Collections.KeepproxyTrafficStats.LogInterval.Duration())
+	}
+	if cluster.Collections.BlobSigning && cluster.Collections.BlobSigningKey != "" {
+		h.blobSigningKey = []byte(cluster.Collections.BlobSigningKey)
+		h.blobSigningTTL = cluster.Collections.BlobSigningTTL.Duration()
 	}
 
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}\+.*}`, h.Get).Methods("GET", "HEAD")
@@ -312,16 +547,40 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}\+.*}`, h.Put).Methods("PUT")
 	rest.HandleFunc(`/{locator:[0-9a-f]{32}}`, h.Put).Methods("PUT")
 	rest.HandleFunc(`/`, h.Put).Methods("POST")
-	rest.HandleFunc(`/{any}`, h.Options).Methods("OPTIONS")
-	rest.HandleFunc(`/`, h.Options).Methods("OPTIONS")
+
+	// Trash and untrash blocks on all keepstore servers (admin
+	// only, see Collections.KeepproxyAdminPassthrough)
+	rest.HandleFunc(`/{locator:[0-9a-f]{32}\+.*}`, h.Delete).Methods("DELETE")
+	rest.HandleFunc(`/{locator:[0-9a-f]{32}}`, h.Delete).Methods("DELETE")
+	rest.HandleFunc(`/untrash/{hash:[0-9a-f]{32}}`, h.Untrash).Methods("PUT")
+
+	// Respond to CORS preflight requests for all of the above
+	// routes, including GET/HEAD and index requests that use
+	// custom headers. (This uses a MatcherFunc rather than
+	// Methods("OPTIONS") so other methods on unroutable paths
+	// still get InvalidPathHandler's 400 response rather than
+	// 405.)
+	rest.PathPrefix(`/`).HandlerFunc(h.Options).MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return req.Method == "OPTIONS"
+	})
 
 	rest.Handle("/_health/{check}", &health.Handler{
-		Token:  mgmtToken,
+		Token:  cluster.ManagementToken,
 		Prefix: "/_health/",
 	}).Methods("GET")
 
+	// Block size histogram and top talkers (see
+	// Collections.KeepproxyTrafficStats)
+	if cluster.ManagementToken == "" {
+		rest.HandleFunc("/_traffic", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Management API authentication is not configured", http.StatusForbidden)
+		}).Methods("GET")
+	} else {
+		rest.Handle("/_traffic", auth.RequireLiteralToken(cluster.ManagementToken, h.traffic)).Methods("GET")
+	}
+
 	rest.NotFoundHandler = InvalidPathHandler{}
-	return h
+	return h, nil
 }
 
 var errLoopDetected = errors.New("loop detected")
@@ -338,7 +597,7 @@ func (*proxyHandler) checkLoop(resp http.ResponseWriter, req *http.Request) erro
 func SetCorsHeaders(resp http.ResponseWriter) {
 	resp.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
 	resp.Header().Set("Access-Control-Allow-Origin", "*")
-	resp.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas")
+	resp.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Length, Content-Type, Range, X-Keep-Desired-Replicas")
 	resp.Header().Set("Access-Control-Max-Age", "86486400")
 }
 
@@ -357,9 +616,40 @@ func (h *proxyHandler) Options(resp http.ResponseWriter, req *http.Request) {
 var errBadAuthorizationHeader = errors.New("Missing or invalid Authorization header")
 var errContentLengthMismatch = errors.New("Actual length != expected content length")
 var errMethodNotSupported = errors.New("Method not supported")
+var errSignatureExpired = errors.New("Locator signature has expired: get a freshly signed locator from the API server")
+var errSignatureMissing = errors.New("Locator has no permission signature")
+var errSignatureInvalid = errors.New("Locator signature is not valid for this token")
 
 var removeHint, _ = regexp.Compile("\\+K@[a-z0-9]{5}(\\+|$)")
 
+// checkSignature returns an error if blob signing is enabled and the
+// given locator does not have a valid, unexpired signature for the
+// given token. Checking here, instead of leaving it to keepstore,
+// saves a round trip to the backend for requests that will fail
+// anyway, and gives the client a clearer error message.
+//
+// Locators for blobs on remote clusters (with a +R hint and no +A
+// hint) are signed by the remote cluster, so they are not checked
+// here.
+func (h *proxyHandler) checkSignature(locator, tok string) error {
+	if h.blobSigningKey == nil {
+		return nil
+	}
+	if strings.Contains(locator, "+R") && !strings.Contains(locator, "+A") {
+		return nil
+	}
+	switch err := keepclient.VerifySignature(locator, tok, h.blobSigningTTL, h.blobSigningKey); err {
+	case nil:
+		return nil
+	case keepclient.ErrSignatureExpired:
+		return errSignatureExpired
+	case keepclient.ErrSignatureMissing:
+		return errSignatureMissing
+	default:
+		return errSignatureInvalid
+	}
+}
+
 func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 	if err := h.checkLoop(resp, req); err != nil {
 		return
@@ -372,18 +662,34 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 	var status int
 	var expectLength, responseLength int64
 	var proxiedURI = "-"
+	var tok string
+
+	kc := h.makeKeepClient(req)
 
 	defer func() {
 		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, expectLength, responseLength, proxiedURI, err)
+		rec := auditRecord{Locator: locator, Bytes: responseLength, Status: status}
+		if err != nil {
+			rec.Result = err.Error()
+		}
+		h.audit.Record(req, kc, tok, rec)
+		if status == http.StatusOK && err == nil && req.Method == "GET" {
+			h.traffic.Record(req, tok, responseLength)
+		}
 		if status != http.StatusOK {
 			http.Error(resp, err.Error(), status)
 		}
 	}()
 
-	kc := h.makeKeepClient(req)
+	if perm, cerr := h.clientCerts.Permission(req); cerr != nil {
+		status, err = http.StatusForbidden, cerr
+		return
+	} else if !perm.Download {
+		status, err = http.StatusForbidden, errCertDownloadNotPermitted
+		return
+	}
 
 	var pass bool
-	var tok string
 	if pass, tok = CheckAuthorizationHeader(kc, h.APITokenCache, req); !pass {
 		status, err = http.StatusForbidden, errBadAuthorizationHeader
 		return
@@ -394,10 +700,23 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 	arvclient.ApiToken = tok
 	kc.Arvados = &arvclient
 
+	if perm, perr := h.permission.Permission(&arvclient); perr != nil {
+		status, err = http.StatusBadGateway, perr
+		return
+	} else if !perm.Download {
+		status, err = http.StatusForbidden, errDownloadNotPermitted
+		return
+	}
+
 	var reader io.ReadCloser
 
 	locator = removeHint.ReplaceAllString(locator, "$1")
 
+	if err = h.checkSignature(locator, tok); err != nil {
+		status = http.StatusForbidden
+		return
+	}
+
 	switch req.Method {
 	case "HEAD":
 		expectLength, proxiedURI, err = kc.Ask(locator)
@@ -444,6 +763,20 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 var errLengthRequired = errors.New(http.StatusText(http.StatusLengthRequired))
 var errLengthMismatch = errors.New("Locator size hint does not match Content-Length header")
 
+// readBlock reads all of r into memory, and returns
+// keepclient.ErrOversizeBlock if r has more than
+// keepclient.BLOCKSIZE bytes.
+func readBlock(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, keepclient.BLOCKSIZE+1))
+	if err != nil {
+		return nil, err
+	} else if n > keepclient.BLOCKSIZE {
+		return nil, keepclient.ErrOversizeBlock
+	}
+	return buf.Bytes(), nil
+}
+
 func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	if err := h.checkLoop(resp, req); err != nil {
 		return
@@ -458,16 +791,27 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	var status = http.StatusInternalServerError
 	var wroteReplicas int
 	var locatorOut string = "-"
+	var tok string
+	locatorIn := mux.Vars(req)["locator"]
 
 	defer func() {
 		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, expectLength, kc.Want_replicas, wroteReplicas, locatorOut, err)
+		rec := auditRecord{Locator: locatorIn, Status: status}
+		if status == http.StatusOK {
+			rec.Locator, rec.Bytes = locatorOut, expectLength
+		}
+		if err != nil {
+			rec.Result = err.Error()
+		}
+		h.audit.Record(req, kc, tok, rec)
+		if status == http.StatusOK {
+			h.traffic.Record(req, tok, expectLength)
+		}
 		if status != http.StatusOK {
 			http.Error(resp, err.Error(), status)
 		}
 	}()
 
-	locatorIn := mux.Vars(req)["locator"]
-
 	// Check if the client specified storage classes
 	if req.Header.Get("X-Keep-Storage-Classes") != "" {
 		var scl []string
@@ -477,27 +821,43 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		kc.StorageClasses = scl
 	}
 
-	_, err = fmt.Sscanf(req.Header.Get("Content-Length"), "%d", &expectLength)
-	if err != nil || expectLength < 0 {
+	// A chunked request body has no Content-Length header. In
+	// that case expectLength is -1 until we either learn the size
+	// from the locator hint or read the whole body.
+	chunked := req.Header.Get("Content-Length") == "" && len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked"
+	if chunked {
+		expectLength = -1
+	} else if _, err = fmt.Sscanf(req.Header.Get("Content-Length"), "%d", &expectLength); err != nil || expectLength < 0 {
 		err = errLengthRequired
 		status = http.StatusLengthRequired
 		return
+	} else if expectLength > keepclient.BLOCKSIZE {
+		err = keepclient.ErrOversizeBlock
+		status = http.StatusRequestEntityTooLarge
+		return
 	}
 
+	var loc *keepclient.Locator
 	if locatorIn != "" {
-		var loc *keepclient.Locator
 		if loc, err = keepclient.MakeLocator(locatorIn); err != nil {
 			status = http.StatusBadRequest
 			return
-		} else if loc.Size > 0 && int64(loc.Size) != expectLength {
+		} else if loc.Size > 0 && !chunked && int64(loc.Size) != expectLength {
 			err = errLengthMismatch
 			status = http.StatusBadRequest
 			return
 		}
 	}
 
+	if perm, cerr := h.clientCerts.Permission(req); cerr != nil {
+		err, status = cerr, http.StatusForbidden
+		return
+	} else if !perm.Upload {
+		err, status = errCertUploadNotPermitted, http.StatusForbidden
+		return
+	}
+
 	var pass bool
-	var tok string
 	if pass, tok = CheckAuthorizationHeader(kc, h.APITokenCache, req); !pass {
 		err = errBadAuthorizationHeader
 		status = http.StatusForbidden
@@ -509,6 +869,14 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	arvclient.ApiToken = tok
 	kc.Arvados = &arvclient
 
+	if perm, perr := h.permission.Permission(&arvclient); perr != nil {
+		err, status = perr, http.StatusBadGateway
+		return
+	} else if !perm.Upload {
+		err, status = errUploadNotPermitted, http.StatusForbidden
+		return
+	}
+
 	// Check if the client specified the number of replicas
 	if req.Header.Get("X-Keep-Desired-Replicas") != "" {
 		var r int
@@ -518,15 +886,40 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// Now try to put the block through
-	if locatorIn == "" {
-		bytes, err2 := ioutil.ReadAll(req.Body)
-		if err2 != nil {
+	// Now try to put the block through. Note the request body is
+	// not read until after the authorization and permission
+	// checks above, so a client that sent "Expect: 100-continue"
+	// doesn't send the body at all if the request is going to
+	// fail anyway.
+	if chunked && loc != nil && loc.Size > 0 {
+		// The locator's size hint tells us how much data to
+		// expect, so we can stream the body. If the body
+		// turns out to be a different size, the hash check
+		// will fail.
+		expectLength = int64(loc.Size)
+		if expectLength > keepclient.BLOCKSIZE {
+			err = keepclient.ErrOversizeBlock
+			status = http.StatusRequestEntityTooLarge
+			return
+		}
+		locatorOut, wroteReplicas, err = kc.PutHR(locatorIn, req.Body, expectLength)
+	} else if locatorIn == "" || chunked {
+		buf, err2 := readBlock(req.Body)
+		if err2 == keepclient.ErrOversizeBlock {
+			err = err2
+			status = http.StatusRequestEntityTooLarge
+			return
+		} else if err2 != nil {
 			err = fmt.Errorf("Error reading request body: %s", err2)
 			status = http.StatusInternalServerError
 			return
 		}
-		locatorOut, wroteReplicas, err = kc.PutB(bytes)
+		expectLength = int64(len(buf))
+		if locatorIn == "" {
+			locatorOut, wroteReplicas, err = kc.PutB(buf)
+		} else {
+			locatorOut, wroteReplicas, err = kc.PutHB(loc.Hash, buf)
+		}
 	} else {
 		locatorOut, wroteReplicas, err = kc.PutHR(locatorIn, req.Body, expectLength)
 	}
@@ -579,6 +972,14 @@ func (h *proxyHandler) Index(resp http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
+	if perm, cerr := h.clientCerts.Permission(req); cerr != nil {
+		status, err = http.StatusForbidden, cerr
+		return
+	} else if !perm.Download {
+		status, err = http.StatusForbidden, errCertDownloadNotPermitted
+		return
+	}
+
 	kc := h.makeKeepClient(req)
 	ok, token := CheckAuthorizationHeader(kc, h.APITokenCache, req)
 	if !ok {
@@ -591,6 +992,14 @@ func (h *proxyHandler) Index(resp http.ResponseWriter, req *http.Request) {
 	arvclient.ApiToken = token
 	kc.Arvados = &arvclient
 
+	if perm, perr := h.permission.Permission(&arvclient); perr != nil {
+		status, err = http.StatusBadGateway, perr
+		return
+	} else if !perm.Download {
+		status, err = http.StatusForbidden, errDownloadNotPermitted
+		return
+	}
+
 	// Only GET method is supported
 	if req.Method != "GET" {
 		status, err = http.StatusNotImplemented, errMethodNotSupported
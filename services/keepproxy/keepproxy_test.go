@@ -9,6 +9,7 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -52,6 +53,12 @@ var _ = Suite(&NoKeepServerSuite{})
 // Test with no keepserver to simulate errors
 type NoKeepServerSuite struct{}
 
+// Gocheck boilerplate
+var _ = Suite(&SignatureSuite{})
+
+// Tests that don't need any Arvados services
+type SignatureSuite struct{}
+
 var TestProxyUUID = "zzzzz-bi6l4-lrixqc4fxofbmzz"
 
 // Wait (up to 1 second) for keepproxy to listen on a port. This
@@ -61,17 +68,17 @@ func waitForListener() {
 	const (
 		ms = 5
 	)
-	for i := 0; listener == nil && i < 10000; i += ms {
+	for i := 0; listeners == nil && i < 10000; i += ms {
 		time.Sleep(ms * time.Millisecond)
 	}
-	if listener == nil {
+	if listeners == nil {
 		panic("Timed out waiting for listener to start")
 	}
 }
 
 func closeListener() {
-	if listener != nil {
-		listener.Close()
+	for _, ln := range listeners {
+		ln.Close()
 	}
 }
 
@@ -133,7 +140,7 @@ func runProxy(c *C, bogusClientToken bool, loadKeepstoresFromConfig bool) *keepc
 
 	cluster.Services.Keepproxy.InternalURLs = map[arvados.URL]arvados.ServiceInstance{{Host: ":0"}: {}}
 
-	listener = nil
+	listeners = nil
 	go func() {
 		run(log.New(), cluster)
 		defer closeListener()
@@ -148,7 +155,7 @@ func runProxy(c *C, bogusClientToken bool, loadKeepstoresFromConfig bool) *keepc
 	}
 	kc := keepclient.New(arv)
 	sr := map[string]string{
-		TestProxyUUID: "http://" + listener.Addr().String(),
+		TestProxyUUID: "http://" + listeners[0].Addr().String(),
 	}
 	kc.SetServiceRoots(sr, sr, sr)
 	kc.Arvados.External = true
@@ -161,7 +168,7 @@ func (s *ServerRequiredSuite) TestResponseViaHeader(c *C) {
 	defer closeListener()
 
 	req, err := http.NewRequest("POST",
-		"http://"+listener.Addr().String()+"/",
+		"http://"+listeners[0].Addr().String()+"/",
 		strings.NewReader("TestViaHeader"))
 	c.Assert(err, Equals, nil)
 	req.Header.Add("Authorization", "OAuth2 "+arvadostest.ActiveToken)
@@ -174,7 +181,7 @@ func (s *ServerRequiredSuite) TestResponseViaHeader(c *C) {
 	resp.Body.Close()
 
 	req, err = http.NewRequest("GET",
-		"http://"+listener.Addr().String()+"/"+string(locator),
+		"http://"+listeners[0].Addr().String()+"/"+string(locator),
 		nil)
 	c.Assert(err, Equals, nil)
 	resp, err = (&http.Client{}).Do(req)
@@ -188,7 +195,7 @@ func (s *ServerRequiredSuite) TestLoopDetection(c *C) {
 	defer closeListener()
 
 	sr := map[string]string{
-		TestProxyUUID: "http://" + listener.Addr().String(),
+		TestProxyUUID: "http://" + listeners[0].Addr().String(),
 	}
 	router.(*proxyHandler).KeepClient.SetServiceRoots(sr, sr, sr)
 
@@ -257,7 +264,8 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 	// fixes the invalid Content-Length header. In order to test
 	// our server behavior, we have to call the handler directly
 	// using an httptest.ResponseRecorder.
-	rtr := MakeRESTRouter(kc, 10*time.Second, "")
+	rtr, err := MakeRESTRouter(kc, 10*time.Second, &arvados.Cluster{})
+	c.Assert(err, IsNil)
 
 	type testcase struct {
 		sendLength   string
@@ -271,7 +279,7 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 		{"abcdef", http.StatusLengthRequired},
 	} {
 		req, err := http.NewRequest("PUT",
-			fmt.Sprintf("http://%s/%s+%d", listener.Addr().String(), hash, len(content)),
+			fmt.Sprintf("http://%s/%s+%d", listeners[0].Addr().String(), hash, len(content)),
 			bytes.NewReader(content))
 		c.Assert(err, IsNil)
 		req.Header.Set("Content-Length", t.sendLength)
@@ -284,6 +292,89 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 	}
 }
 
+func (s *ServerRequiredSuite) TestPutChunked(c *C) {
+	runProxy(c, false, false)
+	defer closeListener()
+
+	content := []byte("TestPutChunked")
+	hash := fmt.Sprintf("%x", md5.Sum(content))
+
+	for _, t := range []struct {
+		path         string
+		body         []byte
+		expectStatus int
+	}{
+		{"/", content, http.StatusOK},
+		{fmt.Sprintf("/%s", hash), content, http.StatusOK},
+		{fmt.Sprintf("/%s+%d", hash, len(content)), content, http.StatusOK},
+		{fmt.Sprintf("/%s+%d", hash, len(content)), content[1:], 0},
+		{fmt.Sprintf("/%s+%d", hash, len(content)), append(content, 'x'), 0},
+		{"/", make([]byte, keepclient.BLOCKSIZE+1), http.StatusRequestEntityTooLarge},
+	} {
+		c.Logf("path %s, body length %d", t.path, len(t.body))
+		// Hide the body's type from http.NewRequest so the
+		// request is sent with chunked encoding.
+		req, err := http.NewRequest("PUT", "http://"+listeners[0].Addr().String()+t.path, io.MultiReader(bytes.NewReader(t.body)))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "OAuth2 "+arvadostest.ActiveToken)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		if t.expectStatus == 0 {
+			// Size hint does not match body
+			c.Check(resp.StatusCode, Not(Equals), http.StatusOK)
+		} else {
+			c.Check(resp.StatusCode, Equals, t.expectStatus)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Check(err, IsNil)
+		resp.Body.Close()
+		if t.expectStatus == http.StatusOK {
+			c.Check(string(body), Matches, fmt.Sprintf(`^%s\+%d(\+.+)?$`, hash, len(content)))
+		}
+	}
+}
+
+// readFlagger is an io.Reader that records whether it has been read.
+type readFlagger struct {
+	io.Reader
+	read bool
+}
+
+func (rf *readFlagger) Read(p []byte) (int, error) {
+	rf.read = true
+	return rf.Reader.Read(p)
+}
+
+func (s *ServerRequiredSuite) TestPutExpectContinue(c *C) {
+	runProxy(c, false, false)
+	defer closeListener()
+
+	content := []byte("TestPutExpectContinue")
+	hash := fmt.Sprintf("%x", md5.Sum(content))
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+
+	for _, t := range []struct {
+		token        string
+		expectStatus int
+		expectRead   bool
+	}{
+		{"bogus-token", http.StatusForbidden, false},
+		{arvadostest.ActiveToken, http.StatusOK, true},
+	} {
+		body := &readFlagger{Reader: bytes.NewReader(content)}
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s+%d", listeners[0].Addr().String(), hash, len(content)), body)
+		c.Assert(err, IsNil)
+		req.ContentLength = int64(len(content))
+		req.Header.Set("Authorization", "OAuth2 "+t.token)
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, t.expectStatus)
+		c.Check(body.read, Equals, t.expectRead)
+	}
+}
+
 func (s *ServerRequiredSuite) TestManyFailedPuts(c *C) {
 	kc := runProxy(c, false, false)
 	defer closeListener()
@@ -421,7 +512,7 @@ func (s *ServerRequiredSuite) TestCorsHeaders(c *C) {
 	{
 		client := http.Client{}
 		req, err := http.NewRequest("OPTIONS",
-			fmt.Sprintf("http://%s/%x+3", listener.Addr().String(), md5.Sum([]byte("foo"))),
+			fmt.Sprintf("http://%s/%x+3", listeners[0].Addr().String(), md5.Sum([]byte("foo"))),
 			nil)
 		c.Assert(err, IsNil)
 		req.Header.Add("Access-Control-Request-Method", "PUT")
@@ -436,11 +527,30 @@ func (s *ServerRequiredSuite) TestCorsHeaders(c *C) {
 		c.Check(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
 	}
 
+	// Preflight for GET requests, including index requests
+	for _, path := range []string{
+		fmt.Sprintf("/%x+3", md5.Sum([]byte("foo"))),
+		fmt.Sprintf("/%x+3+Afakesignature@12345678", md5.Sum([]byte("foo"))),
+		"/index",
+		"/index/acbd",
+	} {
+		req, err := http.NewRequest("OPTIONS", "http://"+listeners[0].Addr().String()+path, nil)
+		c.Assert(err, IsNil)
+		req.Header.Add("Access-Control-Request-Method", "GET")
+		req.Header.Add("Access-Control-Request-Headers", "Authorization, Range")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, http.StatusOK, Commentf("path %s", path))
+		c.Check(resp.Header.Get("Access-Control-Allow-Methods"), Equals, "GET, HEAD, POST, PUT, OPTIONS")
+		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Matches, `.*\bRange\b.*`)
+	}
+
 	{
 		resp, err := http.Get(
-			fmt.Sprintf("http://%s/%x+3", listener.Addr().String(), md5.Sum([]byte("foo"))))
+			fmt.Sprintf("http://%s/%x+3", listeners[0].Addr().String(), md5.Sum([]byte("foo"))))
 		c.Check(err, Equals, nil)
-		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas")
+		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, Range, X-Keep-Desired-Replicas")
 		c.Check(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
 	}
 }
@@ -452,7 +562,7 @@ func (s *ServerRequiredSuite) TestPostWithoutHash(c *C) {
 	{
 		client := http.Client{}
 		req, err := http.NewRequest("POST",
-			"http://"+listener.Addr().String()+"/",
+			"http://"+listeners[0].Addr().String()+"/",
 			strings.NewReader("qux"))
 		c.Check(err, IsNil)
 		req.Header.Add("Authorization", "OAuth2 "+arvadostest.ActiveToken)
@@ -669,10 +779,11 @@ func (s *ServerRequiredSuite) TestPing(c *C) {
 	kc := runProxy(c, false, false)
 	defer closeListener()
 
-	rtr := MakeRESTRouter(kc, 10*time.Second, arvadostest.ManagementToken)
+	rtr, err := MakeRESTRouter(kc, 10*time.Second, &arvados.Cluster{ManagementToken: arvadostest.ManagementToken})
+	c.Assert(err, IsNil)
 
 	req, err := http.NewRequest("GET",
-		"http://"+listener.Addr().String()+"/_health/ping",
+		"http://"+listeners[0].Addr().String()+"/_health/ping",
 		nil)
 	c.Assert(err, IsNil)
 	req.Header.Set("Authorization", "Bearer "+arvadostest.ManagementToken)
@@ -682,3 +793,28 @@ func (s *ServerRequiredSuite) TestPing(c *C) {
 	c.Check(resp.Code, Equals, 200)
 	c.Assert(resp.Body.String(), Matches, `{"health":"OK"}\n?`)
 }
+
+func (s *SignatureSuite) TestCheckSignature(c *C) {
+	key := []byte("zfhgfenhffzltr9dixws36j1yhksjoll2grmku38mi7yxd66h5j4q9w4jzanezacp8s6q0ro3hxakfye02152hncy6zml2ed0uc")
+	ttl := 2 * time.Hour
+	tok := "v2/zzzzz-gj3su-000000000000000/abc123"
+	hash := "acbd18db4cc2f85cedef654fccc4a4d8+3"
+	h := &proxyHandler{blobSigningKey: key, blobSigningTTL: ttl}
+	for _, trial := range []struct {
+		locator string
+		expect  error
+	}{
+		{keepclient.SignLocator(hash, tok, time.Now().Add(time.Hour), ttl, key), nil},
+		{keepclient.SignLocator(hash, tok, time.Now().Add(-time.Hour), ttl, key), errSignatureExpired},
+		{keepclient.SignLocator(hash, "v2/zzzzz-gj3su-000000000000000/xyzzy", time.Now().Add(time.Hour), ttl, key), errSignatureInvalid},
+		{hash, errSignatureMissing},
+		// Remote blocks are signed by the remote cluster.
+		{hash + "+Rzzzzz-0123456789abcdef", nil},
+	} {
+		c.Check(h.checkSignature(trial.locator, tok), Equals, trial.expect, Commentf("%s", trial.locator))
+	}
+
+	// Blob signing disabled
+	h = &proxyHandler{}
+	c.Check(h.checkSignature(hash, tok), IsNil)
+}
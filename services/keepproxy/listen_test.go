@@ -0,0 +1,291 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ListenSuite{})
+
+// Tests that don't need any Arvados services
+type ListenSuite struct{}
+
+func (s *ListenSuite) cluster(urls ...string) *arvados.Cluster {
+	cluster := &arvados.Cluster{}
+	cluster.Services.Keepproxy.InternalURLs = map[arvados.URL]arvados.ServiceInstance{}
+	for _, u := range urls {
+		cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "http", Host: u}] = arvados.ServiceInstance{}
+	}
+	return cluster
+}
+
+// writeSelfSignedCert writes a self-signed certificate for
+// 127.0.0.1 to dir, and configures cluster to use it.
+func (s *ListenSuite) writeSelfSignedCert(c *C, dir string, cluster *arvados.Cluster) {
+	cluster.TLS.Certificate, cluster.TLS.Key = s.writeCert(c, dir, 1)
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 with the
+// given serial number to dir, and returns the certificate and key
+// file URLs.
+func (s *ListenSuite) writeCert(c *C, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certFile := filepath.Join(dir, fmt.Sprintf("cert%d.pem", serial))
+	keyFile := filepath.Join(dir, fmt.Sprintf("key%d.pem", serial))
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	c.Assert(err, IsNil)
+	return "file://" + certFile, "file://" + keyFile
+}
+
+func (s *ListenSuite) TestMultipleListeners(c *C) {
+	addrs := []string{"127.0.0.1:0", "192.0.2.1:25107"}
+	if ln, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		ln.Close()
+		addrs = append(addrs, "[::1]:0")
+	} else {
+		c.Logf("skipping IPv6 listener: %s", err)
+	}
+	cluster := s.cluster(addrs...)
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "https", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{}
+	s.writeSelfSignedCert(c, c.MkDir(), cluster)
+
+	lns, _, err := listen(ctxlog.TestLogger(c), cluster)
+	c.Assert(err, IsNil)
+	// 192.0.2.1 is not an address on this host
+	c.Assert(lns, HasLen, len(addrs))
+
+	stop := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- serve(lns, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}), stop)
+	}()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, ln := range lns {
+		scheme := "http"
+		if _, ok := ln.(*net.TCPListener); !ok {
+			scheme = "https"
+		}
+		resp, err := client.Get(scheme + "://" + ln.Addr().String() + "/")
+		if c.Check(err, IsNil) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			c.Check(string(body), Equals, "ok")
+		}
+	}
+	stop <- syscall.SIGTERM
+	c.Check(<-done, IsNil)
+}
+
+func (s *ListenSuite) TestPerListenerTLS(c *C) {
+	dir := c.MkDir()
+	cluster := s.cluster()
+	s.writeSelfSignedCert(c, dir, cluster)
+	cert2, key2 := s.writeCert(c, dir, 2)
+	defaultURL := arvados.URL{Scheme: "https", Host: "127.0.0.1:0"}
+	customURL := arvados.URL{Scheme: "https", Host: "localhost:0"}
+	cluster.Services.Keepproxy.InternalURLs[defaultURL] = arvados.ServiceInstance{}
+	cluster.Services.Keepproxy.InternalURLs[customURL] = arvados.ServiceInstance{
+		TLSCertificate: cert2,
+		TLSKey:         key2,
+		TLSMinVersion:  "1.3",
+	}
+
+	lns, urls, err := listen(ctxlog.TestLogger(c), cluster)
+	c.Assert(err, IsNil)
+	c.Assert(lns, HasLen, 2)
+	stop := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- serve(lns, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), stop)
+	}()
+	for i, u := range urls {
+		expectSerial, expectMinVersion := int64(1), uint16(tls.VersionTLS12)
+		if u == customURL {
+			expectSerial, expectMinVersion = 2, tls.VersionTLS13
+		}
+		conn, err := tls.Dial("tcp", lns[i].Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if c.Check(err, IsNil) {
+			c.Check(conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), Equals, expectSerial, Commentf("%s", u))
+			conn.Close()
+		}
+		conn, err = tls.Dial("tcp", lns[i].Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+		if expectMinVersion == tls.VersionTLS12 {
+			if c.Check(err, IsNil, Commentf("%s", u)) {
+				conn.Close()
+			}
+		} else {
+			c.Check(err, NotNil, Commentf("%s", u))
+		}
+	}
+	stop <- syscall.SIGTERM
+	c.Check(<-done, IsNil)
+
+	cluster.Services.Keepproxy.InternalURLs[customURL] = arvados.ServiceInstance{TLSMinVersion: "1.1"}
+	_, _, err = listen(ctxlog.TestLogger(c), cluster)
+	c.Check(err, ErrorMatches, `cannot listen at https://localhost:0.*unsupported TLSMinVersion "1.1".*`)
+}
+
+func (s *ListenSuite) TestNoLocalAddress(c *C) {
+	_, _, err := listen(ctxlog.TestLogger(c), s.cluster("192.0.2.1:25107"))
+	c.Check(err, ErrorMatches, `none of the configured .* is an address on this host`)
+}
+
+func (s *ListenSuite) TestLocalReplicas(c *C) {
+	cluster := s.cluster()
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "http", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{Zone: "east"}
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "http", Host: "192.0.2.1:25107"}] = arvados.ServiceInstance{Zone: "west"}
+	cluster.Services.Keepstore.InternalURLs = map[arvados.URL]arvados.ServiceInstance{
+		{Scheme: "http", Host: "keep0.example:25107", Path: "/"}: {Zone: "east"},
+		{Scheme: "http", Host: "keep1.example:25107", Path: "/"}: {Zone: "west"},
+		{Scheme: "http", Host: "keep2.example:25107", Path: "/"}: {Zone: "east"},
+		{Scheme: "http", Host: "keep3.example:25107", Path: "/"}: {},
+	}
+	lns, urls, err := listen(ctxlog.TestLogger(c), cluster)
+	c.Assert(err, IsNil)
+	defer lns[0].Close()
+	c.Check(urls, DeepEquals, []arvados.URL{{Scheme: "http", Host: "127.0.0.1:0"}})
+
+	kc := &keepclient.KeepClient{}
+	setupLocalReplicas(ctxlog.TestLogger(c), kc, cluster, urls)
+	c.Check(kc.PreferredWriteRoots, IsNil)
+	c.Check(kc.PreferredWriteReplicas, Equals, 0)
+
+	cluster.Collections.KeepproxyLocalReplicas = 1
+	setupLocalReplicas(ctxlog.TestLogger(c), kc, cluster, urls)
+	c.Check(kc.PreferredWriteRoots, DeepEquals, map[string]bool{
+		"http://keep0.example:25107": true,
+		"http://keep2.example:25107": true,
+	})
+	c.Check(kc.PreferredWriteReplicas, Equals, 1)
+
+	// No zone configured for the local keepproxy URL
+	kc = &keepclient.KeepClient{}
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "http", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{}
+	setupLocalReplicas(ctxlog.TestLogger(c), kc, cluster, urls)
+	c.Check(kc.PreferredWriteRoots, IsNil)
+	c.Check(kc.PreferredWriteReplicas, Equals, 0)
+}
+
+func (s *ListenSuite) TestLocalityAwareReads(c *C) {
+	cluster := s.cluster()
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "http", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{Zone: "east", Rack: "r1"}
+	cluster.Services.Keepstore.InternalURLs = map[arvados.URL]arvados.ServiceInstance{
+		{Scheme: "http", Host: "keep0.example:25107", Path: "/"}: {Zone: "east", Rack: "r1"},
+		{Scheme: "http", Host: "keep1.example:25107", Path: "/"}: {Zone: "west"},
+		{Scheme: "http", Host: "keep2.example:25107", Path: "/"}: {},
+	}
+	urls := []arvados.URL{{Scheme: "http", Host: "127.0.0.1:0"}}
+
+	kc := &keepclient.KeepClient{}
+	setupLocalityAwareReads(ctxlog.TestLogger(c), kc, cluster, urls)
+	c.Check(kc.ClientLocality, Equals, keepclient.Locality{})
+	c.Check(kc.ServiceLocality, IsNil)
+
+	cluster.Collections.KeepproxyLocalityAwareReads = true
+	setupLocalityAwareReads(ctxlog.TestLogger(c), kc, cluster, urls)
+	c.Check(kc.ClientLocality, Equals, keepclient.Locality{Zone: "east", Rack: "r1"})
+	c.Check(kc.ServiceLocality, DeepEquals, map[string]keepclient.Locality{
+		"http://keep0.example:25107": {Zone: "east", Rack: "r1"},
+		"http://keep1.example:25107": {Zone: "west"},
+	})
+
+	// No zone configured for the local keepproxy URL
+	kc = &keepclient.KeepClient{}
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "http", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{Rack: "r1"}
+	setupLocalityAwareReads(ctxlog.TestLogger(c), kc, cluster, urls)
+	c.Check(kc.ServiceLocality, IsNil)
+}
+
+func (s *ListenSuite) TestTLSWithoutCertificate(c *C) {
+	cluster := s.cluster("127.0.0.1:0")
+	cluster.Services.Keepproxy.InternalURLs[arvados.URL{Scheme: "https", Host: "127.0.0.1:0"}] = arvados.ServiceInstance{}
+	_, _, err := listen(ctxlog.TestLogger(c), cluster)
+	c.Check(err, ErrorMatches, `cannot listen at https://127.0.0.1:0.*TLS.Key and TLS.Certificate.*`)
+}
+
+func (s *ListenSuite) TestGracefulShutdown(c *C) {
+	lns, _, err := listen(ctxlog.TestLogger(c), s.cluster("127.0.0.1:0", "127.0.0.2:0"))
+	c.Assert(err, IsNil)
+	c.Assert(lns, HasLen, 2)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	stop := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- serve(lns, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("ok"))
+		}), stop)
+	}()
+
+	got := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + lns[0].Addr().String() + "/")
+		c.Check(err, IsNil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		got <- string(body)
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+
+	// Wait for both listeners to stop accepting new connections.
+	for _, ln := range lns {
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				break
+			}
+			conn.Close()
+			if time.Now().After(deadline) {
+				c.Fatalf("still accepting connections at %s", ln.Addr())
+			}
+		}
+	}
+	select {
+	case err := <-done:
+		c.Fatalf("serve returned before active request finished: %v", err)
+	default:
+	}
+
+	close(release)
+	c.Check(<-got, Equals, "ok")
+	c.Check(<-done, IsNil)
+}
@@ -0,0 +1,155 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// permissionCacheSize is the maximum number of client tokens whose
+// permissions are remembered by a permissionChecker.
+const permissionCacheSize = 1000
+
+var errDownloadNotPermitted = errors.New("Downloading data through this keepproxy is not permitted for this client (see Collections.KeepproxyPermission config)")
+var errUploadNotPermitted = errors.New("Uploading data through this keepproxy is not permitted for this client (see Collections.KeepproxyPermission config)")
+
+// permissionChecker decides whether a client may download and/or
+// upload data through keepproxy, according to the
+// Collections.KeepproxyPermission config.
+type permissionChecker struct {
+	config arvados.KeepproxyPermissionConfig
+	ttl    time.Duration
+
+	lookupTokenUUID func(arv *arvadosclient.ArvadosClient) (string, error)
+	lookupUserUUID  func(arv *arvadosclient.ArvadosClient) (string, error)
+	canRead         func(arv *arvadosclient.ArvadosClient, uuid string) (bool, error)
+
+	cache *lru.TwoQueueCache // token => cachedPermission
+}
+
+type cachedPermission struct {
+	perm    arvados.UploadDownloadPermission
+	expires time.Time
+}
+
+func newPermissionChecker(config arvados.KeepproxyPermissionConfig) *permissionChecker {
+	cache, err := lru.New2Q(permissionCacheSize)
+	if err != nil {
+		panic(err)
+	}
+	return &permissionChecker{
+		config:          config,
+		ttl:             5 * time.Minute,
+		lookupTokenUUID: currentTokenUUID,
+		lookupUserUUID:  currentUserUUID,
+		canRead:         canReadGroup,
+		cache:           cache,
+	}
+}
+
+// Permission returns the permissions of the client whose token is
+// arv.ApiToken.
+func (pc *permissionChecker) Permission(arv *arvadosclient.ArvadosClient) (arvados.UploadDownloadPermission, error) {
+	if len(pc.config.ByUUID) == 0 {
+		// Avoid API calls when every client gets the
+		// default permissions.
+		return pc.config.Default, nil
+	}
+	if ent, ok := pc.cache.Get(arv.ApiToken); ok {
+		if ent := ent.(cachedPermission); time.Now().Before(ent.expires) {
+			return ent.perm, nil
+		}
+		pc.cache.Remove(arv.ApiToken)
+	}
+	perm, err := pc.lookup(arv)
+	if err != nil {
+		return perm, err
+	}
+	pc.cache.Add(arv.ApiToken, cachedPermission{perm: perm, expires: time.Now().Add(pc.ttl)})
+	return perm, nil
+}
+
+func (pc *permissionChecker) lookup(arv *arvadosclient.ArvadosClient) (arvados.UploadDownloadPermission, error) {
+	var perm arvados.UploadDownloadPermission
+	tokenUUID, err := pc.lookupTokenUUID(arv)
+	if err != nil {
+		return perm, err
+	}
+	if p, ok := pc.config.ByUUID[tokenUUID]; ok && tokenUUID != "" {
+		return p, nil
+	}
+	userUUID, err := pc.lookupUserUUID(arv)
+	if err != nil {
+		return perm, err
+	}
+	if p, ok := pc.config.ByUUID[userUUID]; ok && userUUID != "" {
+		return p, nil
+	}
+	var groups []string
+	for uuid := range pc.config.ByUUID {
+		if strings.Contains(uuid, "-j7d0g-") {
+			groups = append(groups, uuid)
+		}
+	}
+	sort.Strings(groups)
+	matched := false
+	for _, uuid := range groups {
+		ok, err := pc.canRead(arv, uuid)
+		if err != nil {
+			return perm, err
+		} else if !ok {
+			continue
+		}
+		matched = true
+		p := pc.config.ByUUID[uuid]
+		perm.Download = perm.Download || p.Download
+		perm.Upload = perm.Upload || p.Upload
+	}
+	if !matched {
+		return pc.config.Default, nil
+	}
+	return perm, nil
+}
+
+// isNotPermitted returns true if err is an API response indicating
+// the requested record does not exist or cannot be accessed with
+// the client's token (e.g., a token scoped for read-only access).
+func isNotPermitted(err error) bool {
+	apierr, ok := err.(arvadosclient.APIServerError)
+	return ok && (apierr.HttpStatusCode == 403 || apierr.HttpStatusCode == 404)
+}
+
+func currentTokenUUID(arv *arvadosclient.ArvadosClient) (string, error) {
+	var auth arvados.APIClientAuthorization
+	err := arv.Call("GET", "api_client_authorizations", "", "current", nil, &auth)
+	if isNotPermitted(err) {
+		return "", nil
+	}
+	return auth.UUID, err
+}
+
+func currentUserUUID(arv *arvadosclient.ArvadosClient) (string, error) {
+	var user arvados.User
+	err := arv.Call("GET", "users", "", "current", nil, &user)
+	if isNotPermitted(err) {
+		return "", nil
+	}
+	return user.UUID, err
+}
+
+func canReadGroup(arv *arvadosclient.ArvadosClient, uuid string) (bool, error) {
+	err := arv.Call("GET", "groups", uuid, "", arvadosclient.Dict{"select": []string{"uuid"}}, nil)
+	if isNotPermitted(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,132 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PermissionSuite{})
+
+// Tests that don't need any Arvados services
+type PermissionSuite struct{}
+
+type stubIdentity struct {
+	tokenUUID string
+	userUUID  string
+	groups    map[string]bool
+	calls     int
+}
+
+func (s *PermissionSuite) checker(config arvados.KeepproxyPermissionConfig, ids map[string]*stubIdentity) *permissionChecker {
+	pc := newPermissionChecker(config)
+	pc.lookupTokenUUID = func(arv *arvadosclient.ArvadosClient) (string, error) {
+		id, ok := ids[arv.ApiToken]
+		if !ok {
+			return "", errors.New("API unavailable")
+		}
+		id.calls++
+		return id.tokenUUID, nil
+	}
+	pc.lookupUserUUID = func(arv *arvadosclient.ArvadosClient) (string, error) {
+		return ids[arv.ApiToken].userUUID, nil
+	}
+	pc.canRead = func(arv *arvadosclient.ArvadosClient, uuid string) (bool, error) {
+		return ids[arv.ApiToken].groups[uuid], nil
+	}
+	return pc
+}
+
+func (s *PermissionSuite) TestDefaultOnly(c *C) {
+	pc := s.checker(arvados.KeepproxyPermissionConfig{
+		Default: arvados.UploadDownloadPermission{Download: true},
+	}, nil)
+	perm, err := pc.Permission(&arvadosclient.ArvadosClient{ApiToken: "anytoken"})
+	c.Check(err, IsNil)
+	c.Check(perm, Equals, arvados.UploadDownloadPermission{Download: true})
+}
+
+func (s *PermissionSuite) TestByUUID(c *C) {
+	ro := arvados.UploadDownloadPermission{Download: true}
+	wo := arvados.UploadDownloadPermission{Upload: true}
+	rw := arvados.UploadDownloadPermission{Download: true, Upload: true}
+	ids := map[string]*stubIdentity{
+		"tokenA":    {tokenUUID: "zzzzz-gj3su-aaaaaaaaaaaaaaa", userUUID: "zzzzz-tpzed-aaaaaaaaaaaaaaa"},
+		"tokenB":    {tokenUUID: "zzzzz-gj3su-bbbbbbbbbbbbbbb", userUUID: "zzzzz-tpzed-aaaaaaaaaaaaaaa"},
+		"tokenC":    {tokenUUID: "zzzzz-gj3su-ccccccccccccccc", userUUID: "zzzzz-tpzed-ccccccccccccccc", groups: map[string]bool{"zzzzz-j7d0g-ingestiongroup1": true}},
+		"tokenD":    {tokenUUID: "zzzzz-gj3su-ddddddddddddddd", userUUID: "zzzzz-tpzed-ddddddddddddddd", groups: map[string]bool{"zzzzz-j7d0g-ingestiongroup1": true, "zzzzz-j7d0g-readersgroup111": true}},
+		"tokenE":    {tokenUUID: "zzzzz-gj3su-eeeeeeeeeeeeeee", userUUID: "zzzzz-tpzed-eeeeeeeeeeeeeee"},
+		"sharetok1": {},
+	}
+	pc := s.checker(arvados.KeepproxyPermissionConfig{
+		Default: ro,
+		ByUUID: map[string]arvados.UploadDownloadPermission{
+			"zzzzz-gj3su-aaaaaaaaaaaaaaa": rw,
+			"zzzzz-tpzed-aaaaaaaaaaaaaaa": wo,
+			"zzzzz-j7d0g-ingestiongroup1": wo,
+			"zzzzz-j7d0g-readersgroup111": ro,
+		},
+	}, ids)
+	for token, expect := range map[string]arvados.UploadDownloadPermission{
+		"tokenA":    rw, // token entry overrides user entry
+		"tokenB":    wo, // user entry
+		"tokenC":    wo, // group entry
+		"tokenD":    rw, // union of group entries
+		"tokenE":    ro, // default
+		"sharetok1": ro, // token/user lookups not permitted
+	} {
+		perm, err := pc.Permission(&arvadosclient.ArvadosClient{ApiToken: token})
+		c.Check(err, IsNil)
+		c.Check(perm, Equals, expect, Commentf("token %s", token))
+	}
+
+	// Results are cached
+	_, err := pc.Permission(&arvadosclient.ArvadosClient{ApiToken: "tokenA"})
+	c.Check(err, IsNil)
+	c.Check(ids["tokenA"].calls, Equals, 1)
+
+	// Errors are returned, not cached
+	_, err = pc.Permission(&arvadosclient.ArvadosClient{ApiToken: "unknown"})
+	c.Check(err, ErrorMatches, "API unavailable")
+	c.Check(pc.cache.Len(), Equals, len(ids))
+}
+
+func (s *PermissionSuite) TestCacheSize(c *C) {
+	ids := map[string]*stubIdentity{}
+	for i := 0; i < permissionCacheSize*2; i++ {
+		ids[fmt.Sprintf("token%d", i)] = &stubIdentity{}
+	}
+	pc := s.checker(arvados.KeepproxyPermissionConfig{
+		ByUUID: map[string]arvados.UploadDownloadPermission{
+			"zzzzz-tpzed-aaaaaaaaaaaaaaa": {Upload: true},
+		},
+	}, ids)
+	for token := range ids {
+		_, err := pc.Permission(&arvadosclient.ArvadosClient{ApiToken: token})
+		c.Check(err, IsNil)
+	}
+	c.Check(pc.cache.Len(), Equals, permissionCacheSize)
+}
+
+func (s *PermissionSuite) TestCacheExpiry(c *C) {
+	ids := map[string]*stubIdentity{"tokenA": {}}
+	pc := s.checker(arvados.KeepproxyPermissionConfig{
+		ByUUID: map[string]arvados.UploadDownloadPermission{
+			"zzzzz-tpzed-aaaaaaaaaaaaaaa": {Upload: true},
+		},
+	}, ids)
+	pc.ttl = -time.Second
+	for i := 0; i < 3; i++ {
+		_, err := pc.Permission(&arvadosclient.ArvadosClient{ApiToken: "tokenA"})
+		c.Check(err, IsNil)
+	}
+	c.Check(ids["tokenA"].calls, Equals, 3)
+}
@@ -0,0 +1,290 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upper bounds of the block size histogram buckets. The last one is
+// keepclient.BLOCKSIZE, so every block fits in some bucket.
+var blockSizeBuckets = []int64{1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26}
+
+// Number of slots the rolling window is divided into. Traffic ages
+// out of the window one slot at a time.
+const trafficSlots = 60
+
+// Shortest supported window (one second per slot). A shorter
+// configured window is rounded up to this.
+const minTrafficWindow = trafficSlots * time.Second
+
+// trafficStats keeps a histogram of block sizes, and the number of
+// bytes transferred by each client token and address, over a rolling
+// window (see Collections.KeepproxyTrafficStats). A nil *trafficStats
+// discards all records.
+type trafficStats struct {
+	window     time.Duration
+	topTalkers int
+
+	// lookupTokenUUID returns the UUID of a (non-v2) token. It
+	// is only called for the top talkers when a report is
+	// generated.
+	lookupTokenUUID func(tok string) (string, error)
+	now             func() time.Time
+
+	mtx   sync.Mutex
+	slots [trafficSlots]trafficSlot
+}
+
+type trafficSlot struct {
+	start   time.Time
+	sizes   map[string][]int64 // method -> count per bucket
+	bytes   map[string][]int64 // method -> bytes per bucket
+	byToken map[string]*talker
+	byAddr  map[string]*talker
+}
+
+type talker struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// trafficReport is the response to a "GET /_traffic" request.
+type trafficReport struct {
+	Since      time.Time                   `json:"since"`
+	Until      time.Time                   `json:"until"`
+	BlockSizes map[string][]blockSizeCount `json:"block_sizes"`
+	TopTokens  []talker                    `json:"top_tokens"`
+	TopAddrs   []talker                    `json:"top_addresses"`
+}
+
+type blockSizeCount struct {
+	MaxBytes int64 `json:"max_bytes"`
+	Blocks   int64 `json:"blocks"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// newTrafficStats returns a trafficStats for the given config, or nil
+// if traffic stats are disabled.
+func newTrafficStats(cfg arvados.KeepproxyTrafficStatsConfig, lookupTokenUUID func(string) (string, error)) *trafficStats {
+	if cfg.Window <= 0 {
+		return nil
+	}
+	window := cfg.Window.Duration()
+	if window < minTrafficWindow {
+		window = minTrafficWindow
+	}
+	return &trafficStats{
+		window:          window,
+		topTalkers:      cfg.TopTalkers,
+		lookupTokenUUID: lookupTokenUUID,
+		now:             time.Now,
+	}
+}
+
+// Record adds a successful block transfer of the given size to the
+// current slot. tok is the client's API token.
+func (ts *trafficStats) Record(req *http.Request, tok string, size int64) {
+	if ts == nil {
+		return
+	}
+	bucket := sort.Search(len(blockSizeBuckets), func(i int) bool { return blockSizeBuckets[i] >= size })
+	if bucket == len(blockSizeBuckets) {
+		bucket--
+	}
+	method := req.Method
+	if method == "POST" {
+		method = "PUT"
+	}
+	addr := clientAddress(req)
+
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	slot := ts.currentSlot()
+	if slot.sizes[method] == nil {
+		slot.sizes[method] = make([]int64, len(blockSizeBuckets))
+		slot.bytes[method] = make([]int64, len(blockSizeBuckets))
+	}
+	slot.sizes[method][bucket]++
+	slot.bytes[method][bucket] += size
+	addTalker(slot.byToken, tok, 1, size)
+	addTalker(slot.byAddr, addr, 1, size)
+}
+
+func addTalker(talkers map[string]*talker, key string, requests, bytes int64) {
+	t := talkers[key]
+	if t == nil {
+		t = &talker{Key: key}
+		talkers[key] = t
+	}
+	t.Requests += requests
+	t.Bytes += bytes
+}
+
+// currentSlot returns the slot for the current time, clearing it
+// first if it was last used in an earlier window. Caller must hold
+// ts.mtx.
+func (ts *trafficStats) currentSlot() *trafficSlot {
+	slotDuration := ts.window / trafficSlots
+	start := ts.now().Truncate(slotDuration)
+	slot := &ts.slots[(start.UnixNano()/int64(slotDuration))%trafficSlots]
+	if !slot.start.Equal(start) {
+		*slot = trafficSlot{
+			start:   start,
+			sizes:   map[string][]int64{},
+			bytes:   map[string][]int64{},
+			byToken: map[string]*talker{},
+			byAddr:  map[string]*talker{},
+		}
+	}
+	return slot
+}
+
+// Report returns the block size histogram and top talkers for the
+// current window.
+func (ts *trafficStats) Report() trafficReport {
+	now := ts.now()
+	rpt := trafficReport{
+		Since:      now.Add(-ts.window),
+		Until:      now,
+		BlockSizes: map[string][]blockSizeCount{},
+	}
+	byToken := map[string]*talker{}
+	byAddr := map[string]*talker{}
+	ts.mtx.Lock()
+	for _, slot := range ts.slots {
+		if !slot.start.After(rpt.Since) {
+			continue
+		}
+		for method, counts := range slot.sizes {
+			hist := rpt.BlockSizes[method]
+			if hist == nil {
+				hist = make([]blockSizeCount, len(blockSizeBuckets))
+				for i, max := range blockSizeBuckets {
+					hist[i].MaxBytes = max
+				}
+				rpt.BlockSizes[method] = hist
+			}
+			for i, n := range counts {
+				hist[i].Blocks += n
+				hist[i].Bytes += slot.bytes[method][i]
+			}
+		}
+		for key, t := range slot.byToken {
+			addTalker(byToken, key, t.Requests, t.Bytes)
+		}
+		for key, t := range slot.byAddr {
+			addTalker(byAddr, key, t.Requests, t.Bytes)
+		}
+	}
+	ts.mtx.Unlock()
+
+	rpt.TopTokens = ts.top(byToken)
+	for i := range rpt.TopTokens {
+		rpt.TopTokens[i].Key = ts.tokenUUID(rpt.TopTokens[i].Key)
+	}
+	rpt.TopAddrs = ts.top(byAddr)
+	return rpt
+}
+
+// top returns the talkers with the most bytes transferred, up to
+// ts.topTalkers.
+func (ts *trafficStats) top(talkers map[string]*talker) []talker {
+	top := make([]talker, 0, len(talkers))
+	for _, t := range talkers {
+		top = append(top, *t)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > ts.topTalkers {
+		top = top[:ts.topTalkers]
+	}
+	return top
+}
+
+// tokenUUID returns the UUID of the given token, so tokens
+// themselves are never reported.
+func (ts *trafficStats) tokenUUID(tok string) string {
+	if strings.HasPrefix(tok, "v2/") {
+		if parts := strings.Split(tok, "/"); len(parts) >= 3 {
+			return parts[1]
+		}
+	}
+	uuid, err := ts.lookupTokenUUID(tok)
+	if err != nil || uuid == "" {
+		if err != nil {
+			log.Printf("error looking up token UUID for traffic report: %s", err)
+		}
+		return "(unknown token)"
+	}
+	return uuid
+}
+
+// ServeHTTP responds to a "GET /_traffic" request with a JSON
+// report.
+func (ts *trafficStats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if ts == nil {
+		http.Error(w, "Traffic stats are not enabled on this keepproxy (see Collections.KeepproxyTrafficStats config)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ts.Report())
+}
+
+// runLogger logs a summary of the current window's traffic at the
+// given interval. It does not return.
+func (ts *trafficStats) runLogger(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		rpt := ts.Report()
+		var methods []string
+		for method := range rpt.BlockSizes {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			var counts []string
+			for _, b := range rpt.BlockSizes[method] {
+				counts = append(counts, fmt.Sprintf("<=%dK:%d", b.MaxBytes>>10, b.Blocks))
+			}
+			log.Printf("traffic: %s block sizes in last %v: %s", method, ts.window, strings.Join(counts, " "))
+		}
+		for _, t := range rpt.TopTokens {
+			log.Printf("traffic: top token %s: %d requests, %d bytes", t.Key, t.Requests, t.Bytes)
+		}
+		for _, t := range rpt.TopAddrs {
+			log.Printf("traffic: top address %s: %d requests, %d bytes", t.Key, t.Requests, t.Bytes)
+		}
+	}
+}
+
+// clientAddress returns the IP address of the client that sent req.
+// If the request was forwarded by a reverse proxy, this is the last
+// address in the X-Forwarded-For header, i.e., the one added by the
+// proxy itself, since earlier entries are supplied by the client and
+// can't be trusted.
+func clientAddress(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:])
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
@@ -0,0 +1,159 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TrafficSuite{})
+
+// Tests that don't need any Arvados services
+type TrafficSuite struct {
+	now time.Time
+}
+
+func (s *TrafficSuite) newStats(c *C) *trafficStats {
+	s.now = time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := newTrafficStats(arvados.KeepproxyTrafficStatsConfig{
+		Window:     arvados.Duration(time.Hour),
+		TopTalkers: 2,
+	}, func(tok string) (string, error) {
+		if tok == "oldtoken" {
+			return "zzzzz-gj3su-000000000000001", nil
+		}
+		return "", errors.New("API unavailable")
+	})
+	c.Assert(ts, NotNil)
+	ts.now = func() time.Time { return s.now }
+	return ts
+}
+
+func (s *TrafficSuite) request(method, remoteAddr string) *http.Request {
+	req := httptest.NewRequest(method, "/", nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func (s *TrafficSuite) TestDisabled(c *C) {
+	ts := newTrafficStats(arvados.KeepproxyTrafficStatsConfig{}, nil)
+	c.Check(ts, IsNil)
+	// Recording to a nil trafficStats is a no-op.
+	ts.Record(s.request("GET", "10.0.0.1:1234"), "oldtoken", 1)
+}
+
+func (s *TrafficSuite) TestShortWindow(c *C) {
+	for _, window := range []time.Duration{time.Nanosecond, 59 * time.Nanosecond, time.Second} {
+		ts := newTrafficStats(arvados.KeepproxyTrafficStatsConfig{Window: arvados.Duration(window)}, nil)
+		c.Assert(ts, NotNil)
+		c.Check(ts.window, Equals, time.Minute)
+		ts.Record(s.request("GET", "10.0.0.1:1234"), "oldtoken", 1)
+		c.Check(ts.Report().BlockSizes["GET"][0].Blocks, Equals, int64(1))
+	}
+}
+
+func (s *TrafficSuite) TestReport(c *C) {
+	ts := s.newStats(c)
+	ts.Record(s.request("GET", "10.0.0.1:1234"), "oldtoken", 1000)
+	ts.Record(s.request("GET", "10.0.0.1:1235"), "oldtoken", 1<<20)
+	ts.Record(s.request("POST", "10.0.0.2:1234"), "v2/zzzzz-gj3su-000000000000002/secret", 64<<20)
+	s.now = s.now.Add(10 * time.Minute)
+	ts.Record(s.request("PUT", "10.0.0.3:1234"), "v2/zzzzz-gj3su-000000000000003/secret", 3)
+	ts.Record(s.request("GET", "10.0.0.3:1234"), "badtoken", 5)
+
+	rpt := ts.Report()
+	c.Check(rpt.Until, Equals, s.now)
+	c.Check(rpt.Since, Equals, s.now.Add(-time.Hour))
+	c.Assert(rpt.BlockSizes["GET"], HasLen, len(blockSizeBuckets))
+	c.Check(rpt.BlockSizes["GET"][0], Equals, blockSizeCount{MaxBytes: 1 << 16, Blocks: 2, Bytes: 1005})
+	c.Check(rpt.BlockSizes["GET"][2], Equals, blockSizeCount{MaxBytes: 1 << 20, Blocks: 1, Bytes: 1 << 20})
+	c.Check(rpt.BlockSizes["PUT"][0], Equals, blockSizeCount{MaxBytes: 1 << 16, Blocks: 1, Bytes: 3})
+	c.Check(rpt.BlockSizes["PUT"][5], Equals, blockSizeCount{MaxBytes: 1 << 26, Blocks: 1, Bytes: 64 << 20})
+	c.Check(rpt.BlockSizes["POST"], IsNil)
+
+	// Tokens are reported by UUID.
+	c.Check(rpt.TopTokens, DeepEquals, []talker{
+		{Key: "zzzzz-gj3su-000000000000002", Requests: 1, Bytes: 64 << 20},
+		{Key: "zzzzz-gj3su-000000000000001", Requests: 2, Bytes: 1<<20 + 1000},
+	})
+	c.Check(rpt.TopAddrs, DeepEquals, []talker{
+		{Key: "10.0.0.2", Requests: 1, Bytes: 64 << 20},
+		{Key: "10.0.0.1", Requests: 2, Bytes: 1<<20 + 1000},
+	})
+
+	// Traffic ages out of the window.
+	s.now = s.now.Add(55 * time.Minute)
+	rpt = ts.Report()
+	c.Check(rpt.BlockSizes["PUT"][0].Blocks, Equals, int64(1))
+	c.Check(rpt.BlockSizes["PUT"][5].Blocks, Equals, int64(0))
+	c.Check(rpt.BlockSizes["GET"][0], Equals, blockSizeCount{MaxBytes: 1 << 16, Blocks: 1, Bytes: 5})
+	c.Check(rpt.TopTokens, DeepEquals, []talker{
+		{Key: "(unknown token)", Requests: 1, Bytes: 5},
+		{Key: "zzzzz-gj3su-000000000000003", Requests: 1, Bytes: 3},
+	})
+
+	// A slot is cleared when it's reused in a later window.
+	s.now = s.now.Add(time.Hour)
+	ts.Record(s.request("GET", "10.0.0.1:1234"), "oldtoken", 7)
+	rpt = ts.Report()
+	c.Check(rpt.BlockSizes["GET"][0].Blocks, Equals, int64(1))
+	c.Check(rpt.BlockSizes["PUT"], IsNil)
+	c.Check(rpt.TopAddrs, DeepEquals, []talker{{Key: "10.0.0.1", Requests: 1, Bytes: 7}})
+}
+
+func (s *TrafficSuite) TestClientAddress(c *C) {
+	req := s.request("GET", "10.0.0.1:1234")
+	c.Check(clientAddress(req), Equals, "10.0.0.1")
+	req.RemoteAddr = "[::1]:1234"
+	c.Check(clientAddress(req), Equals, "::1")
+	// The last X-Forwarded-For entry is added by the reverse
+	// proxy; earlier entries could be anything.
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 10.1.1.1")
+	c.Check(clientAddress(req), Equals, "10.1.1.1")
+}
+
+func (s *TrafficSuite) TestEndpoint(c *C) {
+	cluster := &arvados.Cluster{}
+	cluster.Collections.KeepproxyTrafficStats.Window = arvados.Duration(time.Hour)
+	cluster.Collections.KeepproxyTrafficStats.TopTalkers = 10
+	get := func(token string) *httptest.ResponseRecorder {
+		kc := &keepclient.KeepClient{Arvados: &arvadosclient.ArvadosClient{}}
+		rtr, err := MakeRESTRouter(kc, 10*time.Second, cluster)
+		c.Assert(err, IsNil)
+		req := httptest.NewRequest("GET", "/_traffic", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		rtr.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Management token not configured
+	c.Check(get("foo").Code, Equals, http.StatusForbidden)
+
+	cluster.ManagementToken = "mgmttoken"
+	c.Check(get("").Code, Equals, http.StatusUnauthorized)
+	c.Check(get("foo").Code, Equals, http.StatusForbidden)
+	resp := get("mgmttoken")
+	c.Check(resp.Code, Equals, http.StatusOK)
+	var rpt trafficReport
+	c.Check(json.Unmarshal(resp.Body.Bytes(), &rpt), IsNil)
+	c.Check(rpt.TopTokens, HasLen, 0)
+
+	cluster.Collections.KeepproxyTrafficStats.Window = 0
+	resp = get("mgmttoken")
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+	c.Check(resp.Body.String(), Matches, `Traffic stats are not enabled.*\n`)
+}
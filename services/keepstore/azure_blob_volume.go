@@ -541,6 +541,9 @@ func (v *AzureBlobVolume) Status() *VolumeStatus {
 	}
 }
 
+// placeholderStatus implements placeholderStatuser.
+func (v *AzureBlobVolume) placeholderStatus() {}
+
 // String returns a volume label, including the container name.
 func (v *AzureBlobVolume) String() string {
 	return fmt.Sprintf("azure-storage-container:%+q", v.ContainerName)
@@ -200,6 +200,35 @@ func (s *HandlerSuite) TestGetHandler(c *check.C) {
 		503, response)
 }
 
+func (s *HandlerSuite) TestGetHandlerRange(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+
+	vols := s.handler.volmgr.AllWritable()
+	err := vols[0].Put(context.Background(), TestHash, TestBlock)
+	c.Check(err, check.IsNil)
+
+	for _, trial := range []struct {
+		rangeHdr string
+		status   int
+		body     string
+	}{
+		{"bytes=2-5", http.StatusPartialContent, string(TestBlock[2:6])},
+		{"bytes=6-", http.StatusPartialContent, string(TestBlock[6:])},
+		{"bytes=1000-1001", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		comment := check.Commentf("Range: %s", trial.rangeHdr)
+		req, _ := http.NewRequest("GET", "/"+TestHash, nil)
+		req.Header.Set("Range", trial.rangeHdr)
+		resp := httptest.NewRecorder()
+		s.handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status, comment)
+		if trial.status == http.StatusPartialContent {
+			c.Check(resp.Body.String(), check.Equals, trial.body, comment)
+			c.Check(resp.Header().Get("Content-Length"), check.Equals, fmt.Sprintf("%d", len(trial.body)), comment)
+		}
+	}
+}
+
 // Test PutBlockHandler on the following situations:
 //   - no server key
 //   - with server key, authenticated request, unsigned locator
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"context"
 	"crypto/md5"
@@ -152,8 +153,14 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	resp.Header().Set("Content-Length", strconv.Itoa(size))
 	resp.Header().Set("Content-Type", "application/octet-stream")
+	if req.Header.Get("Range") != "" {
+		// Send only the requested part of the block (see
+		// keepclient.GetRange).
+		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(buf[:size]))
+		return
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(size))
 	resp.Write(buf[:size])
 }
 
@@ -330,7 +337,21 @@ func (rtr *router) handleIndex(resp http.ResponseWriter, req *http.Request) {
 
 // MountsHandler responds to "GET /mounts" requests.
 func (rtr *router) MountsHandler(resp http.ResponseWriter, req *http.Request) {
-	err := json.NewEncoder(resp).Encode(rtr.volmgr.Mounts())
+	// Add current space usage to copies of the mount records,
+	// rather than modifying the shared ones.
+	var mounts []VolumeMount
+	for _, mnt := range rtr.volmgr.Mounts() {
+		m := *mnt
+		if _, ok := m.Volume.(placeholderStatuser); ok {
+			// Don't report placeholder values as
+			// space usage.
+		} else if st := m.Status(); st != nil {
+			m.BytesFree = st.BytesFree
+			m.BytesUsed = st.BytesUsed
+		}
+		mounts = append(mounts, m)
+	}
+	err := json.NewEncoder(resp).Encode(mounts)
 	if err != nil {
 		httpserver.Error(resp, err.Error(), http.StatusInternalServerError)
 	}
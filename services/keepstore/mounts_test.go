@@ -10,7 +10,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
@@ -19,6 +21,8 @@ import (
 )
 
 func (s *HandlerSuite) TestMounts(c *check.C) {
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(2 * time.Hour)
+	s.cluster.Collections.BlobTrashLifetime = arvados.Duration(48 * time.Hour)
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
 
 	vols := s.handler.volmgr.AllWritable()
@@ -33,6 +37,11 @@ func (s *HandlerSuite) TestMounts(c *check.C) {
 		ReadOnly       bool            `json:"read_only"`
 		Replication    int             `json:"replication"`
 		StorageClasses map[string]bool `json:"storage_classes"`
+
+		BlobSigningTTL    arvados.Duration `json:"blob_signing_ttl"`
+		BlobTrashLifetime arvados.Duration `json:"blob_trash_lifetime"`
+		BytesFree         uint64           `json:"bytes_free"`
+		BytesUsed         uint64           `json:"bytes_used"`
 	}
 	c.Log(resp.Body.String())
 	err := json.Unmarshal(resp.Body.Bytes(), &mntList)
@@ -45,9 +54,29 @@ func (s *HandlerSuite) TestMounts(c *check.C) {
 		c.Check(m.ReadOnly, check.Equals, false)
 		c.Check(m.Replication, check.Equals, 1)
 		c.Check(m.StorageClasses, check.DeepEquals, map[string]bool{"default": true})
+		c.Check(m.BlobSigningTTL, check.Equals, arvados.Duration(2*time.Hour))
+		c.Check(m.BlobTrashLifetime, check.Equals, arvados.Duration(48*time.Hour))
+		c.Check(m.BytesUsed > 0, check.Equals, true)
+		c.Check(m.BytesFree+m.BytesUsed, check.Equals, uint64(1000000))
 	}
 	c.Check(mntList[0].UUID, check.Not(check.Equals), mntList[1].UUID)
 
+	// Volumes with placeholder Status values (like S3 and Azure)
+	// don't report space usage.
+	for _, mnt := range s.handler.volmgr.Mounts() {
+		mnt.Volume = placeholderStatusVolume{mnt.Volume}
+	}
+	resp = s.call("GET", "/mounts", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	mntList = nil
+	err = json.Unmarshal(resp.Body.Bytes(), &mntList)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(mntList), check.Equals, 2)
+	for _, m := range mntList {
+		c.Check(m.BytesFree, check.Equals, uint64(0))
+		c.Check(m.BytesUsed, check.Equals, uint64(0))
+	}
+
 	// Bad auth
 	for _, tok := range []string{"", "xyzzy"} {
 		resp = s.call("GET", "/mounts/"+mntList[1].UUID+"/blocks", tok, nil)
@@ -150,3 +179,9 @@ func (s *HandlerSuite) call(method, path, tok string, body []byte) *httptest.Res
 	s.handler.ServeHTTP(resp, req)
 	return resp
 }
+
+type placeholderStatusVolume struct {
+	Volume
+}
+
+func (placeholderStatusVolume) placeholderStatus() {}
@@ -713,6 +713,9 @@ func (v *S3Volume) Status() *VolumeStatus {
 	}
 }
 
+// placeholderStatus implements placeholderStatuser.
+func (v *S3Volume) placeholderStatus() {}
+
 // InternalStats returns bucket I/O and API call counters.
 func (v *S3Volume) InternalStats() interface{} {
 	return &v.bucket.stats
@@ -774,6 +774,9 @@ func (v *S3AWSVolume) Status() *VolumeStatus {
 	}
 }
 
+// placeholderStatus implements placeholderStatuser.
+func (v *S3AWSVolume) placeholderStatus() {}
+
 // InternalStats returns bucket I/O and API call counters.
 func (v *S3AWSVolume) InternalStats() interface{} {
 	return &v.bucket.stats
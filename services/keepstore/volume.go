@@ -332,6 +332,9 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 				ReadOnly:       cfgvol.ReadOnly || va.ReadOnly,
 				Replication:    repl,
 				StorageClasses: sc,
+
+				BlobSigningTTL:    cluster.Collections.BlobSigningTTL,
+				BlobTrashLifetime: cluster.Collections.BlobTrashLifetime,
 			},
 			Volume: vol,
 		}
@@ -408,3 +411,10 @@ type ioStats struct {
 type InternalStatser interface {
 	InternalStats() interface{}
 }
+
+// A placeholderStatuser is a Volume whose Status method returns
+// placeholder values, rather than the space actually used and
+// available, so the volume never seems full.
+type placeholderStatuser interface {
+	placeholderStatus()
+}
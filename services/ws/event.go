@@ -23,6 +23,10 @@ type eventSource interface {
 	NewSink() eventSink
 	DB() *sql.DB
 	DBHealth() error
+
+	// Publish sends an event that did not come from the logs
+	// table to all sinks.
+	Publish(*event)
 }
 
 type event struct {
@@ -7,18 +7,38 @@ package ws
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/stats"
 	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+// PostgreSQL notify channel for live log lines published by
+// crunch-run (see Publish). Unlike the "logs" channel, the payload is
+// the event itself, because there is no database row to retrieve.
+const liveLogsChannel = "live_logs"
+
+// Maximum size of a liveLogsChannel notification payload. PostgreSQL
+// rejects payloads of 8000 bytes or more.
+const liveLogsMaxPayload = 7900
+
+// liveLogPayload is the payload of a liveLogsChannel notification.
+type liveLogPayload struct {
+	ObjectUUID string    `json:"object_uuid"`
+	EventType  string    `json:"event_type"`
+	EventAt    time.Time `json:"event_at"`
+	Text       string    `json:"text"`
+}
+
 type pgEventSource struct {
 	DataSource   string
 	MaxOpenConns int
@@ -163,8 +183,8 @@ func (ps *pgEventSource) WaitReady() {
 	<-ps.ready
 }
 
-// Run listens for event notifications on the "logs" channel and sends
-// them to all subscribers.
+// Run listens for event notifications on the "logs" and "live_logs"
+// channels and sends them to all subscribers.
 func (ps *pgEventSource) Run() {
 	ps.Logger.Debug("pgEventSource Run starting")
 	defer ps.Logger.Debug("pgEventSource Run finished")
@@ -207,10 +227,12 @@ func (ps *pgEventSource) Run() {
 	ps.db = db
 
 	ps.pqListener = pq.NewListener(ps.DataSource, time.Second, time.Minute, ps.listenerProblem)
-	err = ps.pqListener.Listen("logs")
-	if err != nil {
-		ps.Logger.WithError(err).Error("pq Listen failed")
-		return
+	for _, channel := range []string{"logs", liveLogsChannel} {
+		err = ps.pqListener.Listen(channel)
+		if err != nil {
+			ps.Logger.WithError(err).Error("pq Listen failed")
+			return
+		}
 	}
 	defer ps.pqListener.Close()
 	ps.Logger.Debug("pq Listen setup done")
@@ -277,6 +299,30 @@ func (ps *pgEventSource) Run() {
 				ps.listenerProblem(-1, errors.New("pqListener Notify chan received nil event"))
 				continue
 			}
+			if pqEvent.Channel == liveLogsChannel {
+				var pl liveLogPayload
+				err := json.Unmarshal([]byte(pqEvent.Extra), &pl)
+				if err != nil {
+					ps.Logger.WithField("pqEvent", pqEvent).Error("bad notify payload")
+					continue
+				}
+				serial++
+				e := &event{
+					Received: time.Now(),
+					Serial:   serial,
+					logger:   ps.Logger,
+					logRow: &arvados.Log{
+						ObjectUUID: pl.ObjectUUID,
+						EventType:  pl.EventType,
+						EventAt:    &pl.EventAt,
+						CreatedAt:  &pl.EventAt,
+						Properties: map[string]interface{}{"text": pl.Text},
+					},
+				}
+				ps.eventsIn.Inc()
+				ps.queue <- e
+				continue
+			}
 			if pqEvent.Channel != "logs" {
 				ps.Logger.WithField("pqEvent", pqEvent).Error("unexpected notify from wrong channel")
 				continue
@@ -302,6 +348,74 @@ func (ps *pgEventSource) Run() {
 	}
 }
 
+// Publish sends an event that did not come from the logs table, like
+// a live log line sent by crunch-run, to all sinks -- including those
+// of other arvados-ws processes using the same database. The event's
+// logRow must be populated, since there is no database row to
+// retrieve.
+//
+// The event is sent as one or more notifications on the
+// "live_logs" channel, splitting its text at line boundaries if
+// needed to fit PostgreSQL's payload size limit, and delivered to
+// sinks by Run.
+func (ps *pgEventSource) Publish(e *event) {
+	ps.WaitReady()
+	if ps.db == nil {
+		return
+	}
+	row := e.Detail()
+	text, _ := row.Properties["text"].(string)
+	payloads, err := liveLogPayloads(liveLogPayload{
+		ObjectUUID: row.ObjectUUID,
+		EventType:  row.EventType,
+		EventAt:    *row.EventAt,
+	}, text)
+	if err != nil {
+		ps.Logger.WithError(err).Error("error encoding live log event")
+		return
+	}
+	for _, payload := range payloads {
+		_, err := ps.db.Exec(`SELECT pg_notify($1, $2)`, liveLogsChannel, payload)
+		if err != nil {
+			ps.Logger.WithError(err).Error("error sending live log notification")
+			return
+		}
+	}
+}
+
+// liveLogPayloads returns the notification payloads needed to send
+// the given text, split into chunks small enough for
+// liveLogsMaxPayload.
+func liveLogPayloads(pl liveLogPayload, text string) ([]string, error) {
+	pl.Text = text
+	buf, err := json.Marshal(pl)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) <= liveLogsMaxPayload || len(text) < 2 {
+		return []string{string(buf)}, nil
+	}
+	// Split after the last newline in the first half of the
+	// text, or in the middle of the text if there is none.
+	split := strings.LastIndexByte(text[:len(text)/2], '\n') + 1
+	if split == 0 {
+		split = len(text) / 2
+		// Don't split a multi-byte UTF-8 character.
+		for split > 1 && text[split]&0xc0 == 0x80 {
+			split--
+		}
+	}
+	first, err := liveLogPayloads(pl, text[:split])
+	if err != nil {
+		return nil, err
+	}
+	rest, err := liveLogPayloads(pl, text[split:])
+	if err != nil {
+		return nil, err
+	}
+	return append(first, rest...), nil
+}
+
 // NewSink subscribes to the event source. NewSink returns an
 // eventSink, whose Channel() method returns a channel: a pointer to
 // each subsequent event will be sent to that channel.
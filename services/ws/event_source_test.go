@@ -6,7 +6,9 @@ package ws
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -106,3 +108,82 @@ func (*eventSourceSuite) TestEventSource(c *check.C) {
 
 	c.Check(pges.DBHealth(), check.IsNil)
 }
+
+// Live log events published by one event source are delivered to the
+// sinks of all event sources using the same database, i.e., to
+// clients of every arvados-ws process.
+func (*eventSourceSuite) TestPublish(c *check.C) {
+	cfg := testDBConfig()
+	var sinks []eventSink
+	var sources []*pgEventSource
+	for i := 0; i < 2; i++ {
+		pges := &pgEventSource{
+			DataSource: cfg.String(),
+			QueueSize:  4,
+			Logger:     ctxlog.TestLogger(c),
+			Reg:        prometheus.NewRegistry(),
+		}
+		go pges.Run()
+		pges.WaitReady()
+		defer pges.cancel()
+		sources = append(sources, pges)
+		sinks = append(sinks, pges.NewSink())
+	}
+
+	now := time.Now().UTC()
+	text := strings.Repeat("0123456789abcdef\n", 1000)
+	sources[0].Publish(&event{logRow: &arvados.Log{
+		ObjectUUID: "zzzzz-dz642-000000000000000",
+		EventType:  "stdout",
+		EventAt:    &now,
+		Properties: map[string]interface{}{"text": text},
+	}})
+	for _, sink := range sinks {
+		received := ""
+		for len(received) < len(text) {
+			select {
+			case e := <-sink.Channel():
+				row := e.Detail()
+				c.Check(e.LogID, check.Equals, uint64(0))
+				c.Check(row.ObjectUUID, check.Equals, "zzzzz-dz642-000000000000000")
+				c.Check(row.EventType, check.Equals, "stdout")
+				c.Check(row.EventAt.Equal(now), check.Equals, true)
+				received += row.Properties["text"].(string)
+			case <-time.After(10 * time.Second):
+				c.Fatal("timed out")
+			}
+		}
+		c.Check(received, check.Equals, text)
+		sink.Stop()
+	}
+}
+
+func (*eventSourceSuite) TestLiveLogPayloads(c *check.C) {
+	pl := liveLogPayload{ObjectUUID: "zzzzz-dz642-000000000000000", EventType: "stdout", EventAt: time.Now()}
+	for _, text := range []string{
+		"short line\n",
+		strings.Repeat("0123456789abcdef\n", 1000),
+		strings.Repeat("x", 20000) + "\n",
+		strings.Repeat("\u00e9", 10000),
+		strings.Repeat("\x01", 5000),
+	} {
+		payloads, err := liveLogPayloads(pl, text)
+		c.Assert(err, check.IsNil)
+		if len(text) < 100 {
+			c.Check(payloads, check.HasLen, 1)
+		}
+		received := ""
+		for _, payload := range payloads {
+			c.Check(len(payload) <= liveLogsMaxPayload, check.Equals, true)
+			var got liveLogPayload
+			c.Assert(json.Unmarshal([]byte(payload), &got), check.IsNil)
+			c.Check(got.ObjectUUID, check.Equals, pl.ObjectUUID)
+			if strings.Contains(text[:len(text)-1], "\n") {
+				// Split at line boundaries.
+				c.Check(strings.HasSuffix(got.Text, "\n"), check.Equals, true)
+			}
+			received += got.Text
+		}
+		c.Check(received, check.Equals, text)
+	}
+}
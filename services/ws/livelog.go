@@ -0,0 +1,75 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveLogLimiter limits the rate at which each container can publish
+// live log lines (see Containers.Logging.LiveLogsMaxLinesPerSecond).
+// Each container can publish up to one second's worth of lines at
+// once, and its allowance is replenished continuously.
+//
+// Limits apply to each arvados-ws process separately.
+type liveLogLimiter struct {
+	linesPerSecond float64
+
+	mtx       sync.Mutex
+	allowance map[string]*liveLogAllowance // container UUID => allowance
+	lastPurge time.Time
+}
+
+type liveLogAllowance struct {
+	lines   float64
+	updated time.Time
+}
+
+// limit returns the leading lines of text that the container with the
+// given UUID is allowed to publish at the given time, and the number
+// of lines dropped. If linesPerSecond is zero, there is no limit.
+func (lim *liveLogLimiter) limit(uuid, text string, now time.Time) (string, int) {
+	if lim.linesPerSecond <= 0 {
+		return text, 0
+	}
+	lim.mtx.Lock()
+	defer lim.mtx.Unlock()
+	if lim.allowance == nil {
+		lim.allowance = map[string]*liveLogAllowance{}
+	}
+	if now.Sub(lim.lastPurge) > time.Minute {
+		// Forget containers that haven't published anything
+		// recently. Their allowance is full again anyway.
+		for uuid, a := range lim.allowance {
+			if now.Sub(a.updated) > time.Minute {
+				delete(lim.allowance, uuid)
+			}
+		}
+		lim.lastPurge = now
+	}
+	a := lim.allowance[uuid]
+	if a == nil {
+		a = &liveLogAllowance{lines: lim.linesPerSecond, updated: now}
+		lim.allowance[uuid] = a
+	}
+	a.lines += now.Sub(a.updated).Seconds() * lim.linesPerSecond
+	if a.lines > lim.linesPerSecond {
+		a.lines = lim.linesPerSecond
+	}
+	a.updated = now
+
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	n := len(lines)
+	if float64(n) > a.lines {
+		n = int(a.lines)
+	}
+	a.lines -= float64(n)
+	return strings.Join(lines[:n], ""), len(lines) - n
+}
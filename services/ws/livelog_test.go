@@ -0,0 +1,60 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package ws
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&liveLogLimiterSuite{})
+
+type liveLogLimiterSuite struct{}
+
+func (*liveLogLimiterSuite) TestLimit(c *check.C) {
+	lim := &liveLogLimiter{linesPerSecond: 2}
+	t0 := time.Now()
+
+	// Up to one second's worth of lines are accepted at once.
+	text, dropped := lim.limit("ctr1", "a\nb\nc\n", t0)
+	c.Check(text, check.Equals, "a\nb\n")
+	c.Check(dropped, check.Equals, 1)
+	text, dropped = lim.limit("ctr1", "d\n", t0)
+	c.Check(text, check.Equals, "")
+	c.Check(dropped, check.Equals, 1)
+
+	// Other containers have their own allowance.
+	text, dropped = lim.limit("ctr2", "x\n", t0)
+	c.Check(text, check.Equals, "x\n")
+	c.Check(dropped, check.Equals, 0)
+
+	// The allowance is replenished over time, but not beyond
+	// one second's worth.
+	text, dropped = lim.limit("ctr1", "e\nf\n", t0.Add(time.Second/2))
+	c.Check(text, check.Equals, "e\n")
+	c.Check(dropped, check.Equals, 1)
+	text, dropped = lim.limit("ctr1", "g\nh\ni\n", t0.Add(time.Hour))
+	c.Check(text, check.Equals, "g\nh\n")
+	c.Check(dropped, check.Equals, 1)
+
+	// A partial line counts as a line.
+	text, dropped = lim.limit("ctr3", "a\nb\nc", t0)
+	c.Check(text, check.Equals, "a\nb\n")
+	c.Check(dropped, check.Equals, 1)
+
+	// Idle containers are forgotten.
+	c.Check(lim.allowance["ctr3"], check.NotNil)
+	lim.limit("ctr1", "x\n", t0.Add(2*time.Hour))
+	c.Check(lim.allowance, check.HasLen, 1)
+	c.Check(lim.allowance["ctr1"], check.NotNil)
+}
+
+func (*liveLogLimiterSuite) TestNoLimit(c *check.C) {
+	lim := &liveLogLimiter{}
+	text, dropped := lim.limit("ctr1", "a\nb\nc\n", time.Now())
+	c.Check(text, check.Equals, "a\nb\nc\n")
+	c.Check(dropped, check.Equals, 0)
+}
@@ -37,6 +37,9 @@ type router struct {
 	setupOnce sync.Once
 	done      chan struct{}
 	reg       *prometheus.Registry
+
+	liveLogLimiter      *liveLogLimiter
+	liveLogLinesDropped prometheus.Counter
 }
 
 func (rtr *router) setup() {
@@ -47,6 +50,16 @@ func (rtr *router) setup() {
 		Help:      "Number of connected sockets",
 	}, []string{"version"})
 	rtr.reg.MustRegister(mSockets)
+	rtr.liveLogLimiter = &liveLogLimiter{
+		linesPerSecond: float64(rtr.cluster.Containers.Logging.LiveLogsMaxLinesPerSecond),
+	}
+	rtr.liveLogLinesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "ws",
+		Name:      "live_log_lines_dropped_total",
+		Help:      "Number of live log lines dropped because a container exceeded Containers.Logging.LiveLogsMaxLinesPerSecond",
+	})
+	rtr.reg.MustRegister(rtr.liveLogLinesDropped)
 
 	rtr.handler = &handler{
 		PingTimeout: time.Duration(rtr.cluster.API.SendTimeout),
@@ -83,7 +96,7 @@ func (rtr *router) makeServer(newSession sessionFactory, gauge prometheus.Gauge)
 
 			stats := rtr.handler.Handle(ws, logger, rtr.eventSource,
 				func(ws wsConn, sendq chan<- interface{}) (session, error) {
-					return newSession(ws, sendq, rtr.eventSource.DB(), rtr.newPermChecker(), rtr.client)
+					return newSession(ws, sendq, rtr.eventSource.DB(), rtr.publish, rtr.newPermChecker(), rtr.client)
 				})
 
 			logger.WithFields(logrus.Fields{
@@ -97,6 +110,22 @@ func (rtr *router) makeServer(newSession sessionFactory, gauge prometheus.Gauge)
 	}
 }
 
+// publish sends a live log event from a session to the event source,
+// after dropping any lines that exceed the container's rate limit.
+func (rtr *router) publish(e *event) {
+	row := e.Detail()
+	text, _ := row.Properties["text"].(string)
+	text, dropped := rtr.liveLogLimiter.limit(row.ObjectUUID, text, time.Now())
+	if dropped > 0 {
+		rtr.liveLogLinesDropped.Add(float64(dropped))
+	}
+	if text == "" {
+		return
+	}
+	row.Properties["text"] = text
+	rtr.eventSource.Publish(e)
+}
+
 func (rtr *router) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	rtr.setupOnce.Do(rtr.setup)
 	rtr.mux.ServeHTTP(resp, req)
@@ -34,4 +34,4 @@ type session interface {
 	EventMessage(*event) ([]byte, error)
 }
 
-type sessionFactory func(wsConn, chan<- interface{}, *sql.DB, permChecker, *arvados.Client) (session, error)
+type sessionFactory func(wsConn, chan<- interface{}, *sql.DB, func(*event), permChecker, *arvados.Client) (session, error)
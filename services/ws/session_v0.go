@@ -8,6 +8,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -35,6 +36,14 @@ var (
 
 	v0subscribeOK   = []byte(`{"status":200}`)
 	v0subscribeFail = []byte(`{"status":400}`)
+
+	// Event types a container's crunch-run process can publish
+	// with the "publish" method.
+	v0publishEventTypes = map[string]bool{
+		"crunch-run": true,
+		"stderr":     true,
+		"stdout":     true,
+	}
 )
 
 type v0session struct {
@@ -42,22 +51,29 @@ type v0session struct {
 	ws            wsConn
 	sendq         chan<- interface{}
 	db            *sql.DB
+	publish       func(*event)
 	permChecker   permChecker
 	subscriptions []v0subscribe
 	lastMsgID     uint64
 	log           logrus.FieldLogger
 	mtx           sync.Mutex
 	setupOnce     sync.Once
+
+	// Client's token, and the UUID of the container whose
+	// runtime token it is (once checked, see checkPublisher).
+	token        string
+	publisherFor string
 }
 
 // newSessionV0 returns a v0 session: a partial port of the Rails/puma
 // implementation, with just enough functionality to support Workbench
 // and arv-mount.
-func newSessionV0(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecker, ac *arvados.Client) (session, error) {
+func newSessionV0(ws wsConn, sendq chan<- interface{}, db *sql.DB, publish func(*event), pc permChecker, ac *arvados.Client) (session, error) {
 	sess := &v0session{
 		sendq:       sendq,
 		ws:          ws,
 		db:          db,
+		publish:     publish,
 		ac:          ac,
 		permChecker: pc,
 		log:         ctxlog.FromContext(ws.Request().Context()),
@@ -69,6 +85,7 @@ func newSessionV0(ws wsConn, sendq chan<- interface{}, db *sql.DB, pc permChecke
 		return nil, err
 	}
 	token := ws.Request().Form.Get("api_token")
+	sess.token = token
 	sess.permChecker.SetToken(token)
 	sess.log.WithField("token", token).Debug("set token")
 
@@ -88,6 +105,8 @@ func (sess *v0session) Receive(buf []byte) error {
 		sess.mtx.Unlock()
 		sub.sendOldEvents(sess)
 		return nil
+	} else if sub.Method == "publish" {
+		return sess.receivePublish(buf)
 	} else if sub.Method == "unsubscribe" {
 		sess.mtx.Lock()
 		found := false
@@ -113,6 +132,63 @@ func (sess *v0session) Receive(buf []byte) error {
 	return nil
 }
 
+// v0publish is a "publish" message, sent by crunch-run to stream log
+// lines from a running container to subscribers as they are written,
+// ahead of the (batched and rate-limited) entries in the logs table.
+type v0publish struct {
+	ObjectUUID string `json:"object_uuid"`
+	EventType  string `json:"event_type"`
+	Properties struct {
+		Text string `json:"text"`
+	} `json:"properties"`
+}
+
+func (sess *v0session) receivePublish(buf []byte) error {
+	var pub v0publish
+	if err := json.Unmarshal(buf, &pub); err != nil || !v0publishEventTypes[pub.EventType] || pub.Properties.Text == "" {
+		sess.log.WithField("EventType", pub.EventType).WithError(err).Info("invalid publish message")
+		sess.sendq <- v0subscribeFail
+		return nil
+	}
+	if err := sess.checkPublisher(pub.ObjectUUID); err != nil {
+		return err
+	}
+	now := time.Now()
+	sess.publish(&event{
+		Received: now,
+		Ready:    now,
+		logger:   sess.log,
+		logRow: &arvados.Log{
+			ObjectUUID: pub.ObjectUUID,
+			EventType:  pub.EventType,
+			EventAt:    &now,
+			CreatedAt:  &now,
+			Properties: map[string]interface{}{"text": pub.Properties.Text},
+		},
+	})
+	return nil
+}
+
+// checkPublisher returns an error unless the client's token is the
+// runtime token of the container with the given UUID, i.e., the
+// client is the crunch-run process running that container.
+func (sess *v0session) checkPublisher(uuid string) error {
+	if sess.publisherFor == "" {
+		ac := *sess.ac
+		ac.AuthToken = sess.token
+		var ctr arvados.Container
+		err := ac.RequestAndDecodeContext(sess.ws.Request().Context(), &ctr, "GET", "arvados/v1/containers/current", nil, nil)
+		if err != nil {
+			return fmt.Errorf("publish: error getting current container for token: %s", err)
+		}
+		sess.publisherFor = ctr.UUID
+	}
+	if uuid != sess.publisherFor {
+		return fmt.Errorf("publish: token is not permitted to publish events for %q", uuid)
+	}
+	return nil
+}
+
 func (sess *v0session) EventMessage(e *event) ([]byte, error) {
 	detail := e.Detail()
 	if detail == nil {
@@ -252,6 +328,12 @@ type v0subscribe struct {
 	Filters   []v0filter
 	LastLogID int64 `json:"last_log_id"`
 
+	// If true, also send log lines published by crunch-run as
+	// they are written. These events have no id or uuid, and
+	// the same lines are sent again later when they are saved
+	// in the logs table.
+	LiveLogs bool `json:"live_logs"`
+
 	funcs []func(*event) bool
 }
 
@@ -259,6 +341,9 @@ type v0filter [3]interface{}
 
 func (sub *v0subscribe) match(sess *v0session, e *event) bool {
 	log := sess.log.WithField("LogID", e.LogID)
+	if e.LogID == 0 && !sub.LiveLogs {
+		return false
+	}
 	detail := e.Detail()
 	if detail == nil {
 		log.Error("match failed, no detail")
@@ -9,6 +9,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -368,3 +370,99 @@ func (s *v0Suite) lastLogID(c *check.C) uint64 {
 	c.Assert(testDB().QueryRow(`SELECT MAX(id) FROM logs`).Scan(&lastID), check.IsNil)
 	return lastID
 }
+
+var _ = check.Suite(&v0PublishSuite{})
+
+// Runtime token of arvadostest.RunningContainerUUID
+const runningContainerToken = "v2/zzzzz-gj3su-077z32aux8dg2s2/it2gl94mgu3rbn5s2d06vzh73ns1y6cthct0tvg82qdlsxvbwk"
+
+// v0PublishSuite tests the "publish" method without a database, using
+// a stub API server to check the publisher's token.
+type v0PublishSuite struct {
+	apiStub   *httptest.Server
+	sendq     chan interface{}
+	published []*event
+}
+
+// stubConn is a wsConn whose request has the given api_token.
+type stubConn struct {
+	bytes.Buffer
+	req *http.Request
+}
+
+func (conn *stubConn) Request() *http.Request           { return conn.req }
+func (conn *stubConn) SetReadDeadline(time.Time) error  { return nil }
+func (conn *stubConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (s *v0PublishSuite) SetUpTest(c *check.C) {
+	s.apiStub = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/arvados/v1/containers/current" {
+			w.WriteHeader(http.StatusNotFound)
+		} else if strings.HasSuffix(req.Header.Get("Authorization"), " "+runningContainerToken) {
+			w.Write([]byte(`{"uuid":"` + arvadostest.RunningContainerUUID + `"}`))
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	s.sendq = make(chan interface{}, 10)
+	s.published = nil
+}
+
+func (s *v0PublishSuite) TearDownTest(c *check.C) {
+	s.apiStub.Close()
+}
+
+func (s *v0PublishSuite) newSession(c *check.C, token string) session {
+	ac := &arvados.Client{APIHost: strings.TrimPrefix(s.apiStub.URL, "https://"), Insecure: true}
+	conn := &stubConn{req: httptest.NewRequest("GET", "/websocket?api_token="+url.QueryEscape(token), nil)}
+	sess, err := newSessionV0(conn, s.sendq, nil, func(e *event) { s.published = append(s.published, e) }, newPermChecker(*ac), ac)
+	c.Assert(err, check.IsNil)
+	return sess
+}
+
+func (s *v0PublishSuite) TestPublish(c *check.C) {
+	sess := s.newSession(c, runningContainerToken)
+	err := sess.Receive([]byte(`{"method":"publish","object_uuid":"` + arvadostest.RunningContainerUUID + `","event_type":"stdout","properties":{"text":"2023-01-13T08:48:00.000000000Z hello\n"}}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.published, check.HasLen, 1)
+	e := s.published[0]
+	c.Check(e.LogID, check.Equals, uint64(0))
+	c.Check(e.Detail().ObjectUUID, check.Equals, arvadostest.RunningContainerUUID)
+	c.Check(e.Detail().EventType, check.Equals, "stdout")
+	c.Check(e.Detail().Properties["text"], check.Equals, "2023-01-13T08:48:00.000000000Z hello\n")
+
+	// Live events are only sent to subscribers that ask for them.
+	for _, sub := range []struct {
+		msg    string
+		expect bool
+	}{
+		{`{"method":"subscribe"}`, false},
+		{`{"method":"subscribe","live_logs":true}`, true},
+		{`{"method":"subscribe","live_logs":true,"filters":[["event_type","in",["stderr"]]]}`, false},
+	} {
+		subscriber := s.newSession(c, arvadostest.ActiveToken)
+		c.Check(subscriber.Receive([]byte(sub.msg)), check.IsNil)
+		c.Check(<-s.sendq, check.DeepEquals, v0subscribeOK)
+		c.Check(subscriber.Filter(e), check.Equals, sub.expect, check.Commentf("%s", sub.msg))
+	}
+
+	// Unsupported event types are rejected without closing the
+	// connection.
+	err = sess.Receive([]byte(`{"method":"publish","object_uuid":"` + arvadostest.RunningContainerUUID + `","event_type":"update","properties":{"text":"x\n"}}`))
+	c.Check(err, check.IsNil)
+	c.Check(<-s.sendq, check.DeepEquals, v0subscribeFail)
+	c.Check(s.published, check.HasLen, 1)
+
+	// Publishing events for a different container closes the
+	// connection.
+	err = sess.Receive([]byte(`{"method":"publish","object_uuid":"` + arvadostest.QueuedContainerUUID + `","event_type":"stdout","properties":{"text":"x\n"}}`))
+	c.Check(err, check.ErrorMatches, `publish: token is not permitted to publish events for "zzzzz-dz642-queuedcontainer"`)
+	c.Check(s.published, check.HasLen, 1)
+}
+
+func (s *v0PublishSuite) TestPublishNotContainerToken(c *check.C) {
+	sess := s.newSession(c, arvadostest.ActiveToken)
+	err := sess.Receive([]byte(`{"method":"publish","object_uuid":"` + arvadostest.RunningContainerUUID + `","event_type":"stdout","properties":{"text":"x\n"}}`))
+	c.Check(err, check.ErrorMatches, `publish: error getting current container for token: .*401.*`)
+	c.Check(s.published, check.HasLen, 0)
+}